@@ -0,0 +1,458 @@
+package plasma
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"unsafe"
+
+	"github.com/couchbase/nitro/skiplist"
+)
+
+// Archived ranges are loaded into an in-memory log in chunks of this size
+const archiveChunkSize = 1024 * 1024
+
+var ErrArchiveIncomplete = errors.New("archived log does not cover the recovery point")
+
+// ArchivedLog is a range of the LSS passed to Config.OnSegmentRetire along
+// with its raw bytes
+type ArchivedLog struct {
+	Range LSSRange
+	Data  io.ReaderAt
+}
+
+// archivedChange is the state of an item at a recovery point found in an
+// archived log
+type archivedChange struct {
+	k, v []byte
+	sn   uint64
+	del  bool
+	// The item is the one of the backup
+	unchanged bool
+	// Index of the page block the change was found in
+	block int
+}
+
+// archivedImage is a range of keys written as a full page by a block. Nil
+// bounds are unbounded.
+type archivedImage struct {
+	lo, hi []byte
+	block  int
+}
+
+// archivedImages tracks the last block which wrote each range of keys as a
+// full page, as sorted and disjoint ranges. A full page only keeps the
+// versions still needed, so the items missing from it have been deleted.
+type archivedImages []archivedImage
+
+func (a archivedImages) add(img archivedImage) archivedImages {
+	// Ranges overlapping with the image are a[i:j]
+	i := sort.Search(len(a), func(i int) bool {
+		return a[i].hi == nil || img.lo == nil || bytes.Compare(a[i].hi, img.lo) > 0
+	})
+
+	j := i
+	for j < len(a) && (img.hi == nil || a[j].lo == nil || bytes.Compare(a[j].lo, img.hi) < 0) {
+		j++
+	}
+
+	ranges := append([]archivedImage(nil), a[:i]...)
+	if i < j && img.lo != nil && (a[i].lo == nil || bytes.Compare(a[i].lo, img.lo) < 0) {
+		ranges = append(ranges, archivedImage{lo: a[i].lo, hi: img.lo, block: a[i].block})
+	}
+
+	ranges = append(ranges, img)
+	if i < j && img.hi != nil && (a[j-1].hi == nil || bytes.Compare(a[j-1].hi, img.hi) > 0) {
+		ranges = append(ranges, archivedImage{lo: img.hi, hi: a[j-1].hi, block: a[j-1].block})
+	}
+
+	return append(ranges, a[j:]...)
+}
+
+// block returns the last block which wrote the key as part of a full page
+func (a archivedImages) block(k []byte) int {
+	i := sort.Search(len(a), func(i int) bool {
+		return a[i].hi == nil || bytes.Compare(a[i].hi, k) > 0
+	})
+
+	if i < len(a) && (a[i].lo == nil || bytes.Compare(a[i].lo, k) <= 0) {
+		return a[i].block
+	}
+
+	return 0
+}
+
+// archivedState is the state at a recovery point found in an archived log,
+// relative to a backup
+type archivedState struct {
+	// Changes of the items, sorted by key
+	changes []archivedChange
+	images  archivedImages
+}
+
+// deleted returns whether a key without changes has been deleted
+func (st *archivedState) deleted(k []byte) bool {
+	return st != nil && st.images.block(k) > 0
+}
+
+// visitArchivedLogs calls callb for the blocks of the archived ranges in
+// log order. The ranges have to be contiguous.
+func visitArchivedLogs(cfg Config, logs []ArchivedLog, callb LSSBlockCallback, buf []byte) error {
+	logs = append([]ArchivedLog(nil), logs...)
+	sort.Slice(logs, func(i, j int) bool {
+		return logs[i].Range.Start < logs[j].Range.Start
+	})
+
+	for i := 1; i < len(logs); i++ {
+		if prev := logs[i-1].Range; logs[i].Range.Start != prev.End {
+			return fmt.Errorf("range [%d, %d) is missing: %w", prev.End, logs[i].Range.Start,
+				ErrArchiveIncomplete)
+		}
+	}
+
+	ml := &memLog{segSize: memLogMaxSegmentSize, segs: make(map[int64][]byte)}
+	lss, err := newLSStore("archive", memLogMaxSegmentSize, archiveChunkSize, 2, false, 0, lssOptions{
+		key:    cfg.EncryptionKey,
+		logger: newTaggedLogger(cfg.Logger, "archive", "lss"),
+		factory: func(string, LogOptions) (Log, error) {
+			return ml, nil
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer lss.Close()
+
+	chunk := make([]byte, archiveChunkSize)
+	for _, l := range logs {
+		start, end := int64(l.Range.Start), int64(l.Range.End)
+		ml.reset(start)
+		for off := start; off < end; {
+			n := minInt64(archiveChunkSize, end-off)
+			if m, err := l.Data.ReadAt(chunk[:n], off-start); err != nil && !(err == io.EOF && int64(m) == n) {
+				return err
+			}
+
+			ml.Append(chunk[:n])
+			off += n
+		}
+
+		if err := lss.VisitorRange(l.Range.Start, l.Range.End, callb, buf); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ArchivedRecoveryPoints returns the recovery points recorded last by the
+// archived log, which can be restored using RestoreToPoint. The config
+// has to be the one of the instance which wrote the log.
+func ArchivedRecoveryPoints(cfg Config, logs []ArchivedLog) ([]*RecoveryPoint, error) {
+	var rps []*RecoveryPoint
+	callb := func(off LSSOffset, bs []byte) (bool, error) {
+		if getLSSBlockType(bs) == lssRecoveryPoints {
+			_, rps = unmarshalRPs(bs[lssBlockTypeSize:])
+		}
+		return true, nil
+	}
+
+	if err := visitArchivedLogs(cfg, logs, callb, make([]byte, maxPageEncodedSize)); err != nil {
+		return nil, err
+	}
+
+	return rps, nil
+}
+
+// RestoreToPoint creates an instance with the given config in the state
+// of a recovery point, which has been created after a full backup taken by
+// Backup. The items of the backup are restored along with the changes up
+// to the recovery point found in the archived log.
+//
+// The archived ranges have to be contiguous, starting from the tail of the
+// log when the backup was taken up to past the creation of the recovery
+// point. Since the cleaner only archives the ranges it discards, the rest
+// of the log has to be archived separately. Values stored in a value log
+// cannot be restored. The recovery points up to the restored one are
+// recreated like Restore does.
+func RestoreToPoint(cfg Config, backup io.Reader, logs []ArchivedLog,
+	target *RecoveryPoint) (*Plasma, error) {
+
+	br, since, err := newBackupReader(backup, cfg.MaxItemSize)
+	if err != nil {
+		return nil, err
+	} else if since != 0 {
+		return nil, ErrInvalidBackup
+	} else if target.sn < br.sn {
+		return nil, fmt.Errorf("recovery point precedes the backup: %w", ErrArchiveIncomplete)
+	}
+
+	b, err := NewBuilder(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	st, rps, err := b.scanArchivedLogs(logs, br.sn, target.sn)
+	if err == nil {
+		_, err = b.restoreBackup(br, st)
+	}
+
+	if err != nil {
+		b.Abort()
+		return nil, err
+	}
+
+	s, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	s.restoreRecoveryPoints(rps)
+	return s, nil
+}
+
+// scanArchivedLogs returns the state of the items at the recovery point of
+// the until sequence number relative to a backup of the since sequence
+// number, along with the recovery points up to it
+func (b *Builder) scanArchivedLogs(logs []ArchivedLog, since, until uint64) (*archivedState,
+	[]*RecoveryPoint, error) {
+
+	var rollbacks []rollbackSn
+	var rps []*RecoveryPoint
+	var rpVersion uint16
+	found, covered := false, since == until
+
+	// The rollbacks have to be known before picking the versions
+	callb := func(off LSSOffset, bs []byte) (bool, error) {
+		switch typ := getLSSBlockType(bs); typ {
+		case lssPageData, lssPageReloc, lssPageUpdate:
+			err := b.walkArchivedPage(off, bs, func(pw *pageWalker, _, _ []byte) error {
+				if pw.Op() == opRollbackDelta {
+					start, end := pw.RollbackInfo()
+					rb := rollbackSn{start: start, end: end}
+					for _, r := range rollbacks {
+						if r == rb {
+							return nil
+						}
+					}
+					rollbacks = append(rollbacks, rb)
+				}
+				return nil
+			})
+			if err != nil {
+				return false, err
+			}
+		case lssRecoveryPoints:
+			// The recovery point is recorded before the pages are
+			// persisted and again once they have been
+			version, list := unmarshalRPs(bs[lssBlockTypeSize:])
+			for _, rp := range list {
+				if rp.sn != until {
+					continue
+				}
+
+				if !found {
+					found, rpVersion = true, version
+				} else if version != rpVersion {
+					covered = true
+				}
+
+				rps = rps[:0]
+				for _, rp := range list {
+					if rp.sn <= until {
+						rps = append(rps, rp)
+					}
+				}
+			}
+		}
+
+		return true, nil
+	}
+
+	buf := b.GetBuffer(bufCleaner)
+	if err := visitArchivedLogs(b.Config, logs, callb, buf); err != nil {
+		return nil, nil, err
+	} else if !covered {
+		return nil, nil, ErrArchiveIncomplete
+	}
+
+	// Rollbacks made before the recovery point was created discard the
+	// versions in their range
+	var applied []rollbackSn
+	for _, rb := range rollbacks {
+		if rb.end < until {
+			if rb.start <= since {
+				return nil, nil, fmt.Errorf("log was rolled back before the backup: %w", ErrInvalidBackup)
+			}
+			applied = append(applied, rb)
+		}
+	}
+
+	sc := &archiveScan{
+		since:     since,
+		until:     until,
+		rollbacks: applied,
+		changes:   make(map[string]*archivedChange),
+	}
+
+	callb = func(off LSSOffset, bs []byte) (bool, error) {
+		switch typ := getLSSBlockType(bs); typ {
+		case lssPageData, lssPageReloc, lssPageUpdate:
+			sc.block++
+			full := typ != lssPageUpdate
+			if err := b.walkArchivedPage(off, bs, sc.collect); err != nil {
+				return false, err
+			}
+			sc.apply(full)
+		}
+
+		return true, nil
+	}
+
+	if err := visitArchivedLogs(b.Config, logs, callb, buf); err != nil {
+		return nil, nil, err
+	}
+
+	st := &archivedState{images: sc.images}
+	for _, c := range sc.changes {
+		// Items missing from a later full page have been deleted
+		if c.block >= sc.images.block(c.k) {
+			st.changes = append(st.changes, *c)
+		}
+	}
+
+	sort.Slice(st.changes, func(i, j int) bool {
+		return bytes.Compare(st.changes[i].k, st.changes[j].k) < 0
+	})
+
+	return st, rps, nil
+}
+
+// walkArchivedPage calls callb for the deltas of a page block along with
+// the bounds of the keys of the page
+func (b *Builder) walkArchivedPage(off LSSOffset, bs []byte,
+	callb func(pw *pageWalker, lo, hi []byte) error) error {
+
+	data, err := b.decompressPageBlock(bs, b.wCtx)
+	if err != nil {
+		return newLSSError("restore", off, err)
+	}
+
+	pg := newPage2(nil, nil, b.wCtx, b.Plasma.storeCtx, new(allocCtx)).(*page)
+	pg.Unmarshal(data, b.wCtx)
+	defer func() {
+		allocs, _, _, _, _ := pg.GetAllocOps()
+		b.discardDeltas(allocs)
+	}()
+
+	var lo, hi []byte
+	if pg.MinItem() != skiplist.MinItem {
+		lo = (*item)(pg.MinItem()).Key()
+	}
+
+	if pg.MaxItem() != skiplist.MaxItem {
+		hi = (*item)(pg.MaxItem()).Key()
+	}
+
+	pw := newPgDeltaWalker(pg.head, b.wCtx)
+	defer pw.Close()
+	for ; !pw.End(); pw.Next() {
+		if err := callb(&pw, lo, hi); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// archiveScan picks the state of the items at a recovery point from the
+// page blocks of an archived log
+type archiveScan struct {
+	since, until uint64
+	rollbacks    []rollbackSn
+
+	block   int
+	lo, hi  []byte
+	found   map[string]*archivedChange
+	changes map[string]*archivedChange
+	images  archivedImages
+}
+
+// collect adds the latest version of the items of the current block up to
+// the recovery point
+func (sc *archiveScan) collect(pw *pageWalker, lo, hi []byte) error {
+	if sc.found == nil {
+		sc.found = make(map[string]*archivedChange)
+		sc.lo, sc.hi = append([]byte(nil), lo...), append([]byte(nil), hi...)
+	}
+
+	add := func(ptr unsafe.Pointer) error {
+		itm := (*item)(ptr)
+		k, sn := itm.Key(), itm.Sn()
+		if sn > sc.until || (lo != nil && bytes.Compare(k, lo) < 0) ||
+			(hi != nil && bytes.Compare(k, hi) >= 0) {
+			return nil
+		}
+
+		for _, rb := range sc.rollbacks {
+			if sn >= rb.start && sn <= rb.end {
+				return nil
+			}
+		}
+
+		// The versions of an item are walked from the latest one
+		if c, ok := sc.found[string(k)]; ok && c.sn >= sn {
+			return nil
+		}
+
+		c := &archivedChange{
+			k:         append([]byte(nil), k...),
+			sn:        sn,
+			del:       !itm.IsInsert(),
+			unchanged: sn <= sc.since,
+			block:     sc.block,
+		}
+
+		if !c.del && !c.unchanged {
+			if itm.IsValuePtr() {
+				return ErrValueLog
+			} else if itm.HasValue() {
+				c.v = append([]byte(nil), itm.Value()...)
+			}
+		}
+
+		sc.found[string(c.k)] = c
+		return nil
+	}
+
+	switch pw.Op() {
+	case opInsertDelta:
+		return add(pw.Item())
+	case opBasePage:
+		for _, itm := range pw.BaseItems() {
+			if err := add(itm); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// apply merges the items collected from the current block. A full page
+// replaces the state of its range of keys.
+func (sc *archiveScan) apply(full bool) {
+	for k, c := range sc.found {
+		if e, ok := sc.changes[k]; full || !ok || c.sn >= e.sn {
+			sc.changes[k] = c
+		}
+	}
+
+	if full {
+		sc.images = sc.images.add(archivedImage{lo: sc.lo, hi: sc.hi, block: sc.block})
+	}
+
+	sc.found = nil
+}
@@ -0,0 +1,113 @@
+package plasma
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestRestoreToPoint(t *testing.T) {
+	os.RemoveAll("teststore.pitr")
+	defer os.RemoveAll("teststore.pitr")
+
+	var logs []ArchivedLog
+	cfg := testSnCfg
+	cfg.File = "teststore.pitr"
+	cfg.AutoLSSCleaning = false
+	cfg.OnSegmentRetire = func(r LSSRange, data io.Reader) error {
+		bs, err := ioutil.ReadAll(data)
+		logs = append(logs, ArchivedLog{Range: r, Data: bytes.NewReader(bs)})
+		return err
+	}
+	s := newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	n := 20000
+	w := s.NewWriter()
+	for i := 0; i < n; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte(fmt.Sprintf("val-%10d", i)))
+	}
+
+	var backup bytes.Buffer
+	snap := s.NewSnapshot()
+	if err := s.Backup(&backup, snap); err != nil {
+		t.Fatal(err)
+	}
+	snap.Close()
+
+	for i := 0; i < n+1000; i++ {
+		k := []byte(fmt.Sprintf("key-%10d", i))
+		if i >= n && i%2 == 0 {
+			w.InsertKV(k, []byte(fmt.Sprintf("new-%10d", i)))
+		} else if i%10 == 0 {
+			w.DeleteKV(k)
+		} else if i%2 == 0 {
+			w.DeleteKV(k)
+			w.InsertKV(k, []byte(fmt.Sprintf("new-%10d", i)))
+		}
+	}
+	s.CreateNamedRecoveryPoint(s.NewSnapshot(), "rp-1", nil)
+
+	// Changes after the recovery point
+	for i := 0; i < n; i++ {
+		k := []byte(fmt.Sprintf("key-%10d", i))
+		w.DeleteKV(k)
+		w.InsertKV(k, []byte("later"))
+	}
+	s.CreateNamedRecoveryPoint(s.NewSnapshot(), "rp-2", nil)
+
+	for i := 0; i < 2; i++ {
+		if err := s.CleanLSS(func() bool { return true }); err != nil {
+			t.Fatal(err)
+		}
+		s.lss.Commit()
+	}
+
+	rps, err := ArchivedRecoveryPoints(cfg, logs)
+	if err != nil || len(rps) != 2 || rps[0].Name() != "rp-1" {
+		t.Fatalf("expected the recovery points to be archived, got %d (err=%v)", len(rps), err)
+	}
+
+	rcfg := testSnCfg
+	rcfg.File = "teststore.pitr.restore"
+	os.RemoveAll(rcfg.File)
+	defer os.RemoveAll(rcfg.File)
+
+	if _, err := RestoreToPoint(rcfg, bytes.NewReader(backup.Bytes()), logs[:1], rps[0]); err != ErrArchiveIncomplete {
+		t.Errorf("expected %v, got %v", ErrArchiveIncomplete, err)
+	}
+
+	os.RemoveAll(rcfg.File)
+	r, err := RestoreToPoint(rcfg, bytes.NewReader(backup.Bytes()), logs, rps[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	rw := r.NewWriter()
+	for i := 0; i < n+1000; i++ {
+		k := fmt.Sprintf("key-%10d", i)
+		v, err := rw.LookupKV([]byte(k))
+		switch {
+		case (i < n && i%10 == 0) || (i >= n && i%2 == 1):
+			if err != ErrItemNotFound {
+				t.Fatalf("%s: expected no item, got %q (err=%v)", k, v, err)
+			}
+		case i%2 == 0:
+			if string(v) != fmt.Sprintf("new-%10d", i) {
+				t.Fatalf("%s: unexpected value %q (err=%v)", k, v, err)
+			}
+		default:
+			if string(v) != fmt.Sprintf("val-%10d", i) {
+				t.Fatalf("%s: unexpected value %q (err=%v)", k, v, err)
+			}
+		}
+	}
+
+	if rps := r.GetRecoveryPoints(); len(rps) != 1 || rps[0].Name() != "rp-1" {
+		t.Errorf("expected rp-1 to be recreated, got %d recovery points", len(rps))
+	}
+}
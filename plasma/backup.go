@@ -0,0 +1,665 @@
+package plasma
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// A backup starts with a header holding the magic, the format version, the
+// sequence number of the snapshot and the sequence number of the recovery
+// point an incremental backup is based on. It is followed by the key value
+// pairs visible in the snapshot in key order and the recovery points of the
+// instance. Incremental backups only hold the items changed after the base
+// sequence number, along with the keys deleted since then. They start with
+// the creation time and the name of the base recovery point and end with
+// the recovery points created after it. The crc32 of all the preceding
+// bytes forms the trailer.
+
+const (
+	backupMagic   uint32 = 0x504c4246
+	backupVersion uint16 = 1
+)
+
+const (
+	backupKV byte = iota + 1
+	backupDelete
+	backupRecoveryPoints
+	backupEnd
+	backupBase
+)
+
+var restoreProgressInterval = time.Second * 10
+
+var ErrCorruptBackup = fmt.Errorf("Backup is corrupted: %w", ErrChecksum)
+var ErrInvalidBackup = errors.New("invalid backup format")
+var ErrBackupBaseNotFound = errors.New("base recovery point of the backup not found")
+
+type backupWriter struct {
+	w   *bufio.Writer
+	crc hash.Hash32
+	buf [10]byte
+	err error
+}
+
+func (bw *backupWriter) write(bs []byte) {
+	if bw.err == nil {
+		bw.crc.Write(bs)
+		_, bw.err = bw.w.Write(bs)
+	}
+}
+
+func (bw *backupWriter) writeUint(v uint64, sz int) {
+	switch sz {
+	case 1:
+		bw.buf[0] = byte(v)
+	case 2:
+		binary.BigEndian.PutUint16(bw.buf[:2], uint16(v))
+	case 4:
+		binary.BigEndian.PutUint32(bw.buf[:4], uint32(v))
+	case 8:
+		binary.BigEndian.PutUint64(bw.buf[:8], v)
+	}
+	bw.write(bw.buf[:sz])
+}
+
+// Backup streams the items visible in the snapshot along with the recovery
+// points created up to the snapshot to w. Writers are not blocked while the
+// backup is taken.
+func (s *Plasma) Backup(w io.Writer, snap *Snapshot) error {
+	var rps []*RecoveryPoint
+	for _, rp := range s.ListRecoveryPoints() {
+		if rp.sn <= snap.sn {
+			rps = append(rps, rp)
+		}
+	}
+
+	return s.writeBackup(w, snap, nil, rps)
+}
+
+// BackupSince streams an incremental backup holding the changes made after
+// the recovery point up to the current snapshot to w. It can be applied
+// using ApplyBackup to an instance restored from a backup which includes
+// the recovery point.
+func (s *Plasma) BackupSince(rp *RecoveryPoint, w io.Writer) error {
+	snap := s.NewSnapshot()
+	defer snap.Close()
+
+	var rps []*RecoveryPoint
+	for _, r := range s.ListRecoveryPoints() {
+		if r.sn > rp.sn && r.sn <= snap.sn {
+			rps = append(rps, r)
+		}
+	}
+
+	return s.writeBackup(w, snap, rp, rps)
+}
+
+// writeBackup writes a full backup of the snapshot, or an incremental one
+// if base is set
+func (s *Plasma) writeBackup(w io.Writer, snap *Snapshot, base *RecoveryPoint,
+	rps []*RecoveryPoint) error {
+	bw := &backupWriter{
+		w:   bufio.NewWriter(w),
+		crc: crc32.NewIEEE(),
+	}
+
+	var since uint64
+	if base != nil {
+		since = base.sn
+	}
+
+	bw.writeUint(uint64(backupMagic), 4)
+	bw.writeUint(uint64(backupVersion), 2)
+	bw.writeUint(snap.sn, 8)
+	bw.writeUint(since, 8)
+
+	if base != nil {
+		bw.writeUint(uint64(backupBase), 1)
+		bw.writeUint(uint64(base.created.UnixNano()), 8)
+		bw.writeUint(uint64(len(base.name)), 2)
+		bw.write([]byte(base.name))
+	}
+
+	itr := snap.NewIterator()
+	if since > 0 {
+		itr = snap.newChangeIterator(since)
+	}
+
+	for itr.SeekFirst(); itr.Valid() && bw.err == nil; itr.Next() {
+		itm := (*item)(itr.Get())
+		k := itm.Key()
+		if !itm.IsInsert() {
+			bw.writeUint(uint64(backupDelete), 1)
+			bw.writeUint(uint64(len(k)), 4)
+			bw.write(k)
+			continue
+		}
+
+		var v []byte
+		if itm.HasValue() {
+			if v, bw.err = snap.db.readValue(itm); bw.err != nil {
+				break
+			}
+		}
+
+		bw.writeUint(uint64(backupKV), 1)
+		bw.writeUint(uint64(len(k)), 4)
+		bw.writeUint(uint64(len(v)), 4)
+		bw.write(k)
+		bw.write(v)
+	}
+	itr.Close()
+
+	bs := marshalRPs(rps, 0)
+	bw.writeUint(uint64(backupRecoveryPoints), 1)
+	bw.writeUint(uint64(len(bs)), 4)
+	bw.write(bs)
+	bw.writeUint(uint64(backupEnd), 1)
+
+	if bw.err != nil {
+		return bw.err
+	}
+
+	binary.BigEndian.PutUint32(bw.buf[:4], bw.crc.Sum32())
+	if _, err := bw.w.Write(bw.buf[:4]); err != nil {
+		return err
+	}
+
+	return bw.w.Flush()
+}
+
+type backupReader struct {
+	r   io.Reader
+	crc hash.Hash32
+	buf []byte
+	// Sequence number of the snapshot of the backup
+	sn uint64
+	// Records beyond this size are rejected before they are read
+	maxKVSize int
+}
+
+// newBackupReader validates the header of a backup and returns the base
+// sequence number of an incremental backup. Items larger than maxItemSize
+// are accepted up to maxKVSize, which is the item size limit of the config.
+func newBackupReader(r io.Reader, maxKVSize int) (*backupReader, uint64, error) {
+	if maxKVSize < maxItemSize {
+		maxKVSize = maxItemSize
+	}
+
+	br := &backupReader{
+		r:         bufio.NewReader(r),
+		crc:       crc32.NewIEEE(),
+		maxKVSize: maxKVSize,
+	}
+
+	if magic, err := br.readUint(4); err != nil {
+		return nil, 0, err
+	} else if uint32(magic) != backupMagic {
+		return nil, 0, ErrInvalidBackup
+	}
+
+	if version, err := br.readUint(2); err != nil {
+		return nil, 0, err
+	} else if uint16(version) != backupVersion {
+		return nil, 0, ErrInvalidBackup
+	}
+
+	var err error
+	if br.sn, err = br.readUint(8); err != nil {
+		return nil, 0, err
+	}
+
+	since, err := br.readUint(8)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return br, since, nil
+}
+
+// verifyTrailer checks the checksum of the backup read so far
+func (br *backupReader) verifyTrailer() error {
+	sum := br.crc.Sum32()
+	bs := make([]byte, 4)
+	if _, err := io.ReadFull(br.r, bs); err != nil || binary.BigEndian.Uint32(bs) != sum {
+		return ErrCorruptBackup
+	}
+
+	return nil
+}
+
+// readKV reads a key value record. Keys of delete records have no value.
+func (br *backupReader) readKV(del bool) (k, v []byte, err error) {
+	kl, err := br.readUint(4)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var vl uint64
+	if !del {
+		if vl, err = br.readUint(4); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if kl > maxKeySize || kl+vl > uint64(br.maxKVSize) {
+		return nil, nil, ErrCorruptBackup
+	}
+
+	bs, err := br.read(int(kl + vl))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if vl > 0 {
+		v = bs[kl:]
+	}
+
+	return bs[:kl], v, nil
+}
+
+// readRecoveryPoints reads the encoded recovery points of a backup. The
+// length is bounded like that of a page before the record is read.
+func (br *backupReader) readRecoveryPoints() ([]byte, error) {
+	l, err := br.readUint(4)
+	if err != nil {
+		return nil, err
+	} else if l > uint64(maxPageEncodedSize) {
+		return nil, ErrCorruptBackup
+	}
+
+	return br.read(int(l))
+}
+
+func (br *backupReader) read(n int) ([]byte, error) {
+	if cap(br.buf) < n {
+		br.buf = make([]byte, n)
+	}
+
+	bs := br.buf[:n]
+	if _, err := io.ReadFull(br.r, bs); err != nil {
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return nil, ErrCorruptBackup
+		}
+		return nil, err
+	}
+
+	br.crc.Write(bs)
+	return bs, nil
+}
+
+func (br *backupReader) readUint(sz int) (uint64, error) {
+	bs, err := br.read(sz)
+	if err != nil {
+		return 0, err
+	}
+
+	switch sz {
+	case 1:
+		return uint64(bs[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(bs)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(bs)), nil
+	}
+	return binary.BigEndian.Uint64(bs), nil
+}
+
+// Restore creates an instance with the given config from a backup taken
+// by Backup. The config must have snapshots enabled and must not refer to
+// an existing instance. The items are restored as part of the initial
+// snapshot of the new instance. Since older versions of the items are not
+// part of a backup, the recovery points are recreated with their names and
+// metadata for the restored snapshot. Progress is reported to the logger
+// of the config.
+func Restore(cfg Config, r io.Reader) (*Plasma, error) {
+	br, since, err := newBackupReader(r, cfg.MaxItemSize)
+	if err != nil {
+		return nil, err
+	} else if since != 0 {
+		return nil, ErrInvalidBackup
+	}
+
+	b, err := NewBuilder(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	rps, err := b.restoreBackup(br, nil)
+	if err != nil {
+		b.Abort()
+		return nil, err
+	}
+
+	s, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	s.restoreRecoveryPoints(rps)
+	return s, nil
+}
+
+// restoreBackup adds the items of a backup to the builder, along with the
+// changes made to them found in an archived log if any
+func (b *Builder) restoreBackup(br *backupReader, st *archivedState) ([]*RecoveryPoint, error) {
+	var rps []byte
+	var items, size int64
+
+	log := b.logger("restore")
+	last := time.Now()
+	add := func(k, v []byte) error {
+		// Keys of a valid backup are sorted and within limits
+		if err := b.AddKV(k, v); err != nil {
+			return ErrCorruptBackup
+		}
+
+		items++
+		size += int64(len(k) + len(v))
+		if time.Since(last) > restoreProgressInterval {
+			log.Infof("restored %d items (%d bytes)", items, size)
+			last = time.Now()
+		}
+		return nil
+	}
+
+	var changes []archivedChange
+	if st != nil {
+		changes = st.changes
+	}
+
+	// addChanges adds the changes of the keys up to k and returns the one
+	// of k if any
+	addChanges := func(k []byte) (*archivedChange, error) {
+		var found *archivedChange
+		for len(changes) > 0 && (k == nil || bytes.Compare(changes[0].k, k) <= 0) {
+			c := &changes[0]
+			changes = changes[1:]
+			if k != nil && bytes.Equal(c.k, k) {
+				found = c
+			}
+
+			if !c.del && !c.unchanged {
+				if err := add(c.k, c.v); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		return found, nil
+	}
+
+	for {
+		typ, err := br.readUint(1)
+		if err != nil {
+			return nil, err
+		}
+
+		switch byte(typ) {
+		case backupKV:
+			k, v, err := br.readKV(false)
+			if err != nil {
+				return nil, err
+			}
+
+			if c, err := addChanges(k); err != nil {
+				return nil, err
+			} else if (c == nil && !st.deleted(k)) || (c != nil && c.unchanged) {
+				if err := add(k, v); err != nil {
+					return nil, err
+				}
+			}
+		case backupRecoveryPoints:
+			bs, err := br.readRecoveryPoints()
+			if err != nil {
+				return nil, err
+			}
+			rps = append([]byte(nil), bs...)
+		case backupEnd:
+			if err := br.verifyTrailer(); err != nil {
+				return nil, err
+			}
+
+			if _, err := addChanges(nil); err != nil {
+				return nil, err
+			}
+
+			log.Infof("completed... restored %d items (%d bytes)", items, size)
+			if rps == nil {
+				return nil, nil
+			}
+
+			_, restored := unmarshalRPs(rps)
+			return restored, nil
+		default:
+			return nil, ErrCorruptBackup
+		}
+	}
+}
+
+// restoreRecoveryPoints recreates the recovery points of a backup for the
+// restored snapshot, after the recovery points of the instance
+func (s *Plasma) restoreRecoveryPoints(rps []*RecoveryPoint) {
+	if len(rps) == 0 || !s.shouldPersist {
+		return
+	}
+
+	snap := s.NewSnapshot()
+	for _, rp := range rps {
+		rp.sn = snap.sn
+		rp.count, rp.keySum, rp.hasKeySum = snap.count, snap.keySum, true
+		rp.offset, rp.hasOffset = snap.offset, true
+	}
+	snap.Close()
+
+	s.mvcc.Lock()
+	rps = append(append([]*RecoveryPoint(nil), s.recoveryPoints...), rps...)
+	rps = s.pruneRecoveryPoints(rps, time.Now())
+	s.updateRecoveryPoints(rps)
+	s.updateRPSns(rps)
+	s.mvcc.Unlock()
+
+	s.lss.Sync(true)
+}
+
+// ApplyBackup applies an incremental backup taken by BackupSince. The base
+// recovery point of the backup has to be one of the recovery points of
+// the instance, which are restored along with a backup. The changes are
+// applied as they are read and are rolled back if the backup cannot be
+// applied completely, hence the instance must not be written otherwise
+// meanwhile. The recovery points created after the base are recreated
+// for the resulting snapshot.
+func (s *Plasma) ApplyBackup(r io.Reader) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+
+	br, since, err := newBackupReader(r, s.MaxItemSize)
+	if err != nil {
+		return err
+	} else if since == 0 {
+		return ErrInvalidBackup
+	}
+
+	if err := s.checkBackupBase(br); err != nil {
+		return err
+	}
+
+	var rp *RecoveryPoint
+	if s.shouldPersist {
+		rp = s.addRollbackPoint()
+	}
+
+	rps, err := s.ingestBackup(br, false)
+	if err != nil && rp != nil {
+		if snap, rerr := s.Rollback(rp); rerr != nil {
+			err = rerr
+		} else {
+			snap.Close()
+		}
+	}
+
+	if rp != nil {
+		s.removeRollbackPoint(rp)
+	}
+
+	if err == nil {
+		s.restoreRecoveryPoints(rps)
+	}
+
+	return err
+}
+
+// checkBackupBase verifies that the base recovery point of an incremental
+// backup is a recovery point of the instance
+func (s *Plasma) checkBackupBase(br *backupReader) error {
+	if typ, err := br.readUint(1); err != nil {
+		return err
+	} else if byte(typ) != backupBase {
+		return ErrCorruptBackup
+	}
+
+	created, err := br.readUint(8)
+	if err != nil {
+		return err
+	}
+
+	l, err := br.readUint(2)
+	if err != nil {
+		return err
+	}
+
+	name, err := br.read(int(l))
+	if err != nil {
+		return err
+	}
+
+	for _, rp := range s.ListRecoveryPoints() {
+		if !rp.created.IsZero() && uint64(rp.created.UnixNano()) == created && rp.name == string(name) {
+			return nil
+		}
+	}
+
+	return ErrBackupBaseNotFound
+}
+
+// addRollbackPoint adds a recovery point for the current snapshot, which
+// is not subject to the retention limits
+func (s *Plasma) addRollbackPoint() *RecoveryPoint {
+	snap := s.NewSnapshot()
+	defer snap.Close()
+
+	rp := &RecoveryPoint{
+		sn:        snap.sn,
+		count:     snap.count,
+		keySum:    snap.keySum,
+		hasKeySum: true,
+		created:   time.Now(),
+		offset:    snap.offset,
+		hasOffset: true,
+	}
+
+	s.mvcc.Lock()
+	defer s.mvcc.Unlock()
+
+	rps := append(append([]*RecoveryPoint(nil), s.recoveryPoints...), rp)
+	s.updateRecoveryPoints(rps)
+	s.updateRPSns(rps)
+	return rp
+}
+
+func (s *Plasma) removeRollbackPoint(rmRP *RecoveryPoint) {
+	s.mvcc.Lock()
+	defer s.mvcc.Unlock()
+
+	var rps []*RecoveryPoint
+	for _, rp := range s.recoveryPoints {
+		if rp != rmRP {
+			rps = append(rps, rp)
+		}
+	}
+
+	s.updateRecoveryPoints(rps)
+	s.updateRPSns(rps)
+}
+
+// ingestBackup applies the records of a backup as they are read, which
+// replace the items of their keys. The keys have to be in increasing order
+// if sorted is set. The recovery points of the backup are returned.
+func (s *Plasma) ingestBackup(br *backupReader, sorted bool) ([]*RecoveryPoint, error) {
+	s.ingestLock.Lock()
+	defer s.ingestLock.Unlock()
+
+	var rps, last []byte
+	for n := 0; ; n++ {
+		typ, err := br.readUint(1)
+		if err != nil {
+			return nil, err
+		}
+
+		switch byte(typ) {
+		case backupKV, backupDelete:
+			del := byte(typ) == backupDelete
+			k, v, err := br.readKV(del)
+			if err != nil {
+				return nil, err
+			}
+
+			if sorted {
+				if n > 0 && bytes.Compare(k, last) <= 0 {
+					return nil, ErrInvalidRun
+				}
+				last = append(last[:0], k...)
+			}
+
+			if err := s.applyMutation(k, v, del); err != nil {
+				return nil, err
+			}
+		case backupRecoveryPoints:
+			bs, err := br.readRecoveryPoints()
+			if err != nil {
+				return nil, err
+			}
+			rps = append(rps[:0], bs...)
+		case backupEnd:
+			if err := br.verifyTrailer(); err != nil {
+				return nil, err
+			} else if rps == nil {
+				return nil, nil
+			}
+
+			_, restored := unmarshalRPs(rps)
+			return restored, nil
+		default:
+			return nil, ErrCorruptBackup
+		}
+	}
+}
+
+// applyMutation replaces the item of a key by deleting the current version
+// first. It has to be called with ingestLock held.
+func (s *Plasma) applyMutation(k, v []byte, del bool) error {
+	if s.ingestWriter == nil {
+		s.ingestWriter = s.NewWriter()
+	}
+
+	w := s.ingestWriter
+	if _, err := w.LookupKV(k); err == nil || err == ErrItemNoValue {
+		if err := w.DeleteKV(k); err != nil {
+			return err
+		}
+	}
+
+	if !del {
+		return w.InsertKV(k, v)
+	}
+
+	return nil
+}
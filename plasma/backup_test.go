@@ -0,0 +1,247 @@
+package plasma
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestMVCCBackup(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testSnCfg)
+	defer s.Close()
+
+	n := 10000
+	w := s.NewWriter()
+	for i := 0; i < n; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte(fmt.Sprintf("val-%10d", i)))
+	}
+
+	for i := 0; i < n; i += 2 {
+		w.DeleteKV([]byte(fmt.Sprintf("key-%10d", i)))
+	}
+
+	s.CreateNamedRecoveryPoint(s.NewSnapshot(), "rp-1", []byte("meta"))
+	snap := s.NewSnapshot()
+
+	// Not part of the snapshot
+	for i := 0; i < n; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte("updated"))
+	}
+
+	var buf bytes.Buffer
+	if err := s.Backup(&buf, snap); err != nil {
+		t.Fatal(err)
+	}
+	snap.Close()
+
+	cfg := testSnCfg
+	cfg.File = "test.data"
+
+	bs := buf.Bytes()
+	bs[len(bs)/2] ^= 0xff
+	os.RemoveAll("test.data")
+	if _, err := Restore(cfg, bytes.NewReader(bs)); !errors.Is(err, ErrChecksum) {
+		t.Errorf("expected corrupted backup to be rejected, got %v", err)
+	}
+	bs[len(bs)/2] ^= 0xff
+
+	// The key length of the first record is rejected before it is read
+	klen := append([]byte(nil), bs[23:27]...)
+	copy(bs[23:27], []byte{0xff, 0xff, 0xff, 0xff})
+	os.RemoveAll("test.data")
+	if _, err := Restore(cfg, bytes.NewReader(bs)); !errors.Is(err, ErrCorruptBackup) {
+		t.Errorf("expected corrupted length to be rejected, got %v", err)
+	}
+	copy(bs[23:27], klen)
+
+	// The length of the recovery points is rejected before it is read
+	hdr := append([]byte(nil), bs[:22]...)
+	hdr = append(hdr, backupRecoveryPoints, 0xff, 0xff, 0xff, 0xff)
+	os.RemoveAll("test.data")
+	if _, err := Restore(cfg, bytes.NewReader(hdr)); !errors.Is(err, ErrCorruptBackup) {
+		t.Errorf("expected oversized recovery points to be rejected, got %v", err)
+	}
+
+	// A truncated record is rejected as well
+	hdr = append(hdr[:22], backupRecoveryPoints, 0, 0, 0, 16)
+	os.RemoveAll("test.data")
+	if _, err := Restore(cfg, bytes.NewReader(hdr)); !errors.Is(err, ErrCorruptBackup) {
+		t.Errorf("expected truncated recovery points to be rejected, got %v", err)
+	}
+
+	os.RemoveAll("test.data")
+	r, err := Restore(cfg, bytes.NewReader(bs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	verify := func(snap *Snapshot) {
+		i := 1
+		itr := snap.NewIterator()
+		defer itr.Close()
+		for itr.SeekFirst(); itr.Valid(); itr.Next() {
+			if k := string(itr.Key()); k != fmt.Sprintf("key-%10d", i) {
+				t.Fatalf("expected key-%10d, got %s", i, k)
+			}
+
+			if v := string(itr.Value()); v != fmt.Sprintf("val-%10d", i) {
+				t.Fatalf("expected val-%10d, got %s", i, v)
+			}
+			i += 2
+		}
+
+		if i != n+1 {
+			t.Errorf("expected %d items, got %d", n/2, (i-1)/2)
+		}
+	}
+
+	rsnap := r.NewSnapshot()
+	verify(rsnap)
+	rsnap.Close()
+
+	if count := r.ItemsCount(); count != int64(n/2) {
+		t.Errorf("expected items count %d, got %d", n/2, count)
+	}
+
+	rp, err := r.LookupRecoveryPoint("rp-1")
+	if err != nil || string(rp.Meta()) != "meta" {
+		t.Fatalf("expected recovery point to be restored, got %v", err)
+	}
+
+	// Recovery points refer to the restored snapshot
+	rw := r.NewWriter()
+	rw.InsertKV([]byte(fmt.Sprintf("key-%10d", 0)), []byte("new"))
+	r.NewSnapshot().Close()
+
+	rsnap, err = r.Rollback(rp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify(rsnap)
+	rsnap.Close()
+}
+
+func TestMVCCBackupSince(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testSnCfg)
+	defer s.Close()
+
+	n := 10000
+	w := s.NewWriter()
+	for i := 0; i < n; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte(fmt.Sprintf("val-%10d", i)))
+	}
+
+	s.CreateNamedRecoveryPoint(s.NewSnapshot(), "base", nil)
+	var full bytes.Buffer
+	snap := s.NewSnapshot()
+	if err := s.Backup(&full, snap); err != nil {
+		t.Fatal(err)
+	}
+	snap.Close()
+
+	// Update, delete and add items after the recovery point
+	deleted := 0
+	for i := 0; i < n; i += 3 {
+		k := []byte(fmt.Sprintf("key-%10d", i))
+		w.DeleteKV(k)
+		if i%2 == 0 {
+			w.InsertKV(k, []byte("updated"))
+		} else {
+			deleted++
+		}
+	}
+
+	for i := n; i < n+100; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte("added"))
+	}
+
+	s.CreateNamedRecoveryPoint(s.NewSnapshot(), "next", nil)
+	rp, _ := s.LookupRecoveryPoint("base")
+	var incr bytes.Buffer
+	if err := s.BackupSince(rp, &incr); err != nil {
+		t.Fatal(err)
+	}
+
+	if incr.Len() >= full.Len()/2 {
+		t.Errorf("expected incremental backup %d to be smaller than full backup %d", incr.Len(), full.Len())
+	}
+
+	cfg := testSnCfg
+	cfg.File = "test.data"
+	os.RemoveAll("test.data")
+	if _, err := Restore(cfg, bytes.NewReader(incr.Bytes())); err != ErrInvalidBackup {
+		t.Errorf("expected incremental backup to be rejected, got %v", err)
+	}
+
+	// The base recovery point has to be part of the instance
+	os.RemoveAll("test.data")
+	r := newTestIntPlasmaStore(cfg)
+	if err := r.ApplyBackup(bytes.NewReader(incr.Bytes())); err != ErrBackupBaseNotFound {
+		t.Errorf("expected backup with unknown base to be rejected, got %v", err)
+	}
+	r.Close()
+
+	os.RemoveAll("test.data")
+	r, err := Restore(cfg, &full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// Changes of a corrupted backup are rolled back
+	bs := incr.Bytes()
+	bs[len(bs)/2] ^= 0xff
+	if err := r.ApplyBackup(bytes.NewReader(bs)); !errors.Is(err, ErrChecksum) {
+		t.Errorf("expected corrupted backup to be rejected, got %v", err)
+	}
+	bs[len(bs)/2] ^= 0xff
+
+	rw := r.NewWriter()
+	if v, err := rw.LookupKV([]byte(fmt.Sprintf("key-%10d", 0))); string(v) != fmt.Sprintf("val-%10d", 0) {
+		t.Errorf("expected changes to be rolled back, got %q (err=%v)", v, err)
+	}
+
+	if len(r.ListRecoveryPoints()) != 1 {
+		t.Errorf("expected only the restored recovery point, got %d", len(r.ListRecoveryPoints()))
+	}
+
+	if err := r.ApplyBackup(&incr); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.LookupRecoveryPoint("next"); err != nil {
+		t.Errorf("expected recovery points after the base to be restored, got %v", err)
+	}
+
+	expected := s.NewSnapshot()
+	defer expected.Close()
+	restored := r.NewSnapshot()
+	defer restored.Close()
+
+	itr1, itr2 := expected.NewIterator(), restored.NewIterator()
+	defer itr1.Close()
+	defer itr2.Close()
+
+	count := 0
+	itr2.SeekFirst()
+	for itr1.SeekFirst(); itr1.Valid(); itr1.Next() {
+		if !itr2.Valid() || !bytes.Equal(itr1.Key(), itr2.Key()) || !bytes.Equal(itr1.Value(), itr2.Value()) {
+			t.Fatalf("mismatch at %s", itr1.Key())
+		}
+		itr2.Next()
+		count++
+	}
+
+	if itr2.Valid() {
+		t.Errorf("unexpected item %s", itr2.Key())
+	}
+
+	if count != n-deleted+100 {
+		t.Errorf("unexpected item count %d", count)
+	}
+}
@@ -0,0 +1,299 @@
+package plasma
+
+import (
+	"sort"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Mutation describes an insert or delete staged in a batch
+type Mutation struct {
+	Item   unsafe.Pointer
+	Delete bool
+}
+
+type mutationSorter struct {
+	muts []Mutation
+	cmp  func(a, b unsafe.Pointer) int
+}
+
+func (s *mutationSorter) Len() int {
+	return len(s.muts)
+}
+
+func (s *mutationSorter) Less(i, j int) bool {
+	return s.cmp(s.muts[i].Item, s.muts[j].Item) < 0
+}
+
+func (s *mutationSorter) Swap(i, j int) {
+	s.muts[i], s.muts[j] = s.muts[j], s.muts[i]
+}
+
+type batchFlushPage struct {
+	pid         PageId
+	pg          Page
+	typ         lssBlockType
+	bs          []byte
+	dataSz      int
+	staleFdSz   int
+	numSegments int
+}
+
+// keySumDelta returns the change in the key checksum of a snapshot when an
+// MVCC item is inserted
+func (s *Plasma) keySumDelta(itm unsafe.Pointer) uint64 {
+	if !s.EnableShapshots {
+		return 0
+	} else if (*item)(itm).IsInsert() {
+		return keyChecksum((*item)(itm).Key())
+	}
+
+	return -keyChecksum((*item)(itm).Key())
+}
+
+// itemCountDelta returns the change in the number of items of a snapshot
+// when an MVCC item is inserted
+func (s *Plasma) itemCountDelta(itm unsafe.Pointer) int64 {
+	if !s.EnableShapshots {
+		return 0
+	} else if (*item)(itm).IsInsert() {
+		return 1
+	}
+
+	return -1
+}
+
+// ApplyBatch applies a set of mutations with a single page lookup and
+// mapping update per target page. Mutations for the same item are applied
+// in the order they appear in the batch. For persistent instances, the
+// modified pages are written to the LSS together and synced once before
+// returning.
+func (w *Writer) ApplyBatch(muts []Mutation) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+
+	if w.readOnly {
+		return ErrReadOnly
+	}
+
+	if err := w.mutationError(); err != nil {
+		return err
+	}
+
+	sorted := make([]Mutation, len(muts))
+	copy(sorted, muts)
+	sort.Stable(&mutationSorter{muts: sorted, cmp: w.cmp})
+
+	var pids []PageId
+	for i := 0; i < len(sorted); {
+	retry:
+		pid, pg, err := w.fetchPage(sorted[i].Item, w.wCtx)
+		if err != nil {
+			return err
+		}
+
+		nr := w.sts.NumLSSReads
+		j := i
+		for ; j < len(sorted) && j-i < w.Config.MaxPageItems; j++ {
+			itm := sorted[j].Item
+			if j > i && (!pg.InRange(itm) || pg.NeedSplit(w.Config.MaxPageItems)) {
+				break
+			}
+
+			if sorted[j].Delete {
+				pg.Delete(itm)
+			} else {
+				pg.Insert(itm)
+			}
+		}
+
+		if !w.trySMOs(pid, pg, w.wCtx, true) {
+			w.sts.InsertConflicts++
+			goto retry
+		}
+
+		for _, m := range sorted[i:j] {
+			w.sts.BytesIncoming += int64(w.itemSize(m.Item))
+			if m.Delete {
+				w.sts.Deletes++
+			} else {
+				w.sts.Inserts++
+				atomic.AddInt64(&w.count, w.itemCountDelta(m.Item))
+				atomic.AddUint64(&w.keySum, w.keySumDelta(m.Item))
+			}
+		}
+
+		if w.sts.NumLSSReads-nr > 0 {
+			w.sts.CacheMisses++
+		} else {
+			w.sts.CacheHits++
+		}
+
+		if len(pids) == 0 || pids[len(pids)-1] != pid {
+			pids = append(pids, pid)
+		}
+		i = j
+	}
+
+	if w.shouldPersist {
+		w.flushBatchPages(pids)
+		w.lss.Sync(false)
+	}
+
+	w.trySMRObjects(w.wCtx, writerSMRBufferSize)
+	return nil
+}
+
+// IngestSorted merges a stream of items in ascending order into the
+// instance. Items are applied a page at a time and every page is written
+// out once after the stream moves past it, instead of being flushed for
+// each item by the persistor.
+func (s *Plasma) IngestSorted(itr ItemIterator) error {
+	if s.isClosed() {
+		return ErrClosed
+	}
+
+	if s.readOnly {
+		return ErrReadOnly
+	}
+
+	if err := s.mutationError(); err != nil {
+		return err
+	}
+
+	s.ingestLock.Lock()
+	defer s.ingestLock.Unlock()
+
+	if s.ingestWriter == nil {
+		s.ingestWriter = s.NewWriter()
+	}
+
+	w := s.ingestWriter
+	var pending []unsafe.Pointer
+	var lastPid PageId
+
+	if err := itr.SeekFirst(); err != nil {
+		return err
+	}
+
+	for {
+		// Items returned by the iterator are only valid until it moves
+		for len(pending) < w.Config.MaxPageItems && itr.Valid() {
+			pending = append(pending, s.copyKey(itr.Get(), nil))
+			if err := itr.Next(); err != nil {
+				return err
+			}
+		}
+
+		if len(pending) == 0 {
+			break
+		}
+
+	retry:
+		pid, pg, err := w.fetchPage(pending[0], w.wCtx)
+		if err != nil {
+			return err
+		}
+
+		j := 0
+		for ; j < len(pending) && (j == 0 || pg.InRange(pending[j]) && !pg.NeedSplit(w.Config.MaxPageItems)); j++ {
+			pg.Insert(pending[j])
+		}
+
+		if !w.trySMOs(pid, pg, w.wCtx, true) {
+			w.sts.InsertConflicts++
+			goto retry
+		}
+
+		for _, itm := range pending[:j] {
+			w.sts.BytesIncoming += int64(w.itemSize(itm))
+			w.sts.Inserts++
+			atomic.AddInt64(&w.count, w.itemCountDelta(itm))
+			atomic.AddUint64(&w.keySum, w.keySumDelta(itm))
+		}
+
+		if w.shouldPersist && lastPid != nil && lastPid != pid {
+			w.flushBatchPages([]PageId{lastPid})
+		}
+
+		lastPid = pid
+		pending = pending[j:]
+	}
+
+	if w.shouldPersist {
+		if lastPid != nil {
+			w.flushBatchPages([]PageId{lastPid})
+		}
+		w.lss.Sync(false)
+	}
+
+	w.trySMRObjects(w.wCtx, writerSMRBufferSize)
+	return nil
+}
+
+// Write out the dirty pages touched by a batch using as few LSS
+// reservations as the flush buffer size allows. Pages which were
+// concurrently modified are left for the persistor.
+func (w *Writer) flushBatchPages(pids []PageId) {
+	var batch []batchFlushPage
+	var batchSz int
+
+	for _, pid := range pids {
+		pg, _ := w.ReadPage(pid, nil, false, w.wCtx)
+		if !pg.NeedsFlush() {
+			continue
+		}
+
+		bs, _, staleFdSz, numSegments, err := pg.Marshal(w.GetBuffer(bufEncPage), w.Config.MaxPageLSSSegments)
+		if err != nil {
+			// Pages too big to be written out are split by Persist
+			w.Persist(pid, false, w.wCtx)
+			continue
+		}
+
+		typ, bs := w.compressPageBlock(pgFlushLSSType(pg, numSegments), bs)
+		sz := lssBlockTypeSize + len(bs) + blockHeaderSize(w.Config.EncryptionKey != nil)
+		if len(batch) > 0 && batchSz+sz > w.Config.FlushBufferSize {
+			w.commitBatchPages(batch)
+			batch, batchSz = batch[:0], 0
+		}
+
+		batch = append(batch, batchFlushPage{
+			pid:         pid,
+			pg:          pg,
+			typ:         typ,
+			bs:          append([]byte(nil), bs...),
+			dataSz:      len(bs),
+			staleFdSz:   staleFdSz,
+			numSegments: numSegments,
+		})
+		batchSz += sz
+	}
+
+	if len(batch) > 0 {
+		w.commitBatchPages(batch)
+	}
+}
+
+func (w *Writer) commitBatchPages(batch []batchFlushPage) {
+	sizes := make([]int, len(batch))
+	for i, b := range batch {
+		sizes[i] = lssBlockTypeSize + len(b.bs)
+	}
+
+	offsets, wbufs, res := w.lss.ReserveSpaceMulti(sizes)
+	for i, b := range batch {
+		writeLSSBlock(wbufs[i], b.typ, b.bs)
+		staleOff, _ := b.pg.GetLastFlushOffset()
+		b.pg.AddFlushRecord(offsets[i], b.dataSz, b.numSegments)
+		if w.UpdateMapping(b.pid, b.pg, w.wCtx) {
+			w.sts.FlushDataSz += int64(b.dataSz) - int64(b.staleFdSz)
+			w.trackLSSUsage(staleOff, b.staleFdSz, offsets[i], b.dataSz)
+		} else {
+			discardLSSBlock(wbufs[i])
+		}
+	}
+
+	w.lss.FinalizeWrite(res)
+}
@@ -0,0 +1,128 @@
+package plasma
+
+import (
+	"github.com/couchbase/nitro/skiplist"
+	"math/rand"
+	"os"
+	"testing"
+	"unsafe"
+)
+
+func TestPlasmaApplyBatch(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testCfg)
+	defer s.Close()
+
+	w := s.NewWriter()
+	n := 100000
+	batchSize := 1000
+	keys := rand.Perm(n)
+	for i := 0; i < n; i += batchSize {
+		var muts []Mutation
+		for _, k := range keys[i : i+batchSize] {
+			muts = append(muts, Mutation{Item: skiplist.NewIntKeyItem(k)})
+		}
+
+		if err := w.ApplyBatch(muts); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+
+	var muts []Mutation
+	for i := 0; i < n; i += 2 {
+		muts = append(muts, Mutation{Item: skiplist.NewIntKeyItem(i), Delete: true})
+	}
+	// Reinsert after delete within the same batch
+	muts = append(muts, Mutation{Item: skiplist.NewIntKeyItem(0)})
+	w.ApplyBatch(muts)
+
+	for i := 0; i < n; i++ {
+		itm := skiplist.NewIntKeyItem(i)
+		got, _ := w.Lookup(itm)
+		if i == 0 || i%2 == 1 {
+			if got == nil || skiplist.CompareInt(itm, got) != 0 {
+				t.Errorf("expected %d to be found", i)
+			}
+		} else if got != nil {
+			t.Errorf("expected %d to be deleted", i)
+		}
+	}
+
+	for pid := s.StartPageId(); pid != s.EndPageId(); pid = NextPid(pid) {
+		pg, _ := s.ReadPage(pid, nil, false, w.wCtx)
+		if pg.NeedsFlush() {
+			t.Errorf("expected batch pages to be flushed")
+			break
+		}
+	}
+}
+
+type sliceIterator struct {
+	itms []unsafe.Pointer
+	i    int
+}
+
+func (itr *sliceIterator) SeekFirst() error {
+	itr.i = 0
+	return nil
+}
+
+func (itr *sliceIterator) Seek(itm unsafe.Pointer) error {
+	for itr.i = 0; itr.Valid() && skiplist.CompareInt(itr.Get(), itm) < 0; itr.i++ {
+	}
+	return nil
+}
+
+func (itr *sliceIterator) Get() unsafe.Pointer {
+	return itr.itms[itr.i]
+}
+
+func (itr *sliceIterator) Valid() bool {
+	return itr.i < len(itr.itms)
+}
+
+func (itr *sliceIterator) Next() error {
+	itr.i++
+	return nil
+}
+
+func TestPlasmaIngestSorted(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testCfg)
+
+	n := 100000
+	w := s.NewWriter()
+	for i := 0; i < n; i += 2 {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+	s.PersistAll()
+
+	itr := &sliceIterator{}
+	for i := 1; i < n; i += 2 {
+		itr.itms = append(itr.itms, skiplist.NewIntKeyItem(i))
+	}
+
+	if err := s.IngestSorted(itr); err != nil {
+		t.Fatal(err)
+	}
+
+	for pid := s.StartPageId(); pid != s.EndPageId(); pid = NextPid(pid) {
+		pg, _ := s.ReadPage(pid, nil, false, w.wCtx)
+		if pg.NeedsFlush() {
+			t.Errorf("expected ingested pages to be flushed")
+			break
+		}
+	}
+	s.Close()
+
+	s = newTestIntPlasmaStore(testCfg)
+	defer s.Close()
+
+	w = s.NewWriter()
+	for i := 0; i < n; i++ {
+		itm := skiplist.NewIntKeyItem(i)
+		if got, _ := w.Lookup(itm); got == nil || skiplist.CompareInt(itm, got) != 0 {
+			t.Fatalf("expected %d to be found", i)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package plasma
+
+import (
+	"github.com/couchbase/nitro/skiplist"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Builder bulk loads sorted items into a new instance. Items are packed
+// into full base pages as they are added, bypassing page lookups, delta
+// chains and SMOs. The pages become visible only when Finish swaps them
+// into the page table of the instance.
+type Builder struct {
+	*wCtx
+
+	pid   PageId
+	buf   []byte
+	offs  []int
+	itms  []unsafe.Pointer
+	pages []*page
+	pids  []PageId
+	count int64
+	// Checksum of the keys added, see keyChecksum
+	keySum uint64
+}
+
+// NewBuilder creates an instance with the given config for bulk loading.
+// The instance must not hold any items.
+func NewBuilder(cfg Config) (*Builder, error) {
+	s, err := New(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	itr := s.NewIterator()
+	if itr.SeekFirst(); itr.Valid() {
+		s.Close()
+		return nil, ErrNotEmpty
+	}
+
+	b := &Builder{
+		wCtx: s.newWCtx(),
+		pid:  s.StartPageId(),
+	}
+
+	return b, nil
+}
+
+// Add appends an item. Items have to be added in strictly ascending order.
+func (b *Builder) Add(itm unsafe.Pointer) error {
+	if n := len(b.offs); n > 0 {
+		last := unsafe.Pointer(&b.buf[b.offs[n-1]])
+		if b.cmp(last, itm) >= 0 {
+			return ErrUnsortedItems
+		}
+
+		if n >= b.Config.MaxPageItems || len(b.buf) > maxPageEncodedSize/4 {
+			next := b.AllocPageId(b.wCtx)
+			b.buildPage(itm, next)
+			b.pid = next
+		}
+	}
+
+	sz := int(b.itemSize(itm))
+	off := len(b.buf)
+	if off+sz > cap(b.buf) {
+		buf := make([]byte, off, 2*cap(b.buf)+sz)
+		copy(buf, b.buf)
+		b.buf = buf
+	}
+
+	b.buf = b.buf[:off+sz]
+	memcopy(unsafe.Pointer(&b.buf[off]), itm, sz)
+	b.offs = append(b.offs, off)
+
+	b.sts.BytesIncoming += int64(sz)
+	b.sts.Inserts++
+	return nil
+}
+
+// AddKV appends a key value pair as part of the current snapshot
+func (b *Builder) AddKV(k, v []byte) error {
+	sn := atomic.LoadUint64(&b.currSn)
+	itm, err := b.newKVItem(k, v, sn, b.GetBuffer(bufTempItem))
+	if err != nil {
+		return err
+	}
+
+	if err = b.Add(unsafe.Pointer(itm)); err != nil {
+		return err
+	}
+
+	b.count++
+	b.keySum += keyChecksum(k)
+	return nil
+}
+
+// buildPage creates a base page from the buffered items
+func (b *Builder) buildPage(hiItm unsafe.Pointer, next PageId) {
+	b.itms = b.itms[:0]
+	for _, off := range b.offs {
+		b.itms = append(b.itms, unsafe.Pointer(&b.buf[off]))
+	}
+
+	pg := newPage(b.wCtx, skiplist.MinItem, nil).(*page)
+	pg.head = pg.newBasePage2(b.itms, hiItm, next)
+	if !b.isStartPage(b.pid) {
+		pg.low = (*basePage)(unsafe.Pointer(pg.head)).items[0]
+	}
+
+	b.pages = append(b.pages, pg)
+	b.pids = append(b.pids, b.pid)
+	b.buf, b.offs = b.buf[:0], b.offs[:0]
+}
+
+// Finish writes out the pages and swaps them into the page table. The
+// builder cannot be used afterwards.
+func (b *Builder) Finish() (*Plasma, error) {
+	s, ctx := b.Plasma, b.wCtx
+	if len(b.offs) > 0 {
+		b.buildPage(skiplist.MaxItem, s.EndPageId())
+	}
+
+	for i, pg := range b.pages {
+		if s.shouldPersist {
+			bs, _, _, numSegments, err := pg.Marshal(ctx.GetBuffer(bufEncPage), 1)
+			if err != nil {
+				return nil, err
+			}
+
+			typ, bs := s.compressPageBlock(lssPageData, bs)
+			offset, wbuf, res := s.lss.ReserveSpace(lssBlockTypeSize + len(bs))
+			writeLSSBlock(wbuf, typ, bs)
+			s.lss.FinalizeWrite(res)
+			pg.AddFlushRecord(offset, len(bs), numSegments)
+			ctx.sts.FlushDataSz += int64(len(bs))
+		}
+
+		if pid := b.pids[i]; !s.isStartPage(pid) {
+			s.CreateMapping(pid, pg, ctx)
+			if err := s.indexPage(pid, ctx); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if s.shouldPersist {
+		s.lss.Sync(false)
+	}
+
+	_, _, nra, _, memUsed := ctx.pgAllocCtx.GetAllocOps()
+	ctx.sts.AllocSz += int64(memUsed)
+	ctx.sts.NumRecordAllocs += int64(nra)
+
+	// Replace the seed page by the first page
+	if len(b.pages) > 0 {
+		pg := b.pages[0]
+	retry:
+		seed, _ := s.ReadPage(s.StartPageId(), nil, false, ctx)
+		pg.prevHeadPtr = seed.(*page).prevHeadPtr
+		seed.(*page).free(false)
+		if !s.UpdateMapping(s.StartPageId(), pg, ctx) {
+			goto retry
+		}
+	}
+
+	s.Lock()
+	s.itemsCount += b.count
+	s.itemsKeySum += b.keySum
+	s.Unlock()
+
+	b.pages, b.pids = nil, nil
+	return s, nil
+}
+
+// Abort discards the items added so far and closes the instance
+func (b *Builder) Abort() {
+	allocs, _, _, _, _ := b.pgAllocCtx.GetAllocOps()
+	b.discardDeltas(allocs)
+	for _, pid := range append(b.pids, b.pid) {
+		if !b.isStartPage(pid) {
+			b.FreePageId(pid, b.wCtx)
+		}
+	}
+
+	b.pages, b.pids = nil, nil
+	b.Close()
+}
@@ -0,0 +1,130 @@
+package plasma
+
+import (
+	"fmt"
+	"github.com/couchbase/nitro/skiplist"
+	"os"
+	"testing"
+)
+
+func TestPlasmaBuilder(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	b, err := NewBuilder(testCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := 100000
+	for i := 0; i < n; i++ {
+		if err := b.Add(skiplist.NewIntKeyItem(i * 2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := b.Add(skiplist.NewIntKeyItem(0)); err != ErrUnsortedItems {
+		t.Errorf("expected unsorted item to be rejected, got %v", err)
+	}
+
+	s, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sts := s.GetStats(); sts.NumPages != int64(n/testCfg.MaxPageItems) || sts.Splits != 0 {
+		t.Errorf("unexpected pages %d with %d splits", sts.NumPages, sts.Splits)
+	}
+
+	// Built pages accept regular writes
+	w := s.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i*2 + 1))
+	}
+
+	verify := func(s *Plasma) {
+		i := 0
+		itr := s.NewIterator()
+		for itr.SeekFirst(); itr.Valid(); itr.Next() {
+			if v := skiplist.IntFromItem(itr.Get()); v != i {
+				t.Fatalf("expected %d, got %d", i, v)
+			}
+			i++
+		}
+
+		if i != 2*n {
+			t.Errorf("expected %d items, got %d", 2*n, i)
+		}
+	}
+
+	verify(s)
+	s.PersistAll()
+	s.Close()
+
+	s = newTestIntPlasmaStore(testCfg)
+	verify(s)
+	s.Close()
+
+	if _, err := NewBuilder(testCfg); err != ErrNotEmpty {
+		t.Errorf("expected builder on existing instance to fail, got %v", err)
+	}
+}
+
+func TestMVCCBuilder(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	b, err := NewBuilder(testSnCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := 10000
+	for i := 0; i < n; i++ {
+		b.AddKV([]byte(fmt.Sprintf("key-%10d", i)), []byte(fmt.Sprintf("val-%10d", i)))
+	}
+
+	s, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	snap := s.NewSnapshot()
+	defer snap.Close()
+
+	if count := s.ItemsCount(); count != int64(n) {
+		t.Errorf("expected %d items, got %d", n, count)
+	}
+
+	i := 0
+	itr := snap.NewIterator()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		if v := string(itr.Value()); v != fmt.Sprintf("val-%10d", i) {
+			t.Fatalf("expected val-%10d, got %s", i, v)
+		}
+		i++
+	}
+	itr.Close()
+
+	if i != n {
+		t.Errorf("expected %d items, got %d", n, i)
+	}
+}
+
+func TestPlasmaBuilderAbort(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	b, err := NewBuilder(testCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10000; i++ {
+		b.Add(skiplist.NewIntKeyItem(i))
+	}
+	b.Abort()
+
+	s := newTestIntPlasmaStore(testCfg)
+	defer s.Close()
+
+	itr := s.NewIterator()
+	if itr.SeekFirst(); itr.Valid() {
+		t.Errorf("expected aborted build to be discarded")
+	}
+}
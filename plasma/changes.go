@@ -0,0 +1,113 @@
+package plasma
+
+// ChangeOp is the type of a change event
+type ChangeOp int
+
+const (
+	ChangeInsert ChangeOp = iota
+	ChangeDelete
+)
+
+// ChangeEvent describes the latest change of a key
+type ChangeEvent struct {
+	Key []byte
+	Op  ChangeOp
+	Sn  uint64
+}
+
+// ChangeStream returns the changes made after a sequence number. Changes
+// are returned in rounds, each of which covers the changes up to a newly
+// created snapshot in key order. Multiple changes of a key within a round
+// are coalesced into the latest one.
+type ChangeStream struct {
+	s     *Plasma
+	since uint64
+
+	// Snapshot of the previous round retains the deleted items
+	base *Snapshot
+	snap *Snapshot
+	itr  *MVCCIterator
+}
+
+// Changes returns a stream of the changes made after fromSn. A stream can
+// be resumed by passing the sequence number returned by Sn.
+func (s *Plasma) Changes(fromSn uint64) *ChangeStream {
+	return &ChangeStream{
+		s:     s,
+		since: fromSn,
+	}
+}
+
+// Next returns the next change. It returns false at the end of a round,
+// after which Sn covers all the changes returned so far. Calling Next again
+// starts a new round with the changes made in the meantime.
+func (cs *ChangeStream) Next() (ChangeEvent, bool) {
+	if cs.itr == nil {
+		snap := cs.s.NewSnapshot()
+		if snap.sn <= cs.since {
+			snap.Close()
+			return ChangeEvent{}, false
+		}
+
+		cs.snap = snap
+		cs.itr = snap.newChangeIterator(cs.since)
+		cs.itr.SeekFirst()
+	}
+
+	if !cs.itr.Valid() {
+		cs.itr.Close()
+		cs.since = cs.snap.sn
+		if cs.base != nil {
+			cs.base.Close()
+		}
+
+		cs.base, cs.snap, cs.itr = cs.snap, nil, nil
+		return ChangeEvent{}, false
+	}
+
+	itm := (*item)(cs.itr.Get())
+	ev := ChangeEvent{
+		Key: append([]byte(nil), itm.Key()...),
+		Op:  ChangeInsert,
+		Sn:  itm.Sn(),
+	}
+
+	if !itm.IsInsert() {
+		ev.Op = ChangeDelete
+	}
+
+	cs.itr.Next()
+	return ev, true
+}
+
+// Sn returns the sequence number up to which all the changes have been
+// returned
+func (cs *ChangeStream) Sn() uint64 {
+	return cs.since
+}
+
+// Close releases the snapshots held by the stream
+func (cs *ChangeStream) Close() {
+	if cs.itr != nil {
+		cs.itr.Close()
+		cs.snap.Close()
+	}
+
+	if cs.base != nil {
+		cs.base.Close()
+	}
+
+	cs.base, cs.snap, cs.itr = nil, nil, nil
+}
+
+// newChangeIterator returns an iterator over the latest versions of the
+// items changed after since, including deletes
+func (s *Snapshot) newChangeIterator(since uint64) *MVCCIterator {
+	itr := s.NewIterator()
+	itr.filter = &changeFilter{
+		snFilter: snFilter{sn: s.sn},
+		since:    since,
+	}
+
+	return itr
+}
@@ -0,0 +1,74 @@
+package plasma
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestMVCCChanges(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testSnCfg)
+	defer s.Close()
+
+	n := 1000
+	w := s.NewWriter()
+	for i := 0; i < n; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte("val"))
+	}
+
+	drain := func(cs *ChangeStream) map[string]ChangeOp {
+		evs := make(map[string]ChangeOp)
+		for ev, ok := cs.Next(); ok; ev, ok = cs.Next() {
+			if _, ok := evs[string(ev.Key)]; ok {
+				t.Fatalf("duplicate change for %s", ev.Key)
+			}
+			evs[string(ev.Key)] = ev.Op
+		}
+		return evs
+	}
+
+	cs := s.Changes(0)
+	if evs := drain(cs); len(evs) != n {
+		t.Errorf("expected %d changes, got %d", n, len(evs))
+	}
+
+	if evs := drain(cs); len(evs) != 0 {
+		t.Errorf("expected no changes, got %d", len(evs))
+	}
+
+	for i := 0; i < n; i += 2 {
+		w.DeleteKV([]byte(fmt.Sprintf("key-%10d", i)))
+	}
+
+	for i := 1; i < n; i += 10 {
+		w.DeleteKV([]byte(fmt.Sprintf("key-%10d", i)))
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte("updated"))
+	}
+
+	verify := func(evs map[string]ChangeOp) {
+		if len(evs) != n/2+n/10 {
+			t.Errorf("expected %d changes, got %d", n/2+n/10, len(evs))
+		}
+
+		for i := 0; i < n; i += 2 {
+			if op := evs[fmt.Sprintf("key-%10d", i)]; op != ChangeDelete {
+				t.Errorf("expected delete for key-%10d, got %v", i, op)
+			}
+		}
+
+		for i := 1; i < n; i += 10 {
+			if op, ok := evs[fmt.Sprintf("key-%10d", i)]; !ok || op != ChangeInsert {
+				t.Errorf("expected insert for key-%10d", i)
+			}
+		}
+	}
+
+	// Resume from the position of the first stream
+	sn := cs.Sn()
+	cs.Close()
+
+	cs = s.Changes(sn)
+	defer cs.Close()
+	verify(drain(cs))
+}
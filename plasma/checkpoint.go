@@ -0,0 +1,392 @@
+package plasma
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/couchbase/nitro/skiplist"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// A page table checkpoint records the low key, high key and the offset of
+// the latest flushed delta of every page as lssCheckpoint blocks. The
+// checkpoint file points to these blocks along with the log offset from
+// which recovery has to replay the log. Every block written before the
+// replay offset is reflected by the checkpoint. Log trimming is held back
+// until the oldest block referenced by the checkpoint, so that the pages
+// can be fetched lazily after recovery.
+
+var checkpointFileName = "checkpoint.data"
+
+var ErrCorruptCheckpoint = fmt.Errorf("Checkpoint is corrupted: %w", ErrChecksum)
+
+const checkpointEntryHdrSize = 2 + 2 + 2 + 8 + 4
+
+type checkpointInfo struct {
+	replayOffset LSSOffset
+	pinOffset    LSSOffset
+	maxSn        uint64
+	flushDataSz  int64
+	chunks       []LSSOffset
+	rps          []byte
+}
+
+func (info *checkpointInfo) Marshal() []byte {
+	bs := make([]byte, 4+8+8+8+8+4+8*len(info.chunks)+len(info.rps))
+	offset := 4
+	binary.BigEndian.PutUint64(bs[offset:offset+8], uint64(info.replayOffset))
+	offset += 8
+	binary.BigEndian.PutUint64(bs[offset:offset+8], uint64(info.pinOffset))
+	offset += 8
+	binary.BigEndian.PutUint64(bs[offset:offset+8], info.maxSn)
+	offset += 8
+	binary.BigEndian.PutUint64(bs[offset:offset+8], uint64(info.flushDataSz))
+	offset += 8
+	binary.BigEndian.PutUint32(bs[offset:offset+4], uint32(len(info.chunks)))
+	offset += 4
+	for _, off := range info.chunks {
+		binary.BigEndian.PutUint64(bs[offset:offset+8], uint64(off))
+		offset += 8
+	}
+	copy(bs[offset:], info.rps)
+
+	binary.BigEndian.PutUint32(bs[:4], crc32.ChecksumIEEE(bs[4:]))
+	return bs
+}
+
+func unmarshalCheckpointInfo(bs []byte) (*checkpointInfo, error) {
+	if len(bs) < 4+8+8+8+8+4 || crc32.ChecksumIEEE(bs[4:]) != binary.BigEndian.Uint32(bs[:4]) {
+		return nil, ErrCorruptCheckpoint
+	}
+
+	info := new(checkpointInfo)
+	offset := 4
+	info.replayOffset = LSSOffset(binary.BigEndian.Uint64(bs[offset : offset+8]))
+	offset += 8
+	info.pinOffset = LSSOffset(binary.BigEndian.Uint64(bs[offset : offset+8]))
+	offset += 8
+	info.maxSn = binary.BigEndian.Uint64(bs[offset : offset+8])
+	offset += 8
+	info.flushDataSz = int64(binary.BigEndian.Uint64(bs[offset : offset+8]))
+	offset += 8
+	n := int(binary.BigEndian.Uint32(bs[offset : offset+4]))
+	offset += 4
+	for i := 0; i < n; i++ {
+		info.chunks = append(info.chunks, LSSOffset(binary.BigEndian.Uint64(bs[offset:offset+8])))
+		offset += 8
+	}
+	info.rps = bs[offset:]
+
+	return info, nil
+}
+
+func (s *Plasma) checkpointFile() string {
+	return filepath.Join(s.File, checkpointFileName)
+}
+
+func (s *Plasma) writeCheckpointFile(info *checkpointInfo) error {
+	tmpFile := s.checkpointFile() + ".tmp"
+	fd, err := os.OpenFile(tmpFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+
+	if _, err = fd.Write(info.Marshal()); err == nil {
+		err = fd.Sync()
+	}
+	fd.Close()
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile, s.checkpointFile())
+}
+
+func (s *Plasma) checkpointChunkSize() int {
+	sz := s.FlushBufferSize
+	if maxPageEncodedSize < sz {
+		sz = maxPageEncodedSize
+	}
+
+	return sz / 2
+}
+
+// latestFlushDelta returns the most recent delta of the page which has
+// been written to the log
+func latestFlushDelta(pd *pageDelta) *pageDelta {
+	for ; pd != nil; pd = pd.next {
+		switch pd.op {
+		case opFlushPageDelta, opRelocPageDelta, opSwapoutDelta:
+			return pd
+		case opSwapinDelta:
+			return latestFlushDelta((*swapinDelta)(unsafe.Pointer(pd)).ptr)
+		case opBasePage:
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func (s *Plasma) marshalCheckpointKey(key unsafe.Pointer, woffset int, buf []byte) int {
+	if key == skiplist.MinItem || key == skiplist.MaxItem {
+		binary.BigEndian.PutUint16(buf[woffset:woffset+2], 0)
+		return woffset + 2
+	}
+
+	l := int(s.itemSize(key))
+	binary.BigEndian.PutUint16(buf[woffset:woffset+2], uint16(l))
+	woffset += 2
+	memcopy(unsafe.Pointer(&buf[woffset]), key, l)
+	return woffset + l
+}
+
+func unmarshalCheckpointKey(data []byte, roffset int, emptyItm unsafe.Pointer) (unsafe.Pointer, int) {
+	l := int(binary.BigEndian.Uint16(data[roffset : roffset+2]))
+	roffset += 2
+	if l == 0 {
+		return emptyItm, roffset
+	}
+
+	return unsafe.Pointer(&data[roffset]), roffset + l
+}
+
+// Checkpoint writes a page table checkpoint to the log
+func (s *Plasma) Checkpoint() error {
+	if !s.shouldPersist || s.InMemoryLog {
+		return nil
+	}
+
+	if s.readOnly {
+		return ErrReadOnly
+	}
+
+	s.checkpointLock.Lock()
+	defer s.checkpointLock.Unlock()
+
+	ctx := s.checkpointWriter
+
+	// All the blocks in the log before the replay offset have been
+	// applied to the page table
+	s.lss.Sync(false)
+	info := &checkpointInfo{
+		replayOffset: s.lss.TailOffset(),
+		pinOffset:    s.lss.TailOffset(),
+	}
+
+	// The heat map written before the replay offset is not recovered
+	s.relocateHeatMap(s.heatMapVersion())
+
+	chunk := make([]byte, s.checkpointChunkSize())
+	woffset, count := 4, 0
+	writeChunk := func() {
+		binary.BigEndian.PutUint32(chunk[:4], uint32(count))
+		offset, wbuf, res := s.lss.ReserveSpace(lssBlockTypeSize + woffset)
+		writeLSSBlock(wbuf, lssCheckpoint, chunk[:woffset])
+		s.lss.FinalizeWrite(res)
+		info.chunks = append(info.chunks, offset)
+		woffset, count = 4, 0
+	}
+
+	callb := func(pid PageId, partn RangePartition) error {
+		tok := ctx.BeginTx()
+		defer ctx.EndTx(tok)
+
+		pg, _ := s.ReadPage(pid, nil, false, ctx)
+		pd := latestFlushDelta(pg.(*page).head)
+		if pd == nil && pg.NeedsFlush() {
+			// A page compacted in memory no longer refers to the blocks
+			// of its persisted items, hence it is written again
+			pg = s.Persist(pid, false, ctx)
+			if pd = latestFlushDelta(pg.(*page).head); pd == nil {
+				return s.newPageError("checkpoint", pg, ErrLogWrite)
+			}
+		}
+
+		if pd == nil {
+			return nil
+		}
+
+		var offset LSSOffset
+		var numSegments int32
+		if pd.op == opSwapoutDelta {
+			sod := (*swapoutDelta)(unsafe.Pointer(pd))
+			offset, numSegments = sod.offset, sod.numSegments
+		} else {
+			fpd := (*flushPageDelta)(unsafe.Pointer(pd))
+			offset, numSegments = fpd.offset, fpd.numSegments
+		}
+
+		// The page may have been split since it was written, hence it is
+		// bounded by its current high key
+		low, hiItm := pid.(*skiplist.Node).Item(), pg.MaxItem()
+		sz := checkpointEntryHdrSize + 4 + int(s.itemSize(low)+s.itemSize(hiItm))
+		if woffset+sz > len(chunk) {
+			writeChunk()
+		}
+
+		binary.BigEndian.PutUint16(chunk[woffset:woffset+2], uint16(pd.state))
+		woffset += 2
+		binary.BigEndian.PutUint16(chunk[woffset:woffset+2], pd.chainLen)
+		woffset += 2
+		binary.BigEndian.PutUint16(chunk[woffset:woffset+2], pd.numItems)
+		woffset += 2
+		binary.BigEndian.PutUint64(chunk[woffset:woffset+8], uint64(offset))
+		woffset += 8
+		binary.BigEndian.PutUint32(chunk[woffset:woffset+4], uint32(numSegments))
+		woffset += 4
+		woffset = s.marshalCheckpointKey(low, woffset, chunk)
+		woffset = s.marshalCheckpointKey(hiItm, woffset, chunk)
+		count++
+
+		if offset < info.pinOffset {
+			info.pinOffset = offset
+		}
+
+		return nil
+	}
+
+	partn := RangePartition{MinKey: skiplist.MinItem, MaxKey: skiplist.MaxItem}
+	if err := s.VisitPartition(partn, callb); err != nil {
+		return err
+	}
+	writeChunk()
+	s.trySMRObjects(ctx, 0)
+
+	s.mvcc.RLock()
+	info.maxSn = atomic.LoadUint64(&s.lastMaxSn)
+	info.rps = marshalRPs(s.recoveryPoints, s.rpVersion)
+	s.mvcc.RUnlock()
+	info.flushDataSz = s.LSSDataSize()
+
+	s.lss.Sync(true)
+	if err := s.writeCheckpointFile(info); err != nil {
+		return err
+	}
+
+	atomic.StoreUint64(&s.ckptPinOffset, uint64(info.pinOffset))
+	ctx.sts.Checkpoints++
+	return nil
+}
+
+// loadCheckpoint populates the page table from the last checkpoint and
+// returns the offset from which the log has to be replayed. Pages are
+// created in the evicted state.
+func (s *Plasma) loadCheckpoint() (LSSOffset, bool, error) {
+	bs, err := os.ReadFile(s.checkpointFile())
+	if err != nil {
+		return 0, false, nil
+	}
+
+	info, err := unmarshalCheckpointInfo(bs)
+	if err == nil {
+		err = s.verifyCheckpoint(info)
+	}
+
+	if err != nil {
+		s.logger("checkpoint").Errorf("Ignoring checkpoint - err %v", err)
+		return 0, false, nil
+	}
+
+	buf := s.gCtx.GetBuffer(bufRecovery)
+	for _, off := range info.chunks {
+		n, _ := s.lss.Read(off, buf)
+		if err := s.loadCheckpointChunk(append([]byte(nil), buf[lssBlockTypeSize:n]...)); err != nil {
+			return 0, false, err
+		}
+	}
+
+	if info.maxSn > 0 {
+		s.currSn = info.maxSn
+	}
+	s.rpVersion, s.recoveryPoints = unmarshalRPs(info.rps)
+	s.gCtx.sts.FlushDataSz += info.flushDataSz
+	atomic.StoreUint64(&s.ckptPinOffset, uint64(info.pinOffset))
+
+	return info.replayOffset, true, nil
+}
+
+func (s *Plasma) verifyCheckpoint(info *checkpointInfo) error {
+	buf := s.gCtx.GetBuffer(bufRecovery)
+	if info.replayOffset < s.lss.TailOffset() {
+		if _, err := s.lss.Read(info.replayOffset, buf); err != nil {
+			return err
+		}
+	}
+
+	for _, off := range info.chunks {
+		if _, err := s.lss.Read(off, buf); err != nil {
+			return err
+		}
+
+		if getLSSBlockType(buf) != lssCheckpoint {
+			return newLSSError("checkpoint", off, ErrCorruptCheckpoint)
+		}
+	}
+
+	return nil
+}
+
+func (s *Plasma) loadCheckpointChunk(data []byte) error {
+	ctx := s.gCtx
+	n := int(binary.BigEndian.Uint32(data[:4]))
+	roffset := 4
+	for i := 0; i < n; i++ {
+		state := pageState(binary.BigEndian.Uint16(data[roffset : roffset+2]))
+		roffset += 2
+		chainLen := binary.BigEndian.Uint16(data[roffset : roffset+2])
+		roffset += 2
+		numItems := binary.BigEndian.Uint16(data[roffset : roffset+2])
+		roffset += 2
+		offset := LSSOffset(binary.BigEndian.Uint64(data[roffset : roffset+8]))
+		roffset += 8
+		numSegments := int32(binary.BigEndian.Uint32(data[roffset : roffset+4]))
+		roffset += 4
+
+		var low, hiItm unsafe.Pointer
+		low, roffset = unmarshalCheckpointKey(data, roffset, skiplist.MinItem)
+		hiItm, roffset = unmarshalCheckpointKey(data, roffset, skiplist.MaxItem)
+
+		pg := newPage(ctx, low, nil).(*page)
+		sod := pg.allocSwapoutDelta(hiItm, nil)
+		sod.op = opSwapoutDelta
+		sod.chainLen = chainLen
+		sod.numItems = numItems
+		sod.state = state
+		sod.state.SetFlushed()
+		sod.state.SetEvicted(true)
+		sod.next = nil
+		sod.rightSibling = nil
+		sod.offset = offset
+		sod.numSegments = numSegments
+		pg.head = (*pageDelta)(unsafe.Pointer(sod))
+
+		pid := s.AllocPageId(ctx)
+		s.CreateMapping(pid, pg, ctx)
+		if err := s.indexPage(pid, ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Plasma) checkpointDaemon() {
+	interval := time.Duration(s.CheckpointInterval) * time.Second
+	for {
+		select {
+		case <-s.stopcheckpoint:
+			s.stopcheckpoint <- struct{}{}
+			return
+		case <-time.After(interval):
+			if err := s.Checkpoint(); err != nil {
+				s.logger("checkpoint").Errorf("Unable to write checkpoint - err %v", err)
+			}
+		}
+	}
+}
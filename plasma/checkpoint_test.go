@@ -0,0 +1,112 @@
+package plasma
+
+import (
+	"github.com/couchbase/nitro/skiplist"
+	"os"
+	"testing"
+)
+
+func TestPlasmaCheckpointRecovery(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	cfg := testCfg
+	cfg.CheckpointInterval = 3600
+	s := newTestIntPlasmaStore(cfg)
+	w := s.NewWriter()
+
+	n := 20000
+	for i := 0; i < n; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+	s.PersistAll()
+	s.EvictAll(0)
+
+	if err := s.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Updates after the checkpoint have to be replayed
+	for i := 0; i < n/2; i++ {
+		w.Delete(skiplist.NewIntKeyItem(i))
+	}
+	for i := n; i < n+n/2; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+	s.PersistAll()
+	tail := s.lss.TailOffset()
+	s.Close()
+
+	var replayed int64
+	cfg.RecoveryProgressCallback = func(done, total int64) {
+		replayed = total
+	}
+	s = newTestIntPlasmaStore(cfg)
+
+	if replayed == 0 || replayed >= int64(tail) {
+		t.Errorf("expected partial replay, replayed %d of %d", replayed, tail)
+	}
+
+	count := 0
+	itr := s.NewIterator()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		if v := skiplist.IntFromItem(itr.Get()); v != count+n/2 {
+			t.Fatalf("expected %d, got %d", count+n/2, v)
+		}
+		count++
+	}
+	itr.(*Iterator).Close()
+
+	if count != n {
+		t.Errorf("expected %d items, got %d", n, count)
+	}
+	s.Close()
+
+	// Checkpoints are discarded once disabled
+	cfg.CheckpointInterval = 0
+	s = newTestIntPlasmaStore(cfg)
+	defer s.Close()
+	if _, err := os.Stat(s.checkpointFile()); !os.IsNotExist(err) {
+		t.Errorf("expected checkpoint file to be removed")
+	}
+
+	if replayed != int64(tail) {
+		t.Errorf("expected full replay of %d, got %d", tail, replayed)
+	}
+}
+
+func TestPlasmaCheckpointCompactedPages(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	cfg := testCfg
+	cfg.CheckpointInterval = 3600
+	s := newTestIntPlasmaStore(cfg)
+	w := s.NewWriter()
+
+	n := 20000
+	for i := 0; i < n; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+	s.PersistAll()
+
+	// The compacted pages no longer refer to their flushed blocks
+	w.CompactAll()
+	if err := s.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s = newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	count := 0
+	itr := s.NewIterator()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		if v := skiplist.IntFromItem(itr.Get()); v != count {
+			t.Fatalf("expected %d, got %d", count, v)
+		}
+		count++
+	}
+	itr.(*Iterator).Close()
+
+	if count != n {
+		t.Errorf("expected %d items, got %d", n, count)
+	}
+}
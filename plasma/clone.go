@@ -0,0 +1,140 @@
+package plasma
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Clone creates a copy of the instance at path and opens it with the same
+// config. The segments of the LSS written so far are shared with the copy
+// through hard links instead of being copied, hence path must be on the
+// same file system. Both instances leave the shared segments intact and
+// append to segments of their own, so that their writes diverge.
+//
+// The items persisted when Clone is called are part of the copy. Instances
+// with a value log or a tier cannot be cloned.
+func (s *Plasma) Clone(path string) (*Plasma, error) {
+	if !s.shouldPersist || s.InMemoryLog {
+		return nil, ErrNoLog
+	} else if s.readOnly {
+		return nil, ErrReadOnly
+	} else if s.vlog != nil {
+		return nil, ErrValueLog
+	} else if s.TierStore != nil || s.TierDir != "" {
+		return nil, ErrCloneNotSupported
+	} else if isInstanceOpen(path) {
+		return nil, ErrInUse
+	}
+
+	if _, err := os.Stat(filepath.Join(path, headerFileName)); err == nil {
+		return nil, ErrNotEmpty
+	}
+
+	s.PersistAll()
+	s.lss.Commit()
+	if err := s.lss.Clone(path); err != nil {
+		DestroyInstance(path)
+		return nil, err
+	}
+
+	cfg := s.Config
+	cfg.File = path
+	return New(cfg)
+}
+
+func (s *lsStore) Clone(path string) error {
+	c, ok := s.log.(interface {
+		Clone(string) error
+	})
+	if !ok {
+		return ErrCloneNotSupported
+	}
+
+	// Ranges are not dropped while the segments are being linked
+	s.Lock()
+	defer s.Unlock()
+
+	return c.Clone(path)
+}
+
+// Clone creates a copy of the log at path. The superblock is copied first,
+// so that the segments hold at least the committed range of the log. The
+// segments before the one of the committed tail are hard linked, while the
+// ones which may still be appended to by either log are copied.
+func (l *multiFilelog) Clone(path string) error {
+	if l.readOnly {
+		return ErrReadOnly
+	}
+
+	// Segments are neither added nor removed meanwhile
+	l.indexLock.Lock()
+	defer l.indexLock.Unlock()
+
+	idx := l.getIndex()
+	for _, lf := range idx.index {
+		if lf.remote {
+			return ErrLogSegmentTiered
+		}
+	}
+
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return err
+	}
+
+	header := filepath.Join(path, headerFileName)
+	if err := copyFile(l.sbFd.Name(), header); err != nil {
+		return err
+	}
+
+	fd, err := os.Open(header)
+	if err != nil {
+		return err
+	}
+
+	sb, _, err := readLogSB(fd, make([]byte, logSBSize))
+	fd.Close()
+	if err != nil {
+		return err
+	}
+
+	for i, lf := range idx.index {
+		start := idx.startOffset + int64(i)*l.segmentSize
+		src := lf.fd.Name()
+		dst := filepath.Join(path, filepath.Base(src))
+		if start+l.segmentSize <= sb.tail {
+			err = os.Link(src, dst)
+		} else {
+			err = copyFile(src, dst)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(w, r); err == nil {
+		err = w.Sync()
+	}
+
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
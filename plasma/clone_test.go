@@ -0,0 +1,96 @@
+package plasma
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPlasmaClone(t *testing.T) {
+	os.RemoveAll("teststore.clone")
+	os.RemoveAll("teststore.clone2")
+	defer os.RemoveAll("teststore.clone")
+	defer os.RemoveAll("teststore.clone2")
+
+	cfg := testSnCfg
+	cfg.File = "teststore.clone"
+	cfg.AutoLSSCleaning = false
+	cfg.LSSLogSegmentSize = 1024 * 1024
+	s := newTestIntPlasmaStore(cfg)
+
+	n := 20000
+	w := s.NewWriter()
+	for i := 0; i < n; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte(fmt.Sprintf("val-%10d", i)))
+	}
+
+	c, err := s.Clone("teststore.clone2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Clone("teststore.clone2"); err != ErrInUse {
+		t.Errorf("expected %v, got %v", ErrInUse, err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join("teststore.clone", segFilePattern))
+	var shared int
+	for _, f := range files {
+		if fd, err := os.Open(f); err == nil {
+			if fileShared(fd) {
+				shared++
+			}
+			fd.Close()
+		}
+	}
+
+	if shared == 0 {
+		t.Fatalf("expected segments to be shared, got %d of %d", shared, len(files))
+	}
+
+	if err := s.lss.(*lsStore).log.(*multiFilelog).WriteAt([]byte("x"), 0); err != ErrLogSegmentShared {
+		t.Errorf("expected %v, got %v", ErrLogSegmentShared, err)
+	}
+
+	// Writes diverge and the stale segments are cleaned by both instances
+	cw := c.NewWriter()
+	for i := 0; i < n; i++ {
+		k := []byte(fmt.Sprintf("key-%10d", i))
+		w.DeleteKV(k)
+		w.InsertKV(k, []byte("source"))
+		cw.DeleteKV(k)
+		cw.InsertKV(k, []byte("clone"))
+	}
+
+	for _, db := range []*Plasma{s, c} {
+		db.PersistAll()
+		if err := db.CleanLSS(func() bool { return true }); err != nil {
+			t.Fatal(err)
+		}
+		db.lss.Commit()
+	}
+
+	c.Close()
+	s.Close()
+
+	for _, path := range []string{"teststore.clone", "teststore.clone2"} {
+		cfg.File = path
+		s = newTestIntPlasmaStore(cfg)
+		w = s.NewWriter()
+
+		val := "source"
+		if path == "teststore.clone2" {
+			val = "clone"
+		}
+
+		for i := 0; i < n; i++ {
+			k := fmt.Sprintf("key-%10d", i)
+			if v, err := w.LookupKV([]byte(k)); err != nil || string(v) != val {
+				t.Fatalf("%s: %s: expected %q, got %q (err=%v)", path, k, val, v, err)
+			}
+		}
+
+		s.Close()
+	}
+}
@@ -0,0 +1,79 @@
+package plasma
+
+import (
+	"github.com/couchbase/nitro/skiplist"
+	"sync/atomic"
+	"unsafe"
+)
+
+// CompactionFilterFn decides whether an item should be purged when its
+// page is compacted or relocated by the LSS cleaner
+type CompactionFilterFn func(itm unsafe.Pointer) (drop bool)
+
+// Wraps the compaction filter to drop items matching a predicate along with
+// any older versions of the same item which would otherwise become visible.
+type dropFilter struct {
+	ItemFilter
+
+	drop    func(unsafe.Pointer) bool
+	cmp     skiplist.CompareFn
+	dropped unsafe.Pointer
+	count   *int64
+}
+
+func (s *Plasma) newDropFilter(f ItemFilter, drop func(unsafe.Pointer) bool, count *int64) ItemFilter {
+	return &dropFilter{
+		ItemFilter: f,
+		drop:       drop,
+		cmp:        s.cmp,
+		count:      count,
+	}
+}
+
+func (s *Plasma) newCompactionFilter(f ItemFilter) ItemFilter {
+	return s.newDropFilter(f, s.Config.CompactionFilter, &s.numFiltered)
+}
+
+func (f *dropFilter) Process(o PageItem) PageItemsList {
+	l := f.ItemFilter.Process(o)
+	if l.Len() == 0 {
+		return l
+	}
+
+	var items []PageItem
+	for i := 0; i < l.Len(); i++ {
+		pi := l.At(i)
+		itm := pi.Item()
+		if f.dropped != nil {
+			if f.cmp(itm, f.dropped) == 0 {
+				continue
+			}
+			f.dropped = nil
+		}
+
+		if pi.IsInsert() && f.drop(itm) {
+			f.dropped = itm
+			atomic.AddInt64(f.count, 1)
+			continue
+		}
+
+		items = append(items, pi)
+	}
+
+	if len(items) == 0 {
+		return nilPageItemsList
+	} else if len(items) == l.Len() {
+		return l
+	}
+
+	return (*pageItemsList)(&items)
+}
+
+func (f *dropFilter) Reset() {
+	f.ItemFilter.Reset()
+	f.dropped = nil
+}
+
+func (s *Plasma) hasCompactionFilters() bool {
+	return s.Config.ItemExpiryGetter != nil || s.Config.CompactionFilter != nil
+}
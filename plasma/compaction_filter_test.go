@@ -0,0 +1,41 @@
+package plasma
+
+import (
+	"github.com/couchbase/nitro/skiplist"
+	"os"
+	"testing"
+	"unsafe"
+)
+
+func TestPlasmaCompactionFilter(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	cfg := testCfg
+	cfg.CompactionFilter = func(itm unsafe.Pointer) bool {
+		return skiplist.IntFromItem(itm) < 1000
+	}
+
+	s := newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	w := s.NewWriter()
+	n := 10000
+	for i := 0; i < n; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+
+	w.CompactAll()
+
+	for i := 0; i < n; i++ {
+		itm := skiplist.NewIntKeyItem(i)
+		got, _ := w.Lookup(itm)
+		if i < 1000 && got != nil {
+			t.Errorf("expected %d to be purged", i)
+		} else if i >= 1000 && got == nil {
+			t.Errorf("expected %d to be found", i)
+		}
+	}
+
+	if sts := s.GetStats(); sts.FilteredItems != 1000 {
+		t.Errorf("expected %d filtered items, got %d", 1000, sts.FilteredItems)
+	}
+}
@@ -0,0 +1,79 @@
+package plasma
+
+import (
+	"github.com/golang/snappy"
+	"sync/atomic"
+	"unsafe"
+)
+
+// compressPage returns the snappy compressed image of a resident page. No
+// image is returned once the compressed pages exceed their quota.
+func (s *Plasma) compressPage(pg Page, ctx *wCtx) ([]byte, bool) {
+	if !s.CompressedCache || pg.(*page).head.state.IsEvicted() {
+		return nil, false
+	}
+
+	if atomic.LoadInt64(&s.compressedMemUsed) >= s.compressedCacheQuota() {
+		return nil, false
+	}
+
+	bs, _, _, _, err := pg.Marshal(ctx.GetBuffer(bufCompressPage), FullMarshal)
+	if err != nil {
+		return nil, false
+	}
+
+	return snappy.Encode(nil, bs), true
+}
+
+func (s *Plasma) compressedCacheQuota() int64 {
+	if s.CompressedCacheQuota > 0 {
+		return s.CompressedCacheQuota
+	}
+
+	quota := atomic.LoadInt64(&s.Config.MemQuota)
+	if quota == 0 {
+		quota = atomic.LoadInt64(&memQuota)
+	}
+
+	return quota / 4
+}
+
+// compressedSize returns the size of the compressed page images held by
+// the deltas starting from pd
+func compressedSize(pd *pageDelta) int {
+	var sz int
+	for ; pd != nil; pd = pd.next {
+		switch pd.op {
+		case opPageMergeDelta:
+			sz += compressedSize((*mergePageDelta)(unsafe.Pointer(pd)).mergeSibling)
+		case opSwapoutDelta:
+			return sz + int((*swapoutDelta)(unsafe.Pointer(pd)).dataLen)
+		case opBasePage:
+			return sz
+		}
+	}
+
+	return sz
+}
+
+// fetchSwapoutPage reads the page referred to by a swapout delta from the
+// compressed image in memory if available or from the LSS
+func (s *Plasma) fetchSwapoutPage(sod *swapoutDelta, ctx *wCtx,
+	aCtx *allocCtx, sCtx *storeCtx) (*page, error) {
+
+	if sod.dataLen == 0 {
+		return s.fetchPageFromLSS2(sod.offset, ctx, aCtx, sCtx)
+	}
+
+	data, err := snappy.Decode(ctx.GetBuffer(bufDecompress), sod.Data())
+	if err != nil {
+		return nil, ErrCorruptPage
+	}
+
+	ctx.sts.NumCompressedReads++
+	pg := newPage2(nil, nil, ctx, sCtx, aCtx).(*page)
+	pg.unmarshalDelta(data, ctx)
+	pg.AddFlushRecord(sod.offset, int(sod.flushDataSz), int(sod.numSegments))
+	pg.head.rightSibling = pg.getPageId(pg.head.hiItm, ctx)
+	return pg, nil
+}
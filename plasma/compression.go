@@ -0,0 +1,98 @@
+package plasma
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"sync"
+)
+
+// Compression selects the codec used for page blocks written to the LSS
+type Compression uint8
+
+const (
+	CompressionNone Compression = iota
+	CompressionSnappy
+	CompressionZstd
+)
+
+// The codec of a block is recorded in the high byte of its block type so
+// that logs written with different codecs remain readable
+const (
+	lssBlockTypeMask   = 0x00ff
+	lssBlockCodecShift = 8
+)
+
+var (
+	zstdOnce sync.Once
+	zstdEnc  *zstd.Encoder
+	zstdDec  *zstd.Decoder
+)
+
+func initZstd() {
+	zstdOnce.Do(func() {
+		zstdEnc, _ = zstd.NewWriter(nil)
+		zstdDec, _ = zstd.NewReader(nil)
+	})
+}
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionSnappy:
+		return "snappy"
+	case CompressionZstd:
+		return "zstd"
+	}
+
+	return fmt.Sprintf("unknown(%d)", uint8(c))
+}
+
+func getLSSBlockCodec(bs []byte) Compression {
+	return Compression(binary.BigEndian.Uint16(bs) >> lssBlockCodecShift)
+}
+
+func withCodec(typ lssBlockType, c Compression) lssBlockType {
+	return typ | lssBlockType(c)<<lssBlockCodecShift
+}
+
+// Compress an encoded page using the configured codec. The returned block
+// type carries the codec used.
+func (s *Plasma) compressPageBlock(typ lssBlockType, bs []byte) (lssBlockType, []byte) {
+	switch s.Config.Compression {
+	case CompressionSnappy:
+		return withCodec(typ, CompressionSnappy), snappy.Encode(nil, bs)
+	case CompressionZstd:
+		initZstd()
+		return withCodec(typ, CompressionZstd), zstdEnc.EncodeAll(bs, nil)
+	}
+
+	return typ, bs
+}
+
+// Returns the decoded page payload of a page block read from the LSS
+func (s *Plasma) decompressPageBlock(bs []byte, ctx *wCtx) ([]byte, error) {
+	data := bs[lssBlockTypeSize:]
+	buf := ctx.GetBuffer(bufDecompress)
+
+	var err error
+	switch c := getLSSBlockCodec(bs); c {
+	case CompressionNone:
+		return data, nil
+	case CompressionSnappy:
+		data, err = snappy.Decode(buf, data)
+	case CompressionZstd:
+		initZstd()
+		data, err = zstdDec.DecodeAll(data, buf[:0])
+	default:
+		return nil, fmt.Errorf("Unknown page block codec %d: %w", c, ErrCorruptLog)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("Page block decompression failed (%v): %w", err, ErrCorruptLog)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,53 @@
+package plasma
+
+import (
+	"github.com/couchbase/nitro/skiplist"
+	"os"
+	"testing"
+)
+
+func TestPlasmaCompressionMixedLog(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	n := 100000
+	codecs := []Compression{CompressionSnappy, CompressionZstd, CompressionNone}
+
+	for i, codec := range codecs {
+		cfg := testCfg
+		cfg.Compression = codec
+		s := newTestIntPlasmaStore(cfg)
+		w := s.NewWriter()
+
+		for j := i * n; j < (i+1)*n; j++ {
+			w.Insert(skiplist.NewIntKeyItem(j))
+		}
+
+		s.EvictAll(0)
+		for j := 0; j < (i+1)*n; j++ {
+			itm := skiplist.NewIntKeyItem(j)
+			got, err := w.Lookup(itm)
+			if err != nil || got == nil || skiplist.CompareInt(itm, got) != 0 {
+				t.Fatalf("codec %v: lookup %d failed (err=%v)", codec, j, err)
+			}
+		}
+
+		s.PersistAll()
+		s.Close()
+	}
+
+	s := newTestIntPlasmaStore(testCfg)
+	defer s.Close()
+
+	count := 0
+	itr := s.NewIterator()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		if v := skiplist.IntFromItem(itr.Get()); v != count {
+			t.Errorf("expected %d, got %d", count, v)
+		}
+		count++
+	}
+	itr.(*Iterator).Close()
+
+	if count != len(codecs)*n {
+		t.Errorf("expected %d items, got %d", len(codecs)*n, count)
+	}
+}
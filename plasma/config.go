@@ -3,6 +3,7 @@ package plasma
 import (
 	"github.com/couchbase/nitro/skiplist"
 	"runtime"
+	"time"
 	"unsafe"
 )
 
@@ -14,26 +15,224 @@ type Config struct {
 	Compare            skiplist.CompareFn
 	ItemSize           ItemSizeFn
 
+	// Expired items and items selected by the compaction filter are
+	// dropped during page compaction and LSS cleaning
+	ItemExpiryGetter ItemExpiryFn
+	CompactionFilter CompactionFilterFn
+
 	LSSLogSegmentSize   int64
 	File                string
 	FlushBufferSize     int
 	NumPersistorThreads int
 	NumEvictorThreads   int
 
+	// Number of goroutines used to decode page blocks during recovery.
+	// Page table updates are always applied in log order.
+	NumRecoveryThreads int
+
+	// Called periodically while the log is replayed on open
+	RecoveryProgressCallback RecoveryProgressFn
+
+	// Record the pages in memory along with their eviction policy state in
+	// the LSS every HeatMapInterval and when the instance is closed.
+	// Warmup swaps in the recorded pages first, starting with the hottest
+	// ones, after the instance is reopened. The heat map is only recorded
+	// on close if HeatMapInterval is zero.
+	RecordHeatMap   bool
+	HeatMapInterval time.Duration
+
+	// Only decode the headers of the page blocks while the log is replayed
+	// on open. The pages are mapped as evicted and read from the log on
+	// first access, which reduces the recovery time and the memory used
+	// when few pages are accessed after recovery. NumRecoveryThreads is
+	// not used in this mode.
+	LazyRecovery bool
+
+	// Verify on open that the items visible at the last recovery point
+	// match the count and the checksum of the keys recorded with it, which
+	// fails the open with a RecoveryMismatchError otherwise. This scans the
+	// items of the recovery point and assumes that no writes were in
+	// progress while its snapshot was created.
+	VerifyRecovery bool
+
 	LSSCleanerThreshold int
 	AutoLSSCleaning     bool
 	AutoSwapper         bool
 
+	// Rewrite pages whose records span at least DefragThreshold
+	// allocations into a single contiguous base page
+	AutoDefrag      bool
+	DefragThreshold int
+
+	// Number of pages following the current page of a forward scan which
+	// are fetched from the LSS in the background, so that the reads of the
+	// scan overlap with its processing. There is no read-ahead if zero.
+	ReadAheadPages int
+
+	// Interval in seconds between page table checkpoints, which allow
+	// recovery to replay only the log written after the last checkpoint.
+	// Checkpoints are disabled if set to zero.
+	CheckpointInterval int
+
 	EnableShapshots bool
 
+	// Retention limits for recovery points. The oldest recovery points are
+	// removed once there are more than MaxRecoveryPoints or once they are
+	// older than RecoveryPointMaxAge, so that the snapshots they hold can
+	// be garbage collected. The most recent recovery point is always
+	// retained. No limit applies if set to zero.
+	MaxRecoveryPoints   int
+	RecoveryPointMaxAge time.Duration
+
 	TriggerSwapper func(SwapperContext) bool
 	shouldPersist  bool
+	readOnly       bool
+	salvage        *RepairReport
+
+	// Evict only the part of a page written by its previous flush and
+	// keep the records added since in memory, so that lookups of recently
+	// written keys do not need to read the page from the LSS. The retained
+	// records are evicted when the page is picked for eviction again.
+	PartialEviction bool
+
+	// Keep evicted pages compressed in memory and swap them out to the
+	// LSS only when they are picked for eviction again
+	CompressedCache bool
+
+	// Memory budget in bytes of the compressed pages, which is charged to
+	// the memory in use like any other page. Pages are evicted to the LSS
+	// directly once it is exceeded. Defaults to a quarter of the memory
+	// quota.
+	CompressedCacheQuota int64
+
+	// Receives spans for slow internal operations when set
+	Tracer Tracer
+
+	// Receives log messages. Defaults to stderr.
+	Logger Logger
+
+	// Panic on the violation of an internal invariant, e.g. to get the
+	// stack of the violation in tests. Otherwise the violation is logged
+	// and the later operations on the instance fail with ErrInvariant.
+	DebugPanics bool
+
+	// Inserts, deletes, lookups and LSS page reads taking longer than
+	// this duration are logged. Disabled if set to zero.
+	SlowOpThreshold time.Duration
+
+	// Policy used by the swapper to pick the pages to be evicted.
+	// Defaults to the clock policy.
+	EvictionPolicy EvictionPolicy
+
+	// Memory budget in bytes for this instance. Pages are evicted once
+	// either this quota or the process wide quota is exceeded. There is no
+	// per-instance limit if set to zero.
+	MemQuota int64
 
 	MaxSnSyncFrequency int
 	SyncInterval       int
 
+	// When writes to the LSS are made durable. Plasma.Sync makes the
+	// writes durable on demand irrespective of the mode.
+	SyncMode SyncMode
+
+	// Called with the error of every failed write to the LSS, e.g. to
+	// raise an alert on a full disk
+	OnIOError func(error)
+
+	// Number of times a failed write to the LSS is retried, one second
+	// apart, before the instance gives up on the log. Inserts and deletes
+	// then fail with an error wrapping ErrLogWrite and the cause, pages are
+	// no longer evicted and the instance has to be reopened once the cause
+	// is fixed. Failed writes are retried forever if set to zero.
+	IOErrorRetries int
+
+	// Space in bytes the LSS and the value log may use. Once it is
+	// exceeded or a write to the LSS fails since the disk is full, the
+	// instance enters the read-only mode, in which lookups and iterators
+	// keep working but inserts and deletes fail with ErrReadOnlyMode until
+	// Plasma.ClearReadOnlyMode is called. There is no limit if set to zero.
+	MaxDiskUsage int64
+
+	// Space in bytes the LSS may use. Once the used space approaches the
+	// quota, the cleaner runs irrespective of LSSCleanerThreshold and
+	// cleans as much as it can. Inserts and deletes fail with an error
+	// wrapping ErrQuotaExceeded while the quota is exceeded. There is no
+	// quota if set to zero.
+	MaxLSSUsedSpace int64
+
 	UseMemoryMgmt bool
 	UseMmap       bool
+
+	// Append to the LSS using O_DIRECT, bypassing the page cache. Flush
+	// buffers are padded to 4K and the segment size has to be a multiple
+	// of 4K.
+	DirectIO bool
+
+	// Engine used to read and append to the LSS files
+	IOEngine IOEngine
+
+	// Allocate the space of the next segment files of the LSS and of the
+	// value log in the background and reuse the files of trimmed segments
+	// instead of removing them, so that appends do not wait for files to
+	// be created and allocated. Only applies to the segment files stored
+	// in File.
+	PreallocateSegments bool
+
+	// Opens the logs of the LSS and of the value log in place of the
+	// segment files stored in File. UseMmap, DirectIO and IOEngine only
+	// apply to the segment files.
+	LogFactory LogFactory
+
+	// Keep the LSS and the value log in memory instead of in File, e.g.
+	// for tests and ephemeral indexes. Evicted pages, snapshots and
+	// recovery points work as with a log on disk, but nothing survives
+	// the instance and checkpoints are disabled.
+	InMemoryLog bool
+
+	// Move the segments of the LSS, except for the most recent
+	// TierLocalSegments ones, to TierStore. Pages are read from the moved
+	// segments through a cache of TierCacheSize bytes. TierDir is a
+	// shortcut for a store which keeps the segments in a directory, e.g.
+	// on a cheaper disk. Segments are moved by the LSS cleaner and only
+	// the segment files stored in File can be moved.
+	TierStore         BlobStore
+	TierDir           string
+	TierLocalSegments int
+	TierCacheSize     int64
+
+	// Called with the raw bytes of the LSS before the cleaner discards
+	// them, e.g. to archive the log for audits or point in time recovery.
+	// Every byte is passed once. The ranges trimmed from the head are
+	// passed in log order, while the ranges of stale blocks dropped from
+	// the middle of the log are passed when they are dropped. The range
+	// is kept and cleaning stops if the callback returns an error.
+	OnSegmentRetire SegmentRetireCallback
+
+	// Encode base pages written to the LSS with shared key prefixes
+	// removed. Pages in either format can always be read back.
+	UsePrefixCompression bool
+
+	// Codec used to compress page blocks written to the LSS
+	Compression Compression
+
+	// AES key (16, 24 or 32 bytes) used to encrypt LSS blocks with
+	// AES-GCM. A log must always be opened with the key it was written
+	// with, otherwise opening it fails with ErrEncryptionKey.
+	EncryptionKey []byte
+
+	// Values of at least ValueLogThreshold bytes are written to a separate
+	// value log and the pages only hold a pointer to them. The value log
+	// is cleaned once ValueLogCleanerThreshold percent of it has been
+	// written since it was last cleaned. Disabled if set to zero.
+	ValueLogThreshold        int
+	ValueLogCleanerThreshold int
+
+	// Maximum size of the key and value of an item. Values of items which
+	// do not fit into a page are stored as a chain of blocks in the value
+	// log, which is only available for persistent instances. Defaults to
+	// the largest item which fits into a page.
+	MaxItemSize int
 }
 
 func applyConfigDefaults(cfg Config) Config {
@@ -49,13 +248,37 @@ func applyConfigDefaults(cfg Config) Config {
 		cfg.TriggerSwapper = QuotaSwapper
 	}
 
-	if cfg.File == "" {
+	if cfg.Logger == nil {
+		cfg.Logger = NewStderrLogger()
+	}
+
+	if cfg.EvictionPolicy == nil {
+		cfg.EvictionPolicy = NewClockPolicy()
+	}
+
+	if cfg.InMemoryLog {
+		cfg.shouldPersist = true
+		cfg.LogFactory = openMemLog
+		cfg.CheckpointInterval = 0
+	} else if cfg.File == "" {
 		cfg.AutoLSSCleaning = false
 		cfg.AutoSwapper = false
+		cfg.AutoDefrag = false
+		cfg.CheckpointInterval = 0
+		cfg.RecoveryPointMaxAge = 0
+		cfg.ValueLogThreshold = 0
+		cfg.RecordHeatMap = false
 	} else {
 		cfg.shouldPersist = true
 	}
 
+	if cfg.readOnly {
+		cfg.AutoLSSCleaning = false
+		cfg.AutoDefrag = false
+		cfg.RecoveryPointMaxAge = 0
+		cfg.RecordHeatMap = false
+	}
+
 	if cfg.MaxSnSyncFrequency == 0 {
 		cfg.MaxSnSyncFrequency = 360000
 	}
@@ -68,6 +291,30 @@ func applyConfigDefaults(cfg Config) Config {
 		cfg.MaxPageLSSSegments = 4
 	}
 
+	if cfg.DefragThreshold == 0 {
+		cfg.DefragThreshold = 32
+	}
+
+	if cfg.ValueLogCleanerThreshold == 0 {
+		cfg.ValueLogCleanerThreshold = 50
+	}
+
+	if cfg.TierStore == nil && cfg.TierDir != "" {
+		cfg.TierStore = NewDirBlobStore(cfg.TierDir)
+	}
+
+	if cfg.TierLocalSegments == 0 {
+		cfg.TierLocalSegments = 2
+	}
+
+	if cfg.TierCacheSize == 0 {
+		cfg.TierCacheSize = 64 * 1024 * 1024
+	}
+
+	if cfg.MaxItemSize == 0 || (!cfg.shouldPersist && cfg.MaxItemSize > maxInlineKVSize) {
+		cfg.MaxItemSize = maxInlineKVSize
+	}
+
 	return cfg
 }
 
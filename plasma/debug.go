@@ -0,0 +1,254 @@
+package plasma
+
+import (
+	"fmt"
+	"github.com/couchbase/nitro/skiplist"
+	"io"
+	"sync/atomic"
+	"unsafe"
+)
+
+// DebugDump writes a snapshot of the instance state for diagnostics.
+// The dump is best effort and does not stop concurrent operations.
+func (s *Plasma) DebugDump(w io.Writer) {
+	fmt.Fprintf(w, "===== Plasma Dump =====\n")
+	s.dumpConfig(w)
+	s.dumpDaemons(w)
+	s.dumpFlushBuffers(w)
+	s.dumpSnapshots(w)
+	s.dumpWriters(w)
+	s.dumpPageTable(w)
+}
+
+func (s *Plasma) dumpConfig(w io.Writer) {
+	cfg := s.Config
+	fmt.Fprintf(w, "----- config -----\n"+
+		"file                   = %s\n"+
+		"max_delta_chain_len    = %d\n"+
+		"max_page_items         = %d\n"+
+		"min_page_items         = %d\n"+
+		"max_page_lss_segments  = %d\n"+
+		"lss_log_segment_size   = %d\n"+
+		"flush_buffer_size      = %d\n"+
+		"num_persistor_threads  = %d\n"+
+		"num_evictor_threads    = %d\n"+
+		"lss_cleaner_threshold  = %d\n"+
+		"enable_snapshots       = %v\n"+
+		"max_sn_sync_frequency  = %d\n"+
+		"sync_interval          = %d\n"+
+		"sync_mode              = %d\n"+
+		"use_memory_mgmt        = %v\n"+
+		"use_mmap               = %v\n"+
+		"direct_io              = %v\n"+
+		"io_engine              = %d\n"+
+		"custom_log             = %v\n"+
+		"in_memory_log          = %v\n"+
+		"tier_store             = %v\n"+
+		"tier_local_segments    = %d\n"+
+		"tier_cache_size        = %d\n"+
+		"segment_retire         = %v\n",
+		cfg.File, cfg.MaxDeltaChainLen, cfg.MaxPageItems, cfg.MinPageItems,
+		cfg.MaxPageLSSSegments, cfg.LSSLogSegmentSize, cfg.FlushBufferSize,
+		cfg.NumPersistorThreads, cfg.NumEvictorThreads,
+		cfg.LSSCleanerThreshold, cfg.EnableShapshots,
+		cfg.MaxSnSyncFrequency, cfg.SyncInterval, cfg.SyncMode,
+		cfg.UseMemoryMgmt, cfg.UseMmap, cfg.DirectIO, cfg.IOEngine,
+		cfg.LogFactory != nil, cfg.InMemoryLog,
+		cfg.TierStore != nil, cfg.TierLocalSegments, cfg.TierCacheSize,
+		cfg.OnSegmentRetire != nil)
+}
+
+func (s *Plasma) dumpDaemons(w io.Writer) {
+	fmt.Fprintf(w, "----- daemons -----\n"+
+		"persist             = %v\n"+
+		"lss_cleaner         = %v\n"+
+		"swapper             = %v\n"+
+		"defrag              = %v\n"+
+		"checkpoint_interval = %d\n"+
+		"memory_pressure     = %v\n"+
+		"memory_quota        = %d\n"+
+		"instance_mem_quota  = %d\n"+
+		"memory_in_use       = %d\n",
+		s.shouldPersist, s.AutoLSSCleaning, s.AutoSwapper,
+		s.AutoDefrag, s.CheckpointInterval, s.hasMemoryPressure, atomic.LoadInt64(&memQuota),
+		atomic.LoadInt64(&s.MemQuota), s.MemoryInUse())
+}
+
+func (s *Plasma) dumpFlushBuffers(w io.Writer) {
+	fmt.Fprintf(w, "----- lss -----\n")
+	if !s.shouldPersist {
+		fmt.Fprintf(w, "(not persistent)\n")
+		return
+	}
+
+	fmt.Fprintf(w, "head_offset = %d\n"+
+		"tail_offset = %d\n"+
+		"used_space  = %d\n"+
+		"data_size   = %d\n",
+		s.lss.HeadOffset(), s.lss.TailOffset(),
+		s.lss.UsedSpace(), s.LSSDataSize())
+
+	lss, ok := s.lss.(*lsStore)
+	if !ok {
+		return
+	}
+
+	fb := lss.currBuf()
+	for i := 0; i < lss.nbufs; i++ {
+		isfull, reset, nw, offset := decodeState(atomic.LoadUint64(&fb.state))
+		fmt.Fprintf(w, "flush_buffer[%d] seqno:%d base:%d used:%d/%d writers:%d full:%v reset:%v\n",
+			i, fb.seqno, fb.StartOffset(), offset, len(fb.b), nw, isfull, reset)
+		fb = fb.NextBuffer()
+	}
+}
+
+func (s *Plasma) dumpSnapshots(w io.Writer) {
+	fmt.Fprintf(w, "----- snapshots -----\n")
+	if !s.EnableShapshots {
+		fmt.Fprintf(w, "(disabled)\n")
+		return
+	}
+
+	s.mvcc.RLock()
+	defer s.mvcc.RUnlock()
+
+	currSn := atomic.LoadUint64(&s.currSn)
+	gcSn := atomic.LoadUint64(&s.gcSn)
+	fmt.Fprintf(w, "curr_sn       = %d\n"+
+		"gc_sn         = %d\n"+
+		"open_sn_range = %d\n"+
+		"max_sn        = %d\n"+
+		"items_count   = %d\n",
+		currSn, gcSn, currSn-gcSn, atomic.LoadUint64(&s.lastMaxSn), s.itemsCount)
+
+	fmt.Fprintf(w, "recovery_points (version:%d)\n", s.rpVersion)
+	for i, rp := range s.recoveryPoints {
+		fmt.Fprintf(w, "rp[%d] sn:%d count:%d meta_len:%d\n", i, rp.sn, rp.count, len(rp.meta))
+	}
+}
+
+func (s *Plasma) dumpWriters(w io.Writer) {
+	fmt.Fprintf(w, "----- writers -----\n")
+	s.RLock()
+	defer s.RUnlock()
+
+	for i, wr := range s.wlist {
+		sts := wr.sts
+		fmt.Fprintf(w, "writer[%d] inserts:%d deletes:%d compacts:%d splits:%d merges:%d "+
+			"lss_reads:%d cache_hits:%d cache_misses:%d reclaim_pending:%d\n",
+			i, sts.Inserts, sts.Deletes, sts.Compacts, sts.Splits, sts.Merges,
+			sts.NumLSSReads, sts.CacheHits, sts.CacheMisses, len(wr.reclaimList))
+	}
+}
+
+func (s *Plasma) dumpPageTable(w io.Writer) {
+	var numPages, numFlushed, numEvicted, numRemoved int
+	var maxChainLen int
+
+	callb := func(pid PageId, partn RangePartition) error {
+		pd := (*pageDelta)(atomic.LoadPointer(&pid.(*skiplist.Node).Link))
+		numPages++
+		if pd == nil {
+			return nil
+		}
+
+		if pd.state.IsFlushed() {
+			numFlushed++
+		}
+
+		switch pd.op {
+		case opSwapoutDelta:
+			numEvicted++
+		case opPageRemoveDelta:
+			numRemoved++
+		}
+
+		if int(pd.chainLen) > maxChainLen {
+			maxChainLen = int(pd.chainLen)
+		}
+		return nil
+	}
+
+	barrier := s.Skiplist.GetAccesBarrier()
+	token := barrier.Acquire()
+	partn := RangePartition{MinKey: skiplist.MinItem, MaxKey: skiplist.MaxItem}
+	s.VisitPartition(partn, callb)
+	barrier.Release(token)
+
+	fmt.Fprintf(w, "----- page table -----\n"+
+		"num_pages       = %d\n"+
+		"flushed_pages   = %d\n"+
+		"evicted_pages   = %d\n"+
+		"removed_pages   = %d\n"+
+		"max_chain_len   = %d\n"+
+		"index_mem_size  = %d\n",
+		numPages, numFlushed, numEvicted, numRemoved, maxChainLen,
+		s.GetStats().MemSzIndex)
+}
+
+// PageDiag describes the state of a page for diagnostics
+type PageDiag struct {
+	// Lowest key of the page, which is only valid during the callback
+	MinItem unsafe.Pointer
+	// Number of deltas on top of the base page
+	ChainLen int
+	// Number of items of the base page
+	NumItems int
+	// Memory used by the resident part of the page
+	MemSz int
+	// Size of the lss data of the page
+	FlushDataSz int
+	// Number of lss blocks the page is read from
+	NumSegments int
+
+	Flushed    bool
+	Evicted    bool
+	Compressed bool
+}
+
+// PageStatsVisitor calls callb for every page in key order without reading
+// pages from the lss, e.g. to find pages with long delta chains causing
+// latency spikes. Concurrent operations are not blocked.
+func (s *Plasma) PageStatsVisitor(callb func(PageDiag)) {
+	s.estimateLock.Lock()
+	defer s.estimateLock.Unlock()
+
+	ctx := s.estimateWriter
+	tok := ctx.BeginTx()
+	defer ctx.EndTx(tok)
+
+	s.walkRange(nil, nil, ctx, func(pg *page) {
+		diag := PageDiag{MinItem: pg.MinItem()}
+		if pd := pg.head; pd != nil {
+			diag.ChainLen = int(pd.chainLen)
+			diag.NumItems = int(pd.numItems)
+			diag.MemSz = pg.ComputeMemUsed()
+			diag.FlushDataSz = flushedDataSize(pd)
+			diag.NumSegments = pageNumSegments(pd)
+			diag.Flushed = pd.state.IsFlushed()
+			diag.Evicted = pd.state.IsEvicted()
+			diag.Compressed = pg.IsCompressed()
+		}
+
+		callb(diag)
+	})
+}
+
+// pageNumSegments returns the number of lss blocks recorded by the most
+// recent flush of a page
+func pageNumSegments(pd *pageDelta) int {
+	for ; pd != nil; pd = pd.next {
+		switch pd.op {
+		case opBasePage:
+			return 0
+		case opFlushPageDelta, opRelocPageDelta:
+			return int((*flushPageDelta)(unsafe.Pointer(pd)).numSegments)
+		case opSwapoutDelta:
+			return int((*swapoutDelta)(unsafe.Pointer(pd)).numSegments)
+		case opSwapinDelta:
+			return pageNumSegments((*swapinDelta)(unsafe.Pointer(pd)).ptr)
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,86 @@
+package plasma
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/couchbase/nitro/skiplist"
+	"os"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func TestPlasmaDebugDump(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testSnCfg)
+	defer s.Close()
+
+	w := s.NewWriter()
+	for i := 0; i < 10000; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte(fmt.Sprintf("val-%10d", i)))
+	}
+
+	snap := s.NewSnapshot()
+	s.CreateRecoveryPoint(snap, []byte("rp1"))
+
+	var buf bytes.Buffer
+	s.DebugDump(&buf)
+	out := buf.String()
+
+	for _, section := range []string{"config", "daemons", "lss", "snapshots", "writers", "page table"} {
+		if !strings.Contains(out, "----- "+section+" -----") {
+			t.Errorf("missing section %s", section)
+		}
+	}
+
+	if !strings.Contains(out, "rp[0]") {
+		t.Errorf("expected recovery point in dump")
+	}
+
+	if !strings.Contains(out, "writer[0] inserts:10000") {
+		t.Errorf("expected writer stats in dump")
+	}
+}
+
+func TestPageStatsVisitor(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testCfg)
+	defer s.Close()
+
+	w := s.NewWriter()
+	for i := 0; i < 100000; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+
+	var pages, items int
+	s.PageStatsVisitor(func(d PageDiag) {
+		pages++
+		items += d.NumItems + d.ChainLen
+		if d.Evicted || d.MemSz == 0 {
+			t.Errorf("unexpected state of a resident page %+v", d)
+		}
+	})
+
+	if n := int(s.GetStats().NumPages); pages != n {
+		t.Errorf("expected %d pages, got %d", n, pages)
+	}
+
+	if items < 100000 {
+		t.Errorf("expected at least %d items, got %d", 100000, items)
+	}
+
+	s.PersistAll()
+	s.EvictAll(0)
+
+	var prev unsafe.Pointer
+	s.PageStatsVisitor(func(d PageDiag) {
+		if !d.Evicted || d.FlushDataSz == 0 || d.NumSegments == 0 {
+			t.Errorf("unexpected state of an evicted page %+v", d)
+		}
+
+		if prev != nil && s.cmp(prev, d.MinItem) >= 0 {
+			t.Errorf("expected pages in key order")
+		}
+		prev = d.MinItem
+	})
+}
@@ -0,0 +1,164 @@
+package plasma
+
+import (
+	"github.com/couchbase/nitro/skiplist"
+	"github.com/golang/snappy"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+var (
+	defragSMRInterval = 20
+	defragInterval    = time.Second * 5
+)
+
+// Count the number of separate allocations which hold records of the page.
+// A page which has been partially swapped out cannot be defragmented
+// without reading from the LSS and is reported as -1.
+func countPageFragments(pd *pageDelta) int {
+	var n int
+	for ; pd != nil; pd = pd.next {
+		switch pd.op {
+		case opInsertDelta, opDeleteDelta:
+			n++
+		case opPageMergeDelta:
+			pdm := (*mergePageDelta)(unsafe.Pointer(pd))
+			nx := countPageFragments(pdm.mergeSibling)
+			if nx < 0 {
+				return -1
+			}
+			n += nx
+		case opSwapinDelta:
+			sid := (*swapinDelta)(unsafe.Pointer(pd))
+			nx := countPageFragments(sid.ptr)
+			if nx < 0 {
+				return -1
+			}
+			return n + nx
+		case opBasePage:
+			return n + 1
+		case opSwapoutDelta:
+			return -1
+		}
+	}
+
+	return n
+}
+
+// Rewrite the page into a single contiguous base page if its records are
+// spread across too many allocations. The page is only rewritten in memory
+// and the persistor picks it up like any other dirty page. Base pages are
+// kept unencoded in memory, so that their items can be addressed directly.
+// A page whose records are all in the LSS is not rewritten, since that would
+// make its flushed data stale. With UsePrefixCompression, it is kept as a
+// single prefix compressed image instead, which is decoded on access like
+// the compressed pages of the swapper.
+func (s *Plasma) tryPageDefrag(pid PageId, ctx *wCtx) bool {
+	tok := ctx.BeginTx()
+	defer ctx.EndTx(tok)
+
+	pg, _ := s.ReadPage(pid, nil, false, ctx)
+	pgi := pg.(*page)
+	if pgi.head == nil || pg.NeedRemoval() {
+		return false
+	}
+
+	if countPageFragments(pgi.head) < s.Config.DefragThreshold {
+		return false
+	}
+
+	if s.UsePrefixCompression && pg.IsEvictable() {
+		data, ok := s.encodePrefixPage(pgi, ctx)
+		if !ok {
+			return false
+		}
+
+		pg.EvictCompressed(data)
+		if !s.UpdateMapping(pid, pg, ctx) {
+			ctx.sts.DefragConflicts++
+			return false
+		}
+
+		ctx.sts.Defrags++
+		s.trySMRObjects(ctx, defragSMRInterval)
+		return true
+	}
+
+	staleOff, _ := pg.GetLastFlushOffset()
+	staleFdSz := pg.Compact()
+	if !s.UpdateMapping(pid, pg, ctx) {
+		ctx.sts.DefragConflicts++
+		return false
+	}
+
+	ctx.sts.Defrags++
+	ctx.sts.FlushDataSz -= int64(staleFdSz)
+	s.trackLSSUsage(staleOff, staleFdSz, 0, 0)
+	s.trySMRObjects(ctx, defragSMRInterval)
+	return true
+}
+
+// encodePrefixPage returns the snappy compressed image of the page encoded
+// as a single prefix compressed base page. The image holds the items of the
+// flushed page, hence its LSS data remains valid. No image is returned once
+// the compressed pages exceed their quota.
+func (s *Plasma) encodePrefixPage(pg *page, ctx *wCtx) ([]byte, bool) {
+	if atomic.LoadInt64(&s.compressedMemUsed) >= s.compressedCacheQuota() {
+		return nil, false
+	}
+
+	it, itms, _, _ := pg.collectItems(pg.head, nil, pg.head.hiItm)
+	defer it.Close()
+
+	bp := &basePage{
+		op:           opBasePage,
+		numItems:     uint16(len(itms)),
+		state:        pg.head.state,
+		hiItm:        pg.head.hiItm,
+		rightSibling: pg.head.rightSibling,
+		items:        itms,
+	}
+
+	head := (*pageDelta)(unsafe.Pointer(bp))
+	buf := ctx.GetBuffer(bufCompressPage)
+	n, _, _, err := pg.marshal(buf, 0, head, head.hiItm, false, FullMarshal)
+	if err != nil {
+		return nil, false
+	}
+
+	return snappy.Encode(nil, buf[:n]), true
+}
+
+// DefragPages performs a pass over all the pages and rewrites fragmented
+// pages into contiguous blocks. It returns the number of pages rewritten.
+// Passes are serialized, since they share the defrag writer context.
+func (s *Plasma) DefragPages() int {
+	s.defragLock.Lock()
+	defer s.defragLock.Unlock()
+
+	var count int
+	callb := func(pid PageId, partn RangePartition) error {
+		if s.tryPageDefrag(pid, s.defragWriter) {
+			count++
+		}
+		return nil
+	}
+
+	partn := RangePartition{MinKey: skiplist.MinItem, MaxKey: skiplist.MaxItem}
+	s.VisitPartition(partn, callb)
+	s.trySMRObjects(s.defragWriter, 0)
+	return count
+}
+
+func (s *Plasma) defragDaemon() {
+	for {
+		select {
+		case <-s.stopdefrag:
+			s.stopdefrag <- struct{}{}
+			return
+		case <-time.After(defragInterval):
+			s.DefragPages()
+		}
+	}
+}
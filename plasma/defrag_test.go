@@ -0,0 +1,119 @@
+package plasma
+
+import (
+	"github.com/couchbase/nitro/skiplist"
+	"os"
+	"testing"
+)
+
+func TestPlasmaDefrag(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	cfg := testCfg
+	cfg.DefragThreshold = 10
+	s := newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	w := s.NewWriter()
+	n := 10000
+	for i := 0; i < n; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+
+	if count := s.DefragPages(); count == 0 {
+		t.Errorf("expected fragmented pages to be rewritten")
+	}
+
+	if count := s.DefragPages(); count != 0 {
+		t.Errorf("expected no fragmented pages, got %d", count)
+	}
+
+	for pid := s.StartPageId(); pid != s.EndPageId(); pid = NextPid(pid) {
+		pg, _ := s.ReadPage(pid, nil, false, w.wCtx)
+		if nf := countPageFragments(pg.(*page).head); nf >= cfg.DefragThreshold {
+			t.Errorf("expected page to be defragmented, got %d fragments", nf)
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		itm := skiplist.NewIntKeyItem(i)
+		got, _ := w.Lookup(itm)
+		if skiplist.CompareInt(itm, got) != 0 {
+			t.Errorf("mismatch %d != %d", i, skiplist.IntFromItem(got))
+		}
+	}
+
+	if sts := s.GetStats(); sts.Defrags == 0 {
+		t.Errorf("expected defrag stats to be updated")
+	}
+}
+
+func TestPlasmaDefragInMemory(t *testing.T) {
+	cfg := testCfg
+	cfg.File = ""
+	cfg.DefragThreshold = 10
+	s := newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	w := s.NewWriter()
+	n := 10000
+	for i := 0; i < n; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+
+	if count := s.DefragPages(); count == 0 {
+		t.Errorf("expected fragmented pages to be rewritten")
+	}
+
+	for i := 0; i < n; i++ {
+		itm := skiplist.NewIntKeyItem(i)
+		got, _ := w.Lookup(itm)
+		if skiplist.CompareInt(itm, got) != 0 {
+			t.Errorf("mismatch %d != %d", i, skiplist.IntFromItem(got))
+		}
+	}
+}
+
+func TestPlasmaDefragPrefixCompression(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	cfg := testCfg
+	cfg.DefragThreshold = 10
+	cfg.UsePrefixCompression = true
+	cfg.CompressedCacheQuota = 64 * 1024 * 1024
+	s := newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	w := s.NewWriter()
+	n := 10000
+	for i := 0; i < n; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+
+	// Flushed pages are kept compressed instead of being rewritten
+	s.PersistAll()
+	flushSz := s.GetStats().FlushDataSz
+	if count := s.DefragPages(); count == 0 {
+		t.Errorf("expected fragmented pages to be rewritten")
+	}
+
+	sts := s.GetStats()
+	if sts.CompressedSz == 0 {
+		t.Errorf("expected pages to be kept compressed")
+	}
+
+	if sts.FlushDataSz != flushSz {
+		t.Errorf("expected flushed data to remain valid, got %d != %d", sts.FlushDataSz, flushSz)
+	}
+
+	for i := 0; i < n; i++ {
+		itm := skiplist.NewIntKeyItem(i)
+		got, _ := w.Lookup(itm)
+		if skiplist.CompareInt(itm, got) != 0 {
+			t.Errorf("mismatch %d != %d", i, skiplist.IntFromItem(got))
+		}
+	}
+
+	if sts := s.GetStats(); sts.NumCompressedReads == 0 || sts.NumLSSReads != 0 {
+		t.Errorf("expected pages to be read from memory (compressed reads %d, lss reads %d)",
+			sts.NumCompressedReads, sts.NumLSSReads)
+	}
+}
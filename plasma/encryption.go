@@ -0,0 +1,124 @@
+package plasma
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+)
+
+// Encrypted blocks carry a random nonce and the GCM authentication tag
+// in the block header so that the payload keeps the size reserved by the
+// writer and LSS offsets are identical with and without encryption.
+const (
+	blockNonceSize = 12
+	blockTagSize   = 16
+)
+
+func blockHeaderSize(encrypted bool) int {
+	if encrypted {
+		return headerFBSize + blockNonceSize + blockTagSize
+	}
+
+	return headerFBSize
+}
+
+func newBlockCipher(key []byte) (cipher.AEAD, error) {
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+
+	return cipher.NewGCMWithNonceSize(c, blockNonceSize)
+}
+
+// logKeyID derives the identifier of an encryption key recorded in the
+// log superblock, from which the key itself cannot be recovered. Logs
+// which are not encrypted record all zeros.
+func logKeyID(key []byte) (id [logKeyIDSize]byte) {
+	if key != nil {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte("plasma log key"))
+		copy(id[:], mac.Sum(nil))
+	}
+
+	return
+}
+
+// checkKey fails with ErrEncryptionKey unless the log is opened with the
+// key it was written with, since the blocks would otherwise be read with
+// headers of the wrong size. The key of a log which has not been written
+// yet is recorded by the next commit.
+func (s *lsStore) checkKey(key []byte) error {
+	l, ok := s.log.(interface {
+		KeyID() [logKeyIDSize]byte
+		SetKeyID([logKeyIDSize]byte)
+	})
+	if !ok {
+		return nil
+	}
+
+	id := logKeyID(key)
+	if s.log.Tail() == 0 {
+		l.SetKeyID(id)
+		return nil
+	}
+
+	switch recorded := l.KeyID(); {
+	case recorded == id:
+		return nil
+	case key == nil:
+		return fmt.Errorf("%w: the log is encrypted", ErrEncryptionKey)
+	case recorded == [logKeyIDSize]byte{}:
+		return fmt.Errorf("%w: the log is not encrypted", ErrEncryptionKey)
+	default:
+		return fmt.Errorf("%w: the log is encrypted with another key", ErrEncryptionKey)
+	}
+}
+
+// seal returns the on-disk image of a flush buffer. Encrypted blocks are
+// written to a separate buffer since readers may still be accessing the
+// plain text in the flush buffer until it reaches the log.
+func (s *lsStore) seal(fb *flushBuffer) []byte {
+	fb.Pad()
+	if s.aead == nil {
+		fb.Seal(s.log.Epoch())
+		return fb.Bytes()
+	}
+
+	b := fb.Bytes()
+	out := s.encBuf[:len(b)]
+	for off := 0; off < len(b); {
+		l := blockLen(b[off:])
+		hdr := out[off : off+s.hdrSize]
+		copy(hdr[:fbLenSize], b[off:off+fbLenSize])
+		nonce := hdr[headerFBSize : headerFBSize+blockNonceSize]
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			panic(fmt.Sprintf("fatal: unable to generate nonce: %v", err))
+		}
+
+		// The tag is appended after the cipher text and moved into the
+		// header before the next block header overwrites it
+		dataOff := off + s.hdrSize
+		sealed := s.aead.Seal(out[dataOff:dataOff], nonce, b[dataOff:dataOff+l], nil)
+		copy(hdr[headerFBSize+blockNonceSize:], sealed[l:])
+		off += l + s.hdrSize
+	}
+
+	checksumBlocks(out, s.hdrSize, fb.marker(s.log.Epoch()))
+	return out
+}
+
+// decryptBlock decrypts a block read from the log in place
+func (s *lsStore) decryptBlock(hdr []byte, data []byte) error {
+	nonce := hdr[headerFBSize : headerFBSize+blockNonceSize]
+	tag := hdr[headerFBSize+blockNonceSize:]
+	if _, err := s.aead.Open(data[:0], nonce, append(data, tag...), nil); err != nil {
+		return ErrDecrypt
+	}
+
+	return nil
+}
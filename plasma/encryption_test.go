@@ -0,0 +1,112 @@
+package plasma
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPlasmaEncryption(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	cfg := testSnCfg
+	cfg.EncryptionKey = key
+
+	n := 10000
+	s := newTestIntPlasmaStore(cfg)
+	w := s.NewWriter()
+	for i := 0; i < n; i++ {
+		k := []byte(fmt.Sprintf("key-%09d", i))
+		w.InsertKV(k, []byte("plaintext-marker"))
+	}
+	s.PersistAll()
+	s.Close()
+
+	files, _ := filepath.Glob(filepath.Join("teststore.data", segFilePattern))
+	for _, f := range files {
+		bs, _ := ioutil.ReadFile(f)
+		if bytes.Contains(bs, []byte("plaintext-marker")) {
+			t.Fatalf("found plain text in %s", f)
+		}
+	}
+
+	s = newTestIntPlasmaStore(cfg)
+	defer s.Close()
+	w = s.NewWriter()
+	for i := 0; i < n; i++ {
+		k := []byte(fmt.Sprintf("key-%09d", i))
+		if v, err := w.LookupKV(k); err != nil || string(v) != "plaintext-marker" {
+			t.Fatalf("lookup %s failed: %v %v", k, v, err)
+		}
+	}
+}
+
+func TestLSSEncryptionKey(t *testing.T) {
+	os.RemoveAll("test.data")
+	if _, err := newLSStore("test.data", segmentSize, 1024*1024, 2, false, 0, lssOptions{key: []byte("short")}); err == nil {
+		t.Errorf("expected invalid key error")
+	}
+
+	key := []byte("0123456789abcdef")
+	lss, err := newLSStore("test.data", segmentSize, 1024*1024, 2, false, 0, lssOptions{key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offset, buf, res := lss.ReserveSpace(1024)
+	binary.BigEndian.PutUint64(buf[:8], 100)
+	lss.FinalizeWrite(res)
+	lss.Sync(true)
+
+	bufread := make([]byte, 1024*1024)
+	if n, err := lss.Read(offset, bufread); err != nil || n != 1024 ||
+		binary.BigEndian.Uint64(bufread[:8]) != 100 {
+		t.Errorf("unexpected read result n=%d err=%v", n, err)
+	}
+	tail := lss.TailOffset()
+	lss.Close()
+
+	// The log is left intact when opened without the key or with another
+	// key
+	for _, k := range [][]byte{nil, []byte("fedcba9876543210")} {
+		if _, err := newLSStore("test.data", segmentSize, 1024*1024, 2, false, 0, lssOptions{key: k}); !errors.Is(err, ErrEncryptionKey) {
+			t.Errorf("expected ErrEncryptionKey for key %q, got %v", k, err)
+		}
+	}
+
+	lss, err = newLSStore("test.data", segmentSize, 1024*1024, 2, false, 0, lssOptions{key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lss.TailOffset() != tail {
+		t.Errorf("expected tail %d, got %d", tail, lss.TailOffset())
+	}
+
+	if n, err := lss.Read(offset, bufread); err != nil || n != 1024 ||
+		binary.BigEndian.Uint64(bufread[:8]) != 100 {
+		t.Errorf("unexpected read result n=%d err=%v", n, err)
+	}
+	lss.Close()
+
+	// A log which is not encrypted is not opened with a key
+	os.RemoveAll("test.data")
+	defer os.RemoveAll("test.data")
+	lss, err = newLSStore("test.data", segmentSize, 1024*1024, 2, false, 0, lssOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, res = lss.ReserveSpace(1024)
+	lss.FinalizeWrite(res)
+	lss.Sync(true)
+	lss.Close()
+
+	if _, err := newLSStore("test.data", segmentSize, 1024*1024, 2, false, 0, lssOptions{key: key}); !errors.Is(err, ErrEncryptionKey) {
+		t.Errorf("expected ErrEncryptionKey, got %v", err)
+	}
+}
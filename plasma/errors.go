@@ -0,0 +1,177 @@
+package plasma
+
+import (
+	"errors"
+	"fmt"
+	"github.com/couchbase/nitro/skiplist"
+)
+
+var (
+	ErrCorruptLog        = errors.New("log is corrupted")
+	ErrChecksum          = errors.New("checksum mismatch")
+	ErrQuotaExceeded     = errors.New("quota exceeded")
+	ErrReadOnly          = errors.New("instance is read-only")
+	ErrClosed            = errors.New("instance is closed")
+	ErrKeyTooLarge       = errors.New("key is too large")
+	ErrFetchTimeout      = errors.New("page fetch exceeded time budget")
+	ErrDecrypt           = errors.New("unable to decrypt block")
+	ErrNotEmpty          = errors.New("instance is not empty")
+	ErrUnsortedItems     = errors.New("items are not in ascending order")
+	ErrNoLog             = errors.New("instance is not persistent")
+	ErrLogTrimmed        = errors.New("log offset has been trimmed")
+	ErrInUse             = errors.New("instance is open")
+	ErrAborted           = errors.New("operation was aborted")
+	ErrValueLog          = errors.New("operation is not supported with a value log")
+	ErrItemTooBig        = errors.New("item is too big")
+	ErrPageTooBig        = errors.New("page does not fit in the encoding buffer")
+	ErrNoLogTier         = errors.New("log segment has been moved to a tier which is not configured")
+	ErrCloneNotSupported = errors.New("instance cannot be cloned")
+	ErrInvariant         = errors.New("internal invariant violated")
+	ErrDuplicatePage     = errors.New("page is indexed twice")
+	ErrLogWrite          = errors.New("unable to write to the log")
+	ErrWouldThrottle     = errors.New("operation would wait for memory to be freed")
+	ErrSnapshots         = errors.New("operation is not supported with snapshots")
+	ErrLogVersion        = errors.New("log version is not supported")
+	ErrCorruptPage       = errors.New("compressed page image is corrupted")
+	ErrEncryptionKey     = errors.New("encryption key does not match the log")
+)
+
+// Recovery fails with these errors through a PageError when the pages
+// recovered from the log do not cover the whole key space
+var (
+	ErrMissingPage     = fmt.Errorf("page is missing: %w", ErrCorruptLog)
+	ErrInvalidLastPage = fmt.Errorf("invalid last page: %w", ErrCorruptLog)
+)
+
+// ErrLogSegmentTiered is returned when writing to a log segment which has
+// been moved to the tier
+var ErrLogSegmentTiered = fmt.Errorf("log segment has been moved to the tier: %w", ErrReadOnly)
+
+// ErrReadOnlyMode is returned by inserts and deletes while the instance is
+// in the read-only mode, which it enters once the disk is full or
+// Config.MaxDiskUsage is exceeded
+var ErrReadOnlyMode = fmt.Errorf("instance is in read-only mode: %w", ErrReadOnly)
+
+// ErrLogSegmentShared is returned when overwriting a log segment which is
+// shared with a clone of the instance
+var ErrLogSegmentShared = fmt.Errorf("log segment is shared with a clone: %w", ErrReadOnly)
+
+// ItemSizeError is returned when the key and value of an item are larger
+// than Config.MaxItemSize. It matches ErrItemTooBig using errors.Is.
+type ItemSizeError struct {
+	Size    int
+	MaxSize int
+}
+
+func (e *ItemSizeError) Error() string {
+	return fmt.Sprintf("item of %d bytes exceeds the limit of %d bytes", e.Size, e.MaxSize)
+}
+
+func (e *ItemSizeError) Unwrap() error {
+	return ErrItemTooBig
+}
+
+// causeError is an error of a kind caused by another error. It matches
+// both using errors.Is, like an error wrapping the two would.
+type causeError struct {
+	kind  error
+	cause error
+}
+
+func newCauseError(kind, cause error) error {
+	return &causeError{kind: kind, cause: cause}
+}
+
+func (e *causeError) Error() string {
+	return fmt.Sprintf("%v: %v", e.kind, e.cause)
+}
+
+func (e *causeError) Is(target error) bool {
+	return errors.Is(e.kind, target)
+}
+
+func (e *causeError) Unwrap() error {
+	return e.cause
+}
+
+// RecoveryMismatchError is returned by the recovery of an instance with
+// Config.VerifyRecovery set when the items visible at the last recovery
+// point do not match the count and the key checksum recorded with it. It
+// matches ErrCorruptLog using errors.Is.
+type RecoveryMismatchError struct {
+	Sn             uint64
+	Count          int64
+	ExpectedCount  int64
+	KeySum         uint64
+	ExpectedKeySum uint64
+}
+
+func (e *RecoveryMismatchError) Error() string {
+	return fmt.Sprintf("recovered items do not match the recovery point at sn %d: "+
+		"count %d, expected %d, key checksum %x, expected %x",
+		e.Sn, e.Count, e.ExpectedCount, e.KeySum, e.ExpectedKeySum)
+}
+
+func (e *RecoveryMismatchError) Unwrap() error {
+	return ErrCorruptLog
+}
+
+// ErrBlockCorrupt is returned through an LSSError carrying the offset of
+// a log block whose contents do not match its checksum.
+var ErrBlockCorrupt = fmt.Errorf("lss block is corrupted: %w", ErrChecksum)
+
+// LSSError describes a failure while operating on a log block.
+// The underlying cause can be matched using errors.Is and errors.As.
+type LSSError struct {
+	Op     string
+	Offset LSSOffset
+	Err    error
+}
+
+func (e *LSSError) Error() string {
+	return fmt.Sprintf("lss %s at offset %d: %v", e.Op, e.Offset, e.Err)
+}
+
+func (e *LSSError) Unwrap() error {
+	return e.Err
+}
+
+func newLSSError(op string, offset LSSOffset, err error) error {
+	return &LSSError{Op: op, Offset: offset, Err: err}
+}
+
+// PageError describes a failure concerning the page whose range starts at
+// the key Low. Low is nil for the first page and if the instance does not
+// hold key value items. Offset is the last block of the page written to
+// the log, if any.
+type PageError struct {
+	Op     string
+	Low    []byte
+	Offset LSSOffset
+	Err    error
+}
+
+func (e *PageError) Error() string {
+	if e.Offset == expiredLSSOffset {
+		return fmt.Sprintf("%s of page %q: %v", e.Op, e.Low, e.Err)
+	}
+
+	return fmt.Sprintf("%s of page %q at offset %d: %v", e.Op, e.Low, e.Offset, e.Err)
+}
+
+func (e *PageError) Unwrap() error {
+	return e.Err
+}
+
+func (s *Plasma) newPageError(op string, pg Page, err error) error {
+	e := &PageError{Op: op, Offset: expiredLSSOffset, Err: err}
+	if low := pg.MinItem(); s.EnableShapshots && low != skiplist.MinItem {
+		e.Low = append([]byte(nil), (*item)(low).Key()...)
+	}
+
+	if off, ok := pg.(*page).GetLastFlushOffset(); ok {
+		e.Offset = off
+	}
+
+	return e
+}
@@ -0,0 +1,140 @@
+package plasma
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"unsafe"
+)
+
+func TestErrorWrapping(t *testing.T) {
+	if !errors.Is(ErrCorruptSuperBlock, ErrChecksum) {
+		t.Errorf("expected superblock error to wrap ErrChecksum")
+	}
+
+	if !errors.Is(ErrLogSuperBlockCorrupt, ErrCorruptLog) {
+		t.Errorf("expected log superblock error to wrap ErrCorruptLog")
+	}
+
+	err := newLSSError("read", 100, ErrCorruptLog)
+	var lssErr *LSSError
+	if !errors.As(err, &lssErr) || lssErr.Offset != 100 {
+		t.Errorf("expected LSSError with offset, got %v", err)
+	}
+
+	if !errors.Is(err, ErrCorruptLog) {
+		t.Errorf("expected LSSError to wrap ErrCorruptLog")
+	}
+
+	if !errors.Is(ErrMissingPage, ErrCorruptLog) || !errors.Is(ErrInvalidLastPage, ErrCorruptLog) {
+		t.Errorf("expected recovery page errors to wrap ErrCorruptLog")
+	}
+}
+
+func TestErrKeyTooLarge(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testSnCfg)
+	defer s.Close()
+
+	w := s.NewWriter()
+	k := make([]byte, maxKeySize+1)
+	if err := w.InsertKV(k, nil); err != ErrKeyTooLarge {
+		t.Errorf("expected ErrKeyTooLarge, got %v", err)
+	}
+
+	if _, err := w.LookupKV(k); err != ErrKeyTooLarge {
+		t.Errorf("expected ErrKeyTooLarge, got %v", err)
+	}
+}
+
+func TestErrItemTooBig(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testSnCfg)
+	defer s.Close()
+
+	w := s.NewWriter()
+	itm := s.newItem([]byte("key"), make([]byte, maxItemSize), 0, false, nil)
+	if err := w.Insert(unsafe.Pointer(itm)); err != ErrItemTooBig {
+		t.Errorf("expected ErrItemTooBig, got %v", err)
+	}
+
+	if err := w.Delete(unsafe.Pointer(itm)); err != ErrItemTooBig {
+		t.Errorf("expected ErrItemTooBig, got %v", err)
+	}
+}
+
+func TestErrClosed(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testSnCfg)
+	w := s.NewWriter()
+	w.InsertKV([]byte("key"), []byte("val"))
+	s.Close()
+
+	if err := w.InsertKV([]byte("key"), []byte("val")); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestErrInvariant(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testSnCfg)
+	defer s.Close()
+
+	w := s.NewWriter()
+	for i := 0; i < 10000; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte("val"))
+	}
+
+	// Index a second page starting at the low key of an existing page
+	pg, _ := s.ReadPage(s.StartPageId(), nil, false, w.wCtx)
+	pg, _ = s.ReadPage(pg.Next(), nil, false, w.wCtx)
+	low := (*item)(pg.MinItem()).Key()
+	pid := s.AllocPageId(w.wCtx)
+	s.CreateMapping(pid, newPage(w.wCtx, pg.MinItem(), nil), w.wCtx)
+
+	err := s.indexPage(pid, w.wCtx)
+	var pgErr *PageError
+	if !errors.As(err, &pgErr) || !errors.Is(err, ErrDuplicatePage) {
+		t.Fatalf("expected duplicate page error, got %v", err)
+	}
+
+	if !bytes.Equal(pgErr.Low, low) {
+		t.Errorf("expected low key %q, got %q", low, pgErr.Low)
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("expected violation to panic with DebugPanics")
+			}
+		}()
+
+		s.DebugPanics = true
+		s.invariantViolation(err)
+	}()
+
+	if err := w.InsertKV([]byte("key"), []byte("val")); err != nil {
+		t.Errorf("expected operations to succeed, got %v", err)
+	}
+
+	s.DebugPanics = false
+	s.invariantViolation(err)
+	if err := w.InsertKV([]byte("key"), []byte("val")); !errors.Is(err, ErrInvariant) || !errors.Is(err, ErrDuplicatePage) {
+		t.Errorf("expected insert to fail with the violation, got %v", err)
+	}
+
+	if _, err := w.LookupKV(low); !errors.Is(err, ErrInvariant) {
+		t.Errorf("expected lookup to fail with the violation, got %v", err)
+	}
+
+	// Pages are no longer written to the log
+	s.lss.Sync(false)
+	tail := s.lss.TailOffset()
+	s.PersistAll()
+	s.EvictAll(0)
+	if s.lss.TailOffset() != tail {
+		t.Errorf("expected the tail to stay at %d, got %d", tail, s.lss.TailOffset())
+	}
+}
@@ -0,0 +1,129 @@
+package plasma
+
+import (
+	"github.com/couchbase/nitro/skiplist"
+	"unsafe"
+)
+
+// RangeEstimate is the approximate size of a key range
+type RangeEstimate struct {
+	// Number of items including the deltas which are not yet consolidated
+	Items int64
+	// Memory used by the pages of the range
+	MemSz int64
+	// Size of the lss data of the pages of the range
+	DiskSz int64
+}
+
+// EstimateRange returns the approximate number of items and bytes of the
+// keys in [low, high) without reading pages from the lss. A nil bound
+// leaves the range open on that side. The estimate is computed from the
+// page counters and covers all pages overlapping with the range, so the
+// pages at the bounds are accounted completely.
+func (s *Plasma) EstimateRange(low, high unsafe.Pointer) RangeEstimate {
+	s.estimateLock.Lock()
+	defer s.estimateLock.Unlock()
+
+	ctx := s.estimateWriter
+	tok := ctx.BeginTx()
+	defer ctx.EndTx(tok)
+
+	var est RangeEstimate
+	s.walkRange(low, high, ctx, func(pg *page) {
+		est.Items += pageItemCount(pg)
+		est.DiskSz += int64(flushedDataSize(pg.head))
+		est.MemSz += int64(pg.ComputeMemUsed())
+	})
+
+	return est
+}
+
+// KeyRange is the range of keys [Low, High). A nil bound leaves the range
+// open on that side.
+type KeyRange struct {
+	Low, High unsafe.Pointer
+}
+
+// SplitRange divides [low, high) into at most n sub-ranges holding roughly
+// the same number of items so that they can be scanned in parallel. The
+// sub-ranges are split at page boundaries, hence fewer ranges are returned
+// if the range spans less than n pages.
+func (s *Plasma) SplitRange(low, high unsafe.Pointer, n int) []KeyRange {
+	if n < 1 {
+		n = 1
+	}
+
+	s.estimateLock.Lock()
+	defer s.estimateLock.Unlock()
+
+	ctx := s.estimateWriter
+	tok := ctx.BeginTx()
+	defer ctx.EndTx(tok)
+
+	type pageCount struct {
+		low   unsafe.Pointer
+		items int64
+	}
+
+	var pages []pageCount
+	var total int64
+	s.walkRange(low, high, ctx, func(pg *page) {
+		items := pageItemCount(pg)
+		pages = append(pages, pageCount{low: pg.MinItem(), items: items})
+		total += items
+	})
+
+	ranges := []KeyRange{{Low: low, High: high}}
+	var sum int64
+	for i, pc := range pages {
+		// Split points are placed before the page reaching the next share
+		cut := int64(len(ranges)) * total / int64(n)
+		if i > 0 && sum >= cut && len(ranges) < n {
+			key := s.copyKey(pc.low, nil)
+			ranges[len(ranges)-1].High = key
+			ranges = append(ranges, KeyRange{Low: key, High: high})
+		}
+		sum += pc.items
+	}
+
+	return ranges
+}
+
+// walkRange calls fn for the pages overlapping with [low, high) without
+// reading pages from the lss
+func (s *Plasma) walkRange(low, high unsafe.Pointer, ctx *wCtx, fn func(*page)) {
+	if high == nil {
+		high = skiplist.MaxItem
+	}
+
+	pid := s.StartPageId()
+	if low != nil {
+		prev, curr, found := s.Skiplist.Lookup(low, s.cmp, ctx.buf, ctx.slSts)
+		if pid = PageId(prev); found {
+			pid = PageId(curr)
+		}
+	}
+
+	for {
+		pg, _ := s.ReadPage(pid, nil, false, ctx)
+		if s.cmp(pg.MinItem(), high) >= 0 {
+			break
+		}
+
+		fn(pg.(*page))
+		if pg.MaxItem() == skiplist.MaxItem {
+			break
+		}
+		pid = pg.Next()
+	}
+}
+
+// pageItemCount returns the number of items of a page including the deltas
+// which are not yet consolidated
+func pageItemCount(pg *page) int64 {
+	if pg.head == nil {
+		return 0
+	}
+
+	return int64(pg.head.numItems) + int64(pg.head.chainLen)
+}
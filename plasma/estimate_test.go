@@ -0,0 +1,105 @@
+package plasma
+
+import (
+	"github.com/couchbase/nitro/skiplist"
+	"os"
+	"testing"
+)
+
+func TestPlasmaEstimateRange(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testCfg)
+	defer s.Close()
+
+	n := 100000
+	w := s.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+
+	low, high := skiplist.NewIntKeyItem(n/4), skiplist.NewIntKeyItem(n/2)
+	est := s.EstimateRange(nil, nil)
+	if est.Items < int64(n) || est.Items > int64(n)*11/10 {
+		t.Errorf("unexpected item estimate %d for %d items", est.Items, n)
+	}
+
+	if est.MemSz == 0 {
+		t.Errorf("unexpected size estimate %+v", est)
+	}
+
+	sub := s.EstimateRange(low, high)
+	if sub.Items < int64(n/4) || sub.Items > int64(n/4)*12/10 {
+		t.Errorf("unexpected item estimate %d for %d items", sub.Items, n/4)
+	}
+
+	s.PersistAll()
+	if est = s.EstimateRange(nil, nil); est.DiskSz == 0 {
+		t.Errorf("expected flushed data to be estimated")
+	}
+
+	s.EvictAll(0)
+	evicted := s.EstimateRange(low, high)
+	if evicted.Items != sub.Items {
+		t.Errorf("expected %d items after eviction, got %d", sub.Items, evicted.Items)
+	}
+
+	if evicted.DiskSz == 0 || evicted.DiskSz > est.DiskSz/2 {
+		t.Errorf("unexpected disk estimate %d of %d", evicted.DiskSz, est.DiskSz)
+	}
+
+	if after := s.EstimateRange(nil, nil); after.DiskSz != est.DiskSz {
+		t.Errorf("expected disk estimate %d after eviction, got %d", est.DiskSz, after.DiskSz)
+	}
+}
+
+func TestPlasmaSplitRange(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testCfg)
+	defer s.Close()
+
+	n := 100000
+	w := s.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+
+	low, high := skiplist.NewIntKeyItem(n/10), skiplist.NewIntKeyItem(n)
+	ranges := s.SplitRange(low, high, 4)
+	if len(ranges) != 4 {
+		t.Fatalf("expected 4 ranges, got %d", len(ranges))
+	}
+
+	if ranges[0].Low != low || ranges[3].High != high {
+		t.Errorf("expected ranges to cover the bounds")
+	}
+
+	count := 0
+	for i, r := range ranges {
+		if i > 0 && skiplist.CompareInt(ranges[i-1].High, r.Low) != 0 {
+			t.Errorf("expected range %d to be contiguous", i)
+		}
+
+		itr := s.NewIterator()
+		nr := 0
+		for itr.Seek(r.Low); itr.Valid(); itr.Next() {
+			if skiplist.CompareInt(itr.Get(), r.High) >= 0 {
+				break
+			}
+			nr++
+		}
+
+		if share := (n - n/10) / 4; nr < share*8/10 || nr > share*12/10 {
+			t.Errorf("unbalanced range %d with %d items", i, nr)
+		}
+		count += nr
+	}
+
+	if count != n-n/10 {
+		t.Errorf("expected %d items, got %d", n-n/10, count)
+	}
+
+	if ranges = s.SplitRange(nil, nil, 0); len(ranges) != 1 ||
+		ranges[0].Low != nil || ranges[0].High != nil {
+		t.Errorf("expected the whole range, got %v", ranges)
+	}
+}
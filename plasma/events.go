@@ -0,0 +1,181 @@
+package plasma
+
+import (
+	"sync/atomic"
+)
+
+// EventMask selects the types of events delivered to a subscription
+type EventMask uint32
+
+const (
+	// A page was split. NewPageId is the page holding the upper half of
+	// the items and Size the bytes written to the LSS for both pages.
+	EventSplit EventMask = 1 << iota
+
+	// A page was merged into its left sibling and removed
+	EventMerge
+
+	// The delta chain of a page was consolidated. Size is the data of the
+	// page in the LSS which became stale.
+	EventCompact
+
+	// A page was evicted. Size is the data of the page in the LSS.
+	EventEvict
+
+	// An evicted page was read back into memory. Size is the data of the
+	// page in the LSS.
+	EventSwapin
+
+	// A pass of the LSS cleaner completed. Size is the space freed.
+	EventCleanerPass
+
+	// A recovery point was created. Sn is its sequence number.
+	EventRecoveryPoint
+
+	EventAll EventMask = 1<<iota - 1
+)
+
+// Events which are not received before the queue of a subscription fills
+// up are dropped
+const eventQueueSize = 1024
+
+// Event describes a structure modification or a maintenance operation.
+// The fields which do not apply to the type of the event are zero.
+type Event struct {
+	Type      EventMask
+	PageId    PageId
+	NewPageId PageId
+
+	// Items of the page after the operation, including the deltas which
+	// are not yet consolidated
+	NumItems int64
+
+	Size int64
+	Sn   uint64
+}
+
+func (m EventMask) String() string {
+	switch m {
+	case EventSplit:
+		return "split"
+	case EventMerge:
+		return "merge"
+	case EventCompact:
+		return "compact"
+	case EventEvict:
+		return "evict"
+	case EventSwapin:
+		return "swapin"
+	case EventCleanerPass:
+		return "cleaner_pass"
+	case EventRecoveryPoint:
+		return "recovery_point"
+	}
+
+	return "mixed"
+}
+
+// Subscription receives the events selected by its mask on C until it is
+// closed or the instance is closed, upon which C is closed
+type Subscription struct {
+	C <-chan Event
+
+	s       *Plasma
+	mask    EventMask
+	ch      chan Event
+	dropped int64
+}
+
+// Subscribe returns a subscription to the events selected by mask. The
+// events are delivered without blocking the operations which raised them,
+// so a subscriber which falls behind loses events.
+func (s *Plasma) Subscribe(mask EventMask) *Subscription {
+	ch := make(chan Event, eventQueueSize)
+	sub := &Subscription{
+		C:    ch,
+		s:    s,
+		mask: mask,
+		ch:   ch,
+	}
+
+	s.eventLock.Lock()
+	defer s.eventLock.Unlock()
+
+	if s.isClosed() {
+		close(ch)
+		return sub
+	}
+
+	if s.subscriptions == nil {
+		s.subscriptions = make(map[*Subscription]struct{})
+	}
+	s.subscriptions[sub] = struct{}{}
+	s.updateEventMask()
+	return sub
+}
+
+// Dropped returns the number of events lost since the queue was full
+func (sub *Subscription) Dropped() int64 {
+	return atomic.LoadInt64(&sub.dropped)
+}
+
+// Close stops the delivery of events and closes C
+func (sub *Subscription) Close() {
+	s := sub.s
+	s.eventLock.Lock()
+	defer s.eventLock.Unlock()
+
+	if _, ok := s.subscriptions[sub]; ok {
+		delete(s.subscriptions, sub)
+		close(sub.ch)
+		s.updateEventMask()
+	}
+}
+
+func (s *Plasma) updateEventMask() {
+	var mask EventMask
+	for sub := range s.subscriptions {
+		mask |= sub.mask
+	}
+
+	atomic.StoreUint32(&s.eventMask, uint32(mask))
+}
+
+// subscribed returns true if an event of the type has subscribers, so that
+// the cost of describing the event is only paid when it is delivered
+func (s *Plasma) subscribed(typ EventMask) bool {
+	return EventMask(atomic.LoadUint32(&s.eventMask))&typ != 0
+}
+
+func (s *Plasma) publish(e Event) {
+	if !s.subscribed(e.Type) {
+		return
+	}
+
+	s.eventLock.RLock()
+	defer s.eventLock.RUnlock()
+
+	for sub := range s.subscriptions {
+		if sub.mask&e.Type == 0 {
+			continue
+		}
+
+		select {
+		case sub.ch <- e:
+		default:
+			atomic.AddInt64(&sub.dropped, 1)
+		}
+	}
+}
+
+func (s *Plasma) closeSubscriptions() {
+	s.eventLock.Lock()
+	defer s.eventLock.Unlock()
+
+	for sub := range s.subscriptions {
+		close(sub.ch)
+	}
+
+	s.subscriptions = nil
+	s.updateEventMask()
+}
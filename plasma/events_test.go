@@ -0,0 +1,79 @@
+package plasma
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestPlasmaEvents(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	cfg := testSnCfg
+	cfg.AutoSwapper = false
+	cfg.AutoLSSCleaning = false
+	s := newTestIntPlasmaStore(cfg)
+
+	all := s.Subscribe(EventAll)
+	splits := s.Subscribe(EventSplit)
+	closed := s.Subscribe(EventAll)
+	closed.Close()
+
+	w := s.NewWriter()
+	n := 20000
+	for i := 0; i < n; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), nil)
+	}
+	for i := 0; i < n/2; i++ {
+		w.DeleteKV([]byte(fmt.Sprintf("key-%10d", i)))
+	}
+	s.PersistAll()
+	s.EvictAll(0)
+
+	snap := s.NewSnapshot()
+	itr := snap.NewIterator()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+	}
+	itr.Close()
+
+	if err := s.CreateRecoveryPoint(snap, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.CleanLSS(func() bool { return true }); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	counts := make(map[EventMask]int)
+	for e := range all.C {
+		counts[e.Type]++
+		if e.Type == EventSplit && (e.PageId == nil || e.NewPageId == nil || e.Size == 0) {
+			t.Errorf("expected the pages and the size of a split, got %+v", e)
+		} else if e.Type == EventRecoveryPoint && e.Sn != snap.sn {
+			t.Errorf("expected recovery point sn %d, got %d", snap.sn, e.Sn)
+		}
+	}
+
+	for _, typ := range []EventMask{EventSplit, EventMerge, EventCompact, EventEvict,
+		EventSwapin, EventCleanerPass, EventRecoveryPoint} {
+		if counts[typ] == 0 {
+			t.Errorf("expected %s events, got %v", typ, counts)
+		}
+	}
+
+	nsplits := 0
+	for e := range splits.C {
+		if e.Type != EventSplit {
+			t.Errorf("expected only split events, got %s", e.Type)
+		}
+		nsplits++
+	}
+
+	if nsplits != counts[EventSplit] {
+		t.Errorf("expected %d splits, got %d", counts[EventSplit], nsplits)
+	}
+
+	if _, ok := <-closed.C; ok {
+		t.Errorf("expected no events after the subscription was closed")
+	}
+}
@@ -0,0 +1,173 @@
+package plasma
+
+import (
+	"github.com/couchbase/nitro/skiplist"
+	"sync/atomic"
+)
+
+// EvictionPolicy decides which pages are evicted by the swapper. The
+// swapper sweeps the page table in key order like a clock hand and hands
+// every batch of pages under the hand to PickVictims. Policies keep their
+// per-page state in the page table node so that no page id is retained
+// after a page is removed.
+type EvictionPolicy interface {
+	// Touch records an access to a page
+	Touch(pid PageId)
+
+	// PickVictims returns the pages to be evicted among the pages under
+	// the clock hand
+	PickVictims(pids []PageId) []PageId
+}
+
+// Page state bits stored in the page table node
+const (
+	evictRef  int64 = 1 << iota // Accessed since the last sweep
+	evictHot                    // Frequently accessed page
+	evictTest                   // Recently evicted or in test period
+)
+
+func pageEvictState(pid PageId) *int64 {
+	return &pid.(*skiplist.Node).Cache
+}
+
+// sweepEvictState applies the transition of the page state made by the
+// clock hand. Since pages are touched concurrently with the sweep, the
+// transition is retried if the state changes in between.
+func sweepEvictState(pid PageId, next func(st int64) (int64, bool)) bool {
+	st := pageEvictState(pid)
+	for {
+		old := atomic.LoadInt64(st)
+		newSt, evict := next(old)
+		if atomic.CompareAndSwapInt64(st, old, newSt) {
+			return evict
+		}
+	}
+}
+
+// NewClockPolicy returns the second chance clock policy. A page is evicted
+// if it was not accessed during the last revolution of the clock hand.
+func NewClockPolicy() EvictionPolicy {
+	return new(clockPolicy)
+}
+
+type clockPolicy struct{}
+
+func (p *clockPolicy) Touch(pid PageId) {
+	atomic.StoreInt64(pageEvictState(pid), evictRef)
+}
+
+func (p *clockPolicy) PickVictims(pids []PageId) []PageId {
+	victims := pids[:0]
+	for _, pid := range pids {
+		if atomic.SwapInt64(pageEvictState(pid), 0)&evictRef == 0 {
+			victims = append(victims, pid)
+		}
+	}
+
+	return victims
+}
+
+// New2QPolicy returns a clock approximation of the 2Q policy. Pages enter
+// a probation queue and are evicted when the clock hand reaches them
+// irrespective of accesses, so that a scan does not displace the working
+// set. Evicted probation pages are remembered for one revolution and are
+// promoted to the hot queue if they are accessed again during that time.
+// Hot pages are evicted once they are not accessed for a revolution.
+func New2QPolicy() EvictionPolicy {
+	return new(twoQPolicy)
+}
+
+type twoQPolicy struct{}
+
+func (p *twoQPolicy) Touch(pid PageId) {
+	st := pageEvictState(pid)
+	for {
+		old := atomic.LoadInt64(st)
+		newSt := old | evictRef
+		if old&evictTest != 0 {
+			newSt = evictHot | evictRef
+		}
+
+		if old == newSt || atomic.CompareAndSwapInt64(st, old, newSt) {
+			return
+		}
+	}
+}
+
+func (p *twoQPolicy) PickVictims(pids []PageId) []PageId {
+	victims := pids[:0]
+	for _, pid := range pids {
+		if sweepEvictState(pid, p.sweep) {
+			victims = append(victims, pid)
+		}
+	}
+
+	return victims
+}
+
+func (p *twoQPolicy) sweep(st int64) (int64, bool) {
+	switch {
+	case st&evictHot != 0:
+		if st&evictRef != 0 {
+			return evictHot, false
+		}
+		return 0, true
+	case st&evictTest != 0:
+		// Ghost entry has expired
+		return 0, false
+	default:
+		return evictTest, true
+	}
+}
+
+// NewClockProPolicy returns a simplified Clock-Pro policy. Cold pages
+// accessed within their test period are promoted to hot pages, while hot
+// pages which are not accessed for a revolution are demoted to cold pages
+// instead of being evicted. Only cold pages are evicted.
+func NewClockProPolicy() EvictionPolicy {
+	return new(clockProPolicy)
+}
+
+type clockProPolicy struct{}
+
+func (p *clockProPolicy) Touch(pid PageId) {
+	st := pageEvictState(pid)
+	for {
+		old := atomic.LoadInt64(st)
+		if old&evictRef != 0 || atomic.CompareAndSwapInt64(st, old, old|evictRef) {
+			return
+		}
+	}
+}
+
+func (p *clockProPolicy) PickVictims(pids []PageId) []PageId {
+	victims := pids[:0]
+	for _, pid := range pids {
+		if sweepEvictState(pid, p.sweep) {
+			victims = append(victims, pid)
+		}
+	}
+
+	return victims
+}
+
+func (p *clockProPolicy) sweep(st int64) (int64, bool) {
+	ref := st&evictRef != 0
+	test := st&evictTest != 0
+	switch {
+	case st&evictHot != 0:
+		if ref {
+			return evictHot, false
+		}
+		return 0, false
+	case ref && test:
+		return evictHot, false
+	case ref:
+		return evictTest, false
+	case test:
+		// Test period has expired
+		return 0, true
+	default:
+		return evictTest, true
+	}
+}
@@ -0,0 +1,218 @@
+package plasma
+
+import (
+	"github.com/couchbase/nitro/skiplist"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func pickVictims(p EvictionPolicy, pids ...PageId) map[PageId]bool {
+	victims := make(map[PageId]bool)
+	for _, pid := range p.PickVictims(append([]PageId(nil), pids...)) {
+		victims[pid] = true
+	}
+
+	return victims
+}
+
+func TestClockPolicy(t *testing.T) {
+	p := NewClockPolicy()
+	a, b := new(skiplist.Node), new(skiplist.Node)
+
+	p.Touch(a)
+	if v := pickVictims(p, a, b); v[a] || !v[b] {
+		t.Errorf("expected only untouched page to be evicted")
+	}
+
+	if v := pickVictims(p, a); !v[a] {
+		t.Errorf("expected page to be evicted after a revolution")
+	}
+}
+
+func Test2QPolicy(t *testing.T) {
+	p := New2QPolicy()
+	hot, scan := new(skiplist.Node), new(skiplist.Node)
+
+	// Probation pages are evicted even if they were accessed
+	p.Touch(hot)
+	p.Touch(scan)
+	if v := pickVictims(p, hot, scan); !v[hot] || !v[scan] {
+		t.Errorf("expected probation pages to be evicted")
+	}
+
+	// Reaccess while remembered promotes the page
+	p.Touch(hot)
+	if v := pickVictims(p, hot, scan); v[hot] || v[scan] {
+		t.Errorf("expected no evictions")
+	}
+
+	if v := pickVictims(p, hot); !v[hot] {
+		t.Errorf("expected idle hot page to be evicted")
+	}
+
+	// Ghost entry of the scan page has expired
+	p.Touch(scan)
+	if v := pickVictims(p, scan); !v[scan] {
+		t.Errorf("expected scan page to remain in probation")
+	}
+}
+
+func TestClockProPolicy(t *testing.T) {
+	p := NewClockProPolicy()
+	a, b := new(skiplist.Node), new(skiplist.Node)
+
+	// Accessed cold page enters test period
+	p.Touch(a)
+	if v := pickVictims(p, a, b); v[a] || !v[b] {
+		t.Errorf("expected only untouched page to be evicted")
+	}
+
+	// Access within test period promotes the page
+	p.Touch(a)
+	pickVictims(p, a)
+
+	// Hot page is demoted before it can be evicted
+	if v := pickVictims(p, a); v[a] {
+		t.Errorf("expected hot page to be demoted")
+	}
+
+	if v := pickVictims(p, a); !v[a] {
+		t.Errorf("expected cold page to be evicted")
+	}
+}
+
+func TestPlasmaEvictionPolicies(t *testing.T) {
+	policies := []EvictionPolicy{NewClockPolicy(), New2QPolicy(), NewClockProPolicy()}
+	for _, policy := range policies {
+		os.RemoveAll("teststore.data")
+		cfg := testCfg
+		cfg.EvictionPolicy = policy
+		cfg.MemQuota = 1024 * 1024
+		cfg.AutoSwapper = true
+		s := newTestIntPlasmaStore(cfg)
+
+		n := 200000
+		w := s.NewWriter()
+		for i := 0; i < n; i++ {
+			w.Insert(skiplist.NewIntKeyItem(i))
+		}
+
+		s.PersistAll()
+		for i := 0; i < 100 && s.MemoryInUse() >= cfg.MemQuota; i++ {
+			time.Sleep(time.Millisecond * 100)
+		}
+
+		if used := s.MemoryInUse(); used >= cfg.MemQuota {
+			t.Errorf("%T: expected memory in use %d to be within quota", policy, used)
+		}
+
+		for i := 0; i < n; i++ {
+			itm := skiplist.NewIntKeyItem(i)
+			if got, _ := w.Lookup(itm); skiplist.CompareInt(itm, got) != 0 {
+				t.Fatalf("%T: mismatch %d", policy, i)
+			}
+		}
+
+		s.Close()
+	}
+}
+
+type touchCountPolicy struct {
+	EvictionPolicy
+	touches int64
+}
+
+func (p *touchCountPolicy) Touch(pid PageId) {
+	atomic.AddInt64(&p.touches, 1)
+	p.EvictionPolicy.Touch(pid)
+}
+
+func TestIteratorCachePolicy(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	policy := &touchCountPolicy{EvictionPolicy: NewClockPolicy()}
+	cfg := testCfg
+	cfg.EvictionPolicy = policy
+	s := newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	n := 20000
+	w := s.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+
+	scan := func(p CachePolicy, full bool) int64 {
+		atomic.StoreInt64(&policy.touches, 0)
+		itr := s.NewIterator().(*Iterator)
+		defer itr.Close()
+
+		itr.SetCachePolicy(p)
+		if full {
+			itr.SeekFirst()
+		} else {
+			itr.Seek(skiplist.NewIntKeyItem(n / 2))
+		}
+
+		for ; itr.Valid(); itr.Next() {
+		}
+
+		return atomic.LoadInt64(&policy.touches)
+	}
+
+	if c := scan(CacheDefault, true); c != 0 {
+		t.Errorf("expected a full scan not to promote pages, got %d touches", c)
+	}
+
+	if c := scan(CacheDefault, false); c == 0 {
+		t.Errorf("expected a range scan to promote pages")
+	}
+
+	if c := scan(CachePromote, true); c == 0 {
+		t.Errorf("expected a full scan to promote pages with CachePromote")
+	}
+
+	if c := scan(CacheNoPromote, false); c != 0 {
+		t.Errorf("expected a range scan not to promote pages with CacheNoPromote, got %d touches", c)
+	}
+}
+
+func TestPlasmaEvictAllTarget(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testCfg)
+	defer s.Close()
+
+	low, high := skiplist.NewIntKeyItem(10000), skiplist.NewIntKeyItem(20000)
+	s.PinRange(low, high)
+
+	n := 200000
+	w := s.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+	s.PersistAll()
+
+	target := s.MemoryInUse() / 2
+	s.EvictAll(target)
+	if used := s.MemoryInUse(); used > target || used < target/2 {
+		t.Errorf("expected memory in use %d to drop to %d", used, target)
+	}
+
+	s.EvictAll(0)
+	if sts := s.GetStats(); sts.NumRecordSwapOut == 0 {
+		t.Errorf("expected records to be swapped out")
+	}
+
+	nr := w.wCtx.sts.NumLSSReads
+	for i := 10000; i < 20000; i++ {
+		itm := skiplist.NewIntKeyItem(i)
+		if got, _ := w.Lookup(itm); skiplist.CompareInt(itm, got) != 0 {
+			t.Fatalf("mismatch %d", i)
+		}
+	}
+
+	if w.wCtx.sts.NumLSSReads != nr {
+		t.Errorf("expected pinned pages to be resident")
+	}
+}
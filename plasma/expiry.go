@@ -0,0 +1,21 @@
+package plasma
+
+import (
+	"time"
+	"unsafe"
+)
+
+// ItemExpiryFn returns the expiry time of an item. A zero time indicates
+// that the item never expires.
+type ItemExpiryFn func(unsafe.Pointer) time.Time
+
+func (s *Plasma) newExpiryFilter(f ItemFilter) ItemFilter {
+	now := time.Now()
+	expiry := s.Config.ItemExpiryGetter
+	isExpired := func(itm unsafe.Pointer) bool {
+		exp := expiry(itm)
+		return !exp.IsZero() && !exp.After(now)
+	}
+
+	return s.newDropFilter(f, isExpired, &s.numExpired)
+}
@@ -0,0 +1,49 @@
+package plasma
+
+import (
+	"github.com/couchbase/nitro/skiplist"
+	"os"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestPlasmaItemExpiry(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	cfg := testCfg
+	cfg.ItemExpiryGetter = func(itm unsafe.Pointer) time.Time {
+		if skiplist.IntFromItem(itm)%2 == 0 {
+			return time.Now().Add(-time.Hour)
+		}
+		return time.Time{}
+	}
+
+	s := newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	w := s.NewWriter()
+	n := 10000
+	for i := 0; i < n; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+
+	w.CompactAll()
+
+	count := 0
+	itr := s.NewIterator()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		if v := skiplist.IntFromItem(itr.Get()); v%2 == 0 {
+			t.Errorf("expected %d to be expired", v)
+		}
+		count++
+	}
+	itr.(*Iterator).Close()
+
+	if count != n/2 {
+		t.Errorf("expected %d items, got %d", n/2, count)
+	}
+
+	if sts := s.GetStats(); sts.ExpiredItems != int64(n/2) {
+		t.Errorf("expected %d expired items, got %d", n/2, sts.ExpiredItems)
+	}
+}
@@ -0,0 +1,41 @@
+package plasma
+
+import (
+	"errors"
+	"io"
+)
+
+// A run exported from a snapshot uses the framing of a backup. It is a
+// full backup of the snapshot without recovery points, so that it can be
+// restored using Restore as well as ingested into an existing instance
+// using ImportRun.
+
+var ErrInvalidRun = errors.New("invalid sorted run format")
+
+// Export writes the items visible in the snapshot to w as a sorted run,
+// which can be imported using ImportRun by an instance with the same key
+// order, e.g. to transfer an index or to analyze it offline.
+func (snap *Snapshot) Export(w io.Writer) error {
+	return snap.db.writeBackup(w, snap, nil, nil)
+}
+
+// ImportRun ingests a sorted run written by Snapshot.Export or a full
+// backup, without its recovery points. The items of the run replace the
+// current versions of their keys and are applied as they are read, hence
+// the items read before the run is found to be corrupted or out of order
+// are applied.
+func (s *Plasma) ImportRun(r io.Reader) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+
+	br, since, err := newBackupReader(r, s.MaxItemSize)
+	if err != nil {
+		return err
+	} else if since != 0 {
+		return ErrInvalidRun
+	}
+
+	_, err = s.ingestBackup(br, true)
+	return err
+}
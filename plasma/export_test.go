@@ -0,0 +1,110 @@
+package plasma
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"testing"
+)
+
+func TestSnapshotExport(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testSnCfg)
+	defer s.Close()
+
+	n := 10000
+	w := s.NewWriter()
+	for i := 0; i < n; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte(fmt.Sprintf("val-%10d", i)))
+	}
+
+	for i := 0; i < n; i += 2 {
+		w.DeleteKV([]byte(fmt.Sprintf("key-%10d", i)))
+	}
+
+	var buf bytes.Buffer
+	snap := s.NewSnapshot()
+	if err := snap.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	snap.Close()
+
+	cfg := testSnCfg
+	cfg.File = "test.data"
+	os.RemoveAll(cfg.File)
+	defer os.RemoveAll(cfg.File)
+	r := newTestIntPlasmaStore(cfg)
+	defer r.Close()
+
+	// Keys of the run replace the existing items
+	rw := r.NewWriter()
+	for i := 0; i < n; i++ {
+		rw.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte("old"))
+	}
+
+	bs := buf.Bytes()
+	bs[len(bs)/2] ^= 0xff
+	if err := r.ImportRun(bytes.NewReader(bs)); !errors.Is(err, ErrChecksum) {
+		t.Errorf("expected corrupted run to be rejected, got %v", err)
+	}
+	bs[len(bs)/2] ^= 0xff
+
+	if err := r.ImportRun(bytes.NewReader(bs[:len(bs)-1])); err != ErrCorruptBackup {
+		t.Errorf("expected truncated run to be rejected, got %v", err)
+	}
+
+	// Keys have to be in order
+	var ubuf bytes.Buffer
+	bw := &backupWriter{w: bufio.NewWriter(&ubuf), crc: crc32.NewIEEE()}
+	bw.writeUint(uint64(backupMagic), 4)
+	bw.writeUint(uint64(backupVersion), 2)
+	bw.writeUint(1, 8)
+	bw.writeUint(0, 8)
+	for _, k := range []string{"key-b", "key-a"} {
+		bw.writeUint(uint64(backupKV), 1)
+		bw.writeUint(uint64(len(k)), 4)
+		bw.writeUint(0, 4)
+		bw.write([]byte(k))
+	}
+	bw.writeUint(uint64(backupEnd), 1)
+	bw.writeUint(uint64(bw.crc.Sum32()), 4)
+	bw.w.Flush()
+
+	if err := r.ImportRun(&ubuf); err != ErrInvalidRun {
+		t.Errorf("expected unsorted run to be rejected, got %v", err)
+	}
+
+	// Exported runs can be restored as well
+	os.RemoveAll("test2.data")
+	defer os.RemoveAll("test2.data")
+	rcfg := testSnCfg
+	rcfg.File = "test2.data"
+	rs, err := Restore(rcfg, bytes.NewReader(bs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count := rs.ItemsCount(); count != int64(n/2) {
+		t.Errorf("expected items count %d, got %d", n/2, count)
+	}
+	rs.Close()
+
+	if err := r.ImportRun(bytes.NewReader(bs)); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < n; i++ {
+		k := fmt.Sprintf("key-%10d", i)
+		v, err := rw.LookupKV([]byte(k))
+		if i%2 == 0 {
+			if string(v) != "old" {
+				t.Fatalf("%s: expected the item to be kept, got %q (err=%v)", k, v, err)
+			}
+		} else if string(v) != fmt.Sprintf("val-%10d", i) {
+			t.Fatalf("%s: unexpected value %q (err=%v)", k, v, err)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package plasma
+
+import (
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// Histogram is the distribution of a page property. Counts[i] is the
+// number of pages with a value below Bounds[i] and at least Bounds[i-1].
+// The last count is of the pages with a value of at least the last bound.
+type Histogram struct {
+	Bounds []int   `json:"bounds"`
+	Counts []int64 `json:"counts"`
+}
+
+func newHistogram(bounds ...int) Histogram {
+	return Histogram{
+		Bounds: bounds,
+		Counts: make([]int64, len(bounds)+1),
+	}
+}
+
+func (h *Histogram) add(v int) {
+	i := 0
+	for ; i < len(h.Bounds) && v >= h.Bounds[i]; i++ {
+	}
+
+	h.Counts[i]++
+}
+
+// Number of buckets of a Pow2Histogram, the last one counts the values of
+// at least 4M
+const numPow2Buckets = 24
+
+// Pow2Histogram is a distribution in power of two buckets. Bucket 0 counts
+// the zero values and bucket i the values in [2^(i-1), 2^i). Unlike
+// Histogram, it has a fixed size, so that it can be kept in Stats.
+type Pow2Histogram [numPow2Buckets]int64
+
+func (h *Pow2Histogram) add(v int) {
+	i := 0
+	if v > 0 {
+		i = bits.Len(uint(v))
+	}
+
+	if i >= numPow2Buckets {
+		i = numPow2Buckets - 1
+	}
+
+	h[i]++
+}
+
+func (h *Pow2Histogram) merge(o *Pow2Histogram) {
+	for i := range h {
+		h[i] += o[i]
+	}
+}
+
+func (h *Pow2Histogram) sub(o *Pow2Histogram) {
+	for i := range h {
+		h[i] -= o[i]
+	}
+}
+
+// String lists the non-empty buckets as the lowest value of the bucket
+// followed by its count
+func (h Pow2Histogram) String() string {
+	var b strings.Builder
+	for i, c := range h {
+		if c == 0 {
+			continue
+		}
+
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+
+		low := 0
+		if i > 0 {
+			low = 1 << (i - 1)
+		}
+		fmt.Fprintf(&b, "%d:%d", low, c)
+	}
+
+	return b.String()
+}
+
+// LSSRangeFrag is the estimated utilization of a range of the log
+type LSSRangeFrag struct {
+	Start    LSSOffset `json:"start"`
+	End      LSSOffset `json:"end"`
+	DataSize int64     `json:"data_size"`
+	Frag     int       `json:"fragmentation"`
+}
+
+// FragmentationReport describes how well the pages and the log are
+// utilized, e.g. to decide when to run CompactAll or to tune MaxPageItems
+type FragmentationReport struct {
+	NumPages int `json:"num_pages"`
+	// Items of the base pages in percent of MaxPageItems
+	PageFill Histogram `json:"page_fill"`
+	// Number of deltas on top of the base pages
+	ChainLen Histogram `json:"chain_len"`
+
+	LSSFrag int `json:"lss_fragmentation"`
+	// Ranges of the log from the head to the tail. The ranges written
+	// before the instance was opened are assumed to be as fragmented as
+	// the whole log.
+	LSSRanges []LSSRangeFrag `json:"lss_ranges"`
+}
+
+// FragmentationReport visits the pages to compute the distribution of the
+// page fill factor and the delta chain lengths. Pages are not read from
+// the lss.
+func (s *Plasma) FragmentationReport() (FragmentationReport, error) {
+	maxChain := s.Config.MaxDeltaChainLen
+	rep := FragmentationReport{
+		PageFill: newHistogram(10, 25, 50, 75, 100),
+		ChainLen: newHistogram(1, maxChain/4, maxChain/2, maxChain),
+	}
+
+	s.estimateLock.Lock()
+	defer s.estimateLock.Unlock()
+
+	ctx := s.estimateWriter
+	tok := ctx.BeginTx()
+	defer ctx.EndTx(tok)
+
+	callb := func(pid PageId, partn RangePartition) error {
+		pg, err := s.ReadPage(pid, nil, false, ctx)
+		if err != nil {
+			return err
+		}
+
+		rep.NumPages++
+		if pd := pg.(*page).head; pd != nil {
+			rep.PageFill.add(int(pd.numItems) * 100 / s.Config.MaxPageItems)
+			rep.ChainLen.add(int(pd.chainLen))
+		}
+
+		return nil
+	}
+
+	// The writer context cannot be shared by the visitor threads
+	if err := s.PageVisitor(callb, 1); err != nil {
+		return rep, err
+	}
+
+	if s.shouldPersist {
+		rep.LSSFrag, rep.LSSRanges = s.lssRangeFrag()
+	}
+
+	return rep, nil
+}
+
+func (s *Plasma) lssRangeFrag() (int, []LSSRangeFrag) {
+	frag, data, used := s.GetLSSInfo()
+	if s.lssRegions == nil {
+		return frag, nil
+	}
+
+	util := 1.0
+	if used > 0 && data < used {
+		util = float64(data) / float64(used)
+	}
+
+	var ranges []LSSRangeFrag
+	head := s.lss.HeadOffset()
+	start := head
+	for _, r := range s.lssRegions.snapshot(head, s.lss.TailOffset(), util) {
+		rf := LSSRangeFrag{
+			Start:    start,
+			End:      start + LSSOffset(r.size),
+			DataSize: r.live,
+		}
+
+		if r.size > 0 {
+			rf.Frag = int((r.size - r.live) * 100 / r.size)
+		}
+
+		ranges = append(ranges, rf)
+		start = rf.End
+	}
+
+	return frag, ranges
+}
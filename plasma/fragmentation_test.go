@@ -0,0 +1,84 @@
+package plasma
+
+import (
+	"github.com/couchbase/nitro/skiplist"
+	"os"
+	"testing"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram(10, 20)
+	for _, v := range []int{0, 9, 10, 19, 20, 100} {
+		h.add(v)
+	}
+
+	for i, exp := range []int64{2, 2, 2} {
+		if h.Counts[i] != exp {
+			t.Errorf("bucket %d: expected %d, got %d", i, exp, h.Counts[i])
+		}
+	}
+}
+
+func TestFragmentationReport(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	cfg := testCfg
+	cfg.AutoLSSCleaning = false
+	s := newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	n := 100000
+	w := s.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+
+	s.PersistAll()
+	for i := 0; i < n; i += 2 {
+		w.Delete(skiplist.NewIntKeyItem(i))
+	}
+	s.PersistAll()
+
+	rep, err := s.FragmentationReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := int(s.GetStats().NumPages); rep.NumPages != n {
+		t.Errorf("expected %d pages, got %d", n, rep.NumPages)
+	}
+
+	var pages, chains int64
+	for i := range rep.PageFill.Counts {
+		pages += rep.PageFill.Counts[i]
+	}
+	for i := range rep.ChainLen.Counts {
+		chains += rep.ChainLen.Counts[i]
+	}
+
+	if pages != int64(rep.NumPages) || chains != int64(rep.NumPages) {
+		t.Errorf("expected %d pages in the histograms, got %d and %d", rep.NumPages, pages, chains)
+	}
+
+	if rep.ChainLen.Counts[0] == int64(rep.NumPages) {
+		t.Errorf("expected pages with deltas %+v", rep.ChainLen)
+	}
+
+	if len(rep.LSSRanges) == 0 || rep.LSSRanges[0].Start != s.lss.HeadOffset() ||
+		rep.LSSRanges[len(rep.LSSRanges)-1].End != s.lss.TailOffset() {
+		t.Fatalf("expected the log to be covered %+v", rep.LSSRanges)
+	}
+
+	var frag bool
+	for _, r := range rep.LSSRanges {
+		frag = frag || r.Frag > 0
+	}
+
+	if !frag || rep.LSSFrag == 0 {
+		t.Errorf("expected fragmentation in the log, got %d", rep.LSSFrag)
+	}
+
+	w.CompactAll()
+	if rep, _ = s.FragmentationReport(); rep.ChainLen.Counts[0] != int64(rep.NumPages) {
+		t.Errorf("expected no deltas after compaction %+v", rep.ChainLen)
+	}
+}
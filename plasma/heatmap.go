@@ -0,0 +1,166 @@
+package plasma
+
+import (
+	"encoding/binary"
+	"github.com/couchbase/nitro/skiplist"
+	"sort"
+	"time"
+	"unsafe"
+)
+
+// The heat map is recorded in the log as a block holding a version
+// followed by the eviction policy state and the low item of the pages in
+// memory, starting with the hottest pages. Like the recovery points, the
+// latest block is recovered on open and it is rewritten at the tail of the
+// log by the cleaner and by checkpoints.
+
+const (
+	heatMapEntryHdrSize = 1 + 2
+	maxHeatMapItemSize  = 0xffff
+)
+
+// PageHeat is the access state of a page recorded in the heat map
+type PageHeat struct {
+	// Low key of the page, which is nil for the first page
+	LowKey []byte
+	// 3 for a hot page accessed since the last sweep of the swapper, 2 for
+	// a hot page, 1 for an accessed page and 0 otherwise
+	Temperature int
+}
+
+func heatMapVersion(bs []byte) uint64 {
+	if len(bs) < 8 {
+		return 0
+	}
+
+	return binary.BigEndian.Uint64(bs[:8])
+}
+
+func (s *Plasma) heatMapVersion() uint64 {
+	s.heatMapLock.Lock()
+	defer s.heatMapLock.Unlock()
+	return heatMapVersion(s.heatMap)
+}
+
+// appendHeatMap writes the entries as the next version of the heat map.
+// The caller holds heatMapLock.
+func (s *Plasma) appendHeatMap(entries []byte) {
+	bs := make([]byte, 8+len(entries))
+	binary.BigEndian.PutUint64(bs[:8], heatMapVersion(s.heatMap)+1)
+	copy(bs[8:], entries)
+
+	_, wbuf, res := s.lss.ReserveSpace(lssBlockTypeSize + len(bs))
+	writeLSSBlock(wbuf, lssHeatMap, bs)
+	s.lss.FinalizeWrite(res)
+	s.heatMap = bs
+}
+
+// relocateHeatMap rewrites the heat map at the tail of the log if version
+// is the latest one
+func (s *Plasma) relocateHeatMap(version uint64) {
+	s.heatMapLock.Lock()
+	defer s.heatMapLock.Unlock()
+
+	if s.heatMap != nil && heatMapVersion(s.heatMap) == version {
+		s.appendHeatMap(s.heatMap[8:])
+	}
+}
+
+// writeHeatMap records the pages in memory in the log. The coldest pages
+// are left out if the heat map does not fit into a block.
+func (s *Plasma) writeHeatMap() {
+	var pages []PageHeat
+	ctx := s.heatMapWriter
+	callb := func(pid PageId, partn RangePartition) error {
+		tok := ctx.BeginTx()
+		defer ctx.EndTx(tok)
+
+		pg, _ := s.ReadPage(pid, nil, false, ctx)
+		if pgi := pg.(*page); pgi.head == nil || pgi.head.state.IsEvicted() {
+			return nil
+		}
+
+		// The low item is recorded rather than its key, so that the page
+		// can be looked up whatever the item format
+		ph := PageHeat{Temperature: int(*pageEvictState(pid) & (evictRef | evictHot))}
+		if low := pid.(*skiplist.Node).Item(); low != skiplist.MinItem {
+			sz := int(s.itemSize(low))
+			if sz > maxHeatMapItemSize {
+				return nil
+			}
+			ph.LowKey = append([]byte(nil), ptrBytes(low, sz)...)
+		}
+		pages = append(pages, ph)
+		return nil
+	}
+
+	s.PageVisitor(callb, 1)
+	sort.SliceStable(pages, func(i, j int) bool {
+		return pages[i].Temperature > pages[j].Temperature
+	})
+
+	entries := make([]byte, 0, s.checkpointChunkSize())
+	for _, ph := range pages {
+		if len(entries)+heatMapEntryHdrSize+len(ph.LowKey) > cap(entries) {
+			break
+		}
+
+		entries = append(entries, byte(ph.Temperature), 0, 0)
+		binary.BigEndian.PutUint16(entries[len(entries)-2:], uint16(len(ph.LowKey)))
+		entries = append(entries, ph.LowKey...)
+	}
+
+	s.heatMapLock.Lock()
+	s.appendHeatMap(entries)
+	s.heatMapLock.Unlock()
+}
+
+// HeatMap returns the pages recorded by the latest heat map written to or
+// recovered from the log, starting with the hottest pages. The instance
+// must hold key value items.
+func (s *Plasma) HeatMap() []PageHeat {
+	pages := s.heatMapPages()
+	for i := range pages {
+		if low := pages[i].LowKey; len(low) > 0 {
+			pages[i].LowKey = (*item)(unsafe.Pointer(&low[0])).Key()
+		}
+	}
+
+	return pages
+}
+
+// heatMapPages returns the pages of the latest heat map with the low item
+// of the page in place of its key. A truncated entry ends the heat map.
+func (s *Plasma) heatMapPages() []PageHeat {
+	s.heatMapLock.Lock()
+	bs := s.heatMap
+	s.heatMapLock.Unlock()
+
+	var pages []PageHeat
+	for offset := 8; offset+heatMapEntryHdrSize <= len(bs); {
+		ph := PageHeat{Temperature: int(bs[offset])}
+		l := int(binary.BigEndian.Uint16(bs[offset+1 : offset+3]))
+		offset += heatMapEntryHdrSize
+		if offset+l > len(bs) {
+			break
+		} else if l > 0 {
+			ph.LowKey = append([]byte(nil), bs[offset:offset+l]...)
+		}
+		pages = append(pages, ph)
+		offset += l
+	}
+
+	return pages
+}
+
+func (s *Plasma) heatMapDaemon() {
+	for {
+		select {
+		case <-s.stopheatmap:
+			s.stopheatmap <- struct{}{}
+			return
+		case <-time.After(s.HeatMapInterval):
+			s.writeHeatMap()
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package plasma
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPlasmaHeatMap(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	cfg := testSnCfg
+	cfg.AutoSwapper = false
+	cfg.RecordHeatMap = true
+	cfg.HeatMapInterval = time.Millisecond * 10
+	s := newTestIntPlasmaStore(cfg)
+
+	w := s.NewWriter()
+	n := 100000
+	for i := 0; i < n; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte("val"))
+	}
+	s.PersistAll()
+	if err := s.CleanLSS(func() bool { return true }); err != nil {
+		t.Fatal(err)
+	}
+	s.EvictAll(0)
+
+	// Lookups only swap in the pages they read with a fetch budget
+	w.SetFetchBudget(time.Minute)
+	for i := 50000; i < 60000; i++ {
+		if _, err := w.LookupKV([]byte(fmt.Sprintf("key-%10d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	version := s.heatMapVersion()
+	for s.heatMapVersion() < version+2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	heatMap := s.HeatMap()
+	if len(heatMap) == 0 {
+		t.Fatalf("expected pages in the heat map")
+	}
+
+	for _, ph := range heatMap {
+		if len(ph.LowKey) == 0 {
+			t.Fatalf("unexpected first page in the heat map")
+		}
+
+		var k int
+		if _, err := fmt.Sscanf(string(ph.LowKey), "key-%d", &k); err != nil {
+			t.Fatalf("unexpected low key %q in the heat map", ph.LowKey)
+		}
+		if k < 49000 || k >= 60000 || ph.Temperature != 1 {
+			t.Errorf("unexpected page %d with temperature %d in the heat map", k, ph.Temperature)
+		}
+	}
+
+	// The latest heat map is rewritten after the replay offset
+	version = s.heatMapVersion()
+	if err := s.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if s.heatMapVersion() <= version {
+		t.Errorf("expected the heat map to be relocated")
+	}
+	s.Close()
+
+	s = newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	if got := s.HeatMap(); !reflect.DeepEqual(got, heatMap) {
+		t.Errorf("expected %d recovered pages in the heat map, got %d", len(heatMap), len(got))
+	}
+}
@@ -0,0 +1,397 @@
+package plasma
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	sysIOUringSetup = 425
+	sysIOUringEnter = 426
+
+	ioRingOffSQRing = 0
+	ioRingOffCQRing = 0x8000000
+	ioRingOffSQEs   = 0x10000000
+
+	ioRingEnterGetEvents = 1
+
+	ioRingOpRead  = 22
+	ioRingOpWrite = 23
+
+	ioRingSQESize = 64
+	ioRingCQESize = 16
+
+	ioRingEntries = 256
+	// Appends are split into writes of at most ioRingWriteSize bytes which
+	// are submitted in batches of up to ioRingMaxBatch writes
+	ioRingWriteSize = 256 * 1024
+	ioRingMaxBatch  = 32
+)
+
+type ioSQRingOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type ioCQRingOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type ioUringParams struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFd uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  ioSQRingOffsets
+	cqOff                                                                  ioCQRingOffsets
+}
+
+type ioRingSQE struct {
+	opcode, flags uint8
+	ioprio        uint16
+	fd            int32
+	off, addr     uint64
+	len, rwFlags  uint32
+	userData      uint64
+	pad           [3]uint64
+}
+
+type ioRingCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+type ioRingReq struct {
+	res  int32
+	done bool
+	// The request was not submitted before the ring failed
+	canceled bool
+}
+
+// Returned for the requests of a ring which has failed to submit requests.
+// They are done with synchronous system calls instead.
+var errIORingFailed = errors.New("io_uring has failed")
+
+// ioRing submits reads and writes to an io_uring. Requests of concurrent
+// callers are pushed to the submission queue and submitted in batches.
+// One of the callers waits for completions in the kernel and reaps them
+// for all the others.
+//
+// The buffers passed to the log escape to the heap through the Log
+// interface, hence they are not moved while the kernel accesses them.
+type ioRing struct {
+	fd             int
+	sqRing, cqRing []byte
+	sqes           []byte
+	sqTail, sqMask *uint32
+	sqArray        unsafe.Pointer
+	cqHead, cqTail *uint32
+	cqMask         uint32
+	cqes           unsafe.Pointer
+
+	mu          sync.Mutex
+	reaped      *sync.Cond
+	sqLocalTail uint32
+	pending     uint32
+	waiting     bool
+	inflight    []*ioRingReq
+	slots       chan uint64
+	// Set once submitting requests has failed, after which the ring is
+	// only entered to wait for the requests already submitted
+	err error
+
+	// Serializes the callers which need more than one slot, so that they
+	// cannot wait for each other's slots
+	batchMu sync.Mutex
+}
+
+func newIORing(entries uint32) (*ioRing, error) {
+	var p ioUringParams
+	fd, _, errno := syscall.Syscall(sysIOUringSetup, uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, os.NewSyscallError("io_uring_setup", errno)
+	}
+
+	r := &ioRing{fd: int(fd)}
+	r.reaped = sync.NewCond(&r.mu)
+	var err error
+	defer func() {
+		if err != nil {
+			r.unmap()
+			syscall.Close(r.fd)
+		}
+	}()
+
+	sqSize := int(p.sqOff.array + p.sqEntries*4)
+	if r.sqRing, err = syscall.Mmap(r.fd, ioRingOffSQRing, sqSize,
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE); err != nil {
+		return nil, err
+	}
+
+	cqSize := int(p.cqOff.cqes + p.cqEntries*ioRingCQESize)
+	if r.cqRing, err = syscall.Mmap(r.fd, ioRingOffCQRing, cqSize,
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE); err != nil {
+		return nil, err
+	}
+
+	if r.sqes, err = syscall.Mmap(r.fd, ioRingOffSQEs, int(p.sqEntries*ioRingSQESize),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE); err != nil {
+		return nil, err
+	}
+
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.tail]))
+	r.sqMask = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.ringMask]))
+	r.sqArray = unsafe.Pointer(&r.sqRing[p.sqOff.array])
+	r.sqLocalTail = atomic.LoadUint32(r.sqTail)
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.tail]))
+	r.cqMask = *(*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.ringMask]))
+	r.cqes = unsafe.Pointer(&r.cqRing[p.cqOff.cqes])
+
+	// The requests in flight are bounded by the submission queue size,
+	// which keeps the completion queue from overflowing
+	r.inflight = make([]*ioRingReq, p.sqEntries)
+	r.slots = make(chan uint64, p.sqEntries)
+	for i := uint64(0); i < uint64(p.sqEntries); i++ {
+		r.slots <- i
+	}
+
+	return r, nil
+}
+
+func (r *ioRing) unmap() {
+	for _, m := range [][]byte{r.sqRing, r.cqRing, r.sqes} {
+		if m != nil {
+			syscall.Munmap(m)
+		}
+	}
+}
+
+func (r *ioRing) enter(toSubmit, minComplete uint32, flags uintptr) (int, error) {
+	for {
+		n, _, errno := syscall.Syscall6(sysIOUringEnter, uintptr(r.fd), uintptr(toSubmit),
+			uintptr(minComplete), flags, 0, 0)
+		if errno == syscall.EINTR || errno == syscall.EAGAIN || errno == syscall.EBUSY {
+			continue
+		} else if errno != 0 {
+			return 0, os.NewSyscallError("io_uring_enter", errno)
+		}
+		return int(n), nil
+	}
+}
+
+// submit submits the pending requests. It is called with mu held, which
+// is released during the system call. If the requests cannot be submitted,
+// the ring fails. An error is only returned if waiting for completions
+// fails.
+func (r *ioRing) submit(minComplete uint32, flags uintptr) error {
+	n := r.pending
+	r.pending = 0
+	r.mu.Unlock()
+	submitted, err := r.enter(n, minComplete, flags)
+	r.mu.Lock()
+	r.pending += n - uint32(submitted)
+	if err != nil && n > 0 {
+		r.fail(err)
+		return nil
+	}
+
+	return err
+}
+
+// fail cancels the requests which have not been submitted. The entries of
+// the submission queue have been published to the kernel, which would
+// access their buffers once submitted, hence no further requests are
+// submitted to the ring. It is called with mu held.
+func (r *ioRing) fail(err error) {
+	r.err = err
+	for tail := r.sqLocalTail - r.pending; tail != r.sqLocalTail; tail++ {
+		slot := *(*uint32)(unsafe.Add(r.sqArray, (tail&*r.sqMask)*4))
+		req := r.inflight[slot]
+		r.inflight[slot] = nil
+		req.canceled, req.done = true, true
+		r.slots <- uint64(slot)
+	}
+	r.pending = 0
+	r.reaped.Broadcast()
+}
+
+// reap completes the requests found in the completion queue
+func (r *ioRing) reap() {
+	head := atomic.LoadUint32(r.cqHead)
+	tail := atomic.LoadUint32(r.cqTail)
+	for ; head != tail; head++ {
+		cqe := (*ioRingCQE)(unsafe.Add(r.cqes, (head&r.cqMask)*ioRingCQESize))
+		req := r.inflight[cqe.userData]
+		r.inflight[cqe.userData] = nil
+		req.res, req.done = cqe.res, true
+		r.slots <- cqe.userData
+	}
+	atomic.StoreUint32(r.cqHead, head)
+	r.reaped.Broadcast()
+}
+
+// do submits the reads or writes of bufs at the offsets of f and waits for
+// them to complete. The number of bytes transferred by each of them is
+// returned. It returns errIORingFailed without waiting for the requests
+// which could not be submitted, while the requests which were submitted
+// are always waited for since the kernel accesses their buffers.
+func (r *ioRing) do(op uint8, f *os.File, bufs [][]byte, offs []int64) ([]int, error) {
+	if len(bufs) > 1 {
+		r.batchMu.Lock()
+		defer r.batchMu.Unlock()
+	}
+
+	reqs := make([]ioRingReq, len(bufs))
+	slots := make([]uint64, len(bufs))
+	for i := range bufs {
+		slots[i] = <-r.slots
+	}
+
+	r.mu.Lock()
+	if r.err != nil {
+		for _, slot := range slots {
+			r.slots <- slot
+		}
+		r.mu.Unlock()
+		return nil, errIORingFailed
+	}
+
+	for i, bs := range bufs {
+		r.inflight[slots[i]] = &reqs[i]
+		sqe := (*ioRingSQE)(unsafe.Pointer(&r.sqes[slots[i]*ioRingSQESize]))
+		*sqe = ioRingSQE{
+			opcode:   op,
+			fd:       int32(f.Fd()),
+			off:      uint64(offs[i]),
+			addr:     uint64(uintptr(unsafe.Pointer(&bs[0]))),
+			len:      uint32(len(bs)),
+			userData: slots[i],
+		}
+		idx := r.sqLocalTail & *r.sqMask
+		*(*uint32)(unsafe.Add(r.sqArray, idx*4)) = uint32(slots[i])
+		r.sqLocalTail++
+	}
+	atomic.StoreUint32(r.sqTail, r.sqLocalTail)
+	r.pending += uint32(len(bufs))
+
+	var err error
+	if r.waiting {
+		// The caller waiting for completions cannot submit the requests
+		// until it returns from the kernel
+		err = r.submit(0, 0)
+	}
+
+	for err == nil && !reqsDone(reqs) {
+		if r.waiting {
+			r.reaped.Wait()
+			continue
+		}
+
+		r.waiting = true
+		err = r.submit(1, ioRingEnterGetEvents)
+		r.waiting = false
+		r.reap()
+	}
+	r.mu.Unlock()
+
+	if err != nil {
+		// The kernel may still access the buffers of the requests
+		panic(fmt.Sprintf("fatal: unable to wait for io_uring requests: %v", err))
+	}
+
+	// Only the descriptor of f is passed to the kernel
+	runtime.KeepAlive(f)
+
+	ns := make([]int, len(reqs))
+	for i, req := range reqs {
+		if req.canceled {
+			return nil, errIORingFailed
+		} else if req.res < 0 {
+			return nil, &os.PathError{Op: "io_uring", Path: f.Name(), Err: syscall.Errno(-req.res)}
+		}
+		ns[i] = int(req.res)
+	}
+
+	return ns, nil
+}
+
+func reqsDone(reqs []ioRingReq) bool {
+	for i := range reqs {
+		if !reqs[i].done {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (r *ioRing) ReadAt(f *os.File, bs []byte, off int64) error {
+	if len(bs) == 0 {
+		return nil
+	}
+
+	ns, err := r.do(ioRingOpRead, f, [][]byte{bs}, []int64{off})
+	if err == errIORingFailed {
+		_, err = f.ReadAt(bs, off)
+		return err
+	} else if err != nil {
+		return err
+	} else if ns[0] == 0 {
+		return io.EOF
+	} else if ns[0] < len(bs) {
+		// Short reads are completed synchronously
+		_, err = f.ReadAt(bs[ns[0]:], off+int64(ns[0]))
+	}
+
+	return err
+}
+
+// WriteAt splits bs into writes which are submitted together
+func (r *ioRing) WriteAt(f *os.File, bs []byte, off int64) error {
+	for len(bs) > 0 {
+		var bufs [][]byte
+		var offs []int64
+		for len(bs) > 0 && len(bufs) < ioRingMaxBatch {
+			n := len(bs)
+			if n > ioRingWriteSize {
+				n = ioRingWriteSize
+			}
+
+			bufs = append(bufs, bs[:n])
+			offs = append(offs, off)
+			bs, off = bs[n:], off+int64(n)
+		}
+
+		ns, err := r.do(ioRingOpWrite, f, bufs, offs)
+		if err == errIORingFailed {
+			// The writes are redone synchronously
+			ns = make([]int, len(bufs))
+		} else if err != nil {
+			return err
+		}
+
+		for i, n := range ns {
+			if n < len(bufs[i]) {
+				// Short writes are completed synchronously
+				if _, err := f.WriteAt(bufs[i][n:], offs[i]+int64(n)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *ioRing) Close() error {
+	r.unmap()
+	return syscall.Close(r.fd)
+}
@@ -2,6 +2,7 @@ package plasma
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"github.com/couchbase/nitro/skiplist"
 	"reflect"
@@ -12,15 +13,27 @@ import (
 
 // Layout for the item is as follows:
 // [    32 bit header       ][opt 32 bit keylen][key][64 bit sn][opt val]
-// [insert bit][val bit][len]
+// [insert bit][val bit][val ptr bit][len]
+//
+// Items with the val ptr bit set hold the offset and length of every
+// chunk of a value stored in the value log instead of the value itself.
 
 const (
 	itmInsertMask = 0x80000000
 	itmHasValMask = 0x40000000
-	itmLenMask    = 0x3fffffff
+	itmValPtrMask = 0x20000000
+	itmLenMask    = 0x1fffffff
 	itmHdrLen     = 4
 	itmSnSize     = 8
 	itmKlenSize   = 4
+	itmValPtrSize = 12
+
+	// Items are length prefixed by 16 bits in the page encoding
+	maxItemSize = 0xffff
+	maxKeySize  = maxItemSize - itmHdrLen - itmKlenSize - itmSnSize
+
+	// Largest key and value which can be stored inline
+	maxInlineKVSize = maxItemSize - itmHdrLen - itmKlenSize - itmSnSize
 )
 
 // A placeholder type for holding item data
@@ -51,6 +64,36 @@ func (itm *item) HasValue() bool {
 	return itmHasValMask&*itm > 0
 }
 
+func (itm *item) IsValuePtr() bool {
+	return itmValPtrMask&*itm > 0
+}
+
+func (itm *item) numValuePtrs() int {
+	return len(itm.Value()) / itmValPtrSize
+}
+
+func (itm *item) valuePtr(i int) (LSSOffset, int) {
+	vp := itm.Value()[i*itmValPtrSize:]
+	return LSSOffset(binary.BigEndian.Uint64(vp[:8])), int(binary.BigEndian.Uint32(vp[8:12]))
+}
+
+func (itm *item) setValuePtr(i int, off LSSOffset) {
+	binary.BigEndian.PutUint64(itm.Value()[i*itmValPtrSize:], uint64(off))
+}
+
+func (itm *item) valueLen() int {
+	if !itm.IsValuePtr() {
+		return len(itm.Value())
+	}
+
+	var l int
+	for i := 0; i < itm.numValuePtrs(); i++ {
+		_, cl := itm.valuePtr(i)
+		l += cl
+	}
+	return l
+}
+
 func (itm *item) Sn() uint64 {
 	kptr, klen := itm.k()
 	return *(*uint64)(unsafe.Pointer(kptr + uintptr(klen)))
@@ -137,6 +180,21 @@ func (s *Plasma) newItem(k, v []byte, sn uint64, del bool, buf []byte) *item {
 	return (*item)(ptr)
 }
 
+// newValuePtrItem creates an item pointing to the chunks of a value written
+// to the value log
+func (s *Plasma) newValuePtrItem(k []byte, ptrs []byte, sn uint64, buf []byte) *item {
+	itm := s.newItem(k, ptrs, sn, false, buf)
+	*itm |= itmValPtrMask
+	return itm
+}
+
+func appendValuePtr(ptrs []byte, off LSSOffset, l int) []byte {
+	var vp [itmValPtrSize]byte
+	binary.BigEndian.PutUint64(vp[:8], uint64(off))
+	binary.BigEndian.PutUint32(vp[8:], uint32(l))
+	return append(ptrs, vp[:]...)
+}
+
 func cmpItem(a, b unsafe.Pointer) int {
 	if a == skiplist.MinItem || b == skiplist.MaxItem {
 		return -1
@@ -161,7 +219,10 @@ func itemStringer(itm unsafe.Pointer) string {
 
 	x := (*item)(itm)
 	v := "(nil)"
-	if x.HasValue() {
+	if x.IsValuePtr() {
+		off, _ := x.valuePtr(0)
+		v = fmt.Sprintf("(vlog %d:%d)", off, x.valueLen())
+	} else if x.HasValue() {
 		v = string(x.Value())
 	}
 	return fmt.Sprintf("item key:%s val:%s sn:%d insert: %v", string(x.Key()), v, x.Sn(), x.IsInsert())
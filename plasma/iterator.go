@@ -57,11 +57,45 @@ type Iterator struct {
 	currPid   PageId
 	nextPid   PageId
 	currPgItr pgOpIterator
+	currHiItm unsafe.Pointer
+	currLoItm unsafe.Pointer
 	filter    ItemFilter
+	reverse   bool
+
+	startItm unsafe.Pointer
+	endItm   unsafe.Pointer
+
+	// Low item of the last page requested to be fetched ahead
+	readAheadItm unsafe.Pointer
+
+	cachePolicy CachePolicy
+
+	// Pages read from the LSS are not swapped in
+	keysOnly bool
+
+	// Positioned by SeekFirst or SeekLast without bounds
+	fullScan bool
 
 	err error
 }
 
+// CachePolicy controls whether the pages read by an iterator are promoted
+// in the eviction policy of the instance
+type CachePolicy int
+
+const (
+	// Pages are promoted unless they are read by a full scan, i.e. a scan
+	// positioned by SeekFirst or SeekLast on an iterator without bounds,
+	// so that a single large scan does not evict the hot working set
+	CacheDefault CachePolicy = iota
+
+	// Pages are always promoted
+	CachePromote
+
+	// Pages are never promoted
+	CacheNoPromote
+)
+
 func (s *Plasma) NewIterator() ItemIterator {
 	return &Iterator{
 		store:  s,
@@ -72,8 +106,8 @@ func (s *Plasma) NewIterator() ItemIterator {
 
 func (itr *Iterator) initPgIterator(pid PageId, seekItm unsafe.Pointer) {
 	itr.currPid = pid
-	if pgPtr, err := itr.store.ReadPage(pid, itr.wCtx.pgRdrFn, true, itr.wCtx); err == nil {
-		itr.store.updateCacheMeta(pid)
+	if pgPtr, err := itr.store.ReadPage(pid, itr.wCtx.pgRdrFn, !itr.keysOnly, itr.wCtx); err == nil {
+		itr.touchPage(pid)
 		pg := pgPtr.(*page)
 		if err == nil {
 			if pg.IsEmpty() {
@@ -81,11 +115,17 @@ func (itr *Iterator) initPgIterator(pid PageId, seekItm unsafe.Pointer) {
 			}
 
 			itr.nextPid = pg.Next()
+			itr.currHiItm = pg.head.hiItm
+			itr.sts.ChainLenHist.add(int(pg.head.chainLen))
 			itr.filter.Reset()
 			var sts pgOpIteratorStats
 			itr.currPgItr = newPgOpIterator(pg.head, pg.cmp, seekItm, pg.head.hiItm, itr.filter, itr.wCtx, &sts)
 			itr.nr = itr.sts.NumLSSReads
 			itr.currPgItr.Init()
+
+			if itr.store.readAheadCh != nil && !itr.keysOnly {
+				itr.readAhead(pg)
+			}
 		} else {
 			itr.err = err
 		}
@@ -100,6 +140,17 @@ func (itr *Iterator) Close() {
 }
 
 func (itr *Iterator) SeekFirst() error {
+	if itr.store.isClosed() {
+		return ErrClosed
+	}
+
+	if itr.startItm != nil {
+		return itr.Seek(itr.startItm)
+	}
+
+	itr.fullScan = itr.endItm == nil
+	itr.reverse = false
+	itr.readAheadItm = nil
 	itr.initPgIterator(itr.store.Skiplist.HeadNode(), nil)
 	itr.tryNextPg()
 	return itr.err
@@ -107,6 +158,21 @@ func (itr *Iterator) SeekFirst() error {
 }
 
 func (itr *Iterator) Seek(itm unsafe.Pointer) error {
+	itr.fullScan = false
+	return itr.seek(itm)
+}
+
+// seek positions the iterator at itm without changing whether the scan is
+// a full scan
+func (itr *Iterator) seek(itm unsafe.Pointer) error {
+	if itr.store.isClosed() {
+		return ErrClosed
+	}
+
+	if itr.startItm != nil && itr.store.cmp(itm, itr.startItm) < 0 {
+		itm = itr.startItm
+	}
+
 	var pid PageId
 	if prev, curr, found := itr.store.Skiplist.Lookup(itm, itr.store.cmp, itr.wCtx.buf, itr.wCtx.slSts); found {
 		pid = curr
@@ -114,6 +180,8 @@ func (itr *Iterator) Seek(itm unsafe.Pointer) error {
 		pid = prev
 	}
 
+	itr.reverse = false
+	itr.readAheadItm = nil
 	itr.initPgIterator(pid, itm)
 	itr.tryNextPg()
 	return itr.err
@@ -127,30 +195,275 @@ func (itr *Iterator) Valid() bool {
 	return itr.currPgItr != nil && itr.currPgItr.Valid()
 }
 
+// SetEndKey sets an inclusive upper bound for the iterator. The iterator
+// becomes invalid once it moves past the end item. A nil item removes the
+// bound.
+func (itr *Iterator) SetEndKey(itm unsafe.Pointer) {
+	itr.endItm = itm
+}
+
+// SetBounds restricts the iterator to items within [start, end]. Seeks
+// to an item below start are positioned at start. A nil item leaves the
+// corresponding side unbounded.
+func (itr *Iterator) SetBounds(start, end unsafe.Pointer) {
+	itr.startItm = start
+	itr.endItm = end
+}
+
+// SetCachePolicy sets whether the pages read by the iterator are promoted
+// in the eviction policy. It applies to the pages read after the call.
+func (itr *Iterator) SetCachePolicy(p CachePolicy) {
+	itr.cachePolicy = p
+}
+
+// touchPage records the access to a page read by the iterator according to
+// its cache policy
+func (itr *Iterator) touchPage(pid PageId) {
+	if itr.cachePolicy == CachePromote || (itr.cachePolicy == CacheDefault && !itr.fullScan) {
+		itr.store.updateCacheMeta(pid)
+	}
+}
+
+func (itr *Iterator) closePgIterator() {
+	itr.currPgItr.Close()
+	if itr.sts.NumLSSReads-itr.nr > 0 {
+		itr.sts.CacheMisses++
+	} else {
+		itr.sts.CacheHits++
+	}
+}
+
 // If the current page has no valid item, move to next page
 func (itr *Iterator) tryNextPg() {
 	for !itr.currPgItr.Valid() {
-		itr.currPgItr.Close()
-		if itr.sts.NumLSSReads-itr.nr > 0 {
-			itr.sts.CacheMisses++
-		} else {
-			itr.sts.CacheHits++
-		}
-		if itr.nextPid == itr.store.EndPageId() {
+		itr.closePgIterator()
+
+		// End item is covered by the current page
+		endReached := itr.endItm != nil && itr.store.cmp(itr.endItm, itr.currHiItm) < 0
+		if endReached || itr.nextPid == itr.store.EndPageId() {
 			itr.currPgItr = nil
 			break
 		}
 		itr.initPgIterator(itr.nextPid, nil)
 	}
+
+	itr.checkEndItm()
+}
+
+func (itr *Iterator) checkEndItm() {
+	if itr.endItm != nil && itr.currPgItr != nil &&
+		itr.store.cmp(itr.currPgItr.Get().Item(), itr.endItm) > 0 {
+		itr.currPgItr.Close()
+		itr.currPgItr = nil
+	}
 }
 
 func (itr *Iterator) Next() error {
+	if itr.reverse {
+		// Reposition in ascending order at the current item
+		curr, old := itr.Get(), itr.currPgItr
+		err := itr.seek(curr)
+		if err == nil && itr.Valid() && itr.store.cmp(itr.Get(), curr) == 0 {
+			err = itr.Next()
+		}
+		old.Close()
+		return err
+	}
+
 	itr.currPgItr.Next()
 	itr.tryNextPg()
 
 	return itr.err
 }
 
+// SeekLast positions the iterator at the last item. If an end bound is set,
+// the iterator is positioned at the last item within the bound.
+func (itr *Iterator) SeekLast() error {
+	if itr.store.isClosed() {
+		return ErrClosed
+	}
+
+	if itr.endItm != nil {
+		itr.fullScan = false
+		return itr.seekPrev(itr.endItm, true)
+	}
+
+	itr.fullScan = itr.startItm == nil
+	return itr.seekPrev(skiplist.MaxItem, false)
+}
+
+// SeekLT positions the iterator at the last item less than itm
+func (itr *Iterator) SeekLT(itm unsafe.Pointer) error {
+	if itr.store.isClosed() {
+		return ErrClosed
+	}
+
+	itr.fullScan = false
+	if itr.endItm != nil && itr.store.cmp(itm, itr.endItm) > 0 {
+		return itr.seekPrev(itr.endItm, true)
+	}
+
+	return itr.seekPrev(itm, false)
+}
+
+// Prev moves the iterator to the previous item
+func (itr *Iterator) Prev() error {
+	if !itr.reverse {
+		return itr.seekPrev(itr.Get(), false)
+	}
+
+	itr.currPgItr.Next()
+	itr.tryPrevPg()
+
+	return itr.err
+}
+
+// seekPrev positions the iterator at the last item below itm, or at itm
+// if it is inclusive
+func (itr *Iterator) seekPrev(itm unsafe.Pointer, inclusive bool) error {
+	var pid PageId
+	if itm == skiplist.MaxItem {
+		pid = itr.store.pageBefore(itm, itr.wCtx)
+	} else {
+		prev, curr, found := itr.store.Skiplist.Lookup(itm, itr.store.cmp, itr.wCtx.buf, itr.wCtx.slSts)
+		if pid = prev; found && inclusive {
+			pid = curr
+		}
+	}
+
+	old := itr.currPgItr
+	itr.reverse = true
+	itr.initRevPgIterator(pid, itm, inclusive)
+	itr.tryPrevPg()
+	if old != nil {
+		old.Close()
+	}
+
+	return itr.err
+}
+
+func (itr *Iterator) initRevPgIterator(pid PageId, high unsafe.Pointer, inclusive bool) {
+	itr.currPid = pid
+	pgPtr, err := itr.store.ReadPage(pid, itr.wCtx.pgRdrFn, !itr.keysOnly, itr.wCtx)
+	if err != nil {
+		itr.err = err
+		itr.currPgItr = nil
+		return
+	}
+
+	itr.touchPage(pid)
+	pg := pgPtr.(*page)
+	if pg.IsEmpty() {
+		panic("an empty page found")
+	}
+
+	itr.currLoItm = pg.MinItem()
+	itr.sts.ChainLenHist.add(int(pg.head.chainLen))
+	itr.filter.Reset()
+	var sts pgOpIteratorStats
+	itr.currPgItr = &revPgIterator{
+		itr:       newPgOpIterator(pg.head, pg.cmp, itr.startItm, pg.head.hiItm, itr.filter, itr.wCtx, &sts),
+		cmp:       pg.cmp,
+		high:      high,
+		inclusive: inclusive,
+	}
+	itr.nr = itr.sts.NumLSSReads
+	itr.currPgItr.Init()
+}
+
+// If the current page has no valid item, move to previous page
+func (itr *Iterator) tryPrevPg() {
+	for itr.currPgItr != nil && !itr.currPgItr.Valid() {
+		itr.closePgIterator()
+
+		// Start item is covered by the current page
+		startReached := itr.startItm != nil && itr.store.cmp(itr.startItm, itr.currLoItm) >= 0
+		if startReached || itr.currLoItm == skiplist.MinItem {
+			itr.currPgItr = nil
+			break
+		}
+
+		low := itr.currLoItm
+		itr.initRevPgIterator(itr.store.pageBefore(low, itr.wCtx), low, false)
+	}
+}
+
+// Lookup key placed after all the pages of the page table
+var pageTableEnd byte
+
+func cmpPageTableEnd(a, b unsafe.Pointer) int {
+	return -1
+}
+
+// pageBefore returns the page holding the items right below the minimum
+// item of a page, or the last page for MaxItem
+func (s *Plasma) pageBefore(low unsafe.Pointer, ctx *wCtx) PageId {
+retry:
+	var prev *skiplist.Node
+	if low == skiplist.MaxItem {
+		prev, _, _ = s.Skiplist.Lookup(unsafe.Pointer(&pageTableEnd), cmpPageTableEnd, ctx.buf, ctx.slSts)
+	} else {
+		prev, _, _ = s.Skiplist.Lookup(low, s.cmp, ctx.buf, ctx.slSts)
+	}
+
+	pid := PageId(prev)
+	for {
+		pg, _ := s.ReadPage(pid, nil, false, ctx)
+		if pg.NeedRemoval() {
+			s.tryPageRemoval(pid, pg, ctx)
+			goto retry
+		}
+
+		// Split page may not be indexed yet
+		if pg.MaxItem() == skiplist.MaxItem || s.cmp(pg.MaxItem(), low) >= 0 {
+			return pid
+		}
+		pid = pg.Next()
+	}
+}
+
+// Reverse page iterator. Delta chains can only be merged in ascending
+// order, so the items of the page are collected by a forward iterator.
+type revPgIterator struct {
+	itr       pgOpIterator
+	cmp       skiplist.CompareFn
+	high      unsafe.Pointer
+	inclusive bool
+	items     []PageItem
+	i         int
+}
+
+func (rpi *revPgIterator) Init() {
+	rpi.itr.Init()
+	for ; rpi.itr.Valid(); rpi.itr.Next() {
+		itm := rpi.itr.Get()
+		if rpi.high != skiplist.MaxItem {
+			if c := rpi.cmp(itm.Item(), rpi.high); c > 0 || c == 0 && !rpi.inclusive {
+				break
+			}
+		}
+		rpi.items = append(rpi.items, itm)
+	}
+
+	rpi.i = len(rpi.items) - 1
+}
+
+func (rpi *revPgIterator) Get() PageItem {
+	return rpi.items[rpi.i]
+}
+
+func (rpi *revPgIterator) Valid() bool {
+	return rpi.i >= 0
+}
+
+func (rpi *revPgIterator) Next() {
+	rpi.i--
+}
+
+func (rpi *revPgIterator) Close() {
+	rpi.itr.Close()
+}
+
 // Delta chain sorted iterator
 type pdIterator struct {
 	pw     pageWalker
@@ -393,6 +706,7 @@ func newPgOpIterator(head *pageDelta, cmp skiplist.CompareFn,
 	low, high unsafe.Pointer, filter ItemFilter, ctx *wCtx, sts *pgOpIteratorStats) (iter pgOpIterator) {
 
 	var hasReloc bool
+	var ranges []*rangeDeleteDelta
 	m := &pdMergeIterator{cmp: cmp, ItemFilter: filter}
 	pdCount := 0
 
@@ -450,18 +764,28 @@ loop:
 			pdCount++
 		case opRollbackDelta:
 			filter.AddFilter(pw.RollbackFilter())
+		case opRangeDeleteDelta:
+			ranges = append(ranges, pw.RangeDelete())
 		}
 	}
 
+	// Range tombstones remove the items older than them
+	if len(ranges) > 0 && m.itrs[1] != nil {
+		m.itrs[1] = &rangeDeleteIterator{itr: m.itrs[1], ranges: ranges, cmp: cmp}
+	}
+
 	if pdCount > 0 {
 		pdi.deltas = make([]PageItem, 0, pdCount)
+		newer := 0
 		for pw.SetEndAndRestart(); !pw.End(); pw.Next() {
 			op := pw.Op()
 			if op == opInsertDelta || op == opDeleteDelta {
 				itm := pw.Item()
-				if cmp(itm, high) < 0 && cmp(itm, low) >= 0 {
+				if cmp(itm, high) < 0 && cmp(itm, low) >= 0 && !rangeDeleted(ranges[:newer], itm, cmp) {
 					pdi.deltas = append(pdi.deltas, pw.PageItem())
 				}
+			} else if op == opRangeDeleteDelta {
+				newer++
 			}
 		}
 
@@ -476,3 +800,50 @@ loop:
 	sts.numLSSRecords += pw.NumLSSRecords()
 	return m
 }
+
+// rangeDeleted returns whether itm is covered by one of the range tombstones
+func rangeDeleted(ranges []*rangeDeleteDelta, itm unsafe.Pointer, cmp skiplist.CompareFn) bool {
+	for _, rdd := range ranges {
+		if rdd.covers(itm, cmp) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Skips the items of an iterator which are covered by the range tombstones
+// added after them
+type rangeDeleteIterator struct {
+	itr    pgOpIterator
+	ranges []*rangeDeleteDelta
+	cmp    skiplist.CompareFn
+}
+
+func (rdi *rangeDeleteIterator) Init() {
+	rdi.itr.Init()
+	rdi.skip()
+}
+
+func (rdi *rangeDeleteIterator) skip() {
+	for rdi.itr.Valid() && rangeDeleted(rdi.ranges, rdi.itr.Get().Item(), rdi.cmp) {
+		rdi.itr.Next()
+	}
+}
+
+func (rdi *rangeDeleteIterator) Get() PageItem {
+	return rdi.itr.Get()
+}
+
+func (rdi *rangeDeleteIterator) Valid() bool {
+	return rdi.itr.Valid()
+}
+
+func (rdi *rangeDeleteIterator) Next() {
+	rdi.itr.Next()
+	rdi.skip()
+}
+
+func (rdi *rangeDeleteIterator) Close() {
+	rdi.itr.Close()
+}
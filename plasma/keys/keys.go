@@ -0,0 +1,163 @@
+// Package keys implements order-preserving composite key encoding for
+// plasma. Encoded keys compare correctly using bytes.Compare, so they can be
+// used with the default KV comparator or with the Compare/ItemSize functions
+// provided here when storing raw items.
+package keys
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/couchbase/nitro/skiplist"
+	"math"
+	"reflect"
+	"strings"
+	"unsafe"
+)
+
+// Order specifies the sort direction of a key component
+type Order int
+
+const (
+	Asc Order = iota
+	Desc
+)
+
+const (
+	strEscape    = 0x00
+	strEscaped   = 0xff
+	strTerminate = 0x01
+
+	itemHdrLen = 4
+)
+
+// Collation transforms a string into a byte sequence whose bytewise order
+// matches the desired string order
+type Collation func(dst []byte, s string) []byte
+
+// Binary collation orders strings by their raw bytes
+func Binary(dst []byte, s string) []byte {
+	return append(dst, s...)
+}
+
+// CaseInsensitive collation orders strings ignoring letter case
+func CaseInsensitive(dst []byte, s string) []byte {
+	return append(dst, strings.ToLower(s)...)
+}
+
+// Builder composes a key from multiple typed components
+type Builder struct {
+	buf []byte
+}
+
+func NewBuilder(buf []byte) *Builder {
+	return &Builder{buf: buf[:0]}
+}
+
+func (b *Builder) Reset() {
+	b.buf = b.buf[:0]
+}
+
+// Bytes returns the encoded key. The slice is reused by the builder
+// after Reset.
+func (b *Builder) Bytes() []byte {
+	return b.buf
+}
+
+func (b *Builder) Int(v int64, o Order) *Builder {
+	return b.Uint(uint64(v)^(1<<63), o)
+}
+
+func (b *Builder) Uint(v uint64, o Order) *Builder {
+	off := len(b.buf)
+	var tmp [8]byte
+	binary.BigEndian.PutUint64(tmp[:], v)
+	b.buf = append(b.buf, tmp[:]...)
+	b.applyOrder(off, o)
+	return b
+}
+
+func (b *Builder) Float(v float64, o Order) *Builder {
+	bits := math.Float64bits(v)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+
+	return b.Uint(bits, o)
+}
+
+// String appends a string component using the given collation. Zero bytes
+// are escaped and the component is terminated so that a string always sorts
+// before any longer string sharing it as a prefix.
+func (b *Builder) String(s string, coll Collation, o Order) *Builder {
+	if coll == nil {
+		coll = Binary
+	}
+
+	off := len(b.buf)
+	b.buf = coll(b.buf, s)
+	end := len(b.buf)
+	for i := off; i < end; i++ {
+		if b.buf[i] == strEscape {
+			b.buf = append(b.buf, 0)
+			copy(b.buf[i+2:], b.buf[i+1:end+1])
+			b.buf[i+1] = strEscaped
+			i++
+			end++
+		}
+	}
+
+	b.buf = append(b.buf, strEscape, strTerminate)
+	b.applyOrder(off, o)
+	return b
+}
+
+func (b *Builder) applyOrder(off int, o Order) {
+	if o == Desc {
+		for i := off; i < len(b.buf); i++ {
+			b.buf[i] = ^b.buf[i]
+		}
+	}
+}
+
+// NewItem returns a length prefixed item holding the key which can be
+// inserted into a plasma instance configured with Compare and ItemSize
+func NewItem(k []byte) unsafe.Pointer {
+	buf := make([]byte, itemHdrLen+len(k))
+	binary.LittleEndian.PutUint32(buf, uint32(len(k)))
+	copy(buf[itemHdrLen:], k)
+	return unsafe.Pointer(&buf[0])
+}
+
+// Key returns the encoded key stored in an item created by NewItem
+func Key(itm unsafe.Pointer) (bs []byte) {
+	l := *(*uint32)(itm)
+	sh := (*reflect.SliceHeader)(unsafe.Pointer(&bs))
+	sh.Data = uintptr(itm) + itemHdrLen
+	sh.Len = int(l)
+	sh.Cap = sh.Len
+	return
+}
+
+// Compare implements skiplist.CompareFn for items created by NewItem
+func Compare(a, b unsafe.Pointer) int {
+	if a == skiplist.MinItem || b == skiplist.MaxItem {
+		return -1
+	}
+
+	if a == skiplist.MaxItem || b == skiplist.MinItem {
+		return 1
+	}
+
+	return bytes.Compare(Key(a), Key(b))
+}
+
+// ItemSize implements plasma.ItemSizeFn for items created by NewItem
+func ItemSize(itm unsafe.Pointer) uintptr {
+	if itm == skiplist.MinItem || itm == skiplist.MaxItem {
+		return 0
+	}
+
+	return uintptr(itemHdrLen + *(*uint32)(itm))
+}
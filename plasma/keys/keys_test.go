@@ -0,0 +1,85 @@
+package keys
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"testing"
+)
+
+func TestIntFloatOrder(t *testing.T) {
+	ints := []int64{math.MinInt64, -1000, -1, 0, 1, 42, math.MaxInt64}
+	floats := []float64{math.Inf(-1), -1e10, -0.5, 0, 0.5, 3.14, math.Inf(1)}
+
+	for i := 1; i < len(ints); i++ {
+		a := NewBuilder(nil).Int(ints[i-1], Asc).Bytes()
+		b := NewBuilder(nil).Int(ints[i], Asc).Bytes()
+		if bytes.Compare(a, b) >= 0 {
+			t.Errorf("expected %d < %d", ints[i-1], ints[i])
+		}
+
+		a = NewBuilder(nil).Int(ints[i-1], Desc).Bytes()
+		b = NewBuilder(nil).Int(ints[i], Desc).Bytes()
+		if bytes.Compare(a, b) <= 0 {
+			t.Errorf("expected %d > %d in descending order", ints[i-1], ints[i])
+		}
+	}
+
+	for i := 1; i < len(floats); i++ {
+		a := NewBuilder(nil).Float(floats[i-1], Asc).Bytes()
+		b := NewBuilder(nil).Float(floats[i], Asc).Bytes()
+		if bytes.Compare(a, b) >= 0 {
+			t.Errorf("expected %v < %v", floats[i-1], floats[i])
+		}
+	}
+}
+
+func TestCompositeOrder(t *testing.T) {
+	type row struct {
+		name string
+		age  int64
+	}
+
+	rows := []row{
+		{"bob", 10}, {"Alice", 30}, {"alice", 20}, {"al", 5},
+		{"al\x00x", 1}, {"bob", 40}, {"carol", 7},
+	}
+
+	var itms [][]byte
+	for _, r := range rows {
+		k := NewBuilder(nil).String(r.name, CaseInsensitive, Asc).Int(r.age, Desc).Bytes()
+		itms = append(itms, k)
+	}
+
+	sort.Slice(itms, func(i, j int) bool {
+		return Compare(NewItem(itms[i]), NewItem(itms[j])) < 0
+	})
+
+	expected := [][]byte{
+		NewBuilder(nil).String("al", CaseInsensitive, Asc).Int(5, Desc).Bytes(),
+		NewBuilder(nil).String("al\x00x", CaseInsensitive, Asc).Int(1, Desc).Bytes(),
+		NewBuilder(nil).String("alice", CaseInsensitive, Asc).Int(30, Desc).Bytes(),
+		NewBuilder(nil).String("alice", CaseInsensitive, Asc).Int(20, Desc).Bytes(),
+		NewBuilder(nil).String("bob", CaseInsensitive, Asc).Int(40, Desc).Bytes(),
+		NewBuilder(nil).String("bob", CaseInsensitive, Asc).Int(10, Desc).Bytes(),
+		NewBuilder(nil).String("carol", CaseInsensitive, Asc).Int(7, Desc).Bytes(),
+	}
+
+	for i := range expected {
+		if !bytes.Equal(itms[i], expected[i]) {
+			t.Errorf("mismatch at %d: %v != %v", i, itms[i], expected[i])
+		}
+	}
+}
+
+func TestItemSize(t *testing.T) {
+	k := NewBuilder(nil).String("hello", nil, Desc).Bytes()
+	itm := NewItem(k)
+	if !bytes.Equal(Key(itm), k) {
+		t.Errorf("key mismatch")
+	}
+
+	if ItemSize(itm) != uintptr(itemHdrLen+len(k)) {
+		t.Errorf("unexpected item size %d", ItemSize(itm))
+	}
+}
@@ -2,41 +2,138 @@ package plasma
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	mmap "github.com/edsrzf/mmap-go"
 	"hash/crc32"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"sync"
 	"sync/atomic"
 	"unsafe"
 )
 
 const (
-	logSBSize  = 4096
-	logVersion = 0
+	logSBSize = 4096
+	// Version of the format of the log. Logs of version 0 were written
+	// before the blocks were checksummed and may hold blocks whose header
+	// only records their length. The blocks written since are flagged as
+	// checksummed, hence such a log is read as is and only recorded at the
+	// current version once the cleaner has trimmed the blocks written
+	// before it was opened. Logs of a newer version fail to open with
+	// ErrLogVersion.
+	logVersion = 1
+	// Superblock copies are written in turns, so that a torn write leaves
+	// the previous copies intact
+	logSBCopies = 2
+	// Alignment of the offset, size and memory of O_DIRECT writes
+	directIOAlign = 4096
+	// Size of the identifier of the encryption key recorded in the
+	// superblock
+	logKeyIDSize = 16
 )
 
+// Granularity at which the trimmed part of a segment file is freed
+const trimPunchSize = 8 * 1024 * 1024
+
 var segFileNameFormat = "log.%014d.data"
 var segFilePattern = "log.*.data"
 var segFileIdPattern = "log.%d.data"
 var headerFileName = "header.data"
-var ErrLogSuperBlockCorrupt = fmt.Errorf("Log superblock is corrupt")
 
+// Spare segment files are preallocated ahead of the tail of the log and
+// renamed to the next segment once the log grows
+var segSpareNameFormat = "log.%014d.spare"
+var segSparePattern = "log.*.spare"
+var segSpareIdPattern = "log.%d.spare"
+
+// Number of spare segment files kept ready. As many trimmed segments are
+// kept to replace the spares taken.
+const maxSpareSegments = 2
+
+var ErrLogSuperBlockCorrupt = fmt.Errorf("Log superblock is corrupt: %w", ErrCorruptLog)
+
+// Log is the storage of an LSS. It is an append-only address space of
+// bytes, from Head to Tail, whose head and tail are made durable by
+// commits. A custom Log can be supplied by Config.LogFactory.
 type Log interface {
+	// Offset of the first byte which has not been trimmed
 	Head() int64
+	// Offset at which the next append is written
 	Tail() int64
+	// Read fills the buffer with the bytes at the offset. The range must
+	// lie between Head and Tail.
 	Read([]byte, int64) error
+	// Append writes the bytes at the tail
 	Append([]byte) error
+	// Trim discards the log before the offset. The space may be reclaimed
+	// once the trim is committed.
 	Trim(offset int64)
+	// Commit makes the appends and the head and the tail durable. The log
+	// is reopened at the last committed head and tail.
 	Commit() error
+	// CommitNoSync records the head and the tail like Commit without
+	// waiting for the appends and the superblock to reach the disk
+	CommitNoSync() error
+	// Space used by the log in bytes
 	Size() int64
 	Close() error
+
+	// Epoch of the writes since the log was opened. A log which returns
+	// zero disables the detection of torn tails.
+	Epoch() int64
+	// Start and epoch of the range appended by the last commit
+	LastCommit() (start int64, epoch int64)
+	// Truncate discards the log from offset to the tail. It must be called
+	// before any appends.
+	Truncate(offset int64) error
+}
+
+// LogHolePuncher is implemented by logs which can free the space of a
+// range between the head and the tail. It is used to drop the segments
+// of the LSS which only hold stale blocks.
+type LogHolePuncher interface {
+	// WriteAt overwrites the bytes at the offset and makes them durable
+	WriteAt([]byte, int64) error
+	// PunchHole frees the space of the range, which reads back as zeros
+	PunchHole(start, end int64) error
+}
+
+// LogOptions are passed to a LogFactory
+type LogOptions struct {
+	SegmentSize int64
+	ReadOnly    bool
+	// Appends are expected to be durable once they return
+	Sync bool
 }
 
+// LogFactory opens the log stored at path, which is the directory of the
+// LSS or of the value log of an instance
+type LogFactory func(path string, opts LogOptions) (Log, error)
+
+// IOEngine selects how the files of the LSS are read and written
+type IOEngine uint8
+
+const (
+	// Reads and appends are synchronous system calls
+	IOEngineSync IOEngine = iota
+	// Reads and appends are submitted to an io_uring. The reads of
+	// concurrent page fetches are submitted in batches and appends are
+	// split into writes which are submitted together.
+	IOEngineIOUring
+)
+
 type logFile struct {
 	fd   *os.File
 	data mmap.MMap
+
+	// Opened with O_DIRECT for the appends to the last segment
+	directFd *os.File
+
+	// The segment has been moved to the tier and has no local file
+	remote bool
 }
 
 type fileIndex struct {
@@ -47,23 +144,55 @@ type fileIndex struct {
 }
 
 type multiFilelog struct {
-	sbBuffer [logSBSize]byte
-	sbGen    int64
-	sbFd     *os.File
+	sbBuffer  [logSBSize]byte
+	sbGen     int64
+	sbFd      *os.File
+	committed logSB
+	epoch     int64
+	// Blocks before upgradeOffset may have been written at the version
+	// the log was opened at. The superblock keeps that version until they
+	// have been trimmed.
+	upgradeOffset int64
 
 	basePath    string
 	segmentSize int64
 
 	headOffset int64
 	tailOffset int64
+	// The space of the first segment file is freed up to this offset
+	punchOffset int64
+	// Set once the file system has refused to punch a hole
+	noHolePunch int32
 
 	index *fileIndex
+	// Serializes the updates of the index
+	indexLock sync.Mutex
+
+	// Cold segments are moved to the tier if set
+	tier *logTier
 
 	sync       bool
 	enableMmap bool
+	readOnly   bool
+	directIO   bool
+
+	// Used for the reads and appends of IOEngineIOUring
+	ring *ioRing
+
+	// Set if segment files are preallocated and trimmed segments are
+	// recycled. Spares are ready to become the next segment, while the
+	// recycled files still have to be cleared by the preallocator.
+	prealloc     bool
+	spares       []string
+	recycled     []string
+	nextSpareId  int64
+	preallocCh   chan struct{}
+	stopPrealloc chan struct{}
+	preallocWg   sync.WaitGroup
 }
 
-func newLog(path string, segmentSize int64, sync bool, mmap bool) (Log, error) {
+func newLog(path string, segmentSize int64, sync bool, mmap bool, directIO bool, engine IOEngine,
+	tier *logTier) (Log, error) {
 	var sbBuffer [logSBSize]byte
 	os.MkdirAll(path, 0755)
 	headerFile := filepath.Join(path, headerFileName)
@@ -72,34 +201,138 @@ func newLog(path string, segmentSize int64, sync bool, mmap bool) (Log, error) {
 		return nil, err
 	}
 
-	h, t, g, err := readLogSB(fd, sbBuffer[:])
+	// Segments are removed and rewritten, hence readers are excluded
+	if err := lockFileExclusive(fd); err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	sb, invalid, err := readLogSB(fd, sbBuffer[:])
 	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	if err := repairLogSB(fd, sbBuffer[:], sb, invalid); err != nil {
+		fd.Close()
 		return nil, err
 	}
 
 	log := &multiFilelog{
 		segmentSize: segmentSize,
 		sbBuffer:    sbBuffer,
-		sbGen:       g + 1,
+		sbGen:       sb.gen + 1,
 		sbFd:        fd,
+		committed:   sb,
+		epoch:       sb.gen + 1,
 		basePath:    path,
-		headOffset:  h,
-		tailOffset:  t,
+		headOffset:  sb.head,
+		tailOffset:  sb.tail,
 		enableMmap:  mmap,
 		sync:        sync,
+		directIO:    directIO,
+		tier:        tier,
+
+		upgradeOffset: sb.tail,
+	}
+
+	if err := log.initIOEngine(engine); err != nil {
+		fd.Close()
+		return nil, err
 	}
 
 	if err := log.initIndex(); err != nil {
+		log.closeIOEngine()
+		fd.Close()
 		return nil, err
 	}
 
 	return log, err
 }
 
+func (l *multiFilelog) initIOEngine(engine IOEngine) (err error) {
+	if engine == IOEngineIOUring {
+		l.ring, err = newIORing(ioRingEntries)
+	}
+	return err
+}
+
+func (l *multiFilelog) closeIOEngine() {
+	if l.ring != nil {
+		l.ring.Close()
+	}
+}
+
+func (l *multiFilelog) readAt(f *os.File, bs []byte, off int64) error {
+	if l.ring != nil {
+		return l.ring.ReadAt(f, bs, off)
+	}
+
+	_, err := f.ReadAt(bs, off)
+	return err
+}
+
+func (l *multiFilelog) writeAt(f *os.File, bs []byte, off int64) error {
+	if l.ring != nil {
+		return l.ring.WriteAt(f, bs, off)
+	}
+
+	_, err := f.WriteAt(bs, off)
+	return err
+}
+
+// newReadOnlyLog opens an existing log for reading. A shared lock is held
+// on the header file until the log is closed, which excludes a writer.
+func newReadOnlyLog(path string, segmentSize int64, mmap bool, engine IOEngine, tier *logTier) (Log, error) {
+	var sbBuffer [logSBSize]byte
+	fd, err := os.Open(filepath.Join(path, headerFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lockFileShared(fd); err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	sb, _, err := readLogSB(fd, sbBuffer[:])
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	log := &multiFilelog{
+		segmentSize: segmentSize,
+		sbBuffer:    sbBuffer,
+		sbGen:       sb.gen,
+		sbFd:        fd,
+		committed:   sb,
+		basePath:    path,
+		headOffset:  sb.head,
+		tailOffset:  sb.tail,
+		enableMmap:  mmap,
+		readOnly:    true,
+		tier:        tier,
+	}
+
+	if err := log.initIOEngine(engine); err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	if err := log.initIndex(); err != nil {
+		log.closeIOEngine()
+		fd.Close()
+		return nil, err
+	}
+
+	return log, nil
+}
+
 func newLogFile(file string, flags int, maxSize int, enableMmap bool) (*logFile, error) {
 	var err error
 	lf := new(logFile)
-	lf.fd, err = os.OpenFile(file, os.O_RDWR|flags, 0755)
+	lf.fd, err = os.OpenFile(file, flags, 0755)
 	if err != nil {
 		return nil, err
 	}
@@ -112,6 +345,14 @@ func newLogFile(file string, flags int, maxSize int, enableMmap bool) (*logFile,
 }
 
 func (lf *logFile) Close() error {
+	if lf.remote {
+		return nil
+	}
+
+	if lf.directFd != nil {
+		lf.directFd.Close()
+	}
+
 	err := lf.fd.Close()
 	if err != nil {
 		return err
@@ -126,23 +367,51 @@ func (lf *logFile) Close() error {
 func (l *multiFilelog) initIndex() error {
 	fi := new(fileIndex)
 	files, _ := filepath.Glob(filepath.Join(l.basePath, segFilePattern))
-	if len(files) > 0 {
-		var startId, endId int64
-		startFile := filepath.Base(files[0])
-		endFile := filepath.Base(files[len(files)-1])
-		fmt.Sscanf(startFile, segFileIdPattern, &startId)
-		fmt.Sscanf(endFile, segFileIdPattern, &endId)
+	remote := l.remoteSegments()
+	if len(files) > 0 || len(remote) > 0 {
+		startId, endId := int64(math.MaxInt64), int64(-1)
+		for _, f := range files {
+			var id int64
+			fmt.Sscanf(filepath.Base(f), segFileIdPattern, &id)
+			startId, endId = minInt64(startId, id), maxInt64(endId, id)
+		}
+
+		for id := range remote {
+			startId, endId = minInt64(startId, id), maxInt64(endId, id)
+		}
+
 		fi.startOffset = startId * l.segmentSize
 		fi.endOffset = endId*l.segmentSize + l.segmentSize
 	}
 
-	for i, f := range files {
-		if lf, err := newLogFile(f, 0, int(l.segmentSize), l.enableMmap); err == nil {
-			fi.index = append(fi.index, lf)
-			if i == len(files)-1 {
-				fi.w = lf.fd
-			}
+	flags := os.O_RDWR
+	if l.readOnly {
+		flags = os.O_RDONLY
+	} else if l.sync {
+		// Commits rely on the appends to be synced like in growLog
+		flags |= os.O_SYNC
+	}
+
+	for off := fi.startOffset; off < fi.endOffset; off += l.segmentSize {
+		id := off / l.segmentSize
+		f := filepath.Join(l.basePath, fmt.Sprintf(segFileNameFormat, id))
+
+		var err error
+		if _, serr := os.Stat(f); serr != nil && remote[id] {
+			fi.index = append(fi.index, &logFile{remote: true})
 		} else {
+			// The local file is used if the log was closed while the
+			// segment was being moved
+			var lf *logFile
+			if lf, err = newLogFile(f, flags, int(l.segmentSize), l.enableMmap); err == nil {
+				fi.index = append(fi.index, lf)
+				if off+l.segmentSize == fi.endOffset && !l.readOnly {
+					fi.w, err = l.openWriter(lf, flags)
+				}
+			}
+		}
+
+		if err != nil {
 			for _, lf := range fi.index {
 				lf.Close()
 			}
@@ -159,11 +428,11 @@ func (l *multiFilelog) Read(bs []byte, off int64) error {
 
 retry:
 	if off >= idx.endOffset {
-		return fmt.Errorf("Log size is smaller than offset (%d < %d)", idx.endOffset, off)
+		return fmt.Errorf("Log size is smaller than offset (%d < %d): %w", idx.endOffset, off, ErrCorruptLog)
 	}
 
 	if off < idx.startOffset {
-		return fmt.Errorf("Log starts at offset %d, trying to read %d", idx.startOffset, off)
+		return fmt.Errorf("Log starts at offset %d, trying to read %d: %w", idx.startOffset, off, ErrCorruptLog)
 	}
 
 	fdIdx := (off - idx.startOffset) / l.segmentSize
@@ -176,10 +445,14 @@ retry:
 		bs = bs[:avail]
 	}
 
-	if l.enableMmap {
-		copy(bs, idx.index[fdIdx].data[fdOffset:])
+	if lf := idx.index[fdIdx]; lf.remote {
+		if err := l.readRemote(off/l.segmentSize, bs, fdOffset); err != nil {
+			return err
+		}
+	} else if l.enableMmap {
+		copy(bs, lf.data[fdOffset:])
 	} else {
-		if _, err := idx.index[fdIdx].fd.ReadAt(bs, fdOffset); err != nil {
+		if err := l.readAt(idx.index[fdIdx].fd, bs, fdOffset); err != nil {
 			return err
 		}
 	}
@@ -206,6 +479,9 @@ func (l *multiFilelog) getIndex() *fileIndex {
 }
 
 func (l *multiFilelog) growLog() error {
+	l.indexLock.Lock()
+	defer l.indexLock.Unlock()
+
 	var err error
 	idx := l.getIndex()
 	newFileId := (idx.endOffset + 1) / l.segmentSize
@@ -218,14 +494,24 @@ func (l *multiFilelog) growLog() error {
 		idx.w.Sync()
 	}
 
+	if l.prealloc {
+		l.takeSpare(file)
+	}
+
 	lf, err := newLogFile(file, flags, int(l.segmentSize), l.enableMmap)
 	if err != nil {
 		return err
 	}
 
+	w, err := l.openWriter(lf, flags)
+	if err != nil {
+		lf.Close()
+		return err
+	}
+
 	newIdx := *idx
 	newIdx.index = append(newIdx.index, lf)
-	newIdx.w = lf.fd
+	newIdx.w = w
 	newIdx.endOffset += l.segmentSize
 
 	atomic.StorePointer((*unsafe.Pointer)(unsafe.Pointer(&l.index)), unsafe.Pointer(&newIdx))
@@ -233,6 +519,10 @@ func (l *multiFilelog) growLog() error {
 }
 
 func (l *multiFilelog) Append(bs []byte) error {
+	if l.readOnly {
+		return ErrReadOnly
+	}
+
 	wsize := int64(len(bs))
 	tail := l.tailOffset
 retry:
@@ -248,7 +538,14 @@ retry:
 
 	if wl := int64(len(bs)); wl > 0 {
 		woffset := tail % l.segmentSize
-		if _, err := idx.w.WriteAt(bs, woffset); err != nil {
+		w := idx.w
+		if l.directIO && !directIOAligned(bs, woffset) {
+			// E.g. the first append at the tail of a log which was written
+			// without direct IO goes through the page cache
+			w = idx.index[len(idx.index)-1].fd
+		}
+
+		if err := l.writeAt(w, bs, woffset); err != nil {
 			return err
 		}
 
@@ -268,22 +565,128 @@ retry:
 	return nil
 }
 
+// openWriter returns the file used to append to a segment
+func (l *multiFilelog) openWriter(lf *logFile, flags int) (*os.File, error) {
+	if !l.directIO {
+		return lf.fd, nil
+	}
+
+	var err error
+	lf.directFd, err = os.OpenFile(lf.fd.Name(), flags|oDirect, 0755)
+	return lf.directFd, err
+}
+
+// directIOAligned reports whether bs can be written at offset using O_DIRECT
+func directIOAligned(bs []byte, offset int64) bool {
+	return offset%directIOAlign == 0 && len(bs)%directIOAlign == 0 &&
+		uintptr(unsafe.Pointer(&bs[0]))%directIOAlign == 0
+}
+
 func (l *multiFilelog) Trim(offset int64) {
 	if offset > 0 {
 		atomic.StoreInt64(&l.headOffset, offset)
 	}
 }
 
+// segmentRanges calls fn with the part of the range [off, off+n) stored in
+// each segment file
+func (l *multiFilelog) segmentRanges(off, n int64, fn func(lf *logFile, fdOffset, size int64) error) error {
+	idx := l.getIndex()
+	if off < idx.startOffset || off+n > idx.endOffset {
+		return fmt.Errorf("Log range is [%d, %d), trying to access %d bytes at %d: %w",
+			idx.startOffset, idx.endOffset, n, off, ErrCorruptLog)
+	}
+
+	for n > 0 {
+		fdOffset := off % l.segmentSize
+		size := l.segmentSize - fdOffset
+		if size > n {
+			size = n
+		}
+
+		if err := fn(idx.index[(off-idx.startOffset)/l.segmentSize], fdOffset, size); err != nil {
+			return err
+		}
+
+		off, n = off+size, n-size
+	}
+
+	return nil
+}
+
+func (l *multiFilelog) WriteAt(bs []byte, off int64) error {
+	if l.readOnly {
+		return ErrReadOnly
+	}
+
+	return l.segmentRanges(off, int64(len(bs)), func(lf *logFile, fdOffset, size int64) error {
+		if lf.remote {
+			return ErrLogSegmentTiered
+		} else if fileShared(lf.fd) {
+			return ErrLogSegmentShared
+		}
+
+		if _, err := lf.fd.WriteAt(bs[:size], fdOffset); err != nil {
+			return err
+		}
+
+		bs = bs[size:]
+		return lf.fd.Sync()
+	})
+}
+
+func (l *multiFilelog) PunchHole(start, end int64) error {
+	if l.readOnly {
+		return ErrReadOnly
+	}
+
+	return l.segmentRanges(start, end-start, func(lf *logFile, fdOffset, size int64) error {
+		if lf.remote || fileShared(lf.fd) {
+			// The space is not held locally or is still used by a clone
+			return nil
+		}
+
+		err := punchHole(lf.fd, fdOffset, size)
+		if holePunchUnsupported(err) {
+			atomic.StoreInt32(&l.noHolePunch, 1)
+		}
+		return err
+	})
+}
+
+// HolePunchSupported returns false once the file system of the log has
+// refused to punch a hole, after which the space of trimmed and dropped
+// ranges is only freed by removing whole segments
+func (l *multiFilelog) HolePunchSupported() bool {
+	return atomic.LoadInt32(&l.noHolePunch) == 0
+}
+
 func (l *multiFilelog) doGCSegments() {
+	l.indexLock.Lock()
+	defer l.indexLock.Unlock()
+
 	idx := l.getIndex()
 	free := (l.headOffset/l.segmentSize)*l.segmentSize - idx.startOffset
 	if free > 0 {
 		n := free / l.segmentSize
 		toRemove := idx.index[:n]
 		var rmList []string
-		for _, lf := range toRemove {
-			rmList = append(rmList, lf.fd.Name())
+		for i, lf := range toRemove {
+			if lf.remote {
+				id := idx.startOffset/l.segmentSize + int64(i)
+				l.removeRemote(id)
+				continue
+			}
+
+			recycle := l.prealloc && !fileShared(lf.fd) &&
+				len(l.recycled) < maxSpareSegments
+			name := lf.fd.Name()
 			lf.Close()
+			if recycle && l.recycleSegment(name) {
+				continue
+			}
+
+			rmList = append(rmList, name)
 		}
 		toRetain := append([]*logFile(nil), idx.index[n:]...)
 
@@ -299,29 +702,258 @@ func (l *multiFilelog) doGCSegments() {
 		}()
 
 		atomic.StorePointer((*unsafe.Pointer)(unsafe.Pointer(&l.index)), unsafe.Pointer(&newIdx))
+		idx = &newIdx
+	}
+
+	// Segment files are large, hence the space before the head is also
+	// freed in steps of trimPunchSize within the first one
+	if l.punchOffset < idx.startOffset {
+		l.punchOffset = idx.startOffset
+	}
+
+	if end := (l.headOffset / trimPunchSize) * trimPunchSize; end > l.punchOffset &&
+		l.HolePunchSupported() {
+		if err := l.PunchHole(l.punchOffset, end); err == nil {
+			l.punchOffset = end
+		}
+	}
+}
+
+// startPrealloc makes the log keep spare segment files ready, so that
+// growing the log renames a file whose space is already allocated instead
+// of creating one, and recycle the trimmed segments as spares instead of
+// removing them
+func (l *multiFilelog) startPrealloc() {
+	if l.readOnly {
+		return
+	}
+
+	// Spares left over from an earlier open might not have been prepared
+	files, _ := filepath.Glob(filepath.Join(l.basePath, segSparePattern))
+	for _, f := range files {
+		var id int64
+		fmt.Sscanf(filepath.Base(f), segSpareIdPattern, &id)
+		l.nextSpareId = maxInt64(l.nextSpareId, id+1)
+		if len(l.recycled) < 2*maxSpareSegments {
+			l.recycled = append(l.recycled, f)
+		} else {
+			os.Remove(f)
+		}
+	}
+
+	l.prealloc = true
+	l.preallocCh = make(chan struct{}, 1)
+	l.stopPrealloc = make(chan struct{})
+	l.preallocWg.Add(1)
+	go l.preallocator()
+	l.notifyPreallocator()
+}
+
+func (l *multiFilelog) notifyPreallocator() {
+	select {
+	case l.preallocCh <- struct{}{}:
+	default:
 	}
 }
 
+func (l *multiFilelog) preallocator() {
+	defer l.preallocWg.Done()
+
+	for {
+		select {
+		case <-l.stopPrealloc:
+			return
+		case <-l.preallocCh:
+		}
+
+		for l.prepareSpare() {
+		}
+	}
+}
+
+// prepareSpare clears a recycled segment file or creates a new one and
+// allocates the space of a segment to it. It returns false once enough
+// spares are ready.
+func (l *multiFilelog) prepareSpare() bool {
+	l.indexLock.Lock()
+	if len(l.spares) >= maxSpareSegments {
+		l.indexLock.Unlock()
+		return false
+	}
+
+	var file string
+	if n := len(l.recycled); n > 0 {
+		file, l.recycled = l.recycled[n-1], l.recycled[:n-1]
+	} else {
+		file = filepath.Join(l.basePath, fmt.Sprintf(segSpareNameFormat, l.nextSpareId))
+		l.nextSpareId++
+	}
+	l.indexLock.Unlock()
+
+	if err := preallocFile(file, l.segmentSize); err != nil {
+		os.Remove(file)
+		return false
+	}
+
+	l.indexLock.Lock()
+	l.spares = append(l.spares, file)
+	l.indexLock.Unlock()
+	return true
+}
+
+// takeSpare renames a spare to the segment file, if one is ready. It is
+// called with the index lock held.
+func (l *multiFilelog) takeSpare(file string) {
+	defer l.notifyPreallocator()
+
+	if len(l.spares) == 0 {
+		return
+	}
+
+	spare := l.spares[0]
+	l.spares = l.spares[1:]
+	if err := os.Rename(spare, file); err != nil {
+		os.Remove(spare)
+	}
+}
+
+// recycleSegment renames the file of a trimmed segment to a spare, which is
+// cleared by the preallocator. It is called with the index lock held.
+func (l *multiFilelog) recycleSegment(file string) bool {
+	spare := filepath.Join(l.basePath, fmt.Sprintf(segSpareNameFormat, l.nextSpareId))
+	if err := os.Rename(file, spare); err != nil {
+		return false
+	}
+
+	l.nextSpareId++
+	l.recycled = append(l.recycled, spare)
+	l.notifyPreallocator()
+	return true
+}
+
 func (l *multiFilelog) Commit() error {
+	return l.commit(true)
+}
+
+func (l *multiFilelog) CommitNoSync() error {
+	return l.commit(false)
+}
+
+func (l *multiFilelog) commit(sync bool) error {
+	if l.readOnly {
+		return ErrReadOnly
+	}
+
 	idx := l.getIndex()
-	if !l.sync {
+	if sync && !l.sync && idx.w != nil {
 		if err := idx.w.Sync(); err != nil {
 			return err
 		}
 	}
 
-	marshalLogSB(l.sbBuffer[:], l.Head(), l.Tail(), l.sbGen)
-	offset := int64(logSBSize * (l.sbGen % 2))
+	sb := logSB{
+		head:        l.Head(),
+		tail:        l.Tail(),
+		gen:         l.sbGen,
+		commitStart: l.committed.commitStart,
+		epoch:       l.committed.epoch,
+		version:     l.committed.version,
+		keyID:       l.committed.keyID,
+	}
+
+	if sb.version < logVersion && sb.head >= l.upgradeOffset {
+		sb.version = logVersion
+	}
+
+	if sb.tail != l.committed.tail {
+		sb.commitStart, sb.epoch = l.committed.tail, l.epoch
+	}
+
+	marshalLogSB(l.sbBuffer[:], sb)
+	offset := int64(logSBSize * (l.sbGen % logSBCopies))
 	if _, err := l.sbFd.WriteAt(l.sbBuffer[:], offset); err != nil {
 		return err
 	}
 
-	l.sbFd.Sync()
+	if sync {
+		l.sbFd.Sync()
+	}
 	l.sbGen++
+	l.committed = sb
 	l.doGCSegments()
 	return nil
 }
 
+// Version returns the version of the log recorded by the last commit
+func (l *multiFilelog) Version() uint32 {
+	return l.committed.version
+}
+
+// KeyID returns the identifier of the encryption key recorded by the last
+// commit
+func (l *multiFilelog) KeyID() [logKeyIDSize]byte {
+	return l.committed.keyID
+}
+
+// SetKeyID sets the identifier of the encryption key recorded by the next
+// commit. It is only set before the first block is appended.
+func (l *multiFilelog) SetKeyID(id [logKeyIDSize]byte) {
+	l.committed.keyID = id
+}
+
+func (l *multiFilelog) Epoch() int64 {
+	return l.epoch
+}
+
+func (l *multiFilelog) LastCommit() (int64, int64) {
+	return l.committed.commitStart, l.committed.epoch
+}
+
+func (l *multiFilelog) Truncate(offset int64) error {
+	atomic.StoreInt64(&l.tailOffset, offset)
+	if l.readOnly {
+		return nil
+	}
+
+	// Segments past the new tail are removed
+	idx := l.getIndex()
+	for len(idx.index) > 1 && offset < idx.endOffset-l.segmentSize {
+		lf := idx.index[len(idx.index)-1]
+		lf.Close()
+		if err := os.Remove(lf.fd.Name()); err != nil {
+			return err
+		}
+
+		flags := os.O_RDWR
+		if l.sync {
+			flags |= os.O_SYNC
+		}
+
+		newIdx := *idx
+		newIdx.index = idx.index[:len(idx.index)-1]
+		w, err := l.openWriter(newIdx.index[len(newIdx.index)-1], flags)
+		if err != nil {
+			return err
+		}
+
+		newIdx.w = w
+		newIdx.endOffset -= l.segmentSize
+		atomic.StorePointer((*unsafe.Pointer)(unsafe.Pointer(&l.index)), unsafe.Pointer(&newIdx))
+		idx = &newIdx
+	}
+
+	if idx.w != nil {
+		if err := idx.w.Truncate(offset - (idx.endOffset - l.segmentSize)); err != nil {
+			return err
+		}
+	}
+
+	// The commit range is kept to record the epoch of the blocks before
+	// the new tail
+	l.committed.tail = offset
+	return l.Commit()
+}
+
 func (l *multiFilelog) Size() int64 {
 	return l.Tail() - l.Head()
 }
@@ -333,28 +965,52 @@ func (l *multiFilelog) Close() error {
 	}
 
 	idx.index = nil
-	return nil
+	l.closeIOEngine()
+	if l.stopPrealloc != nil {
+		close(l.stopPrealloc)
+		l.preallocWg.Wait()
+		l.stopPrealloc = nil
+	}
+
+	// Releases the shared or exclusive lock
+	return l.sbFd.Close()
+}
+
+// logSB is the state of the log recorded by a superblock. The blocks in
+// [commitStart, tail) were appended by the epoch which wrote the last
+// commit. The epoch is the generation of the superblock committed when
+// the log was opened for writing.
+type logSB struct {
+	head, tail  int64
+	gen         int64
+	commitStart int64
+	epoch       int64
+	version     uint32
+	// Identifies the key the blocks are encrypted with, all zeros if
+	// they are not encrypted
+	keyID [logKeyIDSize]byte
 }
 
-func marshalLogSB(buf []byte, headOffset, tailOffset int64, gen int64) {
+func marshalLogSB(buf []byte, sb logSB) {
 	woffset := 4
-	binary.BigEndian.PutUint32(buf[woffset:woffset+4], uint32(logVersion))
+	binary.BigEndian.PutUint32(buf[woffset:woffset+4], sb.version)
 	woffset += 4
 
-	binary.BigEndian.PutUint64(buf[woffset:woffset+8], uint64(gen))
-	woffset += 8
-
-	binary.BigEndian.PutUint64(buf[woffset:woffset+8], uint64(headOffset))
-	woffset += 8
-
-	binary.BigEndian.PutUint64(buf[woffset:woffset+8], uint64(tailOffset))
-	woffset += 8
+	for _, v := range []int64{sb.gen, sb.head, sb.tail, sb.commitStart, sb.epoch} {
+		binary.BigEndian.PutUint64(buf[woffset:woffset+8], uint64(v))
+		woffset += 8
+	}
+	copy(buf[woffset:woffset+logKeyIDSize], sb.keyID[:])
 
 	hash := crc32.ChecksumIEEE(buf[4:logSBSize])
 	binary.BigEndian.PutUint32(buf[0:4], hash)
 }
 
-func unmarshalLogSB(buf []byte) (headOffset, tailOffset int64, gen int64, err error) {
+// unmarshalLogSB decodes a superblock. Superblocks written before commit
+// ranges were recorded have a zero epoch and those written before the key
+// was recorded a zero key identifier. Logs of a newer version are
+// rejected with ErrLogVersion.
+func unmarshalLogSB(buf []byte) (sb logSB, err error) {
 	hash := binary.BigEndian.Uint32(buf[0:4])
 	computedHash := crc32.ChecksumIEEE(buf[4:logSBSize])
 	if hash != computedHash {
@@ -362,51 +1018,77 @@ func unmarshalLogSB(buf []byte) (headOffset, tailOffset int64, gen int64, err er
 		return
 	}
 
+	sb.version = binary.BigEndian.Uint32(buf[4:8])
+	if sb.version > logVersion {
+		err = fmt.Errorf("%w: version %d is newer than %d", ErrLogVersion, sb.version, logVersion)
+		return
+	}
+
 	roffset := 8
-	gen = int64(binary.BigEndian.Uint64(buf[roffset : roffset+8]))
-	roffset += 8
-	headOffset = int64(binary.BigEndian.Uint64(buf[roffset : roffset+8]))
-	roffset += 8
-	tailOffset = int64(binary.BigEndian.Uint64(buf[roffset : roffset+8]))
-	roffset += 8
+	for _, v := range []*int64{&sb.gen, &sb.head, &sb.tail, &sb.commitStart, &sb.epoch} {
+		*v = int64(binary.BigEndian.Uint64(buf[roffset : roffset+8]))
+		roffset += 8
+	}
+	copy(sb.keyID[:], buf[roffset:roffset+logKeyIDSize])
 	return
 }
 
-func readLogSB(fd *os.File, buf []byte) (headOff, tailOff, gen int64, err error) {
-	var hs, ts, gens [2]int64
-	var errs [2]error
+// readLogSB returns the newest valid superblock copy along with the slots
+// of the copies which are corrupt or have not been written. An error is
+// returned only if none of the written copies is valid.
+func readLogSB(fd *os.File, buf []byte) (sb logSB, invalid []int, err error) {
+	var found, written bool
 
-	if _, err = fd.ReadAt(buf, 0); err == io.EOF {
-		return 0, 0, 0, nil
-	} else if err != nil {
-		return
-	}
+	for i := 0; i < logSBCopies; i++ {
+		n, rerr := fd.ReadAt(buf, int64(logSBSize*i))
+		if rerr != nil && rerr != io.EOF {
+			return logSB{}, nil, rerr
+		}
 
-	hs[0], ts[0], gens[0], errs[0] = unmarshalLogSB(buf)
+		if n == 0 {
+			invalid = append(invalid, i)
+			continue
+		}
 
-	if _, err = fd.ReadAt(buf, logSBSize); err == io.EOF {
-		return hs[0], ts[0], gens[0], errs[0]
-	} else if err != nil {
-		return
+		// A torn copy is rejected by the checksum
+		for j := n; j < len(buf); j++ {
+			buf[j] = 0
+		}
+
+		written = true
+		csb, uerr := unmarshalLogSB(buf)
+		if errors.Is(uerr, ErrLogVersion) {
+			return logSB{}, nil, uerr
+		} else if uerr != nil {
+			invalid = append(invalid, i)
+		} else if !found || csb.gen > sb.gen {
+			sb, found = csb, true
+		}
+	}
+
+	if !written {
+		return logSB{version: logVersion}, invalid, nil
+	} else if !found {
+		return logSB{}, nil, ErrLogSuperBlockCorrupt
 	}
 
-	hs[1], ts[1], gens[1], errs[1] = unmarshalLogSB(buf)
+	return sb, invalid, nil
+}
 
-	var sbIndex int
-	if errs[0] == nil && errs[1] == nil {
-		if gens[0] < gens[1] {
-			sbIndex = 1
-		} else {
-			sbIndex = 0
+// repairLogSB overwrites the corrupt superblock copies by the valid one.
+// The copies of a new log are initialized, so that a torn write of the
+// first superblock falls back to the empty log.
+func repairLogSB(fd *os.File, buf []byte, sb logSB, invalid []int) error {
+	if len(invalid) == 0 {
+		return nil
+	}
+
+	marshalLogSB(buf, sb)
+	for _, i := range invalid {
+		if _, err := fd.WriteAt(buf[:logSBSize], int64(logSBSize*i)); err != nil {
+			return err
 		}
-	} else if errs[0] == nil {
-		sbIndex = 0
-	} else if errs[1] == nil {
-		sbIndex = 1
-	} else {
-		err = ErrLogSuperBlockCorrupt
-		return
 	}
 
-	return hs[sbIndex], ts[sbIndex], gens[sbIndex] + 1, nil
+	return fd.Sync()
 }
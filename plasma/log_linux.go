@@ -1,6 +1,7 @@
 package plasma
 
 import (
+	"errors"
 	"os"
 	"sync/atomic"
 	"syscall"
@@ -9,6 +10,7 @@ import (
 const minHolePunchSize = 512 * 1024 * 1024
 const FALLOC_FL_PUNCH_HOLEOC_FL_KEEP_SIZE = 0x01
 const FALLOC_FL_PUNCH_HOLE = 0x02
+const oDirect = syscall.O_DIRECT
 
 type singleFileLog struct {
 	fd                     *os.File
@@ -16,6 +18,7 @@ type singleFileLog struct {
 	sbBuffer               [logSBSize]byte
 	sbGen                  int64
 	lastTrimOffset         int64
+	version                uint32
 }
 
 func newSingleFileLog(path string) (Log, error) {
@@ -26,16 +29,21 @@ func newSingleFileLog(path string) (Log, error) {
 		return nil, err
 	}
 
-	h, t, g, err := readLogSB(fd, sbBuffer[:])
+	sb, invalid, err := readLogSB(fd, sbBuffer[:])
 	if err != nil {
 		return nil, err
 	}
 
+	if err := repairLogSB(fd, sbBuffer[:], sb, invalid); err != nil {
+		return nil, err
+	}
+
 	log := &singleFileLog{
 		fd:         fd,
-		headOffset: h,
-		tailOffset: t,
-		sbGen:      g + 1,
+		headOffset: sb.head,
+		tailOffset: sb.tail,
+		sbGen:      sb.gen + 1,
+		version:    sb.version,
 	}
 
 	return log, nil
@@ -50,7 +58,7 @@ func (l *singleFileLog) Tail() int64 {
 }
 
 func (l *singleFileLog) Read(bs []byte, off int64) error {
-	_, err := l.fd.ReadAt(bs, off+2*logSBSize)
+	_, err := l.fd.ReadAt(bs, off+logSBCopies*logSBSize)
 	return err
 }
 
@@ -68,8 +76,9 @@ func (l *singleFileLog) Trim(offset int64) {
 }
 
 func (l *singleFileLog) Commit() error {
-	marshalLogSB(l.sbBuffer[:], l.headOffset, l.tailOffset, l.sbGen)
-	offset := int64(logSBSize * (l.sbGen % 2))
+	marshalLogSB(l.sbBuffer[:], logSB{head: l.headOffset, tail: l.tailOffset, gen: l.sbGen,
+		version: l.version})
+	offset := int64(logSBSize * (l.sbGen % logSBCopies))
 	if _, err := l.fd.WriteAt(l.sbBuffer[:], offset); err != nil {
 		return err
 	}
@@ -81,10 +90,35 @@ func (l *singleFileLog) Commit() error {
 	return nil
 }
 
+// The superblock is never synced by Commit
+func (l *singleFileLog) CommitNoSync() error {
+	return l.Commit()
+}
+
 func (l *singleFileLog) Size() int64 {
 	return atomic.LoadInt64(&l.tailOffset) - atomic.LoadInt64(&l.headOffset)
 }
 
+// Version returns the version of the log when it was opened, which is
+// kept since the log is not upgraded
+func (l *singleFileLog) Version() uint32 {
+	return l.version
+}
+
+// Epoch is not tracked, hence the blocks of the last commit are not checked
+func (l *singleFileLog) Epoch() int64 {
+	return 0
+}
+
+func (l *singleFileLog) LastCommit() (int64, int64) {
+	return l.Tail(), 0
+}
+
+func (l *singleFileLog) Truncate(offset int64) error {
+	atomic.StoreInt64(&l.tailOffset, offset)
+	return l.Commit()
+}
+
 func (l *singleFileLog) Close() error {
 	return l.fd.Close()
 }
@@ -101,8 +135,67 @@ func (l *singleFileLog) tryHolePunch() error {
 	return nil
 }
 
+// lockFileShared and lockFileExclusive lock the header of a log for readers
+// and for the writer respectively. ErrInUse is returned if the log is held
+// in the other mode or by another writer.
+func lockFileShared(f *os.File) error {
+	return lockFile(f, syscall.LOCK_SH)
+}
+
+func lockFileExclusive(f *os.File) error {
+	return lockFile(f, syscall.LOCK_EX)
+}
+
+func lockFile(f *os.File, how int) error {
+	err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return ErrInUse
+	}
+
+	return err
+}
+
 func punchHole(f *os.File, offset, size int64) error {
 	return syscall.Fallocate(int(f.Fd()),
 		FALLOC_FL_PUNCH_HOLE|FALLOC_FL_PUNCH_HOLEOC_FL_KEEP_SIZE, offset,
 		size)
 }
+
+// holePunchUnsupported reports whether punchHole failed since the file
+// system does not support it
+func holePunchUnsupported(err error) bool {
+	return errors.Is(err, syscall.EOPNOTSUPP)
+}
+
+// preallocFile truncates the file and allocates size bytes of space to it
+// without changing its size, so that appends up to size do not allocate
+func preallocFile(file string, size int64) error {
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0755)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+
+	err = syscall.Fallocate(int(f.Fd()), FALLOC_FL_PUNCH_HOLEOC_FL_KEEP_SIZE, 0, size)
+	if err != nil && err != syscall.EOPNOTSUPP {
+		return err
+	}
+
+	return f.Sync()
+}
+
+// fileShared reports whether the file has other hard links, e.g. a log
+// segment shared with a clone
+func fileShared(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return true
+	}
+
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && st.Nlink > 1
+}
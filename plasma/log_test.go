@@ -2,10 +2,16 @@ package plasma
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"os"
 	"path/filepath"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 )
 
 var logTestDataPath = "/tmp/logdir"
@@ -13,7 +19,7 @@ var syncMode = true
 
 func TestLogOperation(t *testing.T) {
 	os.RemoveAll(logTestDataPath)
-	l, _ := newLog(logTestDataPath, 1024*1024, syncMode, false)
+	l, _ := newLog(logTestDataPath, 1024*1024, syncMode, false, false, IOEngineSync, nil)
 	bs := make([]byte, 973)
 	n := 1024 * 20
 	for i := 0; i < n; i++ {
@@ -38,7 +44,7 @@ func TestLogOperation(t *testing.T) {
 
 	l.Close()
 
-	l, _ = newLog(logTestDataPath, 1024*1024, syncMode, false)
+	l, _ = newLog(logTestDataPath, 1024*1024, syncMode, false, false, IOEngineSync, nil)
 
 	for i := 0; i < n; i++ {
 		copy(bs, []byte(fmt.Sprintf("hello %05d", i)))
@@ -54,7 +60,7 @@ func TestLogOperation(t *testing.T) {
 
 func TestLogLargeSize(t *testing.T) {
 	os.RemoveAll(logTestDataPath)
-	l, _ := newLog(logTestDataPath, 1024*10, syncMode, false)
+	l, _ := newLog(logTestDataPath, 1024*10, syncMode, false, false, IOEngineSync, nil)
 	bs := make([]byte, 1024*1024)
 	for i, _ := range bs {
 		bs[i] = 1
@@ -73,7 +79,7 @@ func TestLogLargeSize(t *testing.T) {
 
 func TestLogTrim(t *testing.T) {
 	os.RemoveAll(logTestDataPath)
-	l, _ := newLog(logTestDataPath, 1024*1024, syncMode, false)
+	l, _ := newLog(logTestDataPath, 1024*1024, syncMode, false, false, IOEngineSync, nil)
 	bs := make([]byte, 973)
 	bs2 := make([]byte, 973)
 	n := 1024 * 20
@@ -87,7 +93,7 @@ func TestLogTrim(t *testing.T) {
 	l.Commit()
 	l.Close()
 
-	l, _ = newLog(logTestDataPath, 1024*1024, syncMode, false)
+	l, _ = newLog(logTestDataPath, 1024*1024, syncMode, false, false, IOEngineSync, nil)
 	l.Commit()
 
 	for i := 1024 * 10; i < n; i++ {
@@ -104,7 +110,7 @@ func TestLogTrim(t *testing.T) {
 
 func TestLogSuperblockCorruption(t *testing.T) {
 	os.RemoveAll(logTestDataPath)
-	l, _ := newLog(logTestDataPath, 1024*1024, syncMode, false)
+	l, _ := newLog(logTestDataPath, 1024*1024, syncMode, false, false, IOEngineSync, nil)
 	bs := make([]byte, 973)
 	n := 1024 * 20
 	for i := 0; i < n/2; i++ {
@@ -134,7 +140,7 @@ func TestLogSuperblockCorruption(t *testing.T) {
 		w.Close()
 	}
 
-	l, err := newLog(logTestDataPath, 1024*1024, syncMode, false)
+	l, err := newLog(logTestDataPath, 1024*1024, syncMode, false, false, IOEngineSync, nil)
 	if err != nil {
 		panic(err)
 	}
@@ -147,3 +153,407 @@ func TestLogSuperblockCorruption(t *testing.T) {
 		t.Errorf("Expected tail %d, got %d", to, l.Tail())
 	}
 }
+
+func TestLogSuperblockRepair(t *testing.T) {
+	os.RemoveAll(logTestDataPath)
+	l, err := newLog(logTestDataPath, 1024*1024, syncMode, false, false, IOEngineSync, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	// A torn write of the first superblock
+	header := filepath.Join(logTestDataPath, headerFileName)
+	w, err := os.OpenFile(header, os.O_WRONLY, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteAt([]byte("corrupt"), logSBSize)
+	w.Close()
+
+	l, err = newLog(logTestDataPath, 1024*1024, syncMode, false, false, IOEngineSync, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bs := make([]byte, 1024)
+	for i := 0; i < 100; i++ {
+		l.Append(bs)
+	}
+	l.Commit()
+	l.Close()
+
+	w, _ = os.OpenFile(header, os.O_WRONLY, 0755)
+	w.WriteAt([]byte("corrupt"), 0)
+	w.Close()
+
+	l, err = newLog(logTestDataPath, 1024*1024, syncMode, false, false, IOEngineSync, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if l.Tail() != 100*1024 {
+		t.Errorf("expected tail %d, got %d", 100*1024, l.Tail())
+	}
+
+	fd, _ := os.Open(header)
+	defer fd.Close()
+	var buf [logSBSize]byte
+	if _, invalid, err := readLogSB(fd, buf[:]); err != nil || len(invalid) != 0 {
+		t.Errorf("expected the superblock copies to be repaired, invalid %v (err=%v)", invalid, err)
+	}
+}
+
+func TestLogVersion(t *testing.T) {
+	os.RemoveAll(logTestDataPath)
+	l, err := newLog(logTestDataPath, 1024*1024, syncMode, false, false, IOEngineSync, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Append(make([]byte, 1024))
+	l.Commit()
+	l.Close()
+
+	// Logs written before the version was recorded are opened and keep
+	// their version until the blocks written before are trimmed, while
+	// logs of a newer version are rejected
+	header := filepath.Join(logTestDataPath, headerFileName)
+	for _, version := range []uint32{0, logVersion + 1} {
+		w, _ := os.OpenFile(header, os.O_RDWR, 0755)
+		var buf [logSBSize]byte
+		for i := 0; i < logSBCopies; i++ {
+			w.ReadAt(buf[:], int64(logSBSize*i))
+			binary.BigEndian.PutUint32(buf[4:8], version)
+			binary.BigEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(buf[4:]))
+			w.WriteAt(buf[:], int64(logSBSize*i))
+		}
+		w.Close()
+
+		l, err := newLog(logTestDataPath, 1024*1024, syncMode, false, false, IOEngineSync, nil)
+		if version > logVersion {
+			if !errors.Is(err, ErrLogVersion) {
+				t.Errorf("expected ErrLogVersion for version %d, got %v", version, err)
+			}
+			continue
+		} else if err != nil {
+			t.Fatalf("version %d: %v", version, err)
+		}
+
+		ml := l.(*multiFilelog)
+		tail := l.Tail()
+		l.Append(make([]byte, 1024))
+		l.Commit()
+		if v := ml.Version(); v != version {
+			t.Errorf("expected version %d before trimming, got %d", version, v)
+		}
+
+		l.Trim(tail)
+		l.Commit()
+		if v := ml.Version(); v != logVersion {
+			t.Errorf("expected version %d after trimming, got %d", logVersion, v)
+		}
+		l.Close()
+	}
+}
+
+func TestLogReaderWriterLock(t *testing.T) {
+	os.RemoveAll(logTestDataPath)
+	l, err := newLog(logTestDataPath, 1024*1024, syncMode, false, false, IOEngineSync, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Append(make([]byte, 1024))
+	l.Commit()
+
+	if _, err := newReadOnlyLog(logTestDataPath, 1024*1024, false, IOEngineSync, nil); err != ErrInUse {
+		t.Errorf("expected reader to be excluded by the writer, got %v", err)
+	}
+	l.Close()
+
+	r, err := newReadOnlyLog(logTestDataPath, 1024*1024, false, IOEngineSync, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Readers share the log
+	r2, err := newReadOnlyLog(logTestDataPath, 1024*1024, false, IOEngineSync, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newLog(logTestDataPath, 1024*1024, syncMode, false, false, IOEngineSync, nil); err != ErrInUse {
+		t.Errorf("expected writer to be excluded by the readers, got %v", err)
+	}
+	r.Close()
+	r2.Close()
+
+	l, err = newLog(logTestDataPath, 1024*1024, syncMode, false, false, IOEngineSync, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+}
+
+func TestLogIOUring(t *testing.T) {
+	os.RemoveAll(logTestDataPath)
+	l, err := newLog(logTestDataPath, 1024*1024, false, false, false, IOEngineIOUring, nil)
+	if errors.Is(err, syscall.ENOSYS) || errors.Is(err, syscall.EPERM) {
+		t.Skip("io_uring is not available")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	// Appends span segments and are split into several writes
+	bs := make([]byte, 700*1024)
+	n := 20
+	for i := 0; i < n; i++ {
+		for j := range bs {
+			bs[j] = byte(i + j)
+		}
+
+		if err := l.Append(bs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Commit()
+	l.Close()
+
+	l, err = newLog(logTestDataPath, 1024*1024, false, false, false, IOEngineIOUring, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			buf := make([]byte, 4096)
+			for k := 0; k < 1000; k++ {
+				i, j := (g+k)%n, (k*7919)%(len(bs)-len(buf))
+				if err := l.Read(buf, int64(i*len(bs)+j)); err != nil {
+					t.Errorf("read %d/%d: %v", i, j, err)
+					return
+				}
+
+				for x := range buf {
+					if buf[x] != byte(i+j+x) {
+						t.Errorf("read %d/%d: unexpected data at %d", i, j, x)
+						return
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestIORingFailure(t *testing.T) {
+	r, err := newIORing(ioRingEntries)
+	if errors.Is(err, syscall.ENOSYS) || errors.Is(err, syscall.EPERM) {
+		t.Skip("io_uring is not available")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	defer r.unmap()
+
+	os.RemoveAll(logTestDataPath)
+	os.MkdirAll(logTestDataPath, 0755)
+	f, err := os.Create(filepath.Join(logTestDataPath, "ring.data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// Requests can no longer be submitted
+	syscall.Close(r.fd)
+
+	bs := make([]byte, 3*ioRingWriteSize)
+	for i := range bs {
+		bs[i] = byte(i)
+	}
+
+	if err := r.WriteAt(f, bs, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, len(bs))
+	if err := r.ReadAt(f, buf, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(buf, bs) {
+		t.Errorf("unexpected data read after the ring failed")
+	}
+
+	if r.err == nil || r.pending != 0 {
+		t.Errorf("expected the ring to have failed without pending requests, got %v and %d",
+			r.err, r.pending)
+	}
+}
+
+func TestLogPreallocSegments(t *testing.T) {
+	os.RemoveAll(logTestDataPath)
+	segSize := int64(1024 * 1024)
+	l, err := newLog(logTestDataPath, segSize, false, false, false, IOEngineSync, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ml := l.(*multiFilelog)
+	ml.startPrealloc()
+
+	waitSpares := func() []os.FileInfo {
+		var spares []os.FileInfo
+		for i := 0; i < 100; i++ {
+			ml.indexLock.Lock()
+			files := append([]string(nil), ml.spares...)
+			ml.indexLock.Unlock()
+			if len(files) == maxSpareSegments {
+				for _, f := range files {
+					fi, err := os.Stat(f)
+					if err != nil {
+						t.Fatal(err)
+					}
+					spares = append(spares, fi)
+				}
+				return spares
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+
+		t.Fatalf("expected %d spare segments", maxSpareSegments)
+		return nil
+	}
+
+	segFile := func(id int64) string {
+		return filepath.Join(logTestDataPath, fmt.Sprintf(segFileNameFormat, id))
+	}
+
+	isSpare := func(file string, spares []os.FileInfo) bool {
+		fi, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, sfi := range spares {
+			if os.SameFile(fi, sfi) {
+				return true
+			}
+		}
+		return false
+	}
+
+	spares := waitSpares()
+	bs := make([]byte, 973)
+	n := 1024 * 3
+	for i := 0; i < n; i++ {
+		copy(bs, []byte(fmt.Sprintf("hello %05d", i)))
+		if err := l.Append(bs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !isSpare(segFile(0), spares) || !isSpare(segFile(1), spares) {
+		t.Errorf("expected the log to grow into the spare segments")
+	}
+
+	// The trimmed segments are kept to replace the spares taken
+	spares = waitSpares()
+	seg0, _ := os.Stat(segFile(0))
+	l.Trim(2 * segSize)
+	l.Commit()
+	if _, err := os.Stat(segFile(0)); !os.IsNotExist(err) {
+		t.Errorf("expected the trimmed segment to be renamed, got %v", err)
+	}
+
+	recycled := false
+	files, _ := filepath.Glob(filepath.Join(logTestDataPath, segSparePattern))
+	for _, f := range files {
+		recycled = recycled || isSpare(f, []os.FileInfo{seg0})
+	}
+
+	if len(files) != 2*maxSpareSegments || !recycled {
+		t.Errorf("expected the trimmed segments to be recycled, got %v", files)
+	}
+
+	for i := n; i < 2*n; i++ {
+		copy(bs, []byte(fmt.Sprintf("hello %05d", i)))
+		if err := l.Append(bs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !isSpare(segFile(3), spares) || !isSpare(segFile(4), spares) {
+		t.Errorf("expected the log to grow into the spare segments")
+	}
+
+	waitSpares()
+	l.Commit()
+	l.Close()
+
+	// The spares left over are reused after the log is reopened
+	l, err = newLog(logTestDataPath, segSize, false, false, false, IOEngineSync, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ml = l.(*multiFilelog)
+	ml.startPrealloc()
+	waitSpares()
+	if files, _ := filepath.Glob(filepath.Join(logTestDataPath, segSparePattern)); len(files) > 2*maxSpareSegments {
+		t.Errorf("expected at most %d spare files, got %v", 2*maxSpareSegments, files)
+	}
+
+	bs2 := make([]byte, 973)
+	for i := int(2*segSize)/973 + 1; i < 2*n; i++ {
+		copy(bs, []byte(fmt.Sprintf("hello %05d", i)))
+		if err := l.Read(bs2, int64(i*973)); err != nil || !bytes.Equal(bs, bs2) {
+			t.Fatalf("got invalid item for %d (err=%v)", i, err)
+		}
+	}
+}
+
+func TestLogTrimPunchHole(t *testing.T) {
+	os.RemoveAll(logTestDataPath)
+	l, err := newLog(logTestDataPath, 64*1024*1024, false, false, false, IOEngineSync, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	bs := make([]byte, 1024*1024)
+	n := 32
+	for i := 0; i < n; i++ {
+		bs[0] = byte(i)
+		if err := l.Append(bs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Commit()
+
+	// The head segment still holds live data after the trim
+	disk := diskUsage(t, logTestDataPath)
+	l.Trim(int64(len(bs)) * 20)
+	l.Commit()
+
+	if !l.(*multiFilelog).HolePunchSupported() {
+		t.Skip("file system does not support punching holes")
+	}
+
+	freed := disk - diskUsage(t, logTestDataPath)
+	if expected := (int64(len(bs)) * 20 / trimPunchSize) * trimPunchSize; freed < expected {
+		t.Errorf("expected %d bytes to be freed, got %d", expected, freed)
+	}
+
+	bs2 := make([]byte, len(bs))
+	for i := 20; i < n; i++ {
+		bs[0] = byte(i)
+		if err := l.Read(bs2, int64(i*len(bs))); err != nil || !bytes.Equal(bs, bs2) {
+			t.Errorf("got invalid data at %d (err=%v)", i, err)
+		}
+	}
+}
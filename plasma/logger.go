@@ -0,0 +1,69 @@
+package plasma
+
+import (
+	"log"
+	"os"
+)
+
+// Logger receives the log messages of an instance so that they can be
+// routed into the logging system of the host service
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// NewStderrLogger returns the default logger writing to stderr
+func NewStderrLogger() Logger {
+	return &stdLogger{log.New(os.Stderr, "", log.LstdFlags)}
+}
+
+type stdLogger struct {
+	l *log.Logger
+}
+
+func (l *stdLogger) Debugf(format string, args ...interface{}) {
+	l.l.Printf("Plasma: [DEBUG] "+format, args...)
+}
+
+func (l *stdLogger) Infof(format string, args ...interface{}) {
+	l.l.Printf("Plasma: [INFO] "+format, args...)
+}
+
+func (l *stdLogger) Errorf(format string, args ...interface{}) {
+	l.l.Printf("Plasma: [ERROR] "+format, args...)
+}
+
+// taggedLogger prefixes messages with the instance path and component
+type taggedLogger struct {
+	l   Logger
+	tag string
+}
+
+func newTaggedLogger(l Logger, path, component string) Logger {
+	if l == nil {
+		l = NewStderrLogger()
+	}
+
+	return &taggedLogger{l: l, tag: "(" + path + ") " + component + ": "}
+}
+
+func (l *taggedLogger) args(args []interface{}) []interface{} {
+	return append([]interface{}{l.tag}, args...)
+}
+
+func (l *taggedLogger) Debugf(format string, args ...interface{}) {
+	l.l.Debugf("%s"+format, l.args(args)...)
+}
+
+func (l *taggedLogger) Infof(format string, args ...interface{}) {
+	l.l.Infof("%s"+format, l.args(args)...)
+}
+
+func (l *taggedLogger) Errorf(format string, args ...interface{}) {
+	l.l.Errorf("%s"+format, l.args(args)...)
+}
+
+func (s *Plasma) logger(component string) Logger {
+	return newTaggedLogger(s.Logger, s.File, component)
+}
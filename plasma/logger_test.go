@@ -0,0 +1,103 @@
+package plasma
+
+import (
+	"fmt"
+	"github.com/couchbase/nitro/skiplist"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testLogger struct {
+	sync.Mutex
+	msgs []string
+}
+
+func (l *testLogger) logf(level, format string, args ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	l.msgs = append(l.msgs, level+" "+fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) Debugf(format string, args ...interface{}) {
+	l.logf("debug", format, args...)
+}
+
+func (l *testLogger) Infof(format string, args ...interface{}) {
+	l.logf("info", format, args...)
+}
+
+func (l *testLogger) Errorf(format string, args ...interface{}) {
+	l.logf("error", format, args...)
+}
+
+func TestPlasmaLogger(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	logger := new(testLogger)
+	cfg := testCfg
+	cfg.Logger = logger
+	s := newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	if err := s.CleanLSS(func() bool { return true }); err != nil {
+		t.Fatal(err)
+	}
+	s.logError("100%")
+
+	logger.Lock()
+	defer logger.Unlock()
+	expected := []string{
+		"info (teststore.data) logCleaner: starting...",
+		"info (teststore.data) logCleaner: completed...",
+		"error (teststore.data) plasma: fatal error - 100%",
+	}
+
+	if len(logger.msgs) != len(expected) {
+		t.Fatalf("expected %d messages, got %v", len(expected), logger.msgs)
+	}
+
+	for i, msg := range logger.msgs {
+		if !strings.HasPrefix(msg, expected[i]) {
+			t.Errorf("expected %q, got %q", expected[i], msg)
+		}
+	}
+}
+
+func TestPlasmaSlowOpLogging(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	logger := new(testLogger)
+	cfg := testCfg
+	cfg.Logger = logger
+	cfg.SlowOpThreshold = time.Nanosecond
+	s := newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	w := s.NewWriter()
+	w.Insert(skiplist.NewIntKeyItem(1))
+	w.Delete(skiplist.NewIntKeyItem(1))
+	w.Insert(skiplist.NewIntKeyItem(2))
+	s.PersistAll()
+	s.EvictAll(0)
+	w.Lookup(skiplist.NewIntKeyItem(2))
+
+	logger.Lock()
+	defer logger.Unlock()
+	for _, op := range []string{"insert", "delete", "lookup", "lss read"} {
+		found := false
+		for _, msg := range logger.msgs {
+			if strings.Contains(msg, "slowop: "+op+" took") {
+				found = true
+			}
+		}
+
+		if !found {
+			t.Errorf("expected slow %s to be logged", op)
+		}
+	}
+
+	if !strings.Contains(logger.msgs[0], "chain_len: 1, lss_reads: 0") {
+		t.Errorf("unexpected message %q", logger.msgs[0])
+	}
+}
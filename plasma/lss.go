@@ -1,10 +1,15 @@
 package plasma
 
 import (
+	"crypto/cipher"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
 	"runtime"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -17,26 +22,95 @@ const superBlockSize = 4096
 const lssReclaimBlockSize = 1024 * 1024 * 8
 const expiredLSSOffset = LSSOffset(^uint64(0))
 
-var ErrCorruptSuperBlock = errors.New("Superblock is corrupted")
+var ErrCorruptSuperBlock = fmt.Errorf("Superblock is corrupted: %w", ErrChecksum)
+
+// Returned with the length of a range dropped by DropRange when its header
+// is read
+var errDroppedRange = fmt.Errorf("lss range has been dropped: %w", ErrLogTrimmed)
+
+// Marker of the header of a dropped range
+const droppedRangeMarker = ^uint64(0)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// SyncMode selects when writes to the LSS are made durable
+type SyncMode uint8
+
+const (
+	// The log is committed at most every SyncInterval seconds and whenever
+	// a commit is requested, e.g. by a checkpoint. Every flush is committed
+	// if SyncInterval is zero.
+	SyncModeInterval SyncMode = iota
+	// Every flush is written synchronously and committed
+	SyncModeAlways
+	// The log is only committed when requested
+	SyncModeOnCommitOnly
+	// The log is committed like SyncModeInterval, but it is not synced
+	// to disk unless Plasma.Sync is called or the instance is closed
+	SyncModeNever
+)
 
 type LSSOffset uint64
 type LSSResource interface{}
 type LSSBlockCallback func(LSSOffset, []byte) (bool, error)
 type LSSCleanerCallback func(start, end LSSOffset, bs []byte) (cont bool, cleanOff LSSOffset, err error)
 type LSSSafeTrimCallback func() LSSOffset
+type LSSCommitCallback func()
+
+// LSSRange is the range of offsets [Start, End) of the LSS
+type LSSRange struct {
+	Start, End LSSOffset
+}
+
+// SegmentRetireCallback is called with the raw bytes of a range of the
+// LSS before the cleaner discards it, e.g. to archive them. The range is
+// kept if it returns an error.
+type SegmentRetireCallback func(r LSSRange, data io.Reader) error
 
 type LSS interface {
 	ReserveSpace(size int) (LSSOffset, []byte, LSSResource)
 	ReserveSpaceMulti(sizes []int) ([]LSSOffset, [][]byte, LSSResource)
 	FinalizeWrite(LSSResource)
+	// FinalizeWriteAsync is FinalizeWrite which returns a handle resolved
+	// once the reserved blocks are durable, without blocking like Sync
+	FinalizeWriteAsync(LSSResource) *LSSWrite
 	TrimLog(LSSOffset)
 	Read(LSSOffset, []byte) (int, error)
+	// ReadMulti reads the blocks at the offsets into the buffers like Read,
+	// with the reads in flight together, and returns their lengths and
+	// errors
+	ReadMulti([]LSSOffset, [][]byte) ([]int, []error)
 	Sync(bool)
+	// Commit flushes the buffered writes and makes them durable
+	// irrespective of the sync mode
+	Commit()
 	Visitor(callb LSSBlockCallback, buf []byte) error
+	VisitorFrom(start LSSOffset, callb LSSBlockCallback, buf []byte) error
+	VisitorRange(start, end LSSOffset, callb LSSBlockCallback, buf []byte) error
 	RunCleaner(callb LSSCleanerCallback, buf []byte) error
 	BytesWritten() int64
+	StallStats() LSSStallStats
+	BlockEndOffset(LSSOffset, []byte) LSSOffset
+	TruncatedBytes() int64
+
+	// RegionRange returns the blocks of the flush buffers which start in
+	// the region of the log with the given id, if they are known and have
+	// not been dropped
+	RegionRange(id int64) (start, end LSSOffset, ok bool)
+	// DropRange frees the space of a range returned by RegionRange, whose
+	// blocks must all be stale. It reports whether the range was dropped.
+	DropRange(start, end LSSOffset) (bool, error)
+	// TierSegments moves the cold segments of the log to the tier and
+	// returns the number of segments moved. The local files of the moved
+	// segments are closed by the function passed to retire, once they are
+	// no longer read.
+	TierSegments(retire func(func())) (int, error)
+	// Clone creates a copy of the log at path which shares the segments
+	// written so far
+	Clone(path string) error
 
 	SetSafeTrimCallback(LSSSafeTrimCallback)
+	SetPreCommitCallback(LSSCommitCallback)
 	HeadOffset() LSSOffset
 	TailOffset() LSSOffset
 	UsedSpace() int64
@@ -52,7 +126,10 @@ type lsStore struct {
 
 	head, tail unsafe.Pointer
 	bufSize    int
+	hdrSize    int
 	nbufs      int
+	// Flush buffers are padded to end at a multiple of align for direct IO
+	align int
 
 	sbBuffer [superBlockSize]byte
 
@@ -60,21 +137,97 @@ type lsStore struct {
 
 	path        string
 	segmentSize int64
+	logger      Logger
+	onInvariant func(error)
+
+	ioErrorRetries int
+	onIOError      func(err error, failed bool)
+	// Set once a write has failed for good or the flush buffers violated
+	// an invariant, after which the flush buffers are dropped and the log
+	// is no longer committed
+	writeFailed int32
 
 	lastCommitTS   time.Time
 	commitDuration time.Duration
+	syncMode       SyncMode
 	trimOffset     LSSOffset
 	log            Log
 
-	bytesWritten int64
+	// Seqno following the last flush buffer written and committed
+	flushedSeqno uint64
+
+	bytesWritten   int64
+	truncatedBytes int64
 
 	safeOffset LSSSafeTrimCallback
+	preCommit  LSSCommitCallback
+
+	// The log before retiredOffset has been passed to onRetire
+	onRetire      SegmentRetireCallback
+	retiredOffset int64
+
+	stalls LSSStallStats
+
+	aead   cipher.AEAD
+	encBuf []byte
+
+	// Offsets of the first flush buffer written to each region of the log
+	// since it was opened and the ranges between the head and the tail
+	// which have been dropped, in log order
+	regionLock   sync.Mutex
+	regionStarts map[int64]int64
+	dropped      []lssRange
+
+	// Slots of the readers helping ReadMulti
+	readers chan struct{}
+
+	// Blocks before legacyEnd may have been written before the blocks
+	// were checksummed, in which case they are not flagged as such
+	legacyEnd int64
+}
+
+type lssRange struct {
+	start, end int64
+}
+
+// LSSStallStats tracks the time spent spinning for flush buffers
+type LSSStallStats struct {
+	ReserveStalls    int64 `json:"reserve_stalls" metric:"counter"`
+	ReserveStallTime int64 `json:"reserve_stall_ns" metric:"counter"`
+	TrimStalls       int64 `json:"trim_stalls" metric:"counter"`
+	TrimStallTime    int64 `json:"trim_stall_ns" metric:"counter"`
+	SyncStalls       int64 `json:"sync_stalls" metric:"counter"`
+	SyncStallTime    int64 `json:"sync_stall_ns" metric:"counter"`
+}
+
+func (s *lsStore) StallStats() LSSStallStats {
+	return LSSStallStats{
+		ReserveStalls:    atomic.LoadInt64(&s.stalls.ReserveStalls),
+		ReserveStallTime: atomic.LoadInt64(&s.stalls.ReserveStallTime),
+		TrimStalls:       atomic.LoadInt64(&s.stalls.TrimStalls),
+		TrimStallTime:    atomic.LoadInt64(&s.stalls.TrimStallTime),
+		SyncStalls:       atomic.LoadInt64(&s.stalls.SyncStalls),
+		SyncStallTime:    atomic.LoadInt64(&s.stalls.SyncStallTime),
+	}
+}
+
+func recordStall(count, dur *int64, start time.Time) {
+	if !start.IsZero() {
+		atomic.AddInt64(count, 1)
+		atomic.AddInt64(dur, int64(time.Since(start)))
+	}
 }
 
 func (s *lsStore) SetSafeTrimCallback(callb LSSSafeTrimCallback) {
 	s.safeOffset = callb
 }
 
+// SetPreCommitCallback sets a callback which is invoked before the log
+// is committed to disk
+func (s *lsStore) SetPreCommitCallback(callb LSSCommitCallback) {
+	s.preCommit = callb
+}
+
 func (s *lsStore) HeadOffset() LSSOffset {
 	return LSSOffset(atomic.LoadInt64(&s.cleanerTrimOffset))
 }
@@ -88,28 +241,122 @@ func (s *lsStore) BytesWritten() int64 {
 }
 
 func NewLSStore(path string, segSize int64, bufSize int, nbufs int, mmap bool, commitDur time.Duration) (LSS, error) {
+	return newLSStore(path, segSize, bufSize, nbufs, mmap, commitDur, lssOptions{})
+}
+
+// lssOptions are the options of an lsStore which are taken from Config
+type lssOptions struct {
+	syncMode SyncMode
+	directIO bool
+	ioEngine IOEngine
+	prealloc bool
+	key      []byte
+	logger   Logger
+	readOnly bool
+	factory  LogFactory
+	tier     *logTier
+	onRetire SegmentRetireCallback
+
+	// Called on the violation of an internal invariant instead of
+	// panicking
+	onInvariant func(error)
+
+	// Called with the error of every failed write of a flush buffer. The
+	// log is given up on once the write has been retried ioErrorRetries
+	// times, which is reported by the last call.
+	ioErrorRetries int
+	onIOError      func(err error, failed bool)
+}
+
+func newLSStore(path string, segSize int64, bufSize int, nbufs int, mmap bool,
+	commitDur time.Duration, opts lssOptions) (LSS, error) {
 	var err error
 
+	logger, key, syncMode := opts.logger, opts.key, opts.syncMode
+	if logger == nil {
+		logger = newTaggedLogger(nil, path, "lss")
+	}
+
 	s := &lsStore{
 		path:           path,
+		logger:         logger,
 		segmentSize:    segSize,
 		nbufs:          nbufs,
 		bufSize:        bufSize,
+		hdrSize:        blockHeaderSize(key != nil),
 		trimBatchSize:  int64(bufSize),
 		commitDuration: commitDur,
+		syncMode:       syncMode,
 		safeOffset:     func() LSSOffset { return expiredLSSOffset },
+		onRetire:       opts.onRetire,
+		onInvariant:    opts.onInvariant,
+		ioErrorRetries: opts.ioErrorRetries,
+		onIOError:      opts.onIOError,
+		regionStarts:   make(map[int64]int64),
+		readers:        make(chan struct{}, maxReadMultiReaders),
+	}
+
+	if opts.directIO {
+		s.align = directIOAlign
+	}
+
+	if key != nil {
+		if s.aead, err = newBlockCipher(key); err != nil {
+			return nil, err
+		}
+		s.encBuf = alignedBuffer(flushBufferCap(bufSize, s.align)+s.aead.Overhead(), s.align)
+	}
+
+	sync := syncMode == SyncModeAlways || (syncMode == SyncModeInterval && commitDur == 0)
+	if opts.factory != nil {
+		s.log, err = opts.factory(path, LogOptions{
+			SegmentSize: segSize,
+			ReadOnly:    opts.readOnly,
+			Sync:        sync,
+		})
+	} else if opts.readOnly {
+		s.log, err = newReadOnlyLog(path, segSize, mmap, opts.ioEngine, opts.tier)
+	} else {
+		s.log, err = newLog(path, segSize, sync, mmap, opts.directIO, opts.ioEngine, opts.tier)
+		if err == nil && opts.prealloc {
+			s.log.(*multiFilelog).startPrealloc()
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.checkKey(key); err != nil {
+		s.log.Close()
+		return nil, err
+	}
+
+	if v, ok := s.log.(interface {
+		Version() uint32
+	}); ok && v.Version() == 0 {
+		s.legacyEnd = s.log.Tail()
 	}
 
-	if s.log, err = newLog(path, segSize, commitDur == 0, mmap); err != nil {
+	if err = s.truncateTornTail(); err != nil {
+		s.log.Close()
 		return nil, err
 	}
 
-	head := newFlushBuffer(bufSize, s.flush)
+	// Start a new epoch
+	if !opts.readOnly {
+		if err = s.log.Commit(); err != nil {
+			s.log.Close()
+			return nil, err
+		}
+	}
+
+	head := newFlushBuffer(bufSize, s.hdrSize, s.align, s.flush)
 
 	// Prepare circular linked buffers
 	curr := head
 	for i := 0; i < nbufs-1; i++ {
-		nextFb := newFlushBuffer(bufSize, s.flush)
+		nextFb := newFlushBuffer(bufSize, s.hdrSize, s.align, s.flush)
 		curr.SetNext(nextFb)
 		curr = nextFb
 		curr.Reset()
@@ -119,6 +366,7 @@ func NewLSStore(path string, segSize int64, bufSize int, nbufs int, mmap bool, c
 
 	head.baseOffset = s.log.Tail()
 	s.startOffset = s.log.Head()
+	s.retiredOffset = s.startOffset
 
 	s.head = unsafe.Pointer(head)
 	s.tail = s.head
@@ -130,37 +378,110 @@ func (s *lsStore) Close() {
 	s.log.Close()
 }
 
+// UsedSpace returns the size of the log between the head and the tail,
+// excluding the dropped ranges
 func (s *lsStore) UsedSpace() int64 {
-	return s.log.Size()
+	head := s.log.Head()
+	used := s.log.Size()
+
+	s.regionLock.Lock()
+	defer s.regionLock.Unlock()
+
+	for len(s.dropped) > 0 && s.dropped[0].end <= head {
+		s.dropped = s.dropped[1:]
+	}
+
+	for _, r := range s.dropped {
+		used -= r.end - maxInt64(r.start, head)
+	}
+
+	return used
 }
 
 func (s *lsStore) flush(fb *flushBuffer) {
-	for {
-		err := s.log.Append(fb.Bytes())
+	bs := s.seal(fb)
+	for retries := 0; atomic.LoadInt32(&s.writeFailed) == 0; retries++ {
+		err := s.log.Append(bs)
 		if err == nil {
-			s.bytesWritten += int64(len(fb.Bytes()))
+			s.bytesWritten += int64(len(bs))
 			break
 		}
 
-		fmt.Printf("Plasma: (%s) Unable to write - err %v\n", s.path, err)
-		time.Sleep(time.Second)
+		s.logger.Errorf("Unable to write - err %v", err)
+		failed := s.ioErrorRetries > 0 && retries >= s.ioErrorRetries
+		if failed {
+			atomic.StoreInt32(&s.writeFailed, 1)
+		}
+
+		if s.onIOError != nil {
+			s.onIOError(err, failed)
+		}
+
+		if !failed {
+			time.Sleep(time.Second)
+		}
 	}
 
+	s.regionLock.Lock()
+	id := fb.StartOffset() / lssRegionSize
+	if _, ok := s.regionStarts[id]; !ok {
+		s.regionStarts[id] = fb.StartOffset()
+	}
+	s.regionLock.Unlock()
+
 	if trimOffset, doTrim := fb.GetTrimLogOffset(); doTrim {
 		s.trimOffset = trimOffset
 	}
 
-	doCommit := fb.doCommit || time.Since(s.lastCommitTS) > s.commitDuration
+	// Asynchronous writes are resolved once they are durable
+	completions := fb.takeCompletions()
+	doCommit, sync := s.commitPolicy(fb)
+	if len(completions) > 0 {
+		doCommit, sync = true, true
+	}
+
+	var err error
+	if atomic.LoadInt32(&s.writeFailed) != 0 {
+		err = ErrLogWrite
+	} else if doCommit {
+		if s.preCommit != nil {
+			s.preCommit()
+		}
 
-	if doCommit {
 		off := minInt64(int64(s.safeOffset()), int64(s.trimOffset))
 		s.log.Trim(off)
-		s.log.Commit()
+		if sync {
+			err = s.log.Commit()
+		} else {
+			err = s.log.CommitNoSync()
+		}
 		s.lastCommitTS = time.Now()
 	}
 
 	nextFb := fb.NextBuffer()
+	atomic.StoreUint64(&s.flushedSeqno, fb.seqno+1)
 	atomic.StorePointer(&s.head, unsafe.Pointer(nextFb))
+
+	for _, w := range completions {
+		w.resolve(err)
+	}
+}
+
+// commitPolicy returns whether the log is committed once the flush buffer
+// has been written and whether the commit is synced to disk
+func (s *lsStore) commitPolicy(fb *flushBuffer) (commit, sync bool) {
+	onInterval := fb.doCommit || time.Since(s.lastCommitTS) > s.commitDuration
+
+	switch s.syncMode {
+	case SyncModeAlways:
+		return true, true
+	case SyncModeOnCommitOnly:
+		return fb.doCommit, true
+	case SyncModeNever:
+		return onInterval || fb.forceCommit, fb.forceCommit
+	}
+
+	return onInterval, true
 }
 
 func (s *lsStore) initNextBuffer(currFb *flushBuffer) {
@@ -178,17 +499,32 @@ func (s *lsStore) initNextBuffer(currFb *flushBuffer) {
 	atomic.StoreUint64(&nextFb.state, encodeState(false, 2, 0))
 
 	if !atomic.CompareAndSwapPointer(&s.tail, unsafe.Pointer(currFb), unsafe.Pointer(nextFb)) {
-		panic(fmt.Sprintf("fatal: tailSeqno:%d, currSeqno:%d", s.currBuf().seqno, currFb.seqno))
+		err := fmt.Errorf("flush buffer %d replaced by %d", currFb.seqno, s.currBuf().seqno)
+		if s.onInvariant == nil {
+			panic(fmt.Sprintf("fatal: %v", err))
+		}
+
+		// The flush buffers can no longer be trusted, hence they are
+		// dropped instead of being written to the log
+		atomic.StoreInt32(&s.writeFailed, 1)
+		s.onInvariant(err)
+		return
 	}
 }
 
 func (s *lsStore) TrimLog(off LSSOffset) {
+	var stallStart time.Time
 retry:
 	fb := s.currBuf()
 	if !fb.SetTrimLogOffset(off) {
+		if stallStart.IsZero() {
+			stallStart = time.Now()
+		}
 		runtime.Gosched()
 		goto retry
 	}
+
+	recordStall(&s.stalls.TrimStalls, &s.stalls.TrimStallTime, stallStart)
 }
 
 func (s *lsStore) ReserveSpace(size int) (LSSOffset, []byte, LSSResource) {
@@ -201,10 +537,15 @@ func (s *lsStore) currBuf() *flushBuffer {
 }
 
 func (s *lsStore) ReserveSpaceMulti(sizes []int) ([]LSSOffset, [][]byte, LSSResource) {
+	var stallStart time.Time
 retry:
 	fb := s.currBuf()
 	success, markedFull, offsets, bufs := fb.Alloc(sizes)
 	if !success {
+		if stallStart.IsZero() {
+			stallStart = time.Now()
+		}
+
 		if markedFull {
 			s.initNextBuffer(fb)
 			fb.Done()
@@ -215,10 +556,18 @@ retry:
 		goto retry
 	}
 
+	recordStall(&s.stalls.ReserveStalls, &s.stalls.ReserveStallTime, stallStart)
 	return offsets, bufs, LSSResource(fb)
 }
 
 func (s *lsStore) Read(lssOf LSSOffset, buf []byte) (int, error) {
+	l, _, err := s.read(lssOf, buf)
+	return l, err
+}
+
+// read reads the block at lssOf like Read and also returns the size of its
+// header
+func (s *lsStore) read(lssOf LSSOffset, buf []byte) (int, int, error) {
 	offset := int64(lssOf)
 retry:
 	tailOff := s.log.Tail()
@@ -228,21 +577,217 @@ retry:
 		fb := (*flushBuffer)(s.head)
 		for i := 0; i < s.nbufs; i++ {
 			if n, err := fb.Read(offset, buf); err == nil {
-				return n, nil
+				return n, s.hdrSize, nil
 			}
 			fb = fb.NextBuffer()
 		}
+
+		if atomic.LoadInt32(&s.writeFailed) == 1 {
+			return 0, 0, newLSSError("read", lssOf, ErrLogWrite)
+		}
 		runtime.Gosched()
 		goto retry
 	}
 
-	if err := s.log.Read(buf[:headerFBSize], offset); err != nil {
+	var hdrBuf [maxHeaderFBSize]byte
+	// The length of a dropped range is returned along with errDroppedRange
+	hdr, l, err := s.readBlock(lssOf, hdrBuf[:], buf)
+	if err != nil {
+		return l, len(hdr), err
+	}
+
+	if s.aead != nil && len(hdr) == s.hdrSize {
+		if err := s.decryptBlock(hdr, buf[:l]); err != nil {
+			return 0, 0, newLSSError("read", lssOf, err)
+		}
+	}
+
+	return l, len(hdr), nil
+}
+
+// Number of reads helping ReadMulti in flight across all callers
+const maxReadMultiReaders = 16
+
+// ReadMulti reads the first block itself and the others using the free
+// reader slots. Blocks for which no slot is free are read by the caller.
+func (s *lsStore) ReadMulti(offs []LSSOffset, bufs [][]byte) ([]int, []error) {
+	ls := make([]int, len(offs))
+	errs := make([]error, len(offs))
+
+	var wg sync.WaitGroup
+	for i := 1; i < len(offs); i++ {
+		select {
+		case s.readers <- struct{}{}:
+			wg.Add(1)
+			go func(i int) {
+				defer func() {
+					<-s.readers
+					wg.Done()
+				}()
+				ls[i], errs[i] = s.Read(offs[i], bufs[i])
+			}(i)
+		default:
+			ls[i], errs[i] = s.Read(offs[i], bufs[i])
+		}
+	}
+
+	ls[0], errs[0] = s.Read(offs[0], bufs[0])
+	wg.Wait()
+
+	return ls, errs
+}
+
+// readBlock reads the header and the checksummed data of a block as
+// written to the log, without decrypting it. It returns the header, which
+// is read into hdr. The blocks which are not flagged as checksummed are
+// returned as read.
+func (s *lsStore) readBlock(lssOf LSSOffset, hdr, buf []byte) ([]byte, int, error) {
+	offset := int64(lssOf)
+	hdr, err := s.readHeader(offset, hdr)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	l := blockLen(hdr)
+	if len(hdr) == legacyHeaderFBSize {
+		if l > len(buf) {
+			return hdr, 0, newLSSError("read", lssOf, ErrCorruptLog)
+		}
+
+		return hdr, l, s.log.Read(buf[:l], offset+legacyHeaderFBSize)
+	}
+
+	crc := binary.BigEndian.Uint32(hdr[fbLenSize:fbMarkerOffset])
+	if binary.BigEndian.Uint64(hdr[fbMarkerOffset:headerFBSize]) == droppedRangeMarker {
+		if blockChecksum(hdr, nil) != crc {
+			return hdr, 0, newLSSError("read", lssOf, ErrBlockCorrupt)
+		}
+
+		return hdr, l, errDroppedRange
+	}
+
+	if l > len(buf) {
+		return hdr, 0, newLSSError("read", lssOf, ErrCorruptLog)
+	}
+
+	if err := s.log.Read(buf[:l], offset+int64(len(hdr))); err != nil {
+		return hdr, 0, err
+	}
+
+	if blockChecksum(hdr, buf[:l]) != crc {
+		return hdr, 0, newLSSError("read", lssOf, ErrBlockCorrupt)
+	}
+
+	return hdr, l, nil
+}
+
+// headerSize returns the size of the header of the block at offset
+func (s *lsStore) headerSize(offset int64) (int, error) {
+	if offset >= s.legacyEnd {
+		return s.hdrSize, nil
+	}
+
+	var w [fbLenSize]byte
+	if err := s.log.Read(w[:], offset); err != nil {
 		return 0, err
 	}
 
-	l := int(binary.BigEndian.Uint32(buf[:headerFBSize]))
-	err := s.log.Read(buf[:l], offset+headerFBSize)
-	return l, err
+	if binary.BigEndian.Uint32(w[:])&fbChecksummed == 0 {
+		return legacyHeaderFBSize, nil
+	}
+
+	return s.hdrSize, nil
+}
+
+// readHeader reads the header of the block at offset into hdr, which must
+// hold maxHeaderFBSize bytes, and returns it
+func (s *lsStore) readHeader(offset int64, hdr []byte) ([]byte, error) {
+	n, err := s.headerSize(offset)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr = hdr[:n]
+	if err := s.log.Read(hdr, offset); err != nil {
+		return nil, err
+	}
+
+	return hdr, nil
+}
+
+// truncateTornTail checks the blocks appended by the last commit. If the
+// superblock reached the disk before all of them did, e.g. on power loss,
+// the log is truncated to the first block which runs past the end of the
+// log files or was left over from an earlier epoch. Any other block which
+// cannot be read fails the open with ErrBlockCorrupt, since it may hold
+// committed data.
+func (s *lsStore) truncateTornTail() error {
+	start, epoch := s.log.LastCommit()
+	end := s.log.Tail()
+	if epoch == 0 || start >= end {
+		return nil
+	}
+
+	corrupt := func(offset int64, err error) error {
+		return newLSSError("recover", LSSOffset(offset), fmt.Errorf("%w: %v", ErrBlockCorrupt, err))
+	}
+
+	buf := make([]byte, s.bufSize)
+	var hdrBuf [maxHeaderFBSize]byte
+	curr := start
+	var last uint64
+	for curr < end {
+		hdr, err := s.readHeader(curr, hdrBuf[:])
+		if isTornRead(err) {
+			break
+		} else if err != nil {
+			return corrupt(curr, err)
+		}
+
+		// The blocks of a commit are written with the full header
+		if len(hdr) != s.hdrSize {
+			return corrupt(curr, fmt.Errorf("header of %d bytes, expected %d", len(hdr), s.hdrSize))
+		}
+
+		marker := binary.BigEndian.Uint64(hdr[fbMarkerOffset:headerFBSize])
+		if marker != droppedRangeMarker && (marker>>32 != uint64(uint32(epoch)) || marker < last) {
+			break
+		}
+
+		_, n, err := s.readBlock(LSSOffset(curr), hdrBuf[:], buf)
+		if err == errDroppedRange {
+			curr += int64(n + s.hdrSize)
+			continue
+		} else if isTornRead(err) {
+			break
+		} else if errors.Is(err, ErrBlockCorrupt) {
+			return err
+		} else if err != nil {
+			return corrupt(curr, err)
+		}
+
+		last = marker
+		curr += int64(n + s.hdrSize)
+	}
+
+	if curr >= end {
+		return nil
+	}
+
+	s.truncatedBytes = end - curr
+	s.logger.Errorf("Truncating torn log tail of %d bytes at offset %d", s.truncatedBytes, curr)
+	return s.log.Truncate(curr)
+}
+
+// isTornRead reports whether a read ran past the end of the log files
+func isTornRead(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// TruncatedBytes returns the size of the torn tail truncated when the log
+// was opened
+func (s *lsStore) TruncatedBytes() int64 {
+	return s.truncatedBytes
 }
 
 func (s *lsStore) FinalizeWrite(res LSSResource) {
@@ -258,12 +803,17 @@ func (s *lsStore) RunCleaner(callb LSSCleanerCallback, buf []byte) error {
 	startOff := s.startOffset
 
 	fn := func(offset LSSOffset, b []byte) (bool, error) {
-		cont, cleanOff, err := callb(offset, lssBlockEndOffset(offset, b), b)
+		cont, cleanOff, err := callb(offset, s.BlockEndOffset(offset, b), b)
 		if err != nil {
 			return false, err
 		}
 
 		if int64(cleanOff)-s.cleanerTrimOffset >= s.trimBatchSize {
+			if err := s.retire(s.retiredOffset, int64(cleanOff)); err != nil {
+				return false, err
+			}
+
+			s.retiredOffset = int64(cleanOff)
 			s.TrimLog(cleanOff)
 			atomic.StoreInt64(&s.cleanerTrimOffset, int64(cleanOff))
 		}
@@ -279,11 +829,26 @@ func (s *lsStore) Visitor(callb LSSBlockCallback, buf []byte) error {
 	return s.visitor(s.log.Head(), s.log.Tail(), callb, buf)
 }
 
+func (s *lsStore) VisitorFrom(start LSSOffset, callb LSSBlockCallback, buf []byte) error {
+	return s.visitor(int64(start), s.log.Tail(), callb, buf)
+}
+
+func (s *lsStore) VisitorRange(start, end LSSOffset, callb LSSBlockCallback, buf []byte) error {
+	return s.visitor(int64(start), int64(end), callb, buf)
+}
+
+// visitor calls callb for the blocks from start to end. Dropped ranges are
+// skipped.
 func (s *lsStore) visitor(start, end int64, callb LSSBlockCallback, buf []byte) error {
 	curr := start
 	for curr < end {
-		n, err := s.Read(LSSOffset(curr), buf)
-		if err != nil {
+		n, hdrSize, err := s.read(LSSOffset(curr), buf)
+		if err == errDroppedRange {
+			next := curr + int64(n+hdrSize)
+			s.addDroppedRange(curr, next)
+			curr = next
+			continue
+		} else if err != nil {
 			return err
 		}
 
@@ -293,13 +858,244 @@ func (s *lsStore) visitor(start, end int64, callb LSSBlockCallback, buf []byte)
 			return err
 		}
 
-		curr += int64(n + headerFBSize)
+		curr += int64(n + hdrSize)
+	}
+
+	return nil
+}
+
+// salvage visits the blocks between the head and the tail of the log like
+// Visitor, but skips the blocks which cannot be read or are rejected by the
+// callback. If the length of a damaged block cannot be trusted, the log is
+// scanned for the next readable block. skipped is called for every range
+// of the log skipped.
+func (s *lsStore) salvage(callb LSSBlockCallback, skipped func(start, end LSSOffset, err error),
+	buf []byte) error {
+	curr, end := s.log.Head(), s.log.Tail()
+	for curr < end {
+		n, hdrSize, err := s.read(LSSOffset(curr), buf)
+		if err == errDroppedRange {
+			curr += int64(n + hdrSize)
+			continue
+		} else if err != nil {
+			next := s.nextReadableBlock(curr, end, buf)
+			skipped(LSSOffset(curr), LSSOffset(next), err)
+			curr = next
+			continue
+		}
+
+		next := curr + int64(n+hdrSize)
+		if cont, err := callb(LSSOffset(curr), buf[:n]); err != nil {
+			skipped(LSSOffset(curr), LSSOffset(next), err)
+		} else if !cont {
+			break
+		}
+
+		curr = next
+	}
+
+	return nil
+}
+
+// nextReadableBlock returns the offset of the first block after the damaged
+// block at offset whose checksum is valid, or end if there is none. Blocks
+// which are not flagged as checksummed cannot be told apart from damaged
+// data and are skipped.
+func (s *lsStore) nextReadableBlock(offset, end int64, buf []byte) int64 {
+	var hdrBuf [maxHeaderFBSize]byte
+
+	readable := func(off int64) bool {
+		if off+int64(s.hdrSize) > end {
+			return false
+		}
+
+		hdr, err := s.readHeader(off, hdrBuf[:])
+		if err != nil || len(hdr) != s.hdrSize {
+			return false
+		}
+
+		l := int64(blockLen(hdr))
+		if l > int64(len(buf)) || off+int64(s.hdrSize)+l > end {
+			return false
+		}
+
+		_, err = s.Read(LSSOffset(off), buf)
+		return err == nil
+	}
+
+	// The block following a block with a bad checksum is found using its
+	// length, unless the header itself is damaged
+	if hdr, err := s.readHeader(offset, hdrBuf[:]); err == nil {
+		l := int64(blockLen(hdr))
+		if next := offset + int64(len(hdr)) + l; next < end && readable(next) {
+			return next
+		}
+	}
+
+	for off := offset + 1; off < end; off++ {
+		if readable(off) {
+			return off
+		}
+	}
+
+	return end
+}
+
+func (s *lsStore) RegionRange(id int64) (LSSOffset, LSSOffset, bool) {
+	s.regionLock.Lock()
+	defer s.regionLock.Unlock()
+
+	head := s.log.Head() / lssRegionSize
+	for rid := range s.regionStarts {
+		if rid < head {
+			delete(s.regionStarts, rid)
+		}
+	}
+
+	start, ok1 := s.regionStarts[id]
+	end, ok2 := s.regionStarts[id+1]
+	if !ok1 || !ok2 {
+		return 0, 0, false
+	}
+
+	for _, r := range s.dropped {
+		if start < r.end && end > r.start {
+			return 0, 0, false
+		}
+	}
+
+	return LSSOffset(start), LSSOffset(end), true
+}
+
+// DropRange replaces the header of the first block of the range by one
+// which covers the whole range and is skipped by the visitors, before the
+// space of the rest of the range is freed. The header is durable once it
+// has been written, hence the range is either intact or skipped after a
+// crash.
+func (s *lsStore) DropRange(start, end LSSOffset) (bool, error) {
+	p, ok := s.log.(LogHolePuncher)
+	if !ok || end-start > math.MaxUint32 || end-start < LSSOffset(s.hdrSize) {
+		return false, nil
+	}
+
+	// A range whose space cannot be freed is left to the cleaner
+	if h, ok := s.log.(interface {
+		HolePunchSupported() bool
+	}); ok && !h.HolePunchSupported() {
+		return false, nil
+	}
+
+	// The cleaner may be about to trim the range
+	s.Lock()
+	defer s.Unlock()
+
+	if int64(start) < atomic.LoadInt64(&s.startOffset) || int64(end) > s.log.Tail() {
+		return false, nil
+	}
+
+	if err := s.retire(int64(start), int64(end)); err != nil {
+		return false, err
+	}
+
+	hdr := make([]byte, s.hdrSize)
+	putBlockLen(hdr, int(end-start)-s.hdrSize)
+	binary.BigEndian.PutUint64(hdr[fbMarkerOffset:headerFBSize], droppedRangeMarker)
+	binary.BigEndian.PutUint32(hdr[fbLenSize:fbMarkerOffset], blockChecksum(hdr, nil))
+	if err := p.WriteAt(hdr, int64(start)); err != nil {
+		return false, err
+	}
+
+	s.addDroppedRange(int64(start), int64(end))
+	if err := p.PunchHole(int64(start)+int64(s.hdrSize), int64(end)); err != nil {
+		return true, err
+	}
+
+	return true, nil
+}
+
+func (s *lsStore) TierSegments(retire func(func())) (int, error) {
+	if t, ok := s.log.(interface {
+		TierSegments(func(func())) (int, error)
+	}); ok {
+		return t.TierSegments(retire)
+	}
+
+	return 0, nil
+}
+
+// retire passes the range to the retire callback, except for the ranges
+// which have been dropped
+func (s *lsStore) retire(start, end int64) error {
+	if s.onRetire == nil {
+		return nil
+	}
+
+	s.regionLock.Lock()
+	dropped := append([]lssRange(nil), s.dropped...)
+	s.regionLock.Unlock()
+
+	dropped = append(dropped, lssRange{start: end, end: end})
+	for _, r := range dropped {
+		if r.end <= start {
+			continue
+		}
+
+		if r.start > start {
+			rangeEnd := minInt64(r.start, end)
+			data := io.NewSectionReader(logReaderAt{s.log}, start, rangeEnd-start)
+			if err := s.onRetire(LSSRange{LSSOffset(start), LSSOffset(rangeEnd)}, data); err != nil {
+				return err
+			}
+		}
+
+		if start = r.end; start >= end {
+			break
+		}
 	}
 
 	return nil
 }
 
+// logReaderAt reads the raw bytes of a log
+type logReaderAt struct {
+	log Log
+}
+
+func (r logReaderAt) ReadAt(bs []byte, off int64) (int, error) {
+	if err := r.log.Read(bs, off); err != nil {
+		return 0, err
+	}
+
+	return len(bs), nil
+}
+
+func (s *lsStore) addDroppedRange(start, end int64) {
+	s.regionLock.Lock()
+	defer s.regionLock.Unlock()
+
+	i := sort.Search(len(s.dropped), func(i int) bool {
+		return s.dropped[i].start >= start
+	})
+
+	if i < len(s.dropped) && s.dropped[i].start == start {
+		return
+	}
+
+	s.dropped = append(s.dropped, lssRange{})
+	copy(s.dropped[i+1:], s.dropped[i:])
+	s.dropped[i] = lssRange{start: start, end: end}
+}
+
 func (s *lsStore) Sync(commit bool) {
+	s.sync(commit, false)
+}
+
+func (s *lsStore) Commit() {
+	s.sync(true, true)
+}
+
+func (s *lsStore) sync(commit, force bool) {
+	var stallStart time.Time
 retry:
 	fb := s.currBuf()
 
@@ -307,19 +1103,28 @@ retry:
 	var closed bool
 
 	if closed, endOffset = fb.TryClose(); !closed {
+		if stallStart.IsZero() {
+			stallStart = time.Now()
+		}
 		runtime.Gosched()
 		goto retry
 	}
 
+	recordStall(&s.stalls.SyncStalls, &s.stalls.SyncStallTime, stallStart)
+
 	s.initNextBuffer(fb)
+	seqno := fb.seqno
 	fb.doCommit = commit
+	fb.forceCommit = force
 	fb.Done()
 
-	for {
-		tailOffset := s.log.Tail()
-		if tailOffset >= endOffset {
-			break
-		}
+	// The flush buffer is dropped if the log has been given up on
+	for s.log.Tail() < endOffset && atomic.LoadUint64(&s.flushedSeqno) <= seqno {
+		runtime.Gosched()
+	}
+
+	// The commit follows the append
+	for commit && atomic.LoadUint64(&s.flushedSeqno) <= seqno {
 		runtime.Gosched()
 	}
 }
@@ -328,27 +1133,76 @@ var errFBReadFailed = errors.New("flushBuffer read failed")
 
 type flushCallback func(fb *flushBuffer)
 
-const headerFBSize = 4
+// Every block in a flush buffer is prefixed by
+// [32 bit length][32 bit crc32c][32 bit epoch][32 bit flush seqno]
+// When encryption is enabled, the header is followed by the nonce and
+// the authentication tag of the block. The checksum covers everything
+// in the block after itself. The epoch and the seqno of the flush buffer
+// increase along the log, so that blocks left over from an earlier epoch
+// are not mistaken for blocks which have not been fully written.
+//
+// The top bit of the length flags the blocks with this header. Logs of
+// version 0 may hold blocks written before, whose header is only the
+// length.
+const (
+	fbChecksummed      = 1 << 31
+	legacyHeaderFBSize = 4
+
+	fbLenSize       = 4
+	fbCRCSize       = 4
+	fbMarkerSize    = 8
+	fbMarkerOffset  = fbLenSize + fbCRCSize
+	headerFBSize    = fbMarkerOffset + fbMarkerSize
+	maxHeaderFBSize = headerFBSize + blockNonceSize + blockTagSize
+)
 
 type flushBuffer struct {
 	seqno      uint64
 	baseOffset int64
 	state      uint64
 	b          []byte
+	hdrSize    int
+	align      int
 	next       *flushBuffer
 	callb      flushCallback
 
-	doCommit bool
+	doCommit    bool
+	forceCommit bool
 
 	trimOffset LSSOffset
+
+	// Asynchronous writes to the buffer which are waiting for it to be
+	// written and committed
+	completionLock sync.Mutex
+	completions    []*LSSWrite
 }
 
-func newFlushBuffer(sz int, callb flushCallback) *flushBuffer {
+func newFlushBuffer(sz int, hdrSize int, align int, callb flushCallback) *flushBuffer {
 	return &flushBuffer{
-		state: encodeState(false, 1, 0),
-		b:     make([]byte, sz),
-		callb: callb,
+		state:   encodeState(false, 1, 0),
+		b:       alignedBuffer(flushBufferCap(sz, align), align),
+		hdrSize: hdrSize,
+		align:   align,
+		callb:   callb,
+	}
+}
+
+// flushBufferCap returns the capacity of a flush buffer of size sz which
+// leaves room for the padding block
+func flushBufferCap(sz, align int) int {
+	return sz + 2*align
+}
+
+// alignedBuffer returns a buffer of size bytes whose memory starts at a
+// multiple of align
+func alignedBuffer(size, align int) []byte {
+	if align == 0 {
+		return make([]byte, size)
 	}
+
+	b := make([]byte, size+align)
+	off := (align - int(uintptr(unsafe.Pointer(&b[0]))%uintptr(align))) % align
+	return b[off : off+size]
 }
 
 func (fb *flushBuffer) GetTrimLogOffset() (LSSOffset, bool) {
@@ -356,8 +1210,7 @@ func (fb *flushBuffer) GetTrimLogOffset() (LSSOffset, bool) {
 }
 
 func (fb *flushBuffer) Bytes() []byte {
-	_, _, _, offset := decodeState(fb.state)
-	return fb.b[:offset]
+	return fb.b[:fb.EndOffset()-fb.StartOffset()]
 }
 
 func (fb *flushBuffer) StartOffset() int64 {
@@ -366,7 +1219,40 @@ func (fb *flushBuffer) StartOffset() int64 {
 
 func (fb *flushBuffer) EndOffset() int64 {
 	_, _, _, offset := decodeState(fb.state)
-	return atomic.LoadInt64(&fb.baseOffset) + int64(offset)
+	return fb.alignOffset(atomic.LoadInt64(&fb.baseOffset) + int64(offset))
+}
+
+// alignOffset returns the offset the buffer is padded to if its blocks end
+// at off. The padding is large enough to hold a discard block.
+func (fb *flushBuffer) alignOffset(off int64) int64 {
+	align := int64(fb.align)
+	if align == 0 || off%align == 0 {
+		return off
+	}
+
+	end := (off + align - 1) / align * align
+	if end-off < int64(fb.hdrSize+lssBlockTypeSize) {
+		end += align
+	}
+
+	return end
+}
+
+// Pad fills the space between the last block and the end of the buffer
+// with a discard block
+func (fb *flushBuffer) Pad() {
+	_, _, _, offset := decodeState(fb.state)
+	end := int(fb.EndOffset() - fb.StartOffset())
+	if end == offset {
+		return
+	}
+
+	putBlockLen(fb.b[offset:], end-offset-fb.hdrSize)
+	data := fb.b[offset+fb.hdrSize : end]
+	for i := range data {
+		data[i] = 0
+	}
+	discardLSSBlock(data)
 }
 
 func (fb *flushBuffer) TryClose() (markedFull bool, lssOff int64) {
@@ -398,8 +1284,8 @@ func (fb *flushBuffer) Read(off int64, buf []byte) (l int, err error) {
 
 	if off >= startOff && off < endOff {
 		payloadOffset := off - startOff
-		dataOffset := payloadOffset + headerFBSize
-		l = int(binary.BigEndian.Uint32(fb.b[payloadOffset:dataOffset]))
+		dataOffset := payloadOffset + int64(fb.hdrSize)
+		l = blockLen(fb.b[payloadOffset:])
 		copy(buf, fb.b[dataOffset:dataOffset+int64(l)])
 
 		if startOff != atomic.LoadInt64(&fb.baseOffset) {
@@ -437,11 +1323,11 @@ retry:
 
 	size := 0
 	for _, sz := range sizes {
-		size += sz + headerFBSize
+		size += sz + fb.hdrSize
 	}
 
 	newOffset := offset + size
-	if newOffset > len(fb.b) {
+	if newOffset > len(fb.b)-2*fb.align {
 		markedFull := true
 		newState := encodeState(true, nw, offset)
 		if !atomic.CompareAndSwapUint64(&fb.state, state, newState) {
@@ -459,15 +1345,52 @@ retry:
 	bufs = make([][]byte, len(sizes))
 	offs = make([]LSSOffset, len(sizes))
 	for i, bufOffset := 0, offset; i < len(sizes); i++ {
-		binary.BigEndian.PutUint32(fb.b[bufOffset:bufOffset+headerFBSize], uint32(sizes[i]))
-		bufs[i] = fb.b[bufOffset+headerFBSize : bufOffset+headerFBSize+sizes[i]]
+		putBlockLen(fb.b[bufOffset:], sizes[i])
+		bufs[i] = fb.b[bufOffset+fb.hdrSize : bufOffset+fb.hdrSize+sizes[i]]
 		offs[i] = LSSOffset(fb.baseOffset + int64(bufOffset))
-		bufOffset += sizes[i] + headerFBSize
+		bufOffset += sizes[i] + fb.hdrSize
 	}
 
 	return true, false, offs, bufs
 }
 
+// Seal computes the checksum of every block in the buffer. It must only
+// be called once all the writers are done with the buffer.
+func (fb *flushBuffer) Seal(epoch int64) {
+	checksumBlocks(fb.Bytes(), fb.hdrSize, fb.marker(epoch))
+}
+
+func (fb *flushBuffer) marker(epoch int64) uint64 {
+	return uint64(uint32(epoch))<<32 | uint64(uint32(fb.seqno))
+}
+
+func checksumBlocks(b []byte, hdrSize int, marker uint64) {
+	for off := 0; off < len(b); {
+		l := blockLen(b[off:])
+		hdr := b[off : off+hdrSize]
+		binary.BigEndian.PutUint64(hdr[fbMarkerOffset:headerFBSize], marker)
+		binary.BigEndian.PutUint32(hdr[fbLenSize:fbMarkerOffset],
+			blockChecksum(hdr, b[off+hdrSize:off+hdrSize+l]))
+		off += l + hdrSize
+	}
+}
+
+// blockLen returns the length of the data of the block whose header is hdr
+func blockLen(hdr []byte) int {
+	return int(binary.BigEndian.Uint32(hdr[:fbLenSize]) &^ fbChecksummed)
+}
+
+// putBlockLen records the length of the data of a checksummed block in its
+// header
+func putBlockLen(hdr []byte, l int) {
+	binary.BigEndian.PutUint32(hdr[:fbLenSize], uint32(l)|fbChecksummed)
+}
+
+func blockChecksum(hdr []byte, data []byte) uint32 {
+	crc := crc32.Checksum(hdr[fbMarkerOffset:], crc32cTable)
+	return crc32.Update(crc, crc32cTable, data)
+}
+
 func (fb *flushBuffer) Done() {
 retry:
 	state := atomic.LoadUint64(&fb.state)
@@ -499,6 +1422,7 @@ func (fb *flushBuffer) IsReset() bool {
 
 func (fb *flushBuffer) Reset() {
 	fb.doCommit = false
+	fb.forceCommit = false
 	fb.trimOffset = 0
 	state := resetState(atomic.LoadUint64(&fb.state))
 	atomic.StoreUint64(&fb.state, state)
@@ -537,6 +1461,11 @@ func isResetState(state uint64) bool {
 	return state&0x2 > 0
 }
 
-func lssBlockEndOffset(off LSSOffset, b []byte) LSSOffset {
-	return headerFBSize + off + LSSOffset(len(b))
+func (s *lsStore) BlockEndOffset(off LSSOffset, b []byte) LSSOffset {
+	hdrSize, err := s.headerSize(int64(off))
+	if err != nil {
+		hdrSize = s.hdrSize
+	}
+
+	return LSSOffset(hdrSize) + off + LSSOffset(len(b))
 }
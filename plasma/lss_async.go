@@ -0,0 +1,97 @@
+package plasma
+
+import (
+	"runtime"
+)
+
+// LSSWrite is the completion of a write finalized using
+// LSS.FinalizeWriteAsync. It is resolved once the flush buffer holding the
+// blocks of the write has been written to the log and the commit covering
+// it has been synced to disk, irrespective of the sync mode.
+type LSSWrite struct {
+	s     *lsStore
+	seqno uint64
+
+	done chan struct{}
+	err  error
+}
+
+// Done returns a channel which is closed once the write is durable or has
+// failed. A flush buffer is only written once it fills up or the log is
+// synced, unless Wait is called.
+func (w *LSSWrite) Done() <-chan struct{} {
+	return w.done
+}
+
+// Err returns the error the write failed with, e.g. ErrLogWrite if the log
+// has been given up on. It must only be called once Done is closed.
+func (w *LSSWrite) Err() error {
+	return w.err
+}
+
+// Wait flushes the buffer holding the blocks of the write if it is still
+// being filled up and waits for the write to complete. Unlike LSS.Sync, it
+// does not wait for the buffers reserved after the write.
+func (w *LSSWrite) Wait() error {
+	select {
+	case <-w.done:
+		return w.err
+	default:
+	}
+
+	w.s.closeBuffer(w.seqno)
+	<-w.done
+	return w.err
+}
+
+func (w *LSSWrite) resolve(err error) {
+	w.err = err
+	close(w.done)
+}
+
+// FinalizeWriteAsync finalizes the write of the blocks reserved by res like
+// FinalizeWrite and returns a handle which is resolved once they are durable
+func (s *lsStore) FinalizeWriteAsync(res LSSResource) *LSSWrite {
+	fb := res.(*flushBuffer)
+	w := &LSSWrite{
+		s:     s,
+		seqno: fb.seqno,
+		done:  make(chan struct{}),
+	}
+
+	fb.completionLock.Lock()
+	fb.completions = append(fb.completions, w)
+	fb.completionLock.Unlock()
+
+	fb.Done()
+	return w
+}
+
+// closeBuffer closes the flush buffer with the given seqno so that it gets
+// written once its writers are done, unless it has already been closed
+func (s *lsStore) closeBuffer(seqno uint64) {
+	for {
+		fb := s.currBuf()
+		if fb.seqno != seqno {
+			return
+		}
+
+		if closed, _ := fb.TryClose(); closed {
+			s.initNextBuffer(fb)
+			fb.Done()
+			return
+		}
+
+		runtime.Gosched()
+	}
+}
+
+// takeCompletions returns the pending completions of the flush buffer
+func (fb *flushBuffer) takeCompletions() []*LSSWrite {
+	fb.completionLock.Lock()
+	defer fb.completionLock.Unlock()
+
+	ws := fb.completions
+	fb.completions = nil
+	return ws
+}
@@ -1,35 +1,547 @@
 package plasma
 
 import (
-	"fmt"
+	"errors"
+	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
-func (s *Plasma) tryPageRelocation(pid PageId, pg Page, buf []byte, ctx *wCtx) (bool, LSSOffset) {
+// Utilization of the log is tracked at the granularity of regions
+const lssRegionSize = lssReclaimBlockSize
+
+// Transactions which may still read a dead region are waited for at most
+// this long before the region is dropped
+const lssDropTxTimeout = time.Second
+
+// Maximum number of fragmented regions whose live pages are relocated in
+// a cleaner pass
+const lssMaxCleanRegions = 16
+
+// Percentage of Config.MaxLSSUsedSpace beyond which the cleaner runs
+// irrespective of the fragmentation threshold
+const lssQuotaCleanPercent = 90
+
+type lssRegion struct {
+	live      int64
+	lastWrite time.Time
+	// The region cannot be dropped and is left to the cleaner
+	keep bool
+}
+
+// lssRegionStats maintains an estimate of the live bytes in every region
+// of the log from the changes to the flushed data size of the pages.
+// Bytes which became stale are accounted to the region of the most recent
+// block of the page. Regions written before the instance was opened start
+// off with the utilization of the whole log.
+type lssRegionStats struct {
+	sync.Mutex
+	regions   map[int64]*lssRegion
+	trackFrom LSSOffset
+	opened    time.Time
+}
+
+type lssRegionInfo struct {
+	size int64
+	live int64
+	age  time.Duration
+}
+
+func newLSSRegionStats(trackFrom LSSOffset) *lssRegionStats {
+	return &lssRegionStats{
+		regions:   make(map[int64]*lssRegion),
+		trackFrom: trackFrom,
+		opened:    time.Now(),
+	}
+}
+
+func (rs *lssRegionStats) region(off LSSOffset) *lssRegion {
+	id := int64(off) / lssRegionSize
+	r, ok := rs.regions[id]
+	if !ok {
+		r = &lssRegion{lastWrite: rs.opened}
+		rs.regions[id] = r
+	}
+
+	return r
+}
+
+// update accounts dataSz bytes written at off, which made staleSz bytes
+// of the page written earlier at staleOff stale
+func (rs *lssRegionStats) update(staleOff LSSOffset, staleSz int, off LSSOffset, dataSz int) {
+	rs.Lock()
+	defer rs.Unlock()
+
+	if staleSz > 0 {
+		rs.region(staleOff).live -= int64(staleSz)
+	}
+
+	if dataSz > 0 {
+		r := rs.region(off)
+		r.live += int64(dataSz)
+		r.lastWrite = time.Now()
+	}
+}
+
+// snapshot returns the estimated utilization of the regions covering
+// the log between head and tail. Stats of the regions before head are
+// discarded.
+func (rs *lssRegionStats) snapshot(head, tail LSSOffset, util float64) []lssRegionInfo {
+	rs.Lock()
+	defer rs.Unlock()
+
+	first, last := int64(head)/lssRegionSize, int64(tail)/lssRegionSize
+	for id := range rs.regions {
+		if id < first {
+			delete(rs.regions, id)
+		}
+	}
+
+	now := time.Now()
+	infos := make([]lssRegionInfo, 0, last-first+1)
+	for id := first; id <= last; id++ {
+		start, end := id*lssRegionSize, (id+1)*lssRegionSize
+		if start < int64(head) {
+			start = int64(head)
+		}
+		if end > int64(tail) {
+			end = int64(tail)
+		}
+		if start >= end {
+			continue
+		}
+
+		info := lssRegionInfo{size: end - start, age: now.Sub(rs.opened)}
+		if id*lssRegionSize < int64(rs.trackFrom) {
+			info.live = int64(util * float64(info.size))
+		}
+
+		if r, ok := rs.regions[id]; ok {
+			info.live += r.live
+			info.age = now.Sub(r.lastWrite)
+		}
+
+		if info.live < 0 {
+			info.live = 0
+		} else if info.live > info.size {
+			info.live = info.size
+		}
+
+		infos = append(infos, info)
+	}
+
+	return infos
+}
+
+// deadRegions returns the ids of the regions from head to limit which have
+// been written since the instance was opened and are estimated to hold no
+// live data
+func (rs *lssRegionStats) deadRegions(head, limit LSSOffset) []int64 {
+	rs.Lock()
+	defer rs.Unlock()
+
+	first := int64(head)/lssRegionSize + 1
+	if from := (int64(rs.trackFrom) + lssRegionSize - 1) / lssRegionSize; from > first {
+		first = from
+	}
+
+	var ids []int64
+	for id := first; (id+1)*lssRegionSize <= int64(limit); id++ {
+		if r, ok := rs.regions[id]; !ok || (r.live <= 0 && !r.keep) {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+// fragmentedRegions returns the ids of at most n regions from head to
+// limit, which have been written since the instance was opened and are
+// more fragmented than threshold percent. The regions are ordered by the
+// cost-benefit ratio of cleaning them, (free * age) / (read + relocated)
+// as in LFS, so that the cold regions with the least live data come first.
+func (rs *lssRegionStats) fragmentedRegions(head, limit LSSOffset, threshold, n int) []int64 {
+	rs.Lock()
+	defer rs.Unlock()
+
+	first := int64(head)/lssRegionSize + 1
+	if from := (int64(rs.trackFrom) + lssRegionSize - 1) / lssRegionSize; from > first {
+		first = from
+	}
+
+	now := time.Now()
+	var ids []int64
+	scores := make(map[int64]float64)
+	for id := first; (id+1)*lssRegionSize <= int64(limit); id++ {
+		r, ok := rs.regions[id]
+		if !ok || r.live <= 0 || r.keep || (lssRegionSize-r.live)*100/lssRegionSize <= int64(threshold) {
+			continue
+		}
+
+		ids = append(ids, id)
+		scores[id] = float64(lssRegionSize-r.live) * now.Sub(r.lastWrite).Seconds() /
+			float64(lssRegionSize+r.live)
+	}
+
+	sort.SliceStable(ids, func(i, j int) bool {
+		return scores[ids[i]] > scores[ids[j]]
+	})
+
+	if len(ids) > n {
+		ids = ids[:n]
+	}
+
+	return ids
+}
+
+// markDead records that the live data of a region has been relocated.
+// The bytes which became stale might have been accounted to the regions
+// of later blocks of the pages instead.
+func (rs *lssRegionStats) markDead(id int64) {
+	rs.Lock()
+	defer rs.Unlock()
+
+	rs.region(LSSOffset(id * lssRegionSize)).live = 0
+}
+
+func (rs *lssRegionStats) keep(id int64) {
+	rs.Lock()
+	defer rs.Unlock()
+
+	rs.region(LSSOffset(id * lssRegionSize)).keep = true
+}
+
+// selectCleanRegions decides how many regions from the head of the log
+// the cleaner should process. The regions written before the instance was
+// opened can only be reclaimed by trimming the head, so the cleaner has to
+// go at least as far as required to bring the fragmentation below
+// threshold. Beyond that, the prefix is extended over
+// the following regions as long as it improves the cost-benefit ratio of
+// the pass, (free * age) / (read + relocated) as in LFS, which picks up
+// the cheap regions left behind by frequently updated pages.
+func selectCleanRegions(regions []lssRegionInfo, data int64, threshold int) int {
+	var used int64
+	for _, r := range regions {
+		used += r.size
+	}
+
+	var freed, live int64
+	var best int
+	var bestScore float64
+	for i, r := range regions {
+		freed += r.size
+		live += r.live
+
+		score := float64(freed-live) * r.age.Seconds() / float64(freed+live)
+		if best == 0 || score > bestScore {
+			best, bestScore = i+1, score
+		}
+
+		usedAfter := used - freed + live
+		if usedAfter <= 0 || (usedAfter-data)*100/usedAfter > int64(threshold) {
+			best, bestScore = i+1, score
+		}
+	}
+
+	return best
+}
+
+// lssCleanerTarget returns the log offset upto which the cleaner should
+// relocate the pages during a pass
+func (s *Plasma) lssCleanerTarget() LSSOffset {
+	head, tail := s.lss.HeadOffset(), s.lss.TailOffset()
+	data, used := s.LSSDataSize(), s.lss.UsedSpace()
+
+	util := 1.0
+	if used > 0 && data < used {
+		util = float64(data) / float64(used)
+	}
+
+	threshold := s.Config.LSSCleanerThreshold
+	if s.lssQuotaApproached() {
+		threshold = 0
+	}
+
+	regions := s.lssRegions.snapshot(head, tail, util)
+	n := selectCleanRegions(regions, data, threshold)
+
+	target := head
+	for _, r := range regions[:n] {
+		target += LSSOffset(r.size)
+	}
+
+	return target
+}
+
+func (s *Plasma) trackLSSUsage(staleOff LSSOffset, staleSz int, off LSSOffset, dataSz int) {
+	if s.lssRegions != nil {
+		s.lssRegions.update(staleOff, staleSz, off, dataSz)
+	}
+}
+
+func (s *Plasma) tryPageRelocation(pid PageId, pg Page, buf []byte, ctx *wCtx) (bool, LSSOffset, error) {
 	var ok bool
-	bs, dataSz, staleSz, numSegments := pg.Marshal(buf, FullMarshal)
+	var compactFdSz int
+
+	staleOff, _ := pg.GetLastFlushOffset()
+
+	// Apply compaction filters to resident pages before relocating them
+	if s.hasCompactionFilters() && !pg.(*page).head.state.IsEvicted() {
+		compactFdSz = pg.Compact()
+	}
+
+	bs, _, staleSz, numSegments, err := pg.Marshal(buf, FullMarshal)
+	if err != nil {
+		allocs, _, _, _, _ := pg.GetAllocOps()
+		s.discardDeltas(allocs)
+		if err == ErrPageTooBig {
+			// The pages split off are written out, the relocation is retried
+			err = s.splitOversizedPage(pid, ctx)
+		}
+		return false, 0, err
+	}
+
+	typ, bs := s.compressPageBlock(lssPageReloc, bs)
+	dataSz := len(bs)
 	offset, wbuf, res := s.lss.ReserveSpace(lssBlockTypeSize + len(bs))
-	writeLSSBlock(wbuf, lssPageReloc, bs)
+	writeLSSBlock(wbuf, typ, bs)
 
 	pg.AddFlushRecord(offset, dataSz, numSegments)
 
 	if ok = s.UpdateMapping(pid, pg, ctx); !ok {
 		discardLSSBlock(wbuf)
 		s.lss.FinalizeWrite(res)
-		return false, 0
+		return false, 0, nil
 	}
 
 	s.lss.FinalizeWrite(res)
-	s.lssCleanerWriter.sts.FlushDataSz += int64(dataSz) - int64(staleSz)
-	relocEnd := lssBlockEndOffset(offset, wbuf)
+	s.lssCleanerWriter.sts.FlushDataSz += int64(dataSz) - int64(staleSz) - int64(compactFdSz)
+	s.trackLSSUsage(staleOff, staleSz+compactFdSz, offset, dataSz)
+	relocEnd := s.lss.BlockEndOffset(offset, wbuf)
 	s.trySMRObjects(ctx, lssCleanerSMRInterval)
 
-	return true, relocEnd
+	return true, relocEnd, nil
 }
 
-func (s *Plasma) CleanLSS(proceed func() bool) error {
+// relocatePage relocates the page of a page block read from the log if the
+// block belongs to the current version of the page or if the page has not
+// been flushed since. It reports whether the page was found.
+func (s *Plasma) relocatePage(data []byte, buf []byte, w *wCtx) (found, relocated bool, retries int, err error) {
 	var pg Page
+	state, key := decodePageState(data)
+retry:
+	pid := s.getPageId(key, w)
+	if pid == nil {
+		return false, false, retries, nil
+	}
+
+	if pg, err = s.ReadPage(pid, w.pgRdrFn, false, w); err != nil {
+		return true, false, retries, err
+	}
+
+	if pg.NeedRemoval() {
+		s.tryPageRemoval(pid, pg, w)
+		goto retry
+	}
+
+	if pg.GetVersion() == state.GetVersion() || !pg.IsFlushed() {
+		if ok, _, err := s.tryPageRelocation(pid, pg, buf, w); err != nil {
+			return true, false, retries, err
+		} else if !ok {
+			retries++
+			goto retry
+		}
+
+		return true, true, retries, nil
+	}
+
+	allocs, _, _, _, _ := pg.GetAllocOps()
+	s.discardDeltas(allocs)
+	return true, false, retries, nil
+}
+
+// relocateMetaBlock rewrites the recovery points, the max sn or the heat
+// map at the tail of the log if the block is the latest one
+func (s *Plasma) relocateMetaBlock(typ lssBlockType, bs []byte) {
+	s.mvcc.Lock()
+	defer s.mvcc.Unlock()
+
+	switch typ {
+	case lssRecoveryPoints:
+		if version, _ := unmarshalRPs(bs[lssBlockTypeSize:]); s.rpVersion == version {
+			s.updateRecoveryPoints(s.recoveryPoints)
+		}
+	case lssMaxSn:
+		if maxSn := decodeMaxSn(bs[lssBlockTypeSize:]); maxSn <= atomic.LoadUint64(&s.lastMaxSn) {
+			s.updateMaxSn(atomic.LoadUint64(&s.currSn), true)
+		}
+	case lssHeatMap:
+		s.relocateHeatMap(heatMapVersion(bs[lssBlockTypeSize:]))
+	}
+}
+
+// dropDeadLSSRegions frees the regions of the log between the head and the
+// blocks which are pinned, which hold no live data according to the region
+// stats, without moving the head. The blocks of such a region are checked
+// like the cleaner does and the pages found to be live are relocated. The
+// region is dropped once the relocations are durable and the transactions
+// which could still read it have ended. Regions with page removals are
+// left to the cleaner, since replaying the older blocks of a removed page
+// would bring it back. It returns the number of bytes dropped.
+func (s *Plasma) dropDeadLSSRegions() (int64, error) {
+	if s.readOnly {
+		return 0, ErrReadOnly
+	} else if s.lssRegions == nil {
+		return 0, nil
+	}
+
+	w := s.lssCleanerWriter
+	relocBuf := w.GetBuffer(bufReloc)
+	buf := w.GetBuffer(bufCleaner)
+
+	limit := s.lssPinOffset()
+	if tail := s.lss.TailOffset(); tail < limit {
+		limit = tail
+	}
+
+	var dropped int64
+	for _, id := range s.lssRegions.deadRegions(s.lss.HeadOffset(), limit) {
+		start, end, ok := s.lss.RegionRange(id)
+		if !ok || end > limit {
+			continue
+		}
+
+		keep, moved, err := s.relocateLSSRegion(start, end, relocBuf, buf)
+		if err != nil {
+			return dropped, err
+		} else if keep {
+			s.lssRegions.keep(id)
+			continue
+		}
+
+		// The relocated blocks have to be recovered in place of the region
+		if moved {
+			s.lss.Commit()
+		}
+
+		if !s.waitForTxs(w, lssDropTxTimeout) {
+			break
+		}
+
+		if ok, err := s.lss.DropRange(start, end); errors.Is(err, ErrLogSegmentTiered) ||
+			errors.Is(err, ErrLogSegmentShared) {
+			s.lssRegions.keep(id)
+		} else if err != nil {
+			return dropped, err
+		} else if ok {
+			dropped += int64(end - start)
+		}
+	}
+
+	return dropped, nil
+}
+
+// relocateLSSRegion relocates the live pages and metadata of the blocks of
+// a region to the tail of the log. It reports whether the region has to be
+// kept since it has page removals and whether any block was relocated.
+func (s *Plasma) relocateLSSRegion(start, end LSSOffset, relocBuf, buf []byte) (keep, moved bool, err error) {
+	w := s.lssCleanerWriter
+	callb := func(off LSSOffset, bs []byte) (bool, error) {
+		tok := w.BeginTx()
+		defer w.EndTx(tok)
+
+		switch typ := getLSSBlockType(bs); typ {
+		case lssPageData, lssPageReloc, lssPageUpdate:
+			data, err := s.decompressPageBlock(bs, w)
+			if err != nil {
+				return false, err
+			}
+
+			_, ok, _, err := s.relocatePage(data, relocBuf, w)
+			if err != nil {
+				return false, err
+			}
+			moved = moved || ok
+		case lssRecoveryPoints, lssMaxSn, lssHeatMap:
+			s.relocateMetaBlock(typ, bs)
+			moved = true
+		case lssPageRemove:
+			keep = true
+			return false, nil
+		case lssDiscard, lssCheckpoint:
+		default:
+			return false, newLSSError("relocate", off, ErrCorruptLog)
+		}
+
+		return true, nil
+	}
+
+	err = s.lss.VisitorRange(start, end, callb, buf)
+	return keep, moved, err
+}
+
+// cleanFragmentedLSSRegions relocates the live pages of the most
+// fragmented regions of the log, wherever they are, so that the regions
+// are dropped by dropDeadLSSRegions without waiting for the head to reach
+// them. It returns the number of regions relocated.
+func (s *Plasma) cleanFragmentedLSSRegions() (int, error) {
+	if s.readOnly {
+		return 0, ErrReadOnly
+	} else if s.lssRegions == nil {
+		return 0, nil
+	}
+
+	w := s.lssCleanerWriter
+	relocBuf := w.GetBuffer(bufReloc)
+	buf := w.GetBuffer(bufCleaner)
+
+	limit := s.lssPinOffset()
+	if tail := s.lss.TailOffset(); tail < limit {
+		limit = tail
+	}
+
+	var cleaned int
+	ids := s.lssRegions.fragmentedRegions(s.lss.HeadOffset(), limit,
+		s.Config.LSSCleanerThreshold, lssMaxCleanRegions)
+	for _, id := range ids {
+		if s.isClosed() || s.IsMaintenancePaused() {
+			break
+		}
+
+		start, end, ok := s.lss.RegionRange(id)
+		if !ok || end > limit {
+			continue
+		}
+
+		keep, _, err := s.relocateLSSRegion(start, end, relocBuf, buf)
+		if err != nil {
+			return cleaned, err
+		} else if keep {
+			s.lssRegions.keep(id)
+			continue
+		}
+
+		s.lssRegions.markDead(id)
+		cleaned++
+	}
+
+	return cleaned, nil
+}
+
+func (s *Plasma) CleanLSS(proceed func() bool) error {
+	return s.cleanLSS(func(LSSOffset) bool {
+		return proceed()
+	})
+}
+
+// cleanLSS runs a cleaner pass, which continues as long as proceed returns
+// true for the offset upto which the log has been cleaned
+func (s *Plasma) cleanLSS(proceed func(LSSOffset) bool) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+
 	w := s.lssCleanerWriter
 	relocBuf := w.GetBuffer(bufReloc)
 	cleanerBuf := w.GetBuffer(bufCleaner)
@@ -45,65 +557,54 @@ func (s *Plasma) CleanLSS(proceed func() bool) error {
 		typ := getLSSBlockType(bs)
 		switch typ {
 		case lssPageData, lssPageReloc:
-			state, key := decodePageState(bs[lssBlockTypeSize:])
-		retry:
-			if pid := s.getPageId(key, w); pid != nil {
-				if pg, err = s.ReadPage(pid, w.pgRdrFn, false, w); err != nil {
-					return false, 0, err
-				}
-
-				if pg.NeedRemoval() {
-					s.tryPageRemoval(pid, pg, w)
-					goto retry
-				}
+			data, err := s.decompressPageBlock(bs, w)
+			if err != nil {
+				return false, 0, err
+			}
 
-				if pg.GetVersion() == state.GetVersion() || !pg.IsFlushed() {
-					if ok, _ := s.tryPageRelocation(pid, pg, relocBuf, w); !ok {
-						retries++
-						goto retry
-					}
-					relocated++
-				} else {
-					allocs, _, _, _, _ := pg.GetAllocOps()
-					s.discardDeltas(allocs)
-					skipped++
-				}
+			found, ok, n, err := s.relocatePage(data, relocBuf, w)
+			if err != nil {
+				return false, 0, err
 			}
 
-			return proceed(), endOff, nil
-		case lssRecoveryPoints:
-			version, _ := unmarshalRPs(bs[lssBlockTypeSize:])
-			s.mvcc.Lock()
-			if s.rpVersion == version {
-				s.updateRecoveryPoints(s.recoveryPoints)
+			retries += n
+			if ok {
+				relocated++
+			} else if found {
+				skipped++
 			}
-			s.mvcc.Unlock()
-			return true, endOff, nil
-		case lssDiscard, lssPageUpdate, lssPageRemove:
+
+			return proceed(endOff), endOff, nil
+		case lssRecoveryPoints, lssMaxSn, lssHeatMap:
+			s.relocateMetaBlock(typ, bs)
+		case lssDiscard, lssPageUpdate, lssPageRemove, lssCheckpoint:
 			return true, endOff, nil
-		case lssMaxSn:
-			maxSn := decodeMaxSn(bs[lssBlockTypeSize:])
-			s.mvcc.Lock()
-			if maxSn <= atomic.LoadUint64(&s.lastMaxSn) {
-				s.updateMaxSn(atomic.LoadUint64(&s.currSn), true)
-			}
-			s.mvcc.Unlock()
 		default:
-			panic(fmt.Sprintf("unknown block typ %d", typ))
+			return false, 0, newLSSError("clean", startOff, ErrCorruptLog)
 		}
 
 		return true, endOff, nil
 	}
 
 	frag, ds, used := s.GetLSSInfo()
+	usedBefore := used
 	start := s.lss.HeadOffset()
 	end := s.lss.TailOffset()
-	fmt.Printf("logCleaner: starting... frag %d, data: %d, used: %d log:(%d - %d)\n", frag, ds, used, start, end)
+	s.logger("logCleaner").Infof("starting... frag %d, data: %d, used: %d log:(%d - %d)", frag, ds, used, start, end)
+	span := s.startSpan(SpanLSSClean)
 	err := s.lss.RunCleaner(callb, cleanerBuf)
+	span.SetAttribute("relocated", relocated)
+	span.SetAttribute("retries", retries)
+	span.SetAttribute("skipped", skipped)
+	span.End(err)
 	frag, ds, used = s.GetLSSInfo()
 	start = s.lss.HeadOffset()
 	end = s.lss.TailOffset()
-	fmt.Printf("logCleaner: completed... frag %d, data: %d, used: %d, relocated: %d, retries: %d, skipped: %d log:(%d - %d)\n", frag, ds, used, relocated, retries, skipped, start, end)
+	s.logger("logCleaner").Infof("completed... frag %d, data: %d, used: %d, relocated: %d, retries: %d, skipped: %d log:(%d - %d)", frag, ds, used, relocated, retries, skipped, start, end)
+	s.publish(Event{
+		Type: EventCleanerPass,
+		Size: maxInt64(usedBefore-used, 0),
+	})
 	return err
 }
 
@@ -120,8 +621,12 @@ func (s *Plasma) GetLSSInfo() (frag int, data int64, used int64) {
 
 func (s *Plasma) lssCleanerDaemon() {
 	shouldClean := func() bool {
+		if s.isClosed() {
+			return false
+		}
+
 		frag, _, _ := s.GetLSSInfo()
-		return frag > 0 && frag > s.Config.LSSCleanerThreshold
+		return frag > 0 && (frag > s.Config.LSSCleanerThreshold || s.lssQuotaApproached())
 	}
 
 loop:
@@ -133,10 +638,40 @@ loop:
 		default:
 		}
 
-		if shouldClean() {
-			if err := s.CleanLSS(shouldClean); err != nil {
-				fmt.Printf("logCleaner: failed (err=%v)\n", err)
+		if s.beginMaintenance() {
+			if dropped, err := s.dropDeadLSSRegions(); err != nil {
+				s.logger("logCleaner").Errorf("failed to drop dead regions (err=%v)", err)
+			} else if dropped > 0 {
+				s.logger("logCleaner").Infof("dropped %d bytes of dead regions", dropped)
+			}
+
+			if n, err := s.lss.TierSegments(s.retireLogFile); err != nil {
+				s.logger("logCleaner").Errorf("failed to move segments to the tier (err=%v)", err)
+			} else if n > 0 {
+				s.logger("logCleaner").Infof("moved %d segments to the tier", n)
+			}
+
+			if shouldClean() {
+				// The most fragmented regions are cleaned first, which
+				// leaves them to be dropped on the next iteration
+				if n, err := s.cleanFragmentedLSSRegions(); err != nil {
+					s.logger("logCleaner").Errorf("failed to clean fragmented regions (err=%v)", err)
+				} else if n > 0 {
+					s.logger("logCleaner").Infof("relocated the pages of %d fragmented regions", n)
+				}
+			}
+
+			if shouldClean() {
+				target := s.lssCleanerTarget()
+				proceed := func(off LSSOffset) bool {
+					return off < target && !s.isClosed() && !s.IsMaintenancePaused()
+				}
+
+				if err := s.cleanLSS(proceed); err != nil {
+					s.logger("logCleaner").Errorf("failed (err=%v)", err)
+				}
 			}
+			s.endMaintenance()
 		}
 
 		time.Sleep(time.Second)
@@ -0,0 +1,200 @@
+package plasma
+
+import (
+	"sort"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/couchbase/nitro/skiplist"
+)
+
+// ScanCallback is called with the key and the value of an item. The slices
+// are only valid until the callback returns.
+type ScanCallback func(key, val []byte) error
+
+// ScanLSSOrder calls callback for the items visible in the snapshot in the
+// order their pages are laid out in the LSS rather than in key order, so
+// that the log is read sequentially like the cleaner does, e.g. for
+// analytics or backup jobs which do not need the items sorted. Pages with
+// changes which have not been written to the LSS are read from memory
+// before the log is scanned. The log is not trimmed while the scan is in
+// progress. The scan stops at the first error returned by callback.
+func (s *Plasma) ScanLSSOrder(snap *Snapshot, callback ScanCallback) error {
+	if s.isClosed() {
+		return ErrClosed
+	}
+
+	snap.Open()
+	defer snap.Close()
+
+	ctx := s.newWCtx()
+	defer s.retireWCtx(ctx)
+
+	if s.shouldPersist {
+		t := s.pinLog(s.lss.HeadOffset())
+		defer s.unpinLog(t)
+
+		// The head might have been trimmed before it was pinned
+		for LSSOffset(atomic.LoadUint64(&t.offset)) < s.lss.HeadOffset() {
+			atomic.StoreUint64(&t.offset, uint64(s.lss.HeadOffset()))
+		}
+	}
+
+	// Pages which have not changed since they were last written are
+	// scanned from the log, starting at the item following the part of the
+	// key space scanned before the page was visited
+	blocks := make(map[LSSOffset]unsafe.Pointer)
+	low := skiplist.MinItem
+	pid := s.StartPageId()
+	for {
+		tok := ctx.BeginTx()
+		pg, _ := s.ReadPage(pid, nil, false, ctx)
+		pgi := pg.(*page)
+		if pgi.NeedRemoval() {
+			// The items of the page are merged into the page on its left,
+			// which is scanned again from low
+			s.tryPageRemoval(pid, pg, ctx)
+			if prev, curr, found := s.Skiplist.Lookup(low, s.cmp, ctx.buf, ctx.slSts); found {
+				pid = curr
+			} else {
+				pid = prev
+			}
+			ctx.EndTx(tok)
+			continue
+		}
+
+		if pgi.head != nil {
+			if offset, ok := unchangedPageOffset(pgi.head); ok {
+				blocks[offset] = low
+			} else if err := s.scanPage(pgi, low, snap, ctx, callback); err != nil {
+				ctx.EndTx(tok)
+				return err
+			}
+		}
+
+		hi := pgi.MaxItem()
+		low, pid = ctx.storeCtx.dup(hi), pg.Next()
+		ctx.EndTx(tok)
+
+		if hi == skiplist.MaxItem {
+			break
+		}
+	}
+
+	if len(blocks) == 0 {
+		return nil
+	}
+
+	offsets := make([]LSSOffset, 0, len(blocks))
+	for offset := range blocks {
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	var err error
+	remaining := len(offsets)
+	buf := make([]byte, maxPageEncodedSize)
+	fn := func(offset LSSOffset, bs []byte) (bool, error) {
+		low, ok := blocks[offset]
+		if !ok {
+			return true, nil
+		}
+
+		tok := ctx.BeginTx()
+		defer ctx.EndTx(tok)
+
+		pg, err := s.decodePageBlock(offset, bs, ctx)
+		if err != nil {
+			return false, err
+		}
+
+		allocs, _, _, _, _ := pg.GetAllocOps()
+		defer s.discardDeltas(allocs)
+
+		if err := s.scanPage(pg, low, snap, ctx, callback); err != nil {
+			return false, err
+		}
+
+		remaining--
+		return remaining > 0, nil
+	}
+
+	if err = s.lss.VisitorRange(offsets[0], s.lss.TailOffset(), fn, buf); err == nil && remaining > 0 {
+		err = newLSSError("scan", offsets[len(offsets)-remaining], ErrCorruptLog)
+	}
+
+	return err
+}
+
+// unchangedPageOffset returns the offset of the block holding the page if
+// the page has not changed since it was last written to the LSS. Swapping
+// in the page does not change it.
+func unchangedPageOffset(pd *pageDelta) (LSSOffset, bool) {
+	for pd.op == opSwapinDelta {
+		pd = pd.next
+	}
+
+	switch pd.op {
+	case opFlushPageDelta, opRelocPageDelta:
+		return (*flushPageDelta)(unsafe.Pointer(pd)).offset, true
+	case opSwapoutDelta:
+		return (*swapoutDelta)(unsafe.Pointer(pd)).offset, true
+	}
+
+	return 0, false
+}
+
+// decodePageBlock decodes the page written at offset from the block bs.
+// The older segments of the page are read from the log.
+func (s *Plasma) decodePageBlock(offset LSSOffset, bs []byte, ctx *wCtx) (*page, error) {
+	switch getLSSBlockType(bs) {
+	case lssPageData, lssPageReloc, lssPageUpdate:
+	default:
+		return nil, newLSSError("scan", offset, ErrCorruptLog)
+	}
+
+	data, err := s.decompressPageBlock(bs, ctx)
+	if err != nil {
+		return nil, newLSSError("scan", offset, err)
+	}
+
+	pg := newPage2(nil, nil, ctx, ctx.storeCtx, ctx.pgAllocCtx).(*page)
+	next, _, hasChain := pg.unmarshalDelta2(data, ctx, nil)
+	pg.AddFlushRecord(offset, len(bs)-lssBlockTypeSize, 1)
+	if hasChain {
+		rest, _, err := s.readPageSegments(next, ctx, ctx.pgAllocCtx, ctx.storeCtx)
+		if err != nil {
+			return nil, err
+		}
+		pg.Append(rest)
+	}
+
+	return pg, nil
+}
+
+// scanPage calls callback for the items of the page from low on which are
+// visible in the snapshot
+func (s *Plasma) scanPage(pg *page, low unsafe.Pointer, snap *Snapshot,
+	ctx *wCtx, callback ScanCallback) error {
+	var sts pgOpIteratorStats
+	filter := &snFilter{sn: snap.sn}
+	itr := newPgOpIterator(pg.head, s.cmp, low, pg.head.hiItm, filter, ctx, &sts)
+	defer itr.Close()
+
+	for itr.Init(); itr.Valid(); itr.Next() {
+		itm := (*item)(itr.Get().Item())
+		var v []byte
+		if itm.HasValue() {
+			var err error
+			if v, err = s.readValue(itm); err != nil {
+				return err
+			}
+		}
+
+		if err := callback(itm.Key(), v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
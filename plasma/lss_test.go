@@ -2,11 +2,14 @@ package plasma
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"runtime"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -146,6 +149,52 @@ func TestLSSCleaner(t *testing.T) {
 	}
 }
 
+func TestLSSCleanerRegionSelection(t *testing.T) {
+	// Has to go past the first region to reach the threshold
+	regions := []lssRegionInfo{
+		{size: 100, live: 90, age: time.Second * 10},
+		{size: 100, live: 10, age: time.Second * 9},
+		{size: 100, live: 90, age: time.Second},
+	}
+
+	if n := selectCleanRegions(regions, 190, 10); n != 2 {
+		t.Errorf("expected 2 regions, got %d", n)
+	}
+
+	// First region is sufficient, but the next one is cheap to clean
+	regions = []lssRegionInfo{
+		{size: 100, live: 50, age: time.Second * 10},
+		{size: 100, live: 0, age: time.Second * 9},
+		{size: 100, live: 100, age: time.Second},
+	}
+
+	if n := selectCleanRegions(regions, 150, 40); n != 2 {
+		t.Errorf("expected 2 regions, got %d", n)
+	}
+
+	rs := newLSSRegionStats(0)
+	rs.update(0, 0, 10, 100)
+	rs.update(10, 60, lssRegionSize+10, 100)
+	infos := rs.snapshot(0, lssRegionSize*2, 1)
+	if len(infos) != 2 || infos[0].live != 40 || infos[1].live != 100 {
+		t.Errorf("unexpected region stats %+v", infos)
+	}
+
+	// Regions beyond the threshold are picked by cost-benefit anywhere
+	// in the log
+	rs = newLSSRegionStats(0)
+	now := time.Now()
+	for id, live := range []int64{0, lssRegionSize * 9 / 10, lssRegionSize / 4, lssRegionSize / 4, lssRegionSize / 8} {
+		r := rs.region(LSSOffset(int64(id) * lssRegionSize))
+		r.live, r.lastWrite = live, now.Add(-time.Duration(id)*time.Second)
+	}
+
+	ids := rs.fragmentedRegions(0, lssRegionSize*5, 50, 2)
+	if len(ids) != 2 || ids[0] != 4 || ids[1] != 3 {
+		t.Errorf("unexpected fragmented regions %v", ids)
+	}
+}
+
 func TestLSSSuperBlock(t *testing.T) {
 	var wg sync.WaitGroup
 	BufSize := 1024 * 1024
@@ -253,3 +302,614 @@ func TestLSSPerf(t *testing.T) {
 	lss.Close()
 
 }
+
+func TestLSSStallStats(t *testing.T) {
+	os.RemoveAll("test.data")
+	lss, _ := NewLSStore("test.data", segmentSize, 4096, 2, false, 0)
+	defer lss.Close()
+
+	var wg sync.WaitGroup
+	for x := 0; x < 4; x++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				_, _, res := lss.ReserveSpace(1024)
+				lss.FinalizeWrite(res)
+			}
+		}()
+	}
+
+	wg.Wait()
+	lss.Sync(false)
+
+	sts := lss.StallStats()
+	if sts.ReserveStalls == 0 || sts.ReserveStallTime == 0 {
+		t.Errorf("expected reserve stalls to be recorded, got %+v", sts)
+	}
+}
+
+func TestLSSBlockChecksum(t *testing.T) {
+	os.RemoveAll("test.data")
+	lss, err := NewLSStore("test.data", segmentSize, 1024*1024, 2, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var offs []LSSOffset
+	for i := 0; i < 10; i++ {
+		offset, buf, res := lss.ReserveSpace(1024)
+		binary.BigEndian.PutUint64(buf[:8], uint64(i))
+		lss.FinalizeWrite(res)
+		offs = append(offs, offset)
+	}
+	lss.Sync(true)
+
+	// Keep the damaged block out of the last commit, which would
+	// otherwise be truncated as a torn tail
+	for i := 0; i < 10; i++ {
+		_, _, res := lss.ReserveSpace(1024)
+		lss.FinalizeWrite(res)
+	}
+	lss.Sync(true)
+	lss.Close()
+
+	f, err := os.OpenFile(filepath.Join("test.data", fmt.Sprintf(segFileNameFormat, 0)), os.O_RDWR, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0xff}, int64(offs[5])+headerFBSize+100); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	lss, err = NewLSStore("test.data", segmentSize, 1024*1024, 2, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lss.Close()
+
+	buf := make([]byte, 1024*1024)
+	if _, err := lss.Read(offs[4], buf); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	var lssErr *LSSError
+	_, err = lss.Read(offs[5], buf)
+	if !errors.Is(err, ErrBlockCorrupt) || !errors.As(err, &lssErr) || lssErr.Offset != offs[5] {
+		t.Errorf("expected ErrBlockCorrupt at %d, got %v", offs[5], err)
+	}
+
+	visited := 0
+	err = lss.Visitor(func(LSSOffset, []byte) (bool, error) {
+		visited++
+		return true, nil
+	}, buf)
+	if !errors.Is(err, ErrBlockCorrupt) || visited != 5 {
+		t.Errorf("expected visitor to stop at corrupt block, visited %d, err %v", visited, err)
+	}
+}
+
+func TestLSSTornTail(t *testing.T) {
+	os.RemoveAll("test.data")
+	defer os.RemoveAll("test.data")
+
+	open := func() LSS {
+		lss, err := NewLSStore("test.data", segmentSize, 1024*1024, 2, false, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return lss
+	}
+
+	write := func(lss LSS, n int, v byte) (offs []LSSOffset) {
+		for i := 0; i < n; i++ {
+			offset, buf, res := lss.ReserveSpace(1024)
+			buf[0] = v
+			lss.FinalizeWrite(res)
+			offs = append(offs, offset)
+		}
+		lss.Sync(true)
+		return offs
+	}
+
+	segFile := filepath.Join("test.data", fmt.Sprintf(segFileNameFormat, 0))
+	readRange := func(start, end LSSOffset) []byte {
+		f, err := os.Open(segFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		bs := make([]byte, end-start)
+		if _, err := f.ReadAt(bs, int64(start)); err != nil {
+			t.Fatal(err)
+		}
+		return bs
+	}
+
+	writeRange := func(start LSSOffset, bs []byte) {
+		f, err := os.OpenFile(segFile, os.O_RDWR, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		if _, err := f.WriteAt(bs, int64(start)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lss := open()
+	write(lss, 10, 1)
+	offs := write(lss, 10, 2)
+	tail := lss.TailOffset()
+	lss.Close()
+
+	// A complete block of the last commit which fails its checksum is not
+	// taken for a torn write
+	stale := readRange(offs[5], tail)
+	writeRange(offs[5]+headerFBSize, []byte{0xff})
+	if _, err := NewLSStore("test.data", segmentSize, 1024*1024, 2, false, 0); !errors.Is(err, ErrBlockCorrupt) {
+		t.Errorf("expected ErrBlockCorrupt, got %v", err)
+	}
+	writeRange(offs[5], stale)
+
+	// A block of the last commit was not fully written
+	if err := os.Truncate(segFile, int64(offs[5])+headerFBSize+100); err != nil {
+		t.Fatal(err)
+	}
+	lss = open()
+	if lss.TailOffset() != offs[5] || lss.TruncatedBytes() != int64(tail-offs[5]) {
+		t.Errorf("expected tail %d and %d truncated bytes, got %d and %d",
+			offs[5], tail-offs[5], lss.TailOffset(), lss.TruncatedBytes())
+	}
+
+	offs = write(lss, 5, 3)
+	tail = lss.TailOffset()
+	lss.Close()
+
+	// The blocks of the last commit were not written, leaving the valid
+	// blocks of the previous epoch in place
+	writeRange(offs[0], stale)
+	lss = open()
+	defer lss.Close()
+	if lss.TailOffset() != offs[0] || lss.TruncatedBytes() != int64(tail-offs[0]) {
+		t.Errorf("expected tail %d and %d truncated bytes, got %d and %d",
+			offs[0], tail-offs[0], lss.TailOffset(), lss.TruncatedBytes())
+	}
+
+	n := 0
+	buf := make([]byte, 1024*1024)
+	lss.Visitor(func(_ LSSOffset, bs []byte) (bool, error) {
+		if exp := byte(1 + n/10); bs[0] != exp {
+			t.Errorf("block %d: expected %d, got %d", n, exp, bs[0])
+		}
+		n++
+		return true, nil
+	}, buf)
+
+	if n != 15 {
+		t.Errorf("expected 15 blocks, got %d", n)
+	}
+}
+
+func TestLSSInvariantViolation(t *testing.T) {
+	os.RemoveAll("test.data")
+	defer os.RemoveAll("test.data")
+
+	var violation error
+	lss, err := newLSStore("test.data", segmentSize, 1024*1024, 3, false, 0,
+		lssOptions{onInvariant: func(err error) { violation = err }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lss.Close()
+
+	s := lss.(*lsStore)
+
+	_, _, res := s.ReserveSpace(1024)
+	s.FinalizeWrite(res)
+	s.Sync(true)
+	tail := s.log.Tail()
+
+	// Rotate a flush buffer which is no longer the tail, as if it had
+	// been replaced concurrently
+	fb := s.currBuf().NextBuffer()
+	s.initNextBuffer(fb)
+	fb.NextBuffer().Reset()
+	if violation == nil {
+		t.Fatal("expected an invariant violation")
+	}
+
+	// Nothing more is written to the log
+	_, _, res = s.ReserveSpace(1024)
+	s.FinalizeWrite(res)
+	s.Sync(true)
+	if s.log.Tail() != tail {
+		t.Errorf("expected the tail to stay at %d, got %d", tail, s.log.Tail())
+	}
+}
+
+func TestLSSLegacyBlocks(t *testing.T) {
+	os.RemoveAll("test.data")
+	defer os.RemoveAll("test.data")
+
+	open := func() LSS {
+		lss, err := NewLSStore("test.data", segmentSize, 1024*1024, 2, false, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return lss
+	}
+
+	lss := open()
+	lss.Close()
+
+	// Write the blocks as the releases which did not checksum them, whose
+	// header is only the length, and record the log as version 0
+	var legacy []byte
+	for i := 0; i < 10; i++ {
+		var hdr [legacyHeaderFBSize]byte
+		binary.BigEndian.PutUint32(hdr[:], 1024)
+		bs := make([]byte, 1024)
+		bs[0] = byte(i)
+		legacy = append(append(legacy, hdr[:]...), bs...)
+	}
+
+	segFile := filepath.Join("test.data", fmt.Sprintf(segFileNameFormat, 0))
+	if err := os.WriteFile(segFile, legacy, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeLogSB(t, "test.data", logSB{gen: 1, tail: int64(len(legacy))})
+
+	lss = open()
+	var offs []LSSOffset
+	for i := 0; i < 5; i++ {
+		offset, buf, res := lss.ReserveSpace(1024)
+		buf[0] = byte(10 + i)
+		lss.FinalizeWrite(res)
+		offs = append(offs, offset)
+	}
+	lss.Sync(true)
+
+	if v := lssCommittedSB(t, "test.data").version; v != 0 {
+		t.Errorf("expected version 0 until the blocks are rewritten, got %d", v)
+	}
+
+	n := 0
+	buf := make([]byte, 1024*1024)
+	lss.Visitor(func(_ LSSOffset, bs []byte) (bool, error) {
+		if len(bs) != 1024 || bs[0] != byte(n) {
+			t.Errorf("block %d: unexpected length %d or data %d", n, len(bs), bs[0])
+		}
+		n++
+		return true, nil
+	}, buf)
+
+	if n != 15 {
+		t.Errorf("expected 15 blocks, got %d", n)
+	}
+
+	lss.SetSafeTrimCallback(func() LSSOffset { return offs[0] })
+	lss.TrimLog(offs[0])
+	lss.Sync(true)
+	if v := lssCommittedSB(t, "test.data").version; v != logVersion {
+		t.Errorf("expected version %d once the blocks are trimmed, got %d", logVersion, v)
+	}
+	lss.Close()
+
+	lss = open()
+	defer lss.Close()
+	for i, off := range offs {
+		if l, err := lss.Read(off, buf); err != nil || l != 1024 || buf[0] != byte(10+i) {
+			t.Errorf("block %d: unexpected length %d or data %d (err=%v)", i, l, buf[0], err)
+		}
+	}
+}
+
+// lssCommittedTail returns the tail recorded by the last commit of the log
+func lssCommittedTail(t *testing.T, path string) LSSOffset {
+	return LSSOffset(lssCommittedSB(t, path).tail)
+}
+
+// lssCommittedSB returns the superblock written by the last commit of the
+// log
+func lssCommittedSB(t *testing.T, path string) logSB {
+	fd, err := os.Open(filepath.Join(path, headerFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+
+	var buf [logSBSize]byte
+	sb, _, err := readLogSB(fd, buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sb
+}
+
+// writeLogSB replaces the superblock copies of the log with sb
+func writeLogSB(t *testing.T, path string, sb logSB) {
+	fd, err := os.OpenFile(filepath.Join(path, headerFileName), os.O_RDWR, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+
+	var buf [logSBSize]byte
+	marshalLogSB(buf[:], sb)
+	for i := 0; i < logSBCopies; i++ {
+		if _, err := fd.WriteAt(buf[:], int64(logSBSize*i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLSSSyncMode(t *testing.T) {
+	committedTail := func() LSSOffset {
+		return lssCommittedTail(t, "test.data")
+	}
+
+	for _, mode := range []SyncMode{SyncModeAlways, SyncModeOnCommitOnly, SyncModeNever} {
+		os.RemoveAll("test.data")
+		lss, err := newLSStore("test.data", segmentSize, 1024*1024, 2, false, time.Hour, lssOptions{syncMode: mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 10; i++ {
+			_, _, res := lss.ReserveSpace(1024)
+			lss.FinalizeWrite(res)
+		}
+		lss.Sync(false)
+
+		// The first flush after the log is opened is committed on the
+		// interval unless commits have to be requested
+		if tail := committedTail(); (mode == SyncModeOnCommitOnly) == (tail == lss.TailOffset()) {
+			t.Errorf("mode %d: unexpected committed tail %d, tail %d", mode, tail, lss.TailOffset())
+		}
+
+		lss.Commit()
+		if tail := committedTail(); tail != lss.TailOffset() {
+			t.Errorf("mode %d: expected committed tail %d, got %d", mode, lss.TailOffset(), tail)
+		}
+		lss.Close()
+	}
+}
+
+func TestLSSAsyncWrite(t *testing.T) {
+	os.RemoveAll("test.data")
+	lss, err := newLSStore("test.data", segmentSize, 1024*1024, 4, false, time.Hour,
+		lssOptions{syncMode: SyncModeOnCommitOnly})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lss.Close()
+
+	write := func(i int) (LSSOffset, *LSSWrite) {
+		off, buf, res := lss.ReserveSpace(1024)
+		binary.BigEndian.PutUint64(buf[:8], uint64(i))
+		return off, lss.FinalizeWriteAsync(res)
+	}
+
+	var offs []LSSOffset
+	var ws []*LSSWrite
+	for i := 0; i < 10; i++ {
+		off, w := write(i)
+		offs = append(offs, off)
+		ws = append(ws, w)
+	}
+
+	select {
+	case <-ws[0].Done():
+		t.Fatalf("write completed before the flush buffer was written")
+	default:
+	}
+
+	if err := ws[len(ws)-1].Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes sharing the flush buffer complete together
+	for i, w := range ws {
+		select {
+		case <-w.Done():
+			if w.Err() != nil {
+				t.Errorf("write %d failed: %v", i, w.Err())
+			}
+		default:
+			t.Errorf("write %d has not completed", i)
+		}
+	}
+
+	end := lss.BlockEndOffset(offs[len(offs)-1], make([]byte, 1024))
+	if tail := lssCommittedTail(t, "test.data"); tail < end {
+		t.Errorf("expected the writes to be committed upto %d, got %d", end, tail)
+	}
+
+	buf := make([]byte, 1024)
+	for i, off := range offs {
+		if _, err := lss.Read(off, buf); err != nil || binary.BigEndian.Uint64(buf[:8]) != uint64(i) {
+			t.Errorf("unexpected block %d at %d (err=%v)", binary.BigEndian.Uint64(buf[:8]), off, err)
+		}
+	}
+
+	// Writes complete without waiting once their flush buffers fill up
+	ws = ws[:0]
+	for i := 0; i < 4000; i++ {
+		_, w := write(i)
+		ws = append(ws, w)
+	}
+
+	for _, w := range ws[:1000] {
+		select {
+		case <-w.Done():
+		case <-time.After(10 * time.Second):
+			t.Fatalf("write of a full flush buffer did not complete")
+		}
+	}
+
+	if err := ws[len(ws)-1].Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLSSDirectIO(t *testing.T) {
+	os.RemoveAll("test.data")
+	defer os.RemoveAll("test.data")
+
+	// Start with a tail which is not aligned
+	lss, err := newLSStore("test.data", 1024*1024, 64*1024, 2, false, 0, lssOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, res := lss.ReserveSpace(100)
+	lss.FinalizeWrite(res)
+	lss.Sync(true)
+	lss.Close()
+
+	lss, err = newLSStore("test.data", 1024*1024, 64*1024, 2, false, 0, lssOptions{directIO: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var offs []LSSOffset
+	for i := 0; i < 1000; i++ {
+		offset, buf, res := lss.ReserveSpace(lssBlockTypeSize + 8 + i%3000)
+		binary.BigEndian.PutUint16(buf, uint16(lssValue))
+		binary.BigEndian.PutUint64(buf[lssBlockTypeSize:], uint64(i))
+		lss.FinalizeWrite(res)
+		offs = append(offs, offset)
+
+		if i%100 == 0 {
+			lss.Sync(false)
+			if tail := lss.TailOffset(); tail%directIOAlign != 0 {
+				t.Fatalf("expected an aligned tail, got %d", tail)
+			}
+		}
+	}
+	lss.Sync(true)
+	lss.Close()
+
+	lss, err = newLSStore("test.data", 1024*1024, 64*1024, 2, false, 0, lssOptions{directIO: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lss.Close()
+
+	if lss.TruncatedBytes() != 0 {
+		t.Errorf("expected no torn tail, truncated %d bytes", lss.TruncatedBytes())
+	}
+
+	buf := make([]byte, 1024*1024)
+	for i, off := range offs {
+		if _, err := lss.Read(off, buf); err != nil ||
+			binary.BigEndian.Uint64(buf[lssBlockTypeSize:]) != uint64(i) {
+			t.Fatalf("block %d: unexpected read result (err=%v)", i, err)
+		}
+	}
+
+	n := 0
+	err = lss.Visitor(func(_ LSSOffset, bs []byte) (bool, error) {
+		if getLSSBlockType(bs) == lssValue {
+			n++
+		}
+		return true, nil
+	}, buf)
+
+	if err != nil || n != len(offs) {
+		t.Errorf("expected %d blocks, got %d (err=%v)", len(offs), n, err)
+	}
+}
+
+func diskUsage(t *testing.T, dir string) int64 {
+	files, _ := filepath.Glob(filepath.Join(dir, segFilePattern))
+	var blocks int64
+	for _, f := range files {
+		var st syscall.Stat_t
+		if err := syscall.Stat(f, &st); err != nil {
+			t.Fatal(err)
+		}
+		blocks += st.Blocks
+	}
+
+	return blocks * 512
+}
+
+func TestLSSDropRange(t *testing.T) {
+	os.RemoveAll("test.data")
+	defer os.RemoveAll("test.data")
+
+	lss, err := newLSStore("test.data", segmentSize, 1024*1024, 2, false, 0, lssOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var offs []LSSOffset
+	for i := 0; i < 3000; i++ {
+		offset, buf, res := lss.ReserveSpace(lssBlockTypeSize + 10000)
+		binary.BigEndian.PutUint16(buf, uint16(lssValue))
+		binary.BigEndian.PutUint64(buf[lssBlockTypeSize:], uint64(i))
+		lss.FinalizeWrite(res)
+		offs = append(offs, offset)
+	}
+	lss.Sync(true)
+
+	start, end, ok := lss.RegionRange(1)
+	if !ok || int64(start) < lssRegionSize || int64(end) < 2*lssRegionSize {
+		t.Fatalf("unexpected range of region 1 [%d, %d) (ok=%v)", start, end, ok)
+	}
+
+	used, disk := lss.UsedSpace(), diskUsage(t, "test.data")
+	if ok, err := lss.DropRange(start, end); !ok || err != nil {
+		t.Fatalf("unable to drop range (ok=%v, err=%v)", ok, err)
+	}
+
+	if _, _, ok := lss.RegionRange(1); ok {
+		t.Errorf("expected dropped region to be unavailable")
+	}
+
+	if got := used - lss.UsedSpace(); got != int64(end-start) {
+		t.Errorf("expected used space to shrink by %d, got %d", end-start, got)
+	}
+
+	if freed := disk - diskUsage(t, "test.data"); freed < int64(end-start)-2*4096 {
+		t.Errorf("expected %d bytes to be freed on disk, got %d", end-start, freed)
+	}
+
+	buf := make([]byte, 1024*1024)
+	if _, err := lss.Read(start, buf); !errors.Is(err, ErrLogTrimmed) {
+		t.Errorf("expected %v reading a dropped block, got %v", ErrLogTrimmed, err)
+	}
+	lss.Close()
+
+	lss, err = newLSStore("test.data", segmentSize, 1024*1024, 2, false, 0, lssOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lss.Close()
+
+	var expected []uint64
+	for i, off := range offs {
+		if off < start || off >= end {
+			expected = append(expected, uint64(i))
+		}
+	}
+
+	var got []uint64
+	err = lss.Visitor(func(_ LSSOffset, bs []byte) (bool, error) {
+		got = append(got, binary.BigEndian.Uint64(bs[lssBlockTypeSize:]))
+		return true, nil
+	}, buf)
+
+	if err != nil || fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected %d blocks outside of the dropped range, got %d (err=%v)",
+			len(expected), len(got), err)
+	}
+
+	if got := used - lss.UsedSpace(); got != int64(end-start) {
+		t.Errorf("expected dropped range to be found on reopen, used space shrunk by %d", got)
+	}
+}
@@ -0,0 +1,45 @@
+package plasma
+
+import (
+	"sync/atomic"
+)
+
+// PauseMaintenance stops the LSS cleaner, the value log cleaner and the
+// swapper from starting new work, e.g. to avoid background IO during peak
+// traffic or while a storage snapshot is taken. It returns once the work
+// in progress has completed. A cleaner pass in progress stops at the next
+// block. Explicit calls such as CleanLSS and EvictAll are not affected.
+// Writers are not throttled while the swapper is paused, so memory may
+// exceed the quota.
+func (s *Plasma) PauseMaintenance() {
+	atomic.StoreInt32(&s.maintenancePaused, 1)
+	s.maintenanceLock.Lock()
+	s.maintenanceLock.Unlock()
+}
+
+// ResumeMaintenance lets the background daemons paused by PauseMaintenance
+// run again
+func (s *Plasma) ResumeMaintenance() {
+	atomic.StoreInt32(&s.maintenancePaused, 0)
+}
+
+// IsMaintenancePaused returns true if the background daemons are paused
+func (s *Plasma) IsMaintenancePaused() bool {
+	return atomic.LoadInt32(&s.maintenancePaused) == 1
+}
+
+// beginMaintenance returns true if a daemon may start a unit of work, which
+// has to be completed with endMaintenance
+func (s *Plasma) beginMaintenance() bool {
+	s.maintenanceLock.RLock()
+	if s.IsMaintenancePaused() {
+		s.maintenanceLock.RUnlock()
+		return false
+	}
+
+	return true
+}
+
+func (s *Plasma) endMaintenance() {
+	s.maintenanceLock.RUnlock()
+}
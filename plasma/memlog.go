@@ -0,0 +1,209 @@
+package plasma
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Upper bound on the segments of an in-memory log, so that the default
+// LSS segment size of a few GB is not allocated upfront
+const memLogMaxSegmentSize = 4 * 1024 * 1024
+
+// memLog is a Log which keeps its segments in memory. It is used by
+// instances configured with InMemoryLog and does not survive them.
+type memLog struct {
+	sync.RWMutex
+	segSize    int64
+	segs       map[int64][]byte
+	head, tail int64
+	trimOffset int64
+}
+
+func openMemLog(path string, opts LogOptions) (Log, error) {
+	if opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+
+	segSize := opts.SegmentSize
+	if segSize <= 0 || segSize > memLogMaxSegmentSize {
+		segSize = memLogMaxSegmentSize
+	}
+
+	return &memLog{
+		segSize: segSize,
+		segs:    make(map[int64][]byte),
+	}, nil
+}
+
+// reset empties the log, which starts at the offset
+func (l *memLog) reset(offset int64) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.segs = make(map[int64][]byte)
+	l.head, l.tail, l.trimOffset = offset, offset, offset
+}
+
+func (l *memLog) Head() int64 {
+	l.RLock()
+	defer l.RUnlock()
+	return l.head
+}
+
+func (l *memLog) Tail() int64 {
+	l.RLock()
+	defer l.RUnlock()
+	return l.tail
+}
+
+func (l *memLog) Read(bs []byte, off int64) error {
+	l.RLock()
+	defer l.RUnlock()
+
+	if off < l.head || off+int64(len(bs)) > l.tail {
+		return fmt.Errorf("Log range is [%d, %d), trying to read %d bytes at %d: %w",
+			l.head, l.tail, len(bs), off, ErrCorruptLog)
+	}
+
+	for len(bs) > 0 {
+		n := l.segSize - off%l.segSize
+		if n > int64(len(bs)) {
+			n = int64(len(bs))
+		}
+
+		// Segments freed by PunchHole read back as zeros
+		if seg, ok := l.segs[off/l.segSize]; ok {
+			copy(bs[:n], seg[off%l.segSize:])
+		} else {
+			memclr(bs[:n])
+		}
+		bs, off = bs[n:], off+n
+	}
+
+	return nil
+}
+
+func (l *memLog) Append(bs []byte) error {
+	l.Lock()
+	defer l.Unlock()
+
+	for len(bs) > 0 {
+		id := l.tail / l.segSize
+		seg, ok := l.segs[id]
+		if !ok {
+			seg = make([]byte, l.segSize)
+			l.segs[id] = seg
+		}
+
+		n := copy(seg[l.tail%l.segSize:], bs)
+		bs, l.tail = bs[n:], l.tail+int64(n)
+	}
+
+	return nil
+}
+
+func (l *memLog) WriteAt(bs []byte, off int64) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if off < l.head || off+int64(len(bs)) > l.tail {
+		return fmt.Errorf("Log range is [%d, %d), trying to write %d bytes at %d: %w",
+			l.head, l.tail, len(bs), off, ErrCorruptLog)
+	}
+
+	for len(bs) > 0 {
+		id := off / l.segSize
+		seg, ok := l.segs[id]
+		if !ok {
+			seg = make([]byte, l.segSize)
+			l.segs[id] = seg
+		}
+
+		n := copy(seg[off%l.segSize:], bs)
+		bs, off = bs[n:], off+int64(n)
+	}
+
+	return nil
+}
+
+// PunchHole frees the segments within the range and clears the rest
+func (l *memLog) PunchHole(start, end int64) error {
+	l.Lock()
+	defer l.Unlock()
+
+	for off := start; off < end; {
+		id := off / l.segSize
+		segEnd := (id + 1) * l.segSize
+		if off == id*l.segSize && segEnd <= end {
+			delete(l.segs, id)
+		} else if seg, ok := l.segs[id]; ok {
+			memclr(seg[off%l.segSize : minInt64(segEnd, end)-id*l.segSize])
+		}
+		off = segEnd
+	}
+
+	return nil
+}
+
+func (l *memLog) Trim(offset int64) {
+	l.Lock()
+	defer l.Unlock()
+
+	if offset > l.trimOffset && offset <= l.tail {
+		l.trimOffset = offset
+	}
+}
+
+// Commit applies the last trim and frees the segments before the head
+func (l *memLog) Commit() error {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.trimOffset > l.head {
+		for id := l.head / l.segSize; id < l.trimOffset/l.segSize; id++ {
+			delete(l.segs, id)
+		}
+		l.head = l.trimOffset
+	}
+
+	return nil
+}
+
+func (l *memLog) CommitNoSync() error {
+	return l.Commit()
+}
+
+func (l *memLog) Size() int64 {
+	l.RLock()
+	defer l.RUnlock()
+	return l.tail - l.head
+}
+
+func (l *memLog) Close() error {
+	l.Lock()
+	defer l.Unlock()
+	l.segs = nil
+	return nil
+}
+
+// The log cannot be torn since it is never reopened
+func (l *memLog) Epoch() int64 {
+	return 0
+}
+
+func (l *memLog) LastCommit() (int64, int64) {
+	return 0, 0
+}
+
+func (l *memLog) Truncate(offset int64) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if offset < l.head || offset > l.tail {
+		return fmt.Errorf("Log range is [%d, %d), trying to truncate at %d: %w",
+			l.head, l.tail, offset, ErrCorruptLog)
+	}
+
+	l.tail = offset
+	return nil
+}
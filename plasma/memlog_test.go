@@ -0,0 +1,101 @@
+package plasma
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestMemLog(t *testing.T) {
+	log, _ := openMemLog("", LogOptions{SegmentSize: 1024})
+	l := log.(*memLog)
+
+	bs := make([]byte, 3000)
+	for i := range bs {
+		bs[i] = byte(i)
+	}
+
+	for i := 0; i < 4; i++ {
+		l.Append(bs)
+	}
+
+	buf := make([]byte, len(bs))
+	if err := l.Read(buf, 6000); err != nil || !bytes.Equal(buf, bs) {
+		t.Fatalf("read mismatch (err=%v)", err)
+	}
+
+	l.Trim(6000)
+	if len(l.segs) != 12 || l.Head() != 0 {
+		t.Errorf("expected trim to wait for commit, got %d segments", len(l.segs))
+	}
+
+	l.Commit()
+	if len(l.segs) != 7 || l.Head() != 6000 || l.Size() != 6000 {
+		t.Errorf("expected 7 segments of [6000, 12000), got %d of [%d, %d)",
+			len(l.segs), l.Head(), l.Tail())
+	}
+
+	if err := l.Read(buf, 3000); err == nil {
+		t.Errorf("expected error reading trimmed range")
+	}
+}
+
+func TestPlasmaInMemoryLog(t *testing.T) {
+	os.Remove(checkpointFileName)
+	cfg := testSnCfg
+	cfg.File = ""
+	cfg.InMemoryLog = true
+	cfg.AutoSwapper = false
+	s := newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	w := s.NewWriter()
+	for i := 0; i < 10000; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte(fmt.Sprintf("val-%10d", i)))
+		if i == 4999 {
+			snap := s.NewSnapshot()
+			s.CreateRecoveryPoint(snap, nil)
+		}
+	}
+
+	s.EvictAll(0)
+	if s.GetStats().NumRecordSwapOut == 0 {
+		t.Errorf("expected pages to be evicted to the in-memory log")
+	}
+
+	for i := 0; i < 10000; i++ {
+		k := fmt.Sprintf("key-%10d", i)
+		if v, err := w.LookupKV([]byte(k)); err != nil || string(v) != fmt.Sprintf("val-%10d", i) {
+			t.Fatalf("%s: unexpected value %q (err=%v)", k, v, err)
+		}
+	}
+
+	rps := s.GetRecoveryPoints()
+	if len(rps) != 1 {
+		t.Fatalf("expected 1 recovery point, got %d", len(rps))
+	}
+
+	snap, err := s.Rollback(rps[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+
+	count := 0
+	itr := snap.NewIterator()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		count++
+	}
+	itr.Close()
+
+	if count != 5000 {
+		t.Errorf("expected 5000 items after rollback, got %d", count)
+	}
+
+	if err := s.Checkpoint(); err != nil {
+		t.Error(err)
+	} else if _, err := os.Stat(checkpointFileName); !os.IsNotExist(err) {
+		t.Errorf("expected no checkpoint file, got %v", err)
+	}
+}
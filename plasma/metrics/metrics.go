@@ -0,0 +1,185 @@
+// Package metrics exports the statistics of plasma instances as expvar
+// variables and prometheus collectors. Every numeric field of plasma.Stats
+// is exported under its snake_case name and values are refreshed from
+// GetStats whenever they are read or scraped. The buckets of histograms
+// such as plasma.Pow2Histogram are exported with the bucket index appended,
+// e.g. chain_len_hist_bucket_3. The fields tagged with metric:"counter" are
+// exported as prometheus counters and the others as gauges. Collectors read
+// the stats of sources which can reset them, such as *plasma.Plasma, using
+// GetCumulativeStats, so that the counters never decrease.
+package metrics
+
+import (
+	"expvar"
+	"fmt"
+	"github.com/couchbase/nitro/plasma"
+	"github.com/prometheus/client_golang/prometheus"
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+const namespace = "plasma"
+
+// StatsSource provides the statistics of an instance, e.g. *plasma.Plasma
+type StatsSource interface {
+	GetStats() plasma.Stats
+}
+
+// cumulativeStats returns the stats of src with the counters unaffected by
+// resets if src provides them
+func cumulativeStats(src StatsSource) plasma.Stats {
+	if c, ok := src.(interface {
+		GetCumulativeStats() plasma.Stats
+	}); ok {
+		return c.GetCumulativeStats()
+	}
+
+	return src.GetStats()
+}
+
+// Metric is a single named statistic value
+type Metric struct {
+	Name  string
+	Value float64
+	// Set for the statistics which only increase, e.g. operation counts
+	// and total stall times
+	Counter bool
+}
+
+// Metrics returns all numeric fields of sts. Fields of nested structs are
+// prefixed with the name of the struct field.
+func Metrics(sts plasma.Stats) []Metric {
+	return appendMetrics(nil, "", reflect.ValueOf(sts))
+}
+
+func appendMetrics(ms []Metric, prefix string, v reflect.Value) []Metric {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := v.Field(i)
+		name := prefix + snakeCase(t.Field(i).Name)
+		counter := t.Field(i).Tag.Get("metric") == "counter"
+		switch f.Kind() {
+		case reflect.Array:
+			for j := 0; j < f.Len(); j++ {
+				if value, ok := numericValue(f.Index(j)); ok {
+					ms = append(ms, Metric{Name: fmt.Sprintf("%s_bucket_%d", name, j),
+						Value: value, Counter: counter})
+				}
+			}
+		case reflect.Struct:
+			ms = appendMetrics(ms, name+"_", f)
+		default:
+			if value, ok := numericValue(f); ok {
+				ms = append(ms, Metric{Name: name, Value: value, Counter: counter})
+			}
+		}
+	}
+
+	return ms
+}
+
+func numericValue(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+
+	return 0, false
+}
+
+// snakeCase converts a Go identifier to snake_case keeping acronyms
+// together, e.g. NumLSSReads becomes num_lss_reads
+func snakeCase(s string) string {
+	var b strings.Builder
+	rs := []rune(s)
+	for i, r := range rs {
+		if unicode.IsUpper(r) && i > 0 {
+			prevLower := unicode.IsLower(rs[i-1]) || unicode.IsDigit(rs[i-1])
+			nextLower := i+1 < len(rs) && unicode.IsLower(rs[i+1])
+			if prevLower || (nextLower && unicode.IsUpper(rs[i-1])) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+
+	return b.String()
+}
+
+// PublishExpvar publishes the statistics of an instance as an expvar map
+// with the given name. The name must be unique within the process.
+func PublishExpvar(name string, src StatsSource) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		m := make(map[string]float64)
+		for _, metric := range Metrics(src.GetStats()) {
+			m[metric.Name] = metric.Value
+		}
+
+		return m
+	}))
+}
+
+// Collector is a prometheus collector for the statistics of an instance.
+// The instance name is attached to all metrics as the instance label.
+type Collector struct {
+	src   StatsSource
+	descs map[string]*prometheus.Desc
+}
+
+// NewCollector returns a collector which can be registered with a
+// prometheus registry
+func NewCollector(instance string, src StatsSource) *Collector {
+	c := &Collector{
+		src:   src,
+		descs: make(map[string]*prometheus.Desc),
+	}
+
+	labels := prometheus.Labels{"instance": instance}
+	for _, metric := range Metrics(plasma.Stats{}) {
+		c.descs[metric.Name] = prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", metric.Name),
+			"Plasma statistic "+metric.Name, nil, labels)
+	}
+
+	return c
+}
+
+// Describe implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range c.descs {
+		ch <- desc
+	}
+}
+
+// Collect implements prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	for _, metric := range Metrics(cumulativeStats(c.src)) {
+		typ := prometheus.GaugeValue
+		if metric.Counter {
+			typ = prometheus.CounterValue
+		}
+
+		ch <- prometheus.MustNewConstMetric(c.descs[metric.Name], typ, metric.Value)
+	}
+}
+
+// Register publishes the statistics of an instance using both expvar and
+// the prometheus registerer. Nothing is published if the name is taken by
+// an expvar variable or the registerer rejects the collector.
+func Register(name string, src StatsSource, reg prometheus.Registerer) error {
+	if expvar.Get(name) != nil {
+		return fmt.Errorf("expvar %s is already published", name)
+	}
+
+	if err := reg.Register(NewCollector(name, src)); err != nil {
+		return err
+	}
+
+	PublishExpvar(name, src)
+	return nil
+}
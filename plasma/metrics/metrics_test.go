@@ -0,0 +1,177 @@
+package metrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"github.com/couchbase/nitro/plasma"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"testing"
+)
+
+type testSource struct {
+	sts plasma.Stats
+}
+
+func (s *testSource) GetStats() plasma.Stats {
+	return s.sts
+}
+
+// resetSource returns the counters since the last reset from GetStats
+type resetSource struct {
+	testSource
+	cumulative plasma.Stats
+}
+
+func (s *resetSource) GetCumulativeStats() plasma.Stats {
+	return s.cumulative
+}
+
+func TestSnakeCase(t *testing.T) {
+	cases := map[string]string{
+		"Compacts":         "compacts",
+		"NumLSSReads":      "num_lss_reads",
+		"LSSFrag":          "lss_frag",
+		"MemSzIndex":       "mem_sz_index",
+		"NumRecordSwapOut": "num_record_swap_out",
+	}
+
+	for in, exp := range cases {
+		if got := snakeCase(in); got != exp {
+			t.Errorf("expected %s for %s, got %s", exp, in, got)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	var sts plasma.Stats
+	sts.Inserts = 10
+	sts.LSSFrag = 30
+	sts.ResidentRatio = 0.5
+	sts.LSSStalls.SyncStalls = 2
+	sts.ChainLenHist[3] = 4
+
+	ms := make(map[string]Metric)
+	for _, m := range Metrics(sts) {
+		ms[m.Name] = m
+	}
+
+	exp := map[string]Metric{
+		"inserts":                 {Value: 10, Counter: true},
+		"lss_frag":                {Value: 30},
+		"resident_ratio":          {Value: 0.5},
+		"lss_stalls_sync_stalls":  {Value: 2, Counter: true},
+		"write_amp":               {Value: 0},
+		"mem_sz":                  {Value: 0},
+		"throttle_stall_time":     {Value: 0, Counter: true},
+		"chain_len_hist_bucket_3": {Value: 4, Counter: true},
+	}
+
+	for name, m := range exp {
+		if got, ok := ms[name]; !ok || got.Value != m.Value || got.Counter != m.Counter {
+			t.Errorf("expected %s = %v (counter %v), got %v (counter %v)",
+				name, m.Value, m.Counter, got.Value, got.Counter)
+		}
+	}
+}
+
+func TestExpvar(t *testing.T) {
+	src := new(testSource)
+	PublishExpvar("plasma_test_expvar", src)
+	src.sts.Inserts = 42
+
+	m := make(map[string]float64)
+	if err := json.Unmarshal([]byte(expvar.Get("plasma_test_expvar").String()), &m); err != nil {
+		t.Fatal(err)
+	}
+
+	if m["inserts"] != 42 {
+		t.Errorf("expected refreshed inserts, got %v", m["inserts"])
+	}
+}
+
+func TestCollector(t *testing.T) {
+	c := NewCollector("test", new(testSource))
+
+	descs := make(chan *prometheus.Desc, 1000)
+	c.Describe(descs)
+	close(descs)
+
+	metrics := make(chan prometheus.Metric, 1000)
+	c.Collect(metrics)
+	close(metrics)
+
+	if len(descs) == 0 || len(descs) != len(metrics) {
+		t.Errorf("expected a metric for every description (%d != %d)", len(descs), len(metrics))
+	}
+
+	counters := 0
+	for metric := range metrics {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+
+		if m.Counter != nil {
+			counters++
+		} else if m.Gauge == nil {
+			t.Errorf("expected a counter or a gauge, got %v", metric.Desc())
+		}
+	}
+
+	if counters == 0 || counters == len(descs) {
+		t.Errorf("expected both counters and gauges, got %d counters of %d", counters, len(descs))
+	}
+}
+
+func TestCollectorReset(t *testing.T) {
+	src := new(resetSource)
+	src.cumulative.Inserts = 100
+	src.sts.Inserts = 10
+	c := NewCollector("test", src)
+
+	metrics := make(chan prometheus.Metric, 1000)
+	c.Collect(metrics)
+	close(metrics)
+
+	desc := c.descs["inserts"].String()
+	for metric := range metrics {
+		if metric.Desc().String() != desc {
+			continue
+		}
+
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+
+		if m.Counter.GetValue() != 100 {
+			t.Errorf("expected the inserts counted regardless of resets, got %v", m.Counter.GetValue())
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	if err := Register("plasma_test_register", new(testSource), reg); err != nil {
+		t.Fatal(err)
+	}
+
+	// Registering again fails rather than panicking
+	if err := Register("plasma_test_register", new(testSource), reg); err == nil {
+		t.Errorf("expected the second registration to fail")
+	}
+
+	// Nothing is published if the collector is rejected
+	if err := reg.Register(NewCollector("plasma_test_register2", new(testSource))); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Register("plasma_test_register2", new(testSource), reg); err == nil {
+		t.Errorf("expected a collector with the same metrics to be rejected")
+	}
+
+	if expvar.Get("plasma_test_register2") != nil {
+		t.Errorf("expected no expvar to be published for a rejected collector")
+	}
+}
@@ -1,14 +1,25 @@
 package plasma
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"hash/crc32"
+	"math"
+	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
 var ErrItemNotFound = errors.New("item not found")
 var ErrItemNoValue = errors.New("item has no value")
+var ErrRecoveryPointNotFound = errors.New("recovery point not found")
+var ErrRecoveryPointExists = errors.New("recovery point already exists")
+var ErrRecoveryPointName = errors.New("recovery point name is too long")
+
+// Names are persisted with a 16 bit length
+const maxRecoveryPointNameLen = math.MaxUint16
 
 type Snapshot struct {
 	sn       uint64
@@ -17,14 +28,26 @@ type Snapshot struct {
 	db       *Plasma
 
 	count     int64
+	keySum    uint64
 	persisted bool
 	meta      []byte
+
+	// Tail of the log when the snapshot was sealed. The pages holding items
+	// newer than the snapshot are written past it.
+	offset LSSOffset
 }
 
 func (sn *Snapshot) Count() int64 {
 	return sn.count
 }
 
+// keyChecksum is the contribution of a key to the checksum of the keys of
+// a snapshot, which is the sum of the contributions of its items, so that
+// it can be updated as items are inserted and deleted in any order
+func keyChecksum(k []byte) uint64 {
+	return uint64(crc32.Checksum(k, crc32cTable))
+}
+
 type rollbackSn struct {
 	start, end uint64
 }
@@ -84,6 +107,36 @@ func (f *snFilter) Process(o PageItem) PageItemsList {
 	return o
 }
 
+// Used by change streams and incremental backups to find the latest
+// version of the items changed after a sequence number. Unlike snFilter, deletes are returned.
+type changeFilter struct {
+	snFilter
+	since uint64
+	last  *item
+}
+
+func (f *changeFilter) Process(o PageItem) PageItemsList {
+	if f.rollbackFilter.Process(o) == nilPageItemsList {
+		return nilPageItemsList
+	}
+
+	itm := (*item)(o.Item())
+	if itm.Sn() > f.sn {
+		return nilPageItemsList
+	}
+
+	// Older versions follow the latest version of an item
+	if f.last != nil && bytes.Equal(f.last.Key(), itm.Key()) {
+		return nilPageItemsList
+	}
+
+	if f.last = itm; itm.Sn() <= f.since {
+		return nilPageItemsList
+	}
+
+	return o
+}
+
 // Used by page compactor to GC dead snapshot items
 type gcFilter struct {
 	snIntervals []uint64
@@ -160,12 +213,58 @@ func (itr *MVCCIterator) Seek(k []byte) {
 	itr.Iterator.Seek(itm)
 }
 
+// SeekLT positions the iterator at the last key less than k
+func (itr *MVCCIterator) SeekLT(k []byte) {
+	itr.Iterator.SeekLT(itr.boundItem(k))
+}
+
+// SetEndKey sets an inclusive upper bound key for the iterator
+func (itr *MVCCIterator) SetEndKey(k []byte) {
+	itr.Iterator.SetEndKey(itr.boundItem(k))
+}
+
+// SetBounds restricts the iterator to keys within [start, end]
+func (itr *MVCCIterator) SetBounds(start, end []byte) {
+	itr.Iterator.SetBounds(itr.boundItem(start), itr.boundItem(end))
+}
+
+func (itr *MVCCIterator) boundItem(k []byte) unsafe.Pointer {
+	if k == nil {
+		return nil
+	}
+
+	return unsafe.Pointer(itr.snap.db.newItem(k, nil, 0, false, nil))
+}
+
 func (itr *MVCCIterator) Key() []byte {
 	return (*item)(itr.Get()).Key()
 }
 
+// Value returns the value of the current item. It returns nil if the
+// value cannot be read from the value log, use ReadValue to get the error.
 func (itr *MVCCIterator) Value() []byte {
-	return (*item)(itr.Get()).Value()
+	v, _ := itr.ReadValue()
+	return v
+}
+
+// ReadValue returns the value of the current item along with the error
+// encountered while reading it from the value log. It returns nil in the
+// keys only mode.
+func (itr *MVCCIterator) ReadValue() ([]byte, error) {
+	if itr.keysOnly {
+		return nil, nil
+	}
+
+	return itr.store.readValue((*item)(itr.Get()))
+}
+
+// SetKeysOnly sets whether the iterator only reads the keys of the items,
+// e.g. for existence checks and key range audits. Values are not read from
+// the value log and pages read from the LSS are used for the scan without
+// being swapped in, so that their values are neither copied into the cache
+// nor fetched ahead of the scan.
+func (itr *MVCCIterator) SetKeysOnly(keysOnly bool) {
+	itr.keysOnly = keysOnly
 }
 
 func (itr *MVCCIterator) Close() {
@@ -174,6 +273,41 @@ func (itr *MVCCIterator) Close() {
 	itr.EndTx(itr.token)
 }
 
+// Refresh moves the iterator to the latest snapshot and repositions it at
+// the current key, or at the following key in the iteration order if the
+// current key is not part of the latest snapshot. Long running scans can
+// refresh periodically so that they do not hold back garbage collection
+// of the items superseded since the scan started.
+func (itr *MVCCIterator) Refresh() error {
+	var key []byte
+	valid := itr.Valid()
+	if valid {
+		key = append([]byte(nil), itr.Key()...)
+	}
+
+	// Pages read within the current transaction are released with it
+	itr.Iterator.Close()
+	itr.EndTx(itr.token)
+
+	snap := itr.snap.db.NewSnapshot()
+	itr.snap.Close()
+	itr.snap = snap
+	itr.filter = &snFilter{
+		sn: snap.sn,
+	}
+	itr.token = itr.BeginTx()
+
+	if !valid {
+		return nil
+	}
+
+	if itr.reverse {
+		return itr.seekPrev(itr.boundItem(key), true)
+	}
+
+	return itr.seek(itr.boundItem(key))
+}
+
 func (s *Snapshot) NewIterator() *MVCCIterator {
 	s.Open()
 	itr := s.db.NewIterator().(*Iterator)
@@ -189,6 +323,66 @@ func (s *Snapshot) NewIterator() *MVCCIterator {
 	}
 }
 
+// ParallelScan calls cb for the items of the snapshot using concurr
+// goroutines, each of which scans a range of keys holding roughly the same
+// number of items. The items of a range are passed in key order, while
+// the ranges are scanned concurrently. An item is only valid during the
+// callback. The scan stops at the first error returned by cb or by an
+// iterator, which is returned.
+func (s *Snapshot) ParallelScan(concurr int, cb func(itm unsafe.Pointer) error) error {
+	var wg sync.WaitGroup
+	var failed int32
+
+	ranges := s.db.SplitRange(nil, nil, concurr)
+	errs := make([]error, len(ranges))
+	for i, r := range ranges {
+		wg.Add(1)
+		go func(i int, r KeyRange) {
+			defer wg.Done()
+			if errs[i] = s.scanRange(r, cb, &failed); errs[i] != nil {
+				atomic.StoreInt32(&failed, 1)
+			}
+		}(i, r)
+	}
+
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// scanRange calls cb for the items of the snapshot in [r.Low, r.High)
+// until failed is set
+func (s *Snapshot) scanRange(r KeyRange, cb func(itm unsafe.Pointer) error, failed *int32) error {
+	itr := s.NewIterator()
+	defer itr.Close()
+
+	var err error
+	if r.Low == nil {
+		err = itr.Iterator.SeekFirst()
+	} else {
+		err = itr.Iterator.Seek(r.Low)
+	}
+
+	for ; err == nil && itr.Valid(); err = itr.Next() {
+		if r.High != nil && s.db.cmp(itr.Get(), r.High) >= 0 {
+			break
+		} else if atomic.LoadInt32(failed) == 1 {
+			return nil
+		}
+
+		if err = cb(itr.Get()); err != nil {
+			return err
+		}
+	}
+
+	return err
+}
+
 func (s *Snapshot) Open() {
 	atomic.AddInt32(&s.refCount, 1)
 }
@@ -206,6 +400,9 @@ func (s *Plasma) newSnapshot() (snap *Snapshot) {
 	}
 
 	snap = s.currSnapshot
+	if s.shouldPersist {
+		snap.offset = s.lss.TailOffset()
+	}
 
 	nextSnap := &Snapshot{
 		sn:       atomic.AddUint64(&s.currSn, 1),
@@ -227,11 +424,12 @@ func (s *Plasma) newSnapshot() (snap *Snapshot) {
 
 		}
 
-		s.itemsCount += w.count
-		w.count = 0
+		s.itemsCount += atomic.SwapInt64(&w.count, 0)
+		s.itemsKeySum += atomic.SwapUint64(&w.keySum, 0)
 	}
 
 	snap.count = s.itemsCount
+	snap.keySum = s.itemsKeySum
 	s.FreeObjects(smrList)
 
 	return
@@ -239,21 +437,62 @@ func (s *Plasma) newSnapshot() (snap *Snapshot) {
 
 func (w *Writer) InsertKV(k, v []byte) error {
 	sn := atomic.LoadUint64(&w.currSn)
-	itmBuf := w.GetBuffer(bufTempItem)
-	itm := w.newItem(k, v, sn, false, itmBuf)
-	w.count++
-	return w.Insert(unsafe.Pointer(itm))
+	itm, err := w.newKVItem(k, v, sn, w.GetBuffer(bufKVItem))
+	if err != nil {
+		return err
+	}
+
+	// Only a new key is counted, not a new version of a live item
+	live, err := w.upsertLive(unsafe.Pointer(itm))
+	if err == nil && !live {
+		atomic.AddInt64(&w.count, 1)
+		atomic.AddUint64(&w.keySum, keyChecksum(k))
+	}
+
+	return err
 }
 
 func (w *Writer) DeleteKV(k []byte) error {
+	if len(k) > maxKeySize {
+		return ErrKeyTooLarge
+	}
+
 	sn := atomic.LoadUint64(&w.currSn)
-	itmBuf := w.GetBuffer(bufTempItem)
+	itmBuf := w.GetBuffer(bufKVItem)
 	itm := w.newItem(k, nil, sn, true, itmBuf)
-	w.count--
-	return w.Insert(unsafe.Pointer(itm))
+	live, err := w.upsertLive(unsafe.Pointer(itm))
+	if err == nil && live {
+		atomic.AddInt64(&w.count, -1)
+		atomic.AddUint64(&w.keySum, -keyChecksum(k))
+	}
+
+	return err
+}
+
+// upsertLive inserts itm and returns whether the item it replaced held a
+// value rather than recording its deletion. The replaced item is only
+// inspected within the page update.
+func (w *Writer) upsertLive(itm unsafe.Pointer) (live bool, err error) {
+	_, _, err = w.updateIf(itm, opInsertDelta, func(curr unsafe.Pointer) bool {
+		live = curr != nil && (*item)(curr).IsInsert()
+		return true
+	})
+	return
 }
 
 func (w *Writer) LookupKV(k []byte) ([]byte, error) {
+	if len(k) > maxKeySize {
+		return nil, ErrKeyTooLarge
+	}
+
+	// Keep the value log from being trimmed until the value is read
+	if w.vlog != nil && w.vlogSafeOffset == expiredLSSOffset {
+		w.vlogSafeOffset = w.vlog.HeadOffset()
+		defer func() {
+			w.vlogSafeOffset = expiredLSSOffset
+		}()
+	}
+
 	itmBuf := w.GetBuffer(bufTempItem)
 	itm := w.newItem(k, nil, 0, false, itmBuf)
 	o, err := w.Lookup(unsafe.Pointer(itm))
@@ -268,24 +507,48 @@ func (w *Writer) LookupKV(k []byte) ([]byte, error) {
 	}
 
 	if itm.HasValue() {
-		return itm.Value(), nil
+		return w.readValue(itm)
 	}
 
 	return nil, ErrItemNoValue
 }
 
 type RecoveryPoint struct {
-	sn    uint64
-	count int64
-	meta  []byte
+	sn     uint64
+	count  int64
+	keySum uint64
+	// Set if keySum was recorded, which it is not for the recovery points
+	// created by older versions
+	hasKeySum bool
+	name      string
+	created   time.Time
+	meta      []byte
+
+	// Tail of the log when the snapshot of the recovery point was sealed,
+	// from which the pages changed since are found. It is not set for the
+	// recovery points created by older versions or applied from another log.
+	offset    LSSOffset
+	hasOffset bool
 }
 
 func (rp *RecoveryPoint) Meta() []byte {
 	return rp.meta
 }
 
+// Name returns the name given to a recovery point by
+// CreateNamedRecoveryPoint
+func (rp *RecoveryPoint) Name() string {
+	return rp.name
+}
+
+// CreatedAt returns the creation time of a recovery point. It is zero for
+// recovery points created before creation times were recorded.
+func (rp *RecoveryPoint) CreatedAt() time.Time {
+	return rp.created
+}
+
 func (s *Plasma) updateRecoveryPoints(rps []*RecoveryPoint) {
-	if s.shouldPersist {
+	if s.shouldPersist && !s.readOnly {
 		version := s.rpVersion + 1
 		bs := marshalRPs(rps, version)
 		_, wbuf, res := s.lss.ReserveSpace(len(bs) + lssBlockTypeSize)
@@ -306,16 +569,47 @@ func (s *Plasma) updateRPSns(rps []*RecoveryPoint) {
 }
 
 func (s *Plasma) CreateRecoveryPoint(sn *Snapshot, meta []byte) error {
+	return s.CreateNamedRecoveryPoint(sn, "", meta)
+}
+
+// CreateNamedRecoveryPoint creates a recovery point which can be found
+// using LookupRecoveryPoint. The metadata is persisted along with the
+// recovery point, e.g. to record the position of an external system that
+// the rollback target corresponds to. Names have to be unique among the
+// recovery points of an instance and at most 65535 bytes long.
+func (s *Plasma) CreateNamedRecoveryPoint(sn *Snapshot, name string, meta []byte) error {
+	if s.readOnly {
+		sn.Close()
+		return ErrReadOnly
+	}
+
+	if len(name) > maxRecoveryPointNameLen {
+		sn.Close()
+		return ErrRecoveryPointName
+	}
+
 	if s.shouldPersist {
 		// Prepare
 		s.mvcc.Lock()
+		if name != "" && s.findRecoveryPoint(name) != nil {
+			s.mvcc.Unlock()
+			sn.Close()
+			return ErrRecoveryPointExists
+		}
+
 		rp := &RecoveryPoint{
-			sn:    sn.sn,
-			count: sn.count,
-			meta:  meta,
+			sn:        sn.sn,
+			count:     sn.count,
+			keySum:    sn.keySum,
+			hasKeySum: true,
+			name:      name,
+			created:   time.Now(),
+			meta:      meta,
+			offset:    sn.offset,
+			hasOffset: true,
 		}
 
-		rps := append(s.recoveryPoints, rp)
+		rps := s.pruneRecoveryPoints(append(s.recoveryPoints, rp), rp.created)
 		s.updateRecoveryPoints(rps)
 		s.updateRPSns(rps)
 
@@ -330,6 +624,10 @@ func (s *Plasma) CreateRecoveryPoint(sn *Snapshot, meta []byte) error {
 		s.mvcc.Unlock()
 
 		s.lss.Sync(true)
+		s.publish(Event{
+			Type: EventRecoveryPoint,
+			Sn:   rp.sn,
+		})
 	} else {
 		sn.Close()
 	}
@@ -342,7 +640,41 @@ func (s *Plasma) GetRecoveryPoints() []*RecoveryPoint {
 	return s.recoveryPoints
 }
 
+// ListRecoveryPoints returns a copy of the recovery points in the order of
+// their creation
+func (s *Plasma) ListRecoveryPoints() []*RecoveryPoint {
+	s.mvcc.RLock()
+	defer s.mvcc.RUnlock()
+	return append([]*RecoveryPoint(nil), s.recoveryPoints...)
+}
+
+// LookupRecoveryPoint returns the recovery point with the given name
+func (s *Plasma) LookupRecoveryPoint(name string) (*RecoveryPoint, error) {
+	s.mvcc.RLock()
+	defer s.mvcc.RUnlock()
+
+	if rp := s.findRecoveryPoint(name); rp != nil {
+		return rp, nil
+	}
+
+	return nil, ErrRecoveryPointNotFound
+}
+
+func (s *Plasma) findRecoveryPoint(name string) *RecoveryPoint {
+	for _, rp := range s.recoveryPoints {
+		if rp.name == name {
+			return rp
+		}
+	}
+
+	return nil
+}
+
 func (s *Plasma) Rollback(rollRP *RecoveryPoint) (*Snapshot, error) {
+	if s.readOnly {
+		return nil, ErrReadOnly
+	}
+
 	s.mvcc.Lock()
 	defer s.mvcc.Unlock()
 
@@ -355,13 +687,28 @@ func (s *Plasma) Rollback(rollRP *RecoveryPoint) (*Snapshot, error) {
 	retry:
 		if pg, err := s.ReadPage(pid, w.pgRdrFn, false, w); err == nil {
 			pg.Rollback(start, end)
-			pgBuf, fdSz, staleFdSz, numSegments := pg.Marshal(pgBuf, s.Config.MaxPageLSSSegments)
+			pgBuf, _, staleFdSz, numSegments, err := pg.Marshal(pgBuf, s.Config.MaxPageLSSSegments)
+			if err != nil {
+				allocs, _, _, _, _ := pg.GetAllocOps()
+				s.discardDeltas(allocs)
+				if err == ErrPageTooBig {
+					// The pages split off are rolled back once visited
+					if err = s.splitOversizedPage(pid, w); err == nil {
+						goto retry
+					}
+				}
+				return err
+			}
+
+			typ, pgBuf := s.compressPageBlock(pgFlushLSSType(pg, numSegments), pgBuf)
+			fdSz := len(pgBuf)
 			offset, wbuf, res := s.lss.ReserveSpace(len(pgBuf) + lssBlockTypeSize)
-			typ := pgFlushLSSType(pg, numSegments)
 			writeLSSBlock(wbuf, typ, pgBuf)
+			staleOff, _ := pg.GetLastFlushOffset()
 			pg.AddFlushRecord(offset, fdSz, numSegments)
 			s.lss.FinalizeWrite(res)
 			w.sts.FlushDataSz += int64(fdSz) - int64(staleFdSz)
+			s.trackLSSUsage(staleOff, staleFdSz, offset, fdSz)
 
 			// May conflict with cleaner
 			if !s.UpdateMapping(pid, pg, w) {
@@ -381,7 +728,12 @@ func (s *Plasma) Rollback(rollRP *RecoveryPoint) (*Snapshot, error) {
 
 	s.lss.Sync(false)
 
-	s.itemsCount = rollRP.count
+	// Changes not yet accounted by a snapshot have been rolled back
+	for _, w := range s.wlist {
+		atomic.StoreInt64(&w.count, 0)
+		atomic.StoreUint64(&w.keySum, 0)
+	}
+	s.itemsCount, s.itemsKeySum = rollRP.count, rollRP.keySum
 	newSnap := s.newSnapshot()
 	var newRpts []*RecoveryPoint
 	for _, rp := range s.recoveryPoints {
@@ -397,7 +749,52 @@ func (s *Plasma) Rollback(rollRP *RecoveryPoint) (*Snapshot, error) {
 	return newSnap, nil
 }
 
+// pruneRecoveryPoints drops the oldest recovery points exceeding the
+// retention limits. The most recent recovery point is always retained.
+func (s *Plasma) pruneRecoveryPoints(rps []*RecoveryPoint, now time.Time) []*RecoveryPoint {
+	var n int
+	if s.MaxRecoveryPoints > 0 && len(rps) > s.MaxRecoveryPoints {
+		n = len(rps) - s.MaxRecoveryPoints
+	}
+
+	if s.RecoveryPointMaxAge > 0 {
+		for ; n < len(rps)-1; n++ {
+			created := rps[n].created
+			if created.IsZero() || now.Sub(created) <= s.RecoveryPointMaxAge {
+				break
+			}
+		}
+	}
+
+	if n == 0 {
+		return rps
+	}
+
+	return append([]*RecoveryPoint(nil), rps[n:]...)
+}
+
+func (s *Plasma) recoveryPointDaemon() {
+	for {
+		select {
+		case <-s.stoprp:
+			s.stoprp <- struct{}{}
+			return
+		case <-time.After(time.Second):
+			s.mvcc.Lock()
+			if rps := s.pruneRecoveryPoints(s.recoveryPoints, time.Now()); len(rps) != len(s.recoveryPoints) {
+				s.updateRecoveryPoints(rps)
+				s.updateRPSns(rps)
+			}
+			s.mvcc.Unlock()
+		}
+	}
+}
+
 func (s *Plasma) RemoveRecoveryPoint(rmRP *RecoveryPoint) {
+	if s.readOnly {
+		return
+	}
+
 	s.mvcc.Lock()
 	defer s.mvcc.Unlock()
 
@@ -412,10 +809,42 @@ func (s *Plasma) RemoveRecoveryPoint(rmRP *RecoveryPoint) {
 	s.updateRPSns(newRpts)
 }
 
+// Flags set in the record length of recovery points which have a name or
+// a creation time. Records written before names and creation times were
+// introduced carry only the metadata.
+const (
+	rpNamedFlag  = 1 << 31
+	rpTimeFlag   = 1 << 30
+	rpKeySumFlag = 1 << 29
+	rpOffsetFlag = 1 << 28
+	rpFlagsMask  = rpNamedFlag | rpTimeFlag | rpKeySumFlag | rpOffsetFlag
+)
+
+func rpRecordSize(rp *RecoveryPoint) int {
+	l := 4 + 8 + 8 + len(rp.meta)
+	if rp.name != "" {
+		l += 2 + len(rp.name)
+	}
+
+	if !rp.created.IsZero() {
+		l += 8
+	}
+
+	if rp.hasKeySum {
+		l += 8
+	}
+
+	if rp.hasOffset {
+		l += 8
+	}
+
+	return l
+}
+
 func marshalRPs(rps []*RecoveryPoint, version uint16) []byte {
 	var l int
 	for _, rp := range rps {
-		l += 4 + 8 + 8 + len(rp.meta)
+		l += rpRecordSize(rp)
 	}
 
 	bs := make([]byte, 2+2+l)
@@ -424,13 +853,42 @@ func marshalRPs(rps []*RecoveryPoint, version uint16) []byte {
 	binary.BigEndian.PutUint16(bs[offset:offset+2], uint16(len(rps)))
 	offset += 2
 	for _, rp := range rps {
-		l := uint32(4 + 8 + 8 + len(rp.meta))
+		l := uint32(rpRecordSize(rp))
+		if rp.name != "" {
+			l |= rpNamedFlag
+		}
+		if !rp.created.IsZero() {
+			l |= rpTimeFlag
+		}
+		if rp.hasKeySum {
+			l |= rpKeySumFlag
+		}
+		if rp.hasOffset {
+			l |= rpOffsetFlag
+		}
 		binary.BigEndian.PutUint32(bs[offset:offset+4], l)
 		offset += 4
 		binary.BigEndian.PutUint64(bs[offset:offset+8], rp.sn)
 		offset += 8
 		binary.BigEndian.PutUint64(bs[offset:offset+8], uint64(rp.count))
 		offset += 8
+		if !rp.created.IsZero() {
+			binary.BigEndian.PutUint64(bs[offset:offset+8], uint64(rp.created.UnixNano()))
+			offset += 8
+		}
+		if rp.hasKeySum {
+			binary.BigEndian.PutUint64(bs[offset:offset+8], rp.keySum)
+			offset += 8
+		}
+		if rp.hasOffset {
+			binary.BigEndian.PutUint64(bs[offset:offset+8], uint64(rp.offset))
+			offset += 8
+		}
+		if rp.name != "" {
+			binary.BigEndian.PutUint16(bs[offset:offset+2], uint16(len(rp.name)))
+			offset += 2
+			offset += copy(bs[offset:], rp.name)
+		}
 		copy(bs[offset:], rp.meta)
 		offset += len(rp.meta)
 	}
@@ -445,13 +903,33 @@ func unmarshalRPs(bs []byte) (version uint16, rps []*RecoveryPoint) {
 	offset += 2
 	for i := 0; i < n; i++ {
 		rp := new(RecoveryPoint)
-		l := int(binary.BigEndian.Uint32(bs[offset : offset+4]))
-		endOffset := offset + l
+		l := binary.BigEndian.Uint32(bs[offset : offset+4])
+		endOffset := offset + int(l&^rpFlagsMask)
 		offset += 4
 		rp.sn = binary.BigEndian.Uint64(bs[offset : offset+8])
 		offset += 8
 		rp.count = int64(binary.BigEndian.Uint64(bs[offset : offset+8]))
 		offset += 8
+		if l&rpTimeFlag != 0 {
+			rp.created = time.Unix(0, int64(binary.BigEndian.Uint64(bs[offset:offset+8])))
+			offset += 8
+		}
+		if l&rpKeySumFlag != 0 {
+			rp.keySum = binary.BigEndian.Uint64(bs[offset : offset+8])
+			rp.hasKeySum = true
+			offset += 8
+		}
+		if l&rpOffsetFlag != 0 {
+			rp.offset = LSSOffset(binary.BigEndian.Uint64(bs[offset : offset+8]))
+			rp.hasOffset = true
+			offset += 8
+		}
+		if l&rpNamedFlag != 0 {
+			nl := int(binary.BigEndian.Uint16(bs[offset : offset+2]))
+			offset += 2
+			rp.name = string(bs[offset : offset+nl])
+			offset += nl
+		}
 		rp.meta = append([]byte(nil), bs[offset:endOffset]...)
 		rps = append(rps, rp)
 		offset = endOffset
@@ -461,7 +939,7 @@ func unmarshalRPs(bs []byte) (version uint16, rps []*RecoveryPoint) {
 }
 
 func (s *Plasma) updateMaxSn(sn uint64, force bool) {
-	if s.shouldPersist {
+	if s.shouldPersist && !s.readOnly {
 		freq := s.MaxSnSyncFrequency
 		if s.numSnCreated%freq == 0 || force {
 			var bs [8]byte
@@ -3,10 +3,12 @@ package plasma
 import (
 	"crypto/md5"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/couchbase/nitro/skiplist"
 	"os"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 	"unsafe"
@@ -78,6 +80,43 @@ func TestMVCCSimple(t *testing.T) {
 	}
 }
 
+func TestMVCCIteratorBounds(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testSnCfg)
+	defer s.Close()
+
+	w := s.NewWriter()
+	for i := 0; i < 10000; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte(fmt.Sprintf("val-%10d", i)))
+	}
+
+	snap := s.NewSnapshot()
+	defer snap.Close()
+
+	itr := snap.NewIterator()
+	defer itr.Close()
+
+	itr.SetBounds([]byte(fmt.Sprintf("key-%10d", 100)), []byte(fmt.Sprintf("key-%10d", 5000)))
+	count := 0
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		count++
+	}
+
+	if count != 4901 {
+		t.Errorf("Expected 4901, got %d", count)
+	}
+
+	itr.SetEndKey([]byte(fmt.Sprintf("key-%10d", 200)))
+	count = 0
+	for itr.Seek([]byte(fmt.Sprintf("key-%10d", 150))); itr.Valid(); itr.Next() {
+		count++
+	}
+
+	if count != 51 {
+		t.Errorf("Expected 51, got %d", count)
+	}
+}
+
 func TestMVCCLookup(t *testing.T) {
 	os.RemoveAll("teststore.data")
 	s := newTestIntPlasmaStore(testSnCfg)
@@ -113,6 +152,34 @@ func TestMVCCLookup(t *testing.T) {
 	}
 }
 
+func TestMVCCParallelCompaction(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testSnCfg)
+	defer s.Close()
+
+	w := s.NewWriter()
+	for i := 0; i < 10000; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte(fmt.Sprintf("val-%10d", i)))
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	if err := w.CompactParallel(4, 0, stop); err != ErrAborted {
+		t.Errorf("expected %v, got %v", ErrAborted, err)
+	}
+
+	if err := w.CompactParallel(4, 1024*1024*1024, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10000; i++ {
+		k := []byte(fmt.Sprintf("key-%10d", i))
+		if v, _ := w.LookupKV(k); string(v) != fmt.Sprintf("val-%10d", i) {
+			t.Errorf("Expected val-%10d, got %s", i, v)
+		}
+	}
+}
+
 func TestMVCCGarbageCollection(t *testing.T) {
 	os.RemoveAll("teststore.data")
 	s := newTestIntPlasmaStore(testSnCfg)
@@ -577,3 +644,577 @@ func TestMVCCItemsCount(t *testing.T) {
 		t.Errorf("Expected count %d, got %d", n, rollSn1.Count())
 	}
 }
+
+func TestMVCCItemsCountRecovery(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testSnCfg)
+
+	n, m := 5000, 2000
+	w := s.NewWriter()
+	for i := 0; i < n; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte(fmt.Sprintf("val-%10d", i)))
+	}
+
+	// Failed operations are not counted
+	if err := w.InsertKV(make([]byte, maxKeySize+1), nil); err != ErrKeyTooLarge {
+		t.Fatalf("expected %v, got %v", ErrKeyTooLarge, err)
+	}
+
+	s.CreateRecoveryPoint(s.NewSnapshot(), nil)
+	for i := 0; i < m; i++ {
+		w.DeleteKV([]byte(fmt.Sprintf("key-%10d", i)))
+	}
+
+	// Changes after the recovery point are discarded by a rollback
+	rollSn, _ := s.Rollback(s.GetRecoveryPoints()[0])
+	rollSn.Close()
+	if snap := s.NewSnapshot(); snap.Count() != int64(n) {
+		t.Errorf("expected count %d after rollback, got %d", n, snap.Count())
+	} else {
+		snap.Close()
+	}
+
+	for i := 0; i < m; i++ {
+		w.DeleteKV([]byte(fmt.Sprintf("key-%10d", i)))
+	}
+
+	// Items written after the last recovery point are counted on recovery
+	s.PersistAll()
+	s.Close()
+
+	s = newTestIntPlasmaStore(testSnCfg)
+	defer s.Close()
+
+	if c := s.ItemsCount(); c != int64(n-m) {
+		t.Errorf("expected count %d after recovery, got %d", n-m, c)
+	}
+
+	snap := s.NewSnapshot()
+	defer snap.Close()
+	if c := snap.Count(); c != int64(n-m) {
+		t.Errorf("expected snapshot count %d after recovery, got %d", n-m, c)
+	}
+}
+
+func TestMVCCItemsCountOverwrite(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testSnCfg)
+
+	n, m := 5000, 2000
+	w := s.NewWriter()
+	for i := 0; i < n; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte(fmt.Sprintf("val-%10d", i)))
+	}
+
+	// Overwriting a key or deleting a key which is absent or already
+	// deleted leaves the count unchanged
+	for i := m; i < n; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte(fmt.Sprintf("new-%10d", i)))
+	}
+
+	for i := 0; i < m; i++ {
+		w.DeleteKV([]byte(fmt.Sprintf("key-%10d", i)))
+		w.DeleteKV([]byte(fmt.Sprintf("key-%10d", i)))
+		w.DeleteKV([]byte(fmt.Sprintf("absent-%10d", i)))
+	}
+
+	// A deleted key is counted again once inserted
+	w.InsertKV([]byte(fmt.Sprintf("key-%10d", 0)), nil)
+	exp := int64(n - m + 1)
+
+	snap := s.NewSnapshot()
+	if c := snap.Count(); c != exp {
+		t.Errorf("expected count %d, got %d", exp, c)
+	}
+	s.CreateRecoveryPoint(snap, nil)
+	snap.Close()
+
+	w.InsertKV([]byte(fmt.Sprintf("key-%10d", 1)), nil)
+	w.InsertKV([]byte(fmt.Sprintf("key-%10d", m)), nil)
+	w.DeleteKV([]byte(fmt.Sprintf("absent-%10d", 0)))
+	exp++
+
+	s.PersistAll()
+	s.Close()
+
+	s = newTestIntPlasmaStore(testSnCfg)
+	defer s.Close()
+
+	if c := s.ItemsCount(); c != exp {
+		t.Errorf("expected count %d after recovery, got %d", exp, c)
+	}
+
+	snap = s.NewSnapshot()
+	defer snap.Close()
+	if c := snap.Count(); c != exp {
+		t.Errorf("expected snapshot count %d after recovery, got %d", exp, c)
+	}
+}
+
+func TestMVCCVerifyRecovery(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	cfg := testSnCfg
+	cfg.VerifyRecovery = true
+	s := newTestIntPlasmaStore(cfg)
+
+	w := s.NewWriter()
+	for i := 0; i < 5000; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte(fmt.Sprintf("val-%10d", i)))
+	}
+	for i := 0; i < 2000; i++ {
+		w.DeleteKV([]byte(fmt.Sprintf("key-%10d", i)))
+	}
+	s.CreateRecoveryPoint(s.NewSnapshot(), nil)
+
+	// Items written after the recovery point are not verified
+	for i := 5000; i < 6000; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), nil)
+	}
+	s.PersistAll()
+	s.Close()
+
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("expected recovery to verify, got %v", err)
+	}
+
+	// Record a key checksum which the recovered items do not match
+	s.mvcc.Lock()
+	rp := *s.recoveryPoints[0]
+	rp.keySum++
+	s.updateRecoveryPoints([]*RecoveryPoint{&rp})
+	s.mvcc.Unlock()
+	s.PersistAll()
+	s.Close()
+
+	s, err = New(cfg)
+	if s != nil {
+		defer s.Close()
+	}
+
+	var mErr *RecoveryMismatchError
+	if !errors.As(err, &mErr) || !errors.Is(err, ErrCorruptLog) {
+		t.Fatalf("expected a recovery mismatch, got %v", err)
+	}
+
+	if mErr.Count != 3000 || mErr.ExpectedCount != 3000 || mErr.KeySum+1 != mErr.ExpectedKeySum {
+		t.Errorf("unexpected mismatch %+v", mErr)
+	}
+}
+
+func TestMVCCItemsCountLazyRecovery(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testSnCfg)
+
+	n, m := 50000, 100
+	w := s.NewWriter()
+	for i := 0; i < n; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte(fmt.Sprintf("val-%10d", i)))
+	}
+
+	s.CreateRecoveryPoint(s.NewSnapshot(), nil)
+	for i := 0; i < m; i++ {
+		w.DeleteKV([]byte(fmt.Sprintf("key-%10d", i)))
+	}
+	s.PersistAll()
+	s.Close()
+
+	s = newTestIntPlasmaStore(testSnCfg)
+	memSz := s.GetStats().MemSz
+	s.Close()
+
+	// Only the pages written since the recovery point are read to count
+	// the items
+	cfg := testSnCfg
+	cfg.LazyRecovery = true
+	s = newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	if c := s.ItemsCount(); c != int64(n-m) {
+		t.Errorf("expected count %d after recovery, got %d", n-m, c)
+	}
+
+	if lazySz := s.GetStats().MemSz; lazySz*2 > memSz {
+		t.Errorf("expected the count to read few pages, got %d bytes, full recovery %d", lazySz, memSz)
+	}
+}
+
+func TestMVCCNamedRecoveryPoint(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testSnCfg)
+
+	w := s.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte(fmt.Sprintf("val-%10d", i)))
+	}
+
+	s.CreateRecoveryPoint(s.NewSnapshot(), []byte("unnamed"))
+	if err := s.CreateNamedRecoveryPoint(s.NewSnapshot(), "seqno-1000", []byte("vb:1000")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.CreateNamedRecoveryPoint(s.NewSnapshot(), "seqno-1000", nil); err != ErrRecoveryPointExists {
+		t.Errorf("expected duplicate name to fail, got %v", err)
+	}
+
+	longName := string(make([]byte, maxRecoveryPointNameLen+1))
+	if err := s.CreateNamedRecoveryPoint(s.NewSnapshot(), longName, nil); err != ErrRecoveryPointName {
+		t.Errorf("expected long name to fail, got %v", err)
+	}
+
+	if err := s.CreateNamedRecoveryPoint(s.NewSnapshot(), longName[1:], nil); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s = newTestIntPlasmaStore(testSnCfg)
+	defer s.Close()
+
+	rpts := s.ListRecoveryPoints()
+	if len(rpts) != 3 || rpts[0].Name() != "" || string(rpts[0].Meta()) != "unnamed" {
+		t.Fatalf("unexpected recovery points %v", rpts)
+	}
+
+	if rpts[2].Name() != longName[1:] {
+		t.Errorf("expected the longest name to be recovered")
+	}
+
+	rp, err := s.LookupRecoveryPoint("seqno-1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rp != rpts[1] || string(rp.Meta()) != "vb:1000" {
+		t.Errorf("unexpected recovery point %s", rp.Meta())
+	}
+
+	if _, err := s.LookupRecoveryPoint("seqno-2000"); err != ErrRecoveryPointNotFound {
+		t.Errorf("expected lookup to fail, got %v", err)
+	}
+}
+
+func TestMVCCRecoveryPointRetention(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	cfg := testSnCfg
+	cfg.MaxRecoveryPoints = 3
+	s := newTestIntPlasmaStore(cfg)
+
+	w := s.NewWriter()
+	for i := 0; i < 5; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte(fmt.Sprintf("val-%10d", i)))
+		s.CreateRecoveryPoint(s.NewSnapshot(), []byte(fmt.Sprint(i)))
+	}
+
+	rpts := s.ListRecoveryPoints()
+	if len(rpts) != 3 || string(rpts[0].Meta()) != "2" {
+		t.Fatalf("expected 3 most recent recovery points, got %d", len(rpts))
+	}
+
+	rpSns := *(*[]uint64)(s.rpSns)
+	if len(rpSns) != 3 || rpSns[0] != rpts[0].sn {
+		t.Errorf("expected pruned recovery points to be released")
+	}
+	s.Close()
+
+	cfg.MaxRecoveryPoints = 0
+	cfg.RecoveryPointMaxAge = time.Second
+	s = newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	if rpts := s.ListRecoveryPoints(); len(rpts) != 3 || rpts[2].CreatedAt().IsZero() {
+		t.Fatalf("expected recovery points with creation time to be recovered")
+	}
+
+	time.Sleep(time.Second * 3)
+	if rpts := s.ListRecoveryPoints(); len(rpts) != 1 || string(rpts[0].Meta()) != "4" {
+		t.Errorf("expected only the most recent recovery point, got %d", len(rpts))
+	}
+}
+
+func TestMVCCIteratorReverse(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testSnCfg)
+	defer s.Close()
+
+	w := s.NewWriter()
+	for i := 0; i < 10000; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte(fmt.Sprintf("val-%10d", i)))
+	}
+	snap := s.NewSnapshot()
+
+	// Versions after the snapshot are not visible
+	for i := 0; i < 10000; i++ {
+		w.DeleteKV([]byte(fmt.Sprintf("key-%10d", i)))
+	}
+
+	itr := snap.NewIterator()
+	defer itr.Close()
+	snap.Close()
+
+	i := 4999
+	for itr.SeekLT([]byte(fmt.Sprintf("key-%10d", 5000))); itr.Valid(); itr.Prev() {
+		if k := string(itr.Key()); k != fmt.Sprintf("key-%10d", i) {
+			t.Fatalf("expected key-%10d, got %s", i, k)
+		}
+		i--
+	}
+
+	if i != -1 {
+		t.Errorf("expected iteration to stop at %d, got %d", -1, i)
+	}
+}
+
+func TestMVCCIteratorRefresh(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testSnCfg)
+	defer s.Close()
+
+	w := s.NewWriter()
+	for i := 0; i < 10000; i += 2 {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), nil)
+	}
+
+	snap := s.NewSnapshot()
+	itr := snap.NewIterator()
+	defer itr.Close()
+	snap.Close()
+
+	i := 0
+	for itr.SeekFirst(); itr.Valid() && i < 5000; itr.Next() {
+		i += 2
+	}
+
+	// Odd keys are visible after refresh
+	for i := 1; i < 10000; i += 2 {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), nil)
+	}
+	w.DeleteKV([]byte(fmt.Sprintf("key-%10d", 5000)))
+
+	if err := itr.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	if atomic.LoadInt32(&snap.refCount) != 0 {
+		t.Errorf("expected old snapshot to be released")
+	}
+
+	// Current key was deleted
+	i = 5001
+	for ; itr.Valid(); itr.Next() {
+		if k := string(itr.Key()); k != fmt.Sprintf("key-%10d", i) {
+			t.Fatalf("expected key-%10d, got %s", i, k)
+		}
+		i++
+	}
+
+	if i != 10000 {
+		t.Errorf("expected iteration to stop at %d, got %d", 10000, i)
+	}
+
+	// Reverse iteration
+	itr.SeekLT([]byte(fmt.Sprintf("key-%10d", 100)))
+	itr.Refresh()
+	if k := string(itr.Key()); k != fmt.Sprintf("key-%10d", 99) {
+		t.Errorf("expected key-%10d, got %s", 99, k)
+	}
+
+	if itr.Prev(); string(itr.Key()) != fmt.Sprintf("key-%10d", 98) {
+		t.Errorf("expected key-%10d, got %s", 98, itr.Key())
+	}
+}
+
+func TestMVCCIteratorReadAhead(t *testing.T) {
+	os.RemoveAll("teststore.data")
+
+	var inflight, maxInflight int64
+	cfg := testSnCfg
+	cfg.ReadAheadPages = 4
+	cfg.AutoSwapper = false
+	cfg.LogFactory = func(path string, opts LogOptions) (Log, error) {
+		l, err := newLog(path, opts.SegmentSize, opts.Sync, false, false, IOEngineSync, nil)
+		return slowReadLog{Log: l, inflight: &inflight, maxInflight: &maxInflight}, err
+	}
+
+	s := newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	w := s.NewWriter()
+	n := 20000
+	for i := 0; i < n; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte("val"))
+	}
+	s.PersistAll()
+	s.EvictAll(0)
+
+	snap := s.NewSnapshot()
+	itr := snap.NewIterator()
+	i := 0
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		if k := string(itr.Key()); k != fmt.Sprintf("key-%10d", i) {
+			t.Fatalf("expected key-%10d, got %s", i, k)
+		}
+		i++
+	}
+	itr.Close()
+	snap.Close()
+
+	if i != n {
+		t.Errorf("expected %d items, got %d", n, i)
+	}
+
+	if sts := s.GetStats(); sts.ReadAheads == 0 {
+		t.Errorf("expected pages to be fetched ahead of the scan")
+	}
+}
+
+func TestMVCCScanLSSOrder(t *testing.T) {
+	os.RemoveAll("teststore.data")
+
+	cfg := testSnCfg
+	cfg.AutoSwapper = false
+	s := newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	w := s.NewWriter()
+	n := 20000
+	for i := 0; i < n; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte(fmt.Sprintf("val-%d", i)))
+	}
+	s.PersistAll()
+	s.EvictAll(0)
+
+	for i := 0; i < n; i += 100 {
+		w.DeleteKV([]byte(fmt.Sprintf("key-%10d", i)))
+	}
+
+	snap := s.NewSnapshot()
+	defer snap.Close()
+
+	// Changes after the snapshot are not visible
+	for i := 0; i < n; i += 7 {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte("new"))
+	}
+	for i := 1; i < n; i += 100 {
+		w.DeleteKV([]byte(fmt.Sprintf("key-%10d", i)))
+	}
+	s.PersistAll()
+
+	// Pages changed after they were written are scanned from memory
+	for i := 3; i < n; i += 1000 {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte("newer"))
+	}
+
+	expected := make(map[string]string)
+	itr := snap.NewIterator()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		expected[string(itr.Key())] = string(itr.Value())
+	}
+	itr.Close()
+
+	if len(expected) != n-n/100 {
+		t.Fatalf("expected %d items in the snapshot, got %d", n-n/100, len(expected))
+	}
+
+	got := make(map[string]string)
+	err := s.ScanLSSOrder(snap, func(k, v []byte) error {
+		if _, ok := got[string(k)]; ok {
+			t.Errorf("duplicate item %s", k)
+		}
+		got[string(k)] = string(v)
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if len(got) != len(expected) {
+		t.Errorf("expected %d items, got %d", len(expected), len(got))
+	}
+
+	for k, v := range expected {
+		if got[k] != v {
+			t.Errorf("expected %s=%s, got %s", k, v, got[k])
+			break
+		}
+	}
+
+	errStop := errors.New("stop")
+	count := 0
+	err = s.ScanLSSOrder(snap, func(k, v []byte) error {
+		if count++; count == 10 {
+			return errStop
+		}
+		return nil
+	})
+
+	if err != errStop || count != 10 {
+		t.Errorf("expected the scan to stop at the callback error, got %v after %d items", err, count)
+	}
+}
+
+func TestMVCCParallelScan(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testSnCfg)
+	defer s.Close()
+
+	w := s.NewWriter()
+	n := 100000
+	for i := 0; i < n; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte(fmt.Sprintf("val-%d", i)))
+	}
+
+	for i := 0; i < n; i += 10 {
+		w.DeleteKV([]byte(fmt.Sprintf("key-%10d", i)))
+	}
+
+	snap := s.NewSnapshot()
+	defer snap.Close()
+
+	// Changes after the snapshot are not visible
+	for i := 0; i < n; i += 7 {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte("new"))
+	}
+
+	var mu sync.Mutex
+	got := make(map[string]string)
+	err := snap.ParallelScan(8, func(itm unsafe.Pointer) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		k := string((*item)(itm).Key())
+		if _, ok := got[k]; ok {
+			t.Errorf("duplicate item %s", k)
+		}
+		got[k] = string((*item)(itm).Value())
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != n-n/10 {
+		t.Fatalf("expected %d items, got %d", n-n/10, len(got))
+	}
+
+	for i := 0; i < n; i++ {
+		k := fmt.Sprintf("key-%10d", i)
+		if v, ok := got[k]; ok != (i%10 != 0) || (ok && v != fmt.Sprintf("val-%d", i)) {
+			t.Fatalf("unexpected item %s: %s", k, v)
+		}
+	}
+
+	errStop := errors.New("stop")
+	var count int64
+	err = snap.ParallelScan(8, func(itm unsafe.Pointer) error {
+		if atomic.AddInt64(&count, 1) == 1000 {
+			return errStop
+		}
+		return nil
+	})
+
+	if err != errStop {
+		t.Errorf("expected the error of the callback, got %v", err)
+	}
+}
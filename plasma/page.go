@@ -29,6 +29,11 @@ const (
 
 	opSwapoutDelta
 	opSwapinDelta
+
+	// LSS encoding of a base page with prefix compressed items
+	opBasePagePrefix
+
+	opRangeDeleteDelta
 )
 
 const (
@@ -36,6 +41,9 @@ const (
 	NoFullMarshal = ^0
 )
 
+// Largest fixed size record written for a delta (op, start and end offsets)
+const marshalDeltaHdrSize = 2 + 8 + 8
+
 var pageHeaderSize = int(unsafe.Sizeof(*new(pageDelta)))
 
 type PageId interface{}
@@ -48,6 +56,7 @@ func NextPid(pid PageId) PageId {
 type Page interface {
 	Insert(itm unsafe.Pointer)
 	Delete(itm unsafe.Pointer)
+	DeleteRange(low, high unsafe.Pointer)
 	Lookup(itm unsafe.Pointer) unsafe.Pointer
 	NewIterator() ItemIterator
 
@@ -65,7 +74,7 @@ type Page interface {
 	Rollback(s, end uint64)
 
 	Append(Page)
-	Marshal(buf []byte, maxSegments int) (bs []byte, fdSz int, staleFdSz int, numSegments int)
+	Marshal(buf []byte, maxSegments int) (bs []byte, fdSz int, staleFdSz int, numSegments int, err error)
 
 	GetVersion() uint16
 	IsFlushed() bool
@@ -78,6 +87,9 @@ type Page interface {
 	Next() PageId
 
 	Evict(offset LSSOffset, numSegments int)
+	EvictBase() bool
+	EvictCompressed(data []byte)
+	IsCompressed() bool
 	SwapIn(ptr *pageDelta)
 
 	GetAllocOps() (a []*pageDelta, f []pgFreeObj, nra int, nrs int, sz int)
@@ -88,6 +100,7 @@ type Page interface {
 	// TODO: Clean up later
 	IsEmpty() bool
 	GetFlushInfo() (LSSOffset, int, int)
+	GetLastFlushOffset() (LSSOffset, bool)
 	SetNumSegments(int)
 }
 
@@ -183,6 +196,10 @@ type pageDelta struct {
 	numItems uint16
 	state    pageState
 
+	// Estimate of the size of the items of the page, including the items
+	// of the deltas
+	itemsSz uint32
+
 	next *pageDelta
 
 	hiItm        unsafe.Pointer
@@ -210,6 +227,7 @@ type basePage struct {
 	chainLen uint16
 	numItems uint16
 	state    pageState
+	itemsSz  uint32
 
 	data unsafe.Pointer
 
@@ -260,11 +278,31 @@ func (rpd *rollbackDelta) Filter() interface{} {
 	return &rpd.rb
 }
 
+// Range tombstone for the items within [low, high) which are older than
+// the delta
+type rangeDeleteDelta struct {
+	pageDelta
+	low, high unsafe.Pointer
+}
+
+func (rdd *rangeDeleteDelta) covers(itm unsafe.Pointer, cmp skiplist.CompareFn) bool {
+	return cmp(itm, rdd.low) >= 0 && cmp(itm, rdd.high) < 0
+}
+
 type swapoutDelta struct {
 	pageDelta
 
 	offset      LSSOffset
 	numSegments int32
+
+	// Compressed page image retained in memory
+	dataLen     int32
+	flushDataSz int32
+	data        unsafe.Pointer
+}
+
+func (sod *swapoutDelta) Data() []byte {
+	return ptrBytes(sod.data, int(sod.dataLen))
 }
 
 type swapinDelta struct {
@@ -296,6 +334,31 @@ func (pg *page) SetNext(pid PageId) {
 	}
 }
 
+// Link sets the right sibling of a page through a meta delta, so that
+// the change can be published using UpdateMapping
+func (pg *page) Link(pid PageId) {
+	pg.head = pg.newMetaDelta()
+	pg.head.rightSibling = pid
+}
+
+// Reopen undoes Close by covering the remove delta with a meta delta,
+// which the page walkers skip like the remove delta itself
+func (pg *page) Reopen() {
+	pg.head = pg.newMetaDelta()
+}
+
+// newMetaDelta returns a meta delta copying the header of the page head
+func (pg *page) newMetaDelta() *pageDelta {
+	d := pg.allocMetaDelta(pg.head.hiItm)
+	hiItm := d.hiItm
+	*(*pageDelta)(unsafe.Pointer(d)) = *pg.head
+	d.next = pg.head
+
+	d.op = opMetaDelta
+	d.hiItm = hiItm
+	return (*pageDelta)(unsafe.Pointer(d))
+}
+
 func (pg *page) InCache() bool {
 	return uintptr(unsafe.Pointer(pg.prevHeadPtr))&uintptr(evictMask) == 0
 }
@@ -336,6 +399,17 @@ func (pg *page) newRecordDelta(op pageOp, itm unsafe.Pointer) *pageDelta {
 
 	pd.op = op
 	pd.chainLen++
+	pd.itemsSz += uint32(pg.itemSize(itm))
+	return (*pageDelta)(unsafe.Pointer(pd))
+}
+
+func (pg *page) newRangeDeleteDelta(low, high unsafe.Pointer) *pageDelta {
+	pd := pg.allocRangeDeleteDelta(low, high)
+	*(*pageDelta)(unsafe.Pointer(pd)) = *pg.head
+	pd.next = pg.head
+
+	pd.op = opRangeDeleteDelta
+	pd.chainLen++
 	return (*pageDelta)(unsafe.Pointer(pd))
 }
 
@@ -365,6 +439,7 @@ func (pg *page) newMergePageDelta(itm unsafe.Pointer, sibl *pageDelta) *pageDelt
 	pd.hiItm = hiItm
 	pd.chainLen += sibl.chainLen + 1
 	pd.numItems += sibl.numItems
+	pd.itemsSz += sibl.itemsSz
 	pd.rightSibling = sibl.rightSibling
 	return (*pageDelta)(unsafe.Pointer(pd))
 }
@@ -379,13 +454,21 @@ func (pg *page) newRemovePageDelta() *pageDelta {
 }
 
 func (pg *page) newBasePage(itms []unsafe.Pointer) *pageDelta {
-	var sz uintptr
 	var hiItm unsafe.Pointer
+	var rightSibling PageId
 
 	if pg.head != nil {
 		hiItm = pg.head.hiItm
+		rightSibling = pg.head.rightSibling
 	}
 
+	return pg.newBasePage2(itms, hiItm, rightSibling)
+}
+
+func (pg *page) newBasePage2(itms []unsafe.Pointer, hiItm unsafe.Pointer,
+	rightSibling PageId) *pageDelta {
+	var sz uintptr
+
 	n := len(itms)
 	for _, itm := range itms {
 		sz += pg.itemSize(itm)
@@ -395,6 +478,7 @@ func (pg *page) newBasePage(itms []unsafe.Pointer) *pageDelta {
 	bp.op = opBasePage
 	bp.numItems = uint16(n)
 	bp.state = 0
+	bp.itemsSz = uint32(sz)
 
 	var offset uintptr
 	for i, itm := range itms {
@@ -406,10 +490,7 @@ func (pg *page) newBasePage(itms []unsafe.Pointer) *pageDelta {
 	}
 
 	bp.numItems = uint16(n)
-	if pg.head != nil {
-		bp.rightSibling = pg.head.rightSibling
-	}
-
+	bp.rightSibling = rightSibling
 	return (*pageDelta)(unsafe.Pointer(bp))
 }
 
@@ -430,6 +511,21 @@ func (pg *page) Delete(itm unsafe.Pointer) {
 	pg.head = pg.newRecordDelta(opDeleteDelta, itm)
 }
 
+// DeleteRange adds a tombstone for the items within [low, high). The range
+// is limited to the keys of the page, so that the tombstone does not apply
+// to the items of other pages once the page is merged.
+func (pg *page) DeleteRange(low, high unsafe.Pointer) {
+	if pg.cmp(low, pg.MinItem()) < 0 {
+		low = pg.MinItem()
+	}
+
+	if pg.cmp(high, pg.MaxItem()) > 0 {
+		high = pg.MaxItem()
+	}
+
+	pg.head = pg.newRangeDeleteDelta(low, high)
+}
+
 func (pg *page) equal(itm0, itm1, hi unsafe.Pointer) bool {
 	return pg.cmp(itm0, itm1) == 0 && pg.cmp(itm0, hi) < 0
 }
@@ -492,6 +588,11 @@ loop:
 		case opRollbackDelta:
 			filter.AddFilter(pw.RollbackFilter())
 
+		case opRangeDeleteDelta:
+			if pw.RangeDelete().covers(itm, pg.cmp) {
+				return nil
+			}
+
 		case opFlushPageDelta:
 		case opRelocPageDelta:
 		case opPageRemoveDelta:
@@ -506,12 +607,58 @@ loop:
 	return nil
 }
 
+// seekGE returns the first item of the page greater than or equal to itm,
+// or nil if the page has no such item
+func (pg *page) seekGE(itm unsafe.Pointer) unsafe.Pointer {
+	var sts pgOpIteratorStats
+	it := newPgOpIterator(pg.head, pg.cmp, itm, pg.MaxItem(), new(defaultFilter), pg.ctx, &sts)
+	defer it.Close()
+
+	if it.Init(); !it.Valid() {
+		return nil
+	}
+
+	return pg.copyItem(it.Get().Item())
+}
+
+// seekLE returns the last item of the page less than or equal to itm, or
+// nil if the page has no such item
+func (pg *page) seekLE(itm unsafe.Pointer) unsafe.Pointer {
+	var sts pgOpIteratorStats
+	it := newPgOpIterator(pg.head, pg.cmp, nil, pg.MaxItem(), new(defaultFilter), pg.ctx, &sts)
+	defer it.Close()
+
+	var last unsafe.Pointer
+	for it.Init(); it.Valid() && pg.cmp(it.Get().Item(), itm) <= 0; it.Next() {
+		last = it.Get().Item()
+	}
+
+	if last == nil {
+		return nil
+	}
+
+	return pg.copyItem(last)
+}
+
+// copyItem copies an item of the page into the temporary item buffer so
+// that it stays valid once the page is reclaimed
+func (pg *page) copyItem(itm unsafe.Pointer) unsafe.Pointer {
+	itmBuf := pg.ctx.GetBuffer(bufTempItem)
+	resultPtr := unsafe.Pointer(&itmBuf[0])
+	memcopy(resultPtr, itm, int(pg.itemSize(itm)))
+	return resultPtr
+}
+
 func (pg *page) NeedCompaction(threshold int) bool {
 	return int(pg.head.chainLen) > threshold
 }
 
+// NeedSplit returns true if the page has more items than threshold or if
+// its items take more than a quarter of the encoding buffer, so that the
+// page as well as both halves of a split can always be written out
 func (pg *page) NeedSplit(threshold int) bool {
-	return int(pg.head.numItems) > threshold
+	return int(pg.head.numItems) > threshold ||
+		int(pg.head.itemsSz) > maxPageEncodedSize/4
 }
 
 func (pg *page) NeedMerge(threshold int) bool {
@@ -583,6 +730,12 @@ func (pg *page) doSplit(itm unsafe.Pointer, pid PageId, numItems int) *page {
 		// During recovery
 		pg.head.numItems /= 2
 	}
+
+	if rsz := bp.itemsSz; pg.head.itemsSz > rsz {
+		pg.head.itemsSz -= rsz
+	} else {
+		pg.head.itemsSz = 0
+	}
 	return splitPage
 }
 
@@ -648,6 +801,9 @@ loop:
 		case opRollbackDelta:
 			start, end := pw.RollbackInfo()
 			fmt.Println("-----rollback----", start, end)
+		case opRangeDeleteDelta:
+			rdd := pw.RangeDelete()
+			fmt.Println("-----range-delete----", stringify(rdd.low), stringify(rdd.high))
 		}
 	}
 }
@@ -708,40 +864,125 @@ func (pg *page) NewIterator() ItemIterator {
 	}
 }
 
-func (pg *page) Marshal(buf []byte, maxSegments int) (bs []byte, dataSz, staleFdSz int, numSegments int) {
+func (pg *page) Marshal(buf []byte, maxSegments int) (bs []byte, dataSz, staleFdSz int, numSegments int, err error) {
 	hiItm := pg.MaxItem()
-	offset, staleFdSz, numSegments := pg.marshal(buf, 0, pg.head, hiItm, false, maxSegments)
-	return buf[:offset], offset, staleFdSz, numSegments
+	offset, staleFdSz, numSegments, err := pg.marshal(buf, 0, pg.head, hiItm, false, maxSegments)
+	if err != nil {
+		return nil, 0, 0, 0, err
+	}
+
+	if pg.ctx != nil {
+		pg.ctx.sts.PageSizeHist.add(offset)
+	}
+	return buf[:offset], offset, staleFdSz, numSegments, nil
 }
 
-func (pg *page) marshalIndexKey(key unsafe.Pointer, woffset int, buf []byte) int {
+func (pg *page) marshalIndexKey(key unsafe.Pointer, woffset int, buf []byte) (int, error) {
 	if key == skiplist.MinItem || key == skiplist.MaxItem {
+		if woffset+2 > len(buf) {
+			return woffset, ErrPageTooBig
+		}
 		binary.BigEndian.PutUint16(buf[woffset:woffset+2], uint16(0))
 		woffset += 2
 	} else {
 		return pg.marshalItem(key, woffset, buf)
 	}
 
-	return woffset
+	return woffset, nil
 }
 
-func (pg *page) marshalItem(itm unsafe.Pointer, woffset int, buf []byte) int {
+func (pg *page) marshalItem(itm unsafe.Pointer, woffset int, buf []byte) (int, error) {
 	l := int(pg.itemSize(itm))
+	if l > maxItemSize {
+		return woffset, ErrItemTooBig
+	} else if woffset+2+l > len(buf) {
+		return woffset, ErrPageTooBig
+	}
+
 	binary.BigEndian.PutUint16(buf[woffset:woffset+2], uint16(l))
 	woffset += 2
 	memcopy(unsafe.Pointer(&buf[woffset]), itm, l)
 	woffset += l
 
-	return woffset
+	return woffset, nil
+}
+
+// Base page items are encoded as the number of bytes shared with the
+// previous item followed by the remaining suffix
+func (pg *page) marshalPrefixBasePage(itms []unsafe.Pointer, hiItm unsafe.Pointer,
+	woffset int, buf []byte) (int, error) {
+
+	if woffset+4 > len(buf) {
+		return woffset, ErrPageTooBig
+	}
+
+	binary.BigEndian.PutUint16(buf[woffset:woffset+2], uint16(opBasePagePrefix))
+	woffset += 2
+	bufnitm := buf[woffset : woffset+2]
+	nItms := 0
+	woffset += 2
+
+	var prev []byte
+	for _, itm := range itms {
+		if pg.cmp(itm, hiItm) < 0 {
+			curr := ptrBytes(itm, int(pg.itemSize(itm)))
+			shared := commonPrefixLen(prev, curr)
+			if len(curr) > maxItemSize {
+				return woffset, ErrItemTooBig
+			} else if woffset+4+len(curr)-shared > len(buf) {
+				return woffset, ErrPageTooBig
+			}
+
+			binary.BigEndian.PutUint16(buf[woffset:woffset+2], uint16(shared))
+			woffset += 2
+			binary.BigEndian.PutUint16(buf[woffset:woffset+2], uint16(len(curr)-shared))
+			woffset += 2
+			woffset += copy(buf[woffset:], curr[shared:])
+			prev = curr
+			nItms++
+		}
+	}
+
+	binary.BigEndian.PutUint16(bufnitm, uint16(nItms))
+	return woffset, nil
+}
+
+func unmarshalPrefixItems(data []byte, nItms int) (itms []unsafe.Pointer, roffset int) {
+	var itmBuf []byte
+	offsets := make([]int, nItms)
+	prevOffset := 0
+	for i := 0; i < nItms; i++ {
+		shared := int(binary.BigEndian.Uint16(data[roffset : roffset+2]))
+		roffset += 2
+		l := int(binary.BigEndian.Uint16(data[roffset : roffset+2]))
+		roffset += 2
+
+		offsets[i] = len(itmBuf)
+		itmBuf = append(itmBuf, itmBuf[prevOffset:prevOffset+shared]...)
+		itmBuf = append(itmBuf, data[roffset:roffset+l]...)
+		prevOffset = offsets[i]
+		roffset += l
+	}
+
+	itms = make([]unsafe.Pointer, nItms)
+	for i, off := range offsets {
+		itms[i] = unsafe.Pointer(&itmBuf[off])
+	}
+
+	return itms, roffset
 }
 
 func (pg *page) marshal(buf []byte, woffset int, head *pageDelta,
-	hiItm unsafe.Pointer, child bool, maxSegments int) (offset int, staleFdSz int, numSegments int) {
+	hiItm unsafe.Pointer, child bool, maxSegments int) (offset int, staleFdSz int, numSegments int, err error) {
 
 	if head == nil {
 		return
 	}
 
+	if woffset+marshalDeltaHdrSize > len(buf) {
+		return woffset, 0, 0, ErrPageTooBig
+	}
+
 	var isFullMarshal bool = maxSegments == 0
 	stateBuf := buf[woffset : woffset+2]
 	hasReloc := false
@@ -750,7 +991,13 @@ func (pg *page) marshal(buf []byte, woffset int, head *pageDelta,
 		woffset += 2
 
 		// pageLow
-		woffset = pg.marshalIndexKey(pg.MinItem(), woffset, buf)
+		if woffset, err = pg.marshalIndexKey(pg.MinItem(), woffset, buf); err != nil {
+			return
+		}
+
+		if woffset+4 > len(buf) {
+			return woffset, 0, 0, ErrPageTooBig
+		}
 
 		// chainlen
 		binary.BigEndian.PutUint16(buf[woffset:woffset+2], uint16(head.chainLen))
@@ -761,13 +1008,19 @@ func (pg *page) marshal(buf []byte, woffset int, head *pageDelta,
 		woffset += 2
 
 		// pageHigh
-		woffset = pg.marshalIndexKey(pg.MaxItem(), woffset, buf)
+		if woffset, err = pg.marshalIndexKey(pg.MaxItem(), woffset, buf); err != nil {
+			return
+		}
 	}
 
 	pw := newPgDeltaWalker(head, pg.ctx)
 	defer pw.Close()
 loop:
 	for ; !pw.End(); pw.Next() {
+		if woffset+marshalDeltaHdrSize > len(buf) {
+			return woffset, 0, 0, ErrPageTooBig
+		}
+
 		op := pw.Op()
 		switch op {
 		case opInsertDelta, opDeleteDelta:
@@ -775,7 +1028,9 @@ loop:
 			if pg.cmp(itm, hiItm) < 0 {
 				binary.BigEndian.PutUint16(buf[woffset:woffset+2], uint16(op))
 				woffset += 2
-				woffset = pg.marshalItem(itm, woffset, buf)
+				if woffset, err = pg.marshalItem(itm, woffset, buf); err != nil {
+					return
+				}
 			}
 		case opPageSplitDelta:
 			itm := pw.Item()
@@ -787,7 +1042,9 @@ loop:
 		case opPageMergeDelta:
 			mergeSibling := pw.MergeSibling()
 			var fdSz int
-			woffset, fdSz, _ = pg.marshal(buf, woffset, mergeSibling, hiItm, true, 0)
+			if woffset, fdSz, _, err = pg.marshal(buf, woffset, mergeSibling, hiItm, true, 0); err != nil {
+				return
+			}
 			if !hasReloc {
 				staleFdSz += fdSz
 			}
@@ -796,12 +1053,22 @@ loop:
 				// Encode items as insertDelta
 				for _, itm := range pw.BaseItems() {
 					if pg.cmp(itm, hiItm) < 0 {
+						if woffset+2 > len(buf) {
+							return woffset, 0, 0, ErrPageTooBig
+						}
+
 						binary.BigEndian.PutUint16(buf[woffset:woffset+2], uint16(opInsertDelta))
 						woffset += 2
 
-						woffset = pg.marshalItem(itm, woffset, buf)
+						if woffset, err = pg.marshalItem(itm, woffset, buf); err != nil {
+							return
+						}
 					}
 				}
+			} else if pg.usePrefixCompression {
+				if woffset, err = pg.marshalPrefixBasePage(pw.BaseItems(), hiItm, woffset, buf); err != nil {
+					return
+				}
 			} else {
 				binary.BigEndian.PutUint16(buf[woffset:woffset+2], uint16(op))
 				woffset += 2
@@ -810,7 +1077,9 @@ loop:
 				woffset += 2
 				for _, itm := range pw.BaseItems() {
 					if pg.cmp(itm, hiItm) < 0 {
-						woffset = pg.marshalItem(itm, woffset, buf)
+						if woffset, err = pg.marshalItem(itm, woffset, buf); err != nil {
+							return
+						}
 						nItms++
 					}
 				}
@@ -826,6 +1095,7 @@ loop:
 				woffset += 2
 				binary.BigEndian.PutUint64(buf[woffset:woffset+8], uint64(offset))
 				woffset += 8
+				woffset += marshalChainOffsets(pw.NextPd(), buf[woffset:], maxFetchBlocks-1)
 				numSegments = int(numSegs)
 				break loop
 			}
@@ -845,6 +1115,16 @@ loop:
 			woffset += 8
 			binary.BigEndian.PutUint64(buf[woffset:woffset+8], uint64(end))
 			woffset += 8
+		case opRangeDeleteDelta:
+			rdd := pw.RangeDelete()
+			binary.BigEndian.PutUint16(buf[woffset:woffset+2], uint16(op))
+			woffset += 2
+			if woffset, err = pg.marshalIndexKey(rdd.low, woffset, buf); err != nil {
+				return
+			}
+			if woffset, err = pg.marshalIndexKey(rdd.high, woffset, buf); err != nil {
+				return
+			}
 		case opPageRemoveDelta, opMetaDelta, opSwapinDelta:
 		default:
 			panic(fmt.Sprintf("unknown delta %d", op))
@@ -863,7 +1143,67 @@ loop:
 	}
 
 	pw.SwapIn(pg)
-	return woffset, staleFdSz, numSegments
+	return woffset, staleFdSz, numSegments, nil
+}
+
+// marshalChainOffsets encodes the offsets of the older lss blocks of a page
+// which are known from the flush deltas below pd, up to max of them. They
+// follow the offset of the next block, so that a fetch can read the blocks
+// together instead of one after the other. Decoders which only follow the
+// offset of the next block ignore them.
+func marshalChainOffsets(pd *pageDelta, buf []byte, max int) int {
+	if len(buf) < 2 {
+		return 0
+	}
+
+	woffset := 2
+	n := 0
+loop:
+	for pd != nil && n < max && woffset+8 <= len(buf) {
+		var offset LSSOffset
+		switch pd.op {
+		case opBasePage:
+			break loop
+		case opFlushPageDelta, opRelocPageDelta:
+			offset = (*flushPageDelta)(unsafe.Pointer(pd)).offset
+		case opSwapoutDelta:
+			offset = (*swapoutDelta)(unsafe.Pointer(pd)).offset
+			binary.BigEndian.PutUint64(buf[woffset:woffset+8], uint64(offset))
+			woffset += 8
+			n++
+			break loop
+		case opSwapinDelta:
+			pd = (*swapinDelta)(unsafe.Pointer(pd)).ptr
+			continue
+		default:
+			pd = pd.next
+			continue
+		}
+
+		binary.BigEndian.PutUint64(buf[woffset:woffset+8], uint64(offset))
+		woffset += 8
+		n++
+		pd = pd.next
+	}
+
+	binary.BigEndian.PutUint16(buf[:2], uint16(n))
+	return woffset
+}
+
+// unmarshalChainOffsets appends the offsets encoded by marshalChainOffsets
+func unmarshalChainOffsets(data []byte, offsets []LSSOffset) []LSSOffset {
+	if len(data) < 2 {
+		return offsets
+	}
+
+	n := int(binary.BigEndian.Uint16(data[:2]))
+	data = data[2:]
+	for i := 0; i < n && len(data) >= 8; i++ {
+		offsets = append(offsets, LSSOffset(binary.BigEndian.Uint64(data[:8])))
+		data = data[8:]
+	}
+
+	return offsets
 }
 
 func getLSSPageMeta(data []byte) (itm unsafe.Pointer, pv uint16) {
@@ -887,6 +1227,14 @@ func (pg *page) Unmarshal(data []byte, ctx *wCtx) {
 }
 
 func (pg *page) unmarshalDelta(data []byte, ctx *wCtx) (offset LSSOffset, hasChain bool) {
+	offset, _, hasChain = pg.unmarshalDelta2(data, ctx, nil)
+	return
+}
+
+// unmarshalHeader decodes the header of a marshalled page, which leaves the
+// page with a meta delta holding the high key. Returns the high key and the
+// offset of the deltas following the header.
+func (pg *page) unmarshalHeader(data []byte) (unsafe.Pointer, int) {
 	roffset := 0
 	state := pageState(binary.BigEndian.Uint16(data[roffset : roffset+2]))
 	state.SetFlushed()
@@ -920,14 +1268,28 @@ func (pg *page) unmarshalDelta(data []byte, ctx *wCtx) (offset LSSOffset, hasCha
 		roffset += l
 	}
 
-	lastPd := (*pageDelta)(unsafe.Pointer(pg.allocMetaDelta(hiItm)))
-	lastPd.op = opMetaDelta
-	lastPd.state = state
-	lastPd.numItems = numItems
-	lastPd.chainLen = chainLen
-	lastPd.next = nil
-	lastPd.rightSibling = nil
-	pg.head = lastPd
+	pd := (*pageDelta)(unsafe.Pointer(pg.allocMetaDelta(hiItm)))
+	pd.op = opMetaDelta
+	pd.state = state
+	pd.numItems = numItems
+	pd.chainLen = chainLen
+	pd.itemsSz = uint32(len(data))
+	pd.next = nil
+	pd.rightSibling = nil
+	pg.head, pg.tail = pd, pd
+
+	return hiItm, roffset
+}
+
+// unmarshalDelta2 also appends the offsets of the blocks of the chain known
+// to follow the next block to chain
+func (pg *page) unmarshalDelta2(data []byte, ctx *wCtx, chain []LSSOffset) (LSSOffset, []LSSOffset, bool) {
+	var offset LSSOffset
+	var hasChain bool
+
+	hiItm, roffset := pg.unmarshalHeader(data)
+	state := pg.state
+	lastPd := pg.head
 
 	var pd *pageDelta
 loop:
@@ -967,11 +1329,21 @@ loop:
 				size += l
 			}
 
+			bp := pg.newBasePage(itms)
+			bp.state = state
+			pd = (*pageDelta)(unsafe.Pointer(bp))
+		case opBasePagePrefix:
+			nItms := int(binary.BigEndian.Uint16(data[roffset : roffset+2]))
+			roffset += 2
+			itms, n := unmarshalPrefixItems(data[roffset:], nItms)
+			roffset += n
+
 			bp := pg.newBasePage(itms)
 			bp.state = state
 			pd = (*pageDelta)(unsafe.Pointer(bp))
 		case opFlushPageDelta, opRelocPageDelta:
 			offset = LSSOffset(binary.BigEndian.Uint64(data[roffset : roffset+8]))
+			chain = unmarshalChainOffsets(data[roffset+8:], chain)
 			hasChain = true
 			break loop
 		case opRollbackDelta:
@@ -987,6 +1359,25 @@ loop:
 			pd = (*pageDelta)(unsafe.Pointer(rpd))
 			roffset += 16
 			pd.next = nil
+		case opRangeDeleteDelta:
+			low, high := skiplist.MinItem, skiplist.MaxItem
+			if l := int(binary.BigEndian.Uint16(data[roffset : roffset+2])); l > 0 {
+				low = unsafe.Pointer(&data[roffset+2])
+				roffset += l
+			}
+			roffset += 2
+
+			if l := int(binary.BigEndian.Uint16(data[roffset : roffset+2])); l > 0 {
+				high = unsafe.Pointer(&data[roffset+2])
+				roffset += l
+			}
+			roffset += 2
+
+			rdd := pg.allocRangeDeleteDelta(low, high)
+			*(*pageDelta)(unsafe.Pointer(rdd)) = *pg.head
+			rdd.next = nil
+			rdd.op = op
+			pd = (*pageDelta)(unsafe.Pointer(rdd))
 		}
 
 		lastPd.next = pd
@@ -994,7 +1385,7 @@ loop:
 	}
 
 	pg.tail = lastPd
-	return
+	return offset, chain, hasChain
 }
 
 func (pg *page) AddFlushRecord(offset LSSOffset, dataSz int, numSegments int) {
@@ -1188,8 +1579,71 @@ func (pg *page) GetFlushInfo() (LSSOffset, int, int) {
 }
 
 func (pg *page) Evict(offset LSSOffset, numSegments int) {
+	flushDataSz := flushedDataSize(pg.head)
+	pg.evict(offset, numSegments, nil)
+	(*swapoutDelta)(unsafe.Pointer(pg.head)).flushDataSz = int32(flushDataSz)
+}
+
+// GetLastFlushOffset returns the offset of the most recent block written
+// to the LSS for the page, if any
+func (pg *page) GetLastFlushOffset() (LSSOffset, bool) {
+	return lastFlushOffset(pg.head)
+}
+
+func lastFlushOffset(pd *pageDelta) (LSSOffset, bool) {
+	for ; pd != nil; pd = pd.next {
+		switch pd.op {
+		case opBasePage:
+			return 0, false
+		case opFlushPageDelta, opRelocPageDelta:
+			return (*flushPageDelta)(unsafe.Pointer(pd)).offset, true
+		case opSwapoutDelta:
+			return (*swapoutDelta)(unsafe.Pointer(pd)).offset, true
+		case opSwapinDelta:
+			return lastFlushOffset((*swapinDelta)(unsafe.Pointer(pd)).ptr)
+		}
+	}
+
+	return 0, false
+}
+
+// flushedDataSize returns the size of the lss data of a page using only the
+// deltas in memory. Swapout deltas record the size of the evicted data.
+func flushedDataSize(pd *pageDelta) int {
+	sz := 0
+	for ; pd != nil; pd = pd.next {
+		switch pd.op {
+		case opBasePage:
+			return sz
+		case opFlushPageDelta:
+			sz += int((*flushPageDelta)(unsafe.Pointer(pd)).flushDataSz)
+		case opRelocPageDelta:
+			return sz + int((*flushPageDelta)(unsafe.Pointer(pd)).flushDataSz)
+		case opSwapoutDelta:
+			return sz + int((*swapoutDelta)(unsafe.Pointer(pd)).flushDataSz)
+		}
+	}
+
+	return sz
+}
+
+// EvictCompressed evicts a flushed page while retaining its compressed
+// image in memory, which is decoded instead of reading the LSS on access
+func (pg *page) EvictCompressed(data []byte) {
+	flushDataSz := pg.GetFlushDataSize()
+	offset, numSegments, _ := pg.GetFlushInfo()
+	pg.evict(offset, numSegments, data)
+	(*swapoutDelta)(unsafe.Pointer(pg.head)).flushDataSz = int32(flushDataSz)
+}
+
+func (pg *page) IsCompressed() bool {
+	return pg.head != nil && pg.head.op == opSwapoutDelta &&
+		(*swapoutDelta)(unsafe.Pointer(pg.head)).dataLen > 0
+}
+
+func (pg *page) evict(offset LSSOffset, numSegments int, data []byte) {
 	pg.free(true)
-	sod := pg.allocSwapoutDelta(pg.head.hiItm)
+	sod := pg.allocSwapoutDelta(pg.head.hiItm, data)
 	hiItm := sod.hiItm
 	*(*pageDelta)(unsafe.Pointer(sod)) = *pg.head
 	sod.hiItm = hiItm
@@ -1207,6 +1661,71 @@ func (pg *page) Evict(offset LSSOffset, numSegments int) {
 	pg.head = (*pageDelta)(unsafe.Pointer(sod))
 }
 
+// recentDeltas returns the record deltas starting from pd along with the
+// flush delta below them
+func recentDeltas(pd *pageDelta) ([]*pageDelta, *flushPageDelta) {
+	var recs []*pageDelta
+	for ; pd != nil; pd = pd.next {
+		switch pd.op {
+		case opInsertDelta, opDeleteDelta:
+			recs = append(recs, pd)
+		case opFlushPageDelta, opRelocPageDelta:
+			return recs, (*flushPageDelta)(unsafe.Pointer(pd))
+		default:
+			return nil, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// EvictBase evicts the part of an incrementally flushed page persisted by
+// the previous flush while keeping the record deltas added after it in
+// memory. Returns false if the page cannot be partially evicted.
+func (pg *page) EvictBase() bool {
+	if pg.head == nil || pg.head.op != opFlushPageDelta {
+		return false
+	}
+
+	recs, fd := recentDeltas(pg.head.next)
+	if len(recs) == 0 || fd == nil {
+		return false
+	}
+
+	head := *(*flushPageDelta)(unsafe.Pointer(pg.head))
+	flushDataSz := flushedDataSize(&fd.pageDelta)
+	pg.free(true)
+
+	sod := pg.allocSwapoutDelta(fd.hiItm, nil)
+	hiItm := sod.hiItm
+	*(*pageDelta)(unsafe.Pointer(sod)) = fd.pageDelta
+	sod.hiItm = hiItm
+	sod.state.SetEvicted(true)
+	sod.op = opSwapoutDelta
+	sod.offset = fd.offset
+	sod.numSegments = fd.numSegments
+	sod.flushDataSz = int32(flushDataSz)
+	sod.next = nil
+	pg.head = (*pageDelta)(unsafe.Pointer(sod))
+
+	for i := len(recs) - 1; i >= 0; i-- {
+		rd := pg.allocRecordDelta((*recordDelta)(unsafe.Pointer(recs[i])).itm)
+		*(*pageDelta)(unsafe.Pointer(rd)) = *recs[i]
+		rd.hiItm = hiItm
+		rd.state.SetEvicted(true)
+		rd.next = pg.head
+		pg.head = (*pageDelta)(unsafe.Pointer(rd))
+	}
+
+	nfd := pg.allocFlushPageDelta()
+	*nfd = head
+	nfd.hiItm = hiItm
+	nfd.state.SetEvicted(true)
+	nfd.next = pg.head
+	pg.head = (*pageDelta)(unsafe.Pointer(nfd))
+	return true
+}
+
 func (pg *page) SwapIn(ptr *pageDelta) {
 	sid := pg.allocSwapinDelta()
 	sid.ptr = ptr
@@ -1265,12 +1784,15 @@ loop:
 			size += int(flushPageDeltaSize)
 		case opRollbackDelta:
 			size += int(rollbackDeltaSize)
+		case opRangeDeleteDelta:
+			rdd := (*rangeDeleteDelta)(unsafe.Pointer(pd))
+			size += int(rangeDeleteDeltaSize + itemSize(rdd.low) + itemSize(rdd.high))
 		case opMetaDelta:
 			mpd := (*metaPageDelta)(unsafe.Pointer(pd))
 			size += int(metaDeltaSize + itemSize(mpd.hiItm))
 		case opSwapoutDelta:
 			sod := (*swapoutDelta)(unsafe.Pointer(pd))
-			size += int(swapoutDeltaSize + itemSize(sod.hiItm))
+			size += int(swapoutDeltaSize+itemSize(sod.hiItm)) + int(sod.dataLen)
 			break loop
 		case opSwapinDelta:
 			sid := (*swapinDelta)(unsafe.Pointer(pd))
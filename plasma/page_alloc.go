@@ -6,16 +6,17 @@ import (
 )
 
 var (
-	metaDeltaSize       = unsafe.Sizeof(*new(metaPageDelta))
-	recDeltaSize        = unsafe.Sizeof(*new(recordDelta))
-	basePageSize        = unsafe.Sizeof(*new(basePage))
-	splitPageDeltaSize  = unsafe.Sizeof(*new(splitPageDelta))
-	mergePageDeltaSize  = unsafe.Sizeof(*new(mergePageDelta))
-	flushPageDeltaSize  = unsafe.Sizeof(*new(flushPageDelta))
-	removePageDeltaSize = unsafe.Sizeof(*new(removePageDelta))
-	rollbackDeltaSize   = unsafe.Sizeof(*new(rollbackDelta))
-	swapoutDeltaSize    = unsafe.Sizeof(*new(swapoutDelta))
-	swapinDeltaSize     = unsafe.Sizeof(*new(swapinDelta))
+	metaDeltaSize        = unsafe.Sizeof(*new(metaPageDelta))
+	recDeltaSize         = unsafe.Sizeof(*new(recordDelta))
+	basePageSize         = unsafe.Sizeof(*new(basePage))
+	splitPageDeltaSize   = unsafe.Sizeof(*new(splitPageDelta))
+	mergePageDeltaSize   = unsafe.Sizeof(*new(mergePageDelta))
+	flushPageDeltaSize   = unsafe.Sizeof(*new(flushPageDelta))
+	removePageDeltaSize  = unsafe.Sizeof(*new(removePageDelta))
+	rollbackDeltaSize    = unsafe.Sizeof(*new(rollbackDelta))
+	rangeDeleteDeltaSize = unsafe.Sizeof(*new(rangeDeleteDelta))
+	swapoutDeltaSize     = unsafe.Sizeof(*new(swapoutDelta))
+	swapinDeltaSize      = unsafe.Sizeof(*new(swapinDelta))
 )
 
 type pgFreeObj struct {
@@ -29,6 +30,8 @@ type allocCtx struct {
 	memUsed        int
 	nrecAllocs     int
 	nrecSwapin     int
+	// Size of the compressed page images allocated, part of memUsed
+	compressedUsed int
 }
 
 func (aCtx *allocCtx) GetAllocOps() ([]*pageDelta, []pgFreeObj, int, int, int) {
@@ -39,6 +42,7 @@ func (aCtx *allocCtx) GetAllocOps() ([]*pageDelta, []pgFreeObj, int, int, int) {
 	nrs := aCtx.nrecSwapin
 
 	aCtx.memUsed = 0
+	aCtx.compressedUsed = 0
 	aCtx.nrecAllocs = 0
 	aCtx.nrecSwapin = 0
 	aCtx.allocDeltaList = aCtx.allocDeltaList[:0]
@@ -231,25 +235,63 @@ func (pg *page) allocRollbackPageDelta() *rollbackDelta {
 	return new(rollbackDelta)
 }
 
-func (pg *page) allocSwapoutDelta(hiItm unsafe.Pointer) *swapoutDelta {
+func (pg *page) allocRangeDeleteDelta(low, high unsafe.Pointer) *rangeDeleteDelta {
+	ll, hl := pg.itemSize(low), pg.itemSize(high)
+	size := rangeDeleteDeltaSize + ll + hl
+	pg.memUsed += int(size)
+
+	if pg.useMemMgmt {
+		ptr := pg.allocMM(size)
+		d := (*rangeDeleteDelta)(ptr)
+		d.low, d.high = low, high
+		if ll > 0 {
+			d.low = unsafe.Pointer(uintptr(ptr) + rangeDeleteDeltaSize)
+			memcopy(d.low, low, int(ll))
+		}
+		if hl > 0 {
+			d.high = unsafe.Pointer(uintptr(ptr) + rangeDeleteDeltaSize + ll)
+			memcopy(d.high, high, int(hl))
+		}
+		pg.addDeltaAlloc(ptr)
+		return d
+	}
+
+	return &rangeDeleteDelta{low: pg.dup(low), high: pg.dup(high)}
+}
+
+// allocSwapoutDelta allocates a swapout delta which optionally retains the
+// compressed page image in data
+func (pg *page) allocSwapoutDelta(hiItm unsafe.Pointer, data []byte) *swapoutDelta {
 	l := pg.itemSize(hiItm)
-	size := swapoutDeltaSize + l
+	size := swapoutDeltaSize + l + uintptr(len(data))
 	pg.memUsed += int(size)
+	pg.compressedUsed += len(data)
 	if pg.useMemMgmt {
 		ptr := pg.allocMM(size)
 		d := (*swapoutDelta)(ptr)
 		if l == 0 {
 			d.hiItm = hiItm
 		} else {
-			d.hiItm = unsafe.Pointer(uintptr(ptr) + mergePageDeltaSize)
+			d.hiItm = unsafe.Pointer(uintptr(ptr) + swapoutDeltaSize)
 			memcopy(d.hiItm, hiItm, int(l))
 		}
+
+		d.data = nil
+		d.dataLen = int32(len(data))
+		if len(data) > 0 {
+			d.data = unsafe.Pointer(uintptr(ptr) + swapoutDeltaSize + l)
+			memcopy(d.data, unsafe.Pointer(&data[0]), len(data))
+		}
 		pg.addDeltaAlloc(ptr)
 		return (*swapoutDelta)(ptr)
 	}
 
 	d := new(swapoutDelta)
 	d.hiItm = pg.dup(hiItm)
+	if len(data) > 0 {
+		d.data = unsafe.Pointer(&data[0])
+		d.dataLen = int32(len(data))
+	}
 	return d
 }
 
@@ -1,6 +1,7 @@
 package plasma
 
 import (
+	"fmt"
 	"github.com/couchbase/nitro/skiplist"
 	"testing"
 	"unsafe"
@@ -81,14 +82,14 @@ func TestPageMarshalFull(t *testing.T) {
 	pg1.Compact()
 
 	buf := make([]byte, 1024*1024)
-	_, l1, _, numSegs1 := pg1.Marshal(buf, 100)
+	_, l1, _, numSegs1, _ := pg1.Marshal(buf, 100)
 	pg1.Split(sp)
 	pg1.AddFlushRecord(0, l1, numSegs1)
 
-	_, l2, _, numSegs2 := pg1.Marshal(buf, 100)
+	_, l2, _, numSegs2, _ := pg1.Marshal(buf, 100)
 	pg1.AddFlushRecord(0, l2, numSegs2)
 
-	_, l3, old, _ := pg1.Marshal(buf, FullMarshal)
+	_, l3, old, _, _ := pg1.Marshal(buf, FullMarshal)
 
 	if old != l1+l2 || l3 > old {
 		t.Errorf("expected %d == %d+%d", old, l1, l2)
@@ -97,16 +98,46 @@ func TestPageMarshalFull(t *testing.T) {
 	pg1.AddFlushRecord(0, l3, FullMarshal)
 	bk := skiplist.NewIntKeyItem(1)
 	pg1.Delete(bk)
-	_, l4, _, numSegs4 := pg1.Marshal(buf, 100)
+	_, l4, _, numSegs4, _ := pg1.Marshal(buf, 100)
 	pg1.AddFlushRecord(0, l4, numSegs4)
 
-	_, _, old2, _ := pg1.Marshal(buf, FullMarshal)
+	_, _, old2, _, _ := pg1.Marshal(buf, FullMarshal)
 
 	if old2 != l3+l4 {
 		t.Errorf("expected %d == %d+%d", old2, l3, l4)
 	}
 }
 
+func TestPageMarshalChainOffsets(t *testing.T) {
+	pg, _ := newTestPage()
+	buf := make([]byte, 1024*1024)
+	for i := 1; i <= 5; i++ {
+		pg.Insert(skiplist.NewIntKeyItem(i))
+		_, l, _, numSegs, _ := pg.Marshal(buf, 100)
+		pg.AddFlushRecord(LSSOffset(i*100), l, numSegs)
+	}
+
+	// Only the offsets of the blocks read together are recorded
+	pg.Insert(skiplist.NewIntKeyItem(6))
+	bs, _, _, _, err := pg.Marshal(buf, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newPg, _ := newTestPage()
+	next, chain, hasChain := newPg.unmarshalDelta2(bs, nil, nil)
+	if !hasChain || next != 500 || fmt.Sprint(chain) != "[400 300 200]" {
+		t.Errorf("expected chain 500 [400 300 200], got %d %v", next, chain)
+	}
+
+	// The older offsets are optional
+	newPg, _ = newTestPage()
+	next, chain, hasChain = newPg.unmarshalDelta2(bs[:len(bs)-2-3*8], nil, nil)
+	if !hasChain || next != 500 || len(chain) != 0 {
+		t.Errorf("expected chain 500 [], got %d %v", next, chain)
+	}
+}
+
 func TestPageMergeMarshal(t *testing.T) {
 	pg1, sp := newTestPage()
 	for i := 0; i < 1000; i++ {
@@ -140,7 +171,7 @@ func TestPageMergeMarshal(t *testing.T) {
 	}
 
 	encb := make([]byte, 1024*1024)
-	encb, _, _, _ = pg1.Marshal(encb, 100)
+	encb, _, _, _, _ = pg1.Marshal(encb, 100)
 
 	newPg, _ := newTestPage()
 	newPg.Unmarshal(encb, nil)
@@ -308,7 +339,7 @@ func TestPageMarshal(t *testing.T) {
 		pg.Delete(skiplist.NewIntKeyItem(i))
 	}
 
-	encb, _, _, _ := pg.Marshal(buf, 100)
+	encb, _, _, _, _ := pg.Marshal(buf, 100)
 	newPg, _ := newTestPage()
 	newPg.Unmarshal(encb, nil)
 
@@ -345,3 +376,107 @@ func TestPageMarshal(t *testing.T) {
 		t.Errorf("expected 1000 items, got %d", y)
 	}
 }
+
+func TestPageMarshalTooBig(t *testing.T) {
+	pg, _ := newTestPage()
+	for i := 0; i < 1000; i++ {
+		pg.Insert(skiplist.NewIntKeyItem(i))
+	}
+
+	full, _, _, _, err := pg.Marshal(make([]byte, 1024*1024), FullMarshal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sz := range []int{0, 10, len(full) / 2, len(full) - 1} {
+		if _, _, _, _, err := pg.Marshal(make([]byte, sz), FullMarshal); err != ErrPageTooBig {
+			t.Errorf("buffer of %d bytes: expected %v, got %v", sz, ErrPageTooBig, err)
+		}
+	}
+
+	pg.Compact()
+	if _, _, _, _, err := pg.Marshal(make([]byte, len(full)/2), FullMarshal); err != ErrPageTooBig {
+		t.Errorf("expected %v, got %v", ErrPageTooBig, err)
+	}
+
+	if bs, _, _, _, err := pg.Marshal(make([]byte, len(full)), FullMarshal); err != nil || len(bs) > len(full) {
+		t.Errorf("expected the page to fit (err=%v)", err)
+	}
+}
+
+func TestPagePrefixMarshal(t *testing.T) {
+	newPg := func(prefix bool) *page {
+		pg, _ := newTestPage()
+		pg.itemSize = func(x unsafe.Pointer) uintptr {
+			if x == skiplist.MinItem || x == skiplist.MaxItem {
+				return 0
+			}
+			return uintptr((*item)(x).Size())
+		}
+		pg.cmp = cmpItem
+		pg.usePrefixCompression = prefix
+		return pg
+	}
+
+	s := &Plasma{storeCtx: newPg(false).storeCtx}
+	pg1 := newPg(false)
+	pg2 := newPg(true)
+	for i := 0; i < 1000; i++ {
+		k := []byte(fmt.Sprintf("/users/profiles/eu-west/%010d", i))
+		itm := unsafe.Pointer(s.newItem(k, []byte("value"), 1, false, nil))
+		pg1.Insert(itm)
+		pg2.Insert(itm)
+	}
+
+	pg1.Compact()
+	pg2.Compact()
+
+	buf1 := make([]byte, 1024*1024)
+	buf2 := make([]byte, 1024*1024)
+	bs1, l1, _, _, _ := pg1.Marshal(buf1, FullMarshal)
+	bs2, l2, _, _, _ := pg2.Marshal(buf2, FullMarshal)
+	if l2 >= l1/2 {
+		t.Errorf("expected prefix compressed size %d to be much smaller than %d", l2, l1)
+	}
+
+	for _, bs := range [][]byte{bs1, bs2} {
+		pg := newPg(false)
+		pg.Unmarshal(bs, nil)
+		i := 0
+		itr := pg.NewIterator()
+		for itr.SeekFirst(); itr.Valid(); itr.Next() {
+			k := fmt.Sprintf("/users/profiles/eu-west/%010d", i)
+			if got := string((*item)(itr.Get()).Key()); got != k {
+				t.Errorf("expected %s, got %s", k, got)
+			}
+			i++
+		}
+
+		if i != 1000 {
+			t.Errorf("expected %d items, got %d", 1000, i)
+		}
+	}
+}
+
+func TestPageSwapoutDeltaLayout(t *testing.T) {
+	pg, _ := newTestPage()
+	pg.useMemMgmt = true
+
+	// The high key and the compressed image follow the delta
+	hiItm := skiplist.NewIntKeyItem(100)
+	data := []byte("compressed page image")
+	sod := pg.allocSwapoutDelta(hiItm, data)
+	defer pg.freeMM(unsafe.Pointer(sod))
+
+	if uintptr(sod.hiItm) != uintptr(unsafe.Pointer(sod))+swapoutDeltaSize {
+		t.Errorf("expected the high key to follow the delta")
+	}
+
+	if skiplist.CompareInt(sod.hiItm, hiItm) != 0 {
+		t.Errorf("expected high key %d, got %d", 100, skiplist.IntFromItem(sod.hiItm))
+	}
+
+	if string(sod.Data()) != string(data) {
+		t.Errorf("expected image %q, got %q", data, sod.Data())
+	}
+}
@@ -1,6 +1,7 @@
 package plasma
 
 import (
+	"context"
 	"github.com/couchbase/nitro/skiplist"
 	"sync"
 	"unsafe"
@@ -15,15 +16,25 @@ type RangePartition struct {
 }
 
 func (s *Plasma) PageVisitor(callb PageVisitorCallback, concurr int) error {
+	return s.PageVisitorContext(context.Background(), callb, concurr, nil, nil)
+}
+
+// PageVisitorContext visits the pages holding keys in the range
+// [low, high) like PageVisitor, where a nil bound leaves the range open on
+// that side. The page containing low is visited as well. The visit stops
+// once ctx is done, in which case the error of ctx is returned.
+func (s *Plasma) PageVisitorContext(ctx context.Context, callb PageVisitorCallback,
+	concurr int, low, high unsafe.Pointer) error {
+
 	var wg sync.WaitGroup
-	partitions := s.GetRangePartitions(concurr)
+	partitions := s.getRangePartitions(concurr, low, high)
 	errors := make([]error, len(partitions))
 
 	for _, partn := range partitions {
 		wg.Add(1)
 		go func(p RangePartition) {
 			defer wg.Done()
-			errors[p.Shard] = s.VisitPartition(p, callb)
+			errors[p.Shard] = s.visitPartition(ctx, p, callb)
 		}(partn)
 	}
 
@@ -39,6 +50,10 @@ func (s *Plasma) PageVisitor(callb PageVisitorCallback, concurr int) error {
 }
 
 func (s *Plasma) VisitPartition(partn RangePartition, callb PageVisitorCallback) error {
+	return s.visitPartition(context.Background(), partn, callb)
+}
+
+func (s *Plasma) visitPartition(ctx context.Context, partn RangePartition, callb PageVisitorCallback) error {
 	buf := s.Skiplist.MakeBuf()
 	itr := s.Skiplist.NewIterator(s.cmp, buf)
 	defer itr.Close()
@@ -51,6 +66,10 @@ func (s *Plasma) VisitPartition(partn RangePartition, callb PageVisitorCallback)
 	}
 
 	for itr.Seek(partn.MinKey); itr.Valid() && s.cmp(itr.Get(), partn.MaxKey) < 0; itr.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		pid := PageId(itr.GetNode())
 		if err := callb(pid, partn); err != nil {
 			return err
@@ -61,16 +80,43 @@ func (s *Plasma) VisitPartition(partn RangePartition, callb PageVisitorCallback)
 }
 
 func (s *Plasma) GetRangePartitions(n int) []RangePartition {
+	return s.getRangePartitions(n, nil, nil)
+}
+
+// getRangePartitions returns the partitions restricted to the pages holding
+// keys in the range [low, high). A partition starts at the page containing
+// low, so that the page is visited.
+func (s *Plasma) getRangePartitions(n int, low, high unsafe.Pointer) []RangePartition {
 	var partns []RangePartition
 	var shard int
 
+	if low != nil && high != nil && s.cmp(low, high) >= 0 {
+		return nil
+	}
+
 	barrier := s.Skiplist.GetAccesBarrier()
 	token := barrier.Acquire()
 	defer barrier.Release(token)
 
-	partns = append(partns, RangePartition{MinKey: skiplist.MinItem})
+	minKey := skiplist.MinItem
+	if low != nil {
+		buf := s.Skiplist.MakeBuf()
+		defer s.Skiplist.FreeBuf(buf)
+		if prev, curr, found := s.Skiplist.Lookup(low, s.cmp, buf, &s.Skiplist.Stats); found {
+			minKey = s.dup(curr.Item())
+		} else if prev != s.Skiplist.HeadNode() {
+			minKey = s.dup(prev.Item())
+		}
+	}
+
+	maxKey := skiplist.MaxItem
+	if high != nil {
+		maxKey = high
+	}
+
+	partns = append(partns, RangePartition{MinKey: minKey})
 	for _, key := range s.Skiplist.GetRangeSplitItems(n) {
-		if s.cmp(key, partns[shard].MinKey) > 0 {
+		if s.cmp(key, partns[shard].MinKey) > 0 && s.cmp(key, maxKey) < 0 {
 			key = s.dup(key)
 			partns[shard].MaxKey = key
 			shard++
@@ -78,6 +124,6 @@ func (s *Plasma) GetRangePartitions(n int) []RangePartition {
 		}
 	}
 
-	partns[shard].MaxKey = skiplist.MaxItem
+	partns[shard].MaxKey = maxKey
 	return partns
 }
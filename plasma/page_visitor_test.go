@@ -1,6 +1,7 @@
 package plasma
 
 import (
+	"context"
 	"fmt"
 	"github.com/couchbase/nitro/skiplist"
 	"os"
@@ -71,3 +72,65 @@ func TestPlasmaPageVisitor(t *testing.T) {
 
 	fmt.Println("Paritition counts", counts)
 }
+
+func TestPlasmaPageVisitorContext(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testCfg)
+	defer s.Close()
+
+	w := s.NewWriter()
+	for i := 0; i < 100000; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+
+	minKey := func(pg Page) int {
+		if pg.MinItem() == skiplist.MinItem {
+			return -1
+		}
+		return skiplist.IntFromItem(pg.MinItem())
+	}
+
+	low, high := skiplist.NewIntKeyItem(30000), skiplist.NewIntKeyItem(60000)
+	var expected []int
+	for pid := s.StartPageId(); pid != s.EndPageId(); pid = NextPid(pid) {
+		pg, _ := s.ReadPage(pid, nil, false, w.wCtx)
+		if s.cmp(pg.MinItem(), high) < 0 && s.cmp(pg.MaxItem(), low) > 0 {
+			expected = append(expected, minKey(pg))
+		}
+	}
+
+	var got []int
+	var mu sync.Mutex
+	callb := func(pid PageId, partn RangePartition) error {
+		pg, _ := s.ReadPage(pid, nil, false, w.wCtx)
+		mu.Lock()
+		got = append(got, minKey(pg))
+		mu.Unlock()
+		return nil
+	}
+
+	if err := s.PageVisitorContext(context.Background(), callb, 8, low, high); err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Ints(got)
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected pages %v, got %v", expected, got)
+	}
+
+	// The visit stops once the context is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	visited := 0
+	callb = func(pid PageId, partn RangePartition) error {
+		if visited++; visited == 10 {
+			cancel()
+		}
+		return nil
+	}
+
+	if err := s.PageVisitorContext(ctx, callb, 1, nil, nil); err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	} else if visited != 10 {
+		t.Errorf("expected 10 pages visited, got %d", visited)
+	}
+}
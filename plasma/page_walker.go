@@ -78,6 +78,10 @@ func (w *pageWalker) RollbackInfo() (uint64, uint64) {
 	return rb.start, rb.end
 }
 
+func (w *pageWalker) RangeDelete() *rangeDeleteDelta {
+	return (*rangeDeleteDelta)(unsafe.Pointer(w.currPd))
+}
+
 func (w *pageWalker) Next() {
 	if w.currPd.op == opBasePage {
 		w.maxCount = w.count
@@ -90,7 +94,7 @@ func (w *pageWalker) Next() {
 			var err error
 			sod := (*swapoutDelta)(unsafe.Pointer(w.currPd))
 			w.aCtx = new(allocCtx)
-			fetchPg, err := w.fetchPageFromLSS2(sod.offset, w.wCtx,
+			fetchPg, err := w.fetchSwapoutPage(sod, w.wCtx,
 				w.aCtx, w.wCtx.storeCtx)
 			if err != nil {
 				panic(fmt.Sprintf("fatal: %v", err))
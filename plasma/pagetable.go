@@ -18,6 +18,8 @@ type storeCtx struct {
 	getPageId        func(unsafe.Pointer, *wCtx) PageId
 	getCompactFilter FilterGetter
 	getLookupFilter  FilterGetter
+
+	usePrefixCompression bool
 }
 
 func (ctx *storeCtx) alloc(sz uintptr) unsafe.Pointer {
@@ -121,12 +123,16 @@ func (s *Plasma) UpdateMapping(pid PageId, pg Page, ctx *wCtx) bool {
 	n := pid.(*skiplist.Node)
 	pgi := pg.(*page)
 
+	compressed := pgi.compressedUsed
 	allocs, frees, nra, nrs, memUsed := pg.GetAllocOps()
 	newPtr := unsafe.Pointer(pgi.head)
 	if atomic.CompareAndSwapPointer(&n.Link, pgi.prevHeadPtr, newPtr) {
 		pgi.prevHeadPtr = newPtr
 
 		ctx.sts.AllocSz += int64(memUsed)
+		if compressed > 0 {
+			atomic.AddInt64(&s.compressedMemUsed, int64(compressed))
+		}
 		ctx.sts.NumRecordAllocs += int64(nra)
 		ctx.sts.NumRecordSwapIn += int64(nrs)
 
@@ -154,10 +160,11 @@ retry:
 	ptr := atomic.LoadPointer(&n.Link)
 	pg = newPage(ctx, n.Item(), ptr)
 
-	if swapin {
-		if s.tryPageSwapin(pg) && !s.UpdateMapping(pid, pg, ctx) {
+	if swapin && s.tryPageSwapin(pg) {
+		if !s.UpdateMapping(pid, pg, ctx) {
 			goto retry
 		}
+		s.publishPageEvent(EventSwapin, pid, pg)
 	}
 
 	return pg, nil
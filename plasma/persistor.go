@@ -2,6 +2,8 @@ package plasma
 
 import (
 	"encoding/binary"
+	"errors"
+	"sync"
 	"unsafe"
 )
 
@@ -20,6 +22,9 @@ const (
 	lssRecoveryPoints
 	lssMaxSn
 	lssDiscard
+	lssCheckpoint
+	lssValue
+	lssHeatMap
 )
 
 func discardLSSBlock(wbuf []byte) {
@@ -32,48 +37,100 @@ func writeLSSBlock(wbuf []byte, typ lssBlockType, bs []byte) {
 }
 
 func getLSSBlockType(bs []byte) lssBlockType {
-	return lssBlockType(binary.BigEndian.Uint16(bs))
+	return lssBlockType(binary.BigEndian.Uint16(bs) & lssBlockTypeMask)
 }
 
 func (s *Plasma) Persist(pid PageId, evict bool, ctx *wCtx) Page {
+	// Pages are kept in memory once the log has been given up on
+	if evict && s.writeFailed() != nil {
+		evict = false
+	}
+
+	// Nothing more is written to the log after an invariant violation
+	if s.failed() != nil {
+		pg, _ := s.ReadPage(pid, nil, false, ctx)
+		return pg
+	}
+
 	buf := ctx.GetBuffer(bufPersist)
 retry:
 
 	// Never read from lss
 	pg, _ := s.ReadPage(pid, nil, false, ctx)
-	if pg.NeedsFlush() {
-		bs, dataSz, staleFdSz, numSegments := pg.Marshal(buf, s.Config.MaxPageLSSSegments)
+	if pg.NeedsFlush() && !s.readOnly {
+		bs, _, staleFdSz, numSegments, err := pg.Marshal(buf, s.Config.MaxPageLSSSegments)
+		if err == ErrPageTooBig {
+			// Pages which grew too big to be written are split instead
+			if err = s.splitOversizedPage(pid, ctx); err == nil {
+				goto retry
+			}
+		}
+
+		if err != nil {
+			// The page is retained in memory, since it cannot be written
+			s.logger("persistor").Errorf("unable to flush page (err=%v)", err)
+			return pg
+		}
+
+		typ, bs := s.compressPageBlock(pgFlushLSSType(pg, numSegments), bs)
+		dataSz := len(bs)
 		offset, wbuf, res := s.lss.ReserveSpace(lssBlockTypeSize + len(bs))
-		typ := pgFlushLSSType(pg, numSegments)
 		writeLSSBlock(wbuf, typ, bs)
 
 		var ok bool
+		staleOff, _ := pg.GetLastFlushOffset()
+		pg.AddFlushRecord(offset, dataSz, numSegments)
 		if evict {
-			pg.Evict(offset, numSegments)
-		} else {
-			pg.AddFlushRecord(offset, dataSz, numSegments)
+			s.evictPage(pg, ctx)
 		}
 
 		if ok = s.UpdateMapping(pid, pg, ctx); ok {
 			s.lss.FinalizeWrite(res)
 			ctx.sts.FlushDataSz += int64(dataSz) - int64(staleFdSz)
+			s.trackLSSUsage(staleOff, staleFdSz, offset, dataSz)
+			if evict {
+				s.publishPageEvent(EventEvict, pid, pg)
+			}
 		} else {
 			discardLSSBlock(wbuf)
 			s.lss.FinalizeWrite(res)
 			goto retry
 		}
-	} else if evict && pg.IsEvictable() {
-		offset, numSegs, _ := pg.GetFlushInfo()
-		pg.Evict(offset, numSegs)
+	} else if evict && (pg.IsEvictable() || pg.IsCompressed()) {
+		s.evictPage(pg, ctx)
 		if !s.UpdateMapping(pid, pg, ctx) {
 			goto retry
 		}
+		s.publishPageEvent(EventEvict, pid, pg)
 	}
 
 	return pg
 }
 
+// evictPage evicts a flushed page. Depending on the config, the recent
+// deltas or a compressed image of the page are retained in memory. Pages
+// which are already compressed are evicted completely.
+func (s *Plasma) evictPage(pg Page, ctx *wCtx) {
+	// The recent deltas can only be retained above the blocks of an
+	// incremental flush, since a full flush makes the previous ones stale
+	offset, numSegs, _ := pg.GetFlushInfo()
+	if s.PartialEviction && numSegs > 0 && pg.EvictBase() {
+		return
+	}
+
+	if data, ok := s.compressPage(pg, ctx); ok {
+		pg.EvictCompressed(data)
+		return
+	}
+
+	pg.Evict(offset, numSegs)
+}
+
 func (s *Plasma) PersistAll() {
+	if s.readOnly {
+		return
+	}
+
 	callb := func(pid PageId, partn RangePartition) error {
 		s.Persist(pid, false, s.persistWriters[partn.Shard])
 		return nil
@@ -83,13 +140,106 @@ func (s *Plasma) PersistAll() {
 	s.lss.Sync(false)
 }
 
-func (s *Plasma) EvictAll() {
+// Sync persists all the pages and makes the writes which completed before
+// the call durable irrespective of the sync mode. Concurrent calls are
+// grouped, so that the calls made while a sync is in progress share the
+// next one.
+func (s *Plasma) Sync() error {
+	if !s.shouldPersist {
+		return ErrNoLog
+	} else if s.readOnly {
+		return ErrReadOnly
+	}
+
+	return s.syncGroup.do(func() error {
+		s.PersistAll()
+		// Values have to be durable before the pages pointing to them
+		if s.vlog != nil {
+			s.vlog.Commit()
+		}
+		s.lss.Commit()
+		return nil
+	})
+}
+
+// groupCommit runs a commit for a group of concurrent callers. A caller
+// waits for a commit which started after the call, which the first caller
+// to find no commit in progress runs on behalf of the callers waiting.
+type groupCommit struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	active bool
+
+	// Number of commits started and finished and the error of the last
+	// commit finished
+	started, finished uint64
+	err               error
+}
+
+func (g *groupCommit) do(commit func() error) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.cond == nil {
+		g.cond = sync.NewCond(&g.mu)
+	}
+
+	target := g.started + 1
+	for g.finished < target {
+		if g.active {
+			g.cond.Wait()
+			continue
+		}
+
+		g.active = true
+		g.started++
+		n := g.started
+		g.mu.Unlock()
+		err := commit()
+		g.mu.Lock()
+
+		g.finished, g.err = n, err
+		g.active = false
+		g.cond.Broadcast()
+	}
+
+	return g.err
+}
+
+var errEvictDone = errors.New("evict done")
+
+// EvictAll swaps out pages until the memory used by the instance drops to
+// targetBytes, so that the memory of idle instances can be released on
+// demand. Every page is swapped out if targetBytes is zero. Pages of the
+// ranges pinned by PinRange are kept in memory.
+func (s *Plasma) EvictAll(targetBytes int64) {
+	ctxs := make([]*wCtx, s.NumPersistorThreads)
+	for i := range ctxs {
+		ctxs[i] = s.newWCtx()
+	}
+
 	callb := func(pid PageId, partn RangePartition) error {
-		s.Persist(pid, true, s.evictWriters[partn.Shard])
+		if targetBytes > 0 && s.MemoryInUse() <= targetBytes {
+			return errEvictDone
+		}
+
+		ctx := ctxs[partn.Shard]
+		tok := ctx.BeginTx()
+		defer ctx.EndTx(tok)
+
+		if !s.isPagePinned(pid, ctx) {
+			s.Persist(pid, true, ctx)
+		}
 		return nil
 	}
 
-	s.PageVisitor(callb, s.NumPersistorThreads)
+	s.PageVisitor(callb, len(ctxs))
+
+	// The memory of the evicted pages is reclaimed once the operations
+	// which may still read it have finished
+	for _, ctx := range ctxs {
+		s.retireWCtx(ctx)
+	}
 }
 
 func pgFlushLSSType(pg Page, numSegments int) lssBlockType {
@@ -0,0 +1,135 @@
+package plasma
+
+import (
+	"github.com/couchbase/nitro/skiplist"
+	"sync/atomic"
+	"unsafe"
+)
+
+type pinnedRange struct {
+	low, high unsafe.Pointer
+}
+
+// PinRange keeps the pages holding keys in [low, high) resident in memory.
+// A nil bound leaves the range open on that side. Pages of the range which
+// are already evicted stay on disk until they are accessed.
+func (s *Plasma) PinRange(low, high unsafe.Pointer) {
+	r := pinnedRange{
+		low:  s.copyKey(low, skiplist.MinItem),
+		high: s.copyKey(high, skiplist.MaxItem),
+	}
+
+	s.pinLock.Lock()
+	defer s.pinLock.Unlock()
+	s.pinnedRanges = append(s.pinnedRanges, r)
+	atomic.StoreInt32(&s.numPinnedRanges, int32(len(s.pinnedRanges)))
+}
+
+// UnpinRange removes a range added by PinRange with the same bounds
+func (s *Plasma) UnpinRange(low, high unsafe.Pointer) bool {
+	if low == nil {
+		low = skiplist.MinItem
+	}
+
+	if high == nil {
+		high = skiplist.MaxItem
+	}
+
+	s.pinLock.Lock()
+	defer s.pinLock.Unlock()
+	for i, r := range s.pinnedRanges {
+		if s.cmp(r.low, low) == 0 && s.cmp(r.high, high) == 0 {
+			s.pinnedRanges = append(s.pinnedRanges[:i], s.pinnedRanges[i+1:]...)
+			atomic.StoreInt32(&s.numPinnedRanges, int32(len(s.pinnedRanges)))
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Plasma) copyKey(itm unsafe.Pointer, def unsafe.Pointer) unsafe.Pointer {
+	if itm == nil {
+		return def
+	}
+
+	sz := int(s.itemSize(itm))
+	if sz == 0 {
+		return itm
+	}
+
+	buf := make([]byte, sz)
+	memcopy(unsafe.Pointer(&buf[0]), itm, sz)
+	return unsafe.Pointer(&buf[0])
+}
+
+func (s *Plasma) isPinnedRange(low, high unsafe.Pointer) bool {
+	for _, r := range s.pinnedRanges {
+		if s.cmp(low, r.high) < 0 && s.cmp(r.low, high) < 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isPagePinned reports whether the page overlaps with a pinned range
+func (s *Plasma) isPagePinned(pid PageId, ctx *wCtx) bool {
+	s.pinLock.RLock()
+	defer s.pinLock.RUnlock()
+
+	if len(s.pinnedRanges) == 0 {
+		return false
+	}
+
+	pg, _ := s.ReadPage(pid, nil, false, ctx)
+	return s.isPinnedRange(pg.MinItem(), pg.MaxItem())
+}
+
+// pinnedMemUsed returns the memory used by pages overlapping with the
+// pinned ranges. The pages are walked under pinLock, which serializes the
+// uses of pinWriter.
+func (s *Plasma) pinnedMemUsed() int64 {
+	if atomic.LoadInt32(&s.numPinnedRanges) == 0 {
+		return 0
+	}
+
+	s.pinLock.Lock()
+	defer s.pinLock.Unlock()
+
+	var sz int64
+	ctx := s.pinWriter
+	tok := ctx.BeginTx()
+	defer ctx.EndTx(tok)
+
+	visited := make(map[PageId]bool)
+	for _, r := range s.pinnedRanges {
+		pid := s.StartPageId()
+		if r.low != skiplist.MinItem {
+			prev, curr, found := s.Skiplist.Lookup(r.low, s.cmp, ctx.buf, ctx.slSts)
+			if pid = PageId(prev); found {
+				pid = PageId(curr)
+			}
+		}
+
+		for {
+			pg, _ := s.ReadPage(pid, nil, false, ctx)
+			if s.cmp(pg.MinItem(), r.high) >= 0 {
+				break
+			}
+
+			// Pinned ranges may overlap
+			if !visited[pid] {
+				visited[pid] = true
+				sz += int64(pg.ComputeMemUsed())
+			}
+
+			if pg.MaxItem() == skiplist.MaxItem {
+				break
+			}
+			pid = pg.Next()
+		}
+	}
+
+	return sz
+}
@@ -0,0 +1,97 @@
+package plasma
+
+import (
+	"github.com/couchbase/nitro/skiplist"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPlasmaPinRange(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	cfg := testCfg
+	cfg.AutoSwapper = true
+	cfg.MemQuota = 1024 * 1024
+	s := newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	low, high := skiplist.NewIntKeyItem(10000), skiplist.NewIntKeyItem(20000)
+	s.PinRange(low, high)
+
+	n := 200000
+	w := s.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+
+	s.PersistAll()
+	for i := 0; i < 100 && s.MemoryInUse() >= cfg.MemQuota; i++ {
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	sts := s.GetStats()
+	if sts.NumRecordSwapOut == 0 {
+		t.Errorf("expected records to be swapped out")
+	}
+
+	if sts.PinnedSz == 0 {
+		t.Errorf("expected pinned memory to be reported")
+	}
+
+	nr := w.wCtx.sts.NumLSSReads
+	for i := 10000; i < 20000; i++ {
+		itm := skiplist.NewIntKeyItem(i)
+		if got, _ := w.Lookup(itm); skiplist.CompareInt(itm, got) != 0 {
+			t.Fatalf("mismatch %d", i)
+		}
+	}
+
+	if w.wCtx.sts.NumLSSReads != nr {
+		t.Errorf("expected pinned pages to be resident")
+	}
+
+	if !s.UnpinRange(low, high) {
+		t.Errorf("expected range to be unpinned")
+	}
+
+	if sts := s.GetStats(); sts.PinnedSz != 0 {
+		t.Errorf("expected no pinned memory, got %d", sts.PinnedSz)
+	}
+}
+
+func TestPlasmaPinRangeConcurrentStats(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testCfg)
+	defer s.Close()
+
+	s.PinRange(nil, nil)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					s.GetStats()
+				}
+			}
+		}()
+	}
+
+	w := s.NewWriter()
+	for i := 0; i < 100000; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+	close(done)
+	wg.Wait()
+
+	if sts := s.GetStats(); sts.PinnedSz == 0 || sts.PinnedSz > sts.MemSz {
+		t.Errorf("expected pinned memory within %d, got %d", sts.MemSz, sts.PinnedSz)
+	}
+}
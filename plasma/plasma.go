@@ -1,19 +1,28 @@
 package plasma
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/couchbase/nitro/mm"
 	"github.com/couchbase/nitro/skiplist"
+	"math"
+	"os"
+	"path/filepath"
 	"runtime"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 	"unsafe"
 )
 
 type PageReader func(offset LSSOffset) (Page, error)
 
-const maxCtxBuffers = 8
+const maxCtxBuffers = 11
 const (
 	bufEncPage int = iota
 	bufEncMeta
@@ -23,6 +32,11 @@ const (
 	bufRecovery
 	bufFetch
 	bufPersist
+	bufDecompress
+	bufCompressPage
+	// Items written by InsertKV and DeleteKV, which are kept apart from the
+	// items looked up while writing them
+	bufKVItem
 )
 
 const recoverySMRInterval = 100
@@ -43,14 +57,26 @@ type Plasma struct {
 	*skiplist.Skiplist
 	wlist                           []*Writer
 	lss                             LSS
+	lssRegions                      *lssRegionStats
 	lssCleanerWriter                *wCtx
+	checkpointWriter                *wCtx
 	persistWriters                  []*wCtx
 	evictWriters                    []*wCtx
 	stoplssgc, stopswapper, stopmon chan struct{}
+	stopdefrag                      chan struct{}
+	stopcheckpoint                  chan struct{}
+	stoprp                          chan struct{}
+	stopheatmap                     chan struct{}
+
+	// Low items of the pages to be fetched ahead of scans
+	readAheadCh   chan unsafe.Pointer
+	stopreadahead chan struct{}
+	readAheadWg   sync.WaitGroup
 	sync.RWMutex
 
 	// MVCC data structures
 	itemsCount   int64
+	itemsKeySum  uint64
 	mvcc         sync.RWMutex
 	currSn       uint64
 	numSnCreated int
@@ -59,6 +85,11 @@ type Plasma struct {
 
 	lastMaxSn uint64
 
+	// Offsets and values of the max sn blocks replayed by the recovery,
+	// which starts at recoveryStart
+	recoveredMaxSns []recoveredMaxSn
+	recoveryStart   LSSOffset
+
 	rpSns          unsafe.Pointer
 	rpVersion      uint16
 	recoveryPoints []*RecoveryPoint
@@ -67,6 +98,11 @@ type Plasma struct {
 	clockHandle       *clockHandle
 	clockLock         sync.Mutex
 
+	// Latest heat map written to or recovered from the log
+	heatMapLock   sync.Mutex
+	heatMap       []byte
+	heatMapWriter *wCtx
+
 	smrWg   sync.WaitGroup
 	smrChan chan unsafe.Pointer
 
@@ -75,60 +111,182 @@ type Plasma struct {
 	wCtxLock sync.Mutex
 	wCtxList *wCtx
 	gCtx     *wCtx
+	// Stats of the contexts of closed writers and readers
+	retiredSts Stats
+
+	closed    int32
+	closeDone chan struct{}
+
+	// Error of the first internal invariant violation, if any
+	fatalErr unsafe.Pointer
+	// Error of the write to the log which failed for good, if any
+	writeErr unsafe.Pointer
+	// Error of the read-only mode, if the instance is in it
+	roModeErr unsafe.Pointer
+	// Error of the exceeded LSS quota, if it is exceeded
+	lssQuotaErr  unsafe.Pointer
+	lssUsedSpace int64
+
+	numExpired  int64
+	numFiltered int64
+
+	checkpointLock sync.Mutex
+	ckptPinOffset  uint64
+
+	pinLock      sync.RWMutex
+	pinnedRanges []pinnedRange
+	pinWriter    *wCtx
+
+	// Number of pinned ranges, which is read without pinLock to skip
+	// walking the pages when there are none
+	numPinnedRanges int32
+
+	// Memory used by the compressed images of evicted pages
+	compressedMemUsed int64
+
+	estimateLock   sync.Mutex
+	estimateWriter *wCtx
+
+	defragLock   sync.Mutex
+	defragWriter *wCtx
+
+	ingestLock   sync.Mutex
+	ingestWriter *Writer
+
+	syncGroup groupCommit
+
+	tailLock sync.Mutex
+	tailers  map[*logTailer]struct{}
+
+	eventLock     sync.RWMutex
+	eventMask     uint32
+	subscriptions map[*Subscription]struct{}
+
+	applyLogLock   sync.Mutex
+	applyLogWriter *wCtx
+
+	vlog              LSS
+	vlogCleanLock     sync.Mutex
+	vlogCleanerWriter *wCtx
+	vlogSafeOffset    uint64
+	vlogBaseSize      int64
+	stopvlog          chan struct{}
+
+	// Held shared by the daemons while they work, so that pausing them
+	// waits for the work in progress
+	maintenanceLock   sync.RWMutex
+	maintenancePaused int32
+
+	statsLock sync.Mutex
+	statsBase Stats
 }
 
+// Stats holds the counters of an instance. The JSON field names are
+// stable and match the names used by String. The fields which only
+// increase are tagged as counters for the exporters of the statistics,
+// the others are gauges.
 type Stats struct {
-	Compacts int64
-	Splits   int64
-	Merges   int64
-	Inserts  int64
-	Deletes  int64
+	Compacts int64 `json:"compacts" metric:"counter"`
+	Splits   int64 `json:"splits" metric:"counter"`
+	Merges   int64 `json:"merges" metric:"counter"`
+	Inserts  int64 `json:"inserts" metric:"counter"`
+	Deletes  int64 `json:"deletes" metric:"counter"`
+
+	// Pages updated by DeleteRange. The items it removes are not counted
+	// as deletes, since the pages are not read to find them.
+	RangeDeletes int64 `json:"range_deletes" metric:"counter"`
+
+	CompactConflicts int64 `json:"compact_conflicts" metric:"counter"`
+	SplitConflicts   int64 `json:"split_conflicts" metric:"counter"`
+	MergeConflicts   int64 `json:"merge_conflicts" metric:"counter"`
+	InsertConflicts  int64 `json:"insert_conflicts" metric:"counter"`
+	DeleteConflicts  int64 `json:"delete_conflicts" metric:"counter"`
+	SwapInConflicts  int64 `json:"swapin_conflicts" metric:"counter"`
+
+	Defrags         int64 `json:"defrags" metric:"counter"`
+	DefragConflicts int64 `json:"defrag_conflicts" metric:"counter"`
+
+	Checkpoints int64 `json:"checkpoints" metric:"counter"`
+
+	ExpiredItems  int64 `json:"expired_items" metric:"counter"`
+	FilteredItems int64 `json:"filtered_items" metric:"counter"`
+
+	BytesIncoming int64 `json:"bytes_incoming" metric:"counter"`
+	BytesWritten  int64 `json:"bytes_written" metric:"counter"`
+
+	FlushDataSz int64 `json:"flush_data_size"`
+
+	// Memory quota of the instance, or the process wide quota if it has
+	// none
+	MemQuota int64 `json:"memory_quota"`
+
+	MemSz        int64 `json:"memory_size"`
+	MemSzIndex   int64 `json:"memory_size_index"`
+	PinnedSz     int64 `json:"memory_pinned"`
+	CompressedSz int64 `json:"memory_compressed"`
+
+	AllocSz   int64 `json:"allocated" metric:"counter"`
+	FreeSz    int64 `json:"freed" metric:"counter"`
+	ReclaimSz int64 `json:"reclaimed" metric:"counter"`
+
+	NumRecordAllocs  int64 `json:"num_rec_allocs" metric:"counter"`
+	NumRecordFrees   int64 `json:"num_rec_frees" metric:"counter"`
+	NumRecordSwapOut int64 `json:"num_rec_swapout" metric:"counter"`
+	NumRecordSwapIn  int64 `json:"num_rec_swapin" metric:"counter"`
+	AllocSzIndex     int64 `json:"allocated_index" metric:"counter"`
+	FreeSzIndex      int64 `json:"freed_index" metric:"counter"`
+	ReclaimSzIndex   int64 `json:"reclaimed_index" metric:"counter"`
+
+	NumPages int64 `json:"num_pages"`
+
+	LSSFrag      int   `json:"lss_fragmentation"`
+	LSSDataSize  int64 `json:"lss_data_size"`
+	LSSUsedSpace int64 `json:"lss_used_space"`
 
-	CompactConflicts int64
-	SplitConflicts   int64
-	MergeConflicts   int64
-	InsertConflicts  int64
-	DeleteConflicts  int64
-	SwapInConflicts  int64
+	// Config.MaxLSSUsedSpace and the space left until it is reached, both
+	// zero if there is no quota
+	LSSQuota    int64 `json:"lss_quota"`
+	LSSHeadroom int64 `json:"lss_headroom"`
 
-	BytesIncoming int64
-	BytesWritten  int64
+	NumLSSReads  int64 `json:"lss_num_reads" metric:"counter"`
+	LSSReadBytes int64 `json:"lss_read_bs" metric:"counter"`
 
-	FlushDataSz int64
+	NumLSSCleanerReads  int64 `json:"lss_gc_num_reads" metric:"counter"`
+	LSSCleanerReadBytes int64 `json:"lss_gc_reads_bs" metric:"counter"`
 
-	MemSz      int64
-	MemSzIndex int64
+	// Size of the torn log tail truncated by recovery
+	LSSTruncatedBytes int64 `json:"lss_truncated_bs"`
 
-	AllocSz   int64
-	FreeSz    int64
-	ReclaimSz int64
+	VLogUsedSpace int64 `json:"vlog_used_space"`
 
-	NumRecordAllocs  int64
-	NumRecordFrees   int64
-	NumRecordSwapOut int64
-	NumRecordSwapIn  int64
-	AllocSzIndex     int64
-	FreeSzIndex      int64
-	ReclaimSzIndex   int64
+	NumCompressedReads int64 `json:"compressed_reads" metric:"counter"`
 
-	NumPages int64
+	// Pages fetched ahead of scans
+	ReadAheads int64 `json:"read_aheads" metric:"counter"`
 
-	LSSFrag      int
-	LSSDataSize  int64
-	LSSUsedSpace int64
-	NumLSSReads  int64
-	LSSReadBytes int64
+	CacheHits   int64 `json:"cache_hits" metric:"counter"`
+	CacheMisses int64 `json:"cache_misses" metric:"counter"`
 
-	NumLSSCleanerReads  int64
-	LSSCleanerReadBytes int64
+	// Operations made to wait for memory to be freed, the time they waited
+	// and the Try operations which failed with ErrWouldThrottle instead
+	ThrottleStalls    int64 `json:"throttle_stalls" metric:"counter"`
+	ThrottleStallTime int64 `json:"throttle_stall_ns" metric:"counter"`
+	ThrottleRejects   int64 `json:"throttle_rejects" metric:"counter"`
 
-	CacheHits   int64
-	CacheMisses int64
+	// Delta chain length of the pages read by operations and iterators,
+	// size of the marshaled pages and number of segments of the pages
+	// fetched from the LSS, e.g. to tune MaxDeltaChainLen and
+	// MaxPageLSSSegments
+	ChainLenHist      Pow2Histogram `json:"chain_len_hist" metric:"counter"`
+	PageSizeHist      Pow2Histogram `json:"page_size_hist" metric:"counter"`
+	FetchSegmentsHist Pow2Histogram `json:"fetch_segments_hist" metric:"counter"`
 
-	WriteAmp      float64
-	WriteAmpAvg   float64
-	CacheHitRatio float64
-	ResidentRatio float64
+	LSSStalls LSSStallStats `json:"lss_stalls"`
+
+	WriteAmp      float64 `json:"write_amp"`
+	WriteAmpAvg   float64 `json:"write_amp_avg"`
+	CacheHitRatio float64 `json:"cache_hit_ratio"`
+	ResidentRatio float64 `json:"resident_ratio"`
 }
 
 func (s *Stats) Merge(o *Stats) {
@@ -137,6 +295,7 @@ func (s *Stats) Merge(o *Stats) {
 	s.Merges += o.Merges
 	s.Inserts += o.Inserts
 	s.Deletes += o.Deletes
+	s.RangeDeletes += o.RangeDeletes
 
 	s.CompactConflicts += o.CompactConflicts
 	s.SplitConflicts += o.SplitConflicts
@@ -145,13 +304,17 @@ func (s *Stats) Merge(o *Stats) {
 	s.DeleteConflicts += o.DeleteConflicts
 	s.SwapInConflicts += o.SwapInConflicts
 
+	s.Defrags += o.Defrags
+	s.DefragConflicts += o.DefragConflicts
+	s.Checkpoints += o.Checkpoints
+
 	s.AllocSz += o.AllocSz
 	s.FreeSz += o.FreeSz
 	s.ReclaimSz += o.ReclaimSz
 
 	s.AllocSzIndex += o.AllocSzIndex
 	s.FreeSzIndex += o.FreeSzIndex
-	o.ReclaimSzIndex += o.ReclaimSzIndex
+	s.ReclaimSzIndex += o.ReclaimSzIndex
 
 	s.NumRecordAllocs += o.NumRecordAllocs
 	s.NumRecordFrees += o.NumRecordFrees
@@ -162,9 +325,90 @@ func (s *Stats) Merge(o *Stats) {
 
 	s.NumLSSReads += o.NumLSSReads
 	s.LSSReadBytes += o.LSSReadBytes
+	s.NumCompressedReads += o.NumCompressedReads
+	s.ReadAheads += o.ReadAheads
 
 	s.CacheHits += o.CacheHits
 	s.CacheMisses += o.CacheMisses
+
+	s.ThrottleStalls += o.ThrottleStalls
+	s.ThrottleStallTime += o.ThrottleStallTime
+	s.ThrottleRejects += o.ThrottleRejects
+
+	s.ChainLenHist.merge(&o.ChainLenHist)
+	s.PageSizeHist.merge(&o.PageSizeHist)
+	s.FetchSegmentsHist.merge(&o.FetchSegmentsHist)
+}
+
+// sub subtracts the cumulative counters of o. The gauges, e.g. the memory
+// and log sizes, are retained.
+func (s *Stats) sub(o *Stats) {
+	s.Compacts -= o.Compacts
+	s.Splits -= o.Splits
+	s.Merges -= o.Merges
+	s.Inserts -= o.Inserts
+	s.Deletes -= o.Deletes
+	s.RangeDeletes -= o.RangeDeletes
+
+	s.CompactConflicts -= o.CompactConflicts
+	s.SplitConflicts -= o.SplitConflicts
+	s.MergeConflicts -= o.MergeConflicts
+	s.InsertConflicts -= o.InsertConflicts
+	s.DeleteConflicts -= o.DeleteConflicts
+	s.SwapInConflicts -= o.SwapInConflicts
+
+	s.Defrags -= o.Defrags
+	s.DefragConflicts -= o.DefragConflicts
+	s.Checkpoints -= o.Checkpoints
+
+	s.ExpiredItems -= o.ExpiredItems
+	s.FilteredItems -= o.FilteredItems
+
+	s.BytesIncoming -= o.BytesIncoming
+	s.BytesWritten -= o.BytesWritten
+
+	s.AllocSz -= o.AllocSz
+	s.FreeSz -= o.FreeSz
+	s.ReclaimSz -= o.ReclaimSz
+
+	s.AllocSzIndex -= o.AllocSzIndex
+	s.FreeSzIndex -= o.FreeSzIndex
+	s.ReclaimSzIndex -= o.ReclaimSzIndex
+
+	s.NumRecordAllocs -= o.NumRecordAllocs
+	s.NumRecordFrees -= o.NumRecordFrees
+	s.NumRecordSwapOut -= o.NumRecordSwapOut
+	s.NumRecordSwapIn -= o.NumRecordSwapIn
+
+	s.NumLSSReads -= o.NumLSSReads
+	s.LSSReadBytes -= o.LSSReadBytes
+	s.NumLSSCleanerReads -= o.NumLSSCleanerReads
+	s.LSSCleanerReadBytes -= o.LSSCleanerReadBytes
+	s.NumCompressedReads -= o.NumCompressedReads
+	s.ReadAheads -= o.ReadAheads
+
+	s.CacheHits -= o.CacheHits
+	s.CacheMisses -= o.CacheMisses
+
+	s.ThrottleStalls -= o.ThrottleStalls
+	s.ThrottleStallTime -= o.ThrottleStallTime
+	s.ThrottleRejects -= o.ThrottleRejects
+
+	s.ChainLenHist.sub(&o.ChainLenHist)
+	s.PageSizeHist.sub(&o.PageSizeHist)
+	s.FetchSegmentsHist.sub(&o.FetchSegmentsHist)
+
+	s.LSSStalls.ReserveStalls -= o.LSSStalls.ReserveStalls
+	s.LSSStalls.ReserveStallTime -= o.LSSStalls.ReserveStallTime
+	s.LSSStalls.TrimStalls -= o.LSSStalls.TrimStalls
+	s.LSSStalls.TrimStallTime -= o.LSSStalls.TrimStallTime
+	s.LSSStalls.SyncStalls -= o.LSSStalls.SyncStalls
+	s.LSSStalls.SyncStallTime -= o.LSSStalls.SyncStallTime
+
+	s.WriteAmpAvg = 0
+	if s.BytesIncoming > 0 {
+		s.WriteAmpAvg = float64(s.BytesWritten) / float64(s.BytesIncoming)
+	}
 }
 
 func (s Stats) String() string {
@@ -176,14 +420,22 @@ func (s Stats) String() string {
 		"merges            = %d\n"+
 		"inserts           = %d\n"+
 		"deletes           = %d\n"+
+		"range_deletes     = %d\n"+
 		"compact_conflicts = %d\n"+
 		"split_conflicts   = %d\n"+
 		"merge_conflicts   = %d\n"+
 		"insert_conflicts  = %d\n"+
 		"delete_conflicts  = %d\n"+
 		"swapin_conflicts  = %d\n"+
+		"defrags           = %d\n"+
+		"defrag_conflicts  = %d\n"+
+		"checkpoints       = %d\n"+
+		"expired_items     = %d\n"+
+		"filtered_items    = %d\n"+
 		"memory_size       = %d\n"+
 		"memory_size_index = %d\n"+
+		"memory_pinned     = %d\n"+
+		"memory_compressed = %d\n"+
 		"allocated         = %d\n"+
 		"freed             = %d\n"+
 		"reclaimed         = %d\n"+
@@ -203,21 +455,41 @@ func (s Stats) String() string {
 		"lss_fragmentation = %d%%\n"+
 		"lss_data_size     = %d\n"+
 		"lss_used_space    = %d\n"+
+		"lss_quota         = %d\n"+
+		"lss_headroom      = %d\n"+
 		"lss_num_reads     = %d\n"+
 		"lss_read_bs       = %d\n"+
 		"lss_gc_num_reads  = %d\n"+
 		"lss_gc_reads_bs   = %d\n"+
+		"vlog_used_space   = %d\n"+
+		"compressed_reads  = %d\n"+
+		"read_aheads       = %d\n"+
 		"cache_hits        = %d\n"+
 		"cache_misses      = %d\n"+
 		"cache_hit_ratio   = %.2f\n"+
-		"resident_ratio    = %.2f\n",
-		atomic.LoadInt64(&memQuota),
+		"resident_ratio    = %.2f\n"+
+		"throttle_stalls   = %d\n"+
+		"throttle_stall_ns = %d\n"+
+		"throttle_rejects  = %d\n"+
+		"chain_len_hist    = %v\n"+
+		"page_size_hist    = %v\n"+
+		"fetch_seg_hist    = %v\n"+
+		"reserve_stalls    = %d\n"+
+		"reserve_stall_ns  = %d\n"+
+		"trim_stalls       = %d\n"+
+		"trim_stall_ns     = %d\n"+
+		"sync_stalls       = %d\n"+
+		"sync_stall_ns     = %d\n",
+		s.MemQuota,
 		s.Inserts-s.Deletes,
 		s.Compacts, s.Splits, s.Merges,
-		s.Inserts, s.Deletes, s.CompactConflicts,
+		s.Inserts, s.Deletes, s.RangeDeletes, s.CompactConflicts,
 		s.SplitConflicts, s.MergeConflicts,
 		s.InsertConflicts, s.DeleteConflicts,
-		s.SwapInConflicts, s.MemSz, s.MemSzIndex,
+		s.SwapInConflicts, s.Defrags, s.DefragConflicts,
+		s.Checkpoints,
+		s.ExpiredItems, s.FilteredItems,
+		s.MemSz, s.MemSzIndex, s.PinnedSz, s.CompressedSz,
 		s.AllocSz, s.FreeSz, s.ReclaimSz,
 		s.FreeSz-s.ReclaimSz,
 		s.AllocSzIndex, s.FreeSzIndex, s.ReclaimSzIndex,
@@ -226,10 +498,58 @@ func (s Stats) String() string {
 		s.BytesIncoming, s.BytesWritten,
 		s.WriteAmp, s.WriteAmpAvg,
 		s.LSSFrag, s.LSSDataSize, s.LSSUsedSpace,
+		s.LSSQuota, s.LSSHeadroom,
 		s.NumLSSReads, s.LSSReadBytes,
 		s.NumLSSCleanerReads, s.LSSCleanerReadBytes,
+		s.VLogUsedSpace,
+		s.NumCompressedReads,
+		s.ReadAheads,
 		s.CacheHits, s.CacheMisses, s.CacheHitRatio,
-		s.ResidentRatio)
+		s.ResidentRatio,
+		s.ThrottleStalls, s.ThrottleStallTime, s.ThrottleRejects,
+		s.ChainLenHist, s.PageSizeHist, s.FetchSegmentsHist,
+		s.LSSStalls.ReserveStalls, s.LSSStalls.ReserveStallTime,
+		s.LSSStalls.TrimStalls, s.LSSStalls.TrimStallTime,
+		s.LSSStalls.SyncStalls, s.LSSStalls.SyncStallTime)
+}
+
+func (s Stats) MarshalJSON() ([]byte, error) {
+	type stats Stats
+	return json.Marshal(struct {
+		Count int64 `json:"count"`
+		stats
+	}{s.Inserts - s.Deletes, stats(s)})
+}
+
+// DetailedStats breaks down the counters by the context which updated
+// them. Counters of readers, iterators and short lived contexts are
+// reported under Other.
+type DetailedStats struct {
+	Total      Stats   `json:"total"`
+	Writers    []Stats `json:"writers"`
+	Persistors []Stats `json:"persistors"`
+	Evictors   []Stats `json:"evictors"`
+	LSSCleaner Stats   `json:"lss_cleaner"`
+	Defrag     Stats   `json:"defrag"`
+	Checkpoint Stats   `json:"checkpoint"`
+	Global     Stats   `json:"global"`
+	Other      Stats   `json:"other"`
+}
+
+// OpenReadOnly opens an existing instance for inspection. The page table is
+// recovered from the LSS, but nothing is written to it. Writers, recovery
+// point updates and LSS maintenance fail with ErrReadOnly. A shared lock is
+// held on the LSS header, so that any number of diagnostic or backup
+// processes can open a closed or copied LSS. The writable instance holds an
+// exclusive lock, hence ErrInUse is returned while the LSS is open for
+// writing and the LSS cannot be opened for writing while it is read.
+func OpenReadOnly(cfg Config) (*Plasma, error) {
+	if cfg.File == "" {
+		return nil, ErrReadOnly
+	}
+
+	cfg.readOnly = true
+	return New(cfg)
 }
 
 func New(cfg Config) (*Plasma, error) {
@@ -237,7 +557,11 @@ func New(cfg Config) (*Plasma, error) {
 
 	cfg = applyConfigDefaults(cfg)
 
-	s := &Plasma{Config: cfg}
+	s := &Plasma{
+		Config:        cfg,
+		ckptPinOffset: uint64(expiredLSSOffset),
+		closeDone:     make(chan struct{}),
+	}
 	slCfg := skiplist.DefaultConfig()
 	if cfg.UseMemoryMgmt {
 		s.smrChan = make(chan unsafe.Pointer, smrChanBufSize)
@@ -290,8 +614,23 @@ func New(cfg Config) (*Plasma, error) {
 		}
 	}
 
+	if cfg.ItemExpiryGetter != nil {
+		getCompactFilter := cfGetter
+		cfGetter = func() ItemFilter {
+			return s.newExpiryFilter(getCompactFilter())
+		}
+	}
+
+	if cfg.CompactionFilter != nil {
+		getCompactFilter := cfGetter
+		cfGetter = func() ItemFilter {
+			return s.newCompactionFilter(getCompactFilter())
+		}
+	}
+
 	s.storeCtx = newStoreContext(sl, cfg.UseMemoryMgmt, cfg.ItemSize,
 		cfg.Compare, cfGetter, lfGetter)
+	s.storeCtx.usePrefixCompression = cfg.UsePrefixCompression
 
 	s.gCtx = s.newWCtx()
 	if s.useMemMgmt {
@@ -305,17 +644,44 @@ func New(cfg Config) (*Plasma, error) {
 
 	if s.shouldPersist {
 		commitDur := time.Duration(cfg.SyncInterval) * time.Second
-		s.lss, err = NewLSStore(cfg.File, cfg.LSSLogSegmentSize, cfg.FlushBufferSize, 2, cfg.UseMmap, commitDur)
+		opts := s.lssOptions("lss")
+		if cfg.TierStore != nil {
+			opts.tier = newLogTier(cfg.TierStore, cfg.TierLocalSegments, cfg.TierCacheSize)
+		}
+		opts.onRetire = cfg.OnSegmentRetire
+
+		s.lss, err = newLSStore(cfg.File, cfg.LSSLogSegmentSize, cfg.FlushBufferSize, 2,
+			cfg.UseMmap, commitDur, opts)
 		if err != nil {
+			// The log may be held by another instance
+			dbInstances.Delete(unsafe.Pointer(s), ComparePlasma, sbuf, &dbInstances.Stats)
 			return nil, err
 		}
 
 		s.lss.SetSafeTrimCallback(s.findSafeLSSTrimOffset)
+		if err = s.openValueLog(commitDur); err != nil {
+			s.lss.Close()
+			dbInstances.Delete(unsafe.Pointer(s), ComparePlasma, sbuf, &dbInstances.Stats)
+			return nil, err
+		}
+
 		s.initLRUClock()
 		err = s.doRecovery()
+		s.lssRegions = newLSSRegionStats(s.lss.TailOffset())
 	}
 
 	s.doInit()
+	if err == nil && s.shouldPersist && s.EnableShapshots && cfg.salvage == nil {
+		s.itemsCount, s.itemsKeySum, err = s.recoverItemsCount()
+		if err == nil && cfg.VerifyRecovery {
+			err = s.verifyRecovery()
+		}
+	}
+
+	s.pinWriter = s.newWCtx()
+	s.estimateWriter = s.newWCtx()
+	s.defragWriter = s.newWCtx()
+	s.stopmon = make(chan struct{})
 
 	if s.shouldPersist {
 		s.persistWriters = make([]*wCtx, runtime.NumCPU())
@@ -325,18 +691,48 @@ func New(cfg Config) (*Plasma, error) {
 			s.evictWriters[i] = s.newWCtx()
 		}
 		s.lssCleanerWriter = s.newWCtx()
+		s.checkpointWriter = s.newWCtx()
+		s.vlogCleanerWriter = s.newWCtx()
+		s.heatMapWriter = s.newWCtx()
 
 		s.stoplssgc = make(chan struct{})
 		s.stopswapper = make(chan struct{})
-		s.stopmon = make(chan struct{})
+		s.stopdefrag = make(chan struct{})
+		s.stopcheckpoint = make(chan struct{})
+		s.stoprp = make(chan struct{})
+		s.stopheatmap = make(chan struct{})
+		s.stopvlog = make(chan struct{})
 
 		if cfg.AutoLSSCleaning {
 			go s.lssCleanerDaemon()
+			if s.vlog != nil {
+				go s.vlogCleanerDaemon()
+			}
 		}
 
 		if cfg.AutoSwapper {
 			go s.swapperDaemon()
 		}
+
+		if cfg.AutoDefrag {
+			go s.defragDaemon()
+		}
+
+		if cfg.CheckpointInterval > 0 && !cfg.readOnly {
+			go s.checkpointDaemon()
+		}
+
+		if cfg.RecoveryPointMaxAge > 0 {
+			go s.recoveryPointDaemon()
+		}
+
+		if cfg.RecordHeatMap && cfg.HeatMapInterval > 0 {
+			go s.heatMapDaemon()
+		}
+
+		if cfg.ReadAheadPages > 0 {
+			s.startReadAhead()
+		}
 	}
 
 	go s.monitorMemUsage()
@@ -345,7 +741,7 @@ func New(cfg Config) (*Plasma, error) {
 }
 
 func (s *Plasma) runtimeStats() {
-	so := s.GetStats()
+	so := s.getStats()
 	for {
 		select {
 		case <-s.stopmon:
@@ -355,7 +751,7 @@ func (s *Plasma) runtimeStats() {
 
 		time.Sleep(time.Second * 5)
 
-		now := s.GetStats()
+		now := s.getStats()
 		bsOut := (float64(now.BytesWritten) - float64(so.BytesWritten))
 		bsIn := (float64(now.BytesIncoming) - float64(so.BytesIncoming))
 		if bsIn > 0 {
@@ -380,7 +776,9 @@ func (s *Plasma) monitorMemUsage() {
 			return
 		default:
 		}
-		s.hasMemoryPressure = s.TriggerSwapper(sctx)
+		s.hasMemoryPressure = s.needsSwap(sctx)
+		s.checkDiskUsage()
+		s.checkLSSQuota()
 		time.Sleep(time.Millisecond * 100)
 	}
 }
@@ -391,6 +789,10 @@ func (s *Plasma) doInit() {
 	if pid.(*skiplist.Node).Link == nil {
 		pg := s.newSeedPage(s.gCtx)
 		s.CreateMapping(pid, pg, s.gCtx)
+
+		// The seed page is freed like any other once it is replaced
+		_, _, _, _, memUsed := pg.GetAllocOps()
+		s.gCtx.sts.AllocSz += int64(memUsed)
 	}
 
 	if s.EnableShapshots {
@@ -410,79 +812,34 @@ func (s *Plasma) doInit() {
 	}
 }
 
-func (s *Plasma) doRecovery() error {
-	pg := newPage(s.gCtx, nil, nil).(*page)
-
-	buf := s.gCtx.GetBuffer(bufRecovery)
-
-	fn := func(offset LSSOffset, bs []byte) (bool, error) {
-		typ := getLSSBlockType(bs)
-		bs = bs[lssBlockTypeSize:]
-		switch typ {
-		case lssDiscard:
-		case lssRecoveryPoints:
-			s.rpVersion, s.recoveryPoints = unmarshalRPs(bs)
-		case lssMaxSn:
-			s.currSn = decodeMaxSn(bs)
-		case lssPageRemove:
-			rmPglow := getRmPageLow(bs)
-			pid := s.getPageId(rmPglow, s.gCtx)
-			if pid != nil {
-				currPg, err := s.ReadPage(pid, s.gCtx.pgRdrFn, false, s.gCtx)
-				if err != nil {
-					return false, err
-				}
-
-				// TODO: Store precomputed fdSize in swapout delta
-				s.gCtx.sts.FlushDataSz -= int64(currPg.GetFlushDataSize())
-				currPg.(*page).free(false)
-				s.unindexPage(pid, s.gCtx)
-			}
-		case lssPageData, lssPageReloc, lssPageUpdate:
-			pg.Unmarshal(bs, s.gCtx)
-			flushDataSz := len(bs)
-
-			newPageData := (typ == lssPageData || typ == lssPageReloc)
-			if pid := s.getPageId(pg.low, s.gCtx); pid == nil {
-				if newPageData {
-					s.gCtx.sts.FlushDataSz += int64(flushDataSz)
-					pg.AddFlushRecord(offset, flushDataSz, 1)
-					pid = s.AllocPageId(s.gCtx)
-					s.CreateMapping(pid, pg, s.gCtx)
-					s.indexPage(pid, s.gCtx)
-				} else {
-					pg.free(false)
-				}
-			} else {
-				s.gCtx.sts.FlushDataSz += int64(flushDataSz)
-
-				currPg, err := s.ReadPage(pid, s.gCtx.pgRdrFn, false, s.gCtx)
-				if err != nil {
-					return false, err
-				}
-
-				if newPageData {
-					s.gCtx.sts.FlushDataSz -= int64(currPg.GetFlushDataSize())
-					currPg.(*page).free(false)
-					pg.AddFlushRecord(offset, flushDataSz, 1)
-				} else {
-					_, numSegments, _ := currPg.GetFlushInfo()
-					pg.Append(currPg)
-					pg.AddFlushRecord(offset, flushDataSz, numSegments+1)
-				}
+func (s *Plasma) doRecovery() (err error) {
+	span := s.startSpan(SpanRecovery)
+	defer func() {
+		span.End(err)
+	}()
 
-				pg.prevHeadPtr = currPg.(*page).prevHeadPtr
-				s.UpdateMapping(pid, pg, s.gCtx)
-			}
+	start := expiredLSSOffset
+	if s.CheckpointInterval > 0 {
+		off, ok, err := s.loadCheckpoint()
+		if err != nil {
+			return err
+		} else if ok {
+			start = off
 		}
+	} else if !s.readOnly && !s.InMemoryLog {
+		os.Remove(s.checkpointFile())
+	}
 
-		pg.Reset()
-		s.tryEvictPages(s.gCtx)
-		s.trySMRObjects(s.gCtx, recoverySMRInterval)
-		return true, nil
+	s.recoveryStart = start
+	span.SetAttribute("start_offset", int64(start))
+	span.SetAttribute("threads", s.NumRecoveryThreads)
+
+	if s.NumRecoveryThreads > 1 && !s.LazyRecovery {
+		err = s.replayLogParallel(start, s.NumRecoveryThreads)
+	} else {
+		err = s.replayLog(start)
 	}
 
-	err := s.lss.Visitor(fn, buf)
 	if err != nil {
 		return err
 	}
@@ -490,43 +847,63 @@ func (s *Plasma) doRecovery() error {
 	s.trySMRObjects(s.gCtx, 0)
 
 	// Initialize rightSiblings for all pages
-	var lastPg Page
-	callb := func(pid PageId, partn RangePartition) error {
-		pg, err := s.ReadPage(pid, s.gCtx.pgRdrFn, false, s.gCtx)
-		if lastPg != nil {
-			if err == nil && s.cmp(lastPg.MaxItem(), pg.MinItem()) != 0 {
-				panic("found missing page")
-			}
-
-			lastPg.SetNext(pid)
-		}
-
-		lastPg = pg
+	if err = s.linkSiblings(s.NumPersistorThreads); err != nil {
 		return err
 	}
 
-	s.PageVisitor(callb, 1)
 	s.gcSn = s.currSn
+	return nil
+}
 
-	if lastPg != nil {
-		lastPg.SetNext(s.EndPageId())
-		if lastPg.MaxItem() != skiplist.MaxItem {
-			panic("invalid last page")
-		}
+// Close stops the background work and releases the instance. It blocks
+// until the daemons have stopped.
+func (s *Plasma) Close() {
+	s.CloseContext(context.Background())
+}
+
+// CloseContext closes the instance like Close, but stops waiting once ctx
+// is done. The passes of the log cleaner and the swapper in progress are
+// cancelled and the blocks written to the log are synced. If ctx is done
+// before the daemons have stopped, the error of ctx is returned and the
+// instance is released in the background. Later calls of Close,
+// CloseContext or Destroy wait for the release to finish.
+func (s *Plasma) CloseContext(ctx context.Context) error {
+	if atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+		close(s.stopmon)
+
+		go func() {
+			if s.EnableShapshots {
+				// Force SMR flush
+				s.NewSnapshot().Close()
+			}
+
+			s.stopDaemons()
+			if s.RecordHeatMap {
+				s.writeHeatMap()
+			}
+			s.closeSubscriptions()
+			s.release()
+			close(s.closeDone)
+		}()
 	}
 
-	return err
+	select {
+	case <-s.closeDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func (s *Plasma) Close() {
-	if s.EnableShapshots {
-		// Force SMR flush
-		s.NewSnapshot().Close()
-	}
-	close(s.stopmon)
+func (s *Plasma) stopDaemons() {
 	if s.Config.AutoLSSCleaning {
 		s.stoplssgc <- struct{}{}
 		<-s.stoplssgc
+
+		if s.vlog != nil {
+			s.stopvlog <- struct{}{}
+			<-s.stopvlog
+		}
 	}
 
 	if s.Config.AutoSwapper {
@@ -534,8 +911,42 @@ func (s *Plasma) Close() {
 		<-s.stopswapper
 	}
 
+	if s.Config.AutoDefrag {
+		s.stopdefrag <- struct{}{}
+		<-s.stopdefrag
+	}
+
+	if s.Config.CheckpointInterval > 0 && !s.Config.readOnly {
+		s.stopcheckpoint <- struct{}{}
+		<-s.stopcheckpoint
+	}
+
+	if s.Config.RecoveryPointMaxAge > 0 {
+		s.stoprp <- struct{}{}
+		<-s.stoprp
+	}
+
+	if s.Config.RecordHeatMap && s.Config.HeatMapInterval > 0 {
+		s.stopheatmap <- struct{}{}
+		<-s.stopheatmap
+	}
+
+	s.stopReadAhead()
+}
+
+func (s *Plasma) release() {
 	if s.Config.shouldPersist {
+		if !s.readOnly {
+			s.lss.Commit()
+		}
 		s.lss.Close()
+
+		if s.vlog != nil {
+			if !s.readOnly {
+				s.vlog.Commit()
+			}
+			s.vlog.Close()
+		}
 	}
 
 	sbuf := dbInstances.MakeBuf()
@@ -549,6 +960,91 @@ func (s *Plasma) Close() {
 	}
 }
 
+func (s *Plasma) isClosed() bool {
+	return atomic.LoadInt32(&s.closed) == 1
+}
+
+// IsReadOnly reports whether the instance was opened using OpenReadOnly
+func (s *Plasma) IsReadOnly() bool {
+	return s.readOnly
+}
+
+// Destroy closes the instance and removes its files from disk. If the
+// instance is already being closed, e.g. by CloseContext which timed out,
+// the files are removed once it has been released.
+func (s *Plasma) Destroy() error {
+	s.Close()
+	if !s.shouldPersist || s.InMemoryLog {
+		return nil
+	}
+
+	return DestroyInstance(s.File)
+}
+
+// DestroyInstance removes the log segments, superblock, checkpoint and
+// value log of the instance stored at path. The directory itself is removed if
+// nothing else is left in it. ErrInUse is returned if the instance is
+// open.
+func DestroyInstance(path string) error {
+	if isInstanceOpen(path) {
+		return ErrInUse
+	}
+
+	vlogPath := filepath.Join(path, valueLogDir)
+	files, err := filepath.Glob(filepath.Join(path, segFilePattern))
+	if err != nil {
+		return err
+	}
+
+	vfiles, err := filepath.Glob(filepath.Join(vlogPath, segFilePattern))
+	if err != nil {
+		return err
+	}
+
+	files = append(files, vfiles...)
+	for _, dir := range []string{path, vlogPath} {
+		spares, _ := filepath.Glob(filepath.Join(dir, segSparePattern))
+		files = append(files, spares...)
+	}
+
+	files = append(files,
+		filepath.Join(vlogPath, headerFileName),
+		filepath.Join(path, headerFileName),
+		filepath.Join(path, checkpointFileName),
+		filepath.Join(path, checkpointFileName+".tmp"))
+
+	for _, f := range files {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	os.Remove(vlogPath)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		if entries, _ := os.ReadDir(path); len(entries) == 0 {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func isInstanceOpen(path string) bool {
+	buf := dbInstances.MakeBuf()
+	defer dbInstances.FreeBuf(buf)
+
+	iter := dbInstances.NewIterator(ComparePlasma, buf)
+	defer iter.Close()
+	for iter.SeekFirst(); iter.Valid(); iter.Next() {
+		db := (*Plasma)(iter.Get())
+		if db.shouldPersist && !db.InMemoryLog && filepath.Clean(db.File) == filepath.Clean(path) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func ComparePlasma(a, b unsafe.Pointer) int {
 	return int(uintptr(a)) - int(uintptr(b))
 }
@@ -556,6 +1052,8 @@ func ComparePlasma(a, b unsafe.Pointer) int {
 type Writer struct {
 	*wCtx
 	count int64
+	// Checksum of the keys of the items counted, see keyChecksum
+	keySum uint64
 }
 
 type Reader struct {
@@ -567,6 +1065,7 @@ type wCtx struct {
 	*Plasma
 	buf       *skiplist.ActionBuffer
 	pgBuffers [][]byte
+	fetchBufs [][]byte
 	slSts     *skiplist.Stats
 	sts       *Stats
 	dbIter    *skiplist.Iterator
@@ -579,13 +1078,43 @@ type wCtx struct {
 
 	next *wCtx
 
-	safeOffset LSSOffset
+	// Closed to stop the SMR worker of a writer, which closes smrDone
+	stopSMR, smrDone chan struct{}
+
+	safeOffset     LSSOffset
+	vlogSafeOffset LSSOffset
+	// Number of transactions begun and ended
+	txBegun, txEnded uint64
+
+	fetchBudget   time.Duration
+	fetchDeadline time.Time
+
+	// Context of the operation in progress if it was started using one of
+	// the Ctx variants of the operations. It is also set as fetchCtx while
+	// the page of the operation is swapped in.
+	opCtx, fetchCtx context.Context
+
+	// Set while a Try variant of an operation is in progress, which fails
+	// with ErrWouldThrottle instead of waiting for memory to be freed
+	noThrottle bool
+}
+
+// canceled returns the error of the context of the operation in progress
+func (ctx *wCtx) canceled() error {
+	if ctx.opCtx != nil {
+		return ctx.opCtx.Err()
+	}
+
+	return nil
 }
 
 func (ctx *wCtx) freePages(pages []pgFreeObj) {
 	for _, pg := range pages {
 		nr, size := computeMemUsed(pg.h, ctx.itemSize)
 		ctx.sts.FreeSz += int64(size)
+		if sz := compressedSize(pg.h); sz > 0 {
+			atomic.AddInt64(&ctx.compressedMemUsed, -int64(sz))
+		}
 
 		ctx.sts.NumRecordFrees += int64(nr)
 		if pg.evicted {
@@ -615,14 +1144,15 @@ func (s *Plasma) newWCtx() *wCtx {
 
 func (s *Plasma) newWCtx2() *wCtx {
 	ctx := &wCtx{
-		Plasma:     s,
-		pgAllocCtx: new(allocCtx),
-		buf:        s.Skiplist.MakeBuf(),
-		slSts:      &s.Skiplist.Stats,
-		sts:        new(Stats),
-		pgBuffers:  make([][]byte, maxCtxBuffers),
-		next:       s.wCtxList,
-		safeOffset: expiredLSSOffset,
+		Plasma:         s,
+		pgAllocCtx:     new(allocCtx),
+		buf:            s.Skiplist.MakeBuf(),
+		slSts:          &s.Skiplist.Stats,
+		sts:            new(Stats),
+		pgBuffers:      make([][]byte, maxCtxBuffers),
+		next:           s.wCtxList,
+		safeOffset:     expiredLSSOffset,
+		vlogSafeOffset: expiredLSSOffset,
 	}
 
 	ctx.dbIter = dbInstances.NewIterator(ComparePlasma, ctx.buf)
@@ -633,6 +1163,23 @@ func (s *Plasma) newWCtx2() *wCtx {
 	return ctx
 }
 
+// Number of blocks of a page read together, which bounds the memory of the
+// fetch buffers of a context
+const maxFetchBlocks = 4
+
+// fetchBuffers returns n buffers for the segments of a page read together
+func (ctx *wCtx) fetchBuffers(n int) [][]byte {
+	if len(ctx.fetchBufs) == 0 {
+		ctx.fetchBufs = append(ctx.fetchBufs, ctx.GetBuffer(bufFetch))
+	}
+
+	for len(ctx.fetchBufs) < n {
+		ctx.fetchBufs = append(ctx.fetchBufs, make([]byte, maxPageEncodedSize))
+	}
+
+	return ctx.fetchBufs[:n]
+}
+
 func (ctx *wCtx) GetBuffer(id int) []byte {
 	if ctx.pgBuffers[id] == nil {
 		ctx.pgBuffers[id] = make([]byte, maxPageEncodedSize)
@@ -652,6 +1199,7 @@ func (s *Plasma) NewWriter() *Writer {
 
 	s.wlist = append(s.wlist, w)
 	if s.useMemMgmt {
+		w.stopSMR, w.smrDone = make(chan struct{}), make(chan struct{})
 		s.smrWg.Add(1)
 		go s.smrWorker(w.wCtx)
 	}
@@ -659,6 +1207,65 @@ func (s *Plasma) NewWriter() *Writer {
 	return w
 }
 
+// Close releases the writer, which must not be used afterwards. The items
+// count and the objects pending reclamation of the writer are handed over
+// to the instance and its stats remain part of the stats of the instance.
+func (w *Writer) Close() {
+	s := w.Plasma
+	s.mvcc.Lock()
+	s.Lock()
+	var found bool
+	for i, wr := range s.wlist {
+		if wr == w {
+			s.wlist = append(s.wlist[:i:i], s.wlist[i+1:]...)
+			found = true
+			break
+		}
+	}
+	s.itemsCount += atomic.SwapInt64(&w.count, 0)
+	s.itemsKeySum += atomic.SwapUint64(&w.keySum, 0)
+	s.Unlock()
+	s.mvcc.Unlock()
+
+	if !found {
+		return
+	}
+
+	s.retireWCtx(w.wCtx)
+}
+
+// retireWCtx unlinks a context which is no longer used from wCtxList and
+// keeps its stats in retiredSts
+func (s *Plasma) retireWCtx(ctx *wCtx) {
+	if len(ctx.reclaimList) > 0 {
+		s.FreeObjects([][]reclaimObject{ctx.reclaimList})
+		ctx.reclaimList = nil
+	}
+
+	if ctx.stopSMR != nil {
+		close(ctx.stopSMR)
+		<-ctx.smrDone
+	}
+
+	s.wCtxLock.Lock()
+	defer s.wCtxLock.Unlock()
+
+	if s.wCtxList == ctx {
+		s.wCtxList = ctx.next
+	} else {
+		for prev := s.wCtxList; prev != nil; prev = prev.next {
+			if prev.next == ctx {
+				prev.next = ctx.next
+				break
+			}
+		}
+	}
+
+	s.retiredSts.Merge(ctx.sts)
+}
+
+// NewReader returns a reader for the snapshots of the instance, which
+// should be closed once it is no longer used
 func (s *Plasma) NewReader() *Reader {
 	iter := s.NewIterator().(*Iterator)
 	iter.filter = &snFilter{}
@@ -670,9 +1277,16 @@ func (s *Plasma) NewReader() *Reader {
 	}
 }
 
+// Close releases the reader, which must not be used afterwards
+func (r *Reader) Close() {
+	r.iter.Iterator.Close()
+	r.iter.store.retireWCtx(r.iter.wCtx)
+}
+
 func (r *Reader) NewSnapshotIterator(snap *Snapshot) *MVCCIterator {
 	snap.Open()
 	r.iter.filter.(*snFilter).sn = snap.sn
+	r.iter.SetBounds(nil, nil)
 	r.iter.token = r.iter.BeginTx()
 	r.iter.snap = snap
 	return r.iter
@@ -680,29 +1294,95 @@ func (r *Reader) NewSnapshotIterator(snap *Snapshot) *MVCCIterator {
 
 func (s *Plasma) MemoryInUse() int64 {
 	var memSz int64
+
+	// The list is walked under the lock, so that a context retired
+	// meanwhile is not counted a second time in retiredSts
+	s.wCtxLock.Lock()
 	for w := s.wCtxList; w != nil; w = w.next {
 		memSz += w.sts.AllocSz - w.sts.FreeSz
 		memSz += w.sts.AllocSzIndex - w.sts.FreeSzIndex
 	}
 
+	memSz += s.retiredSts.AllocSz - s.retiredSts.FreeSz
+	memSz += s.retiredSts.AllocSzIndex - s.retiredSts.FreeSzIndex
+	s.wCtxLock.Unlock()
+
 	return memSz
 }
 
+// GetStats returns the stats of the instance. The cumulative counters
+// start from the last call to ResetStats.
 func (s *Plasma) GetStats() Stats {
+	sts := s.getStats()
+	s.statsLock.Lock()
+	sts.sub(&s.statsBase)
+	s.statsLock.Unlock()
+	return sts
+}
+
+// GetCumulativeStats returns the stats of the instance with the cumulative
+// counters started when it was opened regardless of ResetStats, e.g. for
+// exporting them as counters which never decrease.
+func (s *Plasma) GetCumulativeStats() Stats {
+	return s.getStats()
+}
+
+// GetStatsDelta returns the change in the cumulative counters since prev
+// was returned by GetStats, e.g. to compute the rate of inserts over an
+// interval. The gauges are the current values and the cache hit ratio is
+// computed over the interval.
+func (s *Plasma) GetStatsDelta(prev Stats) Stats {
+	sts := s.GetStats()
+	sts.sub(&prev)
+	if tot := sts.CacheHits + sts.CacheMisses; tot > 0 {
+		sts.CacheHitRatio = float64(sts.CacheHits) / float64(tot)
+	}
+
+	return sts
+}
+
+// ResetStats resets the cumulative counters returned by GetStats. The
+// counters used for accounting, such as memory and log usage, are not
+// affected.
+func (s *Plasma) ResetStats() {
+	sts := s.getStats()
+	s.statsLock.Lock()
+	s.statsBase = sts
+	s.statsLock.Unlock()
+}
+
+func (s *Plasma) getStats() Stats {
 	var sts Stats
 
 	sts.NumPages = int64(s.Skiplist.GetStats().NodeCount + 1)
+	s.wCtxLock.Lock()
 	for w := s.wCtxList; w != nil; w = w.next {
 		sts.Merge(w.sts)
 	}
 
+	sts.Merge(&s.retiredSts)
+	s.wCtxLock.Unlock()
+
+	sts.ExpiredItems = atomic.LoadInt64(&s.numExpired)
+	sts.FilteredItems = atomic.LoadInt64(&s.numFiltered)
+	sts.MemQuota = s.memQuota()
 	sts.MemSz = sts.AllocSz - sts.FreeSz
 	sts.MemSzIndex = sts.AllocSzIndex - sts.FreeSzIndex
+	sts.PinnedSz = s.pinnedMemUsed()
+	sts.CompressedSz = atomic.LoadInt64(&s.compressedMemUsed)
 	if s.shouldPersist {
 		sts.BytesWritten = s.lss.BytesWritten()
+		sts.LSSStalls = s.lss.StallStats()
 		sts.LSSFrag, sts.LSSDataSize, sts.LSSUsedSpace = s.GetLSSInfo()
+		if sts.LSSQuota = atomic.LoadInt64(&s.Config.MaxLSSUsedSpace); sts.LSSQuota > 0 {
+			sts.LSSHeadroom = maxInt64(sts.LSSQuota-sts.LSSUsedSpace, 0)
+		}
 		sts.NumLSSCleanerReads = s.lssCleanerWriter.sts.NumLSSReads
 		sts.LSSCleanerReadBytes = s.lssCleanerWriter.sts.LSSReadBytes
+		sts.LSSTruncatedBytes = s.lss.TruncatedBytes()
+		if s.vlog != nil {
+			sts.VLogUsedSpace = s.vlog.UsedSpace()
+		}
 		sts.CacheHitRatio = s.gCtx.sts.CacheHitRatio
 		sts.WriteAmp = s.gCtx.sts.WriteAmp
 		bsOut := float64(sts.BytesWritten)
@@ -720,24 +1400,83 @@ func (s *Plasma) GetStats() Stats {
 	return sts
 }
 
-func (s *Plasma) LSSDataSize() int64 {
-	var sz int64
+func ctxStats(w *wCtx) Stats {
+	sts := *w.sts
+	sts.MemSz = sts.AllocSz - sts.FreeSz
+	sts.MemSzIndex = sts.AllocSzIndex - sts.FreeSzIndex
+	return sts
+}
 
-	for w := s.wCtxList; w != nil; w = w.next {
-		sz += w.sts.FlushDataSz
+func (s *Plasma) GetDetailedStats() DetailedStats {
+	var dsts DetailedStats
+	known := make(map[*wCtx]bool)
+	add := func(w *wCtx) Stats {
+		if w == nil {
+			return Stats{}
+		}
+
+		known[w] = true
+		return ctxStats(w)
 	}
 
-	return sz
-}
+	dsts.Total = s.GetStats()
 
-func (s *Plasma) indexPage(pid PageId, ctx *wCtx) {
-	n := pid.(*skiplist.Node)
-	if n.Item() == skiplist.MinItem {
-		link := n.Link
-		s.FreePageId(pid, ctx)
-		n = s.StartPageId().(*skiplist.Node)
-		n.Link = link
-		return
+	s.Lock()
+	for _, w := range s.wlist {
+		dsts.Writers = append(dsts.Writers, add(w.wCtx))
+	}
+	s.Unlock()
+
+	for _, w := range s.persistWriters {
+		dsts.Persistors = append(dsts.Persistors, add(w))
+	}
+
+	for _, w := range s.evictWriters {
+		dsts.Evictors = append(dsts.Evictors, add(w))
+	}
+
+	dsts.LSSCleaner = add(s.lssCleanerWriter)
+	dsts.Defrag = add(s.defragWriter)
+	dsts.Checkpoint = add(s.checkpointWriter)
+	dsts.Global = add(s.gCtx)
+
+	s.wCtxLock.Lock()
+	for w := s.wCtxList; w != nil; w = w.next {
+		if !known[w] {
+			dsts.Other.Merge(w.sts)
+		}
+	}
+
+	dsts.Other.Merge(&s.retiredSts)
+	s.wCtxLock.Unlock()
+	dsts.Other.MemSz = dsts.Other.AllocSz - dsts.Other.FreeSz
+	dsts.Other.MemSzIndex = dsts.Other.AllocSzIndex - dsts.Other.FreeSzIndex
+
+	return dsts
+}
+
+func (s *Plasma) LSSDataSize() int64 {
+	var sz int64
+
+	s.wCtxLock.Lock()
+	for w := s.wCtxList; w != nil; w = w.next {
+		sz += w.sts.FlushDataSz
+	}
+
+	sz += s.retiredSts.FlushDataSz
+	s.wCtxLock.Unlock()
+
+	return sz
+}
+
+func (s *Plasma) indexPage(pid PageId, ctx *wCtx) error {
+	n := pid.(*skiplist.Node)
+	if n.Item() == skiplist.MinItem {
+		link := n.Link
+		s.FreePageId(pid, ctx)
+		n = s.StartPageId().(*skiplist.Node)
+		n.Link = link
+		return nil
 	}
 retry:
 	if existNode, ok := s.Skiplist.Insert4(n, s.cmp, s.cmp, ctx.buf, n.Level(), false, false, ctx.slSts); !ok {
@@ -745,10 +1484,11 @@ retry:
 			runtime.Gosched()
 			goto retry
 		}
-		panic("duplicate index node")
+		return s.newPageError("index", newPage(ctx, n.Item(), n.Link), ErrDuplicatePage)
 	}
 
 	ctx.sts.AllocSzIndex += int64(s.itemSize(n.Item()) + uintptr(n.Size()))
+	return nil
 }
 
 func (s *Plasma) unindexPage(pid PageId, ctx *wCtx) {
@@ -763,13 +1503,15 @@ func (s *Plasma) unindexPage(pid PageId, ctx *wCtx) {
 	}
 }
 
-func (s *Plasma) tryPageRemoval(pid PageId, pg Page, ctx *wCtx) {
+// tryPageRemoval merges a closed page into its left sibling. The page is
+// reopened if the merged page cannot be written out.
+func (s *Plasma) tryPageRemoval(pid PageId, pg Page, ctx *wCtx) error {
 	itm := pg.MinItem()
 retry:
 	parent, curr, found := s.Skiplist.Lookup(itm, s.cmp, ctx.buf, ctx.slSts)
 	// Page has been removed already
 	if !found || PageId(curr) != pid {
-		return
+		return nil
 	}
 
 	pPid := PageId(parent)
@@ -790,6 +1532,7 @@ retry:
 	var pgBuf = ctx.GetBuffer(bufEncPage)
 	var metaBuf = ctx.GetBuffer(bufEncMeta)
 	var fdSz, staleFdSz int
+	var staleOff LSSOffset
 
 	s.tryPageSwapin(pg)
 	pPg.Merge(pg)
@@ -800,8 +1543,17 @@ retry:
 
 	if s.shouldPersist {
 		var numSegments int
+		var typ lssBlockType
 		metaBuf = marshalPageSMO(pg, metaBuf)
-		pgBuf, fdSz, staleFdSz, numSegments = pPg.Marshal(pgBuf, FullMarshal)
+		if pgBuf, _, staleFdSz, numSegments, err = pPg.Marshal(pgBuf, FullMarshal); err != nil {
+			allocs, _, _, _, _ := pPg.GetAllocOps()
+			s.discardDeltas(allocs)
+			s.reopenPage(pid, ctx)
+			return err
+		}
+
+		typ, pgBuf = s.compressPageBlock(lssPageData, pgBuf)
+		fdSz = len(pgBuf)
 
 		sizes := []int{
 			lssBlockTypeSize + len(metaBuf),
@@ -812,7 +1564,8 @@ retry:
 
 		writeLSSBlock(wbufs[0], lssPageRemove, metaBuf)
 
-		writeLSSBlock(wbufs[1], lssPageData, pgBuf)
+		writeLSSBlock(wbufs[1], typ, pgBuf)
+		staleOff, _ = pPg.GetLastFlushOffset()
 		pPg.AddFlushRecord(offsets[1], fdSz, numSegments)
 	}
 
@@ -821,10 +1574,11 @@ retry:
 
 		if s.shouldPersist {
 			ctx.sts.FlushDataSz += int64(fdSz) - int64(staleFdSz)
+			s.trackLSSUsage(staleOff, staleFdSz, offsets[1], fdSz)
 			s.lss.FinalizeWrite(res)
 		}
 
-		return
+		return nil
 
 	} else if s.shouldPersist {
 		discardLSSBlock(wbufs[0])
@@ -835,6 +1589,26 @@ retry:
 	goto retry
 }
 
+// reopenPage undoes the close of a page which is still indexed
+func (s *Plasma) reopenPage(pid PageId, ctx *wCtx) {
+	for {
+		pg, _ := s.ReadPage(pid, nil, false, ctx)
+		if !pg.NeedRemoval() {
+			return
+		}
+
+		_, curr, found := s.Skiplist.Lookup(pg.MinItem(), s.cmp, ctx.buf, ctx.slSts)
+		if !found || PageId(curr) != pid {
+			return
+		}
+
+		pg.(*page).Reopen()
+		if s.UpdateMapping(pid, pg, ctx) {
+			return
+		}
+	}
+}
+
 func (s *Plasma) isStartPage(pid PageId) bool {
 	return pid.(*skiplist.Node) == s.Skiplist.HeadNode()
 }
@@ -850,29 +1624,56 @@ func (s *Plasma) EndPageId() PageId {
 func (s *Plasma) trySMOs(pid PageId, pg Page, ctx *wCtx, doUpdate bool) bool {
 	var updated bool
 
+	// Structure modifications have to be written to the LSS
+	if s.readOnly {
+		return false
+	}
+
 	if pg.NeedCompaction(s.Config.MaxDeltaChainLen) {
+		span := s.startSpan(SpanCompact)
+		staleOff, _ := pg.GetLastFlushOffset()
 		staleFdSz := pg.Compact()
 		if updated = s.UpdateMapping(pid, pg, ctx); updated {
 			ctx.sts.Compacts++
 			ctx.sts.FlushDataSz -= int64(staleFdSz)
+			s.trackLSSUsage(staleOff, staleFdSz, 0, 0)
+			s.publish(Event{
+				Type:     EventCompact,
+				PageId:   pid,
+				NumItems: pageItemCount(pg.(*page)),
+				Size:     int64(staleFdSz),
+			})
 		} else {
 			ctx.sts.CompactConflicts++
 		}
+		span.SetAttribute("updated", updated)
+		span.End(nil)
 	} else if pg.NeedSplit(s.Config.MaxPageItems) {
+		span := s.startSpan(SpanSplit)
+		defer func() {
+			span.SetAttribute("updated", updated)
+			span.End(nil)
+		}()
+
 		splitPid := s.AllocPageId(ctx)
 
 		var fdSz, splitFdSz, staleFdSz, numSegments, numSegmentsSplit int
 		var pgBuf = ctx.GetBuffer(bufEncPage)
 		var splitPgBuf = ctx.GetBuffer(bufEncMeta)
 
+		// Allocation context and head prior to the split
+		aCtx, head := *pg.(*page).allocCtx, pg.(*page).head
 		newPg := pg.Split(splitPid)
 
 		// Skip split, but compact
 		if newPg == nil {
+			span.SetAttribute("skipped", true)
 			s.FreePageId(splitPid, ctx)
+			staleOff, _ := pg.GetLastFlushOffset()
 			staleFdSz := pg.Compact()
 			if updated = s.UpdateMapping(pid, pg, ctx); updated {
 				ctx.sts.FlushDataSz -= int64(staleFdSz)
+				s.trackLSSUsage(staleOff, staleFdSz, 0, 0)
 			}
 			return updated
 		}
@@ -880,11 +1681,38 @@ func (s *Plasma) trySMOs(pid PageId, pg Page, ctx *wCtx, doUpdate bool) bool {
 		var offsets []LSSOffset
 		var wbufs [][]byte
 		var res LSSResource
+		var staleOff LSSOffset
 
 		// Replace one page with two pages
 		if s.shouldPersist {
-			pgBuf, fdSz, staleFdSz, numSegments = pg.Marshal(pgBuf, s.Config.MaxPageLSSSegments)
-			splitPgBuf, splitFdSz, _, numSegmentsSplit = newPg.Marshal(splitPgBuf, 1)
+			var typ, splitTyp lssBlockType
+			var err error
+			if pgBuf, _, staleFdSz, numSegments, err = pg.Marshal(pgBuf, s.Config.MaxPageLSSSegments); err == nil {
+				splitPgBuf, _, _, numSegmentsSplit, err = newPg.Marshal(splitPgBuf, 1)
+			}
+
+			// Both pages are written using a single flush buffer
+			if err == nil && len(pgBuf)+len(splitPgBuf) > s.Config.FlushBufferSize/2 {
+				err = ErrPageTooBig
+			}
+
+			// Skip the split if the pages cannot be written out
+			if err != nil {
+				span.SetAttribute("skipped", true)
+				s.logger("plasma").Errorf("unable to split page (err=%v)", err)
+				p := pg.(*page)
+				s.discardDeltas(p.allocDeltaList[len(aCtx.allocDeltaList):])
+				*p.allocCtx, p.head = aCtx, head
+				s.FreePageId(splitPid, ctx)
+				if doUpdate {
+					updated = s.UpdateMapping(pid, pg, ctx)
+				}
+				return updated
+			}
+
+			typ, pgBuf = s.compressPageBlock(pgFlushLSSType(pg, numSegments), pgBuf)
+			splitTyp, splitPgBuf = s.compressPageBlock(lssPageData, splitPgBuf)
+			fdSz, splitFdSz = len(pgBuf), len(splitPgBuf)
 
 			sizes := []int{
 				lssBlockTypeSize + len(pgBuf),
@@ -893,23 +1721,35 @@ func (s *Plasma) trySMOs(pid PageId, pg Page, ctx *wCtx, doUpdate bool) bool {
 
 			offsets, wbufs, res = s.lss.ReserveSpaceMulti(sizes)
 
-			typ := pgFlushLSSType(pg, numSegments)
 			writeLSSBlock(wbufs[0], typ, pgBuf)
+			staleOff, _ = pg.GetLastFlushOffset()
 			pg.AddFlushRecord(offsets[0], fdSz, numSegments)
 
-			writeLSSBlock(wbufs[1], lssPageData, splitPgBuf)
+			writeLSSBlock(wbufs[1], splitTyp, splitPgBuf)
 			newPg.AddFlushRecord(offsets[1], splitFdSz, numSegmentsSplit)
 		}
 
 		s.CreateMapping(splitPid, newPg, ctx)
 		if updated = s.UpdateMapping(pid, pg, ctx); updated {
-			s.indexPage(splitPid, ctx)
+			if err := s.indexPage(splitPid, ctx); err != nil {
+				s.invariantViolation(err)
+			}
 			ctx.sts.Splits++
 
 			if s.shouldPersist {
 				ctx.sts.FlushDataSz += int64(fdSz) + int64(splitFdSz) - int64(staleFdSz)
+				s.trackLSSUsage(staleOff, staleFdSz, offsets[0], fdSz)
+				s.trackLSSUsage(0, 0, offsets[1], splitFdSz)
 				s.lss.FinalizeWrite(res)
 			}
+
+			s.publish(Event{
+				Type:      EventSplit,
+				PageId:    pid,
+				NewPageId: splitPid,
+				NumItems:  pageItemCount(pg.(*page)),
+				Size:      int64(fdSz + splitFdSz),
+			})
 		} else {
 			ctx.sts.SplitConflicts++
 			s.FreePageId(splitPid, ctx)
@@ -921,13 +1761,24 @@ func (s *Plasma) trySMOs(pid PageId, pg Page, ctx *wCtx, doUpdate bool) bool {
 			}
 		}
 	} else if !s.isStartPage(pid) && pg.NeedMerge(s.Config.MinPageItems) {
+		span := s.startSpan(SpanMerge)
 		pg.Close()
 		if updated = s.UpdateMapping(pid, pg, ctx); updated {
-			s.tryPageRemoval(pid, pg, ctx)
-			ctx.sts.Merges++
+			if err := s.tryPageRemoval(pid, pg, ctx); err != nil {
+				s.logger("plasma").Errorf("unable to merge page (err=%v)", err)
+			} else {
+				ctx.sts.Merges++
+				s.publish(Event{
+					Type:     EventMerge,
+					PageId:   pid,
+					NumItems: pageItemCount(pg.(*page)),
+				})
+			}
 		} else {
 			ctx.sts.MergeConflicts++
 		}
+		span.SetAttribute("updated", updated)
+		span.End(nil)
 	} else if doUpdate {
 		updated = s.UpdateMapping(pid, pg, ctx)
 	}
@@ -935,16 +1786,110 @@ func (s *Plasma) trySMOs(pid PageId, pg Page, ctx *wCtx, doUpdate bool) bool {
 	return updated
 }
 
-func (s *Plasma) tryThrottleForMemory(ctx *wCtx) {
-	if s.hasMemoryPressure {
-		for s.TriggerSwapper(ctx.SwapperContext()) {
-			time.Sleep(swapperWaitInterval)
+// splitOversizedPage splits a page whose encoding does not fit into the
+// page buffer, so that it can be written out. The page is compacted first,
+// since the size of its items is only known once compacted. The log is
+// given up on if the page cannot be split, e.g. since the versions of a
+// single key do not fit into a page, as its changes cannot be made durable.
+func (s *Plasma) splitOversizedPage(pid PageId, ctx *wCtx) error {
+	pg, err := s.ReadPage(pid, ctx.pgRdrFn, false, ctx)
+	if err != nil {
+		return err
+	}
+
+	if pg.(*page).head.op != opBasePage {
+		staleOff, _ := pg.GetLastFlushOffset()
+		staleFdSz := pg.Compact()
+		if s.UpdateMapping(pid, pg, ctx) {
+			ctx.sts.Compacts++
+			ctx.sts.FlushDataSz -= int64(staleFdSz)
+			s.trackLSSUsage(staleOff, staleFdSz, 0, 0)
+		}
+		return nil
+	}
+
+	if !pg.NeedSplit(s.Config.MaxPageItems) ||
+		s.trySMOs(pid, pg, ctx, true) && pg.(*page).head.op != opPageSplitDelta {
+		err = s.newPageError("split", pg, ErrPageTooBig)
+		s.handleIOError(err, true)
+		return err
+	}
+
+	return nil
+}
+
+func (s *Plasma) tryThrottleForMemory(ctx *wCtx) error {
+	if !s.hasMemoryPressure {
+		return nil
+	}
+
+	// Nothing is evicted while the swapper is paused
+	var t0 time.Time
+	for s.needsSwap(ctx.SwapperContext()) && !s.IsMaintenancePaused() {
+		if ctx.noThrottle {
+			ctx.sts.ThrottleRejects++
+			return ErrWouldThrottle
 		}
+
+		if t0.IsZero() {
+			t0 = time.Now()
+			ctx.sts.ThrottleStalls++
+		}
+
+		if err := ctx.canceled(); err != nil {
+			ctx.sts.ThrottleStallTime += int64(time.Since(t0))
+			return err
+		}
+		time.Sleep(swapperWaitInterval)
+	}
+
+	if !t0.IsZero() {
+		ctx.sts.ThrottleStallTime += int64(time.Since(t0))
+	}
+
+	return nil
+}
+
+// ThrottleState describes whether operations are made to wait for memory
+// to be freed, so that callers can apply their own admission control
+type ThrottleState struct {
+	Throttled bool
+
+	// Memory used by the instance and the quota of the instance, or the
+	// process wide quota if it has none
+	MemoryInUse int64
+	MemQuota    int64
+}
+
+// ThrottleState returns the current throttling state. Operations are
+// throttled once the memory pressure has been noticed by the monitor,
+// which checks it every 100ms.
+func (s *Plasma) ThrottleState() ThrottleState {
+	st := ThrottleState{
+		Throttled:   s.hasMemoryPressure && !s.IsMaintenancePaused(),
+		MemoryInUse: s.MemoryInUse(),
+		MemQuota:    s.memQuota(),
+	}
+
+	return st
+}
+
+// memQuota returns the memory quota of the instance, or the process wide
+// quota if it has none
+func (s *Plasma) memQuota() int64 {
+	if quota := atomic.LoadInt64(&s.Config.MemQuota); quota > 0 {
+		return quota
 	}
+
+	return atomic.LoadInt64(&memQuota)
 }
 
 func (s *Plasma) fetchPage(itm unsafe.Pointer, ctx *wCtx) (pid PageId, pg Page, err error) {
 retry:
+	if err = ctx.canceled(); err != nil {
+		return nil, nil, err
+	}
+
 	if prev, curr, found := s.Skiplist.Lookup(itm, s.cmp, ctx.buf, ctx.slSts); found {
 		pid = curr
 	} else {
@@ -952,7 +1897,9 @@ retry:
 	}
 
 refresh:
-	s.tryThrottleForMemory(ctx)
+	if err = s.tryThrottleForMemory(ctx); err != nil {
+		return nil, nil, err
+	}
 
 	if pg, err = s.ReadPage(pid, ctx.pgRdrFn, false, ctx); err != nil {
 		return nil, nil, err
@@ -968,12 +1915,134 @@ refresh:
 		goto retry
 	}
 
+	if err = s.trySwapinWithBudget(pid, pg, ctx); err == errSwapinConflict {
+		goto refresh
+	} else if err != nil {
+		return nil, nil, err
+	}
+
 	s.updateCacheMeta(pid)
+	if pgi := pg.(*page); pgi.head != nil {
+		ctx.sts.ChainLenHist.add(int(pgi.head.chainLen))
+	}
 
 	return
 }
 
+var errSwapinConflict = errors.New("swapin conflict")
+
+// Bring an evicted page into memory before the operation touches it so
+// that a slow LSS fetch chain or the cancellation of the operation is
+// reported instead of being waited upon.
+func (s *Plasma) trySwapinWithBudget(pid PageId, pg Page, ctx *wCtx) error {
+	if ctx.fetchBudget == 0 && ctx.opCtx == nil {
+		return nil
+	}
+
+	if ctx.fetchBudget > 0 {
+		ctx.fetchDeadline = time.Now().Add(ctx.fetchBudget)
+	}
+	ctx.fetchCtx = ctx.opCtx
+	err := s.swapinPage(pid, pg, ctx)
+	ctx.fetchDeadline = time.Time{}
+	ctx.fetchCtx = nil
+	return err
+}
+
+// swapinPage reads the evicted part of a page from the LSS. Unlike the
+// page walker, it returns the errors of the LSS reads.
+func (s *Plasma) swapinPage(pid PageId, pg Page, ctx *wCtx) error {
+	pgi := pg.(*page)
+	if pgi.head == nil || !pgi.head.state.IsEvicted() {
+		return nil
+	}
+
+	pd := pgi.head
+	for pd != nil && pd.op != opSwapoutDelta {
+		pd = pd.next
+	}
+
+	if pd == nil {
+		return nil
+	}
+
+	sod := (*swapoutDelta)(unsafe.Pointer(pd))
+	aCtx := new(allocCtx)
+	fetchPg, err := s.fetchSwapoutPage(sod, ctx, aCtx, ctx.storeCtx)
+	if err != nil {
+		allocs, _, _, _, _ := aCtx.GetAllocOps()
+		s.discardDeltas(allocs)
+		return err
+	}
+
+	pgi.allocDeltaList = append(pgi.allocDeltaList, aCtx.allocDeltaList...)
+	pgi.memUsed += aCtx.memUsed
+	pgi.nrecAllocs += aCtx.nrecAllocs
+	pgi.nrecSwapin += aCtx.nrecAllocs
+	pgi.SwapIn(fetchPg.head)
+
+	if !s.UpdateMapping(pid, pg, ctx) {
+		ctx.sts.SwapInConflicts++
+		return errSwapinConflict
+	}
+
+	s.publishPageEvent(EventSwapin, pid, pg)
+	return nil
+}
+
+// publishPageEvent publishes an eviction or a swapin of a page
+func (s *Plasma) publishPageEvent(typ EventMask, pid PageId, pg Page) {
+	if s.subscribed(typ) {
+		pgi := pg.(*page)
+		s.publish(Event{
+			Type:     typ,
+			PageId:   pid,
+			NumItems: pageItemCount(pgi),
+			Size:     int64(flushedDataSize(pgi.head)),
+		})
+	}
+}
+
+// SetFetchBudget limits the time a single operation may spend reading
+// the delta chain of an evicted page from the LSS. Operations exceeding
+// the budget fail with an error wrapping ErrFetchTimeout.
+func (w *Writer) SetFetchBudget(d time.Duration) {
+	w.fetchBudget = d
+}
+
+// checkMutation returns the error a mutation of itm fails with before the
+// page of the item is fetched
+func (w *Writer) checkMutation(itm unsafe.Pointer) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+
+	if err := w.failed(); err != nil {
+		return err
+	}
+
+	if err := w.mutationError(); err != nil {
+		return err
+	}
+
+	if w.readOnly {
+		return ErrReadOnly
+	}
+
+	// Items are encoded in pages using a 16 bit length
+	if w.itemSize(itm) > maxItemSize {
+		return ErrItemTooBig
+	}
+
+	return nil
+}
+
 func (w *Writer) Insert(itm unsafe.Pointer) error {
+	if err := w.checkMutation(itm); err != nil {
+		return err
+	}
+
+	t := w.startOp(w.wCtx)
 retry:
 	pid, pg, err := w.fetchPage(itm, w.wCtx)
 	if err != nil {
@@ -996,11 +2065,199 @@ retry:
 		w.sts.CacheHits++
 	}
 
+	w.endOp("insert", t, pid, pg, w.wCtx)
+
 	w.trySMRObjects(w.wCtx, writerSMRBufferSize)
 	return nil
 }
 
+// DeleteRange deletes the items within [low, high). Instead of deleting the
+// items one by one, a range tombstone is added to each page of the range,
+// which hides the items written before it from lookups and iterators. Pages
+// entirely within the range are compacted right away, the tombstone is
+// folded into the base page of the other pages when they are compacted.
+// Range deletes are not supported with snapshots, which have to keep the
+// deleted versions. The pages updated are counted in Stats.RangeDeletes,
+// the items deleted are not reflected in the item count.
+func (w *Writer) DeleteRange(low, high unsafe.Pointer) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+
+	if err := w.failed(); err != nil {
+		return err
+	}
+
+	if err := w.mutationError(); err != nil {
+		return err
+	}
+
+	if w.readOnly {
+		return ErrReadOnly
+	}
+
+	if w.EnableShapshots {
+		return ErrSnapshots
+	}
+
+	var nextBuf []byte
+	for itm := low; w.cmp(itm, high) < 0; {
+		t := w.startOp(w.wCtx)
+		pid, pg, err := w.fetchPage(itm, w.wCtx)
+		if err != nil {
+			return err
+		}
+
+		nr := w.sts.NumLSSReads
+		pg.DeleteRange(low, high)
+		if w.cmp(low, pg.MinItem()) <= 0 && w.cmp(pg.MaxItem(), high) <= 0 {
+			staleOff, _ := pg.GetLastFlushOffset()
+			staleFdSz := pg.Compact()
+			if !w.UpdateMapping(pid, pg, w.wCtx) {
+				w.sts.DeleteConflicts++
+				continue
+			}
+
+			w.sts.Compacts++
+			w.sts.FlushDataSz -= int64(staleFdSz)
+			w.trackLSSUsage(staleOff, staleFdSz, 0, 0)
+			w.trySMOs(pid, pg, w.wCtx, false)
+		} else if !w.trySMOs(pid, pg, w.wCtx, true) {
+			w.sts.DeleteConflicts++
+			continue
+		}
+
+		w.sts.RangeDeletes++
+		if w.sts.NumLSSReads-nr > 0 {
+			w.sts.CacheMisses++
+		} else {
+			w.sts.CacheHits++
+		}
+
+		w.endOp("delete_range", t, pid, pg, w.wCtx)
+
+		// Continue with the page following the current one, which may have
+		// been split by the update
+		hi := pg.MaxItem()
+		if hi != skiplist.MaxItem {
+			sz := int(w.itemSize(hi))
+			if cap(nextBuf) < sz {
+				nextBuf = make([]byte, sz)
+			}
+			memcopy(unsafe.Pointer(&nextBuf[0]), hi, sz)
+		}
+
+		w.trySMRObjects(w.wCtx, writerSMRBufferSize)
+		if hi == skiplist.MaxItem {
+			break
+		}
+		itm = unsafe.Pointer(&nextBuf[0])
+	}
+
+	return nil
+}
+
+// Upsert inserts itm and returns the item it replaced, or nil if there was
+// none. The replaced item is looked up in the same page update as the
+// insert, so that it cannot be changed in between. It is valid until the
+// next operation of the writer.
+func (w *Writer) Upsert(itm unsafe.Pointer) (unsafe.Pointer, error) {
+	prev, _, err := w.updateIf(itm, opInsertDelta, nil)
+	return prev, err
+}
+
+// InsertIfAbsent inserts itm only if there is no item with the same key.
+// The check is done in the same page update as the insert, so that only
+// one of the concurrent writers of a key inserts it. It returns whether
+// itm was inserted.
+func (w *Writer) InsertIfAbsent(itm unsafe.Pointer) (bool, error) {
+	_, applied, err := w.updateIf(itm, opInsertDelta, func(curr unsafe.Pointer) bool {
+		return curr == nil
+	})
+	return applied, err
+}
+
+// CompareAndDelete deletes the item with the key of itm only if it is
+// identical to itm. The comparison is done in the same page update as the
+// delete, so that an item replaced concurrently is not deleted. It returns
+// whether the item was deleted.
+func (w *Writer) CompareAndDelete(itm unsafe.Pointer) (bool, error) {
+	sz := int(w.itemSize(itm))
+	_, applied, err := w.updateIf(itm, opDeleteDelta, func(curr unsafe.Pointer) bool {
+		return curr != nil && int(w.itemSize(curr)) == sz &&
+			bytes.Equal(ptrBytes(curr, sz), ptrBytes(itm, sz))
+	})
+	return applied, err
+}
+
+// updateIf inserts or deletes itm if cond holds for the item currently
+// stored with its key, or unconditionally if cond is nil, and returns the
+// current item. The condition is evaluated again on the refreshed page
+// when the page update conflicts with another writer.
+func (w *Writer) updateIf(itm unsafe.Pointer, op pageOp,
+	cond func(curr unsafe.Pointer) bool) (unsafe.Pointer, bool, error) {
+
+	if err := w.checkMutation(itm); err != nil {
+		return nil, false, err
+	}
+
+	// Objects are reclaimed before the lookup rather than once the page
+	// is updated, so that the current item outlives the return
+	w.trySMRObjects(w.wCtx, writerSMRBufferSize)
+
+	t := w.startOp(w.wCtx)
+retry:
+	pid, pg, err := w.fetchPage(itm, w.wCtx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	nr := w.sts.NumLSSReads
+	curr := pg.Lookup(itm)
+	applied := cond == nil || cond(curr)
+	if !applied {
+		w.trySMOs(pid, pg, w.wCtx, false)
+	} else if op == opInsertDelta {
+		if curr != nil && !w.EnableShapshots {
+			// Without snapshots, the replaced item has to be removed so
+			// that it is not kept along with itm when the page is compacted
+			pg.Delete(itm)
+		}
+		pg.Insert(itm)
+		if !w.trySMOs(pid, pg, w.wCtx, true) {
+			w.sts.InsertConflicts++
+			goto retry
+		}
+
+		w.sts.BytesIncoming += int64(w.itemSize(itm))
+		w.sts.Inserts++
+	} else {
+		pg.Delete(itm)
+		if !w.trySMOs(pid, pg, w.wCtx, true) {
+			w.sts.DeleteConflicts++
+			goto retry
+		}
+
+		w.sts.BytesIncoming += int64(w.itemSize(itm))
+		w.sts.Deletes++
+	}
+
+	if w.sts.NumLSSReads-nr > 0 {
+		w.sts.CacheMisses++
+	} else {
+		w.sts.CacheHits++
+	}
+
+	w.endOp("update_if", t, pid, pg, w.wCtx)
+	return curr, applied, nil
+}
+
 func (w *Writer) Delete(itm unsafe.Pointer) error {
+	if err := w.checkMutation(itm); err != nil {
+		return err
+	}
+
+	t := w.startOp(w.wCtx)
 retry:
 	pid, pg, err := w.fetchPage(itm, w.wCtx)
 	if err != nil {
@@ -1022,11 +2279,22 @@ retry:
 		w.sts.CacheHits++
 	}
 
+	w.endOp("delete", t, pid, pg, w.wCtx)
+
 	w.trySMRObjects(w.wCtx, writerSMRBufferSize)
 	return nil
 }
 
 func (w *Writer) Lookup(itm unsafe.Pointer) (unsafe.Pointer, error) {
+	if w.isClosed() {
+		return nil, ErrClosed
+	}
+
+	if err := w.failed(); err != nil {
+		return nil, err
+	}
+
+	t := w.startOp(w.wCtx)
 	pid, pg, err := w.fetchPage(itm, w.wCtx)
 	if err != nil {
 		return nil, err
@@ -1041,45 +2309,306 @@ func (w *Writer) Lookup(itm unsafe.Pointer) (unsafe.Pointer, error) {
 		w.sts.CacheHits++
 	}
 
+	w.endOp("lookup", t, pid, pg, w.wCtx)
 	return ret, nil
 }
 
-func (s *Plasma) fetchPageFromLSS(baseOffset LSSOffset, ctx *wCtx) (*page, error) {
-	return s.fetchPageFromLSS2(baseOffset, ctx, ctx.pgAllocCtx, ctx.storeCtx)
-}
+// LookupMulti looks up a batch of items and returns the item found for each
+// of them, or nil, in the order of items. The items are looked up in key
+// order, so that the items falling on the same page share a single fetch of
+// the page, which is swapped in if it has been evicted. Unlike Lookup, the
+// returned items are copies owned by the caller.
+func (w *Writer) LookupMulti(items []unsafe.Pointer) ([]unsafe.Pointer, error) {
+	if w.isClosed() {
+		return nil, ErrClosed
+	}
 
-func (s *Plasma) fetchPageFromLSS2(baseOffset LSSOffset, ctx *wCtx,
-	aCtx *allocCtx, sCtx *storeCtx) (*page, error) {
-	pg := newPage2(nil, nil, ctx, sCtx, aCtx).(*page)
-	offset := baseOffset
-	data := ctx.GetBuffer(bufFetch)
-	numSegments := 0
-loop:
-	for {
-		l, err := s.lss.Read(offset, data)
+	if err := w.failed(); err != nil {
+		return nil, err
+	}
+
+	order := make([]int, len(items))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return w.cmp(items[order[i]], items[order[j]]) < 0
+	})
+
+	results := make([]unsafe.Pointer, len(items))
+	for i := 0; i < len(order); {
+		t := w.startOp(w.wCtx)
+	refresh:
+		pid, pg, err := w.fetchPage(items[order[i]], w.wCtx)
 		if err != nil {
 			return nil, err
 		}
 
-		ctx.sts.NumLSSReads++
-		ctx.sts.LSSReadBytes += int64(l)
+		// The items are sorted, the ones below the high item of the page
+		// are held by the page
+		j := i + 1
+		for j < len(order) && w.cmp(items[order[j]], pg.MaxItem()) < 0 {
+			j++
+		}
 
-		typ := getLSSBlockType(data)
-		switch typ {
-		case lssPageData, lssPageReloc, lssPageUpdate:
-			currPgDelta := newPage2(nil, nil, ctx, sCtx, aCtx).(*page)
-			data := data[lssBlockTypeSize:l]
-			nextOffset, hasChain := currPgDelta.unmarshalDelta(data, ctx)
-			currPgDelta.AddFlushRecord(offset, len(data), 1)
-			pg.Append(currPgDelta)
-			offset = nextOffset
-			numSegments++
-
-			if !hasChain {
-				break loop
+		nr := w.sts.NumLSSReads
+		if j-i > 1 {
+			if err := w.swapinPage(pid, pg, w.wCtx); err == errSwapinConflict {
+				goto refresh
+			} else if err != nil {
+				return nil, err
+			}
+		}
+
+		for k := i; k < j; k++ {
+			if ret := pg.Lookup(items[order[k]]); ret != nil {
+				sz := int(w.itemSize(ret))
+				buf := make([]byte, sz)
+				memcopy(unsafe.Pointer(&buf[0]), ret, sz)
+				results[order[k]] = unsafe.Pointer(&buf[0])
+			}
+		}
+
+		w.trySMOs(pid, pg, w.wCtx, false)
+		if w.sts.NumLSSReads-nr > 0 {
+			w.sts.CacheMisses++
+			w.sts.CacheHits += int64(j - i - 1)
+		} else {
+			w.sts.CacheHits += int64(j - i)
+		}
+
+		w.endOp("lookup_multi", t, pid, pg, w.wCtx)
+		i = j
+	}
+
+	return results, nil
+}
+
+// SeekGE returns the first item greater than or equal to itm, or nil if
+// there is no such item. Only the page holding itm is read, unless none of
+// its items is at or above itm. The returned item is valid until the next
+// operation of the writer.
+func (w *Writer) SeekGE(itm unsafe.Pointer) (unsafe.Pointer, error) {
+	if w.isClosed() {
+		return nil, ErrClosed
+	}
+
+	if err := w.failed(); err != nil {
+		return nil, err
+	}
+
+	t := w.startOp(w.wCtx)
+	pid, pg, err := w.fetchPage(itm, w.wCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	nr := w.sts.NumLSSReads
+	ret := pg.(*page).seekGE(itm)
+	for next := pg.Next(); ret == nil && next != w.EndPageId(); {
+		npg, err := w.ReadPage(next, w.wCtx.pgRdrFn, false, w.wCtx)
+		if err != nil {
+			return nil, err
+		}
+
+		ret = npg.(*page).seekGE(itm)
+		next = npg.Next()
+	}
+
+	w.trySMOs(pid, pg, w.wCtx, false)
+	if w.sts.NumLSSReads-nr > 0 {
+		w.sts.CacheMisses++
+	} else {
+		w.sts.CacheHits++
+	}
+
+	w.endOp("seekge", t, pid, pg, w.wCtx)
+	return ret, nil
+}
+
+// SeekLE returns the last item less than or equal to itm, or nil if there
+// is no such item. Only the page holding itm is read, unless none of its
+// items is at or below itm. The returned item is valid until the next
+// operation of the writer.
+func (w *Writer) SeekLE(itm unsafe.Pointer) (unsafe.Pointer, error) {
+	if w.isClosed() {
+		return nil, ErrClosed
+	}
+
+	if err := w.failed(); err != nil {
+		return nil, err
+	}
+
+	t := w.startOp(w.wCtx)
+	pid, pg, err := w.fetchPage(itm, w.wCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	nr := w.sts.NumLSSReads
+	ret := pg.(*page).seekLE(itm)
+	for low := pg.MinItem(); ret == nil && low != skiplist.MinItem; {
+		ppg, err := w.ReadPage(w.pageBefore(low, w.wCtx), w.wCtx.pgRdrFn, false, w.wCtx)
+		if err != nil {
+			return nil, err
+		}
+
+		ret = ppg.(*page).seekLE(itm)
+		low = ppg.MinItem()
+	}
+
+	w.trySMOs(pid, pg, w.wCtx, false)
+	if w.sts.NumLSSReads-nr > 0 {
+		w.sts.CacheMisses++
+	} else {
+		w.sts.CacheHits++
+	}
+
+	w.endOp("seekle", t, pid, pg, w.wCtx)
+	return ret, nil
+}
+
+// InsertCtx inserts itm like Insert, but gives up once ctx is done while the
+// writer waits for memory to be freed, reads a page from the LSS or retries
+// a conflicting update. The error of ctx is returned in that case.
+func (w *Writer) InsertCtx(ctx context.Context, itm unsafe.Pointer) error {
+	w.opCtx = ctx
+	defer func() {
+		w.opCtx = nil
+	}()
+
+	return w.Insert(itm)
+}
+
+// DeleteCtx deletes itm like Delete, but gives up once ctx is done
+func (w *Writer) DeleteCtx(ctx context.Context, itm unsafe.Pointer) error {
+	w.opCtx = ctx
+	defer func() {
+		w.opCtx = nil
+	}()
+
+	return w.Delete(itm)
+}
+
+// TryInsert inserts itm like Insert, but fails with ErrWouldThrottle
+// instead of waiting while the instance is short of memory
+func (w *Writer) TryInsert(itm unsafe.Pointer) error {
+	w.noThrottle = true
+	defer func() {
+		w.noThrottle = false
+	}()
+
+	return w.Insert(itm)
+}
+
+// TryDelete deletes itm like Delete, but fails with ErrWouldThrottle
+// instead of waiting while the instance is short of memory
+func (w *Writer) TryDelete(itm unsafe.Pointer) error {
+	w.noThrottle = true
+	defer func() {
+		w.noThrottle = false
+	}()
+
+	return w.Delete(itm)
+}
+
+// LookupCtx looks up itm like Lookup, but gives up once ctx is done
+func (w *Writer) LookupCtx(ctx context.Context, itm unsafe.Pointer) (unsafe.Pointer, error) {
+	w.opCtx = ctx
+	defer func() {
+		w.opCtx = nil
+	}()
+
+	return w.Lookup(itm)
+}
+
+func (s *Plasma) fetchPageFromLSS(baseOffset LSSOffset, ctx *wCtx) (*page, error) {
+	return s.fetchPageFromLSS2(baseOffset, ctx, ctx.pgAllocCtx, ctx.storeCtx)
+}
+
+func (s *Plasma) fetchPageFromLSS2(baseOffset LSSOffset, ctx *wCtx,
+	aCtx *allocCtx, sCtx *storeCtx) (*page, error) {
+	t := s.startOp(ctx)
+	span := s.startSpan(SpanFetchPage)
+	span.SetAttribute("offset", int64(baseOffset))
+	pg, numSegments, err := s.readPageSegments(baseOffset, ctx, aCtx, sCtx)
+	if err == nil {
+		ctx.sts.FetchSegmentsHist.add(numSegments)
+	}
+	span.SetAttribute("segments", numSegments)
+	span.End(err)
+	s.endLSSRead(t, baseOffset, numSegments)
+	return pg, err
+}
+
+// readPageSegments reads the chain of page segments starting at baseOffset.
+// The offsets of the older segments recorded in a segment are read together
+// and used as long as they match the chain. Segments written before the
+// offsets were recorded end with the offset of the next segment and are read
+// one after the other.
+func (s *Plasma) readPageSegments(baseOffset LSSOffset, ctx *wCtx,
+	aCtx *allocCtx, sCtx *storeCtx) (*page, int, error) {
+	pg := newPage2(nil, nil, ctx, sCtx, aCtx).(*page)
+	offset := baseOffset
+	var chain []LSSOffset
+	numSegments := 0
+loop:
+	for {
+		if !ctx.fetchDeadline.IsZero() && numSegments > 0 && time.Now().After(ctx.fetchDeadline) {
+			return nil, numSegments, newLSSError("fetch", offset, ErrFetchTimeout)
+		}
+
+		if ctx.fetchCtx != nil && ctx.fetchCtx.Err() != nil {
+			return nil, numSegments, newLSSError("fetch", offset, ctx.fetchCtx.Err())
+		}
+
+		if len(chain) > maxFetchBlocks-1 {
+			chain = chain[:maxFetchBlocks-1]
+		}
+
+		offs := append([]LSSOffset{offset}, chain...)
+		bufs := ctx.fetchBuffers(len(offs))
+		ls, errs := s.lss.ReadMulti(offs, bufs)
+		chain = chain[:0]
+
+		for i, off := range offs {
+			// The rest of the recorded offsets are no longer on the chain
+			// or have to be read again
+			if off != offset || (i > 0 && errs[i] != nil) {
+				break
+			}
+
+			data, l := bufs[i], ls[i]
+			if errs[i] != nil {
+				return nil, numSegments, errs[i]
+			}
+
+			ctx.sts.NumLSSReads++
+			ctx.sts.LSSReadBytes += int64(l)
+
+			typ := getLSSBlockType(data)
+			switch typ {
+			case lssPageData, lssPageReloc, lssPageUpdate:
+				currPgDelta := newPage2(nil, nil, ctx, sCtx, aCtx).(*page)
+				pgData, err := s.decompressPageBlock(data[:l], ctx)
+				if err != nil {
+					return nil, numSegments, newLSSError("fetch", offset, err)
+				}
+
+				var nextOffset LSSOffset
+				var hasChain bool
+				nextOffset, chain, hasChain = currPgDelta.unmarshalDelta2(pgData, ctx, chain[:0])
+				currPgDelta.AddFlushRecord(offset, l-lssBlockTypeSize, 1)
+				pg.Append(currPgDelta)
+				offset = nextOffset
+				numSegments++
+
+				if !hasChain {
+					break loop
+				}
+			default:
+				return nil, numSegments, newLSSError("fetch", offset, ErrCorruptLog)
 			}
-		default:
-			panic(fmt.Sprintf("Invalid page data type %d", typ))
 		}
 	}
 
@@ -1088,25 +2617,258 @@ loop:
 		pg.head.rightSibling = pg.getPageId(pg.head.hiItm, ctx)
 	}
 
-	return pg, nil
+	return pg, numSegments, nil
+}
+
+func (s *Plasma) lssOptions(tag string) lssOptions {
+	return lssOptions{
+		syncMode:    s.SyncMode,
+		directIO:    s.DirectIO,
+		ioEngine:    s.IOEngine,
+		prealloc:    s.PreallocateSegments,
+		key:         s.EncryptionKey,
+		logger:      s.logger(tag),
+		readOnly:    s.readOnly,
+		factory:     s.LogFactory,
+		onInvariant: s.invariantViolation,
+
+		ioErrorRetries: s.IOErrorRetries,
+		onIOError:      s.handleIOError,
+	}
+}
+
+// handleIOError is called with the error of every failed write to the log.
+// Once the log has been given up on, mutations fail with the error.
+func (s *Plasma) handleIOError(err error, failed bool) {
+	if s.OnIOError != nil {
+		s.OnIOError(err)
+	}
+
+	if errors.Is(err, syscall.ENOSPC) {
+		s.enterReadOnlyMode(err)
+	}
+
+	if failed {
+		err = newCauseError(ErrLogWrite, err)
+		s.logError(err.Error())
+		atomic.CompareAndSwapPointer(&s.writeErr, nil, unsafe.Pointer(&err))
+	}
+}
+
+// writeFailed returns the error of the failed write to the log, if any
+func (s *Plasma) writeFailed() error {
+	if p := atomic.LoadPointer(&s.writeErr); p != nil {
+		return *(*error)(p)
+	}
+
+	return nil
+}
+
+// mutationError returns the error mutations fail with once the log has
+// been given up on, while the instance is in the read-only mode or while
+// the LSS quota is exceeded
+func (s *Plasma) mutationError() error {
+	if err := s.writeFailed(); err != nil {
+		return err
+	}
+
+	if err := s.ReadOnlyMode(); err != nil {
+		return err
+	}
+
+	if p := atomic.LoadPointer(&s.lssQuotaErr); p != nil {
+		return *(*error)(p)
+	}
+
+	return nil
+}
+
+func (s *Plasma) diskUsage() int64 {
+	used := s.lss.UsedSpace()
+	if s.vlog != nil {
+		used += s.vlog.UsedSpace()
+	}
+
+	return used
+}
+
+func (s *Plasma) checkDiskUsage() {
+	max := atomic.LoadInt64(&s.Config.MaxDiskUsage)
+	if max == 0 || !s.shouldPersist || s.readOnly {
+		return
+	}
+
+	if used := s.diskUsage(); used > max {
+		s.enterReadOnlyMode(fmt.Errorf("disk usage of %d bytes exceeds %d bytes: %w",
+			used, max, ErrQuotaExceeded))
+	}
+}
+
+// checkLSSQuota records the space used by the LSS, which is too expensive
+// to compute on every mutation, and whether it exceeds the quota
+func (s *Plasma) checkLSSQuota() {
+	if !s.shouldPersist {
+		return
+	}
+
+	used := s.lss.UsedSpace()
+	atomic.StoreInt64(&s.lssUsedSpace, used)
+
+	var p unsafe.Pointer
+	if max := atomic.LoadInt64(&s.Config.MaxLSSUsedSpace); max > 0 && used >= max {
+		err := fmt.Errorf("lss used space of %d bytes exceeds the quota of %d bytes: %w",
+			used, max, ErrQuotaExceeded)
+		p = unsafe.Pointer(&err)
+	}
+
+	atomic.StorePointer(&s.lssQuotaErr, p)
+}
+
+// lssQuotaApproached returns true once the LSS uses lssQuotaCleanPercent of
+// Config.MaxLSSUsedSpace, from when on the cleaner reclaims space eagerly
+func (s *Plasma) lssQuotaApproached() bool {
+	max := atomic.LoadInt64(&s.Config.MaxLSSUsedSpace)
+	return max > 0 && atomic.LoadInt64(&s.lssUsedSpace)*100 >= max*lssQuotaCleanPercent
+}
+
+// SetMaxLSSUsedSpace updates the space the LSS may use
+func (s *Plasma) SetMaxLSSUsedSpace(m int64) {
+	atomic.StoreInt64(&s.Config.MaxLSSUsedSpace, m)
+	s.checkLSSQuota()
+}
+
+// SetMaxDiskUsage updates the space the LSS and the value log may use
+func (s *Plasma) SetMaxDiskUsage(m int64) {
+	atomic.StoreInt64(&s.Config.MaxDiskUsage, m)
+}
+
+func (s *Plasma) enterReadOnlyMode(cause error) {
+	err := newCauseError(ErrReadOnlyMode, cause)
+	if atomic.CompareAndSwapPointer(&s.roModeErr, nil, unsafe.Pointer(&err)) {
+		s.logger("plasma").Errorf("Entering read-only mode - %v", cause)
+	}
+}
+
+// ReadOnlyMode returns the error inserts and deletes fail with while the
+// instance is in the read-only mode, or nil
+func (s *Plasma) ReadOnlyMode() error {
+	if p := atomic.LoadPointer(&s.roModeErr); p != nil {
+		return *(*error)(p)
+	}
+
+	return nil
+}
+
+// ClearReadOnlyMode leaves the read-only mode once space has been freed,
+// e.g. by the LSS cleaner or by deleting other files. It fails if the disk
+// usage of the instance still exceeds Config.MaxDiskUsage.
+func (s *Plasma) ClearReadOnlyMode() error {
+	if max := atomic.LoadInt64(&s.Config.MaxDiskUsage); max > 0 && s.shouldPersist {
+		if used := s.diskUsage(); used > max {
+			return newCauseError(ErrReadOnlyMode, fmt.Errorf("disk usage of %d bytes exceeds %d bytes: %w",
+				used, max, ErrQuotaExceeded))
+		}
+	}
+
+	if atomic.SwapPointer(&s.roModeErr, nil) != nil {
+		s.logger("plasma").Infof("Leaving read-only mode")
+	}
+
+	return nil
 }
 
 func (s *Plasma) logError(err string) {
-	fmt.Printf("Plasma: (fatal error - %s)\n", err)
+	s.logger("plasma").Errorf("fatal error - %s", err)
+}
+
+// invariantViolation reports a violation of an internal invariant, after
+// which the state of the instance cannot be trusted. It panics if
+// Config.DebugPanics is set.
+func (s *Plasma) invariantViolation(err error) {
+	err = newCauseError(ErrInvariant, err)
+	if s.DebugPanics {
+		panic(err)
+	}
+
+	s.logError(err.Error())
+	atomic.CompareAndSwapPointer(&s.fatalErr, nil, unsafe.Pointer(&err))
+}
+
+// failed returns the error of the first invariant violation of the instance
+func (s *Plasma) failed() error {
+	if p := atomic.LoadPointer(&s.fatalErr); p != nil {
+		return *(*error)(p)
+	}
+
+	return nil
 }
 
 func (w *Writer) CompactAll() {
+	w.CompactParallel(1, 0, nil)
+}
+
+// CompactParallel compacts all the pages using concurr threads. If
+// rateLimit is non-zero, the threads are paced to compact at most
+// rateLimit bytes of pages per second. The pass stops with ErrAborted once
+// stop is closed.
+func (w *Writer) CompactParallel(concurr int, rateLimit int64, stop <-chan struct{}) error {
+	if concurr < 1 {
+		concurr = 1
+	}
+
+	// The threads other than the first one use contexts of their own
+	ctxs := make([]*wCtx, concurr-1)
+	for i := range ctxs {
+		ctxs[i] = w.newWCtx()
+	}
+
+	var compacted int64
+	start := time.Now()
 	callb := func(pid PageId, partn RangePartition) error {
-		if pg, err := w.ReadPage(pid, nil, false, w.wCtx); err == nil {
-			staleFdSz := pg.Compact()
-			if updated := w.UpdateMapping(pid, pg, w.wCtx); updated {
-				w.wCtx.sts.FlushDataSz -= int64(staleFdSz)
-			}
+		select {
+		case <-stop:
+			return ErrAborted
+		default:
+		}
+
+		ctx := w.wCtx
+		if partn.Shard > 0 {
+			ctx = ctxs[partn.Shard-1]
+		}
+
+		sz := w.compactPage(pid, ctx)
+		if rateLimit > 0 {
+			n := atomic.AddInt64(&compacted, int64(sz))
+			due := time.Duration(float64(n) / float64(rateLimit) * float64(time.Second))
+			time.Sleep(due - time.Since(start))
 		}
 		return nil
 	}
 
-	w.PageVisitor(callb, 1)
+	err := w.PageVisitor(callb, concurr)
+	for _, ctx := range ctxs {
+		w.retireWCtx(ctx)
+	}
+
+	return err
+}
+
+// compactPage rewrites the page into a single base page and returns
+// the memory used by the page after compaction
+func (w *Writer) compactPage(pid PageId, ctx *wCtx) int {
+	pg, err := w.ReadPage(pid, nil, false, ctx)
+	if err != nil {
+		return 0
+	}
+
+	staleOff, _ := pg.GetLastFlushOffset()
+	staleFdSz := pg.Compact()
+	if updated := w.UpdateMapping(pid, pg, ctx); updated {
+		ctx.sts.FlushDataSz -= int64(staleFdSz)
+		w.trackLSSUsage(staleOff, staleFdSz, 0, 0)
+	}
+
+	return pg.ComputeMemUsed()
 }
 
 func SetMemoryQuota(m int64) {
@@ -1138,8 +2900,9 @@ func (s *Plasma) tryPageSwapin(pg Page) bool {
 		pw := newPgDeltaWalker(pgi.head, pgi.ctx)
 		// Force the pagewalker to read the swapout delta
 		for !pw.End() {
-			if pw.Op() == opSwapoutDelta {
-				pw.Next()
+			op := pw.Op()
+			pw.Next()
+			if op == opSwapoutDelta {
 				break
 			}
 		}
@@ -1150,6 +2913,160 @@ func (s *Plasma) tryPageSwapin(pg Page) bool {
 	return ok
 }
 
+// countItems returns the number of items visible at sn in [low, high) of
+// the recovered instance and the checksum of their keys. Items not covered
+// by a recovery point are counted as well if sn is math.MaxUint64.
+func (s *Plasma) countItems(sn uint64, low, high unsafe.Pointer) (n int64, keySum uint64, err error) {
+	itr := s.NewIterator().(*Iterator)
+	itr.filter = &snFilter{sn: sn}
+	tok := itr.BeginTx()
+	defer func() {
+		itr.Close()
+		itr.EndTx(tok)
+	}()
+
+	if low == skiplist.MinItem {
+		err = itr.SeekFirst()
+	} else {
+		err = itr.Seek(low)
+	}
+
+	for ; err == nil && itr.Valid(); err = itr.Next() {
+		if high != skiplist.MaxItem && s.cmp(itr.Get(), high) >= 0 {
+			break
+		}
+
+		n++
+		keySum += keyChecksum((*item)(itr.Get()).Key())
+	}
+
+	return n, keySum, err
+}
+
+type recoveredMaxSn struct {
+	offset LSSOffset
+	sn     uint64
+}
+
+// recoverItemsCount returns the number of items of the recovered instance
+// and the checksum of their keys. They are derived from the last recovery
+// point and the pages written since its snapshot. Items newer than the
+// snapshot are only written past the log tail recorded with the recovery
+// point, hence the pages are found by scanning the log from there. Recovery
+// points without an offset fall back to the last max sn block which does
+// not exceed their sn, since newer items are only created after such a
+// block. All the items are counted if there is no such block either and
+// the log was not replayed from its head.
+func (s *Plasma) recoverItemsCount() (int64, uint64, error) {
+	var rp *RecoveryPoint
+	for _, r := range s.recoveryPoints {
+		if rp == nil || r.sn > rp.sn {
+			rp = r
+		}
+	}
+
+	start, found := s.recoveryStart, s.recoveryStart == expiredLSSOffset
+	for _, m := range s.recoveredMaxSns {
+		if rp != nil && m.sn <= rp.sn {
+			start, found = m.offset, true
+		}
+	}
+	s.recoveredMaxSns = nil
+
+	if rp != nil && rp.hasOffset {
+		// The log below the head has been cleaned, and the pages written
+		// there have been relocated past it
+		start, found = LSSOffset(maxInt64(int64(rp.offset), int64(s.lss.HeadOffset()))), true
+	}
+
+	if rp == nil || !rp.hasKeySum || !found {
+		return s.countItems(math.MaxUint64, skiplist.MinItem, skiplist.MaxItem)
+	}
+
+	ctx := s.newWCtx()
+	defer s.retireWCtx(ctx)
+
+	pids := make(map[PageId]struct{})
+	callb := func(offset LSSOffset, bs []byte) (bool, error) {
+		switch getLSSBlockType(bs) {
+		case lssPageData, lssPageReloc, lssPageUpdate:
+			data, err := s.decompressPageBlock(bs, ctx)
+			if err != nil {
+				return false, newLSSError("recovery", offset, err)
+			}
+
+			_, low := decodePageState(data)
+			if pid := s.getPageId(low, ctx); pid != nil {
+				pids[pid] = struct{}{}
+			}
+		}
+
+		return true, nil
+	}
+
+	if err := s.visitRecoveryLog(start, callb, ctx.GetBuffer(bufRecovery)); err != nil {
+		return 0, 0, err
+	}
+
+	n, keySum := rp.count, rp.keySum
+	for pid := range pids {
+		pg, err := s.ReadPage(pid, ctx.pgRdrFn, false, ctx)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		low, high := pg.MinItem(), pg.MaxItem()
+		curr, currKeySum, err := s.countItems(math.MaxUint64, low, high)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		prev, prevKeySum, err := s.countItems(rp.sn, low, high)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		n += curr - prev
+		keySum += currKeySum - prevKeySum
+	}
+
+	return n, keySum, nil
+}
+
+// verifyRecovery checks the items visible at the last recovery point
+// against the count and the key checksum recorded with it
+func (s *Plasma) verifyRecovery() error {
+	var rp *RecoveryPoint
+	for _, r := range s.recoveryPoints {
+		if r.hasKeySum && (rp == nil || r.sn > rp.sn) {
+			rp = r
+		}
+	}
+
+	if rp == nil {
+		return nil
+	}
+
+	n, keySum, err := s.countItems(rp.sn, skiplist.MinItem, skiplist.MaxItem)
+	if err != nil {
+		return err
+	}
+
+	if n != rp.count || keySum != rp.keySum {
+		err := &RecoveryMismatchError{
+			Sn:             rp.sn,
+			Count:          n,
+			ExpectedCount:  rp.count,
+			KeySum:         keySum,
+			ExpectedKeySum: rp.keySum,
+		}
+		s.logger("recovery").Errorf("%v", err)
+		return err
+	}
+
+	return nil
+}
+
 func (s *Plasma) ItemsCount() int64 {
 	return s.itemsCount
 }
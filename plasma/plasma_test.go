@@ -1,12 +1,21 @@
 package plasma
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/couchbase/nitro/skiplist"
+	"io"
+	"io/ioutil"
+	"math/rand"
 	"os"
+	"path/filepath"
 	"runtime"
 	"runtime/debug"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 	"unsafe"
@@ -120,6 +129,292 @@ func doLookup(w *Writer, wg *sync.WaitGroup, id, n int) {
 	}
 }
 
+func TestPlasmaUpsert(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testCfg)
+	defer s.Close()
+
+	// Only one of the concurrent upserts of an item finds it missing
+	n, nw := 100000, 4
+	var wg sync.WaitGroup
+	var inserted int64
+	for i := 0; i < nw; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := s.NewWriter()
+			for j := 0; j < n; j++ {
+				itm := skiplist.NewIntKeyItem(j)
+				prev, err := w.Upsert(itm)
+				if err != nil {
+					t.Errorf("upsert failed: %v", err)
+					return
+				}
+
+				if prev == nil {
+					atomic.AddInt64(&inserted, 1)
+				} else if skiplist.CompareInt(itm, prev) != 0 {
+					t.Errorf("expected %d, got %d", j, skiplist.IntFromItem(prev))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if inserted != int64(n) {
+		t.Errorf("expected %d new items, got %d", n, inserted)
+	}
+
+	w := s.NewWriter()
+	for i := 0; i < n; i += 2 {
+		w.Delete(skiplist.NewIntKeyItem(i))
+	}
+	s.PersistAll()
+	s.EvictAll(0)
+
+	for i := 0; i < n; i++ {
+		prev, err := w.Upsert(skiplist.NewIntKeyItem(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if deleted := i%2 == 0; deleted != (prev == nil) {
+			t.Errorf("unexpected replaced item %v for %d", prev, i)
+		}
+	}
+}
+
+func TestPlasmaUpsertValue(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	cfg := testSnCfg
+	cfg.EnableShapshots = false
+	s := newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	w := s.NewWriter()
+	upsert := func(i int, v string) []byte {
+		k := []byte(fmt.Sprintf("key-%10d", i))
+		itm, err := s.newKVItem(k, []byte(v), 0, make([]byte, maxPageEncodedSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		prev, err := w.Upsert(unsafe.Pointer(itm))
+		if err != nil {
+			t.Fatal(err)
+		} else if prev == nil {
+			return nil
+		}
+		return append([]byte(nil), (*item)(prev).Value()...)
+	}
+
+	n := 10000
+	for i := 0; i < n; i++ {
+		if prev := upsert(i, fmt.Sprintf("val-%d", i)); prev != nil {
+			t.Fatalf("key %d: unexpected replaced value %s", i, prev)
+		}
+	}
+
+	// The replaced value is returned by the evicted pages too
+	s.PersistAll()
+	s.EvictAll(0)
+	for i := 0; i < n; i++ {
+		if prev := upsert(i, fmt.Sprintf("new-%d", i)); string(prev) != fmt.Sprintf("val-%d", i) {
+			t.Fatalf("key %d: expected the old value, got %s", i, prev)
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		v, err := w.LookupKV([]byte(fmt.Sprintf("key-%10d", i)))
+		if err != nil || string(v) != fmt.Sprintf("new-%d", i) {
+			t.Fatalf("key %d: unexpected value %s (err=%v)", i, v, err)
+		}
+	}
+}
+
+func TestPlasmaConditionalWrites(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testCfg)
+	defer s.Close()
+
+	// Only one of the concurrent writers of an item inserts or deletes it
+	n, nw := 50000, 4
+	var wg sync.WaitGroup
+	var inserted, deleted int64
+	run := func(op func(w *Writer, itm unsafe.Pointer) (bool, error), step int, count *int64) {
+		for i := 0; i < nw; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w := s.NewWriter()
+				for j := 0; j < n; j += step {
+					ok, err := op(w, skiplist.NewIntKeyItem(j))
+					if err != nil {
+						t.Errorf("unexpected error: %v", err)
+						return
+					} else if ok {
+						atomic.AddInt64(count, 1)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	}
+
+	run((*Writer).InsertIfAbsent, 1, &inserted)
+	if inserted != int64(n) {
+		t.Errorf("expected %d inserts, got %d", n, inserted)
+	}
+
+	run((*Writer).CompareAndDelete, 2, &deleted)
+	if deleted != int64(n/2) {
+		t.Errorf("expected %d deletes, got %d", n/2, deleted)
+	}
+
+	w := s.NewWriter()
+	for i := 0; i < n; i++ {
+		got, _ := w.Lookup(skiplist.NewIntKeyItem(i))
+		if i%2 == 0 && got != nil {
+			t.Errorf("expected %d to be deleted", i)
+		} else if i%2 != 0 && got == nil {
+			t.Errorf("expected %d to be found", i)
+		}
+	}
+
+	if ok, err := w.InsertIfAbsent(skiplist.NewIntKeyItem(1)); ok || err != nil {
+		t.Errorf("unexpected insert of an existing item (err=%v)", err)
+	}
+
+	if ok, err := w.CompareAndDelete(skiplist.NewIntKeyItem(0)); ok || err != nil {
+		t.Errorf("unexpected delete of a missing item (err=%v)", err)
+	}
+}
+
+func TestPlasmaDeleteRange(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testCfg)
+
+	w := s.NewWriter()
+	n := 100000
+	for i := 0; i < n; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+
+	// Partially covered pages keep the tombstones in their delta chain
+	ranges := [][2]unsafe.Pointer{
+		{skiplist.MinItem, skiplist.NewIntKeyItem(5000)},
+		{skiplist.NewIntKeyItem(10001), skiplist.NewIntKeyItem(50000)},
+		{skiplist.NewIntKeyItem(90000), skiplist.MaxItem},
+	}
+	for _, r := range ranges {
+		if err := w.DeleteRange(r[0], r[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if sts := s.GetStats(); sts.Deletes != 0 || sts.RangeDeletes < int64(len(ranges)) {
+		t.Errorf("unexpected delete stats %d, %d", sts.Deletes, sts.RangeDeletes)
+	}
+
+	// Items inserted after a range delete are kept
+	w.Insert(skiplist.NewIntKeyItem(20000))
+
+	verify := func(stage string) {
+		exists := func(i int) bool {
+			return i == 20000 || i >= 5000 && i <= 10000 || i >= 50000 && i < 90000
+		}
+
+		var count int
+		for i := 0; i < n; i++ {
+			if exists(i) {
+				count++
+			}
+
+			got, _ := w.Lookup(skiplist.NewIntKeyItem(i))
+			if exists(i) != (got != nil) {
+				t.Fatalf("%s: unexpected lookup result %v for %d", stage, got, i)
+			}
+		}
+
+		itr := s.NewIterator()
+		defer itr.(*Iterator).Close()
+		var got int
+		for itr.SeekFirst(); itr.Valid(); itr.Next() {
+			if i := skiplist.IntFromItem(itr.Get()); !exists(i) {
+				t.Fatalf("%s: unexpected item %d", stage, i)
+			}
+			got++
+		}
+
+		if got != count {
+			t.Errorf("%s: expected %d items, got %d", stage, count, got)
+		}
+	}
+
+	verify("memory")
+	s.PersistAll()
+	s.EvictAll(0)
+	verify("evicted")
+	s.Close()
+
+	s = newTestIntPlasmaStore(testCfg)
+	defer s.Close()
+	w = s.NewWriter()
+	verify("recovered")
+	w.CompactAll()
+	verify("compacted")
+
+	os.RemoveAll("teststore.data")
+	ss := newTestIntPlasmaStore(testSnCfg)
+	defer ss.Close()
+	if err := ss.NewWriter().DeleteRange(skiplist.MinItem, skiplist.MaxItem); err != ErrSnapshots {
+		t.Errorf("expected %v, got %v", ErrSnapshots, err)
+	}
+}
+
+func TestPlasmaLookupMulti(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testCfg)
+	defer s.Close()
+
+	w := s.NewWriter()
+	n := 100000
+	for i := 0; i < n; i += 2 {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+	s.PersistAll()
+	s.EvictAll(0)
+
+	keys := rand.Perm(n)[:n/10]
+	items := make([]unsafe.Pointer, len(keys))
+	for i, k := range keys {
+		items[i] = skiplist.NewIntKeyItem(k)
+	}
+
+	nr := w.wCtx.sts.NumLSSReads
+	got, err := w.LookupMulti(items)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, k := range keys {
+		if k%2 != 0 && got[i] != nil {
+			t.Errorf("expected %d to be missing", k)
+		} else if k%2 == 0 && (got[i] == nil || skiplist.IntFromItem(got[i]) != k) {
+			t.Errorf("expected %d, got %v", k, got[i])
+		}
+	}
+
+	// Each page is fetched once for all of its items
+	if reads := w.wCtx.sts.NumLSSReads - nr; reads == 0 || reads > int64(n/2/testCfg.MinPageItems) {
+		t.Errorf("unexpected number of lss reads %d for %d items", reads, len(keys))
+	}
+
+	if got, err := w.LookupMulti(nil); err != nil || len(got) != 0 {
+		t.Errorf("unexpected result for an empty batch (err=%v)", err)
+	}
+}
+
 func TestPlasmaInsertPerf(t *testing.T) {
 	var wg sync.WaitGroup
 
@@ -230,7 +525,7 @@ func TestIteratorSimple(t *testing.T) {
 	}
 
 	if i != 1000000 {
-		t.Errorf("expected %d, got %d", i)
+		t.Errorf("expected %d, got %d", 1000000, i)
 	}
 
 }
@@ -257,6 +552,164 @@ func TestIteratorSeek(t *testing.T) {
 	}
 }
 
+func TestIteratorBounds(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testCfg)
+	defer s.Close()
+	w := s.NewWriter()
+	for i := 0; i < 100000; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+
+	itr := s.NewIterator().(*Iterator)
+	defer itr.Close()
+
+	itr.SetEndKey(skiplist.NewIntKeyItem(5000))
+	i := 1000
+	for itr.Seek(skiplist.NewIntKeyItem(i)); itr.Valid(); itr.Next() {
+		if v := skiplist.IntFromItem(itr.Get()); v != i {
+			t.Errorf("expected %d, got %d", i, v)
+		}
+		i++
+	}
+
+	if i != 5001 {
+		t.Errorf("expected iteration to stop at %d, got %d", 5001, i)
+	}
+
+	itr.SetBounds(skiplist.NewIntKeyItem(200), skiplist.NewIntKeyItem(299))
+	i = 200
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		i++
+	}
+
+	if i != 300 {
+		t.Errorf("expected iteration to stop at %d, got %d", 300, i)
+	}
+
+	if itr.Seek(skiplist.NewIntKeyItem(300)); itr.Valid() {
+		t.Errorf("expected iterator past end key to be invalid")
+	}
+}
+
+func TestIteratorReverse(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testCfg)
+	defer s.Close()
+	w := s.NewWriter()
+
+	// Even items only, spread over many pages
+	n := 100000
+	for i := 0; i < n; i += 2 {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+	s.PersistAll()
+	s.EvictAll(0)
+
+	itr := s.NewIterator().(*Iterator)
+	defer itr.Close()
+
+	i := n - 2
+	for itr.SeekLast(); itr.Valid(); itr.Prev() {
+		if v := skiplist.IntFromItem(itr.Get()); v != i {
+			t.Fatalf("expected %d, got %d", i, v)
+		}
+		i -= 2
+	}
+
+	if i != -2 {
+		t.Errorf("expected iteration to stop at %d, got %d", -2, i)
+	}
+
+	if itr.SeekLT(skiplist.NewIntKeyItem(0)); itr.Valid() {
+		t.Errorf("expected no item below the first item")
+	}
+
+	// Change of direction
+	itr.SeekLT(skiplist.NewIntKeyItem(5001))
+	steps := []func() error{itr.Prev, itr.Next, itr.Next, itr.Prev}
+	for k, exp := range []int{5000, 4998, 5000, 5002, 5000} {
+		if v := skiplist.IntFromItem(itr.Get()); v != exp {
+			t.Errorf("expected %d, got %d", exp, v)
+		}
+
+		if k < len(steps) {
+			steps[k]()
+		}
+	}
+
+	// Bounds
+	itr.SetBounds(skiplist.NewIntKeyItem(200), skiplist.NewIntKeyItem(299))
+	i = 298
+	for itr.SeekLast(); itr.Valid(); itr.Prev() {
+		if v := skiplist.IntFromItem(itr.Get()); v != i {
+			t.Fatalf("expected %d, got %d", i, v)
+		}
+		i -= 2
+	}
+
+	if i != 198 {
+		t.Errorf("expected iteration to stop at %d, got %d", 198, i)
+	}
+}
+
+func TestPlasmaSeekGELE(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testCfg)
+	defer s.Close()
+
+	// Even items with a gap spanning several pages
+	w := s.NewWriter()
+	n := 100000
+	for i := 0; i < n; i += 2 {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+
+	for i := 40000; i < 60000; i += 2 {
+		w.Delete(skiplist.NewIntKeyItem(i))
+	}
+	s.PersistAll()
+	s.EvictAll(0)
+
+	expect := func(op string, got unsafe.Pointer, err error, exp int) {
+		if err != nil {
+			t.Fatalf("%s: %v", op, err)
+		}
+
+		if exp < 0 {
+			if got != nil {
+				t.Errorf("%s: expected no item, got %d", op, skiplist.IntFromItem(got))
+			}
+		} else if got == nil || skiplist.IntFromItem(got) != exp {
+			t.Errorf("%s: expected %d, got %v", op, exp, got)
+		}
+	}
+
+	for i := -1; i <= n; i++ {
+		ge, le := i+i%2, i-i%2
+		if i < 0 {
+			ge, le = 0, -1
+		}
+
+		if ge >= 40000 && ge < 60000 {
+			ge = 60000
+		}
+
+		if le >= 40000 && le < 60000 {
+			le = 39998
+		}
+
+		if ge >= n {
+			ge, le = -1, n-2
+		}
+
+		got, err := w.SeekGE(skiplist.NewIntKeyItem(i))
+		expect(fmt.Sprintf("SeekGE(%d)", i), got, err, ge)
+		got, err = w.SeekLE(skiplist.NewIntKeyItem(i))
+		expect(fmt.Sprintf("SeekLE(%d)", i), got, err, le)
+	}
+}
+
 func TestPlasmaIteratorLookupPerf(t *testing.T) {
 	var wg sync.WaitGroup
 
@@ -324,410 +777,1860 @@ func TestPlasmaPersistor(t *testing.T) {
 	fmt.Println(s.GetStats())
 }
 
-func TestPlasmaRecovery(t *testing.T) {
-	var wg sync.WaitGroup
+func TestPlasmaCloseContext(t *testing.T) {
 	os.RemoveAll("teststore.data")
-	s := newTestIntPlasmaStore(testCfg)
+	cfg := testSnCfg
+	cfg.RecoveryPointMaxAge = time.Hour
+	s := newTestIntPlasmaStore(cfg)
 
-	numThreads := 8
-	n := 1000000
-	m := 900000
-	ws := make([]*Writer, numThreads)
-	for i := 0; i < numThreads; i++ {
-		wg.Add(1)
-		w := s.NewWriter()
-		ws[i] = w
-		go doInsert(w, &wg, i, n/numThreads)
+	w := s.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), nil)
 	}
-	wg.Wait()
 
-	for i := 0; i < numThreads; i++ {
-		wg.Add(1)
-		w := ws[i]
-		go doDelete(w, &wg, i, m/numThreads)
+	// Stall the recovery point daemon
+	s.mvcc.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	if err := s.CloseContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected timeout, got %v", err)
 	}
-	wg.Wait()
+	s.mvcc.Unlock()
 
-	fmt.Println(s.GetStats())
-	fmt.Println(s.Skiplist.GetStats())
-	s.PersistAll()
-	s.Close()
+	select {
+	case <-s.closeDone:
+	case <-time.After(time.Second * 10):
+		t.Fatal("instance was not released")
+	}
+}
+
+func TestPlasmaCloseAfterTimeout(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	cfg := testSnCfg
+	cfg.RecoveryPointMaxAge = time.Hour
+	s := newTestIntPlasmaStore(cfg)
 
-	fmt.Println("***** reopen file *****")
-	s = newTestIntPlasmaStore(testCfg)
 	w := s.NewWriter()
-	fmt.Println(s.GetStats())
-	fmt.Println(s.Skiplist.GetStats())
+	for i := 0; i < 1000; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), nil)
+	}
 
-	for i := 0; i < m; i++ {
-		itm := skiplist.NewIntKeyItem(i)
+	s.mvcc.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	if err := s.CloseContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected timeout, got %v", err)
+	}
+
+	// Close waits for the release started by CloseContext
+	closed := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+		t.Fatal("expected Close to wait for the instance to be released")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	s.mvcc.Unlock()
+	select {
+	case <-closed:
+	case <-time.After(time.Second * 10):
+		t.Fatal("instance was not released")
+	}
+
+	select {
+	case <-s.closeDone:
+	default:
+		t.Errorf("expected Close to return once the instance was released")
+	}
+
+	if err := DestroyInstance(cfg.File); err != nil {
+		t.Errorf("expected the files of the released instance to be removed, got %v", err)
+	}
+}
+
+func TestPlasmaDestroy(t *testing.T) {
+	os.RemoveAll("teststore.destroy")
+	cfg := testSnCfg
+	cfg.File = "teststore.destroy"
+	s := newTestIntPlasmaStore(cfg)
+
+	w := s.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), nil)
+	}
+	s.PersistAll()
+
+	if err := DestroyInstance("teststore.destroy"); err != ErrInUse {
+		t.Errorf("expected %v, got %v", ErrInUse, err)
+	}
+
+	if err := s.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat("teststore.destroy"); !os.IsNotExist(err) {
+		t.Errorf("expected instance files to be removed, got %v", err)
+	}
+}
+
+func TestPlasmaSync(t *testing.T) {
+	os.RemoveAll("teststore.sync")
+	defer os.RemoveAll("teststore.sync")
+	cfg := testSnCfg
+	cfg.File = "teststore.sync"
+	cfg.SyncMode = SyncModeOnCommitOnly
+	s := newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	w := s.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), nil)
+	}
+
+	if err := s.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	fd, err := os.Open(filepath.Join(cfg.File, headerFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+
+	var buf [logSBSize]byte
+	sb, _, err := readLogSB(fd, buf[:])
+	if err != nil || LSSOffset(sb.tail) != s.lss.TailOffset() || sb.tail == 0 {
+		t.Errorf("expected committed tail %d, got %d (err=%v)", s.lss.TailOffset(), sb.tail, err)
+	}
+}
+
+type countingLog struct {
+	Log
+	appends *int64
+}
+
+func (l countingLog) Append(bs []byte) error {
+	atomic.AddInt64(l.appends, 1)
+	return l.Log.Append(bs)
+}
+
+func TestPlasmaLogFactory(t *testing.T) {
+	os.RemoveAll("teststore.factory")
+	defer os.RemoveAll("teststore.factory")
+
+	var appends int64
+	var paths []string
+	cfg := testSnCfg
+	cfg.File = "teststore.factory"
+	cfg.LogFactory = func(path string, opts LogOptions) (Log, error) {
+		paths = append(paths, path)
+		l, err := newLog(path, opts.SegmentSize, opts.Sync, false, false, IOEngineSync, nil)
+		return countingLog{Log: l, appends: &appends}, err
+	}
+
+	s := newTestIntPlasmaStore(cfg)
+	w := s.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte("val"))
+	}
+	s.PersistAll()
+	s.Close()
+
+	if len(paths) != 1 || paths[0] != cfg.File || atomic.LoadInt64(&appends) == 0 {
+		t.Fatalf("expected appends to the custom log at %s, got %d appends at %v",
+			cfg.File, appends, paths)
+	}
+
+	s = newTestIntPlasmaStore(cfg)
+	defer s.Close()
+	w = s.NewWriter()
+	for i := 0; i < 1000; i++ {
+		if v, err := w.LookupKV([]byte(fmt.Sprintf("key-%10d", i))); err != nil || string(v) != "val" {
+			t.Fatalf("key-%10d: expected val, got %q (err=%v)", i, v, err)
+		}
+	}
+}
+
+// slowCommitLog counts the commits, which take a millisecond each
+type slowCommitLog struct {
+	Log
+	commits *int64
+}
+
+func (l slowCommitLog) Commit() error {
+	atomic.AddInt64(l.commits, 1)
+	time.Sleep(time.Millisecond)
+	return l.Log.Commit()
+}
+
+func TestPlasmaGroupSync(t *testing.T) {
+	os.RemoveAll("teststore.data")
+
+	var commits int64
+	cfg := testSnCfg
+	cfg.SyncMode = SyncModeOnCommitOnly
+	cfg.LogFactory = func(path string, opts LogOptions) (Log, error) {
+		l, err := newLog(path, opts.SegmentSize, opts.Sync, false, false, IOEngineSync, nil)
+		return slowCommitLog{Log: l, commits: &commits}, err
+	}
+
+	s := newTestIntPlasmaStore(cfg)
+
+	var wg sync.WaitGroup
+	n := 64
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := s.NewWriter()
+			k := []byte(fmt.Sprintf("key-%10d", i))
+			w.InsertKV(k, k)
+			if err := s.Sync(); err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if c := atomic.LoadInt64(&commits); c == 0 || c >= int64(n/2) {
+		t.Errorf("expected the syncs to share commits, got %d commits for %d syncs", c, n)
+	}
+
+	s.Close()
+	s = newTestIntPlasmaStore(cfg)
+	defer s.Close()
+	w := s.NewWriter()
+	for i := 0; i < n; i++ {
+		k := []byte(fmt.Sprintf("key-%10d", i))
+		if v, err := w.LookupKV(k); err != nil || string(v) != string(k) {
+			t.Errorf("%s: expected the value to be synced, got %q (err=%v)", k, v, err)
+		}
+	}
+}
+
+type failingLog struct {
+	Log
+	fail *int32
+}
+
+func (l failingLog) Append(bs []byte) error {
+	if atomic.LoadInt32(l.fail) == 1 {
+		return syscall.ENOSPC
+	}
+	return l.Log.Append(bs)
+}
+
+// slowReadLog records the number of reads in flight together
+type slowReadLog struct {
+	Log
+	inflight, maxInflight *int64
+}
+
+func (l slowReadLog) Read(bs []byte, off int64) error {
+	n := atomic.AddInt64(l.inflight, 1)
+	defer atomic.AddInt64(l.inflight, -1)
+	for m := atomic.LoadInt64(l.maxInflight); n > m; m = atomic.LoadInt64(l.maxInflight) {
+		if atomic.CompareAndSwapInt64(l.maxInflight, m, n) {
+			break
+		}
+	}
+
+	time.Sleep(time.Millisecond)
+	return l.Log.Read(bs, off)
+}
+
+func TestPlasmaFetchSegmentsTogether(t *testing.T) {
+	os.RemoveAll("teststore.data")
+
+	var inflight, maxInflight int64
+	cfg := testSnCfg
+	cfg.MaxPageLSSSegments = 8
+	cfg.AutoLSSCleaning = false
+	cfg.AutoSwapper = false
+	cfg.LogFactory = func(path string, opts LogOptions) (Log, error) {
+		l, err := newLog(path, opts.SegmentSize, opts.Sync, false, false, IOEngineSync, nil)
+		return slowReadLog{Log: l, inflight: &inflight, maxInflight: &maxInflight}, err
+	}
+
+	s := newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	w := s.NewWriter()
+	n := 5000
+	for k := 0; k < 4; k++ {
+		for i := 0; i < n; i++ {
+			w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte(fmt.Sprintf("val-%d", k)))
+		}
+		s.PersistAll()
+	}
+
+	s.EvictAll(0)
+	for i := 0; i < n; i += 10 {
+		if v, err := w.LookupKV([]byte(fmt.Sprintf("key-%10d", i))); err != nil || string(v) != "val-3" {
+			t.Fatalf("key %d: expected val-3, got %s (err=%v)", i, v, err)
+		}
+	}
+
+	if sts := s.GetStats(); maxInflight < 2 || maxInflight > maxFetchBlocks || sts.NumLSSReads == 0 {
+		t.Errorf("expected up to %d segments of the pages to be read together, got %d reads in flight", maxFetchBlocks, maxInflight)
+	}
+}
+
+func TestPlasmaFetchUnchainedSegments(t *testing.T) {
+	os.RemoveAll("teststore.data")
+
+	var inflight, maxInflight int64
+	cfg := testCfg
+	cfg.AutoSwapper = false
+	cfg.LogFactory = func(path string, opts LogOptions) (Log, error) {
+		l, err := newLog(path, opts.SegmentSize, opts.Sync, false, false, IOEngineSync, nil)
+		return slowReadLog{Log: l, inflight: &inflight, maxInflight: &maxInflight}, err
+	}
+
+	s := newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	// Write the segments of a page without the offsets of the older
+	// segments, as written before they were recorded
+	pg, _ := newTestPage()
+	buf := make([]byte, 1024*1024)
+	var offset LSSOffset
+	for i := 1; i <= 8; i++ {
+		pg.Insert(skiplist.NewIntKeyItem(i))
+		bs, _, _, numSegs, err := pg.Marshal(buf, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tmp, _ := newTestPage()
+		if _, chain, hasChain := tmp.unmarshalDelta2(bs, nil, nil); hasChain {
+			bs = bs[:len(bs)-2-8*len(chain)]
+		}
+
+		var wbuf []byte
+		var res LSSResource
+		offset, wbuf, res = s.lss.ReserveSpace(lssBlockTypeSize + len(bs))
+		writeLSSBlock(wbuf, lssPageData, bs)
+		s.lss.FinalizeWrite(res)
+		pg.AddFlushRecord(offset, len(bs), numSegs)
+	}
+	s.lss.Sync(true)
+
+	w := s.NewWriter()
+	fetched, numSegments, err := s.readPageSegments(offset, w.wCtx, w.pgAllocCtx, w.storeCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := 0
+	itr := fetched.NewIterator()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		n++
+	}
+
+	if n != 8 || numSegments != 8 || maxInflight != 1 {
+		t.Errorf("expected 8 items in 8 segments read one after the other, got %d items, %d segments, %d reads in flight",
+			n, numSegments, maxInflight)
+	}
+}
+
+func TestPlasmaIOError(t *testing.T) {
+	os.RemoveAll("teststore.data")
+
+	var fail int32
+	var ioErrs int64
+	cfg := testSnCfg
+	cfg.IOErrorRetries = 1
+	cfg.OnIOError = func(err error) {
+		atomic.AddInt64(&ioErrs, 1)
+	}
+	cfg.LogFactory = func(path string, opts LogOptions) (Log, error) {
+		l, err := newLog(path, opts.SegmentSize, opts.Sync, false, false, IOEngineSync, nil)
+		return failingLog{Log: l, fail: &fail}, err
+	}
+
+	s := newTestIntPlasmaStore(cfg)
+	w := s.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte("val"))
+	}
+	s.PersistAll()
+
+	atomic.StoreInt32(&fail, 1)
+	for i := 1000; i < 2000; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte("val"))
+	}
+	s.PersistAll()
+
+	if n := atomic.LoadInt64(&ioErrs); n != 2 {
+		t.Errorf("expected 2 failed writes, got %d", n)
+	}
+
+	err := w.InsertKV([]byte("key"), []byte("val"))
+	if !errors.Is(err, ErrLogWrite) || !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("expected insert to fail with the write error, got %v", err)
+	}
+
+	for i := 0; i < 2000; i++ {
+		if v, err := w.LookupKV([]byte(fmt.Sprintf("key-%10d", i))); err != nil || string(v) != "val" {
+			t.Fatalf("key-%10d: expected val, got %q (err=%v)", i, v, err)
+		}
+	}
+	s.Close()
+
+	// Only the items written before the failure are recovered
+	atomic.StoreInt32(&fail, 0)
+	s = newTestIntPlasmaStore(cfg)
+	defer s.Close()
+	w = s.NewWriter()
+	for i := 0; i < 1000; i++ {
+		if v, err := w.LookupKV([]byte(fmt.Sprintf("key-%10d", i))); err != nil || string(v) != "val" {
+			t.Fatalf("key-%10d: expected val, got %q (err=%v)", i, v, err)
+		}
+	}
+
+	if err := w.InsertKV([]byte("key"), []byte("val")); err != nil {
+		t.Errorf("expected insert to succeed after reopening, got %v", err)
+	}
+}
+
+func TestPlasmaReadOnlyMode(t *testing.T) {
+	os.RemoveAll("teststore.data")
+
+	var fail int32
+	cfg := testSnCfg
+	cfg.LogFactory = func(path string, opts LogOptions) (Log, error) {
+		l, err := newLog(path, opts.SegmentSize, opts.Sync, false, false, IOEngineSync, nil)
+		return failingLog{Log: l, fail: &fail}, err
+	}
+
+	s := newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	waitForMode := func() error {
+		for i := 0; i < 100 && s.ReadOnlyMode() == nil; i++ {
+			time.Sleep(20 * time.Millisecond)
+		}
+		return s.ReadOnlyMode()
+	}
+
+	w := s.NewWriter()
+	n := 50000
+	for i := 0; i < n; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte("val"))
+	}
+	s.PersistAll()
+
+	s.SetMaxDiskUsage(1024 * 1024)
+	if err := waitForMode(); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected read-only mode on exceeding the disk usage, got %v", err)
+	}
+
+	if err := w.InsertKV([]byte("key"), []byte("val")); !errors.Is(err, ErrReadOnlyMode) || !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected insert to fail in read-only mode, got %v", err)
+	}
+
+	if err := w.DeleteKV([]byte(fmt.Sprintf("key-%10d", 0))); !errors.Is(err, ErrReadOnlyMode) {
+		t.Errorf("expected delete to fail in read-only mode, got %v", err)
+	}
+
+	snap := s.NewSnapshot()
+	itr := snap.NewIterator()
+	count := 0
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		count++
+	}
+	itr.Close()
+	snap.Close()
+
+	if v, err := w.LookupKV([]byte(fmt.Sprintf("key-%10d", 0))); err != nil || string(v) != "val" || count != n {
+		t.Errorf("expected reads to work in read-only mode, got %q (err=%v) and %d items", v, err, count)
+	}
+
+	if err := s.ClearReadOnlyMode(); !errors.Is(err, ErrReadOnlyMode) {
+		t.Errorf("expected the mode to be kept while the disk usage exceeds the limit, got %v", err)
+	}
+
+	s.SetMaxDiskUsage(0)
+	if err := s.ClearReadOnlyMode(); err != nil || s.ReadOnlyMode() != nil {
+		t.Fatalf("expected the mode to be cleared, got %v", err)
+	}
+
+	// Writes failing since the disk is full
+	atomic.StoreInt32(&fail, 1)
+	w.InsertKV([]byte("key"), []byte("val"))
+	done := make(chan struct{})
+	go func() {
+		s.PersistAll()
+		close(done)
+	}()
+
+	if err := waitForMode(); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("expected read-only mode on a full disk, got %v", err)
+	}
+
+	if err := w.InsertKV([]byte("key"), []byte("val")); !errors.Is(err, ErrReadOnlyMode) {
+		t.Errorf("expected insert to fail in read-only mode, got %v", err)
+	}
+
+	atomic.StoreInt32(&fail, 0)
+	<-done
+	if err := s.ClearReadOnlyMode(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.InsertKV([]byte("key"), []byte("val")); err != nil {
+		t.Errorf("expected insert to succeed once the mode is cleared, got %v", err)
+	}
+}
+
+func TestPlasmaLSSQuota(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	cfg := testSnCfg
+	cfg.LSSCleanerThreshold = 90
+	s := newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	w := s.NewWriter()
+	n := 50000
+	for k := 0; k < 2; k++ {
+		for i := 0; i < n; i++ {
+			w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte(fmt.Sprintf("val-%d", k)))
+		}
+		s.PersistAll()
+	}
+
+	frag, _, used := s.GetLSSInfo()
+	if frag == 0 || frag > cfg.LSSCleanerThreshold {
+		t.Fatalf("unexpected fragmentation %d%%", frag)
+	}
+
+	// Cleaner should kick in below the threshold as the quota is approached
+	s.SetMaxLSSUsedSpace(used + used/20)
+	for i := 0; i < 100 && frag > 25; i++ {
+		time.Sleep(100 * time.Millisecond)
+		frag, _, _ = s.GetLSSInfo()
+	}
+
+	if frag > 25 {
+		t.Errorf("expected the cleaner to run near the quota, fragmentation is %d%%", frag)
+	}
+
+	_, _, used = s.GetLSSInfo()
+	s.SetMaxLSSUsedSpace(used / 2)
+	if err := w.InsertKV([]byte("key"), []byte("val")); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("expected insert to fail over the quota, got %v", err)
+	}
+
+	if sts := s.GetStats(); sts.LSSQuota != used/2 || sts.LSSHeadroom != 0 {
+		t.Errorf("unexpected quota %d and headroom %d", sts.LSSQuota, sts.LSSHeadroom)
+	}
+
+	s.SetMaxLSSUsedSpace(used * 2)
+	if err := w.InsertKV([]byte("key"), []byte("val")); err != nil {
+		t.Errorf("expected insert to succeed under the quota, got %v", err)
+	}
+
+	if sts := s.GetStats(); sts.LSSHeadroom != sts.LSSQuota-sts.LSSUsedSpace || sts.LSSHeadroom <= 0 {
+		t.Errorf("unexpected headroom %d for quota %d", sts.LSSHeadroom, sts.LSSQuota)
+	}
+}
+
+func TestPlasmaRecovery(t *testing.T) {
+	var wg sync.WaitGroup
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testCfg)
+
+	numThreads := 8
+	n := 1000000
+	m := 900000
+	ws := make([]*Writer, numThreads)
+	for i := 0; i < numThreads; i++ {
+		wg.Add(1)
+		w := s.NewWriter()
+		ws[i] = w
+		go doInsert(w, &wg, i, n/numThreads)
+	}
+	wg.Wait()
+
+	for i := 0; i < numThreads; i++ {
+		wg.Add(1)
+		w := ws[i]
+		go doDelete(w, &wg, i, m/numThreads)
+	}
+	wg.Wait()
+
+	fmt.Println(s.GetStats())
+	fmt.Println(s.Skiplist.GetStats())
+	s.PersistAll()
+	s.Close()
+
+	fmt.Println("***** reopen file *****")
+	s = newTestIntPlasmaStore(testCfg)
+	w := s.NewWriter()
+	fmt.Println(s.GetStats())
+	fmt.Println(s.Skiplist.GetStats())
+
+	for i := 0; i < m; i++ {
+		itm := skiplist.NewIntKeyItem(i)
+		got, _ := w.Lookup(itm)
+		if got != nil {
+			t.Errorf("expected nil %v", skiplist.IntFromItem(got))
+		}
+	}
+
+	for i := m; i < n; i++ {
+		itm := skiplist.NewIntKeyItem(i)
+		got, _ := w.Lookup(itm)
+		if got == nil {
+			t.Errorf("mismatch %d != nil", i)
+		} else if skiplist.CompareInt(itm, got) != 0 {
+			t.Errorf("mismatch %d != %d", i, skiplist.IntFromItem(got))
+		}
+	}
+
+	itr := s.NewIterator()
+	count := 0
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		v := skiplist.IntFromItem(itr.Get())
+		if count+m != v {
+			t.Errorf("Validation: expected %d, got %d", count+m, v)
+		}
+		count++
+	}
+
+	if count != n-m {
+		t.Errorf("Expected %d, got %d", n-m, count)
+	}
+	s.Close()
+}
+
+func TestPlasmaLSSCleaner(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	cfg := testCfg
+	cfg.LSSCleanerThreshold = 10
+	s := newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	w := s.NewWriter()
+
+	for i := 0; i < 10000000; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+
+	_, ds0, used0 := s.GetLSSInfo()
+	s.PersistAll()
+	fmt.Println(s.GetStats())
+
+	donech := make(chan bool)
+
+	go func() {
+		for {
+			select {
+			case <-donech:
+				return
+			default:
+			}
+			s.PersistAll()
+			time.Sleep(time.Second * time.Duration(5))
+		}
+	}()
+
+	go s.lssCleanerDaemon()
+	for x := 0; x < 20; x++ {
+		fmt.Println("Running iteration..", x)
+		for i := 0; i < 1000000; i++ {
+			itm := skiplist.NewIntKeyItem(i)
+			w.Delete(itm)
+			w.Insert(itm)
+		}
+
+		fmt.Println(s.GetStats())
+	}
+
+	time.Sleep(time.Second)
+	frag, ds, used := s.GetLSSInfo()
+
+	fmt.Printf("LSSInfo: frag:%d, ds:%d, used:%d\n", frag, ds, used)
+	if used > used0*110/100 || ds > ds0*110/100 {
+		t.Errorf("Expected better cleaning with frag ~ 10%%")
+	}
+
+	donech <- true
+	s.stoplssgc <- struct{}{}
+	<-s.stoplssgc
+}
+
+func TestPlasmaDropDeadRegions(t *testing.T) {
+	os.RemoveAll("teststore.drop")
+	defer os.RemoveAll("teststore.drop")
+	cfg := testSnCfg
+	cfg.File = "teststore.drop"
+	cfg.AutoLSSCleaning = false
+	s := newTestIntPlasmaStore(cfg)
+
+	n := 200000
+	val := make([]byte, 100)
+	w := s.NewWriter()
+	for i := 0; i < n; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), val)
+	}
+	s.PersistAll()
+
+	// Rewrite all the pages, which leaves the log written so far dead
+	w.CompactAll()
+	s.PersistAll()
+
+	used := s.lss.UsedSpace()
+	dropped, err := s.dropDeadLSSRegions()
+	if err != nil || dropped == 0 {
+		t.Fatalf("expected dead regions to be dropped, got %d bytes (err=%v)", dropped, err)
+	}
+
+	if got := used - s.lss.UsedSpace(); got != dropped {
+		t.Errorf("expected used space to shrink by %d, got %d", dropped, got)
+	}
+
+	lookup := func() {
+		w := s.NewWriter()
+		for i := 0; i < n; i++ {
+			if _, err := w.LookupKV([]byte(fmt.Sprintf("key-%10d", i))); err != nil {
+				t.Fatalf("key-%10d: %v", i, err)
+			}
+		}
+	}
+
+	s.EvictAll(0)
+	lookup()
+	s.Close()
+
+	s = newTestIntPlasmaStore(cfg)
+	defer s.Close()
+	lookup()
+}
+
+func TestPlasmaCleanFragmentedRegions(t *testing.T) {
+	os.RemoveAll("teststore.frag")
+	defer os.RemoveAll("teststore.frag")
+	cfg := testSnCfg
+	cfg.File = "teststore.frag"
+	cfg.AutoLSSCleaning = false
+	s := newTestIntPlasmaStore(cfg)
+
+	n := 200000
+	val := make([]byte, 100)
+	w := s.NewWriter()
+	for i := 0; i < n; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), val)
+	}
+	s.PersistAll()
+
+	// Rewrite half of the pages, which leaves the regions half dead
+	var i int
+	callb := func(pid PageId, _ RangePartition) error {
+		if i++; i%2 == 0 {
+			w.compactPage(pid, w.wCtx)
+		}
+		return nil
+	}
+	s.PageVisitor(callb, 1)
+	s.PersistAll()
+
+	cleaned, err := s.cleanFragmentedLSSRegions()
+	if err != nil || cleaned == 0 {
+		t.Fatalf("expected fragmented regions to be cleaned, got %d (err=%v)", cleaned, err)
+	}
+
+	if dropped, err := s.dropDeadLSSRegions(); err != nil || dropped == 0 {
+		t.Fatalf("expected cleaned regions to be dropped, got %d bytes (err=%v)", dropped, err)
+	}
+
+	lookup := func() {
+		w := s.NewWriter()
+		for i := 0; i < n; i++ {
+			if _, err := w.LookupKV([]byte(fmt.Sprintf("key-%10d", i))); err != nil {
+				t.Fatalf("key-%10d: %v", i, err)
+			}
+		}
+	}
+
+	s.EvictAll(0)
+	lookup()
+	s.Close()
+
+	s = newTestIntPlasmaStore(cfg)
+	defer s.Close()
+	lookup()
+}
+
+func TestPlasmaSegmentRetire(t *testing.T) {
+	os.RemoveAll("teststore.retire")
+	defer os.RemoveAll("teststore.retire")
+
+	var ranges []LSSRange
+	var fail bool
+	cfg := testSnCfg
+	cfg.File = "teststore.retire"
+	cfg.AutoLSSCleaning = false
+	cfg.OnSegmentRetire = func(r LSSRange, data io.Reader) error {
+		if fail {
+			return errors.New("archive failed")
+		}
+
+		n, err := io.Copy(ioutil.Discard, data)
+		if err != nil || n != int64(r.End-r.Start) {
+			t.Errorf("expected %d bytes for %v, got %d (err=%v)", r.End-r.Start, r, n, err)
+		}
+		ranges = append(ranges, r)
+		return nil
+	}
+	s := newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	w := s.NewWriter()
+	for j := 0; j < 2; j++ {
+		for i := 0; i < 100000; i++ {
+			w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), make([]byte, 100))
+		}
+		s.PersistAll()
+	}
+
+	fail = true
+	if err := s.CleanLSS(func() bool { return true }); err == nil {
+		t.Errorf("expected cleaning to fail")
+	}
+
+	s.lss.Commit()
+	if head := s.lss.HeadOffset(); head != 0 {
+		t.Errorf("expected the log to be kept, got head %d", head)
+	}
+
+	fail = false
+	if err := s.CleanLSS(func() bool { return true }); err != nil {
+		t.Fatal(err)
+	}
+
+	s.lss.Commit()
+	var end LSSOffset
+	for _, r := range ranges {
+		if r.Start != end {
+			t.Fatalf("expected range at %d, got %v", end, r)
+		}
+		end = r.End
+	}
+
+	if head := s.lss.HeadOffset(); head == 0 || head > end {
+		t.Errorf("expected the log before %d to be retired, got head %d", end, head)
+	}
+}
+
+func TestPlasmaCleanerPerf(t *testing.T) {
+	var wg sync.WaitGroup
+
+	os.RemoveAll("teststore.data")
+	numThreads := 8
+	n := 100000000
+	nPerThr := n / numThreads
+	cfg := testCfg
+	cfg.LSSCleanerThreshold = 10
+	cfg.AutoLSSCleaning = true
+	s := newTestIntPlasmaStore(cfg)
+	defer s.Close()
+	total := numThreads * nPerThr
+
+	t0 := time.Now()
+	for i := 0; i < numThreads; i++ {
+		wg.Add(1)
+		w := s.NewWriter()
+		go doInsert(w, &wg, i, nPerThr)
+	}
+	wg.Wait()
+
+	dur := time.Since(t0)
+	fmt.Printf("%d items insert took %v -> %v items/s\n", total, dur, float64(total)/float64(dur.Seconds()))
+	s.PersistAll()
+
+	t0 = time.Now()
+	for i := 0; i < numThreads; i++ {
+		wg.Add(1)
+		w := s.NewWriter()
+		go doUpdate(w, &wg, i, nPerThr)
+	}
+	wg.Wait()
+	dur = time.Since(t0)
+	fmt.Printf("%d items update took %v -> %v items/s\n", total, dur, float64(total)/float64(dur.Seconds()))
+
+	fmt.Println(s.GetStats())
+
+	frag, ds, used := s.GetLSSInfo()
+
+	fmt.Printf("LSSInfo: frag:%d, ds:%d, used:%d\n", frag, ds, used)
+
+}
+
+func TestPlasmaEviction(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testCfg)
+	defer s.Close()
+
+	n := 1000000
+	w := s.NewWriter()
+	for i := 0; i < n+100000; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+
+	for i := n; i < n+100000; i++ {
+		w.Delete(skiplist.NewIntKeyItem(i))
+	}
+
+	w.CompactAll()
+
+	s.EvictAll(0)
+	s.EvictAll(0)
+	mem := s.GetStats().MemSz
+
+	if mem != 0 {
+		t.Errorf("Expected memory_usage=0, got=%d", mem)
+	}
+
+	for i := 0; i < n; i++ {
+		itm := skiplist.NewIntKeyItem(i)
 		got, _ := w.Lookup(itm)
-		if got != nil {
-			t.Errorf("expected nil %v", skiplist.IntFromItem(got))
+		if skiplist.CompareInt(itm, got) != 0 {
+			t.Errorf("mismatch %d != %d", i, skiplist.IntFromItem(got))
+		}
+	}
+
+	for i := n; i < n+1000000; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+
+	for i := n; i < n+100000; i++ {
+		w.Delete(skiplist.NewIntKeyItem(i))
+	}
+
+	s.EvictAll(0)
+	mem = s.GetStats().MemSz
+
+	if mem != 0 {
+		t.Errorf("Expected memory_usage=0, got=%d", mem)
+	}
+
+}
+
+func TestPlasmaEvictPerf(t *testing.T) {
+	var wg sync.WaitGroup
+
+	os.RemoveAll("teststore.data")
+	numThreads := 8
+	n := 100000000
+	nPerThr := n / numThreads
+	cfg := testCfg
+	cfg.LSSCleanerThreshold = 10
+	cfg.AutoLSSCleaning = false
+	s := newTestIntPlasmaStore(cfg)
+	defer s.Close()
+	total := numThreads * nPerThr
+
+	t0 := time.Now()
+	for i := 0; i < numThreads; i++ {
+		wg.Add(1)
+		w := s.NewWriter()
+		go doInsert(w, &wg, i, nPerThr)
+	}
+	wg.Wait()
+
+	dur := time.Since(t0)
+	fmt.Printf("%d items insert took %v -> %v items/s\n", total, dur, float64(total)/float64(dur.Seconds()))
+	s.PersistAll()
+
+	s.EvictAll(0)
+	runtime.GC()
+	debug.FreeOSMemory()
+
+	fmt.Println("Evicted items...")
+
+	t0 = time.Now()
+	for i := 0; i < numThreads; i++ {
+		wg.Add(1)
+		w := s.NewWriter()
+		go doLookup(w, &wg, i, nPerThr)
+	}
+	wg.Wait()
+	dur = time.Since(t0)
+	fmt.Printf("%d items swapin took %v -> %v items/s\n", total, dur, float64(total)/float64(dur.Seconds()))
+}
+
+func TestPlasmaSwapper(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testCfg)
+	defer s.Close()
+
+	n := 1000000
+	w := s.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+
+	s.EvictAll(0)
+	for i := 0; i < n; i++ {
+		itm := skiplist.NewIntKeyItem(i)
+		got, _ := w.Lookup(itm)
+		if skiplist.CompareInt(itm, got) != 0 {
+			t.Errorf("mismatch %d != %d", i, skiplist.IntFromItem(got))
+		}
+	}
+
+	sts := s.GetStats()
+	if sts.NumRecordSwapOut == 0 {
+		t.Errorf("Expected few pages to be swapped out")
+	}
+
+	/*
+		FIXME: Test requires update
+		if sts.NumRecordSwapOut != sts.NumPagesSwapIn {
+			t.Errorf("Pages swapped out != swapped in (%d != %d)", sts.NumPagesSwapOut, sts.NumPagesSwapIn)
+		}
+	*/
+
+	fmt.Println(sts)
+}
+
+func TestPlasmaPartialEviction(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	cfg := testCfg
+	cfg.PartialEviction = true
+	s := newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	n := 100000
+	w := s.NewWriter()
+	for i := 0; i < n; i += 2 {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+	s.PersistAll()
+
+	for i := 1; i < n; i += 40 {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+
+	memUsed := s.MemoryInUse()
+	s.EvictAll(0)
+	if s.MemoryInUse() >= memUsed {
+		t.Errorf("expected memory in use to reduce")
+	}
+
+	nr := w.sts.NumLSSReads
+	for i := 1; i < n; i += 40 {
+		itm := skiplist.NewIntKeyItem(i)
+		if got, _ := w.Lookup(itm); skiplist.CompareInt(itm, got) != 0 {
+			t.Fatalf("mismatch %d", i)
+		}
+	}
+
+	if w.sts.NumLSSReads != nr {
+		t.Errorf("expected recent records to be resident")
+	}
+
+	// Pages are fully evicted on the next eviction
+	s.EvictAll(0)
+	for i := 0; i < n; i++ {
+		itm := skiplist.NewIntKeyItem(i)
+		got, _ := w.Lookup(itm)
+		if i%2 == 0 || i%40 == 1 {
+			if skiplist.CompareInt(itm, got) != 0 {
+				t.Fatalf("mismatch %d", i)
+			}
+		} else if got != nil {
+			t.Fatalf("unexpected item %d", i)
+		}
+	}
+
+	if w.sts.NumLSSReads == nr {
+		t.Errorf("expected pages to be read from lss")
+	}
+}
+
+func TestPlasmaCompressedCache(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	cfg := testCfg
+	cfg.CompressedCache = true
+	s := newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	n := 100000
+	w := s.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+
+	lookupAll := func() {
+		for i := 0; i < n; i++ {
+			itm := skiplist.NewIntKeyItem(i)
+			if got, _ := w.Lookup(itm); skiplist.CompareInt(itm, got) != 0 {
+				t.Fatalf("mismatch %d", i)
+			}
+		}
+	}
+
+	memUsed := s.MemoryInUse()
+	s.EvictAll(0)
+	compressedMemUsed := s.MemoryInUse()
+	if compressedMemUsed >= memUsed {
+		t.Errorf("expected memory in use to reduce")
+	}
+
+	lookupAll()
+	if sts := s.GetStats(); sts.NumCompressedReads == 0 || sts.NumLSSReads != 0 {
+		t.Errorf("expected pages to be read from memory (compressed reads %d, lss reads %d)",
+			sts.NumCompressedReads, sts.NumLSSReads)
+	}
+
+	// Compressed pages are swapped out on the next eviction
+	s.EvictAll(0)
+	if s.MemoryInUse() >= compressedMemUsed {
+		t.Errorf("expected memory in use to reduce further")
+	}
+
+	lookupAll()
+	if sts := s.GetStats(); sts.NumLSSReads == 0 {
+		t.Errorf("expected pages to be read from lss")
+	}
+}
+
+func TestPlasmaCompressedCacheQuota(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	cfg := testCfg
+	cfg.CompressedCache = true
+	cfg.CompressedCacheQuota = 64 * 1024
+	s := newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	n := 100000
+	w := s.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+
+	// Pages are swapped out to the lss once the quota is used up
+	s.EvictAll(0)
+	if sz := s.GetStats().CompressedSz; sz == 0 || sz >= 2*cfg.CompressedCacheQuota {
+		t.Errorf("expected compressed pages within the quota %d, got %d", cfg.CompressedCacheQuota, sz)
+	}
+
+	for i := 0; i < n; i++ {
+		itm := skiplist.NewIntKeyItem(i)
+		if got, _ := w.Lookup(itm); skiplist.CompareInt(itm, got) != 0 {
+			t.Fatalf("mismatch %d", i)
 		}
 	}
 
-	for i := m; i < n; i++ {
+	if sts := s.GetStats(); sts.NumCompressedReads == 0 || sts.NumLSSReads == 0 {
+		t.Errorf("expected pages to be read from memory and lss (compressed reads %d, lss reads %d)",
+			sts.NumCompressedReads, sts.NumLSSReads)
+	}
+
+	// Damaged images are reported instead of being decoded
+	data := []byte{0xff, 0xff, 0xff, 0xff, 0xff}
+	sod := &swapoutDelta{data: unsafe.Pointer(&data[0]), dataLen: int32(len(data))}
+	if _, err := s.fetchSwapoutPage(sod, w.wCtx, new(allocCtx), w.storeCtx); err != ErrCorruptPage {
+		t.Errorf("expected %v, got %v", ErrCorruptPage, err)
+	}
+}
+
+func TestPlasmaAutoSwapper(t *testing.T) {
+	defer SetMemoryQuota(maxMemoryQuota)
+	var wg sync.WaitGroup
+
+	os.RemoveAll("teststore.data")
+	numThreads := 8
+	n := 10000000
+	nPerThr := n / numThreads
+	cfg := testCfg
+	cfg.LSSCleanerThreshold = 10
+	cfg.AutoLSSCleaning = true
+	cfg.AutoSwapper = true
+	SetMemoryQuota(1024 * 1024 * 1024)
+
+	s := newTestIntPlasmaStore(cfg)
+	defer s.Close()
+	total := numThreads * nPerThr
+
+	t0 := time.Now()
+	for i := 0; i < numThreads; i++ {
+		wg.Add(1)
+		w := s.NewWriter()
+		go doInsert(w, &wg, i, nPerThr)
+	}
+	wg.Wait()
+
+	dur := time.Since(t0)
+	fmt.Printf("%d items insert took %v -> %v items/s\n", total, dur, float64(total)/float64(dur.Seconds()))
+
+	t0 = time.Now()
+	for i := 0; i < numThreads; i++ {
+		wg.Add(1)
+		w := s.NewWriter()
+		go doUpdate(w, &wg, i, nPerThr)
+	}
+	wg.Wait()
+	dur = time.Since(t0)
+	fmt.Printf("%d items update took %v -> %v items/s\n", total, dur, float64(total)/float64(dur.Seconds()))
+
+	fmt.Println(s.GetStats())
+
+	frag, ds, used := s.GetLSSInfo()
+
+	fmt.Printf("LSSInfo: frag:%d, ds:%d, used:%d\n", frag, ds, used)
+
+}
+
+func TestPlasmaInstanceMemQuota(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	os.RemoveAll("teststore2.data")
+	defer os.RemoveAll("teststore2.data")
+
+	quota := int64(4 * 1024 * 1024)
+	cfg := testCfg
+	cfg.AutoSwapper = true
+	cfg.MemQuota = quota
+	s1 := newTestIntPlasmaStore(cfg)
+	defer s1.Close()
+
+	cfg.File = "teststore2.data"
+	cfg.MemQuota = 0
+	s2 := newTestIntPlasmaStore(cfg)
+	defer s2.Close()
+
+	n := 500000
+	w1 := s1.NewWriter()
+	w2 := s2.NewWriter()
+	for i := 0; i < n; i++ {
+		w1.Insert(skiplist.NewIntKeyItem(i))
+		w2.Insert(skiplist.NewIntKeyItem(i))
+	}
+
+	s1.PersistAll()
+	for i := 0; i < 100 && s1.MemoryInUse() >= quota; i++ {
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	if used := s1.MemoryInUse(); used >= quota {
+		t.Errorf("expected memory in use %d to be within quota %d", used, quota)
+	}
+
+	if sts := s1.GetStats(); sts.NumRecordSwapOut == 0 {
+		t.Errorf("expected records to be swapped out")
+	}
+
+	if sts := s2.GetStats(); sts.NumRecordSwapOut != 0 {
+		t.Errorf("expected no records to be swapped out, got %d", sts.NumRecordSwapOut)
+	}
+
+	for i := 0; i < n; i++ {
 		itm := skiplist.NewIntKeyItem(i)
-		got, _ := w.Lookup(itm)
-		if got == nil {
-			t.Errorf("mismatch %d != nil", i)
-		} else if skiplist.CompareInt(itm, got) != 0 {
-			t.Errorf("mismatch %d != %d", i, skiplist.IntFromItem(got))
+		if got, _ := w1.Lookup(itm); skiplist.CompareInt(itm, got) != 0 {
+			t.Fatalf("mismatch %d", i)
 		}
 	}
+}
 
-	itr := s.NewIterator()
-	count := 0
-	for itr.SeekFirst(); itr.Valid(); itr.Next() {
-		v := skiplist.IntFromItem(itr.Get())
-		if count+m != v {
-			t.Errorf("Validation: expected %d, got %d", count+m, v)
+func TestPlasmaTryInsert(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	cfg := testCfg
+	cfg.MemQuota = 1024 * 1024
+	s := newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	// Nothing is evicted without the swapper
+	w := s.NewWriter()
+	for i := 0; ; i++ {
+		if err := w.TryInsert(skiplist.NewIntKeyItem(i)); err == ErrWouldThrottle {
+			break
+		} else if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		} else if i == 10000000 {
+			t.Fatalf("expected inserts to be throttled")
 		}
-		count++
 	}
 
-	if count != n-m {
-		t.Errorf("Expected %d, got %d", n-m, count)
+	if st := s.ThrottleState(); !st.Throttled || st.MemoryInUse < st.MemQuota {
+		t.Fatalf("expected writers to be throttled, got %+v", st)
+	}
+
+	if err := w.TryInsert(skiplist.NewIntKeyItem(0)); err != ErrWouldThrottle {
+		t.Errorf("expected ErrWouldThrottle, got %v", err)
+	}
+
+	if err := w.TryDelete(skiplist.NewIntKeyItem(0)); err != ErrWouldThrottle {
+		t.Errorf("expected ErrWouldThrottle, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	if err := w.InsertCtx(ctx, skiplist.NewIntKeyItem(0)); err != context.DeadlineExceeded {
+		t.Errorf("expected the insert to wait, got %v", err)
+	}
+
+	sts := s.GetStats()
+	if sts.ThrottleRejects != 3 || sts.ThrottleStalls != 1 ||
+		sts.ThrottleStallTime < int64(time.Millisecond*100) {
+		t.Errorf("unexpected throttle stats %d %d %d", sts.ThrottleRejects,
+			sts.ThrottleStalls, sts.ThrottleStallTime)
+	}
+
+	s.SetMemoryQuota(0)
+	for i := 0; i < 100 && s.ThrottleState().Throttled; i++ {
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	if err := w.TryInsert(skiplist.NewIntKeyItem(0)); err != nil {
+		t.Errorf("unexpected error %v", err)
 	}
-	s.Close()
 }
 
-func TestPlasmaLSSCleaner(t *testing.T) {
+func TestPlasmaPauseMaintenance(t *testing.T) {
 	os.RemoveAll("teststore.data")
+	quota := int64(4 * 1024 * 1024)
 	cfg := testCfg
+	cfg.AutoSwapper = true
+	cfg.AutoLSSCleaning = true
 	cfg.LSSCleanerThreshold = 10
+	cfg.MemQuota = quota
 	s := newTestIntPlasmaStore(cfg)
 	defer s.Close()
 
-	w := s.NewWriter()
+	s.PauseMaintenance()
+	if !s.IsMaintenancePaused() {
+		t.Fatalf("expected maintenance to be paused")
+	}
 
-	for i := 0; i < 10000000; i++ {
+	n := 500000
+	w := s.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+	s.PersistAll()
+	for i := 0; i < n; i++ {
+		w.Delete(skiplist.NewIntKeyItem(i))
 		w.Insert(skiplist.NewIntKeyItem(i))
 	}
-
-	_, ds0, used0 := s.GetLSSInfo()
 	s.PersistAll()
-	fmt.Println(s.GetStats(), "\n")
 
-	donech := make(chan bool)
+	time.Sleep(time.Second * 2)
+	if sts := s.GetStats(); sts.NumRecordSwapOut != 0 {
+		t.Errorf("expected no records to be swapped out, got %d", sts.NumRecordSwapOut)
+	}
 
-	go func() {
-		for {
-			select {
-			case <-donech:
-				return
-			default:
-			}
-			s.PersistAll()
-			time.Sleep(time.Second * time.Duration(5))
-		}
-	}()
+	if head := s.lss.HeadOffset(); head != 0 {
+		t.Errorf("expected the log not to be cleaned, head %d", head)
+	}
 
-	go s.lssCleanerDaemon()
-	for x := 0; x < 20; x++ {
-		fmt.Println("Running iteration..", x)
-		for i := 0; i < 1000000; i++ {
-			itm := skiplist.NewIntKeyItem(i)
-			w.Delete(itm)
-			w.Insert(itm)
-		}
+	s.ResumeMaintenance()
+	for i := 0; i < 100 && (s.MemoryInUse() >= quota || s.lss.HeadOffset() == 0); i++ {
+		time.Sleep(time.Millisecond * 100)
+	}
 
-		fmt.Println(s.GetStats())
+	if used := s.MemoryInUse(); used >= quota {
+		t.Errorf("expected memory in use %d to be within quota %d", used, quota)
 	}
 
-	time.Sleep(time.Second)
-	frag, ds, used := s.GetLSSInfo()
+	if s.lss.HeadOffset() == 0 {
+		t.Errorf("expected the log to be cleaned")
+	}
 
-	fmt.Printf("LSSInfo: frag:%d, ds:%d, used:%d\n", frag, ds, used)
-	if used > used0*110/100 || ds > ds0*110/100 {
-		t.Errorf("Expected better cleaning with frag ~ 10%")
+	for i := 0; i < n; i++ {
+		itm := skiplist.NewIntKeyItem(i)
+		if got, _ := w.Lookup(itm); skiplist.CompareInt(itm, got) != 0 {
+			t.Fatalf("mismatch %d", i)
+		}
 	}
+}
 
-	donech <- true
-	s.stoplssgc <- struct{}{}
-	<-s.stoplssgc
+// Robert Jenkins 32 bit integer
+func intHash(x int) int {
+	a := uint32(x)
+	a = (a + 0x7ed55d16) + (a << 12)
+	a = (a ^ 0xc761c23c) ^ (a >> 19)
+	a = (a + 0x165667b1) + (a << 5)
+	a = (a + 0xd3a2646c) ^ (a << 9)
+	a = (a + 0xfd7046c5) + (a << 3)
+	a = (a ^ 0xb55a4f09) ^ (a >> 16)
+	return int(a)
 }
 
-func TestPlasmaCleanerPerf(t *testing.T) {
+func TestConcurrDelOps(t *testing.T) {
 	var wg sync.WaitGroup
 
 	os.RemoveAll("teststore.data")
-	numThreads := 8
-	n := 100000000
+	numThreads := 6
+	n := 10000000
 	nPerThr := n / numThreads
-	cfg := testCfg
-	cfg.LSSCleanerThreshold = 10
-	cfg.AutoLSSCleaning = true
+	testCfg.MinPageItems = 200
+	s := newTestIntPlasmaStore(testCfg)
+	defer s.Close()
+
+	worker := func(w *Writer, wg *sync.WaitGroup, id int, insert bool, n int) {
+		defer wg.Done()
+
+		for i := 0; i < n; i++ {
+			val := intHash(i + id*n)
+			itm := skiplist.NewIntKeyItem(val)
+			if insert {
+				w.Insert(itm)
+			} else {
+				w.Delete(itm)
+			}
+		}
+	}
+
+	for i := 0; i < numThreads; i++ {
+		wg.Add(1)
+		w := s.NewWriter()
+		go worker(w, &wg, i, true, nPerThr)
+	}
+	wg.Wait()
+
+	for i := 0; i < numThreads; i++ {
+		wg.Add(1)
+		w := s.NewWriter()
+		go worker(w, &wg, i, false, nPerThr)
+	}
+	wg.Wait()
+
+	c := 0
+	itr := s.NewIterator()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		c++
+	}
+
+	if c != 0 {
+		t.Errorf("Expected 0, got %d", c)
+	}
+
+	fmt.Println(s.GetStats())
+}
+
+func TestPlasmaSplitLargePages(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	cfg := testSnCfg
+	cfg.EnableShapshots = false
+	cfg.AutoSwapper = false
+	cfg.AutoLSSCleaning = false
+	cfg.MaxPageItems = 100000
+	cfg.MaxDeltaChainLen = 100000
 	s := newTestIntPlasmaStore(cfg)
+
+	// Items of several page buffers, which would fit into a single page
+	// by its number of items
+	w := s.NewWriter()
+	n := 5000
+	v := make([]byte, 1024)
+	for i := 0; i < n; i++ {
+		if err := w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.PersistAll()
+	if sts := s.GetStats(); sts.Splits < 4 || sts.NumPages < 5 {
+		t.Fatalf("expected the page to be split, got %d splits and %d pages", sts.Splits, sts.NumPages)
+	}
+
+	s.EvictAll(0)
+	for pid := s.StartPageId(); pid != s.EndPageId(); pid = NextPid(pid) {
+		pg, _ := s.ReadPage(pid, nil, false, w.wCtx)
+		if pg.NeedsFlush() {
+			t.Fatalf("expected all the pages to be written")
+		}
+	}
+	s.Close()
+
+	s = newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	w = s.NewWriter()
+	for i := 0; i < n; i++ {
+		if got, err := w.LookupKV([]byte(fmt.Sprintf("key-%10d", i))); err != nil || len(got) != len(v) {
+			t.Fatalf("key %d: unexpected value of %d bytes (err=%v)", i, len(got), err)
+		}
+	}
+}
+
+func TestPlasmaFetchBudget(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testCfg)
+	defer s.Close()
+
+	w := s.NewWriter()
+	for r := 0; r < 3; r++ {
+		for i := r; i < 10000; i += 3 {
+			w.Insert(skiplist.NewIntKeyItem(i))
+		}
+		s.PersistAll()
+	}
+
+	s.EvictAll(0)
+
+	w.SetFetchBudget(time.Nanosecond)
+	var timeouts int
+	for i := 0; i < 10000; i += 100 {
+		if _, err := w.Lookup(skiplist.NewIntKeyItem(i)); errors.Is(err, ErrFetchTimeout) {
+			timeouts++
+		} else if err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+
+	if timeouts == 0 {
+		t.Errorf("expected lookups to exceed fetch budget")
+	}
+
+	w.SetFetchBudget(0)
+	for i := 0; i < 10000; i++ {
+		itm := skiplist.NewIntKeyItem(i)
+		got, err := w.Lookup(itm)
+		if err != nil || skiplist.CompareInt(itm, got) != 0 {
+			t.Errorf("mismatch %d, err %v", i, err)
+		}
+	}
+}
+
+func TestPlasmaOpContext(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testCfg)
 	defer s.Close()
-	total := numThreads * nPerThr
 
-	t0 := time.Now()
-	for i := 0; i < numThreads; i++ {
-		wg.Add(1)
-		w := s.NewWriter()
-		go doInsert(w, &wg, i, nPerThr)
+	w := s.NewWriter()
+	for i := 0; i < 10000; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
 	}
-	wg.Wait()
-
-	dur := time.Since(t0)
-	fmt.Printf("%d items insert took %v -> %v items/s\n", total, dur, float64(total)/float64(dur.Seconds()))
 	s.PersistAll()
+	s.EvictAll(0)
 
-	t0 = time.Now()
-	for i := 0; i < numThreads; i++ {
-		wg.Add(1)
-		w := s.NewWriter()
-		go doUpdate(w, &wg, i, nPerThr)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := w.InsertCtx(ctx, skiplist.NewIntKeyItem(10000)); err != context.Canceled {
+		t.Errorf("expected insert to be canceled, got %v", err)
 	}
-	wg.Wait()
-	dur = time.Since(t0)
-	fmt.Printf("%d items update took %v -> %v items/s\n", total, dur, float64(total)/float64(dur.Seconds()))
 
-	fmt.Println(s.GetStats())
+	if err := w.DeleteCtx(ctx, skiplist.NewIntKeyItem(0)); err != context.Canceled {
+		t.Errorf("expected delete to be canceled, got %v", err)
+	}
 
-	frag, ds, used := s.GetLSSInfo()
+	if _, err := w.LookupCtx(ctx, skiplist.NewIntKeyItem(0)); err != context.Canceled {
+		t.Errorf("expected lookup to be canceled, got %v", err)
+	}
 
-	fmt.Printf("LSSInfo: frag:%d, ds:%d, used:%d\n", frag, ds, used)
+	for i := 0; i < 10000; i += 100 {
+		itm := skiplist.NewIntKeyItem(i)
+		if got, err := w.LookupCtx(context.Background(), itm); err != nil || skiplist.CompareInt(itm, got) != 0 {
+			t.Errorf("mismatch %d, err %v", i, err)
+		}
+	}
 
+	// Operations waiting for memory to be freed give up
+	s.SetMemoryQuota(1)
+	for i := 0; i < 100 && !s.hasMemoryPressure; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := w.InsertCtx(ctx, skiplist.NewIntKeyItem(10000)); err != context.DeadlineExceeded {
+		t.Errorf("expected insert to time out, got %v", err)
+	}
+
+	s.SetMemoryQuota(0)
+	if got, _ := w.Lookup(skiplist.NewIntKeyItem(10000)); got != nil {
+		t.Errorf("expected the item not to be inserted")
+	}
 }
 
-func TestPlasmaEviction(t *testing.T) {
+func TestPlasmaStatsJSON(t *testing.T) {
 	os.RemoveAll("teststore.data")
 	s := newTestIntPlasmaStore(testCfg)
 	defer s.Close()
 
-	n := 1000000
-	w := s.NewWriter()
-	for i := 0; i < n+100000; i++ {
-		w.Insert(skiplist.NewIntKeyItem(i))
+	n := 10000
+	w1 := s.NewWriter()
+	w2 := s.NewWriter()
+	for i := 0; i < n; i++ {
+		w1.Insert(skiplist.NewIntKeyItem(i))
 	}
+	w2.Delete(skiplist.NewIntKeyItem(0))
+	s.PersistAll()
 
-	for i := n; i < n+100000; i++ {
-		w.Delete(skiplist.NewIntKeyItem(i))
+	bs, err := json.Marshal(s.GetStats())
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	w.CompactAll()
+	var m map[string]interface{}
+	if err := json.Unmarshal(bs, &m); err != nil {
+		t.Fatal(err)
+	}
 
-	s.EvictAll()
-	s.EvictAll()
-	mem := s.GetStats().MemSz
+	if m["inserts"] != float64(n) || m["count"] != float64(n-1) {
+		t.Errorf("unexpected stats %s", bs)
+	}
 
-	if mem != 0 {
-		t.Errorf("Expected memory_usage=0, got=%d", mem)
+	if _, ok := m["lss_stalls"].(map[string]interface{})["sync_stalls"]; !ok {
+		t.Errorf("expected lss stall stats %s", bs)
 	}
 
-	for i := 0; i < n; i++ {
-		itm := skiplist.NewIntKeyItem(i)
-		got, _ := w.Lookup(itm)
-		if skiplist.CompareInt(itm, got) != 0 {
-			t.Errorf("mismatch %d != %d", i, skiplist.IntFromItem(got))
-		}
+	quota := atomic.LoadInt64(&memQuota) + 1024*1024
+	s.SetMemoryQuota(quota)
+	defer s.SetMemoryQuota(0)
+
+	if bs, err = json.Marshal(s.GetStats()); err != nil {
+		t.Fatal(err)
 	}
 
-	for i := n; i < n+1000000; i++ {
-		w.Insert(skiplist.NewIntKeyItem(i))
+	m = nil
+	if err := json.Unmarshal(bs, &m); err != nil {
+		t.Fatal(err)
 	}
 
-	for i := n; i < n+100000; i++ {
-		w.Delete(skiplist.NewIntKeyItem(i))
+	if m["memory_quota"] != float64(quota) {
+		t.Errorf("expected the quota of the instance %d, got %v", quota, m["memory_quota"])
 	}
 
-	s.EvictAll()
-	mem = s.GetStats().MemSz
+	dsts := s.GetDetailedStats()
+	if len(dsts.Writers) != 2 {
+		t.Fatalf("expected 2 writers, got %d", len(dsts.Writers))
+	}
 
-	if mem != 0 {
-		t.Errorf("Expected memory_usage=0, got=%d", mem)
+	if dsts.Writers[0].Inserts != int64(n) || dsts.Writers[1].Deletes != 1 {
+		t.Errorf("unexpected writer stats %d, %d", dsts.Writers[0].Inserts, dsts.Writers[1].Deletes)
 	}
 
-}
+	var flushDataSz int64
+	for _, sts := range dsts.Persistors {
+		flushDataSz += sts.FlushDataSz
+	}
 
-func TestPlasmaEvictPerf(t *testing.T) {
-	var wg sync.WaitGroup
+	if flushDataSz == 0 {
+		t.Errorf("expected persistor stats")
+	}
+
+	if _, err := json.Marshal(dsts); err != nil {
+		t.Fatal(err)
+	}
+}
 
+func TestPlasmaStatsDelta(t *testing.T) {
 	os.RemoveAll("teststore.data")
-	numThreads := 8
-	n := 100000000
-	nPerThr := n / numThreads
-	cfg := testCfg
-	cfg.LSSCleanerThreshold = 10
-	cfg.AutoLSSCleaning = false
-	s := newTestIntPlasmaStore(cfg)
+	s := newTestIntPlasmaStore(testCfg)
 	defer s.Close()
-	total := numThreads * nPerThr
 
-	t0 := time.Now()
-	for i := 0; i < numThreads; i++ {
-		wg.Add(1)
-		w := s.NewWriter()
-		go doInsert(w, &wg, i, nPerThr)
+	w := s.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
 	}
-	wg.Wait()
 
-	dur := time.Since(t0)
-	fmt.Printf("%d items insert took %v -> %v items/s\n", total, dur, float64(total)/float64(dur.Seconds()))
-	s.PersistAll()
+	prev := s.GetStats()
+	for i := 1000; i < 1500; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+	w.Delete(skiplist.NewIntKeyItem(0))
 
-	s.EvictAll()
-	runtime.GC()
-	debug.FreeOSMemory()
+	delta := s.GetStatsDelta(prev)
+	if delta.Inserts != 500 || delta.Deletes != 1 || delta.CacheHits+delta.CacheMisses != 501 {
+		t.Errorf("unexpected delta inserts %d, deletes %d, lookups %d",
+			delta.Inserts, delta.Deletes, delta.CacheHits+delta.CacheMisses)
+	}
 
-	fmt.Println("Evicted items...")
+	if delta.MemSz != s.GetStats().MemSz || delta.MemSz == 0 {
+		t.Errorf("expected the current memory size, got %d", delta.MemSz)
+	}
 
-	t0 = time.Now()
-	for i := 0; i < numThreads; i++ {
-		wg.Add(1)
-		w := s.NewWriter()
-		go doLookup(w, &wg, i, nPerThr)
+	memSz := s.MemoryInUse()
+	s.ResetStats()
+	sts := s.GetStats()
+	if sts.Inserts != 0 || sts.Deletes != 0 || sts.CacheHits != 0 {
+		t.Errorf("expected counters to be reset, got inserts %d, deletes %d", sts.Inserts, sts.Deletes)
+	}
+
+	if s.MemoryInUse() != memSz || sts.MemSz == 0 {
+		t.Errorf("expected memory accounting to be retained")
+	}
+
+	w.Insert(skiplist.NewIntKeyItem(2000))
+	if sts = s.GetStats(); sts.Inserts != 1 {
+		t.Errorf("expected 1 insert after reset, got %d", sts.Inserts)
+	}
+
+	if sts = s.GetCumulativeStats(); sts.Inserts != 1501 || sts.Deletes != 1 {
+		t.Errorf("expected cumulative inserts 1501 and deletes 1, got %d and %d", sts.Inserts, sts.Deletes)
 	}
-	wg.Wait()
-	dur = time.Since(t0)
-	fmt.Printf("%d items swapin took %v -> %v items/s\n", total, dur, float64(total)/float64(dur.Seconds()))
 }
 
-func TestPlasmaSwapper(t *testing.T) {
+func TestPlasmaStatsHistograms(t *testing.T) {
+	var h Pow2Histogram
+	for _, v := range []int{0, 1, 2, 3, 4, 1 << 30} {
+		h.add(v)
+	}
+
+	if h[0] != 1 || h[1] != 1 || h[2] != 2 || h[3] != 1 || h[numPow2Buckets-1] != 1 {
+		t.Errorf("unexpected buckets %v", h)
+	}
+
+	if str := h.String(); str != "0:1 1:1 2:2 4:1 4194304:1" {
+		t.Errorf("unexpected string %s", str)
+	}
+
 	os.RemoveAll("teststore.data")
 	s := newTestIntPlasmaStore(testCfg)
 	defer s.Close()
 
-	n := 1000000
 	w := s.NewWriter()
+	n := 10000
 	for i := 0; i < n; i++ {
 		w.Insert(skiplist.NewIntKeyItem(i))
 	}
+	s.PersistAll()
+	s.EvictAll(0)
 
-	s.EvictAll()
-	for i := 0; i < n; i++ {
-		itm := skiplist.NewIntKeyItem(i)
-		got, _ := w.Lookup(itm)
-		if skiplist.CompareInt(itm, got) != 0 {
-			t.Errorf("mismatch %d != %d", i, skiplist.IntFromItem(got))
+	for i := 0; i < n; i += 100 {
+		w.Lookup(skiplist.NewIntKeyItem(i))
+	}
+
+	count := func(h Pow2Histogram) (n int64) {
+		for _, c := range h {
+			n += c
 		}
+		return
 	}
 
 	sts := s.GetStats()
-	if sts.NumRecordSwapOut == 0 {
-		t.Errorf("Expected few pages to be swapped out")
+	if c := count(sts.ChainLenHist); c < int64(n) {
+		t.Errorf("expected the chain length of %d page reads, got %d", n, c)
 	}
 
-	/*
-		FIXME: Test requires update
-		if sts.NumRecordSwapOut != sts.NumPagesSwapIn {
-			t.Errorf("Pages swapped out != swapped in (%d != %d)", sts.NumPagesSwapOut, sts.NumPagesSwapIn)
-		}
-	*/
+	if count(sts.PageSizeHist) < sts.NumPages || sts.PageSizeHist[0] != 0 {
+		t.Errorf("expected the sizes of the flushed pages, got %v", sts.PageSizeHist)
+	}
 
-	fmt.Println(sts)
-}
+	if count(sts.FetchSegmentsHist) == 0 || sts.FetchSegmentsHist[0] != 0 {
+		t.Errorf("expected the segments of the fetched pages, got %v", sts.FetchSegmentsHist)
+	}
 
-func TestPlasmaAutoSwapper(t *testing.T) {
-	defer SetMemoryQuota(maxMemoryQuota)
-	var wg sync.WaitGroup
+	s.ResetStats()
+	if sts = s.GetStats(); count(sts.ChainLenHist) != 0 {
+		t.Errorf("expected histograms to be reset, got %v", sts.ChainLenHist)
+	}
+}
 
+func TestWriterClose(t *testing.T) {
 	os.RemoveAll("teststore.data")
-	numThreads := 8
-	n := 10000000
-	nPerThr := n / numThreads
-	cfg := testCfg
-	cfg.LSSCleanerThreshold = 10
-	cfg.AutoLSSCleaning = true
-	cfg.AutoSwapper = true
-	SetMemoryQuota(1024 * 1024 * 1024)
-
-	s := newTestIntPlasmaStore(cfg)
+	s := newTestIntPlasmaStore(testSnCfg)
 	defer s.Close()
-	total := numThreads * nPerThr
 
-	t0 := time.Now()
-	for i := 0; i < numThreads; i++ {
-		wg.Add(1)
-		w := s.NewWriter()
-		go doInsert(w, &wg, i, nPerThr)
+	numCtxs := func() int {
+		var n int
+		for w := s.wCtxList; w != nil; w = w.next {
+			n++
+		}
+		return n
 	}
-	wg.Wait()
-
-	dur := time.Since(t0)
-	fmt.Printf("%d items insert took %v -> %v items/s\n", total, dur, float64(total)/float64(dur.Seconds()))
 
-	t0 = time.Now()
-	for i := 0; i < numThreads; i++ {
-		wg.Add(1)
+	base := numCtxs()
+	for i := 0; i < 100; i++ {
 		w := s.NewWriter()
-		go doUpdate(w, &wg, i, nPerThr)
+		for j := 0; j < 100; j++ {
+			w.InsertKV([]byte(fmt.Sprintf("key-%10d", i*100+j)), nil)
+		}
+		w.Close()
+		w.Close()
+
+		r := s.NewReader()
+		snap := s.NewSnapshot()
+		itr := r.NewSnapshotIterator(snap)
+		itr.Close()
+		snap.Close()
+		r.Close()
 	}
-	wg.Wait()
-	dur = time.Since(t0)
-	fmt.Printf("%d items update took %v -> %v items/s\n", total, dur, float64(total)/float64(dur.Seconds()))
-
-	fmt.Println(s.GetStats())
-
-	frag, ds, used := s.GetLSSInfo()
 
-	fmt.Printf("LSSInfo: frag:%d, ds:%d, used:%d\n", frag, ds, used)
+	if n := numCtxs(); n != base {
+		t.Errorf("expected %d contexts, got %d", base, n)
+	}
 
-}
+	if sts := s.GetStats(); sts.Inserts != 10000 || sts.MemSz == 0 {
+		t.Errorf("expected stats of closed writers to be kept, got inserts %d", sts.Inserts)
+	}
 
-// Robert Jenkins 32 bit integer
-func intHash(x int) int {
-	a := uint32(x)
-	a = (a + 0x7ed55d16) + (a << 12)
-	a = (a ^ 0xc761c23c) ^ (a >> 19)
-	a = (a + 0x165667b1) + (a << 5)
-	a = (a + 0xd3a2646c) ^ (a << 9)
-	a = (a + 0xfd7046c5) + (a << 3)
-	a = (a ^ 0xb55a4f09) ^ (a >> 16)
-	return int(a)
+	if n := s.ItemsCount(); n != 10000 {
+		t.Errorf("expected 10000 items, got %d", n)
+	}
 }
 
-func TestConcurrDelOps(t *testing.T) {
-	var wg sync.WaitGroup
-
+func TestPlasmaOpenReadOnly(t *testing.T) {
 	os.RemoveAll("teststore.data")
-	numThreads := 6
-	n := 10000000
-	nPerThr := n / numThreads
-	testCfg.MinPageItems = 200
+	if _, err := OpenReadOnly(testCfg); err == nil {
+		t.Fatalf("expected missing instance to fail")
+	}
+
 	s := newTestIntPlasmaStore(testCfg)
-	defer s.Close()
+	w := s.NewWriter()
 
-	worker := func(w *Writer, wg *sync.WaitGroup, id int, insert bool, n int) {
-		defer wg.Done()
+	n := 20000
+	for i := 0; i < n; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+	s.PersistAll()
+	tail := s.lss.TailOffset()
 
-		for i := 0; i < n; i++ {
-			val := intHash(i + id*n)
-			itm := skiplist.NewIntKeyItem(val)
-			if insert {
-				w.Insert(itm)
-			} else {
-				w.Delete(itm)
-			}
-		}
+	cfg := testCfg
+	cfg.AutoLSSCleaning = true
+	if _, err := OpenReadOnly(cfg); !errors.Is(err, ErrInUse) {
+		t.Errorf("expected the open instance to exclude readers, got %v", err)
 	}
+	s.Close()
 
-	for i := 0; i < numThreads; i++ {
-		wg.Add(1)
-		w := s.NewWriter()
-		go worker(w, &wg, i, true, nPerThr)
+	r, err := OpenReadOnly(cfg)
+	if err != nil {
+		t.Fatal(err)
 	}
-	wg.Wait()
 
-	for i := 0; i < numThreads; i++ {
-		wg.Add(1)
-		w := s.NewWriter()
-		go worker(w, &wg, i, false, nPerThr)
+	if _, err := New(testCfg); !errors.Is(err, ErrInUse) {
+		t.Errorf("expected the reader to exclude writers, got %v", err)
 	}
-	wg.Wait()
 
-	c := 0
-	itr := s.NewIterator()
-	for itr.SeekFirst(); itr.Valid(); itr.Next() {
-		c++
+	rw := r.NewWriter()
+	if err := rw.Insert(skiplist.NewIntKeyItem(n)); err != ErrReadOnly {
+		t.Errorf("expected insert to fail, got %v", err)
 	}
 
-	if c != 0 {
-		t.Errorf("Expected 0, got %d", c)
+	if err := r.CleanLSS(func() bool { return true }); err != ErrReadOnly {
+		t.Errorf("expected cleaner to fail, got %v", err)
 	}
 
-	fmt.Println(s.GetStats())
+	r.EvictAll(0)
+	for i := 0; i < n; i++ {
+		itm := skiplist.NewIntKeyItem(i)
+		if got, _ := rw.Lookup(itm); skiplist.CompareInt(itm, got) != 0 {
+			t.Fatalf("mismatch %d", i)
+		}
+	}
+	r.PersistAll()
+	if r.lss.TailOffset() != tail {
+		t.Errorf("expected log to be unmodified")
+	}
+	r.Close()
+
+	s = newTestIntPlasmaStore(testCfg)
+	defer s.Close()
+
+	// The instance can be written once the reader is closed
+	w = s.NewWriter()
+	w.Insert(skiplist.NewIntKeyItem(n))
+	if got, _ := w.Lookup(skiplist.NewIntKeyItem(n)); skiplist.IntFromItem(got) != n {
+		t.Errorf("expected insert to succeed")
+	}
 }
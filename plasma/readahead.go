@@ -0,0 +1,110 @@
+package plasma
+
+import (
+	"unsafe"
+)
+
+// Number of goroutines fetching the pages requested by scans
+const maxReadAheadThreads = 4
+
+// Read-ahead requests which do not fit in the queue are dropped
+const readAheadQueueSize = 1024
+
+func (s *Plasma) startReadAhead() {
+	n := s.Config.ReadAheadPages
+	if n > maxReadAheadThreads {
+		n = maxReadAheadThreads
+	}
+
+	s.readAheadCh = make(chan unsafe.Pointer, readAheadQueueSize)
+	s.stopreadahead = make(chan struct{})
+	for i := 0; i < n; i++ {
+		s.readAheadWg.Add(1)
+		go s.readAheadDaemon(s.newWCtx())
+	}
+}
+
+func (s *Plasma) stopReadAhead() {
+	if s.readAheadCh != nil {
+		close(s.stopreadahead)
+		s.readAheadWg.Wait()
+	}
+}
+
+func (s *Plasma) readAheadDaemon(ctx *wCtx) {
+	defer s.readAheadWg.Done()
+	for {
+		select {
+		case <-s.stopreadahead:
+			return
+		case itm := <-s.readAheadCh:
+			s.readAhead(itm, ctx)
+		}
+	}
+}
+
+// readAhead swaps in the page covering itm if it is still evicted. The page
+// is located by its low item since its page id may have been removed by the
+// time the request is processed.
+func (s *Plasma) readAhead(itm unsafe.Pointer, ctx *wCtx) {
+	// Scans should not push other pages out of memory
+	if s.hasMemoryPressure || s.isClosed() {
+		return
+	}
+
+	tok := ctx.BeginTx()
+	defer ctx.EndTx(tok)
+
+	var pid PageId
+	if prev, curr, found := s.Skiplist.Lookup(itm, s.cmp, ctx.buf, ctx.slSts); found {
+		pid = curr
+	} else {
+		pid = prev
+	}
+
+	pg, err := s.ReadPage(pid, nil, false, ctx)
+	if err != nil || !pg.InRange(itm) || !isReadAheadCandidate(pg.(*page)) {
+		return
+	}
+
+	if err := s.swapinPage(pid, pg, ctx); err == nil {
+		ctx.sts.ReadAheads++
+	}
+}
+
+// isReadAheadCandidate returns true if the page has to be read from the LSS
+func isReadAheadCandidate(pg *page) bool {
+	return pg.head != nil && pg.head.state.IsEvicted() && !pg.IsCompressed()
+}
+
+// readAhead requests the evicted pages among the Config.ReadAheadPages
+// following pg to be fetched in the background, skipping the pages
+// requested earlier during the scan
+func (itr *Iterator) readAhead(pg *page) {
+	s := itr.store
+	pid := pg.Next()
+	for i := 0; i < s.Config.ReadAheadPages && pid != s.EndPageId(); i++ {
+		next, err := s.ReadPage(pid, nil, false, itr.wCtx)
+		if err != nil {
+			return
+		}
+
+		npg := next.(*page)
+		low := npg.MinItem()
+		if itr.endItm != nil && s.cmp(low, itr.endItm) > 0 {
+			return
+		}
+
+		if isReadAheadCandidate(npg) && (itr.readAheadItm == nil || s.cmp(low, itr.readAheadItm) > 0) {
+			low = itr.storeCtx.dup(low)
+			select {
+			case s.readAheadCh <- low:
+				itr.readAheadItm = low
+			default:
+				return
+			}
+		}
+
+		pid = npg.Next()
+	}
+}
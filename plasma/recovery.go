@@ -0,0 +1,477 @@
+package plasma
+
+import (
+	"github.com/couchbase/nitro/skiplist"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const recoveryQueueSize = 256
+const recoveryProgressInterval = time.Second
+
+// RecoveryProgressFn is periodically called with the number of log bytes
+// replayed so far while the instance is being opened
+type RecoveryProgressFn func(bytesDone, bytesTotal int64)
+
+type recoveryProgress struct {
+	callb      RecoveryProgressFn
+	start, end LSSOffset
+	started    bool
+	lastReport time.Time
+}
+
+func (s *Plasma) newRecoveryProgress() *recoveryProgress {
+	return &recoveryProgress{
+		callb: s.RecoveryProgressCallback,
+		end:   s.lss.TailOffset(),
+	}
+}
+
+func (p *recoveryProgress) Update(offset LSSOffset) {
+	if p.callb == nil {
+		return
+	}
+
+	if !p.started {
+		p.started = true
+		p.start = offset
+		p.lastReport = time.Now()
+		p.callb(0, int64(p.end-p.start))
+	} else if time.Since(p.lastReport) >= recoveryProgressInterval {
+		p.lastReport = time.Now()
+		p.callb(int64(offset-p.start), int64(p.end-p.start))
+	}
+}
+
+func (p *recoveryProgress) Done() {
+	if p.callb != nil {
+		total := int64(p.end - p.start)
+		p.callb(total, total)
+	}
+}
+
+// visitRecoveryLog visits the log starting at the given offset or from the
+// log head if the offset is expiredLSSOffset
+func (s *Plasma) visitRecoveryLog(start LSSOffset, callb LSSBlockCallback, buf []byte) error {
+	if s.salvage != nil {
+		return s.lss.(*lsStore).salvage(callb, s.skipLSSRange, buf)
+	}
+
+	if start == expiredLSSOffset {
+		return s.lss.Visitor(callb, buf)
+	}
+
+	return s.lss.VisitorFrom(start, callb, buf)
+}
+
+func (s *Plasma) replayLog(start LSSOffset) error {
+	pg := newPage(s.gCtx, nil, nil).(*page)
+
+	buf := s.gCtx.GetBuffer(bufRecovery)
+	progress := s.newRecoveryProgress()
+
+	fn := func(offset LSSOffset, bs []byte) (bool, error) {
+		var err error
+
+		progress.Update(offset)
+		typ := getLSSBlockType(bs)
+		switch typ {
+		case lssRecoveryPoints, lssMaxSn, lssHeatMap:
+			s.recoverMetaBlock(typ, offset, bs[lssBlockTypeSize:])
+		case lssPageRemove:
+			err = s.recoverPageRemove(offset, bs[lssBlockTypeSize:], s.gCtx)
+		case lssPageData, lssPageReloc, lssPageUpdate:
+			var data []byte
+			if data, err = s.decompressPageBlock(bs, s.gCtx); err != nil {
+				return false, newLSSError("recovery", offset, err)
+			}
+
+			if s.LazyRecovery {
+				err = s.recoverPageLazy(typ, offset, len(bs)-lssBlockTypeSize, data, pg, s.gCtx)
+			} else {
+				pg.Unmarshal(data, s.gCtx)
+				_, err = s.recoverPage(typ, offset, len(bs)-lssBlockTypeSize, pg, s.gCtx)
+			}
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		pg.Reset()
+		s.tryEvictPages(s.gCtx)
+		s.trySMRObjects(s.gCtx, recoverySMRInterval)
+		return true, nil
+	}
+
+	if err := s.visitRecoveryLog(start, fn, buf); err != nil {
+		return err
+	}
+
+	progress.Done()
+	return nil
+}
+
+type recoveryBlock struct {
+	typ         lssBlockType
+	offset      LSSOffset
+	flushDataSz int
+	bs          []byte
+	pg          *page
+	err         error
+}
+
+// replayLogParallel decodes page blocks using n workers. Blocks are handed
+// out to the workers in round robin order and the decoded pages are
+// collected in the same order, so that the page table and the metadata
+// are updated in log order by a single goroutine.
+func (s *Plasma) replayLogParallel(start LSSOffset, n int) error {
+	var wg sync.WaitGroup
+	var failed int32
+	var applyErr error
+
+	in := make([]chan *recoveryBlock, n)
+	out := make([]chan *recoveryBlock, n)
+	for i := 0; i < n; i++ {
+		in[i] = make(chan *recoveryBlock, recoveryQueueSize)
+		out[i] = make(chan *recoveryBlock, recoveryQueueSize)
+		go s.recoveryDecoder(in[i], out[i], s.newWCtx())
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			blk, ok := <-out[i%n]
+			if !ok {
+				return
+			}
+
+			// Drain the remaining blocks after a failure
+			if applyErr != nil {
+				continue
+			}
+
+			err := blk.err
+			if err == nil {
+				switch blk.typ {
+				case lssRecoveryPoints, lssMaxSn, lssHeatMap:
+					s.recoverMetaBlock(blk.typ, blk.offset, blk.bs)
+				case lssPageRemove:
+					err = s.recoverPageRemove(blk.offset, blk.bs, s.gCtx)
+				default:
+					err = s.applyDecodedPage(blk)
+				}
+			}
+
+			if err != nil {
+				applyErr = err
+				atomic.StoreInt32(&failed, 1)
+				continue
+			}
+
+			s.tryEvictPages(s.gCtx)
+			s.trySMRObjects(s.gCtx, recoverySMRInterval)
+		}
+	}()
+
+	nblocks := 0
+	progress := s.newRecoveryProgress()
+	fn := func(offset LSSOffset, bs []byte) (bool, error) {
+		if atomic.LoadInt32(&failed) == 1 {
+			return false, nil
+		}
+
+		progress.Update(offset)
+
+		// Metadata blocks are queued as well, so that they are applied in
+		// log order along with the pages
+		typ := getLSSBlockType(bs)
+		switch typ {
+		case lssRecoveryPoints, lssMaxSn, lssHeatMap,
+			lssPageRemove, lssPageData, lssPageReloc, lssPageUpdate:
+			in[nblocks%n] <- &recoveryBlock{
+				typ:         typ,
+				offset:      offset,
+				flushDataSz: len(bs) - lssBlockTypeSize,
+				bs:          append([]byte(nil), bs...),
+			}
+			nblocks++
+		}
+
+		return true, nil
+	}
+
+	err := s.visitRecoveryLog(start, fn, s.gCtx.GetBuffer(bufRecovery))
+	for _, ch := range in {
+		close(ch)
+	}
+	wg.Wait()
+
+	if err != nil {
+		return err
+	} else if applyErr != nil {
+		return applyErr
+	}
+
+	progress.Done()
+	return nil
+}
+
+func (s *Plasma) recoveryDecoder(in, out chan *recoveryBlock, ctx *wCtx) {
+	for blk := range in {
+		if blk.typ != lssPageData && blk.typ != lssPageReloc && blk.typ != lssPageUpdate {
+			blk.bs = blk.bs[lssBlockTypeSize:]
+		} else if data, err := s.decompressPageBlock(blk.bs, ctx); err != nil {
+			blk.err = newLSSError("recovery", blk.offset, err)
+		} else {
+			// Decompressed data lives in a ctx buffer, which is reused
+			if getLSSBlockCodec(blk.bs) != CompressionNone {
+				data = append([]byte(nil), data...)
+			}
+
+			// The page is owned by the applier once it is decoded
+			blk.pg = newPage2(nil, nil, s.gCtx, s.storeCtx, new(allocCtx)).(*page)
+			blk.pg.Unmarshal(data, ctx)
+		}
+
+		out <- blk
+	}
+
+	s.retireWCtx(ctx)
+	close(out)
+}
+
+// applyDecodedPage applies a page decoded by a recovery worker. Since the
+// page has its own allocation context, the allocations have to be
+// accounted here when the page is used to create a mapping and released
+// when it is discarded.
+func (s *Plasma) applyDecodedPage(blk *recoveryBlock) error {
+	ctx := s.gCtx
+	applied, err := s.recoverPage(blk.typ, blk.offset, blk.flushDataSz, blk.pg, ctx)
+	if err != nil {
+		return err
+	}
+
+	allocs, frees, nra, nrs, memUsed := blk.pg.GetAllocOps()
+	if applied {
+		ctx.sts.AllocSz += int64(memUsed)
+		ctx.sts.NumRecordAllocs += int64(nra)
+		ctx.sts.NumRecordSwapIn += int64(nrs)
+		ctx.freePages(frees)
+	} else {
+		s.discardDeltas(allocs)
+	}
+
+	return nil
+}
+
+func (s *Plasma) recoverMetaBlock(typ lssBlockType, offset LSSOffset, bs []byte) {
+	switch typ {
+	case lssRecoveryPoints:
+		s.rpVersion, s.recoveryPoints = unmarshalRPs(bs)
+	case lssMaxSn:
+		s.currSn = decodeMaxSn(bs)
+		s.recoveredMaxSns = append(s.recoveredMaxSns, recoveredMaxSn{offset, s.currSn})
+	case lssHeatMap:
+		s.heatMap = append([]byte(nil), bs...)
+	}
+}
+
+// isStaleRecoveryBlock reports whether the page already reflects the log
+// block at offset. This happens when replaying the log after a checkpoint.
+// Pages with unflushed changes exist when blocks are applied to a replica.
+func isStaleRecoveryBlock(pg Page, offset LSSOffset) bool {
+	if pg.NeedsFlush() {
+		return false
+	}
+
+	flushOffset, _, _ := pg.GetFlushInfo()
+	return offset <= flushOffset
+}
+
+func (s *Plasma) recoverPageRemove(offset LSSOffset, bs []byte, ctx *wCtx) error {
+	rmPglow := getRmPageLow(bs)
+	pid := s.getPageId(rmPglow, ctx)
+	if pid != nil {
+		currPg, err := s.ReadPage(pid, ctx.pgRdrFn, false, ctx)
+		if err != nil {
+			return err
+		}
+
+		if isStaleRecoveryBlock(currPg, offset) {
+			return nil
+		}
+
+		// TODO: Store precomputed fdSize in swapout delta
+		ctx.sts.FlushDataSz -= int64(currPg.GetFlushDataSize())
+		currPg.(*page).free(false)
+		s.unindexPage(pid, ctx)
+	}
+
+	return nil
+}
+
+// recoverPage applies an unmarshalled page block to the page table. It
+// returns false if the page was discarded.
+func (s *Plasma) recoverPage(typ lssBlockType, offset LSSOffset,
+	flushDataSz int, pg *page, ctx *wCtx) (bool, error) {
+
+	newPageData := (typ == lssPageData || typ == lssPageReloc)
+	if pid := s.getPageId(pg.low, ctx); pid == nil {
+		if !newPageData {
+			pg.free(false)
+			return false, nil
+		}
+
+		ctx.sts.FlushDataSz += int64(flushDataSz)
+		pg.AddFlushRecord(offset, flushDataSz, 1)
+		pid = s.AllocPageId(ctx)
+		s.CreateMapping(pid, pg, ctx)
+		if err := s.indexPage(pid, ctx); err != nil {
+			return false, err
+		}
+	} else {
+		currPg, err := s.ReadPage(pid, ctx.pgRdrFn, false, ctx)
+		if err != nil {
+			return false, err
+		}
+
+		if isStaleRecoveryBlock(currPg, offset) {
+			pg.free(false)
+			return false, nil
+		}
+
+		ctx.sts.FlushDataSz += int64(flushDataSz)
+
+		if newPageData {
+			ctx.sts.FlushDataSz -= int64(currPg.GetFlushDataSize())
+			currPg.(*page).free(false)
+			pg.AddFlushRecord(offset, flushDataSz, 1)
+		} else {
+			var numSegments int
+			if !currPg.NeedsFlush() {
+				_, numSegments, _ = currPg.GetFlushInfo()
+			}
+			pg.Append(currPg)
+			pg.AddFlushRecord(offset, flushDataSz, numSegments+1)
+		}
+
+		pg.prevHeadPtr = currPg.(*page).prevHeadPtr
+		s.UpdateMapping(pid, pg, ctx)
+	}
+
+	return true, nil
+}
+
+// recoverPageLazy applies a page block like recoverPage, but only decodes
+// the header of the page. The page is evicted once the block is applied.
+// Blocks updating a page with changes which are not flushed are applied
+// using the whole page.
+func (s *Plasma) recoverPageLazy(typ lssBlockType, offset LSSOffset,
+	flushDataSz int, data []byte, pg *page, ctx *wCtx) error {
+
+	if typ == lssPageUpdate {
+		_, low := decodePageState(data)
+		if pid := s.getPageId(low, ctx); pid != nil {
+			currPg, err := s.ReadPage(pid, ctx.pgRdrFn, false, ctx)
+			if err != nil {
+				return err
+			}
+
+			if currPg.NeedsFlush() {
+				pg.Unmarshal(data, ctx)
+				_, err = s.recoverPage(typ, offset, flushDataSz, pg, ctx)
+				return err
+			}
+		}
+	}
+
+	pg.unmarshalHeader(data)
+	if applied, err := s.recoverPage(typ, offset, flushDataSz, pg, ctx); !applied || err != nil {
+		return err
+	}
+
+	pid := s.getPageId(pg.low, ctx)
+	currPg, err := s.ReadPage(pid, ctx.pgRdrFn, false, ctx)
+	if err != nil {
+		return err
+	}
+
+	flushOffset, numSegments, _ := currPg.GetFlushInfo()
+	currPg.Evict(flushOffset, numSegments)
+	s.UpdateMapping(pid, currPg, ctx)
+	return nil
+}
+
+// linkSiblings sets the right sibling of every page after the log has been
+// replayed. The pages of the range partitions are linked in parallel and
+// the partitions are joined afterwards, which only has to validate the
+// pages at the partition boundaries.
+func (s *Plasma) linkSiblings(concurr int) error {
+	partns := s.GetRangePartitions(concurr)
+	first := make([]Page, len(partns))
+	firstPid := make([]PageId, len(partns))
+	last := make([]Page, len(partns))
+	errs := make([]error, len(partns))
+
+	var wg sync.WaitGroup
+	for _, partn := range partns {
+		wg.Add(1)
+		go func(p RangePartition, ctx *wCtx) {
+			defer wg.Done()
+			defer s.retireWCtx(ctx)
+			callb := func(pid PageId, _ RangePartition) error {
+				pg, err := s.ReadPage(pid, ctx.pgRdrFn, false, ctx)
+				if lastPg := last[p.Shard]; lastPg == nil {
+					first[p.Shard], firstPid[p.Shard] = pg, pid
+				} else {
+					if err == nil && s.cmp(lastPg.MaxItem(), pg.MinItem()) != 0 && s.salvage == nil {
+						return s.newPageError("recovery", pg, ErrMissingPage)
+					}
+
+					lastPg.SetNext(pid)
+				}
+
+				last[p.Shard] = pg
+				return err
+			}
+
+			errs[p.Shard] = s.VisitPartition(p, callb)
+		}(partn, s.newWCtx())
+	}
+
+	wg.Wait()
+
+	var lastPg Page
+	for i := range partns {
+		if errs[i] != nil {
+			return errs[i]
+		}
+
+		if first[i] == nil {
+			continue
+		}
+
+		if lastPg != nil {
+			pg := first[i]
+			if s.cmp(lastPg.MaxItem(), pg.MinItem()) != 0 && s.salvage == nil {
+				return s.newPageError("recovery", pg, ErrMissingPage)
+			}
+
+			lastPg.SetNext(firstPid[i])
+		}
+
+		lastPg = last[i]
+	}
+
+	if lastPg != nil {
+		lastPg.SetNext(s.EndPageId())
+		if lastPg.MaxItem() != skiplist.MaxItem && s.salvage == nil {
+			return s.newPageError("recovery", lastPg, ErrInvalidLastPage)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,207 @@
+package plasma
+
+import (
+	"github.com/couchbase/nitro/skiplist"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestPlasmaParallelRecovery(t *testing.T) {
+	var wg sync.WaitGroup
+	os.RemoveAll("teststore.data")
+	cfg := testCfg
+	cfg.Compression = CompressionSnappy
+	s := newTestIntPlasmaStore(cfg)
+
+	numThreads := 8
+	n := 400000
+	m := 100000
+	ws := make([]*Writer, numThreads)
+	for i := 0; i < numThreads; i++ {
+		wg.Add(1)
+		ws[i] = s.NewWriter()
+		go doInsert(ws[i], &wg, i, n/numThreads)
+	}
+	wg.Wait()
+
+	// Interleave page data and page update blocks
+	s.PersistAll()
+	for i := 0; i < numThreads; i++ {
+		wg.Add(1)
+		go doDelete(ws[i], &wg, i, m/numThreads)
+	}
+	wg.Wait()
+	s.PersistAll()
+	s.Close()
+
+	cfg.NumRecoveryThreads = 4
+	s = newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	w := s.NewWriter()
+	for i := 0; i < n; i++ {
+		itm := skiplist.NewIntKeyItem(i)
+		got, _ := w.Lookup(itm)
+		if i < m && got != nil {
+			t.Fatalf("expected nil for %d", i)
+		} else if i >= m && (got == nil || skiplist.CompareInt(itm, got) != 0) {
+			t.Fatalf("lookup failed for %d", i)
+		}
+	}
+
+	count := 0
+	itr := s.NewIterator()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		count++
+	}
+	itr.(*Iterator).Close()
+
+	if count != n-m {
+		t.Errorf("expected %d items, got %d", n-m, count)
+	}
+}
+
+func TestPlasmaRecoveryProgress(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testCfg)
+	w := s.NewWriter()
+	for i := 0; i < 100000; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+	s.PersistAll()
+	s.Close()
+
+	for _, nthreads := range []int{1, 4} {
+		var calls [][2]int64
+		cfg := testCfg
+		cfg.NumRecoveryThreads = nthreads
+		cfg.RecoveryProgressCallback = func(done, total int64) {
+			calls = append(calls, [2]int64{done, total})
+		}
+
+		s = newTestIntPlasmaStore(cfg)
+		s.Close()
+
+		if len(calls) < 2 {
+			t.Fatalf("expected at least two progress calls, got %v", calls)
+		}
+
+		last := calls[len(calls)-1]
+		if calls[0][0] != 0 || last[0] != last[1] || last[1] <= 0 {
+			t.Errorf("unexpected progress %v", calls)
+		}
+
+		for i := 1; i < len(calls); i++ {
+			if calls[i][0] < calls[i-1][0] {
+				t.Errorf("progress went backwards %v", calls)
+			}
+		}
+	}
+}
+
+func TestPlasmaRecoverySiblings(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testCfg)
+	w := s.NewWriter()
+	for i := 0; i < 100000; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+	s.PersistAll()
+	s.Close()
+
+	for _, nthreads := range []int{1, 8} {
+		cfg := testCfg
+		cfg.NumPersistorThreads = nthreads
+		s = newTestIntPlasmaStore(cfg)
+
+		var pids []PageId
+		s.PageVisitor(func(pid PageId, _ RangePartition) error {
+			pids = append(pids, pid)
+			return nil
+		}, 1)
+
+		if len(pids) < 100 {
+			t.Fatalf("expected many pages, got %d", len(pids))
+		}
+
+		w := s.NewWriter()
+		for i, pid := range pids {
+			next := s.EndPageId()
+			if i+1 < len(pids) {
+				next = pids[i+1]
+			}
+
+			pg, _ := s.ReadPage(pid, nil, false, w.wCtx)
+			if pg.Next() != next {
+				t.Fatalf("threads %d: page %d of %d is not linked to its sibling", nthreads, i, len(pids))
+			}
+		}
+
+		s.Close()
+	}
+}
+
+func TestPlasmaLazyRecovery(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testCfg)
+	w := s.NewWriter()
+	n, m := 100000, 20000
+	for i := 0; i < n; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+
+	// Interleave page data and page update blocks
+	s.PersistAll()
+	for i := 0; i < m; i++ {
+		w.Delete(skiplist.NewIntKeyItem(i))
+	}
+	s.PersistAll()
+	s.Close()
+
+	s = newTestIntPlasmaStore(testCfg)
+	memSz := s.GetStats().MemSz
+	s.Close()
+
+	cfg := testCfg
+	cfg.LazyRecovery = true
+	s = newTestIntPlasmaStore(cfg)
+	if lazySz := s.GetStats().MemSz; lazySz*2 > memSz {
+		t.Errorf("expected lazy recovery to use less memory, got %d, full recovery %d", lazySz, memSz)
+	}
+
+	w = s.NewWriter()
+	for i := 0; i < n; i++ {
+		itm := skiplist.NewIntKeyItem(i)
+		got, _ := w.Lookup(itm)
+		if i < m && got != nil {
+			t.Fatalf("expected nil for %d", i)
+		} else if i >= m && (got == nil || skiplist.CompareInt(itm, got) != 0) {
+			t.Fatalf("lookup failed for %d", i)
+		}
+	}
+
+	// Pages read from the log are updated and flushed as usual
+	for i := 0; i < m; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+	s.PersistAll()
+	s.Close()
+
+	s = newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	count := 0
+	itr := s.NewIterator()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		if skiplist.IntFromItem(itr.Get()) != count {
+			t.Fatalf("expected %d, got %d", count, skiplist.IntFromItem(itr.Get()))
+		}
+		count++
+	}
+	itr.(*Iterator).Close()
+
+	if count != n {
+		t.Errorf("expected %d items, got %d", n, count)
+	}
+}
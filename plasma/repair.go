@@ -0,0 +1,239 @@
+package plasma
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"unsafe"
+
+	"github.com/couchbase/nitro/skiplist"
+)
+
+const repairDirSuffix = ".repair"
+
+// DroppedRange is a range of keys [Low, High) whose items were lost by
+// Repair. A nil bound leaves the range open on that side.
+type DroppedRange struct {
+	Low, High []byte
+}
+
+// RepairReport describes the damage found by Repair
+type RepairReport struct {
+	// Blocks of the log skipped during recovery
+	SkippedBlocks int
+	SkippedBytes  int64
+
+	DroppedRanges []DroppedRange
+	// Items whose value could not be read from the value log
+	DroppedValues int
+	Items         int64
+	// Location the damaged instance was moved to once it was replaced
+	DamagedPath string
+}
+
+func (r *RepairReport) dropRange(low, high unsafe.Pointer) {
+	var dr DroppedRange
+	if low != skiplist.MinItem {
+		dr.Low = append([]byte(nil), (*item)(low).Key()...)
+	}
+
+	if high != skiplist.MaxItem {
+		dr.High = append([]byte(nil), (*item)(high).Key()...)
+	}
+
+	r.DroppedRanges = append(r.DroppedRanges, dr)
+}
+
+// Repair rebuilds the instance at cfg.File from the parts of its log which
+// can still be read. Unreadable or corrupt blocks are skipped, the pages
+// which can be recovered are copied in key order into a new compacted
+// instance and the key ranges of the pages which are missing or cannot be
+// read are reported. Like Restore, only the latest version of the items is
+// retained and the recovery points are recreated for it. The instance must
+// hold key value items and must not be open. Once the repaired instance is
+// complete, it replaces the damaged instance, which is kept at the path
+// reported in DamagedPath so that it can be inspected or destroyed.
+func Repair(cfg Config) (*RepairReport, error) {
+	if cfg.File == "" {
+		return nil, ErrNoLog
+	} else if isInstanceOpen(cfg.File) {
+		return nil, ErrInUse
+	}
+
+	path := cfg.File
+	cfg.File = path + repairDirSuffix
+	if err := DestroyInstance(cfg.File); err != nil {
+		return nil, err
+	}
+
+	rep := new(RepairReport)
+	srcCfg := cfg
+	srcCfg.File = path
+	srcCfg.readOnly = true
+	srcCfg.salvage = rep
+	srcCfg.CheckpointInterval = 0
+	srcCfg.NumRecoveryThreads = 1
+	srcCfg.AutoSwapper = false
+	srcCfg.PartialEviction = false
+	src, err := New(srcCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := NewBuilder(cfg)
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+
+	rps := src.GetRecoveryPoints()
+	err = src.salvageItems(b, rep)
+	src.Close()
+	if err != nil {
+		b.Abort()
+		DestroyInstance(cfg.File)
+		return nil, err
+	}
+
+	dst, err := b.Finish()
+	if err != nil {
+		b.Abort()
+		DestroyInstance(cfg.File)
+		return nil, err
+	}
+
+	if dst.EnableShapshots {
+		dst.restoreRecoveryPoints(rps)
+	}
+	dst.Close()
+
+	damaged, err := damagedPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(path, damaged); err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(cfg.File, path); err != nil {
+		os.Rename(damaged, path)
+		return nil, err
+	}
+
+	rep.DamagedPath = damaged
+	return rep, nil
+}
+
+// damagedPath returns an unused path to keep the damaged instance at, so
+// that the instances replaced by earlier repairs are not overwritten.
+func damagedPath(path string) (string, error) {
+	damaged := path + ".damaged"
+	for i := 1; ; i++ {
+		if _, err := os.Stat(damaged); os.IsNotExist(err) {
+			return damaged, nil
+		} else if err != nil {
+			return "", err
+		}
+		damaged = fmt.Sprintf("%s.damaged.%d", path, i)
+	}
+}
+
+func (s *Plasma) skipLSSRange(start, end LSSOffset, err error) {
+	s.salvage.SkippedBlocks++
+	s.salvage.SkippedBytes += int64(end - start)
+	s.logger("repair").Errorf("skipped log range [%d, %d) (err=%v)", start, end, err)
+}
+
+// salvageItems adds the latest version of the items of the pages which can
+// be read to the builder in key order
+func (s *Plasma) salvageItems(b *Builder, rep *RepairReport) error {
+	ctx := s.newWCtx()
+	log := s.logger("repair")
+	last := skiplist.MinItem
+
+	callb := func(pid PageId, partn RangePartition) error {
+	refresh:
+		pg, _ := s.ReadPage(pid, nil, false, ctx)
+		pgi := pg.(*page)
+		if pgi.head == nil {
+			return nil
+		}
+
+		// A stale version of a page may be found if its latest version
+		// was lost. It is truncated to the range up to the next page.
+		low, high := pg.MinItem(), pg.MaxItem()
+		if next := pg.Next(); next != s.EndPageId() {
+			npg, _ := s.ReadPage(next, nil, false, ctx)
+			if nlow := npg.MinItem(); s.cmp(nlow, high) < 0 {
+				high = nlow
+			}
+		}
+
+		if low != last && s.cmp(low, last) > 0 {
+			rep.dropRange(last, low)
+			log.Errorf("no page found for the keys from %v to %v",
+				rangeBound(last), rangeBound(low))
+			last = low
+		}
+
+		if err := s.swapinPage(pid, pg, ctx); err == errSwapinConflict {
+			goto refresh
+		} else if err != nil {
+			rep.dropRange(last, high)
+			log.Errorf("unable to read the page from %v to %v (err=%v)",
+				rangeBound(last), rangeBound(high), err)
+			last = high
+			return nil
+		}
+
+		var filter ItemFilter = new(defaultFilter)
+		if s.EnableShapshots {
+			filter = &snFilter{sn: math.MaxUint64}
+		}
+
+		var sts pgOpIteratorStats
+		itr := newPgOpIterator(pgi.head, s.cmp, nil, high, filter, ctx, &sts)
+		defer itr.Close()
+
+		for itr.Init(); itr.Valid(); itr.Next() {
+			itm := (*item)(itr.Get().Item())
+			v, err := s.readValue(itm)
+			if err != nil {
+				rep.DroppedValues++
+				log.Errorf("unable to read the value of %q (err=%v)", itm.Key(), err)
+				continue
+			}
+
+			if err := b.AddKV(itm.Key(), v); err != nil {
+				return err
+			}
+			rep.Items++
+		}
+
+		last = high
+		return nil
+	}
+
+	if err := s.PageVisitor(callb, 1); err != nil {
+		return err
+	}
+
+	if last != skiplist.MaxItem {
+		rep.dropRange(last, skiplist.MaxItem)
+		log.Errorf("no page found for the keys from %v", rangeBound(last))
+	}
+
+	return nil
+}
+
+func rangeBound(itm unsafe.Pointer) string {
+	switch itm {
+	case skiplist.MinItem:
+		return "-inf"
+	case skiplist.MaxItem:
+		return "+inf"
+	}
+
+	return fmt.Sprintf("%q", (*item)(itm).Key())
+}
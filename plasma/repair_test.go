@@ -0,0 +1,135 @@
+package plasma
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepair(t *testing.T) {
+	os.RemoveAll("teststore.repair")
+	defer os.RemoveAll("teststore.repair")
+	os.RemoveAll("teststore.damaged")
+	defer os.RemoveAll("teststore.damaged")
+
+	cfg := testSnCfg
+	cfg.File = "teststore.repair"
+	cfg.AutoLSSCleaning = false
+	cfg.AutoSwapper = false
+	b, err := NewBuilder(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every page is written to a single block
+	n := 100000
+	for i := 0; i < n; i++ {
+		b.AddKV([]byte(fmt.Sprintf("key-%10d", i)), []byte(fmt.Sprintf("val-%10d", i)))
+	}
+
+	s, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.CreateRecoveryPoint(s.NewSnapshot(), []byte("rp"))
+	s.PersistAll()
+	s.Close()
+
+	segSize := applyConfigDefaults(cfg).LSSLogSegmentSize
+	lss, err := NewLSStore(cfg.File, segSize, cfg.FlushBufferSize, 2, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var offs []LSSOffset
+	lss.Visitor(func(offset LSSOffset, bs []byte) (bool, error) {
+		if getLSSBlockType(bs) == lssPageData {
+			offs = append(offs, offset)
+		}
+		return true, nil
+	}, make([]byte, 1024*1024))
+	lss.Close()
+
+	if len(offs) < 10 {
+		t.Fatalf("expected at least 10 page blocks, got %d", len(offs))
+	}
+
+	// Damage the data of a block and the length of another
+	f, err := os.OpenFile(filepath.Join(cfg.File, fmt.Sprintf(segFileNameFormat, 0)), os.O_RDWR, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var l [fbLenSize]byte
+	binary.BigEndian.PutUint32(l[:], 0xffffffff)
+	if _, err := f.WriteAt([]byte{0xff}, int64(offs[3])+headerFBSize+10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(l[:], int64(offs[len(offs)/2])); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if s, err = OpenReadOnly(cfg); err == nil {
+		t.Fatal("expected recovery to fail")
+	} else if s != nil {
+		s.Close()
+	}
+
+	rep, err := Repair(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rep.SkippedBlocks != 2 || len(rep.DroppedRanges) != 2 {
+		t.Errorf("expected 2 skipped blocks and dropped ranges, got %+v", rep)
+	}
+
+	dropped := func(k []byte) bool {
+		for _, r := range rep.DroppedRanges {
+			if (r.Low == nil || bytes.Compare(k, r.Low) >= 0) &&
+				(r.High == nil || bytes.Compare(k, r.High) < 0) {
+				return true
+			}
+		}
+		return false
+	}
+
+	s = newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	w := s.NewWriter()
+	var found int64
+	for i := 0; i < n; i++ {
+		k := []byte(fmt.Sprintf("key-%10d", i))
+		v, err := w.LookupKV(k)
+		if dropped(k) {
+			if err == nil {
+				t.Fatalf("key %d: expected to be dropped", i)
+			}
+			continue
+		}
+
+		if err != nil || !bytes.Equal(v, []byte(fmt.Sprintf("val-%10d", i))) {
+			t.Fatalf("key %d: unexpected value %s (err=%v)", i, v, err)
+		}
+		found++
+	}
+
+	if found != rep.Items || found != int64(n-2*cfg.MaxPageItems) || s.ItemsCount() != found {
+		t.Errorf("expected %d items, found %d, count %d", rep.Items, found, s.ItemsCount())
+	}
+
+	if rps := s.GetRecoveryPoints(); len(rps) != 1 || string(rps[0].Meta()) != "rp" {
+		t.Errorf("expected the recovery point to be restored, got %v", rps)
+	}
+
+	if rep.DamagedPath != cfg.File+".damaged" {
+		t.Errorf("unexpected damaged instance path %s", rep.DamagedPath)
+	} else if _, err := os.Stat(rep.DamagedPath); err != nil {
+		t.Errorf("expected the damaged instance to be kept (err=%v)", err)
+	}
+}
@@ -0,0 +1,335 @@
+package plasma
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/nitro/skiplist"
+)
+
+// A tailed log is streamed as a sequence of frames, each holding a log
+// block. A frame starts with the log offset following the block and the
+// length of the block, followed by the block and its crc32c.
+const logFrameHdrSize = 12
+
+var tailLogPollInterval = time.Millisecond * 10
+
+type logTailer struct {
+	offset uint64
+}
+
+// pinLog keeps the blocks of the log from offset on from being trimmed
+// until the offset of the returned tailer is advanced or it is unpinned
+func (s *Plasma) pinLog(offset LSSOffset) *logTailer {
+	t := &logTailer{offset: uint64(offset)}
+
+	s.tailLock.Lock()
+	if s.tailers == nil {
+		s.tailers = make(map[*logTailer]struct{})
+	}
+	s.tailers[t] = struct{}{}
+	s.tailLock.Unlock()
+
+	return t
+}
+
+func (s *Plasma) unpinLog(t *logTailer) {
+	s.tailLock.Lock()
+	delete(s.tailers, t)
+	s.tailLock.Unlock()
+}
+
+// TailLog streams the blocks written to the log from fromOffset to w as
+// they are flushed, until the instance is closed or writing to w fails. A
+// fromOffset of zero starts from the oldest live block, which is enough to
+// build a replica from scratch. The blocks are not trimmed from the log
+// until they have been streamed. The stream is applied to a replica using
+// ApplyLog.
+func (s *Plasma) TailLog(fromOffset LSSOffset, w io.Writer) error {
+	if !s.shouldPersist {
+		return ErrNoLog
+	}
+
+	// Values written to the value log are not part of the stream
+	if s.vlog != nil {
+		return ErrValueLog
+	}
+
+	start := fromOffset
+	if fromOffset == 0 {
+		start = s.lss.HeadOffset()
+	}
+
+	t := s.pinLog(start)
+	defer s.unpinLog(t)
+
+	// The blocks might have been trimmed before they were pinned
+	for LSSOffset(atomic.LoadUint64(&t.offset)) < s.lss.HeadOffset() {
+		if fromOffset != 0 {
+			return ErrLogTrimmed
+		}
+		atomic.StoreUint64(&t.offset, uint64(s.lss.HeadOffset()))
+	}
+
+	var hdr [logFrameHdrSize]byte
+	var err error
+
+	bw := bufio.NewWriter(w)
+	fn := func(offset LSSOffset, bs []byte) (bool, error) {
+		end := s.lss.BlockEndOffset(offset, bs)
+
+		switch getLSSBlockType(bs) {
+		case lssDiscard, lssCheckpoint:
+			// Checkpoints refer to the offsets of this log
+		default:
+			binary.BigEndian.PutUint64(hdr[:8], uint64(end))
+			binary.BigEndian.PutUint32(hdr[8:], uint32(len(bs)))
+			bw.Write(hdr[:])
+			bw.Write(bs)
+			binary.BigEndian.PutUint32(hdr[:4], crc32.Checksum(bs, crc32cTable))
+			if _, err := bw.Write(hdr[:4]); err != nil {
+				return false, err
+			}
+		}
+
+		atomic.StoreUint64(&t.offset, uint64(end))
+		return true, nil
+	}
+
+	buf := make([]byte, maxPageEncodedSize)
+	for !s.isClosed() {
+		start := LSSOffset(atomic.LoadUint64(&t.offset))
+		if err = s.lss.VisitorFrom(start, fn, buf); err != nil {
+			return err
+		}
+
+		if err = bw.Flush(); err != nil {
+			return err
+		}
+
+		if LSSOffset(atomic.LoadUint64(&t.offset)) == start {
+			time.Sleep(tailLogPollInterval)
+		}
+	}
+
+	return nil
+}
+
+// ApplyLog applies the log blocks streamed by TailLog of another instance
+// until the end of r. The blocks are replayed online through the recovery
+// path and written to the log of the instance, so that the instance can
+// serve as a warm standby. Page blocks refer to the offsets of the other
+// log, hence the applied pages are written out through the log of the
+// instance instead. The instance must not be written otherwise.
+// Reads observe the changes as the blocks are applied. It returns the log
+// offset of the other instance to resume tailing from, which has to be
+// tracked by the caller since blocks must be applied only once.
+func (s *Plasma) ApplyLog(r io.Reader) (LSSOffset, error) {
+	if !s.shouldPersist {
+		return 0, ErrNoLog
+	} else if s.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	s.applyLogLock.Lock()
+	defer s.applyLogLock.Unlock()
+	defer s.lss.Sync(false)
+
+	if s.applyLogWriter == nil {
+		s.applyLogWriter = s.newWCtx()
+	}
+
+	ctx := s.applyLogWriter
+	pg := newPage(ctx, nil, nil).(*page)
+	br := bufio.NewReader(r)
+
+	var hdr [logFrameHdrSize]byte
+	var resumeOffset LSSOffset
+	buf := make([]byte, maxPageEncodedSize)
+	for {
+		if _, err := io.ReadFull(br, hdr[:]); err == io.EOF {
+			return resumeOffset, nil
+		} else if err != nil {
+			return resumeOffset, err
+		}
+
+		end := LSSOffset(binary.BigEndian.Uint64(hdr[:8]))
+		l := int(binary.BigEndian.Uint32(hdr[8:]))
+		if l < lssBlockTypeSize || l > len(buf) {
+			return resumeOffset, newLSSError("apply", end, ErrCorruptLog)
+		}
+
+		bs := buf[:l]
+		if _, err := io.ReadFull(br, bs); err != nil {
+			return resumeOffset, err
+		}
+
+		if _, err := io.ReadFull(br, hdr[:4]); err != nil {
+			return resumeOffset, err
+		} else if binary.BigEndian.Uint32(hdr[:4]) != crc32.Checksum(bs, crc32cTable) {
+			return resumeOffset, newLSSError("apply", end, ErrBlockCorrupt)
+		}
+
+		if err := s.applyLogBlock(end, bs, pg, ctx); err != nil {
+			return resumeOffset, err
+		}
+
+		pg.Reset()
+		s.tryEvictPages(ctx)
+		s.trySMRObjects(ctx, recoverySMRInterval)
+		resumeOffset = end
+	}
+}
+
+func (s *Plasma) applyLogBlock(end LSSOffset, bs []byte, pg *page, ctx *wCtx) error {
+	typ := getLSSBlockType(bs)
+	switch typ {
+	case lssPageData, lssPageReloc, lssPageUpdate:
+		return s.applyPage(end, bs, pg, ctx)
+	}
+
+	var rps []*RecoveryPoint
+	var rpVersion uint16
+	if typ == lssRecoveryPoints {
+		// The offsets of the recovery points refer to the source log
+		rpVersion, rps = unmarshalRPs(bs[lssBlockTypeSize:])
+		for _, rp := range rps {
+			rp.offset, rp.hasOffset = 0, false
+		}
+
+		rpbs := marshalRPs(rps, rpVersion)
+		bs = make([]byte, lssBlockTypeSize+len(rpbs))
+		writeLSSBlock(bs, typ, rpbs)
+	}
+
+	offset, wbuf, res := s.lss.ReserveSpace(len(bs))
+	copy(wbuf, bs)
+	s.lss.FinalizeWrite(res)
+
+	switch typ {
+	case lssRecoveryPoints:
+		s.mvcc.Lock()
+		s.rpVersion, s.recoveryPoints = rpVersion, rps
+		s.updateRPSns(s.recoveryPoints)
+		s.mvcc.Unlock()
+	case lssMaxSn:
+		// Items applied so far become visible to new snapshots
+		maxSn := decodeMaxSn(bs[lssBlockTypeSize:])
+		s.mvcc.Lock()
+		if s.EnableShapshots && maxSn > atomic.LoadUint64(&s.currSn) {
+			atomic.StoreUint64(&s.currSn, maxSn)
+			atomic.StoreUint64(&s.lastMaxSn, maxSn)
+			s.currSnapshot.sn = maxSn
+		}
+		s.mvcc.Unlock()
+	case lssHeatMap:
+		s.heatMapLock.Lock()
+		s.heatMap = append([]byte(nil), bs[lssBlockTypeSize:]...)
+		s.heatMapLock.Unlock()
+	case lssPageRemove:
+		if err := s.recoverPageRemove(offset, bs[lssBlockTypeSize:], ctx); err != nil {
+			return err
+		}
+
+		// Link the page preceding the removed page to its successor
+		low := getRmPageLow(bs[lssBlockTypeSize:])
+		prev, next, _ := s.Skiplist.Lookup(low, s.cmp, ctx.buf, ctx.slSts)
+		return s.linkPage(prev, next, ctx)
+	}
+
+	return nil
+}
+
+// applyPage applies a page block of another log to the page table and
+// persists the resulting page, so that the page is read back from the
+// offsets of the log of the instance once it is evicted.
+func (s *Plasma) applyPage(end LSSOffset, bs []byte, pg *page, ctx *wCtx) error {
+	data, err := s.decompressPageBlock(bs, ctx)
+	if err != nil {
+		return newLSSError("apply", end, err)
+	}
+
+	newPageData := getLSSBlockType(bs) != lssPageUpdate
+
+retry:
+	pg.Reset()
+	pg.Unmarshal(data, ctx)
+
+	next := s.EndPageId()
+	if hiItm := pg.MaxItem(); hiItm != skiplist.MaxItem {
+		_, next, _ = s.Skiplist.Lookup(hiItm, s.cmp, ctx.buf, ctx.slSts)
+	}
+
+	pid := s.getPageId(pg.low, ctx)
+	if pid == nil {
+		if !newPageData {
+			pg.free(false)
+			return nil
+		}
+
+		pg.SetNext(next)
+		pid = s.AllocPageId(ctx)
+		s.CreateMapping(pid, pg, ctx)
+		if err := s.indexPage(pid, ctx); err != nil {
+			return err
+		}
+	} else {
+		currPg, err := s.ReadPage(pid, ctx.pgRdrFn, false, ctx)
+		if err != nil {
+			return err
+		}
+
+		var staleOff LSSOffset
+		var staleFdSz int
+		if newPageData {
+			staleOff, _ = currPg.GetLastFlushOffset()
+			staleFdSz = currPg.GetFlushDataSize()
+			currPg.(*page).free(false)
+		} else {
+			pg.Append(currPg)
+		}
+
+		pg.SetNext(next)
+		pg.prevHeadPtr = currPg.(*page).prevHeadPtr
+		if !s.UpdateMapping(pid, pg, ctx) {
+			goto retry
+		}
+
+		ctx.sts.FlushDataSz -= int64(staleFdSz)
+		s.trackLSSUsage(staleOff, staleFdSz, 0, 0)
+	}
+
+	s.Persist(pid, false, ctx)
+	if !s.isStartPage(pid) {
+		prev, _, _ := s.Skiplist.Lookup(pg.low, s.cmp, ctx.buf, ctx.slSts)
+		return s.linkPage(prev, pid, ctx)
+	}
+
+	return nil
+}
+
+// linkPage sets the right sibling of a page. The pages of a replica are
+// linked as the blocks are applied, since they are not linked by the
+// blocks themselves.
+func (s *Plasma) linkPage(pid, next PageId, ctx *wCtx) error {
+retry:
+	pg, err := s.ReadPage(pid, ctx.pgRdrFn, false, ctx)
+	if err != nil {
+		return err
+	}
+
+	if pg.Next() == next {
+		return nil
+	}
+
+	pg.(*page).Link(next)
+	if !s.UpdateMapping(pid, pg, ctx) {
+		goto retry
+	}
+
+	return nil
+}
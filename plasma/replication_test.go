@@ -0,0 +1,110 @@
+package plasma
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/couchbase/nitro/skiplist"
+)
+
+func TestPlasmaTailLog(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	os.RemoveAll("test.data")
+	s := newTestIntPlasmaStore(testCfg)
+	defer s.Close()
+
+	cfg := testCfg
+	cfg.File = "test.data"
+	r := newTestIntPlasmaStore(cfg)
+
+	count := func() int {
+		var n int
+		itr := r.NewIterator().(*Iterator)
+		for itr.SeekFirst(); itr.Valid(); itr.Next() {
+			n++
+		}
+		itr.Close()
+		return n
+	}
+
+	// Streams the log of s to r until the replica has caught up
+	replicate := func(from LSSOffset, n int) LSSOffset {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(s.TailLog(from, pw))
+		}()
+
+		done := make(chan LSSOffset)
+		go func() {
+			off, _ := r.ApplyLog(pr)
+			done <- off
+		}()
+
+		deadline := time.Now().Add(time.Second * 10)
+		for time.Now().Before(deadline) {
+			if count() == n {
+				break
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+
+		pr.Close()
+		return <-done
+	}
+
+	n := 100000
+	w := s.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+	s.PersistAll()
+
+	off := replicate(0, n)
+	if off == 0 {
+		t.Fatal("expected a resume offset")
+	}
+
+	// Checkpoint blocks are not streamed, hence the offsets of the logs
+	// differ from here on
+	if err := s.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Blocks of the page updates refer to the earlier ones
+	for j := 0; j < 4; j += 2 {
+		for i := j; i < n; i += 4 {
+			w.Delete(skiplist.NewIntKeyItem(i))
+		}
+		s.PersistAll()
+	}
+
+	replicate(off, n/2)
+
+	// Evicted pages are read back from the log of the replica
+	r.EvictAll(0)
+
+	rw := r.NewWriter()
+	for i := 0; i < n; i++ {
+		itm, _ := rw.Lookup(skiplist.NewIntKeyItem(i))
+		if i%2 == 0 && itm != nil {
+			t.Fatalf("expected %d to be deleted", i)
+		} else if i%2 == 1 && (itm == nil || skiplist.IntFromItem(itm) != i) {
+			t.Fatalf("expected %d to be found", i)
+		}
+	}
+
+	if c := count(); c != n/2 {
+		t.Errorf("expected %d items, got %d", n/2, c)
+	}
+
+	// Applied blocks are recovered from the log of the replica
+	r.Close()
+	r = newTestIntPlasmaStore(cfg)
+	defer r.Close()
+
+	if c := count(); c != n/2 {
+		t.Errorf("expected %d items after recovery, got %d", n/2, c)
+	}
+}
@@ -0,0 +1,458 @@
+package plasma
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const shardsMetaFile = "shards"
+
+var ErrShardCount = errors.New("number of shards does not match the store")
+var ErrUnnamedRecoveryPoint = errors.New("recovery point has no name")
+
+// PartitionFn maps a key to one of the n shards of a ShardedStore. The same
+// partitioning has to be used whenever a store is opened.
+type PartitionFn func(k []byte, n int) int
+
+// HashPartition spreads keys evenly across the shards
+func HashPartition(k []byte, n int) int {
+	return int(crc32.Checksum(k, crc32cTable) % uint32(n))
+}
+
+// KeyRangePartition returns a partitioning which assigns the keys lower than
+// splits[i] to shard i and the remaining keys to the last shard. The split
+// keys have to be sorted.
+func KeyRangePartition(splits [][]byte) PartitionFn {
+	return func(k []byte, n int) int {
+		i := sort.Search(len(splits), func(i int) bool {
+			return bytes.Compare(k, splits[i]) < 0
+		})
+
+		if i >= n {
+			return n - 1
+		}
+		return i
+	}
+}
+
+// ShardedStore manages a set of instances stored under one directory. Keys
+// are routed to the instances by a partitioning function, so that the
+// cleaner, swapper and recovery of each instance run independently.
+type ShardedStore struct {
+	dir       string
+	shards    []*Plasma
+	partition PartitionFn
+
+	// Writers are blocked while snapshots are taken across the shards
+	sync.RWMutex
+}
+
+// ShardedWriter holds a writer for every shard of a store
+type ShardedWriter struct {
+	ss *ShardedStore
+	ws []*Writer
+}
+
+// ShardedSnapshot is a consistent set of snapshots of the shards
+type ShardedSnapshot struct {
+	snaps []*Snapshot
+}
+
+// NewShardedStore opens a store with n shards in dir, creating it if it
+// does not exist. Every shard is an instance created with cfg, which is
+// stored in a file of its own. The shards are opened in parallel.
+func NewShardedStore(dir string, n int, cfg Config, partition PartitionFn) (*ShardedStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	metaFile := filepath.Join(dir, shardsMetaFile)
+	if bs, err := os.ReadFile(metaFile); err == nil {
+		if nshards, err := strconv.Atoi(strings.TrimSpace(string(bs))); err != nil || nshards != n {
+			return nil, ErrShardCount
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	} else if err := os.WriteFile(metaFile, []byte(strconv.Itoa(n)), 0644); err != nil {
+		return nil, err
+	}
+
+	ss := &ShardedStore{
+		dir:       dir,
+		shards:    make([]*Plasma, n),
+		partition: partition,
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			shardCfg := cfg
+			shardCfg.File = filepath.Join(dir, fmt.Sprintf("shard-%d", i))
+			ss.shards[i], errs[i] = New(shardCfg)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			for _, s := range ss.shards {
+				if s != nil {
+					s.Close()
+				}
+			}
+			return nil, err
+		}
+	}
+
+	return ss, nil
+}
+
+// NumShards returns the number of shards of the store
+func (ss *ShardedStore) NumShards() int {
+	return len(ss.shards)
+}
+
+// Shard returns the instance holding the given shard
+func (ss *ShardedStore) Shard(i int) *Plasma {
+	return ss.shards[i]
+}
+
+// ShardOf returns the shard a key is routed to
+func (ss *ShardedStore) ShardOf(k []byte) int {
+	return ss.partition(k, len(ss.shards))
+}
+
+func (ss *ShardedStore) Close() {
+	ss.CloseContext(context.Background())
+}
+
+// CloseContext closes the shards in parallel using Plasma.CloseContext
+func (ss *ShardedStore) CloseContext(ctx context.Context) error {
+	return ss.forEach(func(i int, s *Plasma) error {
+		return s.CloseContext(ctx)
+	})
+}
+
+// Destroy closes the shards and removes the store from disk
+func (ss *ShardedStore) Destroy() error {
+	if err := ss.forEach(func(i int, s *Plasma) error {
+		return s.Destroy()
+	}); err != nil {
+		return err
+	}
+
+	if err := os.Remove(filepath.Join(ss.dir, shardsMetaFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return os.Remove(ss.dir)
+}
+
+func (ss *ShardedStore) PersistAll() {
+	ss.forEach(func(i int, s *Plasma) error {
+		s.PersistAll()
+		return nil
+	})
+}
+
+// forEach runs fn for every shard in parallel and returns the first error
+func (ss *ShardedStore) forEach(fn func(i int, s *Plasma) error) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(ss.shards))
+	for i, s := range ss.shards {
+		wg.Add(1)
+		go func(i int, s *Plasma) {
+			defer wg.Done()
+			errs[i] = fn(i, s)
+		}(i, s)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ss *ShardedStore) NewWriter() *ShardedWriter {
+	w := &ShardedWriter{
+		ss: ss,
+		ws: make([]*Writer, len(ss.shards)),
+	}
+
+	for i, s := range ss.shards {
+		w.ws[i] = s.NewWriter()
+	}
+
+	return w
+}
+
+func (w *ShardedWriter) InsertKV(k, v []byte) error {
+	w.ss.RLock()
+	defer w.ss.RUnlock()
+	return w.ws[w.ss.ShardOf(k)].InsertKV(k, v)
+}
+
+func (w *ShardedWriter) DeleteKV(k []byte) error {
+	w.ss.RLock()
+	defer w.ss.RUnlock()
+	return w.ws[w.ss.ShardOf(k)].DeleteKV(k)
+}
+
+func (w *ShardedWriter) LookupKV(k []byte) ([]byte, error) {
+	return w.ws[w.ss.ShardOf(k)].LookupKV(k)
+}
+
+// Close releases the writers of the shards
+func (w *ShardedWriter) Close() {
+	for _, sw := range w.ws {
+		sw.Close()
+	}
+}
+
+// ItemsCount returns the number of items across the shards
+func (ss *ShardedStore) ItemsCount() int64 {
+	var count int64
+	for _, s := range ss.shards {
+		count += s.ItemsCount()
+	}
+
+	return count
+}
+
+// GetStats returns the stats of the shards combined
+func (ss *ShardedStore) GetStats() Stats {
+	return ss.combineStats((*Plasma).GetStats)
+}
+
+// GetCumulativeStats returns the combined stats of the shards with the
+// cumulative counters started when they were opened regardless of
+// ResetStats
+func (ss *ShardedStore) GetCumulativeStats() Stats {
+	return ss.combineStats((*Plasma).GetCumulativeStats)
+}
+
+func (ss *ShardedStore) combineStats(getStats func(*Plasma) Stats) Stats {
+	var sts Stats
+	var globalQuota bool
+	for _, s := range ss.shards {
+		o := getStats(s)
+		sts.Merge(&o)
+
+		// Shards without a quota of their own share the process wide one,
+		// which is only counted once
+		if atomic.LoadInt64(&s.Config.MemQuota) > 0 {
+			sts.MemQuota += o.MemQuota
+		} else {
+			globalQuota = true
+		}
+
+		sts.ExpiredItems += o.ExpiredItems
+		sts.FilteredItems += o.FilteredItems
+		sts.BytesWritten += o.BytesWritten
+		sts.FlushDataSz += o.FlushDataSz
+		sts.MemSz += o.MemSz
+		sts.MemSzIndex += o.MemSzIndex
+		sts.PinnedSz += o.PinnedSz
+		sts.CompressedSz += o.CompressedSz
+		sts.NumPages += o.NumPages
+		sts.LSSDataSize += o.LSSDataSize
+		sts.LSSUsedSpace += o.LSSUsedSpace
+		sts.LSSQuota += o.LSSQuota
+		sts.LSSHeadroom += o.LSSHeadroom
+		sts.NumLSSCleanerReads += o.NumLSSCleanerReads
+		sts.LSSCleanerReadBytes += o.LSSCleanerReadBytes
+		sts.VLogUsedSpace += o.VLogUsedSpace
+
+		sts.LSSStalls.ReserveStalls += o.LSSStalls.ReserveStalls
+		sts.LSSStalls.ReserveStallTime += o.LSSStalls.ReserveStallTime
+		sts.LSSStalls.TrimStalls += o.LSSStalls.TrimStalls
+		sts.LSSStalls.TrimStallTime += o.LSSStalls.TrimStallTime
+		sts.LSSStalls.SyncStalls += o.LSSStalls.SyncStalls
+		sts.LSSStalls.SyncStallTime += o.LSSStalls.SyncStallTime
+	}
+
+	if globalQuota {
+		sts.MemQuota += atomic.LoadInt64(&memQuota)
+	}
+
+	data, used := sts.LSSDataSize, sts.LSSUsedSpace
+	if used > 0 && data > 0 && data < used {
+		sts.LSSFrag = int((used - data) * 100 / used)
+	}
+
+	if sts.BytesIncoming > 0 {
+		sts.WriteAmpAvg = float64(sts.BytesWritten) / float64(sts.BytesIncoming)
+	}
+
+	if tot := sts.CacheHits + sts.CacheMisses; tot > 0 {
+		sts.CacheHitRatio = float64(sts.CacheHits) / float64(tot)
+	}
+
+	cachedRecs := sts.NumRecordAllocs - sts.NumRecordFrees
+	lssRecs := sts.NumRecordSwapOut - sts.NumRecordSwapIn
+	if totalRecs := cachedRecs + lssRecs; totalRecs > 0 {
+		sts.ResidentRatio = float64(cachedRecs) / float64(totalRecs)
+	}
+
+	return sts
+}
+
+// GetStatsDelta returns the change in the combined stats since prev was
+// returned by GetStats
+func (ss *ShardedStore) GetStatsDelta(prev Stats) Stats {
+	sts := ss.GetStats()
+	sts.sub(&prev)
+	if tot := sts.CacheHits + sts.CacheMisses; tot > 0 {
+		sts.CacheHitRatio = float64(sts.CacheHits) / float64(tot)
+	}
+
+	return sts
+}
+
+// ResetStats resets the cumulative counters of every shard
+func (ss *ShardedStore) ResetStats() {
+	for _, s := range ss.shards {
+		s.ResetStats()
+	}
+}
+
+// NewSnapshot takes a snapshot of every shard. Writers are blocked while
+// the snapshots are taken, so that they reflect the same point in time.
+func (ss *ShardedStore) NewSnapshot() *ShardedSnapshot {
+	ss.Lock()
+	defer ss.Unlock()
+
+	snap := &ShardedSnapshot{snaps: make([]*Snapshot, len(ss.shards))}
+	for i, s := range ss.shards {
+		snap.snaps[i] = s.NewSnapshot()
+	}
+
+	return snap
+}
+
+// Shard returns the snapshot of a shard
+func (snap *ShardedSnapshot) Shard(i int) *Snapshot {
+	return snap.snaps[i]
+}
+
+func (snap *ShardedSnapshot) Count() int64 {
+	var count int64
+	for _, sn := range snap.snaps {
+		count += sn.Count()
+	}
+
+	return count
+}
+
+func (snap *ShardedSnapshot) Close() {
+	for _, sn := range snap.snaps {
+		sn.Close()
+	}
+}
+
+// CreateRecoveryPoint creates a recovery point with the given name on every
+// shard. The recovery points are removed from all the shards if any of them
+// cannot be created. The snapshot is consumed.
+func (ss *ShardedStore) CreateRecoveryPoint(snap *ShardedSnapshot, name string, meta []byte) error {
+	if name == "" {
+		snap.Close()
+		return ErrUnnamedRecoveryPoint
+	}
+
+	for _, s := range ss.shards {
+		if _, err := s.LookupRecoveryPoint(name); err == nil {
+			snap.Close()
+			return ErrRecoveryPointExists
+		}
+	}
+
+	err := ss.forEach(func(i int, s *Plasma) error {
+		return s.CreateNamedRecoveryPoint(snap.snaps[i], name, meta)
+	})
+
+	if err != nil {
+		ss.RemoveRecoveryPoint(name)
+	}
+
+	return err
+}
+
+// ListRecoveryPoints returns the names of the recovery points which exist
+// on all the shards in the order of their creation
+func (ss *ShardedStore) ListRecoveryPoints() []string {
+	var names []string
+	for _, rp := range ss.shards[0].ListRecoveryPoints() {
+		if ss.hasRecoveryPoint(rp.name) {
+			names = append(names, rp.name)
+		}
+	}
+
+	return names
+}
+
+func (ss *ShardedStore) hasRecoveryPoint(name string) bool {
+	for _, s := range ss.shards {
+		if _, err := s.LookupRecoveryPoint(name); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// RemoveRecoveryPoint removes a recovery point from the shards
+func (ss *ShardedStore) RemoveRecoveryPoint(name string) {
+	for _, s := range ss.shards {
+		if rp, err := s.LookupRecoveryPoint(name); err == nil {
+			s.RemoveRecoveryPoint(rp)
+		}
+	}
+}
+
+// Rollback rolls back every shard to the named recovery point. Writers are
+// blocked during the rollback.
+func (ss *ShardedStore) Rollback(name string) (*ShardedSnapshot, error) {
+	ss.Lock()
+	defer ss.Unlock()
+
+	if !ss.hasRecoveryPoint(name) {
+		return nil, ErrRecoveryPointNotFound
+	}
+
+	snap := &ShardedSnapshot{snaps: make([]*Snapshot, len(ss.shards))}
+	err := ss.forEach(func(i int, s *Plasma) error {
+		rp, err := s.LookupRecoveryPoint(name)
+		if err == nil {
+			snap.snaps[i], err = s.Rollback(rp)
+		}
+		return err
+	})
+
+	if err != nil {
+		for _, sn := range snap.snaps {
+			if sn != nil {
+				sn.Close()
+			}
+		}
+		return nil, err
+	}
+
+	return snap, nil
+}
@@ -0,0 +1,96 @@
+package plasma
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestShardedStore(t *testing.T) {
+	os.RemoveAll("teststore.shards")
+	defer os.RemoveAll("teststore.shards")
+
+	ss, err := NewShardedStore("teststore.shards", 4, testSnCfg, HashPartition)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := 10000
+	w := ss.NewWriter()
+	for i := 0; i < n; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte(fmt.Sprintf("val-%10d", i)))
+	}
+
+	for i := 0; i < ss.NumShards(); i++ {
+		if c := ss.Shard(i).NewSnapshot().Count(); c == 0 || c == int64(n) {
+			t.Errorf("expected keys to be spread across shards, got %d in shard %d", c, i)
+		}
+	}
+
+	snap := ss.NewSnapshot()
+	if c := snap.Count(); c != int64(n) {
+		t.Errorf("expected %d items, got %d", n, c)
+	}
+
+	if err := ss.CreateRecoveryPoint(snap, "rp-1", []byte("meta")); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < n; i++ {
+		w.DeleteKV([]byte(fmt.Sprintf("key-%10d", i)))
+	}
+
+	// Deletes are inserted as delete markers
+	if sts := ss.GetStats(); sts.Inserts != int64(2*n) {
+		t.Errorf("expected %d inserts, got %d", 2*n, sts.Inserts)
+	}
+
+	if err := ss.CreateRecoveryPoint(ss.NewSnapshot(), "rp-1", nil); err != ErrRecoveryPointExists {
+		t.Errorf("expected %v, got %v", ErrRecoveryPointExists, err)
+	}
+
+	if rps := ss.ListRecoveryPoints(); len(rps) != 1 || rps[0] != "rp-1" {
+		t.Fatalf("unexpected recovery points %v", rps)
+	}
+
+	rsnap, err := ss.Rollback("rp-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsnap.Close()
+
+	for i := 0; i < n; i++ {
+		if v, err := w.LookupKV([]byte(fmt.Sprintf("key-%10d", i))); err != nil || string(v) != fmt.Sprintf("val-%10d", i) {
+			t.Fatalf("expected val-%10d, got %s (%v)", i, v, err)
+		}
+	}
+
+	ss.PersistAll()
+	ss.Close()
+
+	if _, err := NewShardedStore("teststore.shards", 3, testSnCfg, HashPartition); err != ErrShardCount {
+		t.Errorf("expected %v, got %v", ErrShardCount, err)
+	}
+
+	ss, err = NewShardedStore("teststore.shards", 4, testSnCfg, HashPartition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Close()
+
+	w = ss.NewWriter()
+	for i := 0; i < n; i++ {
+		if _, err := w.LookupKV([]byte(fmt.Sprintf("key-%10d", i))); err != nil {
+			t.Fatalf("expected key-%10d after recovery (%v)", i, err)
+		}
+	}
+}
+
+func TestShardedStoreKeyRangePartition(t *testing.T) {
+	partition := KeyRangePartition([][]byte{[]byte("b"), []byte("d")})
+	for k, shard := range map[string]int{"a": 0, "b": 1, "c": 1, "d": 2, "z": 2} {
+		if i := partition([]byte(k), 3); i != shard {
+			t.Errorf("expected %s in shard %d, got %d", k, shard, i)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package plasma
+
+import (
+	"time"
+)
+
+// opTimer tracks an index operation for slow operation logging
+type opTimer struct {
+	start time.Time
+	nr    int64
+}
+
+func (s *Plasma) startOp(ctx *wCtx) opTimer {
+	if s.SlowOpThreshold <= 0 {
+		return opTimer{}
+	}
+
+	return opTimer{start: time.Now(), nr: ctx.sts.NumLSSReads}
+}
+
+// endOp logs the operation if it took longer than the slow operation
+// threshold along with the state of the page it operated upon
+func (s *Plasma) endOp(op string, t opTimer, pid PageId, pg Page, ctx *wCtx) {
+	if t.start.IsZero() {
+		return
+	}
+
+	if dur := time.Since(t.start); dur > s.SlowOpThreshold {
+		var chainLen int
+		if head := pg.(*page).head; head != nil {
+			chainLen = int(head.chainLen)
+		}
+
+		s.logger("slowop").Infof("%s took %v - page: %p, chain_len: %d, lss_reads: %d",
+			op, dur, pid, chainLen, ctx.sts.NumLSSReads-t.nr)
+	}
+}
+
+func (s *Plasma) endLSSRead(t opTimer, offset LSSOffset, numSegments int) {
+	if t.start.IsZero() {
+		return
+	}
+
+	if dur := time.Since(t.start); dur > s.SlowOpThreshold {
+		s.logger("slowop").Infof("lss read took %v - offset: %d, segments: %d",
+			dur, offset, numSegments)
+	}
+}
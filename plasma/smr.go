@@ -3,6 +3,8 @@ package plasma
 import (
 	"github.com/couchbase/nitro/skiplist"
 	"runtime"
+	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
@@ -11,6 +13,7 @@ type smrType int8
 const (
 	smrPage smrType = iota
 	smrPageId
+	smrLogFile
 )
 
 var (
@@ -29,13 +32,54 @@ type reclaimObject struct {
 type TxToken *skiplist.BarrierSession
 
 func (s *wCtx) BeginTx() TxToken {
-	s.safeOffset = s.lss.HeadOffset()
+	atomic.AddUint64(&s.txBegun, 1)
+	if s.shouldPersist {
+		s.safeOffset = s.lss.HeadOffset()
+	}
+	if s.vlog != nil {
+		s.vlogSafeOffset = s.vlog.HeadOffset()
+	}
 	return TxToken(s.Skiplist.GetAccesBarrier().Acquire())
 }
 
 func (s *wCtx) EndTx(t TxToken) {
 	s.safeOffset = expiredLSSOffset
+	s.vlogSafeOffset = expiredLSSOffset
 	s.Skiplist.GetAccesBarrier().Release(t)
+	atomic.AddUint64(&s.txEnded, 1)
+}
+
+// waitForTxs waits for the transactions in progress to end, so that the
+// pages they are reading cannot be changed under them. It gives up once
+// the timeout expires.
+func (s *Plasma) waitForTxs(self *wCtx, timeout time.Duration) bool {
+	type txState struct {
+		w     *wCtx
+		begun uint64
+	}
+
+	// Only the collection is done under the lock, which must not be held
+	// while waiting
+	var active []txState
+	s.wCtxLock.Lock()
+	for w := s.wCtxList; w != nil; w = w.next {
+		if begun := atomic.LoadUint64(&w.txBegun); w != self && atomic.LoadUint64(&w.txEnded) < begun {
+			active = append(active, txState{w: w, begun: begun})
+		}
+	}
+	s.wCtxLock.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	for _, tx := range active {
+		for atomic.LoadUint64(&tx.w.txEnded) < tx.begun {
+			if time.Now().After(deadline) {
+				return false
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	return true
 }
 
 func (s *Plasma) FreeObjects(lists [][]reclaimObject) {
@@ -50,26 +94,45 @@ func (s *Plasma) newBSDestroyCallback() skiplist.BarrierSessionDestructor {
 	}
 }
 
+// smrWorker reclaims the objects of the barrier sessions which have been
+// flushed until the instance is closed or ctx.stopSMR is closed
 func (s *Plasma) smrWorker(ctx *wCtx) {
-	for ptr := range s.smrChan {
-		reclaimSet := (*[][]reclaimObject)(ptr)
-		for _, reclaimList := range *reclaimSet {
-			for _, obj := range reclaimList {
-				switch obj.typ {
-				case smrPage:
-					s.destroyPg((*pageDelta)(obj.ptr))
-					ctx.sts.ReclaimSz += int64(obj.size)
-				case smrPageId:
-					s.FreePageId(PageId((*skiplist.Node)(obj.ptr)), ctx)
-					ctx.sts.ReclaimSzIndex += int64(obj.size)
-				default:
-					panic(obj.typ)
-				}
+	defer s.smrWg.Done()
+	if ctx.smrDone != nil {
+		defer close(ctx.smrDone)
+	}
+
+	for {
+		select {
+		case ptr, ok := <-s.smrChan:
+			if !ok {
+				return
 			}
+			s.reclaimObjects(ptr, ctx)
+		case <-ctx.stopSMR:
+			return
 		}
 	}
+}
 
-	s.smrWg.Done()
+func (s *Plasma) reclaimObjects(ptr unsafe.Pointer, ctx *wCtx) {
+	reclaimSet := (*[][]reclaimObject)(ptr)
+	for _, reclaimList := range *reclaimSet {
+		for _, obj := range reclaimList {
+			switch obj.typ {
+			case smrPage:
+				s.destroyPg((*pageDelta)(obj.ptr))
+				ctx.sts.ReclaimSz += int64(obj.size)
+			case smrPageId:
+				s.FreePageId(PageId((*skiplist.Node)(obj.ptr)), ctx)
+				ctx.sts.ReclaimSzIndex += int64(obj.size)
+			case smrLogFile:
+				(*(*func())(obj.ptr))()
+			default:
+				panic(obj.typ)
+			}
+		}
+	}
 }
 
 func (s *Plasma) destroyAllObjects() {
@@ -105,6 +168,23 @@ func (s *Plasma) destroyAllObjects() {
 	s.freeMM(unsafe.Pointer(tail))
 }
 
+// retireLogFile closes a file of the log which has been replaced, once the
+// operations which may still read it have ended. The access barrier is only
+// active with memory management, otherwise the transactions in progress are
+// waited for in the background.
+func (s *Plasma) retireLogFile(closeFn func()) {
+	if !s.useMemMgmt {
+		go func() {
+			for !s.waitForTxs(nil, time.Second) {
+			}
+			closeFn()
+		}()
+		return
+	}
+
+	s.FreeObjects([][]reclaimObject{{{typ: smrLogFile, ptr: unsafe.Pointer(&closeFn)}}})
+}
+
 func (s *Plasma) trySMRObjects(ctx *wCtx, numObjects int) {
 	if len(ctx.reclaimList) > numObjects {
 		s.FreeObjects([][]reclaimObject{ctx.reclaimList})
@@ -114,12 +194,36 @@ func (s *Plasma) trySMRObjects(ctx *wCtx, numObjects int) {
 
 func (s *Plasma) findSafeLSSTrimOffset() LSSOffset {
 	minOffset := s.lss.HeadOffset()
+	s.wCtxLock.Lock()
 	for w := s.wCtxList; w != nil; w = w.next {
 		off := w.safeOffset
 		if off < expiredLSSOffset && off < minOffset {
 			minOffset = off
 		}
 	}
+	s.wCtxLock.Unlock()
+
+	if off := s.lssPinOffset(); off < minOffset {
+		minOffset = off
+	}
+
+	return minOffset
+}
+
+// lssPinOffset returns the offset from which the blocks of the log have to
+// remain readable irrespective of the pages they belong to
+func (s *Plasma) lssPinOffset() LSSOffset {
+	// Blocks referenced by the last checkpoint must remain readable
+	minOffset := LSSOffset(atomic.LoadUint64(&s.ckptPinOffset))
+
+	// Blocks which are yet to be shipped to the replicas
+	s.tailLock.Lock()
+	for t := range s.tailers {
+		if off := LSSOffset(atomic.LoadUint64(&t.offset)); off < minOffset {
+			minOffset = off
+		}
+	}
+	s.tailLock.Unlock()
 
 	return minOffset
 }
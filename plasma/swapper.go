@@ -58,13 +58,13 @@ func (s *Plasma) sweepClock(h *clockHandle) []PageId {
 
 func (s *Plasma) tryEvictPages(ctx *wCtx) {
 	sctx := ctx.SwapperContext()
-	for s.TriggerSwapper(sctx) {
+	for s.needsSwap(sctx) && !s.isClosed() && s.failed() == nil {
 		h := s.acquireClockHandle()
 		tok := ctx.BeginTx()
 		pids := s.sweepClock(h)
 		s.releaseClockHandle(h)
-		for _, pid := range pids {
-			if s.canEvict(pid) {
+		for _, pid := range s.EvictionPolicy.PickVictims(pids) {
+			if !s.isPagePinned(pid, ctx) {
 				s.Persist(pid, true, ctx)
 			}
 		}
@@ -98,8 +98,9 @@ func (s *Plasma) swapperDaemon() {
 				default:
 				}
 
-				if s.TriggerSwapper(sctx) {
+				if s.failed() == nil && s.needsSwap(sctx) && s.beginMaintenance() {
 					s.tryEvictPages(s.evictWriters[i])
+					s.endMaintenance()
 					s.trySMRObjects(s.evictWriters[i], swapperSMRInterval)
 				} else {
 					time.Sleep(swapperWaitInterval)
@@ -124,15 +125,22 @@ func QuotaSwapper(ctx SwapperContext) bool {
 	return MemoryInUse2(ctx) >= int64(float64(atomic.LoadInt64(&memQuota)))
 }
 
-func (s *Plasma) canEvict(pid PageId) bool {
-	ok := true
-	n := pid.(*skiplist.Node)
-	ok = n.Cache == 0
-	n.Cache = 0
+// needsSwap reports whether the instance is over its own memory quota or
+// the swapper trigger reports pressure across all instances
+func (s *Plasma) needsSwap(ctx SwapperContext) bool {
+	if quota := atomic.LoadInt64(&s.Config.MemQuota); quota > 0 &&
+		s.MemoryInUse() >= quota {
+		return true
+	}
+
+	return s.TriggerSwapper(ctx)
+}
 
-	return ok
+// SetMemoryQuota updates the memory quota of the instance
+func (s *Plasma) SetMemoryQuota(m int64) {
+	atomic.StoreInt64(&s.Config.MemQuota, m)
 }
 
 func (s *Plasma) updateCacheMeta(pid PageId) {
-	pid.(*skiplist.Node).Cache = 1
+	s.EvictionPolicy.Touch(pid)
 }
@@ -0,0 +1,343 @@
+package plasma
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Segments are fetched from the tier and cached in chunks of this size
+const tierChunkSize = 1024 * 1024
+
+// The local file of a segment moved to the tier is replaced by an empty
+// marker file
+var segTierNameFormat = "log.%014d.remote"
+var segTierPattern = "log.*.remote"
+var segTierIdPattern = "log.%d.remote"
+
+// BlobStore stores the cold segments of the LSS moved out by tiering.
+// Blobs are written once and read back in ranges. A store must not be
+// shared by instances.
+type BlobStore interface {
+	// Put stores the size bytes read from r as the named blob
+	Put(name string, r io.Reader, size int64) error
+	// Get fills the buffer with the bytes of the blob at the offset
+	Get(name string, bs []byte, off int64) error
+	// Delete removes the blob
+	Delete(name string) error
+}
+
+// dirBlobStore keeps blobs as the files of a directory
+type dirBlobStore struct {
+	dir string
+
+	sync.Mutex
+	files map[string]*os.File
+}
+
+// NewDirBlobStore returns a BlobStore which keeps the blobs as files of
+// dir, e.g. on a slower and cheaper disk than the one of the LSS
+func NewDirBlobStore(dir string) BlobStore {
+	return &dirBlobStore{
+		dir:   dir,
+		files: make(map[string]*os.File),
+	}
+}
+
+func (d *dirBlobStore) Put(name string, r io.Reader, size int64) error {
+	if err := os.MkdirAll(d.dir, 0755); err != nil {
+		return err
+	}
+
+	path := filepath.Join(d.dir, name)
+	fd, err := os.OpenFile(path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.CopyN(fd, r, size); err == nil {
+		err = fd.Sync()
+	}
+
+	fd.Close()
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	// The rename is only durable once the directory is synced
+	dir, err := os.Open(d.dir)
+	if err != nil {
+		return err
+	}
+
+	err = dir.Sync()
+	dir.Close()
+	return err
+}
+
+func (d *dirBlobStore) Get(name string, bs []byte, off int64) error {
+	d.Lock()
+	fd, ok := d.files[name]
+	if !ok {
+		var err error
+		if fd, err = os.Open(filepath.Join(d.dir, name)); err != nil {
+			d.Unlock()
+			return err
+		}
+		d.files[name] = fd
+	}
+	d.Unlock()
+
+	_, err := fd.ReadAt(bs, off)
+	return err
+}
+
+func (d *dirBlobStore) Delete(name string) error {
+	d.Lock()
+	if fd, ok := d.files[name]; ok {
+		fd.Close()
+		delete(d.files, name)
+	}
+	d.Unlock()
+
+	return os.Remove(filepath.Join(d.dir, name))
+}
+
+// logTier moves the cold segments of a multiFilelog to a BlobStore and
+// reads them back through a cache of chunks
+type logTier struct {
+	store BlobStore
+	// Number of the most recent segments which are kept locally
+	localSegments int
+	cache         *tierCache
+}
+
+func newLogTier(store BlobStore, localSegments int, cacheSize int64) *logTier {
+	if localSegments < 1 {
+		localSegments = 1
+	}
+
+	return &logTier{
+		store:         store,
+		localSegments: localSegments,
+		cache:         newTierCache(cacheSize),
+	}
+}
+
+// read fills bs with the bytes of segment id at the offset
+func (t *logTier) read(id int64, name string, bs []byte, off int64, segSize int64) error {
+	if t.cache.capacity == 0 {
+		return t.store.Get(name, bs, off)
+	}
+
+	for len(bs) > 0 {
+		key := tierChunkKey{seg: id, chunk: off / tierChunkSize}
+		data := t.cache.get(key)
+		if data == nil {
+			data = make([]byte, minInt64(tierChunkSize, segSize-key.chunk*tierChunkSize))
+			if err := t.store.Get(name, data, key.chunk*tierChunkSize); err != nil {
+				return err
+			}
+			t.cache.put(key, data)
+		}
+
+		n := copy(bs, data[off%tierChunkSize:])
+		bs, off = bs[n:], off+int64(n)
+	}
+
+	return nil
+}
+
+type tierChunkKey struct {
+	seg, chunk int64
+}
+
+type tierChunk struct {
+	key  tierChunkKey
+	data []byte
+}
+
+// tierCache is an LRU cache of the chunks read from the tier
+type tierCache struct {
+	sync.Mutex
+	capacity int64
+	size     int64
+	lru      *list.List
+	chunks   map[tierChunkKey]*list.Element
+}
+
+func newTierCache(capacity int64) *tierCache {
+	return &tierCache{
+		capacity: capacity,
+		lru:      list.New(),
+		chunks:   make(map[tierChunkKey]*list.Element),
+	}
+}
+
+func (c *tierCache) get(key tierChunkKey) []byte {
+	c.Lock()
+	defer c.Unlock()
+
+	if e, ok := c.chunks[key]; ok {
+		c.lru.MoveToFront(e)
+		return e.Value.(*tierChunk).data
+	}
+
+	return nil
+}
+
+func (c *tierCache) put(key tierChunkKey, data []byte) {
+	c.Lock()
+	defer c.Unlock()
+
+	if _, ok := c.chunks[key]; ok {
+		return
+	}
+
+	c.chunks[key] = c.lru.PushFront(&tierChunk{key: key, data: data})
+	c.size += int64(len(data))
+	for c.size > c.capacity && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+// evictSegment drops the chunks of a segment removed from the tier
+func (c *tierCache) evictSegment(id int64) {
+	c.Lock()
+	defer c.Unlock()
+
+	for e := c.lru.Front(); e != nil; {
+		next := e.Next()
+		if e.Value.(*tierChunk).key.seg == id {
+			c.remove(e)
+		}
+		e = next
+	}
+}
+
+func (c *tierCache) remove(e *list.Element) {
+	chunk := c.lru.Remove(e).(*tierChunk)
+	delete(c.chunks, chunk.key)
+	c.size -= int64(len(chunk.data))
+}
+
+func tierBlobName(id int64) string {
+	return fmt.Sprintf(segFileNameFormat, id)
+}
+
+func (l *multiFilelog) tierMarker(id int64) string {
+	return filepath.Join(l.basePath, fmt.Sprintf(segTierNameFormat, id))
+}
+
+// remoteSegments returns the ids of the segments moved to the tier
+func (l *multiFilelog) remoteSegments() map[int64]bool {
+	ids := make(map[int64]bool)
+	files, _ := filepath.Glob(filepath.Join(l.basePath, segTierPattern))
+	for _, f := range files {
+		var id int64
+		fmt.Sscanf(filepath.Base(f), segTierIdPattern, &id)
+		ids[id] = true
+	}
+
+	return ids
+}
+
+func (l *multiFilelog) readRemote(id int64, bs []byte, off int64) error {
+	if l.tier == nil {
+		return ErrNoLogTier
+	}
+
+	return l.tier.read(id, tierBlobName(id), bs, off, l.segmentSize)
+}
+
+// removeRemote removes a segment trimmed from the log from the tier
+func (l *multiFilelog) removeRemote(id int64) {
+	if l.tier != nil {
+		l.tier.cache.evictSegment(id)
+		l.tier.store.Delete(tierBlobName(id))
+	}
+
+	os.Remove(l.tierMarker(id))
+}
+
+// TierSegments moves the segments of the log to the tier, except for the
+// most recent ones which are kept locally. It returns the number of
+// segments moved. The local files of the moved segments may still be
+// read, hence they are closed by the function passed to retire.
+func (l *multiFilelog) TierSegments(retire func(func())) (int, error) {
+	if l.tier == nil || l.readOnly {
+		return 0, nil
+	}
+
+	var moved int
+	for {
+		idx := l.getIndex()
+		id := int64(-1)
+		for i := 0; i < len(idx.index)-l.tier.localSegments; i++ {
+			start := idx.startOffset + int64(i)*l.segmentSize
+			if !idx.index[i].remote && start+l.segmentSize > l.Head() {
+				id = start / l.segmentSize
+				break
+			}
+		}
+
+		if id < 0 {
+			return moved, nil
+		}
+
+		lf := idx.index[id-idx.startOffset/l.segmentSize]
+		r := io.NewSectionReader(lf.fd, 0, l.segmentSize)
+		if err := l.tier.store.Put(tierBlobName(id), r, l.segmentSize); err != nil {
+			return moved, err
+		}
+
+		marker, err := os.OpenFile(l.tierMarker(id), os.O_RDWR|os.O_CREATE, 0755)
+		if err == nil {
+			err = marker.Sync()
+			marker.Close()
+		}
+
+		if err != nil {
+			l.tier.store.Delete(tierBlobName(id))
+			return moved, err
+		}
+
+		if !l.replaceRemote(id) {
+			// The segment has been trimmed meanwhile
+			l.removeRemote(id)
+			continue
+		}
+
+		os.Remove(lf.fd.Name())
+		retire(func() { lf.Close() })
+		moved++
+	}
+}
+
+// replaceRemote replaces the local file of the segment in the index
+func (l *multiFilelog) replaceRemote(id int64) bool {
+	l.indexLock.Lock()
+	defer l.indexLock.Unlock()
+
+	idx := l.getIndex()
+	i := id - idx.startOffset/l.segmentSize
+	if i < 0 {
+		return false
+	}
+
+	newIdx := *idx
+	newIdx.index = append([]*logFile(nil), idx.index...)
+	newIdx.index[i] = &logFile{remote: true}
+	atomic.StorePointer((*unsafe.Pointer)(unsafe.Pointer(&l.index)), unsafe.Pointer(&newIdx))
+	return true
+}
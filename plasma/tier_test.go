@@ -0,0 +1,123 @@
+package plasma
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var tierTestDataPath = "/tmp/logtier"
+
+func TestLogTier(t *testing.T) {
+	os.RemoveAll(logTestDataPath)
+	os.RemoveAll(tierTestDataPath)
+	defer os.RemoveAll(tierTestDataPath)
+
+	segSize := int64(1024 * 1024)
+	tier := newLogTier(NewDirBlobStore(tierTestDataPath), 2, 2*tierChunkSize)
+	log, _ := newLog(logTestDataPath, segSize, false, false, false, IOEngineSync, tier)
+	l := log.(*multiFilelog)
+
+	bs := make([]byte, 973)
+	n := 6 * 1024
+	for i := 0; i < n; i++ {
+		copy(bs, []byte(fmt.Sprintf("hello %05d", i)))
+		l.Append(bs)
+	}
+	l.Commit()
+
+	verify := func(l Log) {
+		bs2 := make([]byte, 973)
+		for i := 0; i < n; i++ {
+			copy(bs, []byte(fmt.Sprintf("hello %05d", i)))
+			if err := l.Read(bs2, int64(i*973)); err != nil || !bytes.Equal(bs, bs2) {
+				t.Fatalf("Got invalid item for %d (err=%v)", i, err)
+			}
+		}
+	}
+
+	// The last two of the six segments are kept locally
+	if moved, err := l.TierSegments(func(fn func()) { fn() }); err != nil || moved != 4 {
+		t.Fatalf("expected 4 segments to be moved, got %d (err=%v)", moved, err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(logTestDataPath, segFilePattern))
+	blobs, _ := filepath.Glob(filepath.Join(tierTestDataPath, segFilePattern))
+	if len(files) != 2 || len(blobs) != 4 {
+		t.Errorf("expected 2 local and 4 remote segments, got %d and %d", len(files), len(blobs))
+	}
+
+	if err := l.WriteAt(bs, 0); err != ErrLogSegmentTiered {
+		t.Errorf("expected write to a remote segment to fail, got %v", err)
+	}
+
+	verify(l)
+	l.Close()
+
+	// Remote segments are only readable through the tier
+	log, _ = newLog(logTestDataPath, segSize, false, false, false, IOEngineSync, nil)
+	if err := log.Read(bs, 0); err != ErrNoLogTier {
+		t.Errorf("expected %v, got %v", ErrNoLogTier, err)
+	}
+	log.Close()
+
+	log, _ = newLog(logTestDataPath, segSize, false, false, false, IOEngineSync, tier)
+	verify(log)
+
+	log.Trim(3 * segSize)
+	log.Commit()
+	blobs, _ = filepath.Glob(filepath.Join(tierTestDataPath, segFilePattern))
+	markers, _ := filepath.Glob(filepath.Join(logTestDataPath, segTierPattern))
+	if len(blobs) != 1 || len(markers) != 1 {
+		t.Errorf("expected trimmed segments to be removed from the tier, got %d", len(blobs))
+	}
+	log.Close()
+}
+
+func TestPlasmaTier(t *testing.T) {
+	os.RemoveAll("teststore.tier")
+	os.RemoveAll(tierTestDataPath)
+	defer os.RemoveAll("teststore.tier")
+	defer os.RemoveAll(tierTestDataPath)
+
+	cfg := testSnCfg
+	cfg.File = "teststore.tier"
+	cfg.AutoLSSCleaning = false
+	cfg.LSSLogSegmentSize = 4 * 1024 * 1024
+	cfg.TierDir = tierTestDataPath
+	cfg.TierLocalSegments = 1
+	cfg.TierCacheSize = 8 * 1024 * 1024
+	s := newTestIntPlasmaStore(cfg)
+
+	n := 100000
+	w := s.NewWriter()
+	for i := 0; i < n; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), []byte(fmt.Sprintf("val-%100d", i)))
+	}
+	s.PersistAll()
+
+	moved, err := s.lss.TierSegments(s.retireLogFile)
+	if err != nil || moved == 0 {
+		t.Fatalf("expected segments to be moved, got %d (err=%v)", moved, err)
+	}
+
+	lookup := func() {
+		w := s.NewWriter()
+		for i := 0; i < n; i++ {
+			k := fmt.Sprintf("key-%10d", i)
+			if v, err := w.LookupKV([]byte(k)); err != nil || string(v) != fmt.Sprintf("val-%100d", i) {
+				t.Fatalf("%s: unexpected value %q (err=%v)", k, v, err)
+			}
+		}
+	}
+
+	s.EvictAll(0)
+	lookup()
+	s.Close()
+
+	s = newTestIntPlasmaStore(cfg)
+	defer s.Close()
+	lookup()
+}
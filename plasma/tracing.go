@@ -0,0 +1,39 @@
+package plasma
+
+// Span names used for the operations reported to the tracer
+const (
+	SpanFetchPage = "plasma.fetch_page"
+	SpanCompact   = "plasma.compact"
+	SpanSplit     = "plasma.split"
+	SpanMerge     = "plasma.merge"
+	SpanLSSClean  = "plasma.lss_clean"
+	SpanRecovery  = "plasma.recovery"
+)
+
+// Tracer creates spans for operations which may stall index operations,
+// such as page reads from the LSS, page structure modifications, LSS
+// cleaner passes and recovery. It can be implemented on top of
+// OpenTelemetry or any other tracing system.
+type Tracer interface {
+	StartSpan(name string) Span
+}
+
+// Span is a traced operation
+type Span interface {
+	SetAttribute(key string, value interface{})
+	End(err error)
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(string, interface{}) {}
+
+func (noopSpan) End(error) {}
+
+func (s *Plasma) startSpan(name string) Span {
+	if s.Tracer == nil {
+		return noopSpan{}
+	}
+
+	return s.Tracer.StartSpan(name)
+}
@@ -0,0 +1,88 @@
+package plasma
+
+import (
+	"github.com/couchbase/nitro/skiplist"
+	"os"
+	"sync"
+	"testing"
+)
+
+type testTracer struct {
+	sync.Mutex
+	spans map[string]int
+	errs  int
+}
+
+type testSpan struct {
+	t     *testTracer
+	name  string
+	attrs map[string]interface{}
+}
+
+func (t *testTracer) StartSpan(name string) Span {
+	return &testSpan{t: t, name: name, attrs: make(map[string]interface{})}
+}
+
+func (sp *testSpan) SetAttribute(key string, value interface{}) {
+	sp.attrs[key] = value
+}
+
+func (sp *testSpan) End(err error) {
+	sp.t.Lock()
+	defer sp.t.Unlock()
+	sp.t.spans[sp.name]++
+	if err != nil {
+		sp.t.errs++
+	}
+}
+
+func (t *testTracer) count(name string) int {
+	t.Lock()
+	defer t.Unlock()
+	return t.spans[name]
+}
+
+func TestPlasmaTracer(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	tracer := &testTracer{spans: make(map[string]int)}
+	cfg := testCfg
+	cfg.Tracer = tracer
+	s := newTestIntPlasmaStore(cfg)
+	w := s.NewWriter()
+
+	n := 20000
+	for i := 0; i < n; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+	for i := 0; i < n/2; i++ {
+		w.Delete(skiplist.NewIntKeyItem(i))
+	}
+	s.PersistAll()
+	s.EvictAll(0)
+
+	for i := n / 2; i < n; i++ {
+		itm := skiplist.NewIntKeyItem(i)
+		if got, _ := w.Lookup(itm); skiplist.CompareInt(itm, got) != 0 {
+			t.Fatalf("mismatch %d", i)
+		}
+	}
+
+	if err := s.CleanLSS(func() bool { return true }); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s = newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	for _, name := range []string{SpanFetchPage, SpanCompact, SpanSplit,
+		SpanMerge, SpanLSSClean, SpanRecovery} {
+		if tracer.count(name) == 0 {
+			t.Errorf("expected %s spans", name)
+		}
+	}
+
+	if tracer.errs != 0 {
+		t.Errorf("expected no failed spans, got %d", tracer.errs)
+	}
+}
@@ -43,6 +43,29 @@ func (s *pageItemSorter) Swap(i, j int) {
 	s.itms[i], s.itms[j] = s.itms[j], s.itms[i]
 }
 
+func ptrBytes(ptr unsafe.Pointer, sz int) (bs []byte) {
+	hdr := (*reflect.SliceHeader)(unsafe.Pointer(&bs))
+	hdr.Len = sz
+	hdr.Cap = sz
+	hdr.Data = uintptr(ptr)
+	return
+}
+
+func commonPrefixLen(a, b []byte) int {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+
+	return n
+}
+
 func minInt64(a, b int64) int64 {
 	if a < b {
 		return a
@@ -50,3 +73,17 @@ func minInt64(a, b int64) int64 {
 
 	return b
 }
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+
+	return b
+}
+
+func memclr(bs []byte) {
+	for i := range bs {
+		bs[i] = 0
+	}
+}
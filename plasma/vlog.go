@@ -0,0 +1,404 @@
+package plasma
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// Key/value separation
+//
+// Values of at least Config.ValueLogThreshold bytes are written to a
+// separate log store, the value log, and the page items only hold the
+// offset and length of the value. This keeps the pages small for workloads
+// with large values, so that page flushes, compactions, splits and merges
+// copy far less data.
+//
+// Every block of the value log holds a value prefixed by its key
+// [16 bit block type][32 bit keylen][key][value]
+//
+// Values which do not fit into a block are split into chunks written as
+// separate blocks. The item holds the offset and length of every chunk and
+// the value is reassembled when it is read. Values of items which would not
+// fit into a page are always stored this way, irrespective of the
+// threshold.
+//
+// The value log is cleaned by moving the values which are still referenced
+// to its tail and trimming its head. A value is live if any version of the
+// item in the page of its key points to it. Pages retain every version
+// needed by snapshots and recovery points, so those are honored as well.
+// The head is only trimmed once the pages pointing to the moved values have
+// been persisted and the readers which could have seen the old pointers are
+// done.
+
+const valueLogDir = "vlog"
+
+var (
+	vlogBlockHdrSize   = lssBlockTypeSize + 4
+	vlogCleanerMinSize = int64(lssReclaimBlockSize)
+	vlogCleanerSMR     = 20
+)
+
+func (s *Plasma) openValueLog(commitDur time.Duration) (err error) {
+	path := filepath.Join(s.File, valueLogDir)
+	if s.ValueLogThreshold == 0 && s.MaxItemSize <= maxInlineKVSize {
+		if _, err := os.Stat(path); err != nil {
+			return nil
+		}
+	}
+
+	s.vlog, err = newLSStore(path, s.LSSLogSegmentSize, s.FlushBufferSize, 2,
+		s.UseMmap, commitDur, s.lssOptions("vlog"))
+	if err != nil {
+		return err
+	}
+
+	if !s.readOnly {
+		s.vlog.SetSafeTrimCallback(s.findSafeVLogTrimOffset)
+		s.lss.SetPreCommitCallback(func() {
+			// Values have to be durable before the pages pointing to them
+			s.vlog.Sync(true)
+		})
+	}
+
+	atomic.StoreInt64(&s.vlogBaseSize, s.vlog.UsedSpace())
+	return nil
+}
+
+// A block has to fit into a flush buffer and into the page buffer used by
+// the cleaner to read it back
+func (s *Plasma) maxValueBlockSize() int {
+	maxSz := s.FlushBufferSize - maxHeaderFBSize
+	if maxSz > maxPageEncodedSize {
+		maxSz = maxPageEncodedSize
+	}
+
+	return maxSz
+}
+
+func (s *Plasma) useValueLog(k, v []byte) bool {
+	if s.vlog == nil || s.readOnly {
+		return false
+	}
+
+	if s.ValueLogThreshold > 0 && len(v) >= s.ValueLogThreshold {
+		return true
+	}
+
+	return len(k)+len(v) > maxInlineKVSize
+}
+
+// newKVItem creates the item for a key value pair. The value is written to
+// the value log if it is large or if the item would not fit into a page.
+func (s *Plasma) newKVItem(k, v []byte, sn uint64, buf []byte) (*item, error) {
+	if len(k) > maxKeySize {
+		return nil, ErrKeyTooLarge
+	}
+
+	if sz := len(k) + len(v); sz > s.MaxItemSize {
+		return nil, &ItemSizeError{Size: sz, MaxSize: s.MaxItemSize}
+	}
+
+	if s.useValueLog(k, v) {
+		ptrs, err := s.writeValue(k, v)
+		if err != nil {
+			return nil, err
+		}
+
+		return s.newValuePtrItem(k, ptrs, sn, buf), nil
+	}
+
+	if len(k)+len(v) > maxInlineKVSize {
+		return nil, &ItemSizeError{Size: len(k) + len(v), MaxSize: maxInlineKVSize}
+	}
+
+	return s.newItem(k, v, sn, false, buf), nil
+}
+
+// writeValue writes the value to the value log in chunks of at most a block
+// each and returns the pointers to the chunks
+func (s *Plasma) writeValue(k, v []byte) ([]byte, error) {
+	chunkSz := s.maxValueBlockSize() - vlogBlockHdrSize - len(k)
+	if chunkSz <= 0 {
+		return nil, ErrKeyTooLarge
+	}
+
+	n := (len(v) + chunkSz - 1) / chunkSz
+	if len(k)+n*itmValPtrSize > maxInlineKVSize {
+		return nil, &ItemSizeError{Size: len(k) + len(v), MaxSize: s.MaxItemSize}
+	}
+
+	ptrs := make([]byte, 0, n*itmValPtrSize)
+	for len(v) > 0 {
+		chunk := v
+		if len(chunk) > chunkSz {
+			chunk = chunk[:chunkSz]
+		}
+
+		offset, wbuf, res := s.vlog.ReserveSpace(vlogBlockHdrSize + len(k) + len(chunk))
+		binary.BigEndian.PutUint16(wbuf[:lssBlockTypeSize], uint16(lssValue))
+		binary.BigEndian.PutUint32(wbuf[lssBlockTypeSize:vlogBlockHdrSize], uint32(len(k)))
+		copy(wbuf[vlogBlockHdrSize:], k)
+		copy(wbuf[vlogBlockHdrSize+len(k):], chunk)
+		s.vlog.FinalizeWrite(res)
+
+		ptrs = appendValuePtr(ptrs, offset, len(chunk))
+		v = v[len(chunk):]
+	}
+
+	return ptrs, nil
+}
+
+func (s *Plasma) writeValueBlock(bs []byte) LSSOffset {
+	offset, wbuf, res := s.vlog.ReserveSpace(len(bs))
+	copy(wbuf, bs)
+	s.vlog.FinalizeWrite(res)
+	return offset
+}
+
+func decodeValueBlock(bs []byte) (k, v []byte) {
+	klen := int(binary.BigEndian.Uint32(bs[lssBlockTypeSize:vlogBlockHdrSize]))
+	k = bs[vlogBlockHdrSize : vlogBlockHdrSize+klen]
+	v = bs[vlogBlockHdrSize+klen:]
+	return
+}
+
+// readValue returns the value of the item, which is read from the value log
+// and reassembled from its chunks if the item only holds pointers to it
+func (s *Plasma) readValue(itm *item) ([]byte, error) {
+	if !itm.IsValuePtr() {
+		return itm.Value(), nil
+	}
+
+	k := itm.Key()
+	n := itm.numValuePtrs()
+	if n == 1 {
+		off, l := itm.valuePtr(0)
+		return s.readValueChunk(k, off, l)
+	}
+
+	v := make([]byte, 0, itm.valueLen())
+	for i := 0; i < n; i++ {
+		off, l := itm.valuePtr(i)
+		chunk, err := s.readValueChunk(k, off, l)
+		if err != nil {
+			return nil, err
+		}
+		v = append(v, chunk...)
+	}
+
+	return v, nil
+}
+
+func (s *Plasma) readValueChunk(k []byte, off LSSOffset, vl int) ([]byte, error) {
+	if s.vlog == nil {
+		return nil, newLSSError("read value", off, ErrCorruptLog)
+	}
+
+	buf := make([]byte, vlogBlockHdrSize+len(k)+vl)
+	n, err := s.vlog.Read(off, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if n != len(buf) || getLSSBlockType(buf) != lssValue {
+		return nil, newLSSError("read value", off, ErrCorruptLog)
+	}
+
+	bk, v := decodeValueBlock(buf)
+	if !bytes.Equal(bk, k) {
+		return nil, newLSSError("read value", off, ErrCorruptLog)
+	}
+
+	return v, nil
+}
+
+// The head of the value log is not trimmed beyond the values which may be
+// read by an ongoing transaction or which are referenced by pages yet to be
+// persisted
+func (s *Plasma) findSafeVLogTrimOffset() LSSOffset {
+	minOffset := LSSOffset(atomic.LoadUint64(&s.vlogSafeOffset))
+	s.wCtxLock.Lock()
+	for w := s.wCtxList; w != nil; w = w.next {
+		if off := w.vlogSafeOffset; off < minOffset {
+			minOffset = off
+		}
+	}
+	s.wCtxLock.Unlock()
+
+	return minOffset
+}
+
+// Check whether any version of the item for key k points to the value
+// written at off
+func (s *Plasma) pageHasValue(pg Page, itm unsafe.Pointer, off LSSOffset, ctx *wCtx) bool {
+	var sts pgOpIteratorStats
+	pgi := pg.(*page)
+	it := newPgOpIterator(pgi.head, s.cmp, itm, pgi.head.hiItm, &nilFilter, ctx, &sts)
+	defer it.Close()
+
+	for it.Init(); it.Valid(); it.Next() {
+		x := (*item)(it.Get().Item())
+		if s.cmp(unsafe.Pointer(x), itm) != 0 {
+			break
+		}
+
+		for i := 0; x.IsValuePtr() && i < x.numValuePtrs(); i++ {
+			if o, _ := x.valuePtr(i); o == off {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Move a live value chunk to the tail of the value log and update the items
+// pointing to it. The page is compacted into a base page so that the
+// pointers can be updated in place before the page is published.
+func (s *Plasma) tryValueRelocation(off LSSOffset, bs []byte, ctx *wCtx) (bool, error) {
+	k, _ := decodeValueBlock(bs)
+	itm := unsafe.Pointer(s.newItem(k, nil, 0, false, ctx.GetBuffer(bufTempItem)))
+	newOff := expiredLSSOffset
+
+retry:
+	pid, pg, err := s.fetchPage(itm, ctx)
+	if err != nil {
+		return false, err
+	}
+
+	if !s.pageHasValue(pg, itm, off, ctx) {
+		return false, nil
+	}
+
+	staleOff, _ := pg.GetLastFlushOffset()
+	staleFdSz := pg.Compact()
+
+	var found bool
+	bp := (*basePage)(unsafe.Pointer(pg.(*page).head))
+	for _, ptr := range bp.items {
+		x := (*item)(ptr)
+		if !x.IsValuePtr() || !bytes.Equal(x.Key(), k) {
+			continue
+		}
+
+		for i := 0; i < x.numValuePtrs(); i++ {
+			if o, _ := x.valuePtr(i); o == off {
+				if newOff == expiredLSSOffset {
+					newOff = s.writeValueBlock(bs)
+				}
+				x.setValuePtr(i, newOff)
+				found = true
+			}
+		}
+	}
+
+	if !found {
+		allocs, _, _, _, _ := pg.GetAllocOps()
+		s.discardDeltas(allocs)
+		return false, nil
+	}
+
+	if !s.UpdateMapping(pid, pg, ctx) {
+		goto retry
+	}
+
+	ctx.sts.FlushDataSz -= int64(staleFdSz)
+	s.trackLSSUsage(staleOff, staleFdSz, 0, 0)
+	s.Persist(pid, false, ctx)
+	s.trySMRObjects(ctx, vlogCleanerSMR)
+	return true, nil
+}
+
+// CleanValueLog performs a cleaner pass over the value log, which continues
+// as long as proceed returns true. The pages updated by the pass are made
+// durable before the head of the value log can be trimmed.
+func (s *Plasma) CleanValueLog(proceed func() bool) error {
+	if s.vlog == nil {
+		return nil
+	}
+
+	if s.readOnly {
+		return ErrReadOnly
+	}
+
+	s.vlogCleanLock.Lock()
+	defer s.vlogCleanLock.Unlock()
+
+	w := s.vlogCleanerWriter
+	cleanerBuf := w.GetBuffer(bufCleaner)
+
+	relocated := 0
+	cleaned := LSSOffset(atomic.LoadUint64(&s.vlogSafeOffset))
+
+	callb := func(startOff, endOff LSSOffset, bs []byte) (bool, LSSOffset, error) {
+		if getLSSBlockType(bs) == lssValue {
+			tok := w.BeginTx()
+			ok, err := s.tryValueRelocation(startOff, bs, w)
+			w.EndTx(tok)
+			if err != nil {
+				return false, 0, err
+			}
+
+			if ok {
+				relocated++
+			}
+		}
+
+		cleaned = endOff
+		return proceed(), endOff, nil
+	}
+
+	used := s.vlog.UsedSpace()
+	s.logger("vlogCleaner").Infof("starting... used: %d log:(%d - %d)", used, s.vlog.HeadOffset(), s.vlog.TailOffset())
+	err := s.vlog.RunCleaner(callb, cleanerBuf)
+
+	s.lss.Sync(true)
+	atomic.StoreUint64(&s.vlogSafeOffset, uint64(cleaned))
+	s.trySMRObjects(w, 0)
+
+	// Let the trimmed head take effect
+	s.vlog.Sync(true)
+	used = s.vlog.UsedSpace()
+	atomic.StoreInt64(&s.vlogBaseSize, used)
+	s.logger("vlogCleaner").Infof("completed... used: %d, relocated: %d log:(%d - %d)", used, relocated, s.vlog.HeadOffset(), s.vlog.TailOffset())
+	return err
+}
+
+// The value log is cleaned once the share of it written since the last
+// pass exceeds the cleaner threshold
+func (s *Plasma) vlogNeedsCleaning() bool {
+	used := s.vlog.UsedSpace()
+	grown := used - atomic.LoadInt64(&s.vlogBaseSize)
+	return grown >= vlogCleanerMinSize &&
+		grown*100 >= used*int64(s.Config.ValueLogCleanerThreshold)
+}
+
+func (s *Plasma) vlogCleanerDaemon() {
+	proceed := func() bool {
+		return !s.isClosed() && !s.IsMaintenancePaused()
+	}
+
+loop:
+	for {
+		select {
+		case <-s.stopvlog:
+			s.stopvlog <- struct{}{}
+			break loop
+		default:
+		}
+
+		if !s.isClosed() && s.vlogNeedsCleaning() && s.beginMaintenance() {
+			if err := s.CleanValueLog(proceed); err != nil {
+				s.logger("vlogCleaner").Errorf("failed (err=%v)", err)
+			}
+			s.endMaintenance()
+		}
+
+		time.Sleep(time.Second)
+	}
+}
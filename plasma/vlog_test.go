@@ -0,0 +1,299 @@
+package plasma
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func vlogTestValue(i int, gen int) []byte {
+	prefix := []byte(fmt.Sprintf("val-%10d-%d-", i, gen))
+	return append(prefix, bytes.Repeat([]byte("x"), 2000)...)
+}
+
+func TestValueLogLookup(t *testing.T) {
+	os.RemoveAll("teststore.vlog")
+	defer os.RemoveAll("teststore.vlog")
+
+	cfg := testSnCfg
+	cfg.File = "teststore.vlog"
+	cfg.AutoLSSCleaning = false
+	cfg.ValueLogThreshold = 1024
+	s := newTestIntPlasmaStore(cfg)
+
+	n := 2000
+	w := s.NewWriter()
+	for i := 0; i < n; i++ {
+		k := []byte(fmt.Sprintf("key-%10d", i))
+		if i%2 == 0 {
+			w.InsertKV(k, vlogTestValue(i, 0))
+		} else {
+			w.InsertKV(k, []byte(fmt.Sprintf("val-%10d", i)))
+		}
+	}
+
+	if sts := s.GetStats(); sts.VLogUsedSpace == 0 {
+		t.Errorf("expected values in the value log, used space %d", sts.VLogUsedSpace)
+	}
+
+	check := func(s *Plasma) {
+		w := s.NewWriter()
+		for i := 0; i < n; i++ {
+			exp := []byte(fmt.Sprintf("val-%10d", i))
+			if i%2 == 0 {
+				exp = vlogTestValue(i, 0)
+			}
+
+			v, err := w.LookupKV([]byte(fmt.Sprintf("key-%10d", i)))
+			if err != nil || !bytes.Equal(v, exp) {
+				t.Fatalf("key %d: unexpected value (err=%v)", i, err)
+			}
+		}
+
+		snap := s.NewSnapshot()
+		itr := snap.NewIterator()
+		count := 0
+		for itr.SeekFirst(); itr.Valid(); itr.Next() {
+			v, err := itr.ReadValue()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if i := count; i%2 == 0 && !bytes.Equal(v, vlogTestValue(i, 0)) {
+				t.Fatalf("key %d: unexpected value %s", i, v)
+			}
+			count++
+		}
+		itr.Close()
+		snap.Close()
+
+		if count != n {
+			t.Errorf("expected %d items, got %d", n, count)
+		}
+	}
+
+	check(s)
+	s.PersistAll()
+	s.Close()
+
+	s = newTestIntPlasmaStore(cfg)
+	check(s)
+
+	if err := s.TailLog(0, nil); err != ErrValueLog {
+		t.Errorf("expected %v, got %v", ErrValueLog, err)
+	}
+
+	if err := s.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(cfg.File, valueLogDir)); !os.IsNotExist(err) {
+		t.Errorf("expected the value log to be removed (err=%v)", err)
+	}
+}
+
+func TestValueLogCleaner(t *testing.T) {
+	os.RemoveAll("teststore.vlog")
+	defer os.RemoveAll("teststore.vlog")
+
+	cfg := testSnCfg
+	cfg.File = "teststore.vlog"
+	cfg.AutoLSSCleaning = false
+	cfg.AutoSwapper = false
+	cfg.ValueLogThreshold = 1024
+	s := newTestIntPlasmaStore(cfg)
+
+	n := 2000
+	w := s.NewWriter()
+	for i := 0; i < n; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), vlogTestValue(i, 0))
+	}
+
+	snap1 := s.NewSnapshot()
+	for i := 0; i < n; i++ {
+		k := []byte(fmt.Sprintf("key-%10d", i))
+		w.DeleteKV(k)
+		w.InsertKV(k, vlogTestValue(i, 1))
+	}
+	s.NewSnapshot().Close()
+
+	// Both the versions are retained for the snapshot
+	if err := s.CleanValueLog(func() bool { return true }); err != nil {
+		t.Fatal(err)
+	}
+
+	itr := snap1.NewIterator()
+	i := 0
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		if v, err := itr.ReadValue(); err != nil || !bytes.Equal(v, vlogTestValue(i, 0)) {
+			t.Fatalf("key %d: unexpected snapshot value (err=%v)", i, err)
+		}
+		i++
+	}
+	itr.Close()
+	snap1.Close()
+
+	if i != n {
+		t.Errorf("expected %d items, got %d", n, i)
+	}
+
+	s.NewSnapshot().Close()
+	w.CompactAll()
+	before := s.GetStats().VLogUsedSpace
+	if err := s.CleanValueLog(func() bool { return true }); err != nil {
+		t.Fatal(err)
+	}
+
+	after := s.GetStats().VLogUsedSpace
+	if after >= before*3/4 {
+		t.Errorf("expected the value log to shrink, used space %d -> %d", before, after)
+	}
+
+	for i := 0; i < n; i++ {
+		v, err := w.LookupKV([]byte(fmt.Sprintf("key-%10d", i)))
+		if err != nil || !bytes.Equal(v, vlogTestValue(i, 1)) {
+			t.Fatalf("key %d: unexpected value (err=%v)", i, err)
+		}
+	}
+
+	s.Close()
+	s = newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	w = s.NewWriter()
+	for i := 0; i < n; i++ {
+		v, err := w.LookupKV([]byte(fmt.Sprintf("key-%10d", i)))
+		if err != nil || !bytes.Equal(v, vlogTestValue(i, 1)) {
+			t.Fatalf("key %d: unexpected value after recovery (err=%v)", i, err)
+		}
+	}
+}
+
+func TestValueLogOverflow(t *testing.T) {
+	os.RemoveAll("teststore.vlog")
+	defer os.RemoveAll("teststore.vlog")
+
+	cfg := testSnCfg
+	cfg.File = "teststore.vlog"
+	cfg.AutoLSSCleaning = false
+	cfg.AutoSwapper = false
+	cfg.MaxItemSize = 8 * 1024 * 1024
+	s := newTestIntPlasmaStore(cfg)
+
+	val := func(i int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("%10d", i)), 300*1024)
+	}
+
+	n := 10
+	w := s.NewWriter()
+	for i := 0; i < n; i++ {
+		if err := w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), val(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := w.InsertKV([]byte("key"), make([]byte, cfg.MaxItemSize))
+	var serr *ItemSizeError
+	if !errors.Is(err, ErrItemTooBig) || !errors.As(err, &serr) || serr.MaxSize != cfg.MaxItemSize {
+		t.Errorf("expected %v, got %v", ErrItemTooBig, err)
+	}
+
+	check := func(s *Plasma) {
+		w := s.NewWriter()
+		for i := 0; i < n; i++ {
+			v, err := w.LookupKV([]byte(fmt.Sprintf("key-%10d", i)))
+			if err != nil || !bytes.Equal(v, val(i)) {
+				t.Fatalf("key %d: unexpected value of %d bytes (err=%v)", i, len(v), err)
+			}
+		}
+
+		snap := s.NewSnapshot()
+		itr := snap.NewIterator()
+		i := 0
+		for itr.SeekFirst(); itr.Valid(); itr.Next() {
+			if !bytes.Equal(itr.Value(), val(i)) {
+				t.Fatalf("key %d: unexpected value", i)
+			}
+			i++
+		}
+		itr.Close()
+		snap.Close()
+	}
+
+	check(s)
+	if err := s.CleanValueLog(func() bool { return true }); err != nil {
+		t.Fatal(err)
+	}
+	check(s)
+
+	s.Close()
+	s = newTestIntPlasmaStore(cfg)
+	defer s.Close()
+	check(s)
+
+	// Items larger than a page need a value log
+	mcfg := testSnCfg
+	mcfg.File = ""
+	mcfg.MaxItemSize = cfg.MaxItemSize
+	if sz := applyConfigDefaults(mcfg).MaxItemSize; sz != maxInlineKVSize {
+		t.Errorf("expected max item size %d, got %d", maxInlineKVSize, sz)
+	}
+}
+
+func TestValueLogKeysOnlyIterator(t *testing.T) {
+	os.RemoveAll("teststore.vlog")
+	defer os.RemoveAll("teststore.vlog")
+
+	cfg := testSnCfg
+	cfg.File = "teststore.vlog"
+	cfg.AutoLSSCleaning = false
+	cfg.AutoSwapper = false
+	cfg.ValueLogThreshold = 1024
+	s := newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	n := 2000
+	w := s.NewWriter()
+	for i := 0; i < n; i++ {
+		w.InsertKV([]byte(fmt.Sprintf("key-%10d", i)), vlogTestValue(i, 0))
+	}
+	s.PersistAll()
+	s.EvictAll(0)
+
+	snap := s.NewSnapshot()
+	defer snap.Close()
+
+	swapins := s.GetStats().NumRecordSwapIn
+	itr := snap.NewIterator()
+	itr.SetKeysOnly(true)
+	count := 0
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		if k := fmt.Sprintf("key-%10d", count); string(itr.Key()) != k {
+			t.Fatalf("expected %s, got %s", k, itr.Key())
+		}
+
+		if v := itr.Value(); v != nil {
+			t.Fatalf("expected no value in the keys only mode, got %d bytes", len(v))
+		}
+		count++
+	}
+	itr.Close()
+
+	if count != n {
+		t.Errorf("expected %d items, got %d", n, count)
+	}
+
+	if sts := s.GetStats(); sts.NumRecordSwapIn != swapins {
+		t.Errorf("expected no records to be swapped in, got %d", sts.NumRecordSwapIn-swapins)
+	}
+
+	itr = snap.NewIterator()
+	itr.SeekFirst()
+	if v, err := itr.ReadValue(); err != nil || !bytes.Equal(v, vlogTestValue(0, 0)) {
+		t.Errorf("expected the value to be read (err=%v)", err)
+	}
+	itr.Close()
+}
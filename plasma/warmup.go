@@ -0,0 +1,165 @@
+package plasma
+
+import (
+	"errors"
+	"github.com/couchbase/nitro/skiplist"
+	"math"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+var errWarmupDone = errors.New("warmup done")
+
+type warmup struct {
+	*Plasma
+	need    int64
+	swapped int64
+}
+
+// Warmup swaps in evicted pages using concurr goroutines until the fraction
+// of the pages in memory reaches targetResidentRatio or the instance runs
+// short of memory. The pages recorded by the heat map of the instance,
+// see Config.RecordHeatMap, are swapped in first starting with the hottest
+// pages and regain their eviction policy state. The remaining pages are
+// swapped in in key order.
+func (s *Plasma) Warmup(targetResidentRatio float64, concurr int) error {
+	if concurr < 1 {
+		concurr = 1
+	}
+
+	ctxs := make([]*wCtx, concurr)
+	for i := range ctxs {
+		ctxs[i] = s.newWCtx()
+	}
+
+	defer func() {
+		for _, ctx := range ctxs {
+			s.retireWCtx(ctx)
+		}
+	}()
+
+	total, resident := s.countResidentPages(ctxs[0])
+	w := &warmup{
+		Plasma: s,
+		need:   int64(math.Ceil(targetResidentRatio*float64(total))) - resident,
+	}
+
+	if w.done(ctxs[0]) {
+		return nil
+	}
+
+	if err := w.swapinHeatMap(s.heatMapPages(), ctxs); err != nil {
+		return err
+	}
+
+	callb := func(pid PageId, partn RangePartition) error {
+		_, err := w.swapin(pid, ctxs[partn.Shard])
+		return err
+	}
+
+	if err := s.PageVisitor(callb, concurr); err != nil && err != errWarmupDone {
+		return err
+	}
+
+	return nil
+}
+
+func (w *warmup) done(ctx *wCtx) bool {
+	return atomic.LoadInt64(&w.swapped) >= w.need || w.isClosed() ||
+		w.needsSwap(ctx.SwapperContext())
+}
+
+// swapinHeatMap swaps in the pages of the heat map, which are split among
+// the contexts
+func (w *warmup) swapinHeatMap(pages []PageHeat, ctxs []*wCtx) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(ctxs))
+	for i := range ctxs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx := ctxs[i]
+			for j := i; j < len(pages); j += len(ctxs) {
+				key := skiplist.MinItem
+				if low := pages[j].LowKey; len(low) > 0 {
+					key = unsafe.Pointer(&low[0])
+				}
+
+				var pid PageId
+				if prev, curr, found := w.Skiplist.Lookup(key, w.cmp, ctx.buf, ctx.slSts); found {
+					pid = curr
+				} else {
+					pid = prev
+				}
+
+				swapped, err := w.swapin(pid, ctx)
+				if err != nil {
+					if err != errWarmupDone {
+						errs[i] = err
+					}
+					return
+				} else if swapped {
+					*pageEvictState(pid) = int64(pages[j].Temperature) & (evictRef | evictHot)
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// swapin swaps in the page if it is evicted and reports whether it did.
+// Returns errWarmupDone once enough pages are in memory.
+func (w *warmup) swapin(pid PageId, ctx *wCtx) (bool, error) {
+	if w.done(ctx) {
+		return false, errWarmupDone
+	}
+
+	tok := ctx.BeginTx()
+	defer ctx.EndTx(tok)
+
+	pg, err := w.ReadPage(pid, nil, false, ctx)
+	if err != nil {
+		return false, err
+	}
+
+	if pgi := pg.(*page); pgi.head == nil || !pgi.head.state.IsEvicted() {
+		return false, nil
+	}
+
+	if err := w.swapinPage(pid, pg, ctx); err == errSwapinConflict {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	atomic.AddInt64(&w.swapped, 1)
+	return true, nil
+}
+
+// countResidentPages returns the number of pages and the number of pages
+// which are not evicted
+func (s *Plasma) countResidentPages(ctx *wCtx) (total, resident int64) {
+	callb := func(pid PageId, partn RangePartition) error {
+		tok := ctx.BeginTx()
+		defer ctx.EndTx(tok)
+
+		pg, _ := s.ReadPage(pid, nil, false, ctx)
+		if pgi := pg.(*page); pgi.head == nil || !pgi.head.state.IsEvicted() {
+			resident++
+		}
+		total++
+		return nil
+	}
+
+	s.PageVisitor(callb, 1)
+	return
+}
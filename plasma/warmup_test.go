@@ -0,0 +1,84 @@
+package plasma
+
+import (
+	"github.com/couchbase/nitro/skiplist"
+	"os"
+	"testing"
+)
+
+func TestPlasmaWarmup(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	cfg := testCfg
+	cfg.AutoSwapper = false
+	cfg.RecordHeatMap = true
+	cfg.LazyRecovery = true
+	s := newTestIntPlasmaStore(cfg)
+
+	w := s.NewWriter()
+	n := 100000
+	for i := 0; i < n; i++ {
+		w.Insert(skiplist.NewIntKeyItem(i))
+	}
+	s.PersistAll()
+	s.EvictAll(0)
+
+	// Swap in the pages of a key range
+	var hot []PageId
+	for pid := s.StartPageId(); pid != s.EndPageId(); pid = NextPid(pid) {
+		pg, _ := s.ReadPage(pid, nil, false, w.wCtx)
+		if low := pg.MinItem(); low != skiplist.MinItem &&
+			skiplist.IntFromItem(low) >= 50000 && skiplist.IntFromItem(low) < 60000 {
+			if err := s.swapinPage(pid, pg, w.wCtx); err != nil {
+				t.Fatal(err)
+			}
+			hot = append(hot, pid)
+		}
+	}
+
+	total, resident := s.countResidentPages(w.wCtx)
+	if resident != int64(len(hot)) || total < 100 {
+		t.Fatalf("expected %d of %d pages in memory, got %d", len(hot), total, resident)
+	}
+	s.Close()
+
+	s = newTestIntPlasmaStore(cfg)
+	defer s.Close()
+
+	w = s.NewWriter()
+	if _, resident := s.countResidentPages(w.wCtx); resident != 0 {
+		t.Fatalf("expected no pages in memory after recovery, got %d", resident)
+	}
+
+	if err := s.Warmup(float64(len(hot))/float64(total), 4); err != nil {
+		t.Fatal(err)
+	}
+
+	for pid := s.StartPageId(); pid != s.EndPageId(); pid = NextPid(pid) {
+		pg, _ := s.ReadPage(pid, nil, false, w.wCtx)
+		low := pg.MinItem()
+		isHot := low != skiplist.MinItem && skiplist.IntFromItem(low) >= 50000 &&
+			skiplist.IntFromItem(low) < 60000
+		if evicted := pg.(*page).head.state.IsEvicted(); evicted == isHot {
+			t.Fatalf("expected only the hot pages in memory, page %d evicted: %v", skiplist.IntFromItem(low), evicted)
+		}
+	}
+
+	if err := s.Warmup(1, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	if total, resident := s.countResidentPages(w.wCtx); resident != total {
+		t.Errorf("expected all %d pages in memory, got %d", total, resident)
+	}
+
+	count := 0
+	itr := s.NewIterator()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		count++
+	}
+	itr.(*Iterator).Close()
+
+	if count != n {
+		t.Errorf("expected %d items, got %d", n, count)
+	}
+}
@@ -0,0 +1,55 @@
+package plasma
+
+// WriterPool hands out at most a fixed number of writers to goroutines which
+// only need one for a few operations, so that the buffers and stats of the
+// writers are reused and the number of writer contexts remains bounded
+// irrespective of the number of goroutines.
+type WriterPool struct {
+	s *Plasma
+
+	// Writers which have not been acquired, nil until one is first needed
+	free chan *Writer
+}
+
+// WriterPool returns a pool of up to n writers
+func (s *Plasma) WriterPool(n int) *WriterPool {
+	if n <= 0 {
+		n = 1
+	}
+
+	p := &WriterPool{
+		s:    s,
+		free: make(chan *Writer, n),
+	}
+
+	for i := 0; i < n; i++ {
+		p.free <- nil
+	}
+
+	return p
+}
+
+// Acquire checks out a writer of the pool, waiting for one to be released
+// if all of them are in use. The writer must be handed back using Release.
+func (p *WriterPool) Acquire() *Writer {
+	w := <-p.free
+	if w == nil {
+		w = p.s.NewWriter()
+	}
+
+	return w
+}
+
+// Release checks in a writer obtained using Acquire
+func (p *WriterPool) Release(w *Writer) {
+	p.free <- w
+}
+
+// Close waits for the writers of the pool to be released and closes them
+func (p *WriterPool) Close() {
+	for i := 0; i < cap(p.free); i++ {
+		if w := <-p.free; w != nil {
+			w.Close()
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package plasma
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestWriterPool(t *testing.T) {
+	os.RemoveAll("teststore.data")
+	s := newTestIntPlasmaStore(testSnCfg)
+	defer s.Close()
+
+	numCtxs := func() int {
+		var n int
+		for w := s.wCtxList; w != nil; w = w.next {
+			n++
+		}
+		return n
+	}
+
+	base := numCtxs()
+	p := s.WriterPool(4)
+
+	var wg sync.WaitGroup
+	n := 10000
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for j := id; j < n; j += 64 {
+				w := p.Acquire()
+				w.InsertKV([]byte(fmt.Sprintf("key-%10d", j)), []byte("val"))
+				p.Release(w)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if c := numCtxs() - base; c > 4 || c == 0 {
+		t.Errorf("expected up to 4 writer contexts, got %d", c)
+	}
+
+	w := p.Acquire()
+	for i := 0; i < n; i++ {
+		if _, err := w.LookupKV([]byte(fmt.Sprintf("key-%10d", i))); err != nil {
+			t.Fatalf("key %d: %v", i, err)
+		}
+	}
+	p.Release(w)
+
+	p.Close()
+	if c := numCtxs(); c != base {
+		t.Errorf("expected %d contexts after close, got %d", base, c)
+	}
+
+	snap := s.NewSnapshot()
+	snap.Close()
+	if c := s.ItemsCount(); c != int64(n) {
+		t.Errorf("expected %d items, got %d", n, c)
+	}
+}